@@ -39,6 +39,14 @@ func init() {
 		log.Fatal().Err(err).Msg("")
 	}
 	apiKeysCmd.AddCommand(deleteAPIKeyCmd)
+
+	renewAPIKeyCmd.Flags().StringP("prefix", "p", "", "ApiKey prefix")
+	if err := renewAPIKeyCmd.MarkFlagRequired("prefix"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	renewAPIKeyCmd.Flags().
+		StringP("expiration", "e", DefaultAPIKeyExpiry, "Human-readable expiration of the key from now (e.g. 30m, 24h)")
+	apiKeysCmd.AddCommand(renewAPIKeyCmd)
 }
 
 var apiKeysCmd = &cobra.Command{
@@ -245,3 +253,60 @@ var deleteAPIKeyCmd = &cobra.Command{
 		SuccessOutput(response, "Key deleted", output)
 	},
 }
+
+var renewAPIKeyCmd = &cobra.Command{
+	Use:   "renew",
+	Short: "Extend the expiration of an ApiKey",
+	Long: `
+Sets a new expiration to an ApiKey which has not expired, the key
+keeps working with the same secret.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		prefix, err := cmd.Flags().GetString("prefix")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error getting prefix from CLI flag: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		durationStr, _ := cmd.Flags().GetString("expiration")
+
+		duration, err := model.ParseDuration(durationStr)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Could not parse duration: %s\n", err),
+				output,
+			)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		request := &v1.RenewApiKeyRequest{
+			Prefix:     prefix,
+			Expiration: timestamppb.New(time.Now().UTC().Add(time.Duration(duration))),
+		}
+
+		response, err := client.RenewApiKey(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot renew Api Key: %s\n", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetApiKey(), "Key renewed", output)
+	},
+}
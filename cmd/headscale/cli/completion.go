@@ -0,0 +1,172 @@
+package cli
+
+import (
+	"strconv"
+	"strings"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// registerFlagCompletions sets up dynamic shell completion for the flags
+// and arguments referring to resources living in headscale. It must be
+// called once all the commands and their flags have been defined.
+func registerFlagCompletions() {
+	for _, cmd := range []*cobra.Command{
+		listNodesCmd,
+		registerNodeCmd,
+		moveNodeCmd,
+		createNodeCmd,
+		preauthkeysCmd,
+		listRoutesCmd,
+		listNodeGroupsCmd,
+		generateRegisterURLCmd,
+		qrNodeCmd,
+	} {
+		for _, flag := range []string{"user", "namespace"} {
+			if cmd.Flag(flag) == nil {
+				continue
+			}
+			if err := cmd.RegisterFlagCompletionFunc(flag, completeUsers); err != nil {
+				log.Fatal().Err(err).Msg("")
+			}
+		}
+	}
+
+	for _, cmd := range []*cobra.Command{
+		showNodeCmd,
+		expireNodeCmd,
+		renameNodeCmd,
+		setNodeIPCmd,
+		deleteNodeCmd,
+		moveNodeCmd,
+		tagCmd,
+		lockNodeCmd,
+		unlockNodeCmd,
+		setNodeMetadataCmd,
+		getNodeMetadataCmd,
+		listRoutesCmd,
+		allowRoutesCmd,
+		addNodeToGroupCmd,
+		removeNodeFromGroupCmd,
+	} {
+		if err := cmd.RegisterFlagCompletionFunc("identifier", completeNodeIDs); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	}
+
+	// Keys of nodes waiting for registration are not exposed by the API,
+	// so they cannot be completed.
+	for _, cmd := range []*cobra.Command{registerNodeCmd, createNodeCmd} {
+		if err := cmd.RegisterFlagCompletionFunc("key", cobra.NoFileCompletions); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	}
+
+	expirePreAuthKeyCmd.ValidArgsFunction = completePreAuthKeys
+	destroyUserCmd.ValidArgsFunction = completeUserArg
+	renameUserCmd.ValidArgsFunction = completeUserArg
+	setUserTagsCmd.ValidArgsFunction = completeUserArg
+}
+
+// completeUserArg completes the user name given as first argument.
+func completeUserArg(
+	cmd *cobra.Command,
+	args []string,
+	toComplete string,
+) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	return completeUsers(cmd, args, toComplete)
+}
+
+func completeUsers(
+	cmd *cobra.Command,
+	args []string,
+	toComplete string,
+) ([]string, cobra.ShellCompDirective) {
+	ctx, client, conn, cancel, err := newHeadscaleCLIClient()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	defer cancel()
+	defer conn.Close()
+
+	response, err := client.ListUsers(ctx, &v1.ListUsersRequest{})
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	var completions []string
+	for _, user := range response.GetUsers() {
+		if strings.HasPrefix(user.GetName(), toComplete) {
+			completions = append(completions, user.GetName())
+		}
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+func completeNodeIDs(
+	cmd *cobra.Command,
+	args []string,
+	toComplete string,
+) ([]string, cobra.ShellCompDirective) {
+	ctx, client, conn, cancel, err := newHeadscaleCLIClient()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	defer cancel()
+	defer conn.Close()
+
+	response, err := client.ListNodes(ctx, &v1.ListNodesRequest{})
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	var completions []string
+	for _, node := range response.GetNodes() {
+		id := strconv.FormatUint(node.GetId(), util.Base10)
+		if strings.HasPrefix(id, toComplete) {
+			completions = append(completions, id+"\t"+node.GetGivenName())
+		}
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+func completePreAuthKeys(
+	cmd *cobra.Command,
+	args []string,
+	toComplete string,
+) ([]string, cobra.ShellCompDirective) {
+	user, _ := cmd.Flags().GetString("user")
+	if user == "" || len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	ctx, client, conn, cancel, err := newHeadscaleCLIClient()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	defer cancel()
+	defer conn.Close()
+
+	response, err := client.ListPreAuthKeys(ctx, &v1.ListPreAuthKeysRequest{User: user})
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	var completions []string
+	for _, key := range response.GetPreAuthKeys() {
+		if strings.HasPrefix(key.GetKeyPrefix(), toComplete) {
+			completions = append(completions, key.GetKeyPrefix())
+		}
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
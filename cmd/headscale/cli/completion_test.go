@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/spf13/cobra"
+)
+
+func TestBashCompletionIsValid(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+
+	registerFlagCompletions()
+
+	var script bytes.Buffer
+	if err := rootCmd.GenBashCompletionV2(&script, true); err != nil {
+		t.Fatalf("generating bash completion: %s", err)
+	}
+
+	if script.Len() == 0 {
+		t.Fatal("generated bash completion is empty")
+	}
+
+	check := exec.Command(bash, "-n")
+	check.Stdin = &script
+	if output, err := check.CombinedOutput(); err != nil {
+		t.Fatalf("bash completion is not valid: %s\n%s", err, output)
+	}
+}
+
+func TestCompletionWithoutServer(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := []byte(`---
+server_url: http://127.0.0.1:8080
+noise:
+  private_key_path: noise_private.key
+unix_socket: ` + filepath.Join(tmpDir, "headscale.sock") + `
+cli:
+  timeout: 100ms
+`)
+	if err := os.WriteFile(filepath.Join(tmpDir, "config.yaml"), config, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := types.LoadConfig(tmpDir, false); err != nil {
+		t.Fatalf("loading config: %s", err)
+	}
+
+	// Without a server to ask, the completions fail instead of exiting.
+	for name, complete := range map[string]func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective){
+		"users": completeUsers,
+		"nodes": completeNodeIDs,
+	} {
+		completions, directive := complete(rootCmd, nil, "")
+		if len(completions) != 0 || directive != cobra.ShellCompDirectiveError {
+			t.Errorf("%s completion = %v, %v, want an error", name, completions, directive)
+		}
+	}
+}
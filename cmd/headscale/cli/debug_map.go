@@ -0,0 +1,199 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	debugMapNodeCmd.Flags().
+		Uint64("diff", 0, "Show the differences with the map response of this other node")
+	nodeCmd.AddCommand(debugMapNodeCmd)
+}
+
+var debugMapNodeCmd = &cobra.Command{
+	Use:   "debug-map NODE_ID",
+	Short: "Print the map response a node would receive, without sending it",
+	Long: `Print the map response a node would receive, without sending it.
+
+With --diff, only the lines of the map responses that differ between the two
+nodes are printed, prefixed with - for the first node and + for the other.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		other, _ := cmd.Flags().GetUint64("diff")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.DebugNodeMap(ctx, &v1.DebugNodeMapRequest{NodeId: identifier})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get map response: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		if other == 0 {
+			var indented bytes.Buffer
+			err = json.Indent(&indented, []byte(response.GetMapResponse()), "", "\t")
+			if err != nil {
+				ErrorOutput(err, fmt.Sprintf("Cannot format map response: %s", err), output)
+
+				return
+			}
+
+			//nolint
+			fmt.Println(indented.String())
+
+			return
+		}
+
+		otherResponse, err := client.DebugNodeMap(ctx, &v1.DebugNodeMapRequest{NodeId: other})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get map response of node %d: %s", other, status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		removed, added, err := diffMapResponses(
+			[]byte(response.GetMapResponse()),
+			[]byte(otherResponse.GetMapResponse()),
+		)
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Cannot compare map responses: %s", err), output)
+
+			return
+		}
+
+		//nolint
+		fmt.Printf("--- node %d\n+++ node %d\n", identifier, other)
+		for _, line := range removed {
+			//nolint
+			fmt.Printf("- %s\n", line)
+		}
+		for _, line := range added {
+			//nolint
+			fmt.Printf("+ %s\n", line)
+		}
+	},
+}
+
+// diffMapResponses returns the symmetric difference of two JSON encoded
+// map responses: the flattened lines only present in a, and the ones
+// only present in b.
+func diffMapResponses(a, b []byte) ([]string, []string, error) {
+	aLines, err := flattenMapResponse(a)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bLines, err := flattenMapResponse(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return setDifference(aLines, bLines), setDifference(bLines, aLines), nil
+}
+
+// flattenMapResponse flattens a JSON encoded map response into a set of
+// "path: value" lines. Objects in lists are identified by their Name or
+// ID instead of their position, so that a peer missing in one map does
+// not shift all the others. The ControlTime, which changes every time,
+// is left out.
+func flattenMapResponse(data []byte) (map[string]bool, error) {
+	var resp map[string]any
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	delete(resp, "ControlTime")
+
+	lines := make(map[string]bool)
+	flattenJSON("", resp, lines)
+
+	return lines, nil
+}
+
+func flattenJSON(path string, value any, lines map[string]bool) {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, v := range value {
+			flattenJSON(path+"."+key, v, lines)
+		}
+	case []any:
+		for index, v := range value {
+			flattenJSON(fmt.Sprintf("%s[%s]", path, listKey(index, v)), v, lines)
+		}
+	default:
+		encoded, _ := json.Marshal(value)
+		lines[fmt.Sprintf("%s: %s", path, encoded)] = true
+	}
+}
+
+// listKey identifies an element of a list, by its Name or ID if it is
+// an object, by its value if it is a scalar, and by its index
+// otherwise.
+func listKey(index int, value any) string {
+	switch value := value.(type) {
+	case map[string]any:
+		for _, field := range []string{"Name", "ID"} {
+			if id, ok := value[field]; ok {
+				encoded, _ := json.Marshal(id)
+
+				return string(encoded)
+			}
+		}
+	case []any:
+	default:
+		encoded, _ := json.Marshal(value)
+
+		return string(encoded)
+	}
+
+	return strconv.Itoa(index)
+}
+
+func setDifference(a, b map[string]bool) []string {
+	var diff []string
+	for line := range a {
+		if !b[line] {
+			diff = append(diff, line)
+		}
+	}
+	sort.Strings(diff)
+
+	return diff
+}
@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiffMapResponses(t *testing.T) {
+	a := []byte(`{
+		"ControlTime": "2024-01-01T00:00:00Z",
+		"Domain": "example.com",
+		"Peers": [
+			{"ID": 2, "Name": "web.example.com.", "AllowedIPs": ["100.64.0.2/32"]},
+			{"ID": 3, "Name": "db.example.com.", "AllowedIPs": ["100.64.0.3/32"]}
+		]
+	}`)
+	b := []byte(`{
+		"ControlTime": "2024-01-01T00:00:01Z",
+		"Domain": "example.com",
+		"Peers": [
+			{"ID": 3, "Name": "db.example.com.", "AllowedIPs": ["100.64.0.3/32", "10.0.0.0/8"]}
+		]
+	}`)
+
+	removed, added, err := diffMapResponses(a, b)
+	if err != nil {
+		t.Fatalf("diffMapResponses() unexpected error: %s", err)
+	}
+
+	wantRemoved := []string{
+		`.Peers["web.example.com."].AllowedIPs["100.64.0.2/32"]: "100.64.0.2/32"`,
+		`.Peers["web.example.com."].ID: 2`,
+		`.Peers["web.example.com."].Name: "web.example.com."`,
+	}
+	if !slices.Equal(removed, wantRemoved) {
+		t.Errorf("removed = %q, want %q", removed, wantRemoved)
+	}
+
+	wantAdded := []string{
+		`.Peers["db.example.com."].AllowedIPs["10.0.0.0/8"]: "10.0.0.0/8"`,
+	}
+	if !slices.Equal(added, wantAdded) {
+		t.Errorf("added = %q, want %q", added, wantAdded)
+	}
+}
@@ -0,0 +1,152 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/derp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// derpValidateTimeout is how long the DERP servers have to accept a
+// connection in derp validate.
+const derpValidateTimeout = 10 * time.Second
+
+func init() {
+	rootCmd.AddCommand(derpCmd)
+	derpCmd.AddCommand(reloadDERPCmd)
+
+	validateDERPCmd.Flags().StringSliceP("path", "p", nil, "DERP map file to validate instead of derp.paths and derp.urls")
+	derpCmd.AddCommand(validateDERPCmd)
+}
+
+var derpCmd = &cobra.Command{
+	Use:   "derp",
+	Short: "Manage the DERP map served to the nodes",
+}
+
+var reloadDERPCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload the DERP map from the configured paths and URLs",
+	Long: `Reload the DERP map from derp.paths and derp.urls and push it to all
+connected nodes. This replaces any map set with PUT /api/v1/derp/regions.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.ReloadDERPMap(ctx, &v1.ReloadDERPMapRequest{})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error reloading the DERP map: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetRegions(), "", output)
+
+			return
+		}
+
+		tableData := pterm.TableData{
+			{"ID", "Code", "Name", "Nodes"},
+		}
+		for _, region := range response.GetRegions() {
+			tableData = append(tableData, []string{
+				strconv.Itoa(int(region.GetRegionId())),
+				region.GetRegionCode(),
+				region.GetRegionName(),
+				strconv.Itoa(int(region.GetNodes())),
+			})
+		}
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
+
+var validateDERPCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the DERP map of the configured paths and URLs",
+	Long: `Load the DERP map from derp.paths and derp.urls, or from the files given
+with --path, check it and open a TCP connection to every DERP server in it.
+This is the check run when a file of derp.paths changes, it does not need a
+running headscale.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		cfg := types.GetDERPConfig()
+		if paths, _ := cmd.Flags().GetStringSlice("path"); len(paths) > 0 {
+			cfg.Paths = paths
+			cfg.URLs = nil
+		}
+
+		derpMap, err := derp.LoadDERPMap(cfg)
+		if err == nil {
+			err = derp.ValidateDERPMap(derpMap)
+		}
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), derpValidateTimeout)
+			err = derp.CheckDERPMapReachable(ctx, derpMap)
+			cancel()
+		}
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Invalid DERP map: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(derpMap, "", output)
+
+			return
+		}
+
+		tableData := pterm.TableData{
+			{"ID", "Code", "Name", "Nodes"},
+		}
+		for _, id := range derpMap.RegionIDs() {
+			region := derpMap.Regions[id]
+			tableData = append(tableData, []string{
+				strconv.Itoa(region.RegionID),
+				region.RegionCode,
+				region.RegionName,
+				strconv.Itoa(len(region.Nodes)),
+			})
+		}
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(nil, "DERP map is valid", output)
+	},
+}
@@ -0,0 +1,175 @@
+package cli
+
+import (
+	"fmt"
+
+	survey "github.com/AlecAivazis/survey/v2"
+	"github.com/juanfont/headscale/hscontrol"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+
+	keysCmd.AddCommand(showKeysCmd)
+
+	for _, cmd := range []*cobra.Command{rotateKeysCmd, rotateServerKeyCmd} {
+		cmd.Flags().
+			Bool("no-previous", false, "Stop accepting the old key, disconnecting all clients until they fetch the new one")
+	}
+	keysCmd.AddCommand(rotateKeysCmd)
+
+	rootCmd.AddCommand(rotateServerKeyCmd)
+}
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage the Noise private key of the headscale server",
+	Long: `Manage the Noise private key of the headscale server, stored in
+noise.private_key_path. The commands read and write the key file directly,
+run them on the headscale server.`,
+	Aliases: []string{"key"},
+}
+
+var showKeysCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the public key of the server",
+	Long: `Print the public key of the server, which clients get from /key, to
+verify it out of band.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		cfg, err := types.GetHeadscaleConfig()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to load configuration: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		current, previous, err := hscontrol.ServerPublicKeys(cfg.NoisePrivateKeyPath)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot read server key: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		keys := map[string]string{
+			"public_key": current.String(),
+		}
+		message := current.String()
+		if previous != nil {
+			keys["previous_public_key"] = previous.String()
+			message += fmt.Sprintf(
+				"\nThe previous key %s is still accepted.",
+				previous.String(),
+			)
+		}
+
+		SuccessOutput(keys, message, output)
+	},
+}
+
+var rotateKeysCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Rotate the Noise private key of the headscale server",
+	Long: `Generate a new Noise private key and write it to noise.private_key_path.
+
+The old key is kept in a timestamped backup, and next to the new key with a
+".previous" suffix. After restarting, headscale keeps accepting clients that
+still use the old key, and they pick up the new one the next time they fetch
+it. Remove the ".previous" file once all clients have reconnected.
+
+If the old key has been compromised, use --no-previous to stop accepting it
+right away. All the clients are disconnected after the restart, until they
+fetch the new key, which may require restarting tailscaled.`,
+	Run: rotateServerKey,
+}
+
+var rotateServerKeyCmd = &cobra.Command{
+	Use:        "rotate-server-key",
+	Short:      rotateKeysCmd.Short,
+	Long:       rotateKeysCmd.Long,
+	Deprecated: `use "headscale keys rotate" instead`,
+	Run:        rotateServerKey,
+}
+
+func rotateServerKey(cmd *cobra.Command, args []string) {
+	output, _ := cmd.Flags().GetString("output")
+	noPrevious, _ := cmd.Flags().GetBool("no-previous")
+
+	cfg, err := types.GetHeadscaleConfig()
+	if err != nil {
+		ErrorOutput(
+			err,
+			fmt.Sprintf("Failed to load configuration: %s", err),
+			output,
+		)
+
+		return
+	}
+
+	if noPrevious {
+		confirm := false
+		force, _ := cmd.Flags().GetBool("force")
+		if !force {
+			prompt := &survey.Confirm{
+				Message: "All the clients will be disconnected after the restart until they fetch the new key, do you want to rotate the server key?",
+			}
+			err := survey.AskOne(prompt, &confirm)
+			if err != nil {
+				return
+			}
+		}
+
+		if !confirm && !force {
+			SuccessOutput(map[string]string{"Result": "Server key not rotated"}, "Server key not rotated", output)
+
+			return
+		}
+	}
+
+	backupPath, err := hscontrol.RotatePrivateKey(cfg.NoisePrivateKeyPath, !noPrevious)
+	if err != nil {
+		ErrorOutput(
+			err,
+			fmt.Sprintf("Cannot rotate server key: %s", err),
+			output,
+		)
+
+		return
+	}
+
+	current, _, err := hscontrol.ServerPublicKeys(cfg.NoisePrivateKeyPath)
+	if err != nil {
+		ErrorOutput(
+			err,
+			fmt.Sprintf("Cannot read server key: %s", err),
+			output,
+		)
+
+		return
+	}
+
+	SuccessOutput(
+		map[string]string{
+			"private_key_path": cfg.NoisePrivateKeyPath,
+			"backup_path":      backupPath,
+			"public_key":       current.String(),
+		},
+		fmt.Sprintf(
+			"Server key rotated, old key backed up to %s. Restart headscale to use the new key %s.",
+			backupPath,
+			current.String(),
+		),
+		output,
+	)
+}
@@ -0,0 +1,213 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/pterm/pterm"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	rootCmd.AddCommand(nodeGroupsCmd)
+
+	listNodeGroupsCmd.Flags().StringP("group", "g", "", "Filter by group")
+	listNodeGroupsCmd.Flags().StringP("user", "u", "", "Filter by user")
+	nodeGroupsCmd.AddCommand(listNodeGroupsCmd)
+
+	addNodeToGroupCmd.Flags().StringP("group", "g", "", "Group")
+	if err := addNodeToGroupCmd.MarkFlagRequired("group"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	addNodeToGroupCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	if err := addNodeToGroupCmd.MarkFlagRequired("identifier"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	nodeGroupsCmd.AddCommand(addNodeToGroupCmd)
+
+	removeNodeFromGroupCmd.Flags().StringP("group", "g", "", "Group")
+	if err := removeNodeFromGroupCmd.MarkFlagRequired("group"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	removeNodeFromGroupCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	if err := removeNodeFromGroupCmd.MarkFlagRequired("identifier"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	nodeGroupsCmd.AddCommand(removeNodeFromGroupCmd)
+
+	nodeGroupsCmd.AddCommand(renameNodeGroupCmd)
+}
+
+var nodeGroupsCmd = &cobra.Command{
+	Use:   "nodegroups",
+	Short: "Manage the nodes of the groups of the ACL policy",
+	Long: `Manage the nodes of the groups of the ACL policy, in addition to the users
+of the groups section of the policy file. A group can be referenced as
+group:<name> in the policy even if it is not in the policy file.`,
+	Aliases: []string{"nodegroup", "ng"},
+}
+
+var listNodeGroupsCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List the nodes of the groups",
+	Aliases: []string{"ls", "show"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		group, _ := cmd.Flags().GetString("group")
+		user, _ := cmd.Flags().GetString("user")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.ListNodeGroups(ctx, &v1.ListNodeGroupsRequest{
+			Group: group,
+			User:  user,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot list node groups: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetNodeGroups(), "", output)
+
+			return
+		}
+
+		tableData := pterm.TableData{
+			{"Group", "Node ID", "Node", "User", "Added"},
+		}
+		for _, nodeGroup := range response.GetNodeGroups() {
+			tableData = append(tableData, []string{
+				"group:" + nodeGroup.GetName(),
+				strconv.FormatUint(nodeGroup.GetNodeId(), util.Base10),
+				nodeGroup.GetNodeName(),
+				nodeGroup.GetUser().GetName(),
+				nodeGroup.GetCreatedAt().AsTime().Format(HeadscaleDateTimeFormat),
+			})
+		}
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
+
+var addNodeToGroupCmd = &cobra.Command{
+	Use:     "add",
+	Short:   "Add a node to a group",
+	Aliases: []string{"a"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		group, _ := cmd.Flags().GetString("group")
+		identifier, _ := cmd.Flags().GetUint64("identifier")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		force, _ := cmd.Flags().GetBool("force")
+		response, err := client.AddNodeToGroup(ctx, &v1.AddNodeToGroupRequest{
+			Group:  group,
+			NodeId: identifier,
+			Force:  force,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot add node to group: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetNodeGroup(), "Node added to group", output)
+	},
+}
+
+var renameNodeGroupCmd = &cobra.Command{
+	Use:     "rename OLD_NAME NEW_NAME",
+	Short:   "Rename a group",
+	Aliases: []string{"mv"},
+	Args: func(cmd *cobra.Command, args []string) error {
+		expectedArguments := 2
+		if len(args) < expectedArguments {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.RenameNodeGroup(ctx, &v1.RenameNodeGroupRequest{
+			OldName: args[0],
+			NewName: args[1],
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot rename node group: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetNodeGroups(), "Node group renamed", output)
+	},
+}
+
+var removeNodeFromGroupCmd = &cobra.Command{
+	Use:     "remove",
+	Short:   "Remove a node from a group",
+	Aliases: []string{"rm", "delete"},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		group, _ := cmd.Flags().GetString("group")
+		identifier, _ := cmd.Flags().GetUint64("identifier")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		force, _ := cmd.Flags().GetBool("force")
+		response, err := client.RemoveNodeFromGroup(ctx, &v1.RemoveNodeFromGroupRequest{
+			Group:  group,
+			NodeId: identifier,
+			Force:  force,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot remove node from group: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response, "Node removed from group", output)
+	},
+}
@@ -1,9 +1,12 @@
 package cli
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"log"
 	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -11,16 +14,27 @@ import (
 	survey "github.com/AlecAivazis/survey/v2"
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/prometheus/common/model"
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"tailscale.com/types/key"
 )
 
+var errInvalidMetadata = errors.New("invalid metadata")
+
 func init() {
 	rootCmd.AddCommand(nodeCmd)
 	listNodesCmd.Flags().StringP("user", "u", "", "Filter by user")
+	listNodesCmd.Flags().
+		BoolP("all-users", "A", false, "List the nodes of all the users, ordered by user")
+	listNodesCmd.MarkFlagsMutuallyExclusive("user", "all-users")
 	listNodesCmd.Flags().BoolP("tags", "t", false, "Show tags")
+	listNodesCmd.Flags().
+		String("last-seen-before", "", "Only list the nodes not seen for this long (e.g. 72h, 30d)")
+	listNodesCmd.Flags().
+		String("metadata", "", "Only list the nodes with this metadata, key=value or key")
 
 	listNodesCmd.Flags().StringP("namespace", "n", "", "User")
 	listNodesNamespaceFlag := listNodesCmd.Flags().Lookup("namespace")
@@ -45,8 +59,16 @@ func init() {
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
+	registerNodeCmd.Flags().String("ip", "", "Specific IP address to assign to the node")
 	nodeCmd.AddCommand(registerNodeCmd)
 
+	showNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = showNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	nodeCmd.AddCommand(showNodeCmd)
+
 	expireNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
 	err = expireNodeCmd.MarkFlagRequired("identifier")
 	if err != nil {
@@ -61,6 +83,18 @@ func init() {
 	}
 	nodeCmd.AddCommand(renameNodeCmd)
 
+	setNodeIPCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = setNodeIPCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	setNodeIPCmd.Flags().String("ip", "", "New IPv4 or IPv6 address of the node")
+	err = setNodeIPCmd.MarkFlagRequired("ip")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	nodeCmd.AddCommand(setNodeIPCmd)
+
 	deleteNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
 	err = deleteNodeCmd.MarkFlagRequired("identifier")
 	if err != nil {
@@ -99,6 +133,39 @@ func init() {
 	nodeCmd.AddCommand(tagCmd)
 
 	nodeCmd.AddCommand(backfillNodeIPsCmd)
+
+	lockNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = lockNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	nodeCmd.AddCommand(lockNodeCmd)
+
+	unlockNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = unlockNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	nodeCmd.AddCommand(unlockNodeCmd)
+
+	setNodeMetadataCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = setNodeMetadataCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	nodeCmd.AddCommand(setNodeMetadataCmd)
+
+	getNodeMetadataCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = getNodeMetadataCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	nodeCmd.AddCommand(getNodeMetadataCmd)
+
+	gcNodesCmd.Flags().Bool("dry-run", false, "Only list the nodes that would be deleted")
+	gcNodesCmd.Flags().
+		String("stale-node-expiry", "", "Delete the nodes not seen for longer than this, for example 90d (default gc.stale_node_expiry)")
+	nodeCmd.AddCommand(gcNodesCmd)
 }
 
 var nodeCmd = &cobra.Command{
@@ -134,9 +201,12 @@ var registerNodeCmd = &cobra.Command{
 			return
 		}
 
+		ip, _ := cmd.Flags().GetString("ip")
+
 		request := &v1.RegisterNodeRequest{
 			Key:  machineKey,
 			User: user,
+			Ip:   ip,
 		}
 
 		response, err := client.RegisterNode(ctx, request)
@@ -162,7 +232,7 @@ var registerNodeCmd = &cobra.Command{
 var listNodesCmd = &cobra.Command{
 	Use:     "list",
 	Short:   "List nodes",
-	Aliases: []string{"ls", "show"},
+	Aliases: []string{"ls"},
 	Run: func(cmd *cobra.Command, args []string) {
 		output, _ := cmd.Flags().GetString("output")
 		user, err := cmd.Flags().GetString("user")
@@ -186,6 +256,25 @@ var listNodesCmd = &cobra.Command{
 			User: user,
 		}
 
+		if lastSeenBefore, _ := cmd.Flags().GetString("last-seen-before"); lastSeenBefore != "" {
+			duration, err := model.ParseDuration(lastSeenBefore)
+			if err != nil {
+				ErrorOutput(
+					err,
+					fmt.Sprintf("Could not parse duration: %s\n", err),
+					output,
+				)
+
+				return
+			}
+
+			request.LastSeenBefore = timestamppb.New(time.Now().Add(-time.Duration(duration)))
+		}
+
+		if metadata, _ := cmd.Flags().GetString("metadata"); metadata != "" {
+			request.MetadataKey, request.MetadataValue, _ = strings.Cut(metadata, "=")
+		}
+
 		response, err := client.ListNodes(ctx, request)
 		if err != nil {
 			ErrorOutput(
@@ -197,13 +286,23 @@ var listNodesCmd = &cobra.Command{
 			return
 		}
 
+		nodes := response.GetNodes()
+		if allUsers, _ := cmd.Flags().GetBool("all-users"); allUsers {
+			slices.SortStableFunc(nodes, func(a, b *v1.Node) int {
+				return cmp.Or(
+					cmp.Compare(a.GetUser().GetName(), b.GetUser().GetName()),
+					cmp.Compare(a.GetId(), b.GetId()),
+				)
+			})
+		}
+
 		if output != "" {
-			SuccessOutput(response.GetNodes(), "", output)
+			SuccessOutput(nodes, "", output)
 
 			return
 		}
 
-		tableData, err := nodesToPtables(user, showTags, response.GetNodes())
+		tableData, err := nodesToPtables(user, showTags, nodes)
 		if err != nil {
 			ErrorOutput(err, fmt.Sprintf("Error converting to table: %s", err), output)
 
@@ -223,6 +322,209 @@ var listNodesCmd = &cobra.Command{
 	},
 }
 
+// nodeDetail is the output of nodes show.
+type nodeDetail struct {
+	Node   *v1.Node    `json:"node"`
+	Routes []*v1.Route `json:"routes"`
+}
+
+var showNodeCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the details of a node",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		nodeResponse, err := client.GetNode(ctx, &v1.GetNodeRequest{NodeId: identifier})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get node: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		routesResponse, err := client.GetNodeRoutes(ctx, &v1.GetNodeRoutesRequest{NodeId: identifier})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get routes of node: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		detail := nodeDetail{
+			Node:   nodeResponse.GetNode(),
+			Routes: routesResponse.GetRoutes(),
+		}
+
+		if output != "" {
+			SuccessOutput(detail, "", output)
+
+			return
+		}
+
+		err = pterm.DefaultTable.WithData(nodeToPtable(detail, time.Now())).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
+
+var setNodeMetadataCmd = &cobra.Command{
+	Use:   "set-metadata KEY=VALUE...",
+	Short: "Set metadata of a node",
+	Long: `Set keys of the metadata of a node, attributes managed outside headscale
+like a site code or a rack. KEY= removes the key, the other keys are kept. The
+metadata of a node is at most 4 KB in JSON.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		metadata, err := parseNodeMetadata(args)
+		if err != nil {
+			ErrorOutput(err, err.Error(), output)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		force, _ := cmd.Flags().GetBool("force")
+		response, err := client.SetNodeMetadata(ctx, &v1.SetNodeMetadataRequest{
+			NodeId:   identifier,
+			Metadata: metadata,
+			Force:    force,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot set node metadata: %s\n",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetNode().GetMetadata(), "Node metadata updated", output)
+	},
+}
+
+var getNodeMetadataCmd = &cobra.Command{
+	Use:   "get-metadata",
+	Short: "Print the metadata of a node",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.GetNode(ctx, &v1.GetNodeRequest{NodeId: identifier})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get node: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		metadata := response.GetNode().GetMetadata()
+		SuccessOutput(metadata, formatNodeMetadata(metadata, "\n"), output)
+	},
+}
+
+// parseNodeMetadata parses the KEY=VALUE arguments of set-metadata.
+func parseNodeMetadata(args []string) (map[string]string, error) {
+	metadata := make(map[string]string, len(args))
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%w: %q, want KEY=VALUE", errInvalidMetadata, arg)
+		}
+
+		metadata[key] = value
+	}
+
+	return metadata, nil
+}
+
+// formatNodeMetadata formats the metadata as key=value, sorted by key and
+// separated by sep.
+func formatNodeMetadata(metadata map[string]string, sep string) string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	pairs := make([]string, len(keys))
+	for index, key := range keys {
+		pairs[index] = key + "=" + metadata[key]
+	}
+
+	return strings.Join(pairs, sep)
+}
+
 var expireNodeCmd = &cobra.Command{
 	Use:     "expire",
 	Short:   "Expire (log out) a node in your network",
@@ -246,8 +548,10 @@ var expireNodeCmd = &cobra.Command{
 		defer cancel()
 		defer conn.Close()
 
+		force, _ := cmd.Flags().GetBool("force")
 		request := &v1.ExpireNodeRequest{
 			NodeId: identifier,
+			Force:  force,
 		}
 
 		response, err := client.ExpireNode(ctx, request)
@@ -293,9 +597,11 @@ var renameNodeCmd = &cobra.Command{
 		if len(args) > 0 {
 			newName = args[0]
 		}
+		force, _ := cmd.Flags().GetBool("force")
 		request := &v1.RenameNodeRequest{
 			NodeId:  identifier,
 			NewName: newName,
+			Force:   force,
 		}
 
 		response, err := client.RenameNode(ctx, request)
@@ -316,6 +622,55 @@ var renameNodeCmd = &cobra.Command{
 	},
 }
 
+var setNodeIPCmd = &cobra.Command{
+	Use:   "set-ip",
+	Short: "Set the IP address of a node",
+	Long: `Replace the address of the node of the same family as --ip. The address must
+be within the configured prefixes and not used by another node, the previous
+address is released.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		ip, _ := cmd.Flags().GetString("ip")
+		force, _ := cmd.Flags().GetBool("force")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.SetNodeIP(ctx, &v1.SetNodeIPRequest{
+			NodeId: identifier,
+			Ip:     ip,
+			Force:  force,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot set node IP: %s\n",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetNode(), "Node IP changed", output)
+	},
+}
+
 var deleteNodeCmd = &cobra.Command{
 	Use:     "delete",
 	Short:   "Delete a node",
@@ -356,12 +711,13 @@ var deleteNodeCmd = &cobra.Command{
 			return
 		}
 
+		confirm := false
+		force, _ := cmd.Flags().GetBool("force")
 		deleteRequest := &v1.DeleteNodeRequest{
 			NodeId: identifier,
+			Force:  force,
 		}
 
-		confirm := false
-		force, _ := cmd.Flags().GetBool("force")
 		if !force {
 			prompt := &survey.Confirm{
 				Message: fmt.Sprintf(
@@ -456,9 +812,11 @@ var moveNodeCmd = &cobra.Command{
 			return
 		}
 
+		force, _ := cmd.Flags().GetBool("force")
 		moveRequest := &v1.MoveNodeRequest{
 			NodeId: identifier,
 			User:   user,
+			Force:  force,
 		}
 
 		moveResponse, err := client.MoveNode(ctx, moveRequest)
@@ -479,6 +837,87 @@ var moveNodeCmd = &cobra.Command{
 	},
 }
 
+var lockNodeCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Protect a node from changes",
+	Long: `Lock a node to protect it from accidental changes. Deleting, expiring,
+renaming, moving, tagging, changing the IP address or the routes of a locked
+node fails unless --force is given.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.LockNode(ctx, &v1.LockNodeRequest{NodeId: identifier})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot lock node: %s\n",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetNode(), "Node locked", output)
+	},
+}
+
+var unlockNodeCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Allow changes to a locked node again",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		identifier, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error converting ID to integer: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.UnlockNode(ctx, &v1.UnlockNodeRequest{NodeId: identifier})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot unlock node: %s\n",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetNode(), "Node unlocked", output)
+	},
+}
+
 var backfillNodeIPsCmd = &cobra.Command{
 	Use:   "backfillips",
 	Short: "Backfill IPs missing from nodes",
@@ -493,7 +932,9 @@ all nodes that are missing.
 
 If you remove IPv4 or IPv6 prefixes from the config,
 it can be run to remove the IPs that should no longer
-be assigned to nodes.`,
+be assigned to nodes.
+
+Locked nodes are skipped unless --force is given.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var err error
 		output, _ := cmd.Flags().GetString("output")
@@ -511,7 +952,11 @@ be assigned to nodes.`,
 			defer cancel()
 			defer conn.Close()
 
-			changes, err := client.BackfillNodeIPs(ctx, &v1.BackfillNodeIPsRequest{Confirmed: confirm})
+			force, _ := cmd.Flags().GetBool("force")
+			changes, err := client.BackfillNodeIPs(ctx, &v1.BackfillNodeIPsRequest{
+				Confirmed: confirm,
+				Force:     force,
+			})
 			if err != nil {
 				ErrorOutput(
 					err,
@@ -530,6 +975,95 @@ be assigned to nodes.`,
 	},
 }
 
+var gcNodesCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Delete the nodes that have not been seen for a long time",
+	Long: `Delete the nodes that are disconnected and have not been seen for longer than
+--stale-node-expiry, or gc.stale_node_expiry if not given, releasing their IP
+addresses. Nodes that have never been seen are kept.
+
+With --dry-run, the nodes that would be deleted are only listed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		expiry, _ := cmd.Flags().GetString("stale-node-expiry")
+
+		if !dryRun {
+			confirm := false
+			force, _ := cmd.Flags().GetBool("force")
+			if !force {
+				prompt := &survey.Confirm{
+					Message: "Do you want to delete the stale nodes?",
+				}
+				err := survey.AskOne(prompt, &confirm)
+				if err != nil {
+					return
+				}
+			}
+
+			if !confirm && !force {
+				SuccessOutput(map[string]string{"Result": "Nodes not deleted"}, "Nodes not deleted", output)
+
+				return
+			}
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.DeleteStaleNodes(ctx, &v1.DeleteStaleNodesRequest{
+			DryRun:          dryRun,
+			StaleNodeExpiry: expiry,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot delete stale nodes: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetNodes(), "", output)
+
+			return
+		}
+
+		if len(response.GetNodes()) == 0 {
+			SuccessOutput(nil, "No stale nodes", output)
+
+			return
+		}
+
+		tableData, err := nodesToPtables("", false, response.GetNodes())
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Error converting to table: %s", err), output)
+
+			return
+		}
+
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		if dryRun {
+			SuccessOutput(nil, fmt.Sprintf("%d stale nodes would be deleted", len(response.GetNodes())), output)
+		} else {
+			SuccessOutput(nil, fmt.Sprintf("%d stale nodes deleted", len(response.GetNodes())), output)
+		}
+	},
+}
+
 func nodesToPtables(
 	currentUser string,
 	showTags bool,
@@ -546,7 +1080,7 @@ func nodesToPtables(
 		"Ephemeral",
 		"Last seen",
 		"Expiration",
-		"Connected",
+		"Online",
 		"Expired",
 	}
 	if showTags {
@@ -596,12 +1130,7 @@ func nodesToPtables(
 			return nil, err
 		}
 
-		var online string
-		if node.GetOnline() {
-			online = pterm.LightGreen("online")
-		} else {
-			online = pterm.LightRed("offline")
-		}
+		online := onlineStatus(node.GetOnline(), lastSeen, time.Now())
 
 		var expired string
 		if expiry.IsZero() || expiry.After(time.Now()) {
@@ -630,12 +1159,17 @@ func nodesToPtables(
 		}
 		validTags = strings.TrimLeft(validTags, ",")
 
+		userName := node.GetUser().GetName()
+		if displayName := node.GetUser().GetDisplayName(); displayName != "" {
+			userName = fmt.Sprintf("%s (%s)", userName, displayName)
+		}
+
 		var user string
 		if currentUser == "" || (currentUser == node.GetUser().GetName()) {
-			user = pterm.LightMagenta(node.GetUser().GetName())
+			user = pterm.LightMagenta(userName)
 		} else {
 			// Shared into this user
-			user = pterm.LightYellow(node.GetUser().GetName())
+			user = pterm.LightYellow(userName)
 		}
 
 		var IPV4Address string
@@ -674,6 +1208,105 @@ func nodesToPtables(
 	return tableData, nil
 }
 
+// nodeToPtable converts the details of a node to a table of fields
+// and values.
+func nodeToPtable(detail nodeDetail, now time.Time) pterm.TableData {
+	node := detail.Node
+
+	var ipv4, ipv6 string
+	for _, addr := range node.GetIpAddresses() {
+		if netip.MustParseAddr(addr).Is4() {
+			ipv4 = addr
+		} else {
+			ipv6 = addr
+		}
+	}
+
+	var advertised, enabled []string
+	for _, route := range detail.Routes {
+		if route.GetAdvertised() {
+			advertised = append(advertised, route.GetPrefix())
+		}
+		if route.GetEnabled() {
+			enabled = append(enabled, route.GetPrefix())
+		}
+	}
+
+	var lastSeen time.Time
+	lastSeenTime := "N/A"
+	if node.GetLastSeen() != nil {
+		lastSeen = node.GetLastSeen().AsTime()
+		lastSeenTime = lastSeen.Format("2006-01-02 15:04:05")
+	}
+
+	expiryTime := "N/A"
+	if node.GetExpiry() != nil && !node.GetExpiry().AsTime().IsZero() {
+		expiryTime = node.GetExpiry().AsTime().Format("2006-01-02 15:04:05")
+	}
+
+	derpRegion := "N/A"
+	if node.GetPreferredDerp() != 0 {
+		derpRegion = strconv.Itoa(int(node.GetPreferredDerp()))
+	}
+
+	registerMethod := strings.TrimPrefix(
+		strings.ToLower(node.GetRegisterMethod().String()),
+		"register_method_",
+	)
+
+	tags := append(slices.Clone(node.GetForcedTags()), node.GetValidTags()...)
+	slices.Sort(tags)
+
+	return pterm.TableData{
+		{"ID", strconv.FormatUint(node.GetId(), util.Base10)},
+		{"User", node.GetUser().GetName()},
+		{"Hostname", node.GetName()},
+		{"Name", node.GetGivenName()},
+		{"IPv4", ipv4},
+		{"IPv6", ipv6},
+		{"Tags", strings.Join(slices.Compact(tags), ", ")},
+		{"Invalid tags", strings.Join(node.GetInvalidTags(), ", ")},
+		{"Advertised routes", strings.Join(advertised, ", ")},
+		{"Enabled routes", strings.Join(enabled, ", ")},
+		{"Expiration", expiryTime},
+		{"Last seen", lastSeenTime},
+		{"Online", onlineStatus(node.GetOnline(), lastSeen, now)},
+		{"Registered with", registerMethod},
+		{"DERP region", derpRegion},
+		{"Locked", strconv.FormatBool(node.GetLocked())},
+		{"Metadata", formatNodeMetadata(node.GetMetadata(), ", ")},
+	}
+}
+
+// onlineStatus tells if a node has an open map connection, and if not
+// for how long it has been offline, to tell nodes which have just
+// disconnected from the ones gone for a long time.
+func onlineStatus(online bool, lastSeen time.Time, now time.Time) string {
+	if online {
+		return pterm.LightGreen("online")
+	}
+
+	if lastSeen.IsZero() {
+		return pterm.LightRed("offline")
+	}
+
+	since := now.Sub(lastSeen)
+
+	var ago string
+	switch {
+	case since < time.Minute:
+		ago = fmt.Sprintf("%ds", int(since.Seconds()))
+	case since < time.Hour:
+		ago = fmt.Sprintf("%dm", int(since.Minutes()))
+	case since < 48*time.Hour:
+		ago = fmt.Sprintf("%dh", int(since.Hours()))
+	default:
+		ago = fmt.Sprintf("%dd", int(since.Hours()/24))
+	}
+
+	return pterm.LightRed(fmt.Sprintf("offline (%s ago)", ago))
+}
+
 var tagCmd = &cobra.Command{
 	Use:     "tag",
 	Short:   "Manage the tags of a node",
@@ -706,10 +1339,13 @@ var tagCmd = &cobra.Command{
 			return
 		}
 
+		force, _ := cmd.Flags().GetBool("force")
+
 		// Sending tags to node
 		request := &v1.SetTagsRequest{
 			NodeId: identifier,
 			Tags:   tagsToSet,
+			Force:  force,
 		}
 		resp, err := client.SetTags(ctx, request)
 		if err != nil {
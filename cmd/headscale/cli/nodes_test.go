@@ -0,0 +1,137 @@
+package cli
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestOnlineStatus(t *testing.T) {
+	now := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		online   bool
+		lastSeen time.Time
+		want     string
+	}{
+		{
+			name:     "online",
+			online:   true,
+			lastSeen: now.Add(-time.Hour),
+			want:     "online",
+		},
+		{
+			name: "never-seen",
+			want: "offline",
+		},
+		{
+			name:     "just-disconnected",
+			lastSeen: now.Add(-42 * time.Second),
+			want:     "offline (42s ago)",
+		},
+		{
+			name:     "minutes",
+			lastSeen: now.Add(-5*time.Minute - 10*time.Second),
+			want:     "offline (5m ago)",
+		},
+		{
+			name:     "hours",
+			lastSeen: now.Add(-30 * time.Hour),
+			want:     "offline (30h ago)",
+		},
+		{
+			name:     "days",
+			lastSeen: now.Add(-10 * 24 * time.Hour),
+			want:     "offline (10d ago)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := onlineStatus(tt.online, tt.lastSeen, now)
+			if !strings.Contains(got, tt.want) || (tt.want == "offline" && strings.Contains(got, "ago")) {
+				t.Errorf("onlineStatus() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeToPtable(t *testing.T) {
+	now := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+
+	detail := nodeDetail{
+		Node: &v1.Node{
+			Id:             7,
+			Name:           "laptop",
+			GivenName:      "laptop-1",
+			User:           &v1.User{Name: "alice"},
+			IpAddresses:    []string{"fd7a:115c:a1e0::7", "100.64.0.7"},
+			ForcedTags:     []string{"tag:server"},
+			ValidTags:      []string{"tag:dev", "tag:server"},
+			InvalidTags:    []string{"tag:prod"},
+			LastSeen:       timestamppb.New(now.Add(-time.Hour)),
+			RegisterMethod: v1.RegisterMethod_REGISTER_METHOD_AUTH_KEY,
+			PreferredDerp:  2,
+			Metadata:       map[string]string{"site": "par", "rack": "r12"},
+		},
+		Routes: []*v1.Route{
+			{Prefix: "10.0.0.0/24", Advertised: true, Enabled: true},
+			{Prefix: "10.1.0.0/24", Advertised: true},
+		},
+	}
+
+	got := map[string]string{}
+	for _, row := range nodeToPtable(detail, now) {
+		got[row[0]] = row[1]
+	}
+
+	for field, want := range map[string]string{
+		"ID":                "7",
+		"User":              "alice",
+		"Hostname":          "laptop",
+		"Name":              "laptop-1",
+		"IPv4":              "100.64.0.7",
+		"IPv6":              "fd7a:115c:a1e0::7",
+		"Tags":              "tag:dev, tag:server",
+		"Invalid tags":      "tag:prod",
+		"Advertised routes": "10.0.0.0/24, 10.1.0.0/24",
+		"Enabled routes":    "10.0.0.0/24",
+		"Expiration":        "N/A",
+		"Last seen":         "2024-01-10 11:00:00",
+		"Registered with":   "auth_key",
+		"DERP region":       "2",
+		"Metadata":          "rack=r12, site=par",
+	} {
+		if diff := cmp.Diff(want, got[field]); diff != "" {
+			t.Errorf("nodeToPtable() unexpected %s (-want +got):\n%s", field, diff)
+		}
+	}
+
+	if !strings.Contains(got["Online"], "offline (1h ago)") {
+		t.Errorf("nodeToPtable() Online = %q, want offline (1h ago)", got["Online"])
+	}
+}
+
+func TestParseNodeMetadata(t *testing.T) {
+	got, err := parseNodeMetadata([]string{"site=par", "rack=", "note=a=b"})
+	if err != nil {
+		t.Fatalf("parseNodeMetadata() error = %s", err)
+	}
+
+	want := map[string]string{"site": "par", "rack": "", "note": "a=b"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseNodeMetadata() unexpected metadata (-want +got):\n%s", diff)
+	}
+
+	for _, args := range [][]string{{"site"}, {"=par"}} {
+		if _, err := parseNodeMetadata(args); !errors.Is(err, errInvalidMetadata) {
+			t.Errorf("parseNodeMetadata(%q) error = %v, want %v", args, err, errInvalidMetadata)
+		}
+	}
+}
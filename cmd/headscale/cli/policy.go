@@ -0,0 +1,195 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(policyCmd)
+	policyCmd.AddCommand(reloadPolicyCmd)
+	policyCmd.AddCommand(getPolicyCmd)
+
+	setPolicyCmd.Flags().StringP("file", "f", "", "Path to the HuJSON policy file, - for stdin")
+	if err := setPolicyCmd.MarkFlagRequired("file"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	policyCmd.AddCommand(setPolicyCmd)
+
+	testPolicyCmd.Flags().String("src", "", "Source: user, group, tag, host, IP or node name")
+	if err := testPolicyCmd.MarkFlagRequired("src"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	testPolicyCmd.Flags().String("dst", "", "Destination with a port, like tag:server:22 or 100.64.0.2:80")
+	if err := testPolicyCmd.MarkFlagRequired("dst"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	testPolicyCmd.Flags().String("protocol", "", "Protocol of the traffic, tcp by default")
+	policyCmd.AddCommand(testPolicyCmd)
+}
+
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Manage the ACL policy",
+}
+
+var reloadPolicyCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload the ACL policy from acl_policy_path or the database",
+	Long: `Reload the ACL policy from acl_policy_path, or the database when
+policy.mode is database, and push the new packet filters to all connected
+nodes, like sending SIGHUP to the server. If the policy is invalid, the
+current policy is kept.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.ReloadPolicy(ctx, &v1.ReloadPolicyRequest{})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error reloading the ACL policy: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response, "Policy reloaded", output)
+	},
+}
+
+var getPolicyCmd = &cobra.Command{
+	Use:   "get",
+	Short: "Print the ACL policy",
+	Long: `Print the ACL policy stored in the database, or the policy file when
+policy.mode is file.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.GetPolicy(ctx, &v1.GetPolicyRequest{})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error getting the ACL policy: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response, response.GetPolicy(), output)
+	},
+}
+
+var setPolicyCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Store the ACL policy in the database",
+	Long: `Validate the ACL policy in the HuJSON format, store it in the database
+and push the new packet filters to all connected nodes. It requires
+policy.mode to be database. An invalid policy is not stored.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		policyPath, _ := cmd.Flags().GetString("file")
+
+		var data []byte
+		var err error
+		if policyPath == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(policyPath)
+		}
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error reading the ACL policy: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.SetPolicy(ctx, &v1.SetPolicyRequest{Policy: string(data)})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error setting the ACL policy: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response, "Policy updated", output)
+	},
+}
+
+var testPolicyCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Check whether the ACL policy allows some traffic",
+	Long: `Evaluate the ACL policy currently loaded against the registered nodes,
+and print whether the traffic from the source to the destination is allowed,
+with the rule allowing it. The source and the destination are aliases of the
+policy or node names, the destination takes a single port.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		src, _ := cmd.Flags().GetString("src")
+		dst, _ := cmd.Flags().GetString("dst")
+		protocol, _ := cmd.Flags().GetString("protocol")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.CheckPolicy(ctx, &v1.CheckPolicyRequest{
+			Source:      src,
+			Destination: dst,
+			Protocol:    protocol,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error checking the ACL policy: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response, policyCheckVerdict(src, dst, response), output)
+	},
+}
+
+// policyCheckVerdict describes the verdict of the policy on the traffic
+// from src to dst.
+func policyCheckVerdict(src, dst string, response *v1.CheckPolicyResponse) string {
+	switch {
+	case response.GetAllowed():
+		return fmt.Sprintf("allow: %s -> %s, by %s", src, dst, response.GetRule())
+	case response.GetPartial():
+		return fmt.Sprintf(
+			"deny: %s -> %s, %s only allows part of the addresses",
+			src, dst, response.GetRule(),
+		)
+	default:
+		return fmt.Sprintf("deny: %s -> %s, no rule allows it", src, dst)
+	}
+}
@@ -16,6 +16,12 @@ import (
 
 const (
 	DefaultPreAuthKeyExpiry = "1h"
+
+	// neverExpires is the --expiration of keys that do not expire.
+	neverExpires = "never"
+
+	errInvalidExpiration = Error("invalid expiration, use a duration (e.g. 24h, 30d), an RFC3339 time or \"never\"")
+	errExpirationInPast  = Error("expiration is in the past")
 )
 
 func init() {
@@ -32,6 +38,11 @@ func init() {
 		log.Fatal().Err(err).Msg("")
 	}
 	preauthkeysCmd.AddCommand(listPreAuthKeys)
+	listPreAuthKeys.Flags().
+		Bool("show-key-prefix", false, "Show the first characters of each key, to match them with client logs")
+	showKeyPrefixFlag := listPreAuthKeys.Flags().Lookup("show-key-prefix")
+	showKeyPrefixFlag.Deprecated = "the key prefix is always shown"
+	showKeyPrefixFlag.Hidden = true
 	preauthkeysCmd.AddCommand(createPreAuthKeyCmd)
 	preauthkeysCmd.AddCommand(expirePreAuthKeyCmd)
 	createPreAuthKeyCmd.PersistentFlags().
@@ -39,9 +50,11 @@ func init() {
 	createPreAuthKeyCmd.PersistentFlags().
 		Bool("ephemeral", false, "Preauthkey for ephemeral nodes")
 	createPreAuthKeyCmd.Flags().
-		StringP("expiration", "e", DefaultPreAuthKeyExpiry, "Human-readable expiration of the key (e.g. 30m, 24h)")
+		StringP("expiration", "e", DefaultPreAuthKeyExpiry, "Expiration of the key: a duration (e.g. 30m, 24h, 30d), an RFC3339 time (e.g. 2025-01-31T18:00:00Z) or \"never\"")
+	createPreAuthKeyCmd.Flags().
+		StringSlice("tags", []string{}, "Tags enforced on nodes registered with the key, the user must own them in tagOwners")
 	createPreAuthKeyCmd.Flags().
-		StringSlice("tags", []string{}, "Tags to automatically assign to node")
+		String("ip", "", "Specific IP address to assign to the node registering with the key")
 }
 
 var preauthkeysCmd = &cobra.Command{
@@ -92,17 +105,17 @@ var listPreAuthKeys = &cobra.Command{
 		tableData := pterm.TableData{
 			{
 				"ID",
-				"Key",
+				"Key prefix",
 				"Reusable",
 				"Ephemeral",
 				"Used",
 				"Expiration",
 				"Created",
-				"Tags",
+				"Enforced tags",
 			},
 		}
 		for _, key := range response.GetPreAuthKeys() {
-			expiration := "-"
+			expiration := neverExpires
 			if key.GetExpiration() != nil {
 				expiration = ColourTime(key.GetExpiration().AsTime())
 			}
@@ -117,7 +130,7 @@ var listPreAuthKeys = &cobra.Command{
 
 			tableData = append(tableData, []string{
 				key.GetId(),
-				key.GetKey(),
+				key.GetKeyPrefix(),
 				strconv.FormatBool(key.GetReusable()),
 				strconv.FormatBool(key.GetEphemeral()),
 				strconv.FormatBool(key.GetUsed()),
@@ -157,6 +170,7 @@ var createPreAuthKeyCmd = &cobra.Command{
 		reusable, _ := cmd.Flags().GetBool("reusable")
 		ephemeral, _ := cmd.Flags().GetBool("ephemeral")
 		tags, _ := cmd.Flags().GetStringSlice("tags")
+		ip, _ := cmd.Flags().GetString("ip")
 
 		log.Trace().
 			Bool("reusable", reusable).
@@ -169,28 +183,31 @@ var createPreAuthKeyCmd = &cobra.Command{
 			Reusable:  reusable,
 			Ephemeral: ephemeral,
 			AclTags:   tags,
+			Ip:        ip,
 		}
 
-		durationStr, _ := cmd.Flags().GetString("expiration")
+		expirationStr, _ := cmd.Flags().GetString("expiration")
 
-		duration, err := model.ParseDuration(durationStr)
+		expiration, err := parseExpiration(expirationStr, time.Now())
 		if err != nil {
 			ErrorOutput(
 				err,
-				fmt.Sprintf("Could not parse duration: %s\n", err),
+				fmt.Sprintf("Could not parse expiration: %s\n", err),
 				output,
 			)
 
 			return
 		}
 
-		expiration := time.Now().UTC().Add(time.Duration(duration))
-
-		log.Trace().
-			Dur("expiration", time.Duration(duration)).
-			Msg("expiration has been set")
+		if expiration != nil {
+			log.Trace().
+				Time("expiration", *expiration).
+				Msg("expiration has been set")
 
-		request.Expiration = timestamppb.New(expiration)
+			request.Expiration = timestamppb.New(*expiration)
+		} else {
+			request.NeverExpires = true
+		}
 
 		ctx, client, conn, cancel := getHeadscaleCLIClient()
 		defer cancel()
@@ -213,7 +230,7 @@ var createPreAuthKeyCmd = &cobra.Command{
 
 var expirePreAuthKeyCmd = &cobra.Command{
 	Use:     "expire KEY",
-	Short:   "Expire a preauthkey",
+	Short:   "Expire a preauthkey, given the key or the key prefix shown by list",
 	Aliases: []string{"revoke", "exp", "e"},
 	Args: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
@@ -254,3 +271,31 @@ var expirePreAuthKeyCmd = &cobra.Command{
 		SuccessOutput(response, "Key expired", output)
 	},
 }
+
+// parseExpiration resolves the --expiration of a pre auth key, either a
+// duration from now, an RFC3339 time or "never". It returns nil for keys
+// that do not expire.
+func parseExpiration(value string, now time.Time) (*time.Time, error) {
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(value, neverExpires) {
+		return nil, nil
+	}
+
+	expiration, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		duration, err := model.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", errInvalidExpiration, value)
+		}
+
+		expiration = now.Add(time.Duration(duration))
+	}
+
+	if !expiration.After(now) {
+		return nil, fmt.Errorf("%w: %s", errExpirationInPast, expiration.Format(time.RFC3339))
+	}
+
+	expiration = expiration.UTC()
+
+	return &expiration, nil
+}
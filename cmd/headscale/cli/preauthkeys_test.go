@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseExpiration(t *testing.T) {
+	now := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+	at := func(value string) *time.Time {
+		expiration, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &expiration
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		want    *time.Time
+		wantErr error
+	}{
+		{
+			name:  "duration",
+			value: "24h",
+			want:  at("2024-01-11T11:00:00Z"),
+		},
+		{
+			name:  "days",
+			value: "30d",
+			want:  at("2024-02-09T11:00:00Z"),
+		},
+		{
+			name:  "rfc3339",
+			value: "2024-06-01T18:00:00+02:00",
+			want:  at("2024-06-01T16:00:00Z"),
+		},
+		{
+			name:  "never",
+			value: "never",
+		},
+		{
+			name:  "never-uppercase",
+			value: " Never ",
+		},
+		{
+			name:    "past",
+			value:   "2023-12-31T00:00:00Z",
+			wantErr: errExpirationInPast,
+		},
+		{
+			name:    "zero-duration",
+			value:   "0s",
+			wantErr: errExpirationInPast,
+		},
+		{
+			name:    "invalid",
+			value:   "tomorrow",
+			wantErr: errInvalidExpiration,
+		},
+		{
+			name:    "empty",
+			value:   "",
+			wantErr: errInvalidExpiration,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExpiration(tt.value, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseExpiration(%q) error = %v, want %v", tt.value, err, tt.wantErr)
+			}
+
+			switch {
+			case tt.want == nil && got != nil:
+				t.Errorf("parseExpiration(%q) = %s, want no expiration", tt.value, got)
+			case tt.want != nil && (got == nil || !got.Equal(*tt.want)):
+				t.Errorf("parseExpiration(%q) = %v, want %s", tt.value, got, tt.want)
+			case got != nil && got.Location() != time.UTC:
+				t.Errorf("parseExpiration(%q) = %s, want UTC", tt.value, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package cli
+
+import (
+	"fmt"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/rs/zerolog/log"
+	"github.com/skip2/go-qrcode"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	generateRegisterURLCmd.Flags().StringP("user", "u", "", "User")
+	err := generateRegisterURLCmd.MarkFlagRequired("user")
+	if err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	generateRegisterURLCmd.Flags().String("ip", "", "Specific IP address to assign to the node")
+	nodeCmd.AddCommand(generateRegisterURLCmd)
+
+	qrNodeCmd.Flags().StringP("user", "u", "", "User")
+	err = qrNodeCmd.MarkFlagRequired("user")
+	if err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	qrNodeCmd.Flags().String("ip", "", "Specific IP address to assign to the node")
+	nodeCmd.AddCommand(qrNodeCmd)
+}
+
+var generateRegisterURLCmd = &cobra.Command{
+	Use:   "generate-register-url KEY",
+	Short: "Generate a one-time URL registering a node once opened",
+	Long: `Generate a one-time URL registering the node waiting with KEY in --user once
+opened, for nodes on which running the CLI is cumbersome. The URL expires
+after 5 minutes, or when the server restarts.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		response, err := generateRegisterURL(cmd, args[0])
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot generate register URL: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response, response.GetUrl(), output)
+	},
+}
+
+var qrNodeCmd = &cobra.Command{
+	Use:   "qr KEY",
+	Short: "Print a one-time register URL as a QR code",
+	Long: `Print the URL of generate-register-url as a QR code in the terminal, to open
+it from a phone.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		response, err := generateRegisterURL(cmd, args[0])
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot generate register URL: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response, "", output)
+
+			return
+		}
+
+		code, err := qrcode.New(response.GetUrl(), qrcode.Medium)
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Cannot generate QR code: %s", err), output)
+
+			return
+		}
+
+		SuccessOutput(response, code.ToSmallString(false)+response.GetUrl(), output)
+	},
+}
+
+func generateRegisterURL(cmd *cobra.Command, machineKey string) (*v1.GenerateRegisterURLResponse, error) {
+	user, _ := cmd.Flags().GetString("user")
+	ip, _ := cmd.Flags().GetString("ip")
+
+	ctx, client, conn, cancel := getHeadscaleCLIClient()
+	defer cancel()
+	defer conn.Close()
+
+	return client.GenerateRegisterURL(ctx, &v1.GenerateRegisterURLRequest{
+		User: user,
+		Key:  machineKey,
+		Ip:   ip,
+	})
+}
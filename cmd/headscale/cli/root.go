@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/rs/zerolog"
@@ -16,7 +17,10 @@ const (
 	deprecateNamespaceMessage = "use --user"
 )
 
-var cfgFile string = ""
+var (
+	cfgFile string = ""
+	cfgEnv  string = ""
+)
 
 func init() {
 	if len(os.Args) > 1 &&
@@ -26,7 +30,9 @@ func init() {
 
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().
-		StringVarP(&cfgFile, "config", "c", "", "config file (default is /etc/headscale/config.yaml)")
+		StringVarP(&cfgFile, "config", "c", "", "config file (default is /etc/headscale/config.yaml), - to read it from stdin")
+	rootCmd.PersistentFlags().
+		StringVar(&cfgEnv, "config-env", "", "name of an environment variable containing the YAML config")
 	rootCmd.PersistentFlags().
 		StringP("output", "o", "", "Output format. Empty for human-readable, 'json', 'json-line' or 'yaml'")
 	rootCmd.PersistentFlags().
@@ -34,23 +40,26 @@ func init() {
 }
 
 func initConfig() {
-	if cfgFile == "" {
-		cfgFile = os.Getenv("HEADSCALE_CONFIG")
+	// Shell completion prints the completions on stdout and must not be
+	// interrupted by logs, nor fail without a configuration: the dynamic
+	// completions give up on their own when they cannot reach headscale.
+	completing := isCompletionRequest()
+	if completing {
+		zerolog.SetGlobalLevel(zerolog.Disabled)
 	}
-	if cfgFile != "" {
-		err := types.LoadConfig(cfgFile, true)
-		if err != nil {
-			log.Fatal().Caller().Err(err).Msgf("Error loading config file %s", cfgFile)
-		}
-	} else {
-		err := types.LoadConfig("", false)
-		if err != nil {
-			log.Fatal().Caller().Err(err).Msgf("Error loading config")
+
+	if err := loadConfig(); err != nil {
+		if completing {
+			return
 		}
+		log.Fatal().Caller().Err(err).Msg("Error loading config")
 	}
 
 	cfg, err := types.GetHeadscaleConfig()
 	if err != nil {
+		if completing {
+			return
+		}
 		log.Fatal().Caller().Err(err).Msg("Failed to get headscale configuration")
 	}
 
@@ -60,7 +69,7 @@ func initConfig() {
 
 	// If the user has requested a "node" readable format,
 	// then disable login so the output remains valid.
-	if machineOutput {
+	if machineOutput || completing {
 		zerolog.SetGlobalLevel(zerolog.Disabled)
 	}
 
@@ -68,7 +77,7 @@ func initConfig() {
 		log.Logger = log.Output(os.Stdout)
 	}
 
-	if !cfg.DisableUpdateCheck && !machineOutput {
+	if !cfg.DisableUpdateCheck && !machineOutput && !completing {
 		if (runtime.GOOS == "linux" || runtime.GOOS == "darwin") &&
 			Version != "dev" {
 			githubTag := &latest.GithubTag{
@@ -88,6 +97,50 @@ func initConfig() {
 	}
 }
 
+// loadConfig loads the configuration from the file, environment variable
+// or stdin given on the command line.
+func loadConfig() error {
+	if cfgFile == "" {
+		cfgFile = os.Getenv("HEADSCALE_CONFIG")
+	}
+
+	switch {
+	case cfgEnv != "":
+		content, ok := os.LookupEnv(cfgEnv)
+		if !ok {
+			return fmt.Errorf("config environment variable %s is not set", cfgEnv)
+		}
+
+		// Do not pass the secrets of the config on to child processes.
+		os.Unsetenv(cfgEnv)
+
+		if err := types.LoadConfigFromReader(strings.NewReader(content)); err != nil {
+			return fmt.Errorf("loading config from environment variable %s: %w", cfgEnv, err)
+		}
+	case cfgFile == "-":
+		if err := types.LoadConfigFromReader(os.Stdin); err != nil {
+			return fmt.Errorf("loading config from stdin: %w", err)
+		}
+	case cfgFile != "":
+		if err := types.LoadConfig(cfgFile, true); err != nil {
+			return fmt.Errorf("loading config file %s: %w", cfgFile, err)
+		}
+	default:
+		if err := types.LoadConfig("", false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isCompletionRequest reports whether the shell is asking headscale for
+// completions.
+func isCompletionRequest() bool {
+	return len(os.Args) > 1 &&
+		(os.Args[1] == cobra.ShellCompRequestCmd || os.Args[1] == cobra.ShellCompNoDescRequestCmd)
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "headscale",
 	Short: "headscale - a Tailscale control server",
@@ -98,6 +151,8 @@ https://github.com/juanfont/headscale`,
 }
 
 func Execute() {
+	registerFlagCompletions()
+
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/netip"
 	"strconv"
+	"strings"
 
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
 	"github.com/juanfont/headscale/hscontrol/types"
@@ -20,6 +21,10 @@ const (
 func init() {
 	rootCmd.AddCommand(routesCmd)
 	listRoutesCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	listRoutesCmd.Flags().StringP("user", "u", "", "Only list the routes of the nodes of the user")
+	listRoutesCmd.Flags().Uint32("page", 0, "Page of routes to list, starting at 1")
+	listRoutesCmd.Flags().Uint32("per-page", 0, "Number of routes per page, at most 200")
+
 	routesCmd.AddCommand(listRoutesCmd)
 
 	enableRouteCmd.Flags().Uint64P("route", "r", 0, "Route identifier (ID)")
@@ -42,6 +47,14 @@ func init() {
 		log.Fatalf(err.Error())
 	}
 	routesCmd.AddCommand(deleteRouteCmd)
+
+	allowRoutesCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	allowRoutesCmd.Flags().Bool("deny-all", false, "Hide all the routes of its peers from the node")
+	err = allowRoutesCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	routesCmd.AddCommand(allowRoutesCmd)
 }
 
 var routesCmd = &cobra.Command{
@@ -68,54 +81,37 @@ var listRoutesCmd = &cobra.Command{
 			return
 		}
 
+		user, _ := cmd.Flags().GetString("user")
+		page, _ := cmd.Flags().GetUint32("page")
+		perPage, _ := cmd.Flags().GetUint32("per-page")
+
 		ctx, client, conn, cancel := getHeadscaleCLIClient()
 		defer cancel()
 		defer conn.Close()
 
-		var routes []*v1.Route
-
-		if machineID == 0 {
-			response, err := client.GetRoutes(ctx, &v1.GetRoutesRequest{})
-			if err != nil {
-				ErrorOutput(
-					err,
-					fmt.Sprintf("Cannot get nodes: %s", status.Convert(err).Message()),
-					output,
-				)
-
-				return
-			}
-
-			if output != "" {
-				SuccessOutput(response.GetRoutes(), "", output)
-
-				return
-			}
-
-			routes = response.GetRoutes()
-		} else {
-			response, err := client.GetNodeRoutes(ctx, &v1.GetNodeRoutesRequest{
-				NodeId: machineID,
-			})
-			if err != nil {
-				ErrorOutput(
-					err,
-					fmt.Sprintf("Cannot get routes for node %d: %s", machineID, status.Convert(err).Message()),
-					output,
-				)
-
-				return
-			}
+		response, err := client.GetRoutes(ctx, &v1.GetRoutesRequest{
+			User:    user,
+			NodeId:  machineID,
+			Page:    page,
+			PerPage: perPage,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get routes: %s", status.Convert(err).Message()),
+				output,
+			)
 
-			if output != "" {
-				SuccessOutput(response.GetRoutes(), "", output)
+			return
+		}
 
-				return
-			}
+		if output != "" {
+			SuccessOutput(response.GetRoutes(), "", output)
 
-			routes = response.GetRoutes()
+			return
 		}
 
+		routes := response.GetRoutes()
 		tableData := routesToPtables(routes)
 		if err != nil {
 			ErrorOutput(err, fmt.Sprintf("Error converting to table: %s", err), output)
@@ -133,6 +129,10 @@ var listRoutesCmd = &cobra.Command{
 
 			return
 		}
+
+		if page > 0 || perPage > 0 {
+			fmt.Printf("%d routes in total\n", response.GetTotal())
+		}
 	},
 }
 
@@ -154,12 +154,15 @@ var enableRouteCmd = &cobra.Command{
 			return
 		}
 
+		force, _ := cmd.Flags().GetBool("force")
+
 		ctx, client, conn, cancel := getHeadscaleCLIClient()
 		defer cancel()
 		defer conn.Close()
 
 		response, err := client.EnableRoute(ctx, &v1.EnableRouteRequest{
 			RouteId: routeID,
+			Force:   force,
 		})
 		if err != nil {
 			ErrorOutput(
@@ -197,12 +200,15 @@ var disableRouteCmd = &cobra.Command{
 			return
 		}
 
+		force, _ := cmd.Flags().GetBool("force")
+
 		ctx, client, conn, cancel := getHeadscaleCLIClient()
 		defer cancel()
 		defer conn.Close()
 
 		response, err := client.DisableRoute(ctx, &v1.DisableRouteRequest{
 			RouteId: routeID,
+			Force:   force,
 		})
 		if err != nil {
 			ErrorOutput(
@@ -240,12 +246,15 @@ var deleteRouteCmd = &cobra.Command{
 			return
 		}
 
+		force, _ := cmd.Flags().GetBool("force")
+
 		ctx, client, conn, cancel := getHeadscaleCLIClient()
 		defer cancel()
 		defer conn.Close()
 
 		response, err := client.DeleteRoute(ctx, &v1.DeleteRouteRequest{
 			RouteId: routeID,
+			Force:   force,
 		})
 		if err != nil {
 			ErrorOutput(
@@ -265,9 +274,72 @@ var deleteRouteCmd = &cobra.Command{
 	},
 }
 
+var allowRoutesCmd = &cobra.Command{
+	Use:   "allow PREFIX...",
+	Short: "Limit the routes of its peers a node sees",
+	Long: `This command limits the routes of its peers a node sees to the routes
+within the given prefixes, overriding the enabled routes. With --deny-all,
+the node sees none of them. Without prefixes, the node sees all the
+enabled routes again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		nodeID, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error getting node id from flag: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		force, _ := cmd.Flags().GetBool("force")
+		denyAll, _ := cmd.Flags().GetBool("deny-all")
+		response, err := client.SetNodeAllowedRoutes(ctx, &v1.SetNodeAllowedRoutesRequest{
+			NodeId:  nodeID,
+			Routes:  args,
+			Force:   force,
+			DenyAll: denyAll,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot set the allowed routes of node %d: %s", nodeID, status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		if response.GetDenyAll() {
+			SuccessOutput(response.GetRoutes(), "Node sees none of the routes", output)
+
+			return
+		}
+
+		if len(response.GetRoutes()) == 0 {
+			SuccessOutput(response.GetRoutes(), "Node sees all the enabled routes", output)
+
+			return
+		}
+
+		SuccessOutput(
+			response.GetRoutes(),
+			fmt.Sprintf("Node only sees the routes %s", strings.Join(response.GetRoutes(), ", ")),
+			output,
+		)
+	},
+}
+
 // routesToPtables converts the list of routes to a nice table.
 func routesToPtables(routes []*v1.Route) pterm.TableData {
-	tableData := pterm.TableData{{"ID", "Node", "Prefix", "Advertised", "Enabled", "Primary"}}
+	tableData := pterm.TableData{{"ID", "Node", "User", "Prefix", "Advertised", "Enabled", "Primary"}}
 
 	for _, route := range routes {
 		var isPrimaryStr string
@@ -287,6 +359,7 @@ func routesToPtables(routes []*v1.Route) pterm.TableData {
 			[]string{
 				strconv.FormatUint(route.GetId(), Base10),
 				route.GetNode().GetGivenName(),
+				route.GetNode().GetUser().GetName(),
 				route.GetPrefix(),
 				strconv.FormatBool(route.GetAdvertised()),
 				strconv.FormatBool(route.GetEnabled()),
@@ -0,0 +1,169 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(stateCmd)
+
+	stateExportCmd.Flags().String("out", "", "File to write the state to")
+	if err := stateExportCmd.MarkFlagRequired("out"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	stateCmd.AddCommand(stateExportCmd)
+
+	stateImportCmd.Flags().String("in", "", "File to read the state from")
+	if err := stateImportCmd.MarkFlagRequired("in"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	stateImportCmd.Flags().
+		Bool("force", false, "Replace the state of a database which is not empty")
+	stateCmd.AddCommand(stateImportCmd)
+}
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Export and import the state of headscale",
+	Long: `Export and import the users, nodes, pre auth keys, routes, node groups,
+API keys and stored policies of headscale as JSON, independently of the
+database engine.
+
+These commands use the database configured in the configuration file directly,
+they can be used to move from one database to another by changing the database
+configuration between the export and the import. Stop headscale before
+importing a state.`,
+}
+
+var stateExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the state of headscale to a JSON file",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		out, _ := cmd.Flags().GetString("out")
+
+		hsdb, err := openHeadscaleDatabase()
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Cannot open database: %s", err), output)
+
+			return
+		}
+		defer hsdb.Close()
+
+		state, err := hsdb.ExportState()
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Cannot export state: %s", err), output)
+
+			return
+		}
+
+		data, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Cannot encode state: %s", err), output)
+
+			return
+		}
+
+		// The state contains the hashes of the pre auth keys.
+		if err := os.WriteFile(out, data, 0o600); err != nil {
+			ErrorOutput(err, fmt.Sprintf("Cannot write state: %s", err), output)
+
+			return
+		}
+
+		SuccessOutput(
+			map[string]int{
+				"users":         len(state.Users),
+				"nodes":         len(state.Nodes),
+				"pre_auth_keys": len(state.PreAuthKeys),
+				"routes":        len(state.Routes),
+			},
+			fmt.Sprintf(
+				"Exported %d users, %d nodes, %d pre auth keys and %d routes to %s",
+				len(state.Users),
+				len(state.Nodes),
+				len(state.PreAuthKeys),
+				len(state.Routes),
+				out,
+			),
+			output,
+		)
+	},
+}
+
+var stateImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import the state of headscale from a JSON file",
+	Long: `Import the state of headscale from a JSON file written by "headscale state export".
+
+The database must be empty, unless --force is given in which case its users,
+nodes, pre auth keys and routes are replaced by the imported ones.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		in, _ := cmd.Flags().GetString("in")
+		force, _ := cmd.Flags().GetBool("force")
+
+		data, err := os.ReadFile(in)
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Cannot read state: %s", err), output)
+
+			return
+		}
+
+		var state types.State
+		if err := json.Unmarshal(data, &state); err != nil {
+			ErrorOutput(err, fmt.Sprintf("Cannot decode state: %s", err), output)
+
+			return
+		}
+
+		hsdb, err := openHeadscaleDatabase()
+		if err != nil {
+			ErrorOutput(err, fmt.Sprintf("Cannot open database: %s", err), output)
+
+			return
+		}
+		defer hsdb.Close()
+
+		if err := hsdb.ImportState(&state, force); err != nil {
+			ErrorOutput(err, fmt.Sprintf("Cannot import state: %s", err), output)
+
+			return
+		}
+
+		SuccessOutput(
+			map[string]int{
+				"users":         len(state.Users),
+				"nodes":         len(state.Nodes),
+				"pre_auth_keys": len(state.PreAuthKeys),
+				"routes":        len(state.Routes),
+			},
+			fmt.Sprintf(
+				"Imported %d users, %d nodes, %d pre auth keys and %d routes",
+				len(state.Users),
+				len(state.Nodes),
+				len(state.PreAuthKeys),
+				len(state.Routes),
+			),
+			output,
+		)
+	},
+}
+
+// openHeadscaleDatabase opens, and migrates, the database of the
+// configuration file, without starting headscale.
+func openHeadscaleDatabase() (*db.HSDatabase, error) {
+	cfg, err := types.GetHeadscaleConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading configuration: %w", err)
+	}
+
+	return db.NewHeadscaleDatabase(cfg.Database, cfg.BaseDomain)
+}
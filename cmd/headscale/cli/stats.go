@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+
+	topTrafficCmd.Flags().StringP("window", "w", "1h", "Period to sum the traffic over, like 1h or 7d")
+	topTrafficCmd.Flags().Uint32P("top", "t", 10, "Number of pairs of nodes to list")
+	statsCmd.AddCommand(topTrafficCmd)
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show the traffic statistics reported by the nodes",
+}
+
+var topTrafficCmd = &cobra.Command{
+	Use:   "top",
+	Short: "List the pairs of nodes exchanging the most traffic",
+	Long: `List the pairs of nodes exchanging the most traffic over the window, as
+reported by the nodes. Each node reports its own traffic, the traffic between
+two nodes is listed once for each of them.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		window, _ := cmd.Flags().GetString("window")
+		top, _ := cmd.Flags().GetUint32("top")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		response, err := client.GetTrafficStats(ctx, &v1.GetTrafficStatsRequest{
+			Window: window,
+			Top:    top,
+		})
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Cannot get traffic stats: %s", status.Convert(err).Message()),
+				output,
+			)
+
+			return
+		}
+
+		if output != "" {
+			SuccessOutput(response.GetStats(), "", output)
+
+			return
+		}
+
+		tableData := pterm.TableData{
+			{"Source ID", "Source", "Destination ID", "Destination", "Bytes sent", "Bytes received"},
+		}
+		for _, pair := range response.GetStats() {
+			tableData = append(tableData, []string{
+				strconv.FormatUint(pair.GetSourceNodeId(), util.Base10),
+				pair.GetSourceNodeName(),
+				strconv.FormatUint(pair.GetDestinationNodeId(), util.Base10),
+				pair.GetDestinationNodeName(),
+				strconv.FormatUint(pair.GetBytesTx(), util.Base10),
+				strconv.FormatUint(pair.GetBytesRx(), util.Base10),
+			})
+		}
+		err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Failed to render pterm table: %s", err),
+				output,
+			)
+
+			return
+		}
+	},
+}
@@ -3,9 +3,11 @@ package cli
 import (
 	"errors"
 	"fmt"
+	"strconv"
 
 	survey "github.com/AlecAivazis/survey/v2"
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/pterm/pterm"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -18,6 +20,22 @@ func init() {
 	userCmd.AddCommand(listUsersCmd)
 	userCmd.AddCommand(destroyUserCmd)
 	userCmd.AddCommand(renameUserCmd)
+
+	setUserTagsCmd.Flags().
+		StringSliceP("tags", "t", []string{}, "List of default tags for nodes registering in the user")
+	setUserTagsCmd.Flags().
+		Bool("apply-existing", false, "Also add the tags to the nodes already in the user")
+	userCmd.AddCommand(setUserTagsCmd)
+	userCmd.AddCommand(disableUserCmd)
+	userCmd.AddCommand(enableUserCmd)
+	userCmd.AddCommand(mergeUsersCmd)
+
+	setUserCmd.Flags().StringP("name", "n", "", "User to change")
+	if err := setUserCmd.MarkFlagRequired("name"); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	setUserCmd.Flags().Bool("derp-only", false, "Relay the traffic of the nodes of the user through DERP")
+	userCmd.AddCommand(setUserCmd)
 }
 
 var errMissingParameter = errors.New("missing parameters")
@@ -174,13 +192,17 @@ var listUsersCmd = &cobra.Command{
 			return
 		}
 
-		tableData := pterm.TableData{{"ID", "Name", "Created"}}
+		tableData := pterm.TableData{{"ID", "Name", "Display name", "Nodes", "Active keys", "Disabled", "Created"}}
 		for _, user := range response.GetUsers() {
 			tableData = append(
 				tableData,
 				[]string{
 					user.GetId(),
 					user.GetName(),
+					user.GetDisplayName(),
+					strconv.FormatUint(user.GetNodeCount(), util.Base10),
+					strconv.FormatUint(user.GetActivePreAuthKeyCount(), util.Base10),
+					strconv.FormatBool(user.GetDisabled()),
 					user.GetCreatedAt().AsTime().Format("2006-01-02 15:04:05"),
 				},
 			)
@@ -239,3 +261,253 @@ var renameUserCmd = &cobra.Command{
 		SuccessOutput(response.GetUser(), "User renamed", output)
 	},
 }
+
+var setUserTagsCmd = &cobra.Command{
+	Use:   "set-tags NAME",
+	Short: "Sets the default tags of the nodes registering in a user",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		tags, err := cmd.Flags().GetStringSlice("tags")
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf("Error retrieving list of tags: %s", err),
+				output,
+			)
+
+			return
+		}
+
+		applyExisting, _ := cmd.Flags().GetBool("apply-existing")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		request := &v1.SetUserTagsRequest{
+			Name:          args[0],
+			Tags:          tags,
+			ApplyExisting: applyExisting,
+		}
+
+		response, err := client.SetUserTags(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot set default tags of user: %s",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetUser(), "Default tags updated", output)
+	},
+}
+
+var disableUserCmd = &cobra.Command{
+	Use:   "disable NAME",
+	Short: "Disables a user, expiring its nodes and preventing new registrations",
+	Long: `Disables a user, expiring its nodes and preventing new registrations.
+
+Nodes and pre auth keys of the user are kept, and it can no longer register
+nodes or create pre auth keys until it is enabled again.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		request := &v1.DisableUserRequest{Name: args[0]}
+
+		response, err := client.DisableUser(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot disable user: %s",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetUser(), "User disabled", output)
+	},
+}
+
+var enableUserCmd = &cobra.Command{
+	Use:   "enable NAME",
+	Short: "Enables a disabled user, its expired nodes have to log in again",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		request := &v1.EnableUserRequest{Name: args[0]}
+
+		response, err := client.EnableUser(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot enable user: %s",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetUser(), "User enabled", output)
+	},
+}
+
+var mergeUsersCmd = &cobra.Command{
+	Use:   "merge SOURCE DESTINATION",
+	Short: "Moves the nodes and preauthkeys of a user to another one and destroys it",
+	Long: `Moves the nodes and preauthkeys of the user SOURCE to the user DESTINATION,
+destroys SOURCE and replaces it by DESTINATION in the ACL policy. The merge is
+refused if the rewritten ACL policy is invalid, or if both users have a policy
+file in a policy directory. Locked nodes are only moved with --force.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		expectedArguments := 2
+		if len(args) < expectedArguments {
+			return errMissingParameter
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		force, _ := cmd.Flags().GetBool("force")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		confirm := false
+		if !force {
+			prompt := &survey.Confirm{
+				Message: fmt.Sprintf(
+					"Do you want to move the nodes and preauthkeys of the user '%s' to '%s' and remove '%s'?",
+					args[0],
+					args[1],
+					args[0],
+				),
+			}
+			err := survey.AskOne(prompt, &confirm)
+			if err != nil {
+				return
+			}
+		}
+
+		if !confirm && !force {
+			SuccessOutput(map[string]string{"Result": "Users not merged"}, "Users not merged", output)
+
+			return
+		}
+
+		request := &v1.MergeUsersRequest{
+			Source:      args[0],
+			Destination: args[1],
+			Force:       force,
+		}
+
+		response, err := client.MergeUsers(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot merge users: %s",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetUser(), "Users merged", output)
+	},
+}
+
+var setUserCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Changes the settings of a user",
+	Long: `Changes the settings of the user given with --name. With --derp-only, the
+endpoints of the nodes of the user are not given to their peers, nor the
+endpoints of the peers to them, so their traffic is relayed through DERP.
+Use --derp-only=false to give them back.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		name, _ := cmd.Flags().GetString("name")
+
+		if !cmd.Flags().Changed("derp-only") {
+			ErrorOutput(
+				errMissingParameter,
+				"Nothing to change, set --derp-only",
+				output,
+			)
+
+			return
+		}
+		derpOnly, _ := cmd.Flags().GetBool("derp-only")
+
+		ctx, client, conn, cancel := getHeadscaleCLIClient()
+		defer cancel()
+		defer conn.Close()
+
+		request := &v1.SetUserDERPOnlyRequest{
+			Name:     name,
+			DerpOnly: derpOnly,
+		}
+
+		response, err := client.SetUserDERPOnly(ctx, request)
+		if err != nil {
+			ErrorOutput(
+				err,
+				fmt.Sprintf(
+					"Cannot change user: %s",
+					status.Convert(err).Message(),
+				),
+				output,
+			)
+
+			return
+		}
+
+		SuccessOutput(response.GetUser(), "User changed", output)
+	},
+}
@@ -25,6 +25,8 @@ const (
 	SocketWritePermissions  = 0o666
 )
 
+const errAPIKeyNotDefined = Error("HEADSCALE_CLI_API_KEY environment variable needs to be set")
+
 func getHeadscaleApp() (*hscontrol.Headscale, error) {
 	cfg, err := types.GetHeadscaleConfig()
 	if err != nil {
@@ -58,15 +60,27 @@ func getHeadscaleApp() (*hscontrol.Headscale, error) {
 }
 
 func getHeadscaleCLIClient() (context.Context, v1.HeadscaleServiceClient, *grpc.ClientConn, context.CancelFunc) {
-	cfg, err := types.GetHeadscaleConfig()
+	ctx, client, conn, cancel, err := newHeadscaleCLIClient()
 	if err != nil {
 		log.Fatal().
 			Err(err).
 			Caller().
-			Msgf("Failed to load configuration")
+			Msgf("Could not connect")
 		os.Exit(-1) // we get here if logging is suppressed (i.e., json output)
 	}
 
+	return ctx, client, conn, cancel
+}
+
+// newHeadscaleCLIClient connects to the headscale server like
+// getHeadscaleCLIClient, but returns an error instead of exiting when it
+// cannot, for the callers that must keep going, like shell completion.
+func newHeadscaleCLIClient() (context.Context, v1.HeadscaleServiceClient, *grpc.ClientConn, context.CancelFunc, error) {
+	cfg, err := types.GetHeadscaleConfig()
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
 	log.Debug().
 		Dur("timeout", cfg.CLI.Timeout).
 		Msgf("Setting timeout")
@@ -92,10 +106,13 @@ func getHeadscaleCLIClient() (context.Context, v1.HeadscaleServiceClient, *grpc.
 		socket, err := os.OpenFile(cfg.UnixSocket, os.O_WRONLY, SocketWritePermissions) //nolint
 		if err != nil {
 			if os.IsPermission(err) {
-				log.Fatal().
-					Err(err).
-					Str("socket", cfg.UnixSocket).
-					Msgf("Unable to read/write to headscale socket, do you have the correct permissions?")
+				cancel()
+
+				return nil, nil, nil, nil, fmt.Errorf(
+					"unable to read/write to headscale socket %s, do you have the correct permissions?: %w",
+					cfg.UnixSocket,
+					err,
+				)
 			}
 		}
 		socket.Close()
@@ -109,7 +126,9 @@ func getHeadscaleCLIClient() (context.Context, v1.HeadscaleServiceClient, *grpc.
 		// If we are not connecting to a local server, require an API key for authentication
 		apiKey := cfg.CLI.APIKey
 		if apiKey == "" {
-			log.Fatal().Caller().Msgf("HEADSCALE_CLI_API_KEY environment variable needs to be set.")
+			cancel()
+
+			return nil, nil, nil, nil, errAPIKeyNotDefined
 		}
 		grpcOptions = append(grpcOptions,
 			grpc.WithPerRPCCredentials(tokenAuth{
@@ -138,13 +157,14 @@ func getHeadscaleCLIClient() (context.Context, v1.HeadscaleServiceClient, *grpc.
 	log.Trace().Caller().Str("address", address).Msg("Connecting via gRPC")
 	conn, err := grpc.DialContext(ctx, address, grpcOptions...)
 	if err != nil {
-		log.Fatal().Caller().Err(err).Msgf("Could not connect: %v", err)
-		os.Exit(-1) // we get here if logging is suppressed (i.e., json output)
+		cancel()
+
+		return nil, nil, nil, nil, fmt.Errorf("could not connect to %s: %w", address, err)
 	}
 
 	client := v1.NewHeadscaleServiceClient(conn)
 
-	return ctx, client, conn, cancel
+	return ctx, client, conn, cancel, nil
 }
 
 func SuccessOutput(result interface{}, override string, outputFormat string) {
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/spf13/viper"
@@ -72,6 +75,52 @@ func (*Suite) TestConfigFileLoading(c *check.C) {
 	c.Assert(viper.GetBool("logtail.enabled"), check.Equals, false)
 }
 
+func (*Suite) TestConfigReaderLoading(c *check.C) {
+	path, err := os.Getwd()
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	cfgFile := filepath.Clean(path + "/../../config-example.yaml")
+
+	content, err := os.ReadFile(cfgFile)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	viper.Reset()
+	err = types.LoadConfig(cfgFile, true)
+	c.Assert(err, check.IsNil)
+
+	fromFile, err := types.GetHeadscaleConfig()
+	c.Assert(err, check.IsNil)
+
+	viper.Reset()
+	err = types.LoadConfigFromReader(strings.NewReader(string(content)))
+	c.Assert(err, check.IsNil)
+
+	fromReader, err := types.GetHeadscaleConfig()
+	c.Assert(err, check.IsNil)
+
+	// The example config only has absolute paths, every field must be
+	// the same as when it is read from the file.
+	c.Assert(fromReader.ServerURL, check.Equals, "http://127.0.0.1:8080")
+	c.Assert(fromReader.Addr, check.Equals, "127.0.0.1:8080")
+	c.Assert(fromReader.Database.Sqlite.Path, check.Equals, "/var/lib/headscale/db.sqlite")
+	c.Assert(fromReader.NoisePrivateKeyPath, check.Equals, "/var/lib/headscale/noise_private.key")
+	c.Assert(fromReader.DNSConfig.Resolvers[0].Addr, check.Equals, "1.1.1.1")
+	c.Assert(cmp.Diff(fromFile, fromReader, util.Comparers...), check.Equals, "")
+
+	// Invalid configs are rejected like config files.
+	viper.Reset()
+	err = types.LoadConfigFromReader(strings.NewReader(
+		strings.Replace(string(content), "server_url: http://", "server_url: ftp://", 1),
+	))
+	c.Assert(err, check.NotNil)
+
+	viper.Reset()
+}
+
 func (*Suite) TestConfigLoading(c *check.C) {
 	tmpDir, err := os.MkdirTemp("", "headscale")
 	if err != nil {
@@ -149,6 +198,54 @@ func (*Suite) TestDNSConfigLoading(c *check.C) {
 	c.Assert(baseDomain, check.Equals, "example.com")
 }
 
+func (*Suite) TestConfigEnvOverrides(c *check.C) {
+	tmpDir, err := os.MkdirTemp("", "headscale")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	configYaml := []byte(`---
+server_url: http://127.0.0.1:8080
+database:
+  type: postgres
+  postgres:
+    host: db
+    pass: from-file
+`)
+	writeConfig(c, tmpDir, configYaml)
+
+	env := map[string]string{
+		"HEADSCALE_SERVER_URL":                        "https://headscale.example.com",
+		"HEADSCALE_NOISE_PRIVATE_KEY_PATH":            "noise_private.key",
+		"HEADSCALE_DATABASE_POSTGRES_PASS":            "from-env",
+		"HEADSCALE_OIDC_CLIENT_SECRET":                "oidc-secret",
+		"HEADSCALE_DNS_CONFIG_NAMESERVERS":            "1.1.1.1 8.8.8.8",
+		"HEADSCALE_EPHEMERAL_NODE_INACTIVITY_TIMEOUT": "5m",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	// The noise key is only set in the environment.
+	err = types.LoadConfig(tmpDir, false)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(viper.GetString("server_url"), check.Equals, "https://headscale.example.com")
+	c.Assert(viper.GetString("oidc.client_secret"), check.Equals, "oidc-secret")
+	c.Assert(
+		viper.GetStringSlice("dns_config.nameservers"),
+		check.DeepEquals,
+		[]string{"1.1.1.1", "8.8.8.8"},
+	)
+	c.Assert(viper.GetDuration("ephemeral_node_inactivity_timeout"), check.Equals, 5*time.Minute)
+
+	dbConfig := types.GetDatabaseConfig()
+	c.Assert(dbConfig.Postgres.Host, check.Equals, "db")
+	c.Assert(dbConfig.Postgres.Pass, check.Equals, "from-env")
+}
+
 func writeConfig(c *check.C, tmpDir string, configYaml []byte) {
 	// Populate a custom config file
 	configFile := filepath.Join(tmpDir, "config.yaml")
@@ -205,3 +302,169 @@ tls_letsencrypt_challenge_type: TLS-ALPN-01
 	err = types.LoadConfig(tmpDir, false)
 	c.Assert(err, check.IsNil)
 }
+
+func (*Suite) TestServerURLValidation(c *check.C) {
+	tmpDir, err := os.MkdirTemp("", "headscale")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for serverURL, want := range map[string]string{
+		"headscale.example.com": "server_url must start with https:// or http://",
+		"https://":              "server_url: invalid server_url: \"https://\" has no host",
+		"https://headscale.example.com/?internal=1": "must not have a query or a fragment",
+	} {
+		writeConfig(c, tmpDir, []byte(`---
+noise:
+  private_key_path: noise_private.key
+server_url: `+serverURL+"\n"))
+
+		err = types.LoadConfig(tmpDir, false)
+		c.Assert(err, check.NotNil, check.Commentf("server_url %s", serverURL))
+		c.Assert(strings.Contains(err.Error(), want), check.Equals, true, check.Commentf("%s", err))
+	}
+
+	writeConfig(c, tmpDir, []byte(`---
+noise:
+  private_key_path: noise_private.key
+server_url: https://headscale.example.com/
+`))
+
+	err = types.LoadConfig(tmpDir, false)
+	c.Assert(err, check.IsNil)
+
+	cfg, err := types.GetHeadscaleConfig()
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.ServerURL, check.Equals, "https://headscale.example.com")
+}
+
+func (*Suite) TestBaseDomainValidation(c *check.C) {
+	tmpDir, err := os.MkdirTemp("", "headscale")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, tt := range []struct {
+		serverURL  string
+		baseDomain string
+		magicDNS   bool
+		wantErr    bool
+	}{
+		{serverURL: "https://example.com", baseDomain: "example.com", magicDNS: true, wantErr: true},
+		{serverURL: "https://headscale.example.com:8443", baseDomain: "example.com", magicDNS: true, wantErr: true},
+		{serverURL: "https://Headscale.Example.com", baseDomain: "example.com.", magicDNS: true, wantErr: true},
+		{serverURL: "https://headscale.example.com", baseDomain: "example.com", magicDNS: false},
+		{serverURL: "https://headscale.example.com", baseDomain: "tailnet.example.com", magicDNS: true},
+		{serverURL: "https://headscale.example.com", baseDomain: "le.example.com", magicDNS: true},
+		{serverURL: "https://myexample.com", baseDomain: "example.com", magicDNS: true},
+	} {
+		writeConfig(c, tmpDir, []byte(fmt.Sprintf(`---
+noise:
+  private_key_path: noise_private.key
+server_url: %s
+dns_config:
+  nameservers:
+    - 1.1.1.1
+  magic_dns: %t
+  base_domain: %s
+`, tt.serverURL, tt.magicDNS, tt.baseDomain)))
+
+		err = types.LoadConfig(tmpDir, false)
+		comment := check.Commentf("server_url %s, base_domain %s: %v", tt.serverURL, tt.baseDomain, err)
+		if tt.wantErr {
+			c.Assert(err, check.NotNil, comment)
+			c.Assert(strings.Contains(err.Error(), "server_url must not be in base_domain"), check.Equals, true, comment)
+		} else {
+			c.Assert(err, check.IsNil, comment)
+		}
+	}
+}
+
+func (*Suite) TestDatabaseConnectionPoolValidation(c *check.C) {
+	tmpDir, err := os.MkdirTemp("", "headscale")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	configYaml := []byte(`---
+noise:
+  private_key_path: noise_private.key
+server_url: http://127.0.0.1:8080
+database:
+  type: postgres
+  max_open_connections: 5
+  max_idle_connections: 10
+`)
+	writeConfig(c, tmpDir, configYaml)
+
+	err = types.LoadConfig(tmpDir, false)
+	c.Assert(err, check.NotNil)
+	c.Assert(
+		strings.ReplaceAll(err.Error(), "\n", "***"),
+		check.Matches,
+		".*Fatal config error: database.max_idle_connections \\(10\\) must not be greater than database.max_open_connections \\(5\\).*",
+	)
+
+	// The settings of the postgres block take precedence.
+	configYaml = []byte(`---
+noise:
+  private_key_path: noise_private.key
+server_url: http://127.0.0.1:8080
+database:
+  type: postgres
+  max_open_connections: 5
+  max_idle_connections: 10
+  conn_max_lifetime: 30m
+  postgres:
+    max_open_conns: 20
+`)
+	writeConfig(c, tmpDir, configYaml)
+
+	err = types.LoadConfig(tmpDir, false)
+	c.Assert(err, check.IsNil)
+
+	dbConfig := types.GetDatabaseConfig()
+	c.Assert(dbConfig.MaxOpenConnections, check.Equals, 20)
+	c.Assert(dbConfig.MaxIdleConnections, check.Equals, 10)
+	c.Assert(dbConfig.Postgres.MaxOpenConnections, check.Equals, 20)
+	c.Assert(dbConfig.ConnMaxLifetime, check.Equals, 30*time.Minute)
+}
+
+func (*Suite) TestPerNodePrefixLen(c *check.C) {
+	tmpDir, err := os.MkdirTemp("", "headscale")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for prefixes, want := range map[string]string{
+		"  v4: 100.64.0.0/10\n  per_node_prefix_len: 30\n":       "",
+		"  v4: 100.64.0.0/24\n  per_node_prefix_len: 25\n":       "/25 blocks do not fit in 100.64.0.0/24",
+		"  v4: 100.64.0.0/10\n  per_node_prefix_len: 33\n":       "/33 blocks do not fit in 100.64.0.0/10",
+		"  v6: fd7a:115c:a1e0::/48\n  per_node_prefix_len: 30\n": "/30 blocks need prefixes.v4",
+	} {
+		writeConfig(c, tmpDir, []byte(`---
+noise:
+  private_key_path: noise_private.key
+server_url: https://headscale.example.com
+prefixes:
+`+prefixes))
+
+		err = types.LoadConfig(tmpDir, false)
+		c.Assert(err, check.IsNil)
+
+		cfg, err := types.GetHeadscaleConfig()
+		if want == "" {
+			c.Assert(err, check.IsNil)
+			c.Assert(cfg.PerNodePrefixLen, check.Equals, 30)
+
+			continue
+		}
+
+		c.Assert(err, check.NotNil, check.Commentf("prefixes %s", prefixes))
+		c.Assert(strings.Contains(err.Error(), want), check.Equals, true, check.Commentf("%s", err))
+	}
+}
@@ -0,0 +1,401 @@
+package hscontrol
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns/digitalocean"
+	"github.com/go-acme/lego/v4/providers/dns/exec"
+	"github.com/go-acme/lego/v4/providers/dns/hetzner"
+	"github.com/go-acme/lego/v4/providers/dns/httpreq"
+	"github.com/go-acme/lego/v4/providers/dns/rfc2136"
+	"github.com/go-acme/lego/v4/providers/dns/route53"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	acmeRenewCheckInterval = 12 * time.Hour
+
+	acmeAccountKeyFile = "account.key"
+	acmeAccountFile    = "account.json"
+)
+
+var (
+	errACMENoCertificate          = errors.New("no ACME certificate has been obtained yet")
+	errACMEUnsupportedDNSProvider = errors.New("unsupported DNS challenge provider")
+)
+
+// acmeDNSProviders are the lego DNS providers supported for the DNS-01
+// challenge, by code. Only these are built in, each lego provider brings
+// the SDK of its DNS service. exec and httpreq hand the records to a
+// program or a web service, for the other DNS services.
+var acmeDNSProviders = map[string]func() (challenge.Provider, error){
+	"digitalocean": acmeDNSProvider(digitalocean.NewDNSProvider),
+	"exec":         acmeDNSProvider(exec.NewDNSProvider),
+	"hetzner":      acmeDNSProvider(hetzner.NewDNSProvider),
+	"httpreq":      acmeDNSProvider(httpreq.NewDNSProvider),
+	"rfc2136":      acmeDNSProvider(rfc2136.NewDNSProvider),
+	"route53":      acmeDNSProvider(route53.NewDNSProvider),
+}
+
+func acmeDNSProvider[P challenge.Provider](newProvider func() (P, error)) func() (challenge.Provider, error) {
+	return func() (challenge.Provider, error) {
+		provider, err := newProvider()
+		if err != nil {
+			return nil, err
+		}
+
+		return provider, nil
+	}
+}
+
+// newACMEDNSProvider returns the DNS provider with the code name, set up
+// from the environment variables lego documents for it.
+func newACMEDNSProvider(name string) (challenge.Provider, error) {
+	newProvider, ok := acmeDNSProviders[name]
+	if !ok {
+		names := make([]string, 0, len(acmeDNSProviders))
+		for name := range acmeDNSProviders {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		return nil, fmt.Errorf("%w, the supported providers are %s", errACMEUnsupportedDNSProvider, strings.Join(names, ", "))
+	}
+
+	return newProvider()
+}
+
+// acmeUser is the ACME account headscale registers with the CA.
+type acmeUser struct {
+	email        string
+	registration *registration.Resource
+	key          crypto.PrivateKey
+}
+
+func (u *acmeUser) GetEmail() string {
+	return u.email
+}
+
+func (u *acmeUser) GetRegistration() *registration.Resource {
+	return u.registration
+}
+
+func (u *acmeUser) GetPrivateKey() crypto.PrivateKey {
+	return u.key
+}
+
+// acmeManager obtains the certificate of the configured domain with the
+// DNS-01 challenge, keeps it in the data directory and renews it before
+// it expires. The certificate is handed out per TLS handshake, so a
+// renewed certificate is served without restarting the listeners.
+type acmeManager struct {
+	cfg    types.ACMEConfig
+	client *lego.Client
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newACMEManager(cfg types.ACMEConfig) (*acmeManager, error) {
+	err := os.MkdirAll(cfg.DataDir, headscaleDirPerm)
+	if err != nil {
+		return nil, fmt.Errorf("creating ACME data directory: %w", err)
+	}
+
+	user, err := loadACMEUser(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	legoConfig := lego.NewConfig(user)
+	legoConfig.CADirURL = cfg.DirectoryURL
+	legoConfig.Certificate.KeyType = certcrypto.EC256
+
+	client, err := lego.NewClient(legoConfig)
+	if err != nil {
+		return nil, fmt.Errorf("creating ACME client: %w", err)
+	}
+
+	provider, err := newACMEDNSProvider(cfg.DNSChallengeProvider)
+	if err != nil {
+		return nil, fmt.Errorf("setting up DNS challenge provider %q: %w", cfg.DNSChallengeProvider, err)
+	}
+
+	var opts []dns01.ChallengeOption
+	if len(cfg.DNSResolvers) > 0 {
+		opts = append(opts, dns01.AddRecursiveNameservers(dns01.ParseNameservers(cfg.DNSResolvers)))
+	}
+
+	if cfg.DisablePropagationCheck {
+		opts = append(opts, dns01.WrapPreCheck(
+			func(_, _, _ string, _ dns01.PreCheckFunc) (bool, error) {
+				return true, nil
+			},
+		))
+	}
+
+	err = client.Challenge.SetDNS01Provider(provider, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("setting up DNS-01 challenge: %w", err)
+	}
+
+	if user.registration == nil {
+		user.registration, err = client.Registration.Register(
+			registration.RegisterOptions{TermsOfServiceAgreed: true},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("registering ACME account: %w", err)
+		}
+
+		err = saveACMERegistration(cfg.DataDir, user.registration)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manager := &acmeManager{
+		cfg:    cfg,
+		client: client,
+	}
+
+	cert, err := loadACMECertificate(cfg.DataDir, cfg.Domain)
+	if err == nil {
+		manager.cert = cert
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Warn().
+			Err(err).
+			Str("domain", cfg.Domain).
+			Msg("Failed to load stored ACME certificate, obtaining a new one")
+	}
+
+	return manager, nil
+}
+
+// loadACMEUser reads the ACME account from the data directory, creating
+// a new account key if there is none.
+func loadACMEUser(cfg types.ACMEConfig) (*acmeUser, error) {
+	user := &acmeUser{email: cfg.Email}
+
+	keyPath := filepath.Join(cfg.DataDir, acmeAccountKeyFile)
+	keyPEM, err := os.ReadFile(keyPath)
+	switch {
+	case err == nil:
+		user.key, err = certcrypto.ParsePEMPrivateKey(keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("parsing ACME account key %s: %w", keyPath, err)
+		}
+
+	case errors.Is(err, os.ErrNotExist):
+		user.key, err = certcrypto.GeneratePrivateKey(certcrypto.EC256)
+		if err != nil {
+			return nil, fmt.Errorf("generating ACME account key: %w", err)
+		}
+
+		err = os.WriteFile(keyPath, certcrypto.PEMEncode(user.key), privateKeyFileMode)
+		if err != nil {
+			return nil, fmt.Errorf("saving ACME account key: %w", err)
+		}
+
+		// A registration without its key is of no use.
+		return user, nil
+
+	default:
+		return nil, fmt.Errorf("reading ACME account key: %w", err)
+	}
+
+	regJSON, err := os.ReadFile(filepath.Join(cfg.DataDir, acmeAccountFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return user, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading ACME account: %w", err)
+	}
+
+	var reg registration.Resource
+	err = json.Unmarshal(regJSON, &reg)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ACME account: %w", err)
+	}
+	user.registration = &reg
+
+	return user, nil
+}
+
+func saveACMERegistration(dataDir string, reg *registration.Resource) error {
+	regJSON, err := json.Marshal(reg)
+	if err != nil {
+		return fmt.Errorf("marshalling ACME account: %w", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dataDir, acmeAccountFile), regJSON, privateKeyFileMode)
+	if err != nil {
+		return fmt.Errorf("saving ACME account: %w", err)
+	}
+
+	return nil
+}
+
+func acmeCertificatePaths(dataDir, domain string) (string, string) {
+	return filepath.Join(dataDir, domain+".crt"), filepath.Join(dataDir, domain+".key")
+}
+
+func loadACMECertificate(dataDir, domain string) (*tls.Certificate, error) {
+	certPath, keyPath := acmeCertificatePaths(dataDir, domain)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+// needsRenewal reports whether there is no certificate yet or the
+// current one expires within the configured renewal window.
+func (m *acmeManager) needsRenewal(now time.Time) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.cert == nil || m.cert.Leaf == nil {
+		return true
+	}
+
+	return now.Add(m.cfg.RenewBefore).After(m.cert.Leaf.NotAfter)
+}
+
+// obtain requests a new certificate from the CA, stores it in the data
+// directory and starts serving it.
+func (m *acmeManager) obtain() error {
+	res, err := m.client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{m.cfg.Domain},
+		Bundle:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("obtaining certificate for %s: %w", m.cfg.Domain, err)
+	}
+
+	cert, err := tls.X509KeyPair(res.Certificate, res.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("parsing obtained certificate: %w", err)
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing obtained certificate: %w", err)
+	}
+
+	certPath, keyPath := acmeCertificatePaths(m.cfg.DataDir, m.cfg.Domain)
+	err = os.WriteFile(keyPath, res.PrivateKey, privateKeyFileMode)
+	if err != nil {
+		return fmt.Errorf("saving certificate key: %w", err)
+	}
+
+	err = os.WriteFile(certPath, res.Certificate, privateKeyFileMode)
+	if err != nil {
+		return fmt.Errorf("saving certificate: %w", err)
+	}
+
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+
+	log.Info().
+		Str("domain", m.cfg.Domain).
+		Time("expiry", cert.Leaf.NotAfter).
+		Msg("Obtained ACME certificate")
+
+	return nil
+}
+
+func (m *acmeManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.cert == nil {
+		return nil, errACMENoCertificate
+	}
+
+	return m.cert, nil
+}
+
+// TLSConfig returns a TLS configuration serving the current certificate.
+func (m *acmeManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos:     []string{"http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.getCertificate,
+	}
+}
+
+// renewWorker checks the certificate at a set interval and renews it
+// when it is about to expire. A failed renewal keeps the current
+// certificate and is retried at the next check.
+func (m *acmeManager) renewWorker(ctx context.Context) {
+	ticker := time.NewTicker(acmeRenewCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if !m.needsRenewal(time.Now()) {
+				continue
+			}
+
+			log.Info().Str("domain", m.cfg.Domain).Msg("Renewing ACME certificate")
+			if err := m.obtain(); err != nil {
+				log.Error().
+					Err(err).
+					Str("domain", m.cfg.Domain).
+					Msg("Failed to renew ACME certificate, keeping the current certificate")
+			}
+		}
+	}
+}
+
+// StartACMEAutoRenew obtains a certificate for the configured ACME domain
+// unless a valid one is stored in the data directory, and keeps renewing
+// it in the background until ctx is cancelled. The returned TLS
+// configuration picks up renewed certificates without a restart.
+func (h *Headscale) StartACMEAutoRenew(ctx context.Context) (*tls.Config, error) {
+	manager, err := newACMEManager(h.cfg.TLS.ACME)
+	if err != nil {
+		return nil, err
+	}
+
+	if manager.needsRenewal(time.Now()) {
+		err = manager.obtain()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go manager.renewWorker(ctx)
+
+	return manager.TLSConfig(), nil
+}
@@ -0,0 +1,139 @@
+package hscontrol
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+func writeTestACMECertificate(t *testing.T, dataDir, domain string, notAfter time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshalling key: %s", err)
+	}
+
+	certPath, keyPath := acmeCertificatePaths(dataDir, domain)
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatalf("writing certificate: %s", err)
+	}
+
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		t.Fatalf("writing key: %s", err)
+	}
+}
+
+func TestACMEManagerNeedsRenewal(t *testing.T) {
+	now := time.Now()
+	dataDir := t.TempDir()
+	domain := "headscale.example.com"
+
+	manager := &acmeManager{
+		cfg: types.ACMEConfig{
+			Domain:      domain,
+			DataDir:     dataDir,
+			RenewBefore: 30 * 24 * time.Hour,
+		},
+	}
+
+	if !manager.needsRenewal(now) {
+		t.Error("needsRenewal() = false without a certificate, want true")
+	}
+
+	_, err := manager.getCertificate(nil)
+	if err == nil {
+		t.Error("getCertificate() without a certificate did not return an error")
+	}
+
+	tests := []struct {
+		name     string
+		notAfter time.Time
+		want     bool
+	}{
+		{
+			name:     "valid for long",
+			notAfter: now.Add(60 * 24 * time.Hour),
+			want:     false,
+		},
+		{
+			name:     "within renewal window",
+			notAfter: now.Add(10 * 24 * time.Hour),
+			want:     true,
+		},
+		{
+			name:     "expired",
+			notAfter: now.Add(-time.Hour),
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeTestACMECertificate(t, dataDir, domain, tt.notAfter)
+
+			cert, err := loadACMECertificate(dataDir, domain)
+			if err != nil {
+				t.Fatalf("loadACMECertificate() error = %s", err)
+			}
+			manager.cert = cert
+
+			if got := manager.needsRenewal(now); got != tt.want {
+				t.Errorf("needsRenewal() = %v, want %v", got, tt.want)
+			}
+
+			served, err := manager.getCertificate(nil)
+			if err != nil {
+				t.Fatalf("getCertificate() error = %s", err)
+			}
+			if served.Leaf.DNSNames[0] != domain {
+				t.Errorf("getCertificate() served %v, want %s", served.Leaf.DNSNames, domain)
+			}
+		})
+	}
+}
+
+func TestNewACMEDNSProvider(t *testing.T) {
+	_, err := newACMEDNSProvider("cloudxns")
+	if !errors.Is(err, errACMEUnsupportedDNSProvider) {
+		t.Errorf("newACMEDNSProvider() error = %v, want %v", err, errACMEUnsupportedDNSProvider)
+	}
+
+	t.Setenv("EXEC_PATH", "/usr/local/bin/update-dns")
+	provider, err := newACMEDNSProvider("exec")
+	if err != nil {
+		t.Fatalf("newACMEDNSProvider() error = %s", err)
+	}
+	if provider == nil {
+		t.Error("newACMEDNSProvider() returned no provider")
+	}
+}
@@ -0,0 +1,248 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	grpcRuntime "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+// apiErrorDomain is the domain of the ErrorInfo details carrying the
+// code of the errors of the API.
+const apiErrorDomain = "headscale"
+
+// grpcCodes maps the error codes to the gRPC status of the API, codes
+// missing from it are returned as codes.Internal.
+var grpcCodes = map[types.ErrorCode]codes.Code{
+	types.CodeInternal:           codes.Internal,
+	types.CodeInvalidArgument:    codes.InvalidArgument,
+	types.CodeNotFound:           codes.NotFound,
+	types.CodeAlreadyExists:      codes.AlreadyExists,
+	types.CodeFailedPrecondition: codes.FailedPrecondition,
+	types.CodePermissionDenied:   codes.PermissionDenied,
+	types.CodeUnauthenticated:    codes.Unauthenticated,
+	types.CodeUnavailable:        codes.Unavailable,
+	types.CodeUnimplemented:      codes.Unimplemented,
+	types.CodeDeadlineExceeded:   codes.DeadlineExceeded,
+	types.CodeCanceled:           codes.Canceled,
+	types.CodeQuotaExceeded:      codes.ResourceExhausted,
+
+	types.CodeNodeNotFound:          codes.NotFound,
+	types.CodeNodeNotRegistered:     codes.NotFound,
+	types.CodeRouteNotAvailable:     codes.FailedPrecondition,
+	types.CodeUserNotFound:          codes.NotFound,
+	types.CodeUserExists:            codes.AlreadyExists,
+	types.CodeUserNotEmpty:          codes.FailedPrecondition,
+	types.CodeUserDisabled:          codes.FailedPrecondition,
+	types.CodeUserMismatch:          codes.InvalidArgument,
+	types.CodeKeyNotFound:           codes.NotFound,
+	types.CodeKeyExpired:            codes.FailedPrecondition,
+	types.CodeKeyUsed:               codes.FailedPrecondition,
+	types.CodeKeyInvalid:            codes.InvalidArgument,
+	types.CodeInvalidTag:            codes.InvalidArgument,
+	types.CodeNodeGroupNotFound:     codes.NotFound,
+	types.CodeNodeGroupExists:       codes.AlreadyExists,
+	types.CodeNodeGroupMemberExists: codes.AlreadyExists,
+	types.CodeInvalidNodeGroupName:  codes.InvalidArgument,
+	types.CodeIPExhausted:           codes.ResourceExhausted,
+	types.CodeIPNotInPrefix:         codes.InvalidArgument,
+	types.CodeIPAlreadyAllocated:    codes.AlreadyExists,
+	types.CodeStateNotEmpty:         codes.FailedPrecondition,
+	types.CodeStateVersionMismatch:  codes.InvalidArgument,
+	types.CodePolicyNotFound:        codes.NotFound,
+	types.CodeNodeLocked:            codes.FailedPrecondition,
+	types.CodeUserMergeConflict:     codes.FailedPrecondition,
+}
+
+// httpStatuses overrides the HTTP status the gRPC gateway derives from
+// the gRPC status for some error codes.
+var httpStatuses = map[types.ErrorCode]int{
+	types.CodeNodeLocked: http.StatusLocked,
+}
+
+// errorCodes gives the error code of the gRPC status returned without
+// a HeadscaleError.
+var errorCodes = map[codes.Code]types.ErrorCode{
+	codes.InvalidArgument:    types.CodeInvalidArgument,
+	codes.NotFound:           types.CodeNotFound,
+	codes.AlreadyExists:      types.CodeAlreadyExists,
+	codes.FailedPrecondition: types.CodeFailedPrecondition,
+	codes.PermissionDenied:   types.CodePermissionDenied,
+	codes.Unauthenticated:    types.CodeUnauthenticated,
+	codes.Unavailable:        types.CodeUnavailable,
+	codes.Unimplemented:      types.CodeUnimplemented,
+	codes.DeadlineExceeded:   types.CodeDeadlineExceeded,
+	codes.Canceled:           types.CodeCanceled,
+	codes.ResourceExhausted:  types.CodeQuotaExceeded,
+}
+
+// grpcError returns err as a gRPC status with code, carrying the error
+// code of the HeadscaleError wrapped in err if there is one.
+func grpcError(code codes.Code, err error) error {
+	var hsErr *types.HeadscaleError
+	if errors.As(err, &hsErr) {
+		return statusWithErrorCode(code, hsErr.Code, err.Error(), hsErr.Details)
+	}
+
+	return status.Error(code, err.Error())
+}
+
+// apiError converts err to the gRPC status returned by the API, with
+// its error code in an ErrorInfo detail.
+func apiError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var hsErr *types.HeadscaleError
+	switch {
+	case errors.As(err, &hsErr):
+		code, ok := grpcCodes[hsErr.Code]
+		if !ok {
+			code = codes.Internal
+		}
+
+		return statusWithErrorCode(code, hsErr.Code, err.Error(), hsErr.Details)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return statusWithErrorCode(codes.NotFound, types.CodeNotFound, err.Error(), nil)
+	}
+
+	st := status.Convert(err)
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.GetDomain() == apiErrorDomain {
+			return err
+		}
+	}
+
+	errorCode, ok := errorCodes[st.Code()]
+	if !ok {
+		errorCode = types.CodeInternal
+	}
+
+	return statusWithErrorCode(st.Code(), errorCode, st.Message(), nil)
+}
+
+func statusWithErrorCode(
+	code codes.Code,
+	errorCode types.ErrorCode,
+	message string,
+	details map[string]interface{},
+) error {
+	info := &errdetails.ErrorInfo{
+		Reason: string(errorCode),
+		Domain: apiErrorDomain,
+	}
+	if len(details) > 0 {
+		info.Metadata = make(map[string]string, len(details))
+		for key, value := range details {
+			info.Metadata[key] = fmt.Sprint(value)
+		}
+	}
+
+	st, err := status.New(code, message).WithDetails(info)
+	if err != nil {
+		return status.Error(code, message)
+	}
+
+	return st.Err()
+}
+
+// apiErrorInterceptor makes all the errors returned by the gRPC API
+// carry an error code.
+func apiErrorInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return resp, apiError(err)
+	}
+
+	return resp, nil
+}
+
+// apiErrorResponse is the body of the HTTP API error responses.
+type apiErrorResponse struct {
+	Error *types.HeadscaleError `json:"error"`
+}
+
+// headscaleErrorFromStatus returns the HeadscaleError described by a
+// gRPC status returned by the API.
+func headscaleErrorFromStatus(st *status.Status) *types.HeadscaleError {
+	errorCode, ok := errorCodes[st.Code()]
+	if !ok {
+		errorCode = types.CodeInternal
+	}
+	hsErr := types.NewHeadscaleError(errorCode, st.Message())
+
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.GetDomain() != apiErrorDomain {
+			continue
+		}
+
+		hsErr.Code = types.ErrorCode(info.GetReason())
+		if len(info.GetMetadata()) > 0 {
+			hsErr.Details = make(map[string]interface{}, len(info.GetMetadata()))
+			for key, value := range info.GetMetadata() {
+				hsErr.Details[key] = value
+			}
+		}
+	}
+
+	return hsErr
+}
+
+// writeAPIError writes err as the JSON error response of the HTTP API.
+func writeAPIError(writer http.ResponseWriter, httpStatus int, err *types.HeadscaleError) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(httpStatus)
+
+	if err := json.NewEncoder(writer).Encode(apiErrorResponse{Error: err}); err != nil {
+		log.Error().
+			Caller().
+			Err(err).
+			Msg("Failed to write response")
+	}
+}
+
+// grpcGatewayErrorHandler writes the errors of the gRPC gateway as
+// {"error": {"code": ..., "message": ..., "details": ...}}.
+func grpcGatewayErrorHandler(
+	ctx context.Context,
+	mux *grpcRuntime.ServeMux,
+	marshaler grpcRuntime.Marshaler,
+	writer http.ResponseWriter,
+	req *http.Request,
+	err error,
+) {
+	var httpStatus int
+	var httpErr *grpcRuntime.HTTPStatusError
+	if errors.As(err, &httpErr) {
+		httpStatus = httpErr.HTTPStatus
+		err = httpErr.Err
+	}
+
+	st := status.Convert(apiError(err))
+	hsErr := headscaleErrorFromStatus(st)
+	if httpStatus == 0 {
+		httpStatus = grpcRuntime.HTTPStatusFromCode(st.Code())
+		if override, ok := httpStatuses[hsErr.Code]; ok {
+			httpStatus = override
+		}
+	}
+
+	writeAPIError(writer, httpStatus, hsErr)
+}
@@ -0,0 +1,136 @@
+package hscontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode codes.Code
+		wantErr  types.ErrorCode
+	}{
+		{
+			name:     "headscale-error",
+			err:      db.ErrUserNotFound,
+			wantCode: codes.NotFound,
+			wantErr:  types.CodeUserNotFound,
+		},
+		{
+			name:     "wrapped-headscale-error",
+			err:      fmt.Errorf("renaming user: %w", db.ErrUserExists),
+			wantCode: codes.AlreadyExists,
+			wantErr:  types.CodeUserExists,
+		},
+		{
+			name:     "record-not-found",
+			err:      gorm.ErrRecordNotFound,
+			wantCode: codes.NotFound,
+			wantErr:  types.CodeNotFound,
+		},
+		{
+			name:     "status",
+			err:      status.Error(codes.InvalidArgument, "bad request"),
+			wantCode: codes.InvalidArgument,
+			wantErr:  types.CodeInvalidArgument,
+		},
+		{
+			name:     "plain-error",
+			err:      errors.New("boom"),
+			wantCode: codes.Unknown,
+			wantErr:  types.CodeInternal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := status.Convert(apiError(tt.err))
+			if st.Code() != tt.wantCode {
+				t.Errorf("status code: want %s, got %s", tt.wantCode, st.Code())
+			}
+
+			var reason string
+			for _, detail := range st.Details() {
+				if info, ok := detail.(*errdetails.ErrorInfo); ok {
+					reason = info.GetReason()
+				}
+			}
+			if reason != string(tt.wantErr) {
+				t.Errorf("error code: want %s, got %s", tt.wantErr, reason)
+			}
+
+			// Converting an API error again must not change it.
+			if got := status.Convert(apiError(st.Err())); len(got.Details()) != 1 {
+				t.Errorf("converting twice: want 1 detail, got %d", len(got.Details()))
+			}
+		})
+	}
+}
+
+func TestGRPCGatewayErrorHandler(t *testing.T) {
+	err := types.ErrQuotaExceeded.WithDetails(map[string]interface{}{
+		"retry_after_seconds": 3,
+	})
+
+	recorder := httptest.NewRecorder()
+	grpcGatewayErrorHandler(
+		nil,
+		nil,
+		nil,
+		recorder,
+		httptest.NewRequest(http.MethodGet, "/api/v1/user", nil),
+		err,
+	)
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("HTTP status: want %d, got %d", http.StatusTooManyRequests, recorder.Code)
+	}
+
+	var got apiErrorResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding response: %s", err)
+	}
+
+	want := apiErrorResponse{
+		Error: &types.HeadscaleError{
+			Code:    types.CodeQuotaExceeded,
+			Message: "too many requests",
+			Details: map[string]interface{}{
+				"retry_after_seconds": "3",
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected response (-want +got):\n%s", diff)
+	}
+}
+
+func TestGRPCGatewayErrorHandlerLockedNode(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	grpcGatewayErrorHandler(
+		nil,
+		nil,
+		nil,
+		recorder,
+		httptest.NewRequest(http.MethodDelete, "/api/v1/node/1", nil),
+		apiError(db.ErrNodeLocked),
+	)
+
+	if recorder.Code != http.StatusLocked {
+		t.Errorf("HTTP status: want %d, got %d", http.StatusLocked, recorder.Code)
+	}
+}
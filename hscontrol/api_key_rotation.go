@@ -0,0 +1,240 @@
+package hscontrol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// apiKeyRotationInterval is how often the API keys close to their
+	// expiry are looked for.
+	apiKeyRotationInterval = time.Hour
+
+	// defaultAPIKeyExpiration is the lifetime of the API keys created or
+	// renewed without an expiration, the default of the CLI.
+	defaultAPIKeyExpiration = 90 * 24 * time.Hour
+
+	apiKeyDirectoryMode = 0o700
+)
+
+var errAPIKeyRotationWebhookBadStatus = errors.New("API key rotation webhook returned unexpected status")
+
+// apiKeyRotationRequest is the body POSTed to the API key rotation
+// webhook with a new key.
+type apiKeyRotationRequest struct {
+	APIKey     string    `json:"api_key"`
+	Prefix     string    `json:"prefix"`
+	Expiration time.Time `json:"expiration"`
+	Replaces   string    `json:"replaces"`
+}
+
+// rotateAPIKeysWorker rotates the API keys close to their expiry every
+// interval.
+func (h *Headscale) rotateAPIKeysWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		h.rotateAPIKeys(context.Background(), time.Now())
+	}
+}
+
+// rotateAPIKeys issues a new key for every API key expiring within
+// BeforeExpiry and delivers it. The new key is deleted if it cannot be
+// delivered, the rotation is tried again on the next run.
+func (h *Headscale) rotateAPIKeys(ctx context.Context, now time.Time) {
+	cfg := h.cfg.APIKeyRotation
+
+	keys, err := h.db.ListAPIKeysToRotate(now, cfg.BeforeExpiry)
+	if err != nil {
+		log.Error().Err(err).Msg("database error while listing API keys to rotate")
+
+		return
+	}
+
+	for index := range keys {
+		key := &keys[index]
+
+		expiration := now.Add(cfg.Expiration)
+		keyStr, newKey, err := h.db.CreateAPIKey(&expiration)
+		if err != nil {
+			log.Error().Err(err).Str("prefix", key.Prefix).Msg("Failed to create API key to rotate key")
+
+			continue
+		}
+
+		err = deliverRotatedAPIKey(ctx, cfg, apiKeyRotationRequest{
+			APIKey:     keyStr,
+			Prefix:     newKey.Prefix,
+			Expiration: expiration,
+			Replaces:   key.Prefix,
+		})
+		if err != nil {
+			log.Error().Err(err).Str("prefix", key.Prefix).Msg("Failed to deliver rotated API key")
+
+			if err := h.db.DestroyAPIKey(*newKey); err != nil {
+				log.Error().Err(err).Str("prefix", newKey.Prefix).Msg("Failed to delete undelivered API key")
+			}
+
+			continue
+		}
+
+		if err := h.db.SetAPIKeyRotated(key, now); err != nil {
+			log.Error().Err(err).Str("prefix", key.Prefix).Msg("Failed to mark API key as rotated")
+
+			continue
+		}
+
+		log.Info().
+			Str("prefix", key.Prefix).
+			Str("new_prefix", newKey.Prefix).
+			Time("expiration", expiration).
+			Msg("API key rotated")
+	}
+}
+
+// deliverRotatedAPIKey POSTs the new key to the webhook of the
+// configuration and writes it to the file of the directory holding the
+// key it replaces. The file is only replaced once the webhook has
+// accepted the key, so it never holds a key which is deleted because it
+// could not be delivered.
+func deliverRotatedAPIKey(
+	ctx context.Context,
+	cfg types.APIKeyRotationConfig,
+	req apiKeyRotationRequest,
+) error {
+	var path, tmpPath string
+	if cfg.Directory != "" {
+		if err := os.MkdirAll(cfg.Directory, apiKeyDirectoryMode); err != nil {
+			return fmt.Errorf("creating API key directory: %w", err)
+		}
+
+		var err error
+		path, err = apiKeyFilePath(cfg.Directory, req.Replaces)
+		if err != nil {
+			return err
+		}
+
+		tmpPath, err = writeAPIKeyTempFile(path, req.APIKey)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmpPath)
+	}
+
+	if cfg.WebhookURL != "" {
+		if err := callAPIKeyRotationWebhook(ctx, cfg, req); err != nil {
+			return err
+		}
+	}
+
+	if tmpPath != "" {
+		if err := os.Rename(tmpPath, path); err != nil {
+			return fmt.Errorf("replacing API key file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// apiKeyFilePath returns the file of directory holding the key with the
+// prefix replaces, so the successive keys of a rotation are written to
+// the same file. The first rotation of a key writes to the file named
+// after its prefix, so the keys rotated in the same run do not overwrite
+// each other.
+func apiKeyFilePath(directory string, replaces string) (string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return "", fmt.Errorf("reading API key directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		// The temporary files of the keys being written are hidden.
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(directory, entry.Name())
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading API key file: %w", err)
+		}
+
+		if strings.HasPrefix(strings.TrimSpace(string(content)), replaces+".") {
+			return path, nil
+		}
+	}
+
+	return filepath.Join(directory, replaces), nil
+}
+
+// writeAPIKeyTempFile writes key to a temporary file next to path,
+// readable only by headscale, which replaces path at once when renamed
+// so readers never see a partial key.
+func writeAPIKeyTempFile(path string, key string) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return "", fmt.Errorf("creating API key file: %w", err)
+	}
+
+	if _, err := tmp.WriteString(key + "\n"); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+
+		return "", fmt.Errorf("writing API key file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+
+		return "", fmt.Errorf("writing API key file: %w", err)
+	}
+
+	return tmp.Name(), nil
+}
+
+func callAPIKeyRotationWebhook(
+	ctx context.Context,
+	cfg types.APIKeyRotationConfig,
+	req apiKeyRotationRequest,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.WebhookTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{
+		Timeout: cfg.WebhookTimeout,
+	}
+
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode < http.StatusOK || httpResp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %s", errAPIKeyRotationWebhookBadStatus, httpResp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestRotateAPIKeys(c *check.C) {
+	var received []apiKeyRotationRequest
+	fail := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req apiKeyRotationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			c.Errorf("decoding webhook request: %s", err)
+		}
+
+		received = append(received, req)
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	keyDir := filepath.Join(tmpDir, "api_keys")
+	app.cfg.APIKeyRotation = types.APIKeyRotationConfig{
+		Enabled:        true,
+		BeforeExpiry:   7 * 24 * time.Hour,
+		Expiration:     90 * 24 * time.Hour,
+		Directory:      keyDir,
+		WebhookURL:     server.URL,
+		WebhookTimeout: 5 * time.Second,
+	}
+
+	now := time.Now()
+	soon := now.Add(24 * time.Hour)
+	_, expiring, err := app.db.CreateAPIKey(&soon)
+	c.Assert(err, check.IsNil)
+
+	later := now.Add(30 * 24 * time.Hour)
+	_, _, err = app.db.CreateAPIKey(&later)
+	c.Assert(err, check.IsNil)
+
+	// The new key is deleted if the webhook fails, and not written.
+	fail = true
+	app.rotateAPIKeys(context.Background(), now)
+
+	keys, err := app.db.ListAPIKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 2)
+	c.Assert(received, check.HasLen, 1)
+
+	entries, err := os.ReadDir(keyDir)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 0)
+
+	fail = false
+	app.rotateAPIKeys(context.Background(), now)
+
+	c.Assert(received, check.HasLen, 2)
+	rotated := received[1]
+	c.Assert(rotated.Replaces, check.Equals, expiring.Prefix)
+
+	content, err := os.ReadFile(filepath.Join(keyDir, expiring.Prefix))
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.TrimSpace(string(content)), check.Equals, rotated.APIKey)
+
+	valid, err := app.db.ValidateAPIKey(rotated.APIKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(valid, check.Equals, true)
+
+	key, err := app.db.GetAPIKey(expiring.Prefix)
+	c.Assert(err, check.IsNil)
+	c.Assert(key.RotatedAt, check.NotNil)
+
+	// A key is only rotated once.
+	app.rotateAPIKeys(context.Background(), now)
+	c.Assert(received, check.HasLen, 2)
+
+	keys, err = app.db.ListAPIKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 3)
+
+	// Every key is written to the file of the key it replaces, without
+	// overwriting the keys rotated before.
+	_, other, err := app.db.CreateAPIKey(&soon)
+	c.Assert(err, check.IsNil)
+
+	app.rotateAPIKeys(context.Background(), now)
+	c.Assert(received, check.HasLen, 3)
+	c.Assert(received[2].Replaces, check.Equals, other.Prefix)
+
+	content, err = os.ReadFile(filepath.Join(keyDir, other.Prefix))
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.TrimSpace(string(content)), check.Equals, received[2].APIKey)
+
+	content, err = os.ReadFile(filepath.Join(keyDir, expiring.Prefix))
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.TrimSpace(string(content)), check.Equals, rotated.APIKey)
+
+	// The key replacing a rotated key is written to the same file.
+	app.rotateAPIKeys(context.Background(), now.Add(85*24*time.Hour))
+
+	var rotatedAgain *apiKeyRotationRequest
+	for index := range received {
+		if received[index].Replaces == rotated.Prefix {
+			rotatedAgain = &received[index]
+		}
+	}
+	c.Assert(rotatedAgain, check.NotNil)
+
+	content, err = os.ReadFile(filepath.Join(keyDir, expiring.Prefix))
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.TrimSpace(string(content)), check.Equals, rotatedAgain.APIKey)
+
+	_, err = os.Stat(filepath.Join(keyDir, rotated.Prefix))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
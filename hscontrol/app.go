@@ -1,11 +1,13 @@
 package hscontrol
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
 	_ "net/http/pprof" //nolint
@@ -15,15 +17,18 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/getsentry/sentry-go"
 	"github.com/gorilla/mux"
 	grpcMiddleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpcRuntime "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/juanfont/headscale"
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/compress"
 	"github.com/juanfont/headscale/hscontrol/db"
 	"github.com/juanfont/headscale/hscontrol/derp"
 	derpServer "github.com/juanfont/headscale/hscontrol/derp/server"
@@ -32,9 +37,11 @@ import (
 	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/juanfont/headscale/ui"
 	"github.com/patrickmn/go-cache"
 	zerolog "github.com/philip-bui/grpc-zerolog"
 	"github.com/pkg/profile"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	zl "github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -46,6 +53,8 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection"
@@ -66,6 +75,9 @@ var (
 	errEmptyInitialDERPMap = errors.New(
 		"initial DERPMap is empty, Headscale requires at least one entry",
 	)
+	errNoACLPolicyPath        = errors.New("no ACL policy path configured")
+	errACLPolicyNotInDatabase = errors.New("the ACL policy is only stored in the database when policy.mode is database")
+	errInvalidACLPolicy       = errors.New("invalid ACL policy")
 )
 
 const (
@@ -74,8 +86,12 @@ const (
 	privateKeyFileMode = 0o600
 	headscaleDirPerm   = 0o700
 
-	registerCacheExpiration = time.Minute * 15
-	registerCacheCleanup    = time.Minute * 20
+	registerCacheCleanup = time.Minute * 20
+	staleNodeGCInterval  = time.Hour
+
+	// derpMapCheckTimeout is how long the DERP servers of a changed
+	// DERP map file have to accept a connection.
+	derpMapCheckTimeout = 10 * time.Second
 )
 
 // func init() {
@@ -90,18 +106,55 @@ type Headscale struct {
 	ipAlloc         *db.IPAllocator
 	noisePrivateKey *key.MachinePrivate
 
-	DERPMap    *tailcfg.DERPMap
+	// previousNoisePrivateKey is the key in use before the last key
+	// rotation, still accepted for clients that have not picked up
+	// the new one.
+	previousNoisePrivateKey *key.MachinePrivate
+
+	// derpMap is the DERPMap served to the nodes, read by the map
+	// requests while it is replaced by the DERP map updates, which
+	// derpMapMu serialises.
+	derpMap    atomic.Pointer[tailcfg.DERPMap]
+	derpMapMu  sync.Mutex
 	DERPServer *derpServer.DERPServer
 
 	ACLPolicy *policy.ACLPolicy
 
+	// aclPolicyMu serialises the changes to ACLPolicy, so a reload of
+	// the policy file is not overwritten by a concurrent change of the
+	// node groups.
+	aclPolicyMu sync.Mutex
+
 	mapper       *mapper.Mapper
 	nodeNotifier *notifier.Notifier
 
 	oidcProvider *oidc.Provider
 	oauth2Config *oauth2.Config
+	oidcPKCE     bool
+
+	registrationCache   *cache.Cache
+	registrationWaiters *registrationWaiters
+	nodeHeartbeats      *nodeHeartbeats
+
+	registrationURLSecret []byte
+
+	registerRateLimiter *rateLimiter
+	mapRateLimiter      *rateLimiter
+
+	// nodeStatusMonitor is nil if no online status webhook is
+	// configured.
+	nodeStatusMonitor *NodeStatusMonitor
 
-	registrationCache *cache.Cache
+	// sentryHub is nil if monitoring.sentry_dsn is not set.
+	sentryHub *sentry.Hub
+
+	// grpcHealthClient checks the local gRPC server for /healthz, it
+	// is nil until the server is started.
+	grpcHealthClient grpc_health_v1.HealthClient
+
+	// health is the last health check served by /healthz, it is nil
+	// until the first check is done.
+	health atomic.Pointer[healthResponse]
 
 	pollNetMapStreamWG sync.WaitGroup
 
@@ -127,18 +180,48 @@ func NewHeadscale(cfg *types.Config) (*Headscale, error) {
 		return nil, fmt.Errorf("failed to read or create Noise protocol private key: %w", err)
 	}
 
+	previousNoisePrivateKey, err := readPreviousPrivateKey(cfg.NoisePrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read previous Noise protocol private key: %w", err)
+	}
+
 	registrationCache := cache.New(
-		registerCacheExpiration,
+		cfg.NodeRegistrationTimeout,
 		registerCacheCleanup,
 	)
 
+	registrationURLSecret, err := newRegistrationURLSecret()
+	if err != nil {
+		return nil, err
+	}
+
 	app := Headscale{
-		cfg:                cfg,
-		noisePrivateKey:    noisePrivateKey,
-		registrationCache:  registrationCache,
-		pollNetMapStreamWG: sync.WaitGroup{},
-		nodeNotifier:       notifier.NewNotifier(),
-		mapSessions:        make(map[types.NodeID]*mapSession),
+		cfg:                     cfg,
+		noisePrivateKey:         noisePrivateKey,
+		previousNoisePrivateKey: previousNoisePrivateKey,
+		registrationCache:       registrationCache,
+		registrationWaiters:     newRegistrationWaiters(),
+		nodeHeartbeats:          newNodeHeartbeats(),
+		registrationURLSecret:   registrationURLSecret,
+		registerRateLimiter:     newRateLimiter(cfg.RateLimit.RegisterPerMinute),
+		mapRateLimiter:          newRateLimiter(cfg.RateLimit.MapPerMinute),
+		pollNetMapStreamWG:      sync.WaitGroup{},
+		nodeNotifier:            notifier.NewNotifier(),
+		mapSessions:             make(map[types.NodeID]*mapSession),
+	}
+
+	if cfg.OnlineStatusWebhook.URL != "" {
+		app.nodeStatusMonitor = newNodeStatusMonitor(cfg.OnlineStatusWebhook)
+	}
+
+	if cfg.Monitoring.SentryDSN != "" {
+		hub, err := newSentryHub(sentry.ClientOptions{
+			Dsn: cfg.Monitoring.SentryDSN,
+		})
+		if err != nil {
+			return nil, err
+		}
+		app.sentryHub = hub
 	}
 
 	app.db, err = db.NewHeadscaleDatabase(
@@ -148,11 +231,19 @@ func NewHeadscale(cfg *types.Config) (*Headscale, error) {
 		return nil, err
 	}
 
-	app.ipAlloc, err = db.NewIPAllocator(app.db, cfg.PrefixV4, cfg.PrefixV6, cfg.IPAllocation)
+	if err := app.db.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		return nil, fmt.Errorf("registering database pool metrics: %w", err)
+	}
+
+	app.ipAlloc, err = db.NewIPAllocator(app.db, cfg.PrefixV4, cfg.PrefixV6, cfg.IPAllocation, cfg.PerNodePrefixLen)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := app.loadPendingRegistrations(); err != nil {
+		return nil, fmt.Errorf("loading pending registrations: %w", err)
+	}
+
 	if cfg.OIDC.Issuer != "" {
 		err = app.initOIDC()
 		if err != nil {
@@ -217,37 +308,138 @@ func (h *Headscale) redirect(w http.ResponseWriter, req *http.Request) {
 	http.Redirect(w, req, target, http.StatusFound)
 }
 
-// deleteExpireEphemeralNodes deletes ephemeral node records that have not been
-// seen for longer than h.cfg.EphemeralNodeInactivityTimeout.
+// deleteExpireEphemeralNodes periodically deletes the ephemeral nodes
+// that have been disconnected for longer than
+// h.cfg.EphemeralNodeInactivityTimeout.
 func (h *Headscale) deleteExpireEphemeralNodes(milliSeconds int64) {
 	ticker := time.NewTicker(time.Duration(milliSeconds) * time.Millisecond)
 
 	for range ticker.C {
-		var removed []types.NodeID
-		var changed []types.NodeID
-		if err := h.db.DB.Transaction(func(tx *gorm.DB) error {
-			removed, changed = db.DeleteExpiredEphemeralNodes(tx, h.cfg.EphemeralNodeInactivityTimeout)
+		h.deleteInactiveEphemeralNodes()
+	}
+}
+
+// deleteInactiveEphemeralNodes deletes the ephemeral nodes that have
+// been disconnected for longer than h.cfg.EphemeralNodeInactivityTimeout
+// and removes them from the maps of their peers. Ephemeral nodes logging
+// out are deleted right away by handleNodeLogOut.
+func (h *Headscale) deleteInactiveEphemeralNodes() {
+	var removed []types.NodeID
+	var changed []types.NodeID
+	if err := h.db.Write(func(tx *gorm.DB) error {
+		removed, changed = db.DeleteExpiredEphemeralNodes(
+			tx,
+			h.cfg.EphemeralNodeInactivityTimeout,
+			h.nodeNotifier.ConnectedMap(),
+		)
+
+		return nil
+	}); err != nil {
+		log.Error().Err(err).Msg("database error while expiring ephemeral nodes")
+		h.captureException(context.Background(), err)
+
+		return
+	}
+
+	if removed != nil {
+		h.nodeStatusMonitor.forget(removed...)
+
+		ctx := types.NotifyCtx(context.Background(), "expire-ephemeral", "na")
+		h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+			Type:    types.StatePeerRemoved,
+			Removed: removed,
+		})
+	}
+
+	if changed != nil {
+		ctx := types.NotifyCtx(context.Background(), "expire-ephemeral", "na")
+		h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: changed,
+		})
+	}
+}
+
+// gcStaleNodes periodically deletes the nodes that have not been seen
+// for longer than h.cfg.GC.StaleNodeExpiry.
+func (h *Headscale) gcStaleNodes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		if _, err := h.deleteStaleNodes(h.cfg.GC.StaleNodeExpiry, false); err != nil {
+			log.Error().Err(err).Msg("database error while deleting stale nodes")
+			h.captureException(context.Background(), err)
+		}
+	}
+}
+
+// deleteStaleNodes deletes the nodes that are disconnected and have not
+// been seen for longer than expiry, releases their IPs and removes them
+// from the maps of their peers. With dryRun, the stale nodes are only
+// returned. Every deleted node is logged.
+func (h *Headscale) deleteStaleNodes(expiry time.Duration, dryRun bool) (types.Nodes, error) {
+	stale, changed, err := h.db.DeleteStaleNodes(expiry, h.nodeNotifier.ConnectedMap(), dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun || len(stale) == 0 {
+		return stale, nil
+	}
+
+	removed := make([]types.NodeID, 0, len(stale))
+	for _, node := range stale {
+		h.ipAlloc.Release(node.IPv4, node.IPv6)
+		removed = append(removed, node.ID)
+
+		log.Info().
+			Str("event", "node-gc").
+			Uint64("node.id", node.ID.Uint64()).
+			Str("node", node.Hostname).
+			Str("user", node.User.Name).
+			Time("last_seen", *node.LastSeen).
+			Dur("stale_node_expiry", expiry).
+			Msg("Stale node removed from database")
+	}
+
+	h.nodeStatusMonitor.forget(removed...)
+
+	ctx := types.NotifyCtx(context.Background(), "gc-stale-nodes", "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type:    types.StatePeerRemoved,
+		Removed: removed,
+	})
+
+	if changed != nil {
+		h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: changed,
+		})
+	}
+
+	return stale, nil
+}
+
+// releaseExpiredRequestedIPs periodically frees the IPs reserved for the
+// pre auth keys which expired before being used.
+func (h *Headscale) releaseExpiredRequestedIPs(intervalMs int64) {
+	ticker := time.NewTicker(time.Duration(intervalMs) * time.Millisecond)
+
+	for range ticker.C {
+		ips, err := h.db.ClearExpiredRequestedIPs(time.Now())
+		if err != nil {
+			log.Error().Err(err).Msg("database error while releasing the IPs of expired pre auth keys")
+			h.captureException(context.Background(), err)
 
-			return nil
-		}); err != nil {
-			log.Error().Err(err).Msg("database error while expiring ephemeral nodes")
 			continue
 		}
 
-		if removed != nil {
-			ctx := types.NotifyCtx(context.Background(), "expire-ephemeral", "na")
-			h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
-				Type:    types.StatePeerRemoved,
-				Removed: removed,
-			})
+		for index := range ips {
+			h.ipAlloc.Release(&ips[index])
 		}
 
-		if changed != nil {
-			ctx := types.NotifyCtx(context.Background(), "expire-ephemeral", "na")
-			h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
-				Type:        types.StatePeerChanged,
-				ChangeNodes: changed,
-			})
+		if len(ips) > 0 {
+			log.Debug().Int("ips", len(ips)).Msg("Released the IPs of expired pre auth keys")
 		}
 	}
 }
@@ -263,17 +455,18 @@ func (h *Headscale) expireExpiredMachines(intervalMs int64) {
 	var changed bool
 
 	for range ticker.C {
-		if err := h.db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := h.db.Write(func(tx *gorm.DB) error {
 			lastCheck, update, changed = db.ExpireExpiredNodes(tx, lastCheck)
 
 			return nil
 		}); err != nil {
 			log.Error().Err(err).Msg("database error while expiring nodes")
+			h.captureException(context.Background(), err)
 			continue
 		}
 
 		if changed {
-			log.Trace().Interface("nodes", update.ChangePatches).Msgf("expiring nodes")
+			log.Trace().Interface("nodes", update.ChangeNodes).Msgf("expiring nodes")
 
 			ctx := types.NotifyCtx(context.Background(), "expire-expired", "na")
 			h.nodeNotifier.NotifyAll(ctx, update)
@@ -281,6 +474,36 @@ func (h *Headscale) expireExpiredMachines(intervalMs int64) {
 	}
 }
 
+// failoverStaleRoutes moves primary subnet routes away from nodes that
+// have not been seen for longer than h.cfg.RouteFailoverTimeout.
+func (h *Headscale) failoverStaleRoutes(intervalMs int64) {
+	interval := time.Duration(intervalMs) * time.Millisecond
+	ticker := time.NewTicker(interval)
+
+	failoverPolicy := db.RouteFailoverPolicy{Timeout: h.cfg.RouteFailoverTimeout}
+
+	for range ticker.C {
+		update, err := db.Write(h.db.DB, func(tx *gorm.DB) (*types.StateUpdate, error) {
+			return failoverPolicy.FailoverStaleRoutes(
+				tx,
+				h.nodeNotifier.ConnectedMap(),
+				h.nodeHeartbeats.snapshot(),
+				time.Now(),
+			)
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("database error while failing over stale routes")
+			h.captureException(context.Background(), err)
+			continue
+		}
+
+		if update != nil {
+			ctx := types.NotifyCtx(context.Background(), "route-failover", "na")
+			h.nodeNotifier.NotifyAll(ctx, *update)
+		}
+	}
+}
+
 // scheduledDERPMapUpdateWorker refreshes the DERPMap stored on the global object
 // at a set interval.
 func (h *Headscale) scheduledDERPMapUpdateWorker(cancelChan <-chan struct{}) {
@@ -296,21 +519,68 @@ func (h *Headscale) scheduledDERPMapUpdateWorker(cancelChan <-chan struct{}) {
 
 		case <-ticker.C:
 			log.Info().Msg("Fetching DERPMap updates")
-			h.DERPMap = derp.GetDERPMap(h.cfg.DERP)
-			if h.cfg.DERP.ServerEnabled && h.cfg.DERP.AutomaticallyAddEmbeddedDerpRegion {
-				region, _ := h.DERPServer.GenerateRegion()
-				h.DERPMap.Regions[region.RegionID] = &region
-			}
-
-			ctx := types.NotifyCtx(context.Background(), "derpmap-update", "na")
-			h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
-				Type:    types.StateDERPUpdated,
-				DERPMap: h.DERPMap,
-			})
+			h.setDERPMap(derp.GetDERPMap(h.cfg.DERP), "derpmap-update")
 		}
 	}
 }
 
+// reloadChangedDERPMap reloads the DERPMap after a change of the DERP
+// map files. The new DERPMap is only served if it can be loaded, is
+// valid and all its DERP servers can be reached, otherwise the DERPMap
+// in use is kept.
+func (h *Headscale) reloadChangedDERPMap() {
+	derpMap, err := derp.LoadDERPMap(h.cfg.DERP)
+	if err == nil {
+		err = derp.ValidateDERPMap(derpMap)
+	}
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), derpMapCheckTimeout)
+		err = derp.CheckDERPMapReachable(ctx, derpMap)
+		cancel()
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Strs("paths", h.cfg.DERP.Paths).
+			Msg("DERP map files changed but the new DERP map is invalid, keeping the DERP map in use")
+
+		return
+	}
+
+	log.Info().
+		Int("regions", len(derpMap.Regions)).
+		Msg("DERP map files changed, DERP map reloaded")
+
+	h.setDERPMap(derpMap, "derpmap-watcher")
+}
+
+// DERPMap returns the DERPMap served to the nodes.
+func (h *Headscale) DERPMap() *tailcfg.DERPMap {
+	return h.derpMap.Load()
+}
+
+// setDERPMap replaces the DERPMap served to the nodes, adding the
+// embedded DERP region if configured, and pushes it to all connected
+// nodes.
+func (h *Headscale) setDERPMap(derpMap *tailcfg.DERPMap, origin string) {
+	if h.cfg.DERP.ServerEnabled && h.cfg.DERP.AutomaticallyAddEmbeddedDerpRegion {
+		region, _ := h.DERPServer.GenerateRegion()
+		derpMap.Regions[region.RegionID] = &region
+	}
+
+	h.derpMapMu.Lock()
+	defer h.derpMapMu.Unlock()
+
+	h.derpMap.Store(derpMap)
+	h.mapper.SetDERPMap(derpMap)
+
+	ctx := types.NotifyCtx(context.Background(), origin, "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type:    types.StateDERPUpdated,
+		DERPMap: derpMap,
+	})
+}
+
 func (h *Headscale) grpcAuthenticationInterceptor(ctx context.Context,
 	req interface{},
 	info *grpc.UnaryServerInfo,
@@ -386,14 +656,11 @@ func (h *Headscale) httpAuthenticationMiddleware(next http.Handler) http.Handler
 				Caller().
 				Str("client_address", req.RemoteAddr).
 				Msg(`missing "Bearer " prefix in "Authorization" header`)
-			writer.WriteHeader(http.StatusUnauthorized)
-			_, err := writer.Write([]byte("Unauthorized"))
-			if err != nil {
-				log.Error().
-					Caller().
-					Err(err).
-					Msg("Failed to write response")
-			}
+			writeAPIError(
+				writer,
+				http.StatusUnauthorized,
+				types.NewHeadscaleError(types.CodeUnauthenticated, "Unauthorized"),
+			)
 
 			return
 		}
@@ -406,14 +673,11 @@ func (h *Headscale) httpAuthenticationMiddleware(next http.Handler) http.Handler
 				Str("client_address", req.RemoteAddr).
 				Msg("failed to validate token")
 
-			writer.WriteHeader(http.StatusInternalServerError)
-			_, err := writer.Write([]byte("Unauthorized"))
-			if err != nil {
-				log.Error().
-					Caller().
-					Err(err).
-					Msg("Failed to write response")
-			}
+			writeAPIError(
+				writer,
+				http.StatusInternalServerError,
+				types.NewHeadscaleError(types.CodeInternal, "Unauthorized"),
+			)
 
 			return
 		}
@@ -423,14 +687,11 @@ func (h *Headscale) httpAuthenticationMiddleware(next http.Handler) http.Handler
 				Str("client_address", req.RemoteAddr).
 				Msg("invalid token")
 
-			writer.WriteHeader(http.StatusUnauthorized)
-			_, err := writer.Write([]byte("Unauthorized"))
-			if err != nil {
-				log.Error().
-					Caller().
-					Err(err).
-					Msg("Failed to write response")
-			}
+			writeAPIError(
+				writer,
+				http.StatusUnauthorized,
+				types.NewHeadscaleError(types.CodeUnauthenticated, "Unauthorized"),
+			)
 
 			return
 		}
@@ -452,13 +713,23 @@ func (h *Headscale) ensureUnixSocketIsAbsent() error {
 
 func (h *Headscale) createRouter(grpcMux *grpcRuntime.ServeMux) *mux.Router {
 	router := mux.NewRouter()
+	router.Use(requestIDMiddleware)
+	if h.sentryHub != nil {
+		router.Use(sentryMiddleware(h.sentryHub))
+	}
+	if h.cfg.HTTPCompression.Enabled {
+		router.Use(compress.Middleware(h.cfg.HTTPCompression.MinSize))
+	}
 	router.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
 
 	router.HandleFunc(ts2021UpgradePath, h.NoiseUpgradeHandler).Methods(http.MethodPost)
 
 	router.HandleFunc("/health", h.HealthHandler).Methods(http.MethodGet)
+	router.HandleFunc("/healthz", h.HealthzHandler).Methods(http.MethodGet)
 	router.HandleFunc("/key", h.KeyHandler).Methods(http.MethodGet)
 	router.HandleFunc("/register/{mkey}", h.RegisterWebAPI).Methods(http.MethodGet)
+	router.HandleFunc("/register/confirm/{token}", h.RegisterURL).
+		Methods(http.MethodGet, http.MethodPost)
 
 	router.HandleFunc("/oidc/register/{mkey}", h.RegisterOIDC).Methods(http.MethodGet)
 	router.HandleFunc("/oidc/callback", h.OIDCCallback).Methods(http.MethodGet)
@@ -474,14 +745,18 @@ func (h *Headscale) createRouter(grpcMux *grpcRuntime.ServeMux) *mux.Router {
 	router.HandleFunc("/swagger/v1/openapiv2.json", headscale.SwaggerAPIv1).
 		Methods(http.MethodGet)
 
+	router.Handle("/admin", http.RedirectHandler("/admin/", http.StatusMovedPermanently))
+	router.PathPrefix("/admin/").Handler(ui.Handler("/admin"))
+
 	if h.cfg.DERP.ServerEnabled {
 		router.HandleFunc("/derp", h.DERPServer.DERPHandler)
 		router.HandleFunc("/derp/probe", derpServer.DERPProbeHandler)
-		router.HandleFunc("/bootstrap-dns", derpServer.DERPBootstrapDNSHandler(h.DERPMap))
+		router.HandleFunc("/bootstrap-dns", derpServer.DERPBootstrapDNSHandler(h.DERPMap()))
 	}
 
 	apiRouter := router.PathPrefix("/api").Subrouter()
 	apiRouter.Use(h.httpAuthenticationMiddleware)
+	apiRouter.HandleFunc("/v1/derp/regions", h.DERPRegionsHandler).Methods(http.MethodPut)
 	apiRouter.PathPrefix("/v1/").HandlerFunc(grpcMux.ServeHTTP)
 
 	router.PathPrefix("/").HandlerFunc(notFoundHandler)
@@ -489,6 +764,424 @@ func (h *Headscale) createRouter(grpcMux *grpcRuntime.ServeMux) *mux.Router {
 	return router
 }
 
+// updateNodeGroups sets the node groups of the database in the ACL
+// policy, it is called when the policy is loaded and when the node
+// groups change.
+// Deleting the last node of a node group, like an ephemeral node, removes
+// the group while the policy may still reference it. Such groups are kept
+// empty, with a warning, instead of failing the startup.
+// The policy is not refused when its tests do not hold with the new node
+// groups, they are only checked when the policy is reloaded or set, a
+// warning is logged instead.
+func (h *Headscale) updateNodeGroups() error {
+	h.aclPolicyMu.Lock()
+	defer h.aclPolicyMu.Unlock()
+
+	if h.ACLPolicy == nil {
+		return h.setACLPolicy(nil)
+	}
+
+	validated, err := h.validateACLPolicy(h.ACLPolicy)
+	if errors.Is(err, policy.ErrInvalidGroup) {
+		members, membersErr := h.db.NodeGroupMembers()
+		if membersErr != nil {
+			return membersErr
+		}
+
+		withEmptyGroups := *h.ACLPolicy
+		withEmptyGroups.NodeGroups = members
+
+		undefined := withEmptyGroups.UndefinedNodeGroups()
+		if len(undefined) == 0 {
+			return err
+		}
+
+		withEmptyGroups.Groups = maps.Clone(h.ACLPolicy.Groups)
+		if withEmptyGroups.Groups == nil {
+			withEmptyGroups.Groups = policy.Groups{}
+		}
+		for _, group := range undefined {
+			withEmptyGroups.Groups[group] = []string{}
+		}
+
+		log.Warn().
+			Strs("groups", undefined).
+			Msg("ACL policy references groups which are not defined, they may be node groups whose last node was deleted, using them as empty groups")
+
+		validated, err = h.validateACLPolicy(&withEmptyGroups)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := h.runACLPolicyTests(validated); err != nil {
+		log.Warn().
+			Err(err).
+			Msg("ACL policy tests do not hold with the current nodes and node groups")
+	}
+
+	h.ACLPolicy = validated
+
+	return nil
+}
+
+// loadACLPolicy reads the ACL policy from the policy file or, when
+// policy.mode is database, from the database. There is no policy if none
+// has been stored in the database yet.
+func (h *Headscale) loadACLPolicy() (*policy.ACLPolicy, error) {
+	if h.cfg.ACL.PolicyMode == types.PolicyModeDB {
+		stored, err := h.db.GetPolicy()
+		if errors.Is(err, db.ErrPolicyNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return policy.LoadACLPolicyFromBytes([]byte(stored.Data), "hujson")
+	}
+
+	if h.cfg.ACL.PolicyPath == "" {
+		return nil, errNoACLPolicyPath
+	}
+
+	return policy.LoadACLPolicyFromPath(util.AbsolutePathFromConfigPath(h.cfg.ACL.PolicyPath))
+}
+
+// reloadACLPolicy reads the ACL policy again and, if it is valid,
+// replaces the current policy with it and sends the new packet filters
+// to all the nodes. The current policy is kept if the policy cannot be
+// loaded or is invalid.
+func (h *Headscale) reloadACLPolicy(ctx context.Context, origin string) error {
+	err := func() error {
+		h.aclPolicyMu.Lock()
+		defer h.aclPolicyMu.Unlock()
+
+		pol, err := h.loadACLPolicy()
+		if err != nil {
+			return err
+		}
+
+		return h.setACLPolicy(pol)
+	}()
+	if err != nil {
+		log.Error().
+			Str("mode", string(h.cfg.ACL.PolicyMode)).
+			Str("path", h.cfg.ACL.PolicyPath).
+			Str("origin", origin).
+			Err(err).
+			Msg("Failed to reload ACL policy, keeping the current policy")
+		h.captureException(ctx, err)
+
+		return err
+	}
+
+	log.Info().
+		Str("mode", string(h.cfg.ACL.PolicyMode)).
+		Str("path", h.cfg.ACL.PolicyPath).
+		Str("origin", origin).
+		Msg("ACL policy successfully reloaded, notifying nodes of change")
+
+	ctx = types.NotifyCtx(ctx, origin, "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+
+	return nil
+}
+
+// storeACLPolicy validates the ACL policy in the HuJSON format, stores
+// it in the database and applies it, sending the new packet filters to
+// all the nodes. Invalid policies are not stored.
+func (h *Headscale) storeACLPolicy(ctx context.Context, data string) (*types.Policy, error) {
+	if h.cfg.ACL.PolicyMode != types.PolicyModeDB {
+		return nil, errACLPolicyNotInDatabase
+	}
+
+	stored, err := func() (*types.Policy, error) {
+		h.aclPolicyMu.Lock()
+		defer h.aclPolicyMu.Unlock()
+
+		pol, err := policy.LoadACLPolicyFromBytes([]byte(data), "hujson")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidACLPolicy, err)
+		}
+
+		validated, err := h.validateACLPolicy(pol)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidACLPolicy, err)
+		}
+
+		if err := h.runACLPolicyTests(validated); err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidACLPolicy, err)
+		}
+
+		stored, err := h.db.SetPolicy(data)
+		if err != nil {
+			return nil, err
+		}
+
+		h.ACLPolicy = validated
+
+		return stored, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Uint64("version", stored.ID).
+		Msg("ACL policy stored in the database, notifying nodes of change")
+
+	ctx = types.NotifyCtx(ctx, "api-setpolicy", "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+
+	return stored, nil
+}
+
+// mergeUsers moves the nodes and pre auth keys of the user source to the
+// user destination, deletes source and replaces it by destination in the
+// ACL policy. The rewritten policy is validated, and stored in database
+// mode, in the transaction of the merge, so nothing changes if the
+// policy would be invalid. In file mode only the policy in use is
+// rewritten, the policy files have to be updated not to bring source back
+// on the next reload.
+func (h *Headscale) mergeUsers(
+	ctx context.Context,
+	source, destination string,
+	force bool,
+) (*types.User, []types.NodeID, error) {
+	h.aclPolicyMu.Lock()
+	defer h.aclPolicyMu.Unlock()
+
+	var data []byte
+	var pol *policy.ACLPolicy
+	var changed bool
+	if h.cfg.ACL.PolicyMode == types.PolicyModeDB {
+		stored, err := h.db.GetPolicy()
+		if err != nil && !errors.Is(err, db.ErrPolicyNotFound) {
+			return nil, nil, err
+		}
+
+		if stored != nil {
+			data, changed, err = policy.ReplaceUserHuJSON([]byte(stored.Data), source, destination)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: %w", errInvalidACLPolicy, err)
+			}
+		}
+
+		if changed {
+			pol, err = policy.LoadACLPolicyFromBytes(data, "hujson")
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: %w", errInvalidACLPolicy, err)
+			}
+		}
+	} else {
+		var err error
+		pol, changed, err = h.ACLPolicy.ReplaceUser(source, destination)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", errInvalidACLPolicy, err)
+		}
+	}
+
+	var validated *policy.ACLPolicy
+	if changed {
+		var err error
+		validated, err = h.validateACLPolicy(pol)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", errInvalidACLPolicy, err)
+		}
+	}
+
+	var user *types.User
+	var moved []types.NodeID
+	err := h.db.Write(func(tx *gorm.DB) error {
+		var err error
+		user, moved, err = db.MergeUsers(tx, source, destination, force)
+		if err != nil || validated == nil {
+			return err
+		}
+
+		nodes, err := db.ListNodes(tx)
+		if err != nil {
+			return err
+		}
+
+		if err := validated.RunTests(nodes); err != nil {
+			return fmt.Errorf("%w: %w", errInvalidACLPolicy, err)
+		}
+
+		if h.cfg.ACL.PolicyMode == types.PolicyModeDB {
+			if _, err := db.SetPolicy(tx, string(data)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if validated == nil {
+		return user, moved, nil
+	}
+
+	h.ACLPolicy = validated
+
+	if h.cfg.ACL.PolicyMode != types.PolicyModeDB {
+		log.Warn().
+			Str("path", h.cfg.ACL.PolicyPath).
+			Str("user", source).
+			Str("replaced_by", destination).
+			Msg("User replaced in the ACL policy in use, update the policy files to keep the change on reload")
+	}
+
+	ctx = types.NotifyCtx(ctx, "api-mergeusers", "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+
+	return user, moved, nil
+}
+
+// setACLPolicy replaces the ACL policy with pol, validated by
+// validateACLPolicy, if the assertions of its tests section hold.
+func (h *Headscale) setACLPolicy(pol *policy.ACLPolicy) error {
+	if pol == nil {
+		h.ACLPolicy = nil
+
+		// The node groups are only used by the groups of a policy.
+		members, err := h.db.NodeGroupMembers()
+		if err != nil {
+			return err
+		}
+		if len(members) > 0 {
+			log.Warn().
+				Int("node_groups", len(members)).
+				Msg("Node groups are defined but there is no ACL policy, they have no effect")
+		}
+
+		return nil
+	}
+
+	validated, err := h.validateACLPolicy(pol)
+	if err != nil {
+		return err
+	}
+
+	if err := h.runACLPolicyTests(validated); err != nil {
+		return err
+	}
+
+	h.ACLPolicy = validated
+
+	return nil
+}
+
+// validateACLPolicy returns pol with the node groups of the database,
+// if all the groups it references are defined, all the tags it
+// references have an owner, all the hosts it references are defined and
+// the ports of its destinations and its ssh rules are valid.
+func (h *Headscale) validateACLPolicy(pol *policy.ACLPolicy) (*policy.ACLPolicy, error) {
+	if err := pol.ValidateTags(); err != nil {
+		return nil, err
+	}
+
+	if err := pol.ValidateHosts(); err != nil {
+		return nil, err
+	}
+
+	if err := pol.ValidatePorts(); err != nil {
+		return nil, err
+	}
+
+	if err := pol.ValidateSSH(); err != nil {
+		return nil, err
+	}
+
+	members, err := h.db.NodeGroupMembers()
+	if err != nil {
+		return nil, err
+	}
+
+	return policyWithNodeGroups(pol, members)
+}
+
+// runACLPolicyTests checks the assertions of the tests section of pol
+// against the current nodes.
+func (h *Headscale) runACLPolicyTests(pol *policy.ACLPolicy) error {
+	nodes, err := h.db.ListNodes()
+	if err != nil {
+		return err
+	}
+
+	return pol.RunTests(nodes)
+}
+
+// policyWithNodeGroups returns a copy of pol with the members of the node
+// groups and its groups resolved, after checking that all the groups it
+// references are defined.
+// The policies of the users referencing undefined groups are logged and
+// left out.
+func policyWithNodeGroups(
+	pol *policy.ACLPolicy,
+	members map[string][]types.NodeID,
+) (*policy.ACLPolicy, error) {
+	withNodeGroups := *pol
+	withNodeGroups.NodeGroups = members
+
+	if err := withNodeGroups.ValidateGroups(); err != nil {
+		return nil, err
+	}
+
+	if err := withNodeGroups.ResolveGroups(); err != nil {
+		return nil, err
+	}
+
+	if len(pol.UserPolicies) > 0 {
+		withNodeGroups.UserPolicies = make(map[string]*policy.ACLPolicy, len(pol.UserPolicies))
+		for user, userPol := range pol.UserPolicies {
+			userWithNodeGroups := *userPol
+			userWithNodeGroups.NodeGroups = members
+
+			err := userWithNodeGroups.ValidateGroups()
+			if err == nil {
+				err = userWithNodeGroups.ResolveGroups()
+			}
+			if err != nil {
+				log.Error().
+					Err(err).
+					Str("user", user).
+					Msg("Invalid ACL policy of the user, ignoring it")
+
+				continue
+			}
+
+			withNodeGroups.UserPolicies[user] = &userWithNodeGroups
+		}
+	}
+
+	return &withNodeGroups, nil
+}
+
+// nodeGroupsChanged reloads the node groups in the ACL policy and sends
+// the new packet filters to all the nodes.
+func (h *Headscale) nodeGroupsChanged(ctx context.Context, origin string) {
+	if err := h.updateNodeGroups(); err != nil {
+		log.Error().Err(err).Msg("Failed to reload node groups")
+
+		return
+	}
+
+	ctx = types.NotifyCtx(ctx, origin, "na")
+	h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+}
+
 // Serve launches the HTTP and gRPC server service Headscale and the API.
 func (h *Headscale) Serve() error {
 	if _, enableProfile := os.LookupEnv("HEADSCALE_PROFILING_ENABLED"); enableProfile {
@@ -506,9 +1199,19 @@ func (h *Headscale) Serve() error {
 
 	var err error
 
+	if h.cfg.ACL.PolicyMode == types.PolicyModeDB {
+		h.ACLPolicy, err = h.loadACLPolicy()
+		if err != nil {
+			return fmt.Errorf("loading ACL policy from the database: %w", err)
+		}
+	}
+
+	if err := h.updateNodeGroups(); err != nil {
+		return fmt.Errorf("loading ACL policy: %w", err)
+	}
+
 	// Fetch an initial DERP Map before we start serving
-	h.DERPMap = derp.GetDERPMap(h.cfg.DERP)
-	h.mapper = mapper.NewMapper(h.db, h.cfg, h.DERPMap, h.nodeNotifier.ConnectedMap())
+	derpMap := derp.GetDERPMap(h.cfg.DERP)
 
 	if h.cfg.DERP.ServerEnabled {
 		// When embedded DERP is enabled we always need a STUN server
@@ -522,19 +1225,33 @@ func (h *Headscale) Serve() error {
 		}
 
 		if h.cfg.DERP.AutomaticallyAddEmbeddedDerpRegion {
-			h.DERPMap.Regions[region.RegionID] = &region
+			derpMap.Regions[region.RegionID] = &region
 		}
 
 		go h.DERPServer.ServeSTUN()
 	}
 
+	h.derpMap.Store(derpMap)
+	h.mapper = mapper.NewMapper(h.db, h.cfg, derpMap, h.nodeNotifier.ConnectedMap())
+
 	if h.cfg.DERP.AutoUpdate {
 		derpMapCancelChannel := make(chan struct{})
 		defer func() { derpMapCancelChannel <- struct{}{} }()
 		go h.scheduledDERPMapUpdateWorker(derpMapCancelChannel)
 	}
 
-	if len(h.DERPMap.Regions) == 0 {
+	if h.cfg.DERP.WatchPaths && len(h.cfg.DERP.Paths) > 0 {
+		watcher, err := derp.NewDERPMapWatcher(h.cfg.DERP.Paths, h.reloadChangedDERPMap)
+		if err != nil {
+			return err
+		}
+
+		watchCtx, cancelWatch := context.WithCancel(context.Background())
+		defer cancelWatch()
+		go watcher.Run(watchCtx)
+	}
+
+	if len(derpMap.Regions) == 0 {
 		return errEmptyInitialDERPMap
 	}
 
@@ -542,6 +1259,21 @@ func (h *Headscale) Serve() error {
 	// up on shutdown.
 	go h.deleteExpireEphemeralNodes(updateInterval)
 	go h.expireExpiredMachines(updateInterval)
+	go h.releaseExpiredRequestedIPs(updateInterval)
+
+	if h.cfg.RouteFailoverTimeout > 0 {
+		go h.failoverStaleRoutes(updateInterval)
+	}
+
+	if h.cfg.GC.StaleNodeExpiry > 0 {
+		go h.gcStaleNodes(staleNodeGCInterval)
+	}
+
+	if h.cfg.APIKeyRotation.Enabled {
+		go h.rotateAPIKeysWorker(apiKeyRotationInterval)
+	}
+
+	go h.pruneTrafficStatsWorker(trafficStatsPruneInterval)
 
 	if zl.GlobalLevel() == zl.TraceLevel {
 		zerolog.RespLog = true
@@ -556,6 +1288,10 @@ func (h *Headscale) Serve() error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	if h.nodeStatusMonitor != nil {
+		go h.nodeStatusMonitor.run(ctx)
+	}
+
 	//
 	//
 	// Set up LOCAL listeners
@@ -582,7 +1318,9 @@ func (h *Headscale) Serve() error {
 		return fmt.Errorf("failed change permission of gRPC socket: %w", err)
 	}
 
-	grpcGatewayMux := grpcRuntime.NewServeMux()
+	grpcGatewayMux := grpcRuntime.NewServeMux(
+		grpcRuntime.WithErrorHandler(grpcGatewayErrorHandler),
+	)
 
 	// Make the grpc-gateway connect to grpc over socket
 	grpcGatewayConn, err := grpc.Dial(
@@ -605,13 +1343,21 @@ func (h *Headscale) Serve() error {
 
 	// Start the local gRPC server without TLS and without authentication
 	grpcSocket := grpc.NewServer(
-	// Uncomment to debug grpc communication.
-	// zerolog.UnaryInterceptor(),
+		grpc.UnaryInterceptor(apiErrorInterceptor),
+		// Uncomment to debug grpc communication.
+		// zerolog.UnaryInterceptor(),
 	)
 
 	v1.RegisterHeadscaleServiceServer(grpcSocket, newHeadscaleV1APIServer(h))
+	grpc_health_v1.RegisterHealthServer(grpcSocket, health.NewServer())
 	reflection.Register(grpcSocket)
 
+	h.grpcHealthClient = grpc_health_v1.NewHealthClient(grpcGatewayConn)
+
+	// The health checks use the gRPC health client, they start once it
+	// is set.
+	go h.healthCheckWorker(ctx, healthCheckInterval)
+
 	errorGroup.Go(func() error { return grpcSocket.Serve(socketListener) })
 
 	//
@@ -619,7 +1365,7 @@ func (h *Headscale) Serve() error {
 	// Set up REMOTE listeners
 	//
 
-	tlsConfig, err := h.getTLSSettings()
+	tlsConfig, err := h.getTLSSettings(ctx)
 	if err != nil {
 		return fmt.Errorf("configuring TLS settings: %w", err)
 	}
@@ -644,6 +1390,7 @@ func (h *Headscale) Serve() error {
 		grpcOptions := []grpc.ServerOption{
 			grpc.UnaryInterceptor(
 				grpcMiddleware.ChainUnaryServer(
+					apiErrorInterceptor,
 					h.grpcAuthenticationInterceptor,
 					// Uncomment to debug grpc communication.
 					// zerolog.NewUnaryServerInterceptor(),
@@ -731,6 +1478,7 @@ func (h *Headscale) Serve() error {
 
 		return
 	})
+	debugMux.HandleFunc("/debug/filter", h.DebugFilterHandler)
 	debugMux.Handle("/metrics", promhttp.Handler())
 
 	debugHTTPServer := &http.Server{
@@ -784,22 +1532,9 @@ func (h *Headscale) Serve() error {
 
 				// TODO(kradalby): Reload config on SIGHUP
 
-				if h.cfg.ACL.PolicyPath != "" {
-					aclPath := util.AbsolutePathFromConfigPath(h.cfg.ACL.PolicyPath)
-					pol, err := policy.LoadACLPolicyFromPath(aclPath)
-					if err != nil {
-						log.Error().Err(err).Msg("Failed to reload ACL policy")
-					}
-
-					h.ACLPolicy = pol
-					log.Info().
-						Str("path", aclPath).
-						Msg("ACL policy successfully reloaded, notifying nodes of change")
-
-					ctx := types.NotifyCtx(context.Background(), "acl-sighup", "na")
-					h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
-						Type: types.StateFullUpdate,
-					})
+				if h.cfg.ACL.PolicyPath != "" || h.cfg.ACL.PolicyMode == types.PolicyModeDB {
+					// Failures are logged, the current policy is kept.
+					_ = h.reloadACLPolicy(context.Background(), "acl-sighup")
 				}
 
 			default:
@@ -845,6 +1580,10 @@ func (h *Headscale) Serve() error {
 					log.Error().Err(err).Msg("Failed to close db")
 				}
 
+				if h.sentryHub != nil {
+					h.sentryHub.Flush(sentryFlushTimeout)
+				}
+
 				log.Info().
 					Msg("Headscale stopped")
 
@@ -864,9 +1603,18 @@ func (h *Headscale) Serve() error {
 	return errorGroup.Wait()
 }
 
-func (h *Headscale) getTLSSettings() (*tls.Config, error) {
+func (h *Headscale) getTLSSettings(ctx context.Context) (*tls.Config, error) {
 	var err error
-	if h.cfg.TLS.LetsEncrypt.Hostname != "" {
+	if h.cfg.TLS.ACME.Domain != "" {
+		if !strings.HasPrefix(h.cfg.ServerURL, "https://") {
+			log.Warn().
+				Msg("Listening with TLS but ServerURL does not start with https://")
+		}
+
+		// Certificates obtained with the DNS-01 challenge do not need
+		// headscale to be reachable by the CA.
+		return h.StartACMEAutoRenew(ctx)
+	} else if h.cfg.TLS.LetsEncrypt.Hostname != "" {
 		if !strings.HasPrefix(h.cfg.ServerURL, "https://") {
 			log.Warn().
 				Msg("Listening with TLS but ServerURL does not start with https://")
@@ -994,3 +1742,155 @@ func readOrCreatePrivateKey(path string) (*key.MachinePrivate, error) {
 
 	return &machineKey, nil
 }
+
+// previousPrivateKeyPath returns where the key replaced by the last
+// rotation of the private key at path is kept.
+func previousPrivateKeyPath(path string) string {
+	return path + ".previous"
+}
+
+// readPreviousPrivateKey reads the key replaced by the last rotation of the
+// private key at path. It returns nil if the key has never been rotated, or
+// the previous key has been removed.
+func readPreviousPrivateKey(path string) (*key.MachinePrivate, error) {
+	previousPath := previousPrivateKeyPath(path)
+
+	privateKey, err := os.ReadFile(previousPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil //nolint:nilnil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read private key file: %w", err)
+	}
+
+	var machineKey key.MachinePrivate
+	if err = machineKey.UnmarshalText(bytes.TrimSpace(privateKey)); err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	log.Warn().
+		Str("path", previousPath).
+		Msg("Accepting connections using the previous Noise private key, remove the file once all clients have reconnected")
+
+	return &machineKey, nil
+}
+
+// ServerPublicKeys returns the public key of the private key at path, and
+// of the previous key kept by RotatePrivateKey, nil if there is none.
+func ServerPublicKeys(path string) (key.MachinePublic, *key.MachinePublic, error) {
+	current, err := readPrivateKey(path)
+	if err != nil {
+		return key.MachinePublic{}, nil, err
+	}
+
+	previous, err := readPrivateKey(previousPrivateKeyPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return current.Public(), nil, nil
+	} else if err != nil {
+		return key.MachinePublic{}, nil, err
+	}
+
+	previousPublic := previous.Public()
+
+	return current.Public(), &previousPublic, nil
+}
+
+func readPrivateKey(path string) (*key.MachinePrivate, error) {
+	privateKey, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key file: %w", err)
+	}
+
+	var machineKey key.MachinePrivate
+	if err = machineKey.UnmarshalText(bytes.TrimSpace(privateKey)); err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	return &machineKey, nil
+}
+
+// RotatePrivateKey replaces the private key at path with a newly generated
+// one and returns the path of a timestamped backup of the old key.
+// If keepPrevious is set, the old key is also kept next to the new one, so
+// that headscale keeps accepting clients that still use it after it is
+// restarted. Otherwise a previous key kept by an earlier rotation is
+// removed, and clients using the old key are disconnected until they
+// fetch the new one.
+func RotatePrivateKey(path string, keepPrevious bool) (string, error) {
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read private key file: %w", err)
+	}
+
+	var currentKey key.MachinePrivate
+	if err = currentKey.UnmarshalText(bytes.TrimSpace(current)); err != nil {
+		return "", fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	backupPath := fmt.Sprintf("%s.%s", path, time.Now().UTC().Format("20060102T150405Z"))
+	if err := writeFileAtomic(backupPath, current, privateKeyFileMode); err != nil {
+		return "", fmt.Errorf("failed to back up private key: %w", err)
+	}
+
+	if keepPrevious {
+		if err := writeFileAtomic(previousPrivateKeyPath(path), current, privateKeyFileMode); err != nil {
+			return "", fmt.Errorf("failed to save previous private key: %w", err)
+		}
+	} else {
+		err := os.Remove(previousPrivateKeyPath(path))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("failed to remove previous private key: %w", err)
+		}
+	}
+
+	machineKeyStr, err := key.NewMachine().MarshalText()
+	if err != nil {
+		return "", fmt.Errorf(
+			"failed to convert private key to string for saving: %w",
+			err,
+		)
+	}
+
+	if err := writeFileAtomic(path, machineKeyStr, privateKeyFileMode); err != nil {
+		return "", fmt.Errorf(
+			"failed to save private key to disk at path %q: %w",
+			path,
+			err,
+		)
+	}
+
+	return backupPath, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory
+// and renames it to path, so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+
+		return err
+	}
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
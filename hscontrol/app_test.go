@@ -0,0 +1,79 @@
+package hscontrol
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatePrivateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "noise_private.key")
+
+	oldKey, err := readOrCreatePrivateKey(path)
+	if err != nil {
+		t.Fatalf("creating private key: %s", err)
+	}
+
+	previous, err := readPreviousPrivateKey(path)
+	if err != nil {
+		t.Fatalf("reading previous private key: %s", err)
+	}
+	if previous != nil {
+		t.Fatalf("expected no previous private key before rotation")
+	}
+
+	backupPath, err := RotatePrivateKey(path, true)
+	if err != nil {
+		t.Fatalf("rotating private key: %s", err)
+	}
+
+	newKey, err := readOrCreatePrivateKey(path)
+	if err != nil {
+		t.Fatalf("reading rotated private key: %s", err)
+	}
+	if newKey.Equal(*oldKey) {
+		t.Fatalf("private key was not changed by rotation")
+	}
+
+	backup, err := os.ReadFile(backupPath)
+	if err != nil {
+		t.Fatalf("reading backup: %s", err)
+	}
+	oldKeyStr, _ := oldKey.MarshalText()
+	if string(backup) != string(oldKeyStr) {
+		t.Fatalf("backup does not contain the old private key")
+	}
+
+	previous, err = readPreviousPrivateKey(path)
+	if err != nil {
+		t.Fatalf("reading previous private key: %s", err)
+	}
+	if previous == nil || !previous.Equal(*oldKey) {
+		t.Fatalf("previous private key is not the old private key")
+	}
+
+	current, previousPublic, err := ServerPublicKeys(path)
+	if err != nil {
+		t.Fatalf("reading server public keys: %s", err)
+	}
+	if current != newKey.Public() {
+		t.Fatalf("server public key is not the public key of the new private key")
+	}
+	if previousPublic == nil || *previousPublic != oldKey.Public() {
+		t.Fatalf("previous server public key is not the public key of the old private key")
+	}
+
+	// Rotating without keeping the previous key stops accepting both
+	// older keys.
+	if _, err := RotatePrivateKey(path, false); err != nil {
+		t.Fatalf("rotating private key: %s", err)
+	}
+
+	_, previousPublic, err = ServerPublicKeys(path)
+	if err != nil {
+		t.Fatalf("reading server public keys: %s", err)
+	}
+	if previousPublic != nil {
+		t.Fatalf("expected no previous private key after rotating without keeping it")
+	}
+}
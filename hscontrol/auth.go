@@ -6,12 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/netip"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/db"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 	"tailscale.com/tailcfg"
@@ -19,11 +22,12 @@ import (
 )
 
 func logAuthFunc(
+	logger *zerolog.Logger,
 	registerRequest tailcfg.RegisterRequest,
 	machineKey key.MachinePublic,
 ) (func(string), func(string), func(error, string)) {
 	return func(msg string) {
-			log.Info().
+			logger.Info().
 				Caller().
 				Str("machine_key", machineKey.ShortString()).
 				Str("node_key", registerRequest.NodeKey.ShortString()).
@@ -34,7 +38,7 @@ func logAuthFunc(
 				Msg(msg)
 		},
 		func(msg string) {
-			log.Trace().
+			logger.Trace().
 				Caller().
 				Str("machine_key", machineKey.ShortString()).
 				Str("node_key", registerRequest.NodeKey.ShortString()).
@@ -45,7 +49,7 @@ func logAuthFunc(
 				Msg(msg)
 		},
 		func(err error, msg string) {
-			log.Error().
+			logger.Error().
 				Caller().
 				Str("machine_key", machineKey.ShortString()).
 				Str("node_key", registerRequest.NodeKey.ShortString()).
@@ -65,7 +69,8 @@ func (h *Headscale) handleRegister(
 	registerRequest tailcfg.RegisterRequest,
 	machineKey key.MachinePublic,
 ) {
-	logInfo, logTrace, logErr := logAuthFunc(registerRequest, machineKey)
+	logger := requestLogger(req.Context())
+	logInfo, logTrace, logErr := logAuthFunc(logger, registerRequest, machineKey)
 	now := time.Now().UTC()
 	logTrace("handleRegister called, looking up machine in DB")
 	node, err := h.db.GetNodeByAnyKey(machineKey, registerRequest.NodeKey, registerRequest.OldNodeKey)
@@ -73,32 +78,21 @@ func (h *Headscale) handleRegister(
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		// If the node has AuthKey set, handle registration via PreAuthKeys
 		if registerRequest.Auth.AuthKey != "" {
-			h.handleAuthKey(writer, registerRequest, machineKey)
+			h.handleAuthKey(writer, req, registerRequest, machineKey)
 
 			return
 		}
 
-		// Check if the node is waiting for interactive login.
-		//
-		// TODO(juan): We could use this field to improve our protocol implementation,
-		// and hold the request until the client closes it, or the interactive
-		// login is completed (i.e., the user registers the node).
-		// This is not implemented yet, as it is no strictly required. The only side-effect
-		// is that the client will hammer headscale with requests until it gets a
-		// successful RegisterResponse.
+		// Check if the node is waiting for interactive login, if so we hold
+		// the request until the login is completed instead of starting a new
+		// registration.
 		if registerRequest.Followup != "" {
 			logTrace("register request is a followup")
 			if _, ok := h.registrationCache.Get(machineKey.String()); ok {
 				logTrace("Node is waiting for interactive login")
+				h.handleFollowup(req, writer, registerRequest, machineKey)
 
-				select {
-				case <-req.Context().Done():
-					return
-				case <-time.After(registrationHoldoff):
-					h.handleNewNode(writer, registerRequest, machineKey)
-
-					return
-				}
+				return
 			}
 		}
 
@@ -132,13 +126,9 @@ func (h *Headscale) handleRegister(
 			newNode.Expiry = &registerRequest.Expiry
 		}
 
-		h.registrationCache.Set(
-			machineKey.String(),
-			newNode,
-			registerCacheExpiration,
-		)
+		h.cacheRegistration(machineKey, newNode)
 
-		h.handleNewNode(writer, registerRequest, machineKey)
+		h.handleNewNode(writer, req, registerRequest, machineKey)
 
 		return
 	}
@@ -153,7 +143,7 @@ func (h *Headscale) handleRegister(
 		// So if we have a not valid MachineKey (but we were able to fetch the node with the NodeKeys), we update it.
 		if err != nil || node.MachineKey.IsZero() {
 			if err := h.db.NodeSetMachineKey(node, machineKey); err != nil {
-				log.Error().
+				logger.Error().
 					Caller().
 					Str("func", "RegistrationHandler").
 					Str("node", node.Hostname).
@@ -174,7 +164,7 @@ func (h *Headscale) handleRegister(
 			//   https://github.com/tailscale/tailscale/blob/main/tailcfg/tailcfg.go#L648
 			if !registerRequest.Expiry.IsZero() &&
 				registerRequest.Expiry.UTC().Before(now) {
-				h.handleNodeLogOut(writer, *node, machineKey)
+				h.handleNodeLogOut(writer, req, *node, machineKey)
 
 				return
 			}
@@ -182,7 +172,7 @@ func (h *Headscale) handleRegister(
 			// If node is not expired, and it is register, we have a already accepted this node,
 			// let it proceed with a valid registration
 			if !node.IsExpired() {
-				h.handleNodeWithValidRegistration(writer, *node, machineKey)
+				h.handleNodeWithValidRegistration(writer, req, *node, machineKey)
 
 				return
 			}
@@ -193,6 +183,7 @@ func (h *Headscale) handleRegister(
 			!node.IsExpired() {
 			h.handleNodeKeyRefresh(
 				writer,
+				req,
 				registerRequest,
 				*node,
 				machineKey,
@@ -206,6 +197,7 @@ func (h *Headscale) handleRegister(
 			registerRequest.OldNodeKey.IsZero() && !node.IsExpired() {
 			h.handleNodeKeyRefresh(
 				writer,
+				req,
 				registerRequest,
 				*node,
 				machineKey,
@@ -215,6 +207,12 @@ func (h *Headscale) handleRegister(
 		}
 
 		if registerRequest.Followup != "" {
+			if _, ok := h.registrationCache.Get(machineKey.String()); ok {
+				h.handleFollowup(req, writer, registerRequest, machineKey)
+
+				return
+			}
+
 			select {
 			case <-req.Context().Done():
 				return
@@ -223,7 +221,7 @@ func (h *Headscale) handleRegister(
 		}
 
 		// The node has expired or it is logged out
-		h.handleNodeExpiredOrLoggedOut(writer, registerRequest, *node, machineKey)
+		h.handleNodeExpiredOrLoggedOut(writer, req, registerRequest, *node, machineKey)
 
 		// TODO(juan): RegisterRequest includes an Expiry time, that we could optionally use
 		node.Expiry = &time.Time{}
@@ -233,24 +231,23 @@ func (h *Headscale) handleRegister(
 		// TODO(juan): What happens when using fast user switching between two
 		// headscale-managed tailnets?
 		node.NodeKey = registerRequest.NodeKey
-		h.registrationCache.Set(
-			machineKey.String(),
-			*node,
-			registerCacheExpiration,
-		)
+		h.cacheRegistration(machineKey, *node)
 
 		return
 	}
 }
 
 // handleAuthKey contains the logic to manage auth key client registration
-// When using Noise, the machineKey is Zero.
+// When using Noise, the machineKey is Zero. The address the request came
+// from is given to the registration webhook.
 func (h *Headscale) handleAuthKey(
 	writer http.ResponseWriter,
+	req *http.Request,
 	registerRequest tailcfg.RegisterRequest,
 	machineKey key.MachinePublic,
 ) {
-	log.Debug().
+	logger := requestLogger(req.Context())
+	logger.Debug().
 		Caller().
 		Str("node", registerRequest.Hostinfo.Hostname).
 		Msgf("Processing auth key for %s", registerRequest.Hostinfo.Hostname)
@@ -258,57 +255,34 @@ func (h *Headscale) handleAuthKey(
 
 	pak, err := h.db.ValidatePreAuthKey(registerRequest.Auth.AuthKey)
 	if err != nil {
-		log.Error().
-			Caller().
-			Str("node", registerRequest.Hostinfo.Hostname).
-			Err(err).
-			Msg("Failed authentication via AuthKey")
-		resp.MachineAuthorized = false
-
-		respBody, err := json.Marshal(resp)
-		if err != nil {
-			log.Error().
-				Caller().
-				Str("node", registerRequest.Hostinfo.Hostname).
-				Err(err).
-				Msg("Cannot encode message")
-			http.Error(writer, "Internal server error", http.StatusInternalServerError)
-			nodeRegistrations.WithLabelValues("new", util.RegisterMethodAuthKey, "error", pak.User.Name).
-				Inc()
-
-			return
-		}
-
-		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
-		writer.WriteHeader(http.StatusUnauthorized)
-		_, err = writer.Write(respBody)
-		if err != nil {
-			log.Error().
-				Caller().
-				Err(err).
-				Msg("Failed to write response")
-		}
-
-		log.Error().
-			Caller().
-			Str("node", registerRequest.Hostinfo.Hostname).
-			Msg("Failed authentication via AuthKey")
-
-		if pak != nil {
-			nodeRegistrations.WithLabelValues("new", util.RegisterMethodAuthKey, "error", pak.User.Name).
-				Inc()
-		} else {
-			nodeRegistrations.WithLabelValues("new", util.RegisterMethodAuthKey, "error", "unknown").Inc()
-		}
+		h.handleAuthKeyError(writer, req, registerRequest, pak, err)
 
 		return
 	}
 
-	log.Debug().
+	logger.Debug().
 		Caller().
 		Str("node", registerRequest.Hostinfo.Hostname).
 		Msg("Authentication key was valid, proceeding to acquire IP addresses")
 
+	webhookReq := newRegistrationWebhookRequest(
+		machineKey,
+		registerRequest.NodeKey,
+		registerRequest.Hostinfo,
+		pak.User.Name,
+		pak.Proto().GetAclTags(),
+		util.RegisterMethodAuthKey,
+	)
+	webhookReq.SourceIP = sourceIP(req.RemoteAddr)
+
+	// The registration is authorized even if the node gives up waiting.
+	err = authorizeRegistration(context.WithoutCancel(req.Context()), h.cfg.RegistrationWebhook, webhookReq)
+	if err != nil {
+		h.handleAuthKeyError(writer, req, registerRequest, pak, err)
+
+		return
+	}
+
 	nodeKey := registerRequest.NodeKey
 
 	// retrieve node information if it exist
@@ -317,39 +291,45 @@ func (h *Headscale) handleAuthKey(
 	// on to registration.
 	node, _ := h.db.GetNodeByAnyKey(machineKey, registerRequest.NodeKey, registerRequest.OldNodeKey)
 	if node != nil {
-		log.Trace().
+		logger.Trace().
 			Caller().
 			Str("node", node.Hostname).
 			Msg("node was already registered before, refreshing with new auth key")
 
-		node.NodeKey = nodeKey
-		node.AuthKeyID = uint(pak.ID)
-		err := h.db.NodeSetExpiry(node.ID, registerRequest.Expiry)
-		if err != nil {
-			log.Error().
-				Caller().
-				Str("node", node.Hostname).
-				Err(err).
-				Msg("Failed to refresh node")
+		if node.UserID != pak.User.ID {
+			h.handleAuthKeyError(writer, req, registerRequest, pak, db.ErrDifferentRegisteredUser)
 
 			return
 		}
 
-		aclTags := pak.Proto().GetAclTags()
-		if len(aclTags) > 0 {
-			// This conditional preserves the existing behaviour, although SaaS would reset the tags on auth-key login
-			err = h.db.SetTags(node.ID, aclTags)
+		node.NodeKey = nodeKey
+		node.AuthKeyID = uint(pak.ID)
 
-			if err != nil {
-				log.Error().
-					Caller().
-					Str("node", node.Hostname).
-					Strs("aclTags", aclTags).
-					Err(err).
-					Msg("Failed to set tags after refreshing node")
+		// The key is used in the transaction refreshing the node, so a
+		// single use key is not consumed by a refresh that failed.
+		err := h.db.Write(func(tx *gorm.DB) error {
+			if err := db.UsePreAuthKey(tx, pak); err != nil {
+				return err
+			}
 
-				return
+			if err := db.NodeSetExpiry(tx, node.ID, registerRequest.Expiry); err != nil {
+				return fmt.Errorf("refreshing node: %w", err)
+			}
+
+			aclTags := pak.Proto().GetAclTags()
+			if len(aclTags) > 0 {
+				// This conditional preserves the existing behaviour, although SaaS would reset the tags on auth-key login
+				if err := db.SetTags(tx, node.ID, aclTags); err != nil {
+					return fmt.Errorf("setting tags %v after refreshing node: %w", aclTags, err)
+				}
 			}
+
+			return nil
+		})
+		if err != nil {
+			h.handleAuthKeyError(writer, req, registerRequest, pak, err)
+
+			return
 		}
 
 		ctx := types.NotifyCtx(context.Background(), "handle-authkey", "na")
@@ -359,12 +339,7 @@ func (h *Headscale) handleAuthKey(
 
 		givenName, err := h.db.GenerateGivenName(machineKey, registerRequest.Hostinfo.Hostname)
 		if err != nil {
-			log.Error().
-				Caller().
-				Str("func", "RegistrationHandler").
-				Str("hostinfo.name", registerRequest.Hostinfo.Hostname).
-				Err(err).
-				Msg("Failed to generate given name for node")
+			h.handleAuthKeyError(writer, req, registerRequest, pak, fmt.Errorf("generating given name: %w", err))
 
 			return
 		}
@@ -381,50 +356,76 @@ func (h *Headscale) handleAuthKey(
 			LastSeen:       &now,
 			AuthKeyID:      uint(pak.ID),
 			ForcedTags:     pak.Proto().GetAclTags(),
+			Hostinfo:       registerRequest.Hostinfo,
 		}
 
-		ipv4, ipv6, err := h.ipAlloc.Next()
-		if err != nil {
-			log.Error().
-				Caller().
-				Str("func", "RegistrationHandler").
-				Str("hostinfo.name", registerRequest.Hostinfo.Hostname).
-				Err(err).
-				Msg("failed to allocate IP	")
+		// The IP requested by the key has been reserved when
+		// the key was created.
+		var requestedIP *netip.Addr
+		if pak.RequestedIP != "" {
+			ip, err := netip.ParseAddr(pak.RequestedIP)
+			if err != nil {
+				h.handleAuthKeyError(
+					writer,
+					req,
+					registerRequest,
+					pak,
+					fmt.Errorf("parsing IP requested by pre auth key: %w", err),
+				)
 
-			return
+				return
+			}
+			requestedIP = &ip
 		}
 
-		node, err = h.db.RegisterNode(
-			nodeToRegister,
-			ipv4, ipv6,
-		)
+		ipv4, ipv6, err := h.ipAlloc.NextWith(requestedIP)
 		if err != nil {
-			log.Error().
-				Caller().
-				Err(err).
-				Msg("could not register node")
-			nodeRegistrations.WithLabelValues("new", util.RegisterMethodAuthKey, "error", pak.User.Name).
-				Inc()
-			http.Error(writer, "Internal server error", http.StatusInternalServerError)
+			h.handleAuthKeyError(writer, req, registerRequest, pak, err)
 
 			return
 		}
-	}
 
-	err = h.db.DB.Transaction(func(tx *gorm.DB) error {
-		return db.UsePreAuthKey(tx, pak)
-	})
-	if err != nil {
-		log.Error().
-			Caller().
-			Err(err).
-			Msg("Failed to use pre-auth key")
-		nodeRegistrations.WithLabelValues("new", util.RegisterMethodAuthKey, "error", pak.User.Name).
-			Inc()
-		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		// The key is used in the transaction registering the node, so
+		// concurrent registrations cannot register several nodes with
+		// a single use key.
+		node, err = db.Write(h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+			if err := db.UsePreAuthKey(tx, pak); err != nil {
+				return nil, err
+			}
 
-		return
+			node, err := db.RegisterNode(tx, nodeToRegister, ipv4, ipv6)
+			if err != nil {
+				return nil, err
+			}
+
+			// The routes advertised at registration are saved, and
+			// approved by the autoApprovers, before the node
+			// connects.
+			if _, err := db.SaveNodeRoutes(tx, node); err != nil {
+				return nil, err
+			}
+
+			if h.ACLPolicy != nil {
+				if err := db.EnableAutoApprovedRoutes(tx, h.ACLPolicy, node); err != nil {
+					return nil, err
+				}
+			}
+
+			return node, nil
+		})
+		if err != nil {
+			// The IP requested by the key stays reserved for the key,
+			// the others are handed out again.
+			for _, ip := range []*netip.Addr{ipv4, ipv6} {
+				if ip != nil && (requestedIP == nil || *ip != *requestedIP) {
+					h.ipAlloc.Release(ip)
+				}
+			}
+
+			h.handleAuthKeyError(writer, req, registerRequest, pak, err)
+
+			return
+		}
 	}
 
 	resp.MachineAuthorized = true
@@ -435,7 +436,7 @@ func (h *Headscale) handleAuthKey(
 
 	respBody, err := json.Marshal(resp)
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Str("node", registerRequest.Hostinfo.Hostname).
 			Err(err).
@@ -452,27 +453,101 @@ func (h *Headscale) handleAuthKey(
 	writer.WriteHeader(http.StatusOK)
 	_, err = writer.Write(respBody)
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Failed to write response")
 		return
 	}
 
-	log.Info().
+	logger.Info().
 		Str("node", registerRequest.Hostinfo.Hostname).
 		Msg("Successfully authenticated via AuthKey")
 }
 
+// registrationInternalError is the reason given to the clients whose
+// registration failed on an internal error, the error is only logged.
+const registrationInternalError = "internal server error, see the headscale logs"
+
+// registrationErrorMessage returns the reason given to the client of a
+// failed registration. The errors headscale returns on purpose, like an
+// expired key or a denied registration, are explained to the client, the
+// others, from the database or parsing, are replaced by a generic message.
+func registrationErrorMessage(err error) string {
+	if errors.Is(err, ErrRegistrationDenied) {
+		return err.Error()
+	}
+
+	var hsErr *types.HeadscaleError
+	if errors.As(err, &hsErr) && hsErr.Code != types.CodeInternal {
+		return hsErr.Message
+	}
+
+	return registrationInternalError
+}
+
+// handleAuthKeyError answers a registration with the pre auth key pak
+// which failed with err, pak is nil if the key was not found. The reason
+// is in the Error of the response, which is only shown by the client if
+// the status is 200.
+func (h *Headscale) handleAuthKeyError(
+	writer http.ResponseWriter,
+	req *http.Request,
+	registerRequest tailcfg.RegisterRequest,
+	pak *types.PreAuthKey,
+	err error,
+) {
+	logger := requestLogger(req.Context())
+	logger.Error().
+		Caller().
+		Str("node", registerRequest.Hostinfo.Hostname).
+		Err(err).
+		Msg("Failed authentication via AuthKey")
+
+	userName := "unknown"
+	if pak != nil {
+		userName = pak.User.Name
+	}
+	nodeRegistrations.WithLabelValues("new", util.RegisterMethodAuthKey, "error", userName).
+		Inc()
+
+	respBody, err := json.Marshal(tailcfg.RegisterResponse{
+		MachineAuthorized: false,
+		Error:             registrationErrorMessage(err),
+	})
+	if err != nil {
+		logger.Error().
+			Caller().
+			Str("node", registerRequest.Hostinfo.Hostname).
+			Err(err).
+			Msg("Cannot encode message")
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(respBody)
+	if err != nil {
+		logger.Error().
+			Caller().
+			Err(err).
+			Msg("Failed to write response")
+	}
+}
+
 // handleNewNode returns the authorisation URL to the client based on what type
 // of registration headscale is configured with.
 // This url is then showed to the user by the local Tailscale client.
 func (h *Headscale) handleNewNode(
 	writer http.ResponseWriter,
+	req *http.Request,
 	registerRequest tailcfg.RegisterRequest,
 	machineKey key.MachinePublic,
 ) {
-	logInfo, logTrace, logErr := logAuthFunc(registerRequest, machineKey)
+	logger := requestLogger(req.Context())
+	logInfo, logTrace, logErr := logAuthFunc(logger, registerRequest, machineKey)
 
 	resp := tailcfg.RegisterResponse{}
 
@@ -509,21 +584,171 @@ func (h *Headscale) handleNewNode(
 	logInfo(fmt.Sprintf("Successfully sent auth url: %s", resp.AuthURL))
 }
 
+// handleFollowup holds a followup register request until the interactive
+// registration of the node is completed through the web, CLI or OIDC flow.
+// If it is not completed within registrationFollowupTimeout, the client is
+// sent the same AuthURL again and will follow up with a new request.
+func (h *Headscale) handleFollowup(
+	req *http.Request,
+	writer http.ResponseWriter,
+	registerRequest tailcfg.RegisterRequest,
+	machineKey key.MachinePublic,
+) {
+	logger := requestLogger(req.Context())
+	_, logTrace, _ := logAuthFunc(logger, registerRequest, machineKey)
+
+	registered, release := h.registrationWaiters.wait(machineKey)
+	defer release()
+
+	// The registration can complete between the lookup of the node and
+	// the registration of the waiter, look the node up again so the
+	// completion is not missed.
+	if node, err := h.db.GetNodeByMachineKey(machineKey); err == nil &&
+		node.NodeKey == registerRequest.NodeKey && !node.IsExpired() {
+		h.handleNodeWithValidRegistration(writer, req, *node, machineKey)
+
+		return
+	}
+
+	select {
+	case <-req.Context().Done():
+		return
+	case <-time.After(registrationFollowupTimeout):
+		h.handleNewNode(writer, req, registerRequest, machineKey)
+
+		return
+	case <-registered:
+		logTrace("Interactive registration completed, answering followup")
+	}
+
+	node, err := h.db.GetNodeByMachineKey(machineKey)
+	if err != nil {
+		h.handleNewNode(writer, req, registerRequest, machineKey)
+
+		return
+	}
+
+	h.handleNodeWithValidRegistration(writer, req, *node, machineKey)
+}
+
+// registrationWaiters lets followup register requests wait for the
+// interactive registration of a machine key to complete.
+type registrationWaiters struct {
+	mu      sync.Mutex
+	waiters map[key.MachinePublic]*registrationWaiter
+}
+
+type registrationWaiter struct {
+	registered chan struct{}
+	waiting    int
+}
+
+func newRegistrationWaiters() *registrationWaiters {
+	return &registrationWaiters{
+		waiters: make(map[key.MachinePublic]*registrationWaiter),
+	}
+}
+
+// wait returns a channel that is closed when the registration of the
+// machine key is completed, and a function to call once the caller stops
+// waiting, so the machine keys that are never registered are forgotten.
+func (r *registrationWaiters) wait(machineKey key.MachinePublic) (<-chan struct{}, func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	waiter, ok := r.waiters[machineKey]
+	if !ok {
+		waiter = &registrationWaiter{registered: make(chan struct{})}
+		r.waiters[machineKey] = waiter
+	}
+	waiter.waiting++
+
+	return waiter.registered, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		waiter.waiting--
+		if waiter.waiting == 0 && r.waiters[machineKey] == waiter {
+			delete(r.waiters, machineKey)
+		}
+	}
+}
+
+// done releases all the requests waiting for the registration of the
+// machine key.
+func (r *registrationWaiters) done(machineKey key.MachinePublic) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if waiter, ok := r.waiters[machineKey]; ok {
+		close(waiter.registered)
+		delete(r.waiters, machineKey)
+	}
+}
+
+// cacheRegistration adds a node waiting for an interactive registration
+// to the registration cache, and stores it in the database so it is
+// still pending after a restart.
+func (h *Headscale) cacheRegistration(machineKey key.MachinePublic, node types.Node) {
+	h.registrationCache.Set(
+		machineKey.String(),
+		node,
+		h.cfg.NodeRegistrationTimeout,
+	)
+
+	err := h.db.SavePendingRegistration(
+		machineKey.String(),
+		node,
+		time.Now().Add(h.cfg.NodeRegistrationTimeout),
+	)
+	if err != nil {
+		log.Error().
+			Caller().
+			Err(err).
+			Str("machine_key", machineKey.ShortString()).
+			Msg("Failed to persist pending registration, it will be lost on restart")
+	}
+}
+
+// loadPendingRegistrations puts the pending registrations stored in the
+// database back into the registration cache, keeping their original
+// expiry.
+func (h *Headscale) loadPendingRegistrations() error {
+	now := time.Now()
+
+	regs, err := h.db.ListPendingRegistrations(now)
+	if err != nil {
+		return err
+	}
+
+	for _, reg := range regs {
+		h.registrationCache.Set(reg.MachineKey, reg.Node, reg.Expiry.Sub(now))
+	}
+
+	log.Debug().
+		Int("count", len(regs)).
+		Msg("Loaded pending registrations")
+
+	return nil
+}
+
 func (h *Headscale) handleNodeLogOut(
 	writer http.ResponseWriter,
+	req *http.Request,
 	node types.Node,
 	machineKey key.MachinePublic,
 ) {
+	logger := requestLogger(req.Context())
 	resp := tailcfg.RegisterResponse{}
 
-	log.Info().
+	logger.Info().
 		Str("node", node.Hostname).
 		Msg("Client requested logout")
 
 	now := time.Now()
 	err := h.db.NodeSetExpiry(node.ID, now)
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Failed to expire node")
@@ -533,7 +758,7 @@ func (h *Headscale) handleNodeLogOut(
 	}
 
 	ctx := types.NotifyCtx(context.Background(), "logout-expiry", "na")
-	h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdateExpire(node.ID, now), node.ID)
+	h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdateExpired(node.ID), node.ID)
 
 	resp.AuthURL = ""
 	resp.MachineAuthorized = false
@@ -541,7 +766,7 @@ func (h *Headscale) handleNodeLogOut(
 	resp.User = *node.User.TailscaleUser()
 	respBody, err := json.Marshal(resp)
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Cannot encode message")
@@ -554,7 +779,7 @@ func (h *Headscale) handleNodeLogOut(
 	writer.WriteHeader(http.StatusOK)
 	_, err = writer.Write(respBody)
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Failed to write response")
@@ -565,12 +790,19 @@ func (h *Headscale) handleNodeLogOut(
 	if node.IsEphemeral() {
 		changedNodes, err := h.db.DeleteNode(&node, h.nodeNotifier.ConnectedMap())
 		if err != nil {
-			log.Error().
+			logger.Error().
 				Err(err).
 				Str("node", node.Hostname).
 				Msg("Cannot delete ephemeral node from the database")
 		}
 
+		logger.Info().
+			Uint64("node.id", node.ID.Uint64()).
+			Str("node", node.Hostname).
+			Msg("Ephemeral node logged out, removed from database")
+
+		h.nodeStatusMonitor.forget(node.ID)
+
 		ctx := types.NotifyCtx(context.Background(), "logout-ephemeral", "na")
 		h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
 			Type:    types.StatePeerRemoved,
@@ -586,7 +818,7 @@ func (h *Headscale) handleNodeLogOut(
 		return
 	}
 
-	log.Info().
+	logger.Info().
 		Caller().
 		Str("node", node.Hostname).
 		Msg("Successfully logged out")
@@ -594,13 +826,15 @@ func (h *Headscale) handleNodeLogOut(
 
 func (h *Headscale) handleNodeWithValidRegistration(
 	writer http.ResponseWriter,
+	req *http.Request,
 	node types.Node,
 	machineKey key.MachinePublic,
 ) {
+	logger := requestLogger(req.Context())
 	resp := tailcfg.RegisterResponse{}
 
 	// The node registration is valid, respond with redirect to /map
-	log.Debug().
+	logger.Debug().
 		Caller().
 		Str("node", node.Hostname).
 		Msg("Client is registered and we have the current NodeKey. All clear to /map")
@@ -612,7 +846,7 @@ func (h *Headscale) handleNodeWithValidRegistration(
 
 	respBody, err := json.Marshal(resp)
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Cannot encode message")
@@ -629,13 +863,13 @@ func (h *Headscale) handleNodeWithValidRegistration(
 	writer.WriteHeader(http.StatusOK)
 	_, err = writer.Write(respBody)
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Failed to write response")
 	}
 
-	log.Info().
+	logger.Info().
 		Caller().
 		Str("node", node.Hostname).
 		Msg("Node successfully authorized")
@@ -643,22 +877,24 @@ func (h *Headscale) handleNodeWithValidRegistration(
 
 func (h *Headscale) handleNodeKeyRefresh(
 	writer http.ResponseWriter,
+	req *http.Request,
 	registerRequest tailcfg.RegisterRequest,
 	node types.Node,
 	machineKey key.MachinePublic,
 ) {
+	logger := requestLogger(req.Context())
 	resp := tailcfg.RegisterResponse{}
 
-	log.Info().
+	logger.Info().
 		Caller().
 		Str("node", node.Hostname).
 		Msg("We have the OldNodeKey in the database. This is a key refresh")
 
-	err := h.db.DB.Transaction(func(tx *gorm.DB) error {
+	err := h.db.Write(func(tx *gorm.DB) error {
 		return db.NodeSetNodeKey(tx, &node, registerRequest.NodeKey)
 	})
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Failed to update machine key in the database")
@@ -671,7 +907,7 @@ func (h *Headscale) handleNodeKeyRefresh(
 	resp.User = *node.User.TailscaleUser()
 	respBody, err := json.Marshal(resp)
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Cannot encode message")
@@ -684,13 +920,13 @@ func (h *Headscale) handleNodeKeyRefresh(
 	writer.WriteHeader(http.StatusOK)
 	_, err = writer.Write(respBody)
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Failed to write response")
 	}
 
-	log.Info().
+	logger.Info().
 		Caller().
 		Str("node_key", registerRequest.NodeKey.ShortString()).
 		Str("old_node_key", registerRequest.OldNodeKey.ShortString()).
@@ -700,20 +936,22 @@ func (h *Headscale) handleNodeKeyRefresh(
 
 func (h *Headscale) handleNodeExpiredOrLoggedOut(
 	writer http.ResponseWriter,
+	req *http.Request,
 	registerRequest tailcfg.RegisterRequest,
 	node types.Node,
 	machineKey key.MachinePublic,
 ) {
+	logger := requestLogger(req.Context())
 	resp := tailcfg.RegisterResponse{}
 
 	if registerRequest.Auth.AuthKey != "" {
-		h.handleAuthKey(writer, registerRequest, machineKey)
+		h.handleAuthKey(writer, req, registerRequest, machineKey)
 
 		return
 	}
 
 	// The client has registered before, but has expired or logged out
-	log.Trace().
+	logger.Trace().
 		Caller().
 		Str("node", node.Hostname).
 		Str("machine_key", machineKey.ShortString()).
@@ -733,7 +971,7 @@ func (h *Headscale) handleNodeExpiredOrLoggedOut(
 
 	respBody, err := json.Marshal(resp)
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Cannot encode message")
@@ -750,13 +988,13 @@ func (h *Headscale) handleNodeExpiredOrLoggedOut(
 	writer.WriteHeader(http.StatusOK)
 	_, err = writer.Write(respBody)
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Failed to write response")
 	}
 
-	log.Trace().
+	logger.Trace().
 		Caller().
 		Str("machine_key", machineKey.ShortString()).
 		Str("node_key", registerRequest.NodeKey.ShortString()).
@@ -5,7 +5,6 @@ import (
 	"io"
 	"net/http"
 
-	"github.com/rs/zerolog/log"
 	"tailscale.com/tailcfg"
 )
 
@@ -14,14 +13,25 @@ func (ns *noiseServer) NoiseRegistrationHandler(
 	writer http.ResponseWriter,
 	req *http.Request,
 ) {
-	log.Trace().Caller().Msgf("Noise registration handler for client %s", req.RemoteAddr)
+	logger := requestLogger(req.Context())
+	logger.Trace().Caller().Msgf("Noise registration handler for client %s", req.RemoteAddr)
 	if req.Method != http.MethodPost {
 		http.Error(writer, "Wrong method", http.StatusMethodNotAllowed)
 
 		return
 	}
 
-	log.Trace().
+	if !checkRateLimit(
+		writer,
+		ns.headscale.registerRateLimiter,
+		"register",
+		ns.clientIP,
+		ns.machineKey.String(),
+	) {
+		return
+	}
+
+	logger.Trace().
 		Any("headers", req.Header).
 		Caller().
 		Msg("Headers")
@@ -29,7 +39,7 @@ func (ns *noiseServer) NoiseRegistrationHandler(
 	body, _ := io.ReadAll(req.Body)
 	registerRequest := tailcfg.RegisterRequest{}
 	if err := json.Unmarshal(body, &registerRequest); err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Cannot parse RegisterRequest")
@@ -41,7 +51,7 @@ func (ns *noiseServer) NoiseRegistrationHandler(
 
 	// Reject unsupported versions
 	if registerRequest.Version < MinimumCapVersion {
-		log.Info().
+		logger.Info().
 			Caller().
 			Int("min_version", int(MinimumCapVersion)).
 			Int("client_version", int(registerRequest.Version)).
@@ -51,6 +61,46 @@ func (ns *noiseServer) NoiseRegistrationHandler(
 		return
 	}
 
+	var hostname, clientVersion string
+	if registerRequest.Hostinfo != nil {
+		hostname = registerRequest.Hostinfo.Hostname
+		clientVersion = registerRequest.Hostinfo.IPNVersion
+	}
+
+	logger.Info().
+		Caller().
+		Str("node", hostname).
+		Str("client_version", clientVersion).
+		Int("capability_version", int(registerRequest.Version)).
+		Msg("Registration request")
+
+	if err := ns.headscale.checkClientVersion(clientVersion); err != nil {
+		logger.Info().
+			Caller().
+			Str("node", hostname).
+			Str("client_version", clientVersion).
+			Str("min_client_version", ns.headscale.cfg.MinClientVersion).
+			Msg("Rejecting registration of outdated client")
+
+		respBody, err := json.Marshal(tailcfg.RegisterResponse{Error: err.Error()})
+		if err != nil {
+			http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writer.WriteHeader(http.StatusForbidden)
+		if _, err := writer.Write(respBody); err != nil {
+			logger.Error().
+				Caller().
+				Err(err).
+				Msg("Failed to write response")
+		}
+
+		return
+	}
+
 	ns.nodeKey = registerRequest.NodeKey
 
 	ns.headscale.handleRegister(writer, req, registerRequest, ns.conn.Peer())
@@ -0,0 +1,243 @@
+package hscontrol
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestRegistrationWaiters(t *testing.T) {
+	waiters := newRegistrationWaiters()
+	machineKey := key.NewMachine().Public()
+	otherKey := key.NewMachine().Public()
+
+	first, releaseFirst := waiters.wait(machineKey)
+	second, releaseSecond := waiters.wait(machineKey)
+	other, releaseOther := waiters.wait(otherKey)
+
+	waiters.done(machineKey)
+
+	for _, waiter := range []<-chan struct{}{first, second} {
+		select {
+		case <-waiter:
+		case <-time.After(time.Second):
+			t.Fatal("waiter was not released when the registration completed")
+		}
+	}
+
+	select {
+	case <-other:
+		t.Fatal("waiter for another machine key was released")
+	default:
+	}
+
+	// Completing a registration nobody waits for must not panic.
+	waiters.done(machineKey)
+
+	releaseFirst()
+	releaseSecond()
+	releaseOther()
+
+	// The machine keys nobody waits for anymore are forgotten.
+	if len(waiters.waiters) != 0 {
+		t.Errorf("%d machine keys left after the waiters gave up, want 0", len(waiters.waiters))
+	}
+}
+
+func (s *Suite) TestEphemeralNodeDisconnectAndLogOut(c *check.C) {
+	app.cfg.EphemeralNodeInactivityTimeout = time.Minute
+
+	user, err := app.db.CreateUser("ephemeral")
+	c.Assert(err, check.IsNil)
+
+	pak, err := app.db.CreatePreAuthKey(user.Name, true, true, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	createNode := func(hostname string, lastSeen time.Time) *types.Node {
+		node := types.Node{
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			Hostname:       hostname,
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+			LastSeen:       &lastSeen,
+			AuthKeyID:      uint(pak.ID),
+		}
+		c.Assert(app.db.DB.Save(&node).Error, check.IsNil)
+
+		saved, err := app.db.GetNodeByID(node.ID)
+		c.Assert(err, check.IsNil)
+
+		return saved
+	}
+
+	disconnected := createNode("disconnected", time.Now().Add(-time.Hour))
+	connected := createNode("connected", time.Now().Add(-time.Hour))
+	loggedOut := createNode("logged-out", time.Now())
+
+	app.nodeNotifier.AddNode(connected.ID, make(chan types.StateUpdate, 10))
+
+	// A disconnected node is deleted once the inactivity timeout has
+	// passed, a connected one is kept.
+	app.deleteInactiveEphemeralNodes()
+
+	_, err = app.db.GetNodeByID(disconnected.ID)
+	c.Assert(err, check.NotNil)
+
+	_, err = app.db.GetNodeByID(connected.ID)
+	c.Assert(err, check.IsNil)
+
+	// A node logging out is deleted right away.
+	app.handleNodeLogOut(
+		httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodPost, "/machine/register", nil),
+		*loggedOut,
+		loggedOut.MachineKey,
+	)
+
+	_, err = app.db.GetNodeByID(loggedOut.ID)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestHandleAuthKeyErrors(c *check.C) {
+	alice, err := app.db.CreateUser("alice")
+	c.Assert(err, check.IsNil)
+	_, err = app.db.CreateUser("bob")
+	c.Assert(err, check.IsNil)
+	_, err = app.db.CreateUser("carol")
+	c.Assert(err, check.IsNil)
+
+	newKey := func(user string, expiration *time.Time) string {
+		pak, err := app.db.CreatePreAuthKey(user, false, false, expiration, nil)
+		c.Assert(err, check.IsNil)
+
+		return pak.Key
+	}
+
+	past := time.Now().Add(-time.Hour)
+	expiredKey := newKey("alice", &past)
+	usedKey := newKey("alice", nil)
+	bobKey := newKey("bob", nil)
+	carolKey := newKey("carol", nil)
+
+	_, _, err = app.db.DisableUser("carol", time.Now())
+	c.Assert(err, check.IsNil)
+
+	// A node of alice registering again with a key of bob.
+	aliceMachine := key.NewMachine().Public()
+	aliceNode := types.Node{
+		MachineKey:     aliceMachine,
+		NodeKey:        key.NewNode().Public(),
+		Hostname:       "alice-laptop",
+		UserID:         alice.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+	}
+	c.Assert(app.db.DB.Save(&aliceNode).Error, check.IsNil)
+
+	register := func(authKey string, machineKey key.MachinePublic) tailcfg.RegisterResponse {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/machine/register", nil)
+		req.RemoteAddr = "192.0.2.1:41641"
+		app.handleAuthKey(
+			recorder,
+			req,
+			tailcfg.RegisterRequest{
+				Auth:     tailcfg.RegisterResponseAuth{AuthKey: authKey},
+				NodeKey:  key.NewNode().Public(),
+				Hostinfo: &tailcfg.Hostinfo{Hostname: "laptop"},
+			},
+			machineKey,
+		)
+		c.Assert(recorder.Code, check.Equals, http.StatusOK)
+
+		var resp tailcfg.RegisterResponse
+		c.Assert(json.NewDecoder(recorder.Body).Decode(&resp), check.IsNil)
+
+		return resp
+	}
+
+	resp := register(usedKey, key.NewMachine().Public())
+	c.Assert(resp.MachineAuthorized, check.Equals, true)
+	c.Assert(resp.Error, check.Equals, "")
+
+	tests := []struct {
+		name       string
+		authKey    string
+		machineKey key.MachinePublic
+		want       string
+	}{
+		{
+			name:    "unknown-key",
+			authKey: "hskey-auth-unknown-secret",
+			want:    "AuthKey not found",
+		},
+		{
+			name:    "expired-key",
+			authKey: expiredKey,
+			want:    "AuthKey expired",
+		},
+		{
+			name:    "used-key",
+			authKey: usedKey,
+			want:    "AuthKey has already been used",
+		},
+		{
+			name:    "disabled-user",
+			authKey: carolKey,
+			want:    "user is disabled",
+		},
+		{
+			name:       "different-user",
+			authKey:    bobKey,
+			machineKey: aliceMachine,
+			want:       "node was previously registered with a different user",
+		},
+	}
+
+	for _, tt := range tests {
+		machineKey := tt.machineKey
+		if machineKey.IsZero() {
+			machineKey = key.NewMachine().Public()
+		}
+
+		resp := register(tt.authKey, machineKey)
+		c.Assert(resp.MachineAuthorized, check.Equals, false, check.Commentf(tt.name))
+		c.Assert(resp.Error, check.Equals, tt.want, check.Commentf(tt.name))
+	}
+
+	// The registration webhook denies the node.
+	var webhookReq registrationWebhookRequest
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&webhookReq); err != nil {
+			c.Errorf("decoding webhook request: %s", err)
+		}
+		w.Write([]byte(`{"allow": false, "reason": "not in inventory"}`))
+	}))
+	defer webhook.Close()
+
+	app.cfg.RegistrationWebhook = types.RegistrationWebhookConfig{
+		URL:     webhook.URL,
+		Timeout: time.Second,
+	}
+
+	resp = register(newKey("alice", nil), key.NewMachine().Public())
+	c.Assert(resp.Error, check.Equals, "registration denied: not in inventory")
+	c.Assert(webhookReq.SourceIP, check.Equals, "192.0.2.1")
+
+	app.cfg.RegistrationWebhook = types.RegistrationWebhookConfig{}
+
+	// The details of internal errors are not given to the client.
+	authKey := newKey("alice", nil)
+	c.Assert(app.db.Close(), check.IsNil)
+
+	resp = register(authKey, key.NewMachine().Public())
+	c.Assert(resp.Error, check.Equals, registrationInternalError)
+}
@@ -0,0 +1,33 @@
+package hscontrol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"tailscale.com/util/cmpver"
+)
+
+var ErrClientVersionTooOld = errors.New("client version is too old")
+
+// checkClientVersion returns an error if the Tailscale client version,
+// as reported in Hostinfo.IPNVersion, is older than min_client_version.
+// Clients not reporting their version are allowed.
+func (h *Headscale) checkClientVersion(ipnVersion string) error {
+	if h.cfg.MinClientVersion == "" || ipnVersion == "" {
+		return nil
+	}
+
+	// IPNVersion has the form 1.58.2-t1234abcd-g5678ef.
+	version, _, _ := strings.Cut(ipnVersion, "-")
+	if cmpver.Compare(version, h.cfg.MinClientVersion) < 0 {
+		return fmt.Errorf(
+			"%w: Tailscale %s is older than %s, the minimum version supported by this server, please upgrade",
+			ErrClientVersionTooOld,
+			version,
+			h.cfg.MinClientVersion,
+		)
+	}
+
+	return nil
+}
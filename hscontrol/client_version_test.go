@@ -0,0 +1,63 @@
+package hscontrol
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+func TestCheckClientVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		minVersion string
+		ipnVersion string
+		wantErr    bool
+	}{
+		{
+			name:       "no-minimum",
+			ipnVersion: "1.12.3-t1234abcd",
+		},
+		{
+			name:       "unknown-version",
+			minVersion: "1.32.0",
+		},
+		{
+			name:       "equal",
+			minVersion: "1.32.0",
+			ipnVersion: "1.32.0-t1234abcd-g5678ef",
+		},
+		{
+			name:       "newer",
+			minVersion: "1.32",
+			ipnVersion: "1.58.2-t1234abcd-g5678ef",
+		},
+		{
+			name:       "older",
+			minVersion: "1.14.3",
+			ipnVersion: "1.12.3-t1234abcd",
+			wantErr:    true,
+		},
+		{
+			name:       "older-minor-digits",
+			minVersion: "1.32.0",
+			ipnVersion: "1.4.0",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Headscale{cfg: &types.Config{MinClientVersion: tt.minVersion}}
+
+			err := h.checkClientVersion(tt.ipnVersion)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("checkClientVersion() error = %v, wantErr %t", err, tt.wantErr)
+			}
+
+			if err != nil && !errors.Is(err, ErrClientVersionTooOld) {
+				t.Errorf("checkClientVersion() error = %v, want ErrClientVersionTooOld", err)
+			}
+		})
+	}
+}
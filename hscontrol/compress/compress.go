@@ -0,0 +1,273 @@
+// Package compress implements HTTP response compression with gzip and
+// zstd, negotiated with the Accept-Encoding header of the request.
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+var errHijackNotSupported = errors.New("response writer does not support hijacking")
+
+var (
+	gzipWriterPool = sync.Pool{
+		New: func() any {
+			return gzip.NewWriter(io.Discard)
+		},
+	}
+	zstdWriterPool = sync.Pool{
+		New: func() any {
+			// Only fails on invalid options.
+			encoder, _ := zstd.NewWriter(
+				io.Discard,
+				zstd.WithEncoderLevel(zstd.SpeedFastest),
+				zstd.WithEncoderConcurrency(1),
+			)
+
+			return encoder
+		},
+	}
+)
+
+// Middleware returns a middleware compressing responses of at least
+// minSize bytes with the best encoding accepted by the client, zstd
+// being preferred over gzip. Upgrade requests (WebSockets, TS2021, DERP)
+// are passed through untouched.
+func Middleware(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Upgrade") != "" || req.Method == http.MethodHead {
+				next.ServeHTTP(writer, req)
+
+				return
+			}
+
+			encoding := Negotiate(req.Header.Get("Accept-Encoding"))
+			if encoding == "" {
+				next.ServeHTTP(writer, req)
+
+				return
+			}
+
+			cw := &compressWriter{
+				ResponseWriter: writer,
+				encoding:       encoding,
+				minSize:        minSize,
+				status:         http.StatusOK,
+			}
+			defer cw.Close()
+
+			next.ServeHTTP(cw, req)
+		})
+	}
+}
+
+// Negotiate returns the encoding to use for a request with the given
+// Accept-Encoding header, or "" if the response should not be
+// compressed.
+func Negotiate(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.TrimSpace(key) == "q" {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		accepted[name] = q > 0
+	}
+
+	switch {
+	case accepted[EncodingZstd]:
+		return EncodingZstd
+	case accepted[EncodingGzip]:
+		return EncodingGzip
+	default:
+		return ""
+	}
+}
+
+// compressWriter buffers the beginning of the response until it knows
+// if the response is large enough to be compressed.
+type compressWriter struct {
+	http.ResponseWriter
+
+	encoding string
+	minSize  int
+
+	status      int
+	wroteHeader bool
+
+	// decided is set once the response is either compressed or
+	// passed through.
+	decided bool
+	buf     bytes.Buffer
+	encoder io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+
+	cw.status = status
+	cw.wroteHeader = true
+
+	// Responses without a body, or already encoded by the
+	// handler, are not compressed.
+	if status < http.StatusOK ||
+		status == http.StatusNoContent ||
+		status == http.StatusNotModified ||
+		cw.Header().Get("Content-Encoding") != "" {
+		cw.passthrough()
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(b)
+		}
+
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf.Write(b)
+	if cw.buf.Len() >= cw.minSize {
+		if err := cw.startCompression(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// passthrough sends the response uncompressed.
+func (cw *compressWriter) passthrough() {
+	cw.decided = true
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func (cw *compressWriter) startCompression() error {
+	cw.decided = true
+
+	header := cw.Header()
+	header.Set("Content-Encoding", cw.encoding)
+	header.Add("Vary", "Accept-Encoding")
+	header.Del("Content-Length")
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	switch cw.encoding {
+	case EncodingZstd:
+		encoder, _ := zstdWriterPool.Get().(*zstd.Encoder)
+		encoder.Reset(cw.ResponseWriter)
+		cw.encoder = encoder
+	case EncodingGzip:
+		encoder, _ := gzipWriterPool.Get().(*gzip.Writer)
+		encoder.Reset(cw.ResponseWriter)
+		cw.encoder = encoder
+	}
+
+	_, err := cw.encoder.Write(cw.buf.Bytes())
+	cw.buf.Reset()
+
+	return err
+}
+
+// Flush sends what has been written so far to the client, compressing
+// it if the response has reached minSize.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		if cw.buf.Len() >= cw.minSize {
+			_ = cw.startCompression()
+		} else {
+			cw.passthrough()
+			_, _ = cw.ResponseWriter.Write(cw.buf.Bytes())
+			cw.buf.Reset()
+		}
+	}
+
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errHijackNotSupported
+	}
+
+	return hijacker.Hijack()
+}
+
+// Close finishes the response, writing out a response smaller than
+// minSize uncompressed.
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if !cw.wroteHeader && cw.buf.Len() == 0 {
+			return nil
+		}
+
+		cw.passthrough()
+		_, err := cw.ResponseWriter.Write(cw.buf.Bytes())
+		cw.buf.Reset()
+
+		return err
+	}
+
+	if cw.encoder == nil {
+		return nil
+	}
+
+	err := cw.encoder.Close()
+
+	switch encoder := cw.encoder.(type) {
+	case *zstd.Encoder:
+		encoder.Reset(io.Discard)
+		zstdWriterPool.Put(encoder)
+	case *gzip.Writer:
+		encoder.Reset(io.Discard)
+		gzipWriterPool.Put(encoder)
+	}
+	cw.encoder = nil
+
+	return err
+}
@@ -0,0 +1,243 @@
+package compress
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", EncodingGzip},
+		{"gzip, deflate, br", EncodingGzip},
+		{"gzip, zstd", EncodingZstd},
+		{"ZSTD", EncodingZstd},
+		{"zstd;q=0, gzip;q=0.5", EncodingGzip},
+		{"gzip;q=0", ""},
+		{"br, zstd ; q=0.1", EncodingZstd},
+	}
+
+	for _, tt := range tests {
+		if got := Negotiate(tt.acceptEncoding); got != tt.want {
+			t.Errorf("Negotiate(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func decode(t testing.TB, encoding string, body []byte) []byte {
+	t.Helper()
+
+	var reader io.Reader
+	switch encoding {
+	case EncodingGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("creating gzip reader: %s", err)
+		}
+		reader = gr
+	case EncodingZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("creating zstd reader: %s", err)
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		return body
+	}
+
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("decoding %s body: %s", encoding, err)
+	}
+
+	return out
+}
+
+func TestMiddleware(t *testing.T) {
+	large := []byte(strings.Repeat("headscale ", 1000))
+	small := []byte("small")
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		upgrade        string
+		body           []byte
+		handlerHeader  http.Header
+		wantEncoding   string
+	}{
+		{
+			name:           "large-gzip",
+			acceptEncoding: "gzip",
+			body:           large,
+			wantEncoding:   EncodingGzip,
+		},
+		{
+			name:           "large-zstd",
+			acceptEncoding: "gzip, zstd",
+			body:           large,
+			wantEncoding:   EncodingZstd,
+		},
+		{
+			name:           "small",
+			acceptEncoding: "gzip, zstd",
+			body:           small,
+		},
+		{
+			name: "not-accepted",
+			body: large,
+		},
+		{
+			name:           "upgrade",
+			acceptEncoding: "gzip",
+			upgrade:        "websocket",
+			body:           large,
+		},
+		{
+			name:           "already-encoded",
+			acceptEncoding: "gzip",
+			body:           large,
+			handlerHeader:  http.Header{"Content-Encoding": []string{"br"}},
+			wantEncoding:   "br",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Middleware(1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.handlerHeader {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(http.StatusTeapot)
+
+				// Write in small chunks to go through the buffering.
+				for _, chunk := range bytes.SplitAfter(tt.body, []byte(" ")) {
+					w.Write(chunk)
+				}
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			if tt.upgrade != "" {
+				req.Header.Set("Upgrade", tt.upgrade)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusTeapot {
+				t.Errorf("want status %d, got %d", http.StatusTeapot, rec.Code)
+			}
+
+			encoding := rec.Header().Get("Content-Encoding")
+			if encoding != tt.wantEncoding {
+				t.Fatalf("want Content-Encoding %q, got %q", tt.wantEncoding, encoding)
+			}
+
+			if tt.handlerHeader != nil {
+				return
+			}
+
+			if got := decode(t, encoding, rec.Body.Bytes()); !bytes.Equal(got, tt.body) {
+				t.Errorf("decoded body does not match, got %d bytes, want %d bytes", len(got), len(tt.body))
+			}
+		})
+	}
+}
+
+// syntheticMapResponse returns the JSON encoding of a map response with
+// the given number of peers.
+func syntheticMapResponse(tb testing.TB, peers int) []byte {
+	tb.Helper()
+
+	now := time.Now()
+	resp := tailcfg.MapResponse{
+		KeepAlive: false,
+		Node: &tailcfg.Node{
+			ID:       1,
+			Name:     "self.user.example.com.",
+			Key:      key.NewNode().Public(),
+			Machine:  key.NewMachine().Public(),
+			Hostinfo: (&tailcfg.Hostinfo{Hostname: "self", OS: "linux"}).View(),
+		},
+	}
+
+	for i := range peers {
+		ipv4 := netip.AddrFrom4([4]byte{100, 64, byte(i / 256), byte(i % 256)})
+		resp.Peers = append(resp.Peers, &tailcfg.Node{
+			ID:         tailcfg.NodeID(i + 2),
+			StableID:   tailcfg.StableNodeID(fmt.Sprintf("%d", i+2)),
+			Name:       fmt.Sprintf("node-%d.user.example.com.", i),
+			User:       tailcfg.UserID(i%10 + 1),
+			Key:        key.NewNode().Public(),
+			Machine:    key.NewMachine().Public(),
+			DiscoKey:   key.NewDisco().Public(),
+			Addresses:  []netip.Prefix{netip.PrefixFrom(ipv4, 32)},
+			AllowedIPs: []netip.Prefix{netip.PrefixFrom(ipv4, 32)},
+			Endpoints:  []netip.AddrPort{netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), uint16(41641+i))},
+			DERP:       "127.3.3.40:1",
+			Hostinfo: (&tailcfg.Hostinfo{
+				Hostname: fmt.Sprintf("node-%d", i),
+				OS:       "linux",
+			}).View(),
+			Created:  now,
+			LastSeen: &now,
+			Online:   &[]bool{true}[0],
+		})
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		tb.Fatalf("marshalling map response: %s", err)
+	}
+
+	return body
+}
+
+func BenchmarkMiddleware(b *testing.B) {
+	body := syntheticMapResponse(b, 200)
+
+	handler := Middleware(1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		b.Run(encoding, func(b *testing.B) {
+			var compressed int
+
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for range b.N {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Accept-Encoding", encoding)
+				rec := httptest.NewRecorder()
+
+				handler.ServeHTTP(rec, req)
+				compressed = rec.Body.Len()
+			}
+
+			b.ReportMetric(float64(len(body))/float64(compressed), "ratio")
+		})
+	}
+}
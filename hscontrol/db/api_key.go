@@ -1,7 +1,6 @@
 package db
 
 import (
-	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -16,7 +15,10 @@ const (
 	apiKeyLength    = 32
 )
 
-var ErrAPIKeyFailedToParse = errors.New("failed to parse ApiKey")
+var (
+	ErrAPIKeyFailedToParse = types.NewHeadscaleError(types.CodeKeyInvalid, "failed to parse ApiKey")
+	ErrAPIKeyExpired       = types.NewHeadscaleError(types.CodeKeyExpired, "ApiKey has expired")
+)
 
 // CreateAPIKey creates a new ApiKey in a user, and returns it.
 func (hsdb *HSDatabase) CreateAPIKey(
@@ -102,6 +104,56 @@ func (hsdb *HSDatabase) ExpireAPIKey(key *types.APIKey) error {
 	return nil
 }
 
+// RenewAPIKey sets a new expiration to a ApiKey which has not expired,
+// keeping its secret. The key can be rotated again.
+func (hsdb *HSDatabase) RenewAPIKey(prefix string, expiration time.Time) (*types.APIKey, error) {
+	key, err := hsdb.GetAPIKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if key.Expiration != nil && !key.Expiration.After(time.Now()) {
+		return nil, ErrAPIKeyExpired
+	}
+
+	if err := hsdb.DB.Model(key).Updates(map[string]interface{}{
+		"expiration": expiration,
+		"rotated_at": nil,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("failed to renew API key: %w", err)
+	}
+
+	key.Expiration = &expiration
+	key.RotatedAt = nil
+
+	return key, nil
+}
+
+// ListAPIKeysToRotate returns the ApiKeys expiring between now and
+// now+before which have not been rotated yet.
+func (hsdb *HSDatabase) ListAPIKeysToRotate(now time.Time, before time.Duration) ([]types.APIKey, error) {
+	keys := []types.APIKey{}
+	if err := hsdb.DB.
+		Where("rotated_at IS NULL").
+		Where("expiration > ? AND expiration <= ?", now, now.Add(before)).
+		Find(&keys).Error; err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// SetAPIKeyRotated records that a new key was issued to replace key.
+func (hsdb *HSDatabase) SetAPIKeyRotated(key *types.APIKey, rotatedAt time.Time) error {
+	if err := hsdb.DB.Model(key).Update("rotated_at", rotatedAt).Error; err != nil {
+		return fmt.Errorf("failed to mark API key as rotated: %w", err)
+	}
+
+	key.RotatedAt = &rotatedAt
+
+	return nil
+}
+
 func (hsdb *HSDatabase) ValidateAPIKey(keyStr string) (bool, error) {
 	prefix, hash, found := strings.Cut(keyStr, ".")
 	if !found {
@@ -113,7 +165,7 @@ func (hsdb *HSDatabase) ValidateAPIKey(keyStr string) (bool, error) {
 		return false, fmt.Errorf("failed to validate api key: %w", err)
 	}
 
-	if key.Expiration.Before(time.Now()) {
+	if key.Expiration != nil && key.Expiration.Before(time.Now()) {
 		return false, nil
 	}
 
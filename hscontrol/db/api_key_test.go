@@ -87,3 +87,58 @@ func (*Suite) TestExpireAPIKey(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(notValid, check.Equals, false)
 }
+
+func (*Suite) TestRenewAPIKey(c *check.C) {
+	nowPlus2 := time.Now().Add(2 * time.Hour)
+	apiKeyStr, apiKey, err := db.CreateAPIKey(&nowPlus2)
+	c.Assert(err, check.IsNil)
+
+	rotatedAt := time.Now()
+	err = db.SetAPIKeyRotated(apiKey, rotatedAt)
+	c.Assert(err, check.IsNil)
+
+	nowPlus90d := time.Now().Add(90 * 24 * time.Hour)
+	renewed, err := db.RenewAPIKey(apiKey.Prefix, nowPlus90d)
+	c.Assert(err, check.IsNil)
+	c.Assert(renewed.Expiration.Equal(nowPlus90d), check.Equals, true)
+	c.Assert(renewed.RotatedAt, check.IsNil)
+
+	// The secret is unchanged.
+	valid, err := db.ValidateAPIKey(apiKeyStr)
+	c.Assert(err, check.IsNil)
+	c.Assert(valid, check.Equals, true)
+
+	err = db.ExpireAPIKey(apiKey)
+	c.Assert(err, check.IsNil)
+
+	_, err = db.RenewAPIKey(apiKey.Prefix, nowPlus90d)
+	c.Assert(err, check.Equals, ErrAPIKeyExpired)
+}
+
+func (*Suite) TestListAPIKeysToRotate(c *check.C) {
+	now := time.Now()
+
+	soon := now.Add(24 * time.Hour)
+	_, expiring, err := db.CreateAPIKey(&soon)
+	c.Assert(err, check.IsNil)
+
+	later := now.Add(30 * 24 * time.Hour)
+	_, _, err = db.CreateAPIKey(&later)
+	c.Assert(err, check.IsNil)
+
+	past := now.Add(-time.Hour)
+	_, _, err = db.CreateAPIKey(&past)
+	c.Assert(err, check.IsNil)
+
+	keys, err := db.ListAPIKeysToRotate(now, 7*24*time.Hour)
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+	c.Assert(keys[0].Prefix, check.Equals, expiring.Prefix)
+
+	err = db.SetAPIKeyRotated(&keys[0], now)
+	c.Assert(err, check.IsNil)
+
+	keys, err = db.ListAPIKeysToRotate(now, 7*24*time.Hour)
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 0)
+}
@@ -13,7 +13,9 @@ import (
 
 	"github.com/glebarez/sqlite"
 	"github.com/go-gormigrate/gormigrate/v2"
+	mysqldriver "github.com/go-sql-driver/mysql"
 	"github.com/rs/zerolog/log"
+	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -24,6 +26,8 @@ import (
 
 var errDatabaseNotSupported = errors.New("database type not supported")
 
+var mysqlDatetimePrecision = 6
+
 // KV is a key-value store in a psql table. For future use...
 // TODO(kradalby): Is this used for anything?
 type KV struct {
@@ -35,6 +39,9 @@ type HSDatabase struct {
 	DB *gorm.DB
 
 	baseDomain string
+
+	// peerCache is nil when the peers are not cached.
+	peerCache *PeerMapCache
 }
 
 // TODO(kradalby): assemble this struct from toptions or something typed
@@ -48,6 +55,10 @@ func NewHeadscaleDatabase(
 		return nil, err
 	}
 
+	if err := registerMetricsCallbacks(dbConn); err != nil {
+		return nil, fmt.Errorf("registering database metrics: %w", err)
+	}
+
 	migrations := gormigrate.New(
 		dbConn,
 		gormigrate.DefaultOptions,
@@ -318,6 +329,12 @@ func NewHeadscaleDatabase(
 				// no longer used.
 				ID: "202402151347",
 				Migrate: func(tx *gorm.DB) error {
+					// MySQL does not support dropping a column that
+					// does not exist, which is the case for new databases.
+					if !tx.Migrator().HasColumn(&types.Node{}, "last_successful_update") {
+						return nil
+					}
+
 					err := tx.Migrator().DropColumn(&types.Node{}, "last_successful_update")
 					if err != nil && strings.Contains(err.Error(), `of relation "nodes" does not exist`) {
 						return nil
@@ -400,6 +417,310 @@ func NewHeadscaleDatabase(
 					return nil
 				},
 			},
+			{
+				// Add default tags to users, applied to every node
+				// registering in the user.
+				ID: "202610161200",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.User{}, "default_tags") {
+						return tx.Migrator().AddColumn(&types.User{}, "default_tags")
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Add the IP requested for nodes registering with a
+				// pre auth key.
+				ID: "202610161300",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.PreAuthKey{}, "requested_ip") {
+						return tx.Migrator().AddColumn(&types.PreAuthKey{}, "requested_ip")
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Store the prefix of pre auth keys and fill it in
+				// for the existing keys.
+				ID: "202610161400",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.PreAuthKey{}, "prefix") {
+						err := tx.Migrator().AddColumn(&types.PreAuthKey{}, "prefix")
+						if err != nil {
+							return err
+						}
+					}
+
+					var keys []types.PreAuthKey
+					if err := tx.Where("prefix IS NULL OR prefix = ?", "").Find(&keys).Error; err != nil {
+						return err
+					}
+
+					for _, key := range keys {
+						if len(key.Key) < preAuthKeyPrefixLength {
+							continue
+						}
+
+						err := tx.Model(&types.PreAuthKey{}).
+							Where("id = ?", key.ID).
+							Update("prefix", key.Key[:preAuthKeyPrefixLength]).Error
+						if err != nil {
+							return err
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Persist pending interactive registrations.
+				ID: "202610161500",
+				Migrate: func(tx *gorm.DB) error {
+					return tx.AutoMigrate(&types.PendingRegistration{})
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Store a hash of the secret of pre auth keys and
+				// look them up by prefix.
+				ID: "202610161600",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.PreAuthKey{}, "hash") {
+						err := tx.Migrator().AddColumn(&types.PreAuthKey{}, "hash")
+						if err != nil {
+							return err
+						}
+					}
+
+					if !tx.Migrator().HasIndex(&types.PreAuthKey{}, "Prefix") {
+						// MySQL cannot index the TEXT column added
+						// by the previous migration.
+						if tx.Dialector.Name() == types.DatabaseMysql {
+							err := tx.Migrator().AlterColumn(&types.PreAuthKey{}, "Prefix")
+							if err != nil {
+								return err
+							}
+						}
+
+						return tx.Migrator().CreateIndex(&types.PreAuthKey{}, "Prefix")
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Add the disabled flag of users.
+				ID: "202610161700",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.User{}, "disabled") {
+						return tx.Migrator().AddColumn(&types.User{}, "disabled")
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Store the result of the last device posture
+				// check of nodes.
+				ID: "202610161800",
+				Migrate: func(tx *gorm.DB) error {
+					for _, column := range []string{"posture_checked_at", "posture_error"} {
+						if !tx.Migrator().HasColumn(&types.Node{}, column) {
+							err := tx.Migrator().AddColumn(&types.Node{}, column)
+							if err != nil {
+								return err
+							}
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Add the display name of users, read from the
+				// OIDC claims.
+				ID: "202610161900",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.User{}, "display_name") {
+						return tx.Migrator().AddColumn(&types.User{}, "display_name")
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Add the node groups, the memberships of nodes in
+				// groups of the ACL policy managed with the API.
+				ID: "202610162000",
+				Migrate: func(tx *gorm.DB) error {
+					return tx.AutoMigrate(&types.NodeGroup{})
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Add the versions of the ACL policy stored in the
+				// database when policy.mode is database.
+				ID: "202610162100",
+				Migrate: func(tx *gorm.DB) error {
+					return tx.AutoMigrate(&types.Policy{})
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Add the avatar URL of users, read from the
+				// picture OIDC claim.
+				ID: "202610162200",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.User{}, "avatar_url") {
+						return tx.Migrator().AddColumn(&types.User{}, "avatar_url")
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Add the lock of nodes, protecting them from
+				// changes made with the API.
+				ID: "202610162300",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "locked") {
+						return tx.Migrator().AddColumn(&types.Node{}, "locked")
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Add the time API keys were rotated at, so they
+				// are only rotated once.
+				ID: "202610162330",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.APIKey{}, "rotated_at") {
+						return tx.Migrator().AddColumn(&types.APIKey{}, "rotated_at")
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Add the DERP-only setting of users, hiding the
+				// endpoints of their nodes.
+				ID: "202610170100",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.User{}, "derp_only") {
+						return tx.Migrator().AddColumn(&types.User{}, "derp_only")
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Remember the routes disabled by hand, the
+				// autoApprovers do not enable them again.
+				ID: "202610180000",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Route{}, "disabled") {
+						return tx.Migrator().AddColumn(&types.Route{}, "disabled")
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Metadata of the nodes, JSONB on PostgreSQL.
+				ID: "202610190000",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "metadata") {
+						return tx.Migrator().AddColumn(&types.Node{}, "metadata")
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Add the routes nodes are allowed to use, overriding
+				// the routes of their peers they see.
+				ID: "202610200000",
+				Migrate: func(tx *gorm.DB) error {
+					return tx.AutoMigrate(&types.PerNodeRoute{})
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Add the peer_traffic_stats table, the traffic reported
+				// by the nodes.
+				ID: "202610210000",
+				Migrate: func(tx *gorm.DB) error {
+					return tx.AutoMigrate(&types.PeerTrafficStat{})
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
+			{
+				// Add the deny-all setting of the allowed routes of
+				// nodes, hiding all the routes of their peers.
+				ID: "202610210100",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "deny_all_routes") {
+						return tx.Migrator().AddColumn(&types.Node{}, "deny_all_routes")
+					}
+
+					return nil
+				},
+				Rollback: func(tx *gorm.DB) error {
+					return nil
+				},
+			},
 		},
 	)
 
@@ -413,6 +734,13 @@ func NewHeadscaleDatabase(
 		baseDomain: baseDomain,
 	}
 
+	if cfg.PeerCacheTTL > 0 {
+		db.peerCache = NewPeerMapCache(cfg.PeerCacheTTL)
+		if err := registerPeerCacheCallbacks(dbConn, db.peerCache); err != nil {
+			return nil, fmt.Errorf("registering peer cache: %w", err)
+		}
+	}
+
 	return &db, err
 }
 
@@ -449,12 +777,14 @@ func openDB(cfg types.DatabaseConfig) (*gorm.DB, error) {
 		db.Exec("PRAGMA foreign_keys=ON")
 
 		// The pure Go SQLite library does not handle locking in
-		// the same way as the C based one and we cant use the gorm
-		// connection pool as of 2022/02/23.
+		// the same way as the C based one, more than one open
+		// connection results in "database is locked" errors when
+		// many nodes register at the same time.
 		sqlDB, _ := db.DB()
-		sqlDB.SetMaxIdleConns(1)
+		sqlDB.SetMaxIdleConns(min(cfg.MaxIdleConnections, 1))
 		sqlDB.SetMaxOpenConns(1)
 		sqlDB.SetConnMaxIdleTime(time.Hour)
+		sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 
 		return db, err
 
@@ -501,6 +831,58 @@ func openDB(cfg types.DatabaseConfig) (*gorm.DB, error) {
 		sqlDB.SetConnMaxIdleTime(
 			time.Duration(cfg.Postgres.ConnMaxIdleTimeSecs) * time.Second,
 		)
+		sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+		return db, nil
+
+	case types.DatabaseMysql:
+		dsn := mysqldriver.NewConfig()
+		dsn.User = cfg.Mysql.User
+		dsn.Passwd = cfg.Mysql.Pass
+		dsn.DBName = cfg.Mysql.Name
+		dsn.Net = "tcp"
+		dsn.Addr = fmt.Sprintf("%s:%d", cfg.Mysql.Host, cfg.Mysql.Port)
+		if strings.HasPrefix(cfg.Mysql.Host, "/") {
+			dsn.Net = "unix"
+			dsn.Addr = cfg.Mysql.Host
+		}
+
+		// Store and read all timestamps as UTC, MySQL DATETIME
+		// columns do not carry a timezone.
+		dsn.ParseTime = true
+		dsn.Loc = time.UTC
+		// Report the rows matched by an UPDATE, not only the ones it
+		// changed, like PostgreSQL and SQLite do.
+		dsn.ClientFoundRows = true
+		dsn.Params = map[string]string{
+			"charset": "utf8mb4",
+		}
+
+		log.Info().
+			Str("database", types.DatabaseMysql).
+			Str("path", fmt.Sprintf("%s@%s/%s", dsn.User, dsn.Addr, dsn.DBName)).
+			Msg("Opening database")
+
+		db, err := gorm.Open(mysql.New(mysql.Config{
+			DSN: dsn.FormatDSN(),
+			// Keep microseconds for timestamps, like Postgres,
+			// instead of the milliseconds MySQL uses by default.
+			DefaultDatetimePrecision: &mysqlDatetimePrecision,
+		}), &gorm.Config{
+			DisableForeignKeyConstraintWhenMigrating: true,
+			Logger:                                   dbLogger,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		sqlDB, _ := db.DB()
+		sqlDB.SetMaxIdleConns(cfg.Mysql.MaxIdleConnections)
+		sqlDB.SetMaxOpenConns(cfg.Mysql.MaxOpenConnections)
+		sqlDB.SetConnMaxIdleTime(
+			time.Duration(cfg.Mysql.ConnMaxIdleTimeSecs) * time.Second,
+		)
+		sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 
 		return db, nil
 	}
@@ -550,16 +932,17 @@ func Read[T any](db *gorm.DB, fn func(rx *gorm.DB) (T, error)) (T, error) {
 }
 
 func (hsdb *HSDatabase) Write(fn func(tx *gorm.DB) error) error {
-	tx := hsdb.DB.Begin()
-	defer tx.Rollback()
-	if err := fn(tx); err != nil {
-		return err
-	}
+	_, err := Write(hsdb.DB, func(tx *gorm.DB) (struct{}, error) {
+		return struct{}{}, fn(tx)
+	})
 
-	return tx.Commit().Error
+	return err
 }
 
+// Write runs fn in a transaction, committed if fn succeeds. The cached
+// peers are invalidated after the commit if fn changed the nodes.
 func Write[T any](db *gorm.DB, fn func(tx *gorm.DB) (T, error)) (T, error) {
+	db, writes := withPeerCacheWrites(db)
 	tx := db.Begin()
 	defer tx.Rollback()
 	ret, err := fn(tx)
@@ -567,5 +950,10 @@ func Write[T any](db *gorm.DB, fn func(tx *gorm.DB) (T, error)) (T, error) {
 		var no T
 		return no, err
 	}
-	return ret, tx.Commit().Error
+	if err := tx.Commit().Error; err != nil {
+		return ret, err
+	}
+	writes.invalidate()
+
+	return ret, nil
 }
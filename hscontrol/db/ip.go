@@ -8,6 +8,7 @@ import (
 	"math/big"
 	"net/netip"
 	"sync"
+	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
@@ -34,6 +35,11 @@ type IPAllocator struct {
 	// strategy used for handing out IP addresses.
 	strategy types.IPAllocationStrategy
 
+	// bits4 is the length of the IPv4 prefix handed out to every node,
+	// the address of the node being its first address. Zero or 32 hands
+	// out single addresses.
+	bits4 int
+
 	// Set of all IPs handed out.
 	// This might not be in sync with the database,
 	// but it is more conservative. If saves to the
@@ -47,36 +53,54 @@ type IPAllocator struct {
 // provided IPv4 and IPv6 prefix. It needs to be created
 // when headscale starts and needs to finish its read
 // transaction before any writes to the database occur.
+// With a perNodePrefixLen below 32, every node is handed out
+// an IPv4 block of that length instead of a single address.
 func NewIPAllocator(
 	db *HSDatabase,
 	prefix4, prefix6 *netip.Prefix,
 	strategy types.IPAllocationStrategy,
+	perNodePrefixLen int,
 ) (*IPAllocator, error) {
 	ret := IPAllocator{
 		prefix4: prefix4,
 		prefix6: prefix6,
 
 		strategy: strategy,
+		bits4:    perNodePrefixLen,
 	}
 
 	var v4s []sql.NullString
 	var v6s []sql.NullString
+	var requested []sql.NullString
 
 	if db != nil {
 		err := db.Read(func(rx *gorm.DB) error {
-			return rx.Model(&types.Node{}).Pluck("ipv4", &v4s).Error
+			return withOperation(rx, operationIPAllocationScan).Model(&types.Node{}).Pluck("ipv4", &v4s).Error
 		})
 		if err != nil {
 			return nil, fmt.Errorf("reading IPv4 addresses from database: %w", err)
 		}
 
 		err = db.Read(func(rx *gorm.DB) error {
-			return rx.Model(&types.Node{}).Pluck("ipv6", &v6s).Error
+			return withOperation(rx, operationIPAllocationScan).Model(&types.Node{}).Pluck("ipv6", &v6s).Error
 		})
 		if err != nil {
 			return nil, fmt.Errorf("reading IPv6 addresses from database: %w", err)
 		}
 
+		// Addresses requested by pre auth keys that have not been used
+		// yet are reserved, so they are not handed out to other nodes.
+		// The keys which have expired cannot be used anymore, their
+		// addresses are free.
+		err = db.Read(func(rx *gorm.DB) error {
+			return rx.Model(&types.PreAuthKey{}).
+				Where("used = ? AND requested_ip IS NOT NULL AND requested_ip != ''", false).
+				Where("expiration IS NULL OR expiration > ?", time.Now()).
+				Pluck("requested_ip", &requested).Error
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading requested IP addresses from database: %w", err)
+		}
 	}
 
 	var ips netipx.IPSetBuilder
@@ -103,15 +127,28 @@ func NewIPAllocator(
 	}
 
 	// Fetch all the IP Addresses currently handed out from the Database
-	// and add them to the used IP set.
-	for _, addrStr := range append(v4s, v6s...) {
+	// and add them to the used IP set. With blocks, the addresses must
+	// be the first of their block, which is not shared with another one.
+	blocks := make(map[netip.Prefix]bool)
+	for _, addrStr := range append(append(v4s, v6s...), requested...) {
 		if addrStr.Valid {
 			addr, err := netip.ParseAddr(addrStr.String)
 			if err != nil {
 				return nil, fmt.Errorf("parsing IP address from database: %w", err)
 			}
 
-			ips.Add(addr)
+			block := ret.block(addr)
+			if block.Bits() < addr.BitLen() {
+				if block.Addr() != addr {
+					return nil, fmt.Errorf("%w: %s is in the block %s", ErrIPNotBlockStart, addr, block)
+				}
+				if blocks[block] {
+					return nil, fmt.Errorf("%w: the block %s is shared by several addresses", ErrIPAlreadyAllocated, block)
+				}
+				blocks[block] = true
+			}
+
+			ips.AddPrefix(block)
 		}
 	}
 
@@ -156,7 +193,106 @@ func (i *IPAllocator) Next() (*netip.Addr, *netip.Addr, error) {
 	return ret4, ret6, nil
 }
 
-var ErrCouldNotAllocateIP = errors.New("failed to allocate IP")
+var (
+	ErrCouldNotAllocateIP = types.NewHeadscaleError(types.CodeIPExhausted, "failed to allocate IP")
+	ErrIPNotInPrefix      = types.NewHeadscaleError(types.CodeIPNotInPrefix, "IP is not in any of the configured prefixes")
+	ErrIPAlreadyAllocated = types.NewHeadscaleError(types.CodeIPAlreadyAllocated, "IP is already allocated")
+	ErrIPNotBlockStart    = types.NewHeadscaleError(types.CodeInvalidArgument, "IP is not the first address of a node block")
+)
+
+// block returns the prefix handed out to the node with the address ip,
+// the IPv4 block starting at ip with a per node prefix length, or ip
+// alone.
+func (i *IPAllocator) block(ip netip.Addr) netip.Prefix {
+	if ip.Is4() && i.bits4 > 0 && i.bits4 < 32 {
+		return netip.PrefixFrom(ip, i.bits4).Masked()
+	}
+
+	return netip.PrefixFrom(ip, ip.BitLen())
+}
+
+// Reserve marks the given IP as used, so it is not handed out by Next.
+// It fails if the IP is not within the configured prefixes, or if it
+// has already been handed out or reserved. With IPv4 blocks, the IP
+// must be the first address of a free block, which is reserved whole.
+func (i *IPAllocator) Reserve(ip netip.Addr) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if !(ip.Is4() && i.prefix4 != nil && i.prefix4.Contains(ip)) &&
+		!(ip.Is6() && i.prefix6 != nil && i.prefix6.Contains(ip)) {
+		return fmt.Errorf("%w: %s", ErrIPNotInPrefix, ip)
+	}
+
+	block := i.block(ip)
+	if block.Addr() != ip {
+		return fmt.Errorf("%w: %s is in the block %s", ErrIPNotBlockStart, ip, block)
+	}
+
+	set, err := i.usedIPs.IPSet()
+	if err != nil {
+		return err
+	}
+
+	if set.OverlapsPrefix(block) {
+		return fmt.Errorf("%w: %s", ErrIPAlreadyAllocated, ip)
+	}
+
+	i.usedIPs.AddPrefix(block)
+
+	return nil
+}
+
+// Release marks the IPs of a deleted node as free, so they can be
+// handed out again, with their blocks. Nil IPs are ignored.
+func (i *IPAllocator) Release(ips ...*netip.Addr) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, ip := range ips {
+		if ip != nil {
+			i.usedIPs.RemovePrefix(i.block(*ip))
+		}
+	}
+}
+
+// NextWith works like Next, but uses the requested IP, previously
+// reserved with Reserve, for its address family instead of allocating
+// a new one. If requested is nil, it is equivalent to Next.
+func (i *IPAllocator) NextWith(requested *netip.Addr) (*netip.Addr, *netip.Addr, error) {
+	if requested == nil {
+		return i.Next()
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var err error
+	var ret4 *netip.Addr
+	var ret6 *netip.Addr
+
+	if requested.Is4() {
+		ret4 = requested
+	} else if i.prefix4 != nil {
+		ret4, err = i.next(i.prev4, i.prefix4)
+		if err != nil {
+			return nil, nil, fmt.Errorf("allocating IPv4 address: %w", err)
+		}
+		i.prev4 = *ret4
+	}
+
+	if requested.Is6() {
+		ret6 = requested
+	} else if i.prefix6 != nil {
+		ret6, err = i.next(i.prev6, i.prefix6)
+		if err != nil {
+			return nil, nil, fmt.Errorf("allocating IPv6 address: %w", err)
+		}
+		i.prev6 = *ret6
+	}
+
+	return ret4, ret6, nil
+}
 
 func (i *IPAllocator) nextLocked(prev netip.Addr, prefix *netip.Prefix) (*netip.Addr, error) {
 	i.mu.Lock()
@@ -187,15 +323,28 @@ func (i *IPAllocator) next(prev netip.Addr, prefix *netip.Prefix) (*netip.Addr,
 	}
 
 	for {
-		if !prefix.Contains(ip) {
+		// With blocks, the IP is moved to the start of the next
+		// block, or of its block for a random IP.
+		block := i.block(ip)
+		if block.Addr() != ip {
+			if i.strategy == types.IPAllocationStrategySequential {
+				ip = netipx.PrefixLastIP(block).Next()
+				block = i.block(ip)
+			} else {
+				ip = block.Addr()
+			}
+		}
+
+		if !ip.IsValid() || !prefix.Contains(ip) {
 			return nil, ErrCouldNotAllocateIP
 		}
 
-		// Check if the IP has already been allocated.
-		if set.Contains(ip) {
+		// Check if the IP, or an address of its block, has already
+		// been allocated.
+		if set.OverlapsPrefix(block) {
 			switch i.strategy {
 			case types.IPAllocationStrategySequential:
-				ip = ip.Next()
+				ip = netipx.PrefixLastIP(block).Next()
 			case types.IPAllocationStrategyRandom:
 				ip, err = randomNext(*prefix)
 				if err != nil {
@@ -206,7 +355,7 @@ func (i *IPAllocator) next(prev netip.Addr, prefix *netip.Prefix) (*netip.Addr,
 			continue
 		}
 
-		i.usedIPs.Add(ip)
+		i.usedIPs.AddPrefix(block)
 
 		return &ip, nil
 	}
@@ -258,7 +407,8 @@ func randomNext(pfx netip.Prefix) (netip.Addr, error) {
 // it will be added.
 // If a prefix type has been removed (IPv4 or IPv6), it
 // will remove the IPs in that family from the node.
-func (db *HSDatabase) BackfillNodeIPs(i *IPAllocator) ([]string, error) {
+// Locked nodes are skipped unless force is set.
+func (db *HSDatabase) BackfillNodeIPs(i *IPAllocator, force bool) ([]string, error) {
 	var err error
 	var ret []string
 	err = db.Write(func(tx *gorm.DB) error {
@@ -276,6 +426,14 @@ func (db *HSDatabase) BackfillNodeIPs(i *IPAllocator) ([]string, error) {
 		for _, node := range nodes {
 			log.Trace().Uint64("node.id", node.ID.Uint64()).Msg("checking if need backfill")
 
+			needsBackfill := (i.prefix4 != nil) != (node.IPv4 != nil) ||
+				(i.prefix6 != nil) != (node.IPv6 != nil)
+			if needsBackfill && CheckNodeUnlocked(node, force) != nil {
+				ret = append(ret, fmt.Sprintf("skipping locked Node(%d) %q", node.ID, node.Hostname))
+
+				continue
+			}
+
 			changed := false
 			// IPv4 prefix is set, but node ip is missing, alloc
 			if i.prefix4 != nil && node.IPv4 == nil {
@@ -2,10 +2,12 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"net/netip"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/google/go-cmp/cmp"
@@ -146,6 +148,7 @@ func TestIPAllocatorSequential(t *testing.T) {
 				tt.prefix4,
 				tt.prefix6,
 				types.IPAllocationStrategySequential,
+				32,
 			)
 
 			spew.Dump(alloc)
@@ -250,7 +253,7 @@ func TestIPAllocatorRandom(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			db := tt.dbFunc()
 
-			alloc, _ := NewIPAllocator(db, tt.prefix4, tt.prefix6, types.IPAllocationStrategyRandom)
+			alloc, _ := NewIPAllocator(db, tt.prefix4, tt.prefix6, types.IPAllocationStrategyRandom, 32)
 
 			spew.Dump(alloc)
 
@@ -278,6 +281,206 @@ func TestIPAllocatorRandom(t *testing.T) {
 	}
 }
 
+func TestIPAllocatorReserve(t *testing.T) {
+	alloc, err := NewIPAllocator(
+		nil,
+		mpp("100.64.0.0/10"),
+		mpp("fd7a:115c:a1e0::/48"),
+		types.IPAllocationStrategySequential,
+		32,
+	)
+	if err != nil {
+		t.Fatalf("creating allocator: %s", err)
+	}
+
+	if err := alloc.Reserve(na("100.64.0.1")); err != nil {
+		t.Fatalf("reserving IP: %s", err)
+	}
+
+	if err := alloc.Reserve(na("100.64.0.1")); !errors.Is(err, ErrIPAlreadyAllocated) {
+		t.Errorf("reserving IP twice: want %s, got %v", ErrIPAlreadyAllocated, err)
+	}
+
+	if err := alloc.Reserve(na("10.0.0.1")); !errors.Is(err, ErrIPNotInPrefix) {
+		t.Errorf("reserving IP outside prefix: want %s, got %v", ErrIPNotInPrefix, err)
+	}
+
+	// The reserved IP is skipped by Next.
+	got4, got6, err := alloc.Next()
+	if err != nil {
+		t.Fatalf("allocating next IP: %s", err)
+	}
+
+	if diff := cmp.Diff(nap("100.64.0.2"), got4, util.Comparers...); diff != "" {
+		t.Errorf("Next unexpected IPv4 (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(nap("fd7a:115c:a1e0::1"), got6, util.Comparers...); diff != "" {
+		t.Errorf("Next unexpected IPv6 (-want +got):\n%s", diff)
+	}
+
+	// The reserved IP is handed out by NextWith, the other family is
+	// allocated as usual.
+	got4, got6, err = alloc.NextWith(nap("100.64.0.1"))
+	if err != nil {
+		t.Fatalf("allocating next IP with requested IP: %s", err)
+	}
+
+	if diff := cmp.Diff(nap("100.64.0.1"), got4, util.Comparers...); diff != "" {
+		t.Errorf("NextWith unexpected IPv4 (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(nap("fd7a:115c:a1e0::2"), got6, util.Comparers...); diff != "" {
+		t.Errorf("NextWith unexpected IPv6 (-want +got):\n%s", diff)
+	}
+}
+
+func TestIPAllocatorRelease(t *testing.T) {
+	alloc, err := NewIPAllocator(
+		nil,
+		mpp("100.64.0.0/10"),
+		nil,
+		types.IPAllocationStrategySequential,
+		32,
+	)
+	if err != nil {
+		t.Fatalf("creating allocator: %s", err)
+	}
+
+	got4, _, err := alloc.Next()
+	if err != nil {
+		t.Fatalf("allocating next IP: %s", err)
+	}
+
+	if err := alloc.Reserve(*got4); !errors.Is(err, ErrIPAlreadyAllocated) {
+		t.Errorf("reserving allocated IP: want %s, got %v", ErrIPAlreadyAllocated, err)
+	}
+
+	alloc.Release(got4, nil)
+
+	// A released IP can be handed out again.
+	if err := alloc.Reserve(*got4); err != nil {
+		t.Errorf("reserving released IP: %s", err)
+	}
+}
+
+func TestIPAllocatorBlocks(t *testing.T) {
+	// The first and the last /30 of the prefix hold its network and
+	// broadcast addresses, two blocks are left.
+	alloc, err := NewIPAllocator(
+		nil,
+		mpp("100.64.0.0/28"),
+		mpp("fd7a:115c:a1e0::/48"),
+		types.IPAllocationStrategySequential,
+		30,
+	)
+	if err != nil {
+		t.Fatalf("creating allocator: %s", err)
+	}
+
+	var got []string
+	for range 2 {
+		got4, got6, err := alloc.Next()
+		if err != nil {
+			t.Fatalf("allocating next IP: %s", err)
+		}
+		got = append(got, got4.String(), got6.String())
+	}
+
+	want := []string{"100.64.0.4", "fd7a:115c:a1e0::1", "100.64.0.8", "fd7a:115c:a1e0::2"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Next unexpected IPs (-want +got):\n%s", diff)
+	}
+
+	if _, _, err := alloc.Next(); !errors.Is(err, ErrCouldNotAllocateIP) {
+		t.Errorf("allocating a block in a full prefix: want %s, got %v", ErrCouldNotAllocateIP, err)
+	}
+
+	// The addresses of a block cannot be reserved for another node.
+	if err := alloc.Reserve(na("100.64.0.9")); !errors.Is(err, ErrIPNotBlockStart) {
+		t.Errorf("reserving IP in a block: want %s, got %v", ErrIPNotBlockStart, err)
+	}
+
+	alloc.Release(nap("100.64.0.8"))
+	if err := alloc.Reserve(na("100.64.0.8")); err != nil {
+		t.Errorf("reserving released block: %s", err)
+	}
+
+	// Nodes sharing a block are refused.
+	db := dbForTest(t, "blocks-shared")
+	db.DB.Save(&types.Node{IPv4: nap("100.64.0.4")})
+	db.DB.Save(&types.Node{IPv4: nap("100.64.0.5")})
+
+	_, err = NewIPAllocator(db, mpp("100.64.0.0/10"), nil, types.IPAllocationStrategySequential, 30)
+	if !errors.Is(err, ErrIPNotBlockStart) {
+		t.Errorf("creating allocator with nodes sharing a block: want %s, got %v", ErrIPNotBlockStart, err)
+	}
+}
+
+func TestIPAllocatorRequestedIPs(t *testing.T) {
+	db := dbForTest(t, "requested-ips")
+
+	user, err := db.CreateUser("requested")
+	if err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+
+	now := time.Now()
+	createKey := func(expiration time.Time, ip string) {
+		t.Helper()
+
+		key, err := db.CreatePreAuthKey(user.Name, false, false, &expiration, nil)
+		if err != nil {
+			t.Fatalf("creating pre auth key: %s", err)
+		}
+		if err := SetPreAuthKeyRequestedIP(db.DB, key, na(ip)); err != nil {
+			t.Fatalf("setting requested IP: %s", err)
+		}
+	}
+
+	createKey(now.Add(time.Hour), "100.64.0.1")
+	createKey(now.Add(-time.Hour), "100.64.0.2")
+
+	// The address of an expired key was given to a node after a
+	// restart.
+	createKey(now.Add(-time.Hour), "100.64.0.3")
+	if err := db.DB.Save(&types.Node{IPv4: nap("100.64.0.3")}).Error; err != nil {
+		t.Fatalf("saving node: %s", err)
+	}
+
+	alloc, err := NewIPAllocator(db, mpp("100.64.0.0/10"), nil, types.IPAllocationStrategySequential, 32)
+	if err != nil {
+		t.Fatalf("creating allocator: %s", err)
+	}
+
+	// Only the address of the key which has not expired is reserved.
+	got4, _, err := alloc.Next()
+	if err != nil {
+		t.Fatalf("allocating next IP: %s", err)
+	}
+	if diff := cmp.Diff(nap("100.64.0.2"), got4, util.Comparers...); diff != "" {
+		t.Errorf("Next unexpected IPv4 (-want +got):\n%s", diff)
+	}
+
+	// The addresses of the expired keys are cleared once, the one
+	// given to a node is not released.
+	released, err := db.ClearExpiredRequestedIPs(now)
+	if err != nil {
+		t.Fatalf("clearing expired requested IPs: %s", err)
+	}
+	if diff := cmp.Diff([]netip.Addr{na("100.64.0.2")}, released, util.Comparers...); diff != "" {
+		t.Errorf("ClearExpiredRequestedIPs unexpected IPs (-want +got):\n%s", diff)
+	}
+
+	released, err = db.ClearExpiredRequestedIPs(now)
+	if err != nil {
+		t.Fatalf("clearing expired requested IPs: %s", err)
+	}
+	if len(released) != 0 {
+		t.Errorf("ClearExpiredRequestedIPs released %v again", released)
+	}
+}
+
 func TestBackfillIPAddresses(t *testing.T) {
 	fullNodeP := func(i int) *types.Node {
 		v4 := fmt.Sprintf("100.64.0.%d", i)
@@ -463,12 +666,12 @@ func TestBackfillIPAddresses(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			db := tt.dbFunc()
 
-			alloc, err := NewIPAllocator(db, tt.prefix4, tt.prefix6, types.IPAllocationStrategySequential)
+			alloc, err := NewIPAllocator(db, tt.prefix4, tt.prefix6, types.IPAllocationStrategySequential, 32)
 			if err != nil {
 				t.Fatalf("failed to set up ip alloc: %s", err)
 			}
 
-			logs, err := db.BackfillNodeIPs(alloc)
+			logs, err := db.BackfillNodeIPs(alloc, false)
 			if err != nil {
 				t.Fatalf("failed to backfill: %s", err)
 			}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+)
+
+const (
+	prometheusNamespace = "headscale"
+
+	metricsStartKey     = "headscale:metrics_start"
+	metricsOperationKey = "headscale:metrics_operation"
+)
+
+// Named operations, used as the operation label of the query metrics
+// for the queries worth telling apart from the other queries on the
+// same table.
+const (
+	operationNodeInsert       = "node_insert"
+	operationIPAllocationScan = "ip_allocation_scan"
+	operationPeerListQuery    = "peer_list_query"
+)
+
+var (
+	dbQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "db_queries_total",
+		Help:      "The number of database queries by backend, operation, table and status",
+	}, []string{"database", "operation", "table", "status"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: prometheusNamespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "The latency of database queries by backend, operation and table",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 15),
+	}, []string{"database", "operation", "table"})
+)
+
+// withOperation names the queries run with tx in the query metrics.
+func withOperation(tx *gorm.DB, operation string) *gorm.DB {
+	return tx.Set(metricsOperationKey, operation)
+}
+
+// registerMetricsCallbacks instruments db to record the count and
+// latency of every query it runs.
+func registerMetricsCallbacks(db *gorm.DB) error {
+	database := db.Dialector.Name()
+
+	before := func(tx *gorm.DB) {
+		tx.InstanceSet(metricsStartKey, time.Now())
+	}
+
+	after := func(kind string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			start, ok := tx.InstanceGet(metricsStartKey)
+			if !ok {
+				return
+			}
+
+			operation := kind
+			if name, ok := tx.Get(metricsOperationKey); ok {
+				operation = name.(string)
+			}
+
+			table := tx.Statement.Table
+			if table == "" {
+				table = "unknown"
+			}
+
+			status := "success"
+			if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+				status = "error"
+			}
+
+			dbQueries.WithLabelValues(database, operation, table, status).Inc()
+			dbQueryDuration.WithLabelValues(database, operation, table).
+				Observe(time.Since(start.(time.Time)).Seconds())
+		}
+	}
+
+	callbacks := db.Callback()
+	for _, err := range []error{
+		callbacks.Create().Before("gorm:create").Register("metrics:before_create", before),
+		callbacks.Create().After("gorm:create").Register("metrics:after_create", after("create")),
+		callbacks.Query().Before("gorm:query").Register("metrics:before_query", before),
+		callbacks.Query().After("gorm:query").Register("metrics:after_query", after("query")),
+		callbacks.Update().Before("gorm:update").Register("metrics:before_update", before),
+		callbacks.Update().After("gorm:update").Register("metrics:after_update", after("update")),
+		callbacks.Delete().Before("gorm:delete").Register("metrics:before_delete", before),
+		callbacks.Delete().After("gorm:delete").Register("metrics:after_delete", after("delete")),
+		callbacks.Row().Before("gorm:row").Register("metrics:before_row", before),
+		callbacks.Row().After("gorm:row").Register("metrics:after_row", after("row")),
+		callbacks.Raw().Before("gorm:raw").Register("metrics:before_raw", before),
+		callbacks.Raw().After("gorm:raw").Register("metrics:after_raw", after("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RegisterMetrics registers the connection pool statistics of the
+// database with reg, replacing the ones of a previously opened database.
+func (hsdb *HSDatabase) RegisterMetrics(reg prometheus.Registerer) error {
+	sqlDB, err := hsdb.DB.DB()
+	if err != nil {
+		return err
+	}
+
+	collector := collectors.NewDBStatsCollector(sqlDB, hsdb.DB.Dialector.Name())
+
+	err = reg.Register(collector)
+
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		reg.Unregister(registered.ExistingCollector)
+
+		return reg.Register(collector)
+	}
+
+	return err
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/check.v1"
+	"gorm.io/gorm"
+	"tailscale.com/types/key"
+)
+
+func counterValue(c *check.C, counter prometheus.Counter) float64 {
+	var metric dto.Metric
+	c.Assert(counter.Write(&metric), check.IsNil)
+
+	return metric.GetCounter().GetValue()
+}
+
+func (s *Suite) TestQueryMetrics(c *check.C) {
+	database := db.DB.Dialector.Name()
+	inserts := dbQueries.WithLabelValues(database, operationNodeInsert, "nodes", "success")
+	peerLists := dbQueries.WithLabelValues(database, operationPeerListQuery, "nodes", "success")
+	userQueries := dbQueries.WithLabelValues(database, "query", "users", "success")
+
+	insertsBefore := counterValue(c, inserts)
+	peerListsBefore := counterValue(c, peerLists)
+	userQueriesBefore := counterValue(c, userQueries)
+
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	_, err = db.GetUser("test")
+	c.Assert(err, check.IsNil)
+
+	node := types.Node{
+		MachineKey:     key.NewMachine().Public(),
+		NodeKey:        key.NewNode().Public(),
+		Hostname:       "testnode",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodCLI,
+	}
+	registered, err := Write(db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		return RegisterNode(tx, node, nil, nil)
+	})
+	c.Assert(err, check.IsNil)
+
+	_, err = db.ListPeers(registered.ID)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(counterValue(c, inserts)-insertsBefore, check.Equals, 1.0)
+	c.Assert(counterValue(c, peerLists)-peerListsBefore >= 1, check.Equals, true)
+	c.Assert(counterValue(c, userQueries)-userQueriesBefore >= 1, check.Equals, true)
+}
+
+func (s *Suite) TestRegisterPoolMetrics(c *check.C) {
+	reg := prometheus.NewRegistry()
+	c.Assert(db.RegisterMetrics(reg), check.IsNil)
+
+	// Registering a reopened database replaces the statistics of
+	// the previous one.
+	c.Assert(db.RegisterMetrics(reg), check.IsNil)
+
+	families, err := reg.Gather()
+	c.Assert(err, check.IsNil)
+
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+
+	c.Assert(names["go_sql_in_use_connections"], check.Equals, true)
+	c.Assert(names["go_sql_idle_connections"], check.Equals, true)
+	c.Assert(names["go_sql_wait_count_total"], check.Equals, true)
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// mysqlDBForTest opens the MySQL/MariaDB database configured with the
+// HEADSCALE_TEST_MYSQL_* environment variables, skipping the test if
+// HEADSCALE_TEST_MYSQL_HOST is not set. All tables are dropped when the
+// test finishes.
+func mysqlDBForTest(t *testing.T) *HSDatabase {
+	t.Helper()
+
+	host := os.Getenv("HEADSCALE_TEST_MYSQL_HOST")
+	if host == "" {
+		t.Skip("HEADSCALE_TEST_MYSQL_HOST is not set, skipping MySQL test")
+	}
+
+	port := 3306
+	if p := os.Getenv("HEADSCALE_TEST_MYSQL_PORT"); p != "" {
+		var err error
+		port, err = strconv.Atoi(p)
+		if err != nil {
+			t.Fatalf("parsing HEADSCALE_TEST_MYSQL_PORT: %s", err)
+		}
+	}
+
+	getenv := func(name, fallback string) string {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+
+		return fallback
+	}
+
+	hsdb, err := NewHeadscaleDatabase(
+		types.DatabaseConfig{
+			Type: types.DatabaseMysql,
+			Mysql: types.MysqlConfig{
+				Host:               host,
+				Port:               port,
+				Name:               getenv("HEADSCALE_TEST_MYSQL_NAME", "headscale"),
+				User:               getenv("HEADSCALE_TEST_MYSQL_USER", "headscale"),
+				Pass:               os.Getenv("HEADSCALE_TEST_MYSQL_PASS"),
+				MaxOpenConnections: 10,
+				MaxIdleConnections: 10,
+			},
+		},
+		"",
+	)
+	if err != nil {
+		t.Fatalf("setting up database: %s", err)
+	}
+
+	t.Cleanup(func() {
+		// The tables are the ones the migrations created, dropped on a
+		// single connection with the foreign keys checks disabled so
+		// their order does not matter.
+		err := hsdb.DB.Connection(func(tx *gorm.DB) error {
+			tables, err := tx.Migrator().GetTables()
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Exec("SET FOREIGN_KEY_CHECKS = 0").Error; err != nil {
+				return err
+			}
+
+			for _, table := range tables {
+				if err := tx.Migrator().DropTable(table); err != nil {
+					return err
+				}
+			}
+
+			return tx.Exec("SET FOREIGN_KEY_CHECKS = 1").Error
+		})
+		if err != nil {
+			t.Errorf("dropping tables: %s", err)
+		}
+
+		hsdb.Close()
+	})
+
+	return hsdb
+}
+
+func TestConcurrentRegistrationUniqueIPs(t *testing.T) {
+	tests := []struct {
+		name   string
+		dbFunc func(t *testing.T) *HSDatabase
+	}{
+		{
+			name: "sqlite",
+			dbFunc: func(t *testing.T) *HSDatabase {
+				return dbForTest(t, "concurrent-registration")
+			},
+		},
+		{
+			name:   "mysql",
+			dbFunc: mysqlDBForTest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hsdb := tt.dbFunc(t)
+
+			user, err := hsdb.CreateUser("concurrent")
+			if err != nil {
+				t.Fatalf("creating user: %s", err)
+			}
+
+			alloc, err := NewIPAllocator(
+				hsdb,
+				mpp("100.64.0.0/10"),
+				mpp("fd7a:115c:a1e0::/48"),
+				types.IPAllocationStrategySequential,
+				32,
+			)
+			if err != nil {
+				t.Fatalf("creating allocator: %s", err)
+			}
+
+			const count = 50
+
+			var wg sync.WaitGroup
+			errs := make(chan error, count)
+
+			for i := range count {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+
+					ipv4, ipv6, err := alloc.Next()
+					if err != nil {
+						errs <- err
+
+						return
+					}
+
+					node := types.Node{
+						MachineKey:     key.NewMachine().Public(),
+						NodeKey:        key.NewNode().Public(),
+						DiscoKey:       key.NewDisco().Public(),
+						Hostname:       fmt.Sprintf("node-%d", i),
+						GivenName:      fmt.Sprintf("node-%d", i),
+						UserID:         user.ID,
+						User:           *user,
+						RegisterMethod: util.RegisterMethodAuthKey,
+						Hostinfo:       &tailcfg.Hostinfo{},
+					}
+
+					_, err = hsdb.RegisterNode(node, ipv4, ipv6)
+					if err != nil {
+						errs <- err
+					}
+				}(i)
+			}
+
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Errorf("registering node: %s", err)
+			}
+
+			nodes, err := hsdb.ListNodes()
+			if err != nil {
+				t.Fatalf("listing nodes: %s", err)
+			}
+
+			if len(nodes) != count {
+				t.Fatalf("want %d nodes, got %d", count, len(nodes))
+			}
+
+			seen := make(map[netip.Addr]string)
+			for _, node := range nodes {
+				for _, ip := range node.IPs() {
+					if other, ok := seen[ip]; ok {
+						t.Errorf("IP %s given to both %s and %s", ip, other, node.Hostname)
+					}
+					seen[ip] = node.Hostname
+				}
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package db
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"net/netip"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
@@ -12,7 +16,6 @@ import (
 	"github.com/patrickmn/go-cache"
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
-	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 )
 
@@ -22,18 +25,47 @@ const (
 )
 
 var (
-	ErrNodeNotFound                  = errors.New("node not found")
-	ErrNodeRouteIsNotAvailable       = errors.New("route is not available on node")
-	ErrNodeNotFoundRegistrationCache = errors.New(
+	ErrNodeNotFound                  = types.NewHeadscaleError(types.CodeNodeNotFound, "node not found")
+	ErrNodeRouteIsNotAvailable       = types.NewHeadscaleError(types.CodeRouteNotAvailable, "route is not available on node")
+	ErrNodeNotFoundRegistrationCache = types.NewHeadscaleError(
+		types.CodeNodeNotRegistered,
 		"node not found in registration cache",
 	)
 	ErrCouldNotConvertNodeInterface = errors.New("failed to convert node interface")
-	ErrDifferentRegisteredUser      = errors.New(
+	ErrDifferentRegisteredUser      = types.NewHeadscaleError(
+		types.CodeUserMismatch,
 		"node was previously registered with a different user",
 	)
+	ErrNodeLocked = types.NewHeadscaleError(
+		types.CodeNodeLocked,
+		"node is locked, unlock it or force the change",
+	)
+	ErrNodeMetadataTooLarge = types.NewHeadscaleError(
+		types.CodeInvalidArgument,
+		fmt.Sprintf("node metadata must not exceed %d bytes in JSON", types.MaxNodeMetadataSize),
+	)
+	ErrNodeMetadataEmptyKey = types.NewHeadscaleError(
+		types.CodeInvalidArgument,
+		"node metadata keys must not be empty",
+	)
 )
 
 func (hsdb *HSDatabase) ListPeers(nodeID types.NodeID) (types.Nodes, error) {
+	if hsdb.peerCache != nil {
+		return hsdb.peerCache.Peers(nodeID, func() (types.Nodes, error) {
+			nodes, err := Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+				return ListNodes(withOperation(rx, operationPeerListQuery))
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+
+			return nodes, nil
+		}, time.Now())
+	}
+
 	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
 		return ListPeers(rx, nodeID)
 	})
@@ -42,11 +74,13 @@ func (hsdb *HSDatabase) ListPeers(nodeID types.NodeID) (types.Nodes, error) {
 // ListPeers returns all peers of node, regardless of any Policy or if the node is expired.
 func ListPeers(tx *gorm.DB, nodeID types.NodeID) (types.Nodes, error) {
 	nodes := types.Nodes{}
-	if err := tx.
+	if err := withOperation(tx, operationPeerListQuery).
 		Preload("AuthKey").
 		Preload("AuthKey.User").
+		Preload("AuthKey.ACLTags").
 		Preload("User").
 		Preload("Routes").
+		Preload("AllowedRoutes").
 		Where("id <> ?",
 			nodeID).Find(&nodes).Error; err != nil {
 		return types.Nodes{}, err
@@ -68,8 +102,35 @@ func ListNodes(tx *gorm.DB) (types.Nodes, error) {
 	if err := tx.
 		Preload("AuthKey").
 		Preload("AuthKey.User").
+		Preload("AuthKey.ACLTags").
+		Preload("User").
+		Preload("Routes").
+		Preload("AllowedRoutes").
+		Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func (hsdb *HSDatabase) ListNodesByLastSeenBefore(threshold time.Time) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListNodesByLastSeenBefore(rx, threshold)
+	})
+}
+
+// ListNodesByLastSeenBefore returns the nodes last seen before threshold.
+// Nodes that have never been seen are not returned.
+func ListNodesByLastSeenBefore(tx *gorm.DB, threshold time.Time) (types.Nodes, error) {
+	nodes := types.Nodes{}
+	if err := tx.
+		Preload("AuthKey").
+		Preload("AuthKey.User").
+		Preload("AuthKey.ACLTags").
 		Preload("User").
 		Preload("Routes").
+		Preload("AllowedRoutes").
+		Where("last_seen < ?", threshold).
 		Find(&nodes).Error; err != nil {
 		return nil, err
 	}
@@ -82,8 +143,10 @@ func listNodesByGivenName(tx *gorm.DB, givenName string) (types.Nodes, error) {
 	if err := tx.
 		Preload("AuthKey").
 		Preload("AuthKey.User").
+		Preload("AuthKey.ACLTags").
 		Preload("User").
 		Preload("Routes").
+		Preload("AllowedRoutes").
 		Where("given_name = ?", givenName).Find(&nodes).Error; err != nil {
 		return nil, err
 	}
@@ -125,8 +188,10 @@ func GetNodeByID(tx *gorm.DB, id types.NodeID) (*types.Node, error) {
 	if result := tx.
 		Preload("AuthKey").
 		Preload("AuthKey.User").
+		Preload("AuthKey.ACLTags").
 		Preload("User").
 		Preload("Routes").
+		Preload("AllowedRoutes").
 		Find(&types.Node{ID: id}).First(&mach); result.Error != nil {
 		return nil, result.Error
 	}
@@ -149,8 +214,10 @@ func GetNodeByMachineKey(
 	if result := tx.
 		Preload("AuthKey").
 		Preload("AuthKey.User").
+		Preload("AuthKey.ACLTags").
 		Preload("User").
 		Preload("Routes").
+		Preload("AllowedRoutes").
 		First(&mach, "machine_key = ?", machineKey.String()); result.Error != nil {
 		return nil, result.Error
 	}
@@ -178,8 +245,10 @@ func GetNodeByAnyKey(
 	if result := tx.
 		Preload("AuthKey").
 		Preload("AuthKey.User").
+		Preload("AuthKey.ACLTags").
 		Preload("User").
 		Preload("Routes").
+		Preload("AllowedRoutes").
 		First(&node, "machine_key = ? OR node_key = ? OR node_key = ?",
 			machineKey.String(),
 			nodeKey.String(),
@@ -260,6 +329,138 @@ func NodeSetExpiry(tx *gorm.DB,
 	return tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("expiry", expiry).Error
 }
 
+func (hsdb *HSDatabase) NodeSetIP(nodeID types.NodeID, ip netip.Addr) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return NodeSetIP(tx, nodeID, ip)
+	})
+}
+
+// NodeSetIP replaces the address of a node of the same family as ip.
+// The caller is responsible for reserving ip in the IPAllocator.
+func NodeSetIP(tx *gorm.DB,
+	nodeID types.NodeID, ip netip.Addr,
+) error {
+	column := "ipv4"
+	if ip.Is6() {
+		column = "ipv6"
+	}
+
+	if err := tx.Model(&types.Node{}).Where("id = ?", nodeID).Update(column, ip.String()).Error; err != nil {
+		return fmt.Errorf("failed to set IP of node in the database: %w", err)
+	}
+
+	return nil
+}
+
+func (hsdb *HSDatabase) NodeSetPosture(nodeID types.NodeID, checkedAt time.Time, postureErr string) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return NodeSetPosture(tx, nodeID, checkedAt, postureErr)
+	})
+}
+
+// NodeSetPosture records the result of a device posture check of a
+// node, postureErr being empty if the check passed.
+func NodeSetPosture(tx *gorm.DB,
+	nodeID types.NodeID, checkedAt time.Time, postureErr string,
+) error {
+	return tx.Model(&types.Node{}).Where("id = ?", nodeID).Updates(map[string]any{
+		"posture_checked_at": checkedAt,
+		"posture_error":      postureErr,
+	}).Error
+}
+
+func (hsdb *HSDatabase) SetNodeMetadata(nodeID types.NodeID, changes map[string]string) (*types.Node, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) (*types.Node, error) {
+		if err := SetNodeMetadata(tx, nodeID, changes); err != nil {
+			return nil, err
+		}
+
+		return GetNodeByID(tx, nodeID)
+	})
+}
+
+// SetNodeMetadata sets the keys of changes in the metadata of a node, the
+// keys with an empty value are removed.
+func SetNodeMetadata(tx *gorm.DB, nodeID types.NodeID, changes map[string]string) error {
+	node, err := GetNodeByID(tx, nodeID)
+	if err != nil {
+		return err
+	}
+
+	metadata := make(types.NodeMetadata, len(node.Metadata)+len(changes))
+	maps.Copy(metadata, node.Metadata)
+	for key, value := range changes {
+		if key == "" {
+			return ErrNodeMetadataEmptyKey
+		}
+
+		if value == "" {
+			delete(metadata, key)
+		} else {
+			metadata[key] = value
+		}
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if len(data) > types.MaxNodeMetadataSize {
+		return ErrNodeMetadataTooLarge
+	}
+
+	return tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("metadata", metadata).Error
+}
+
+// FilterNodesByMetadata returns the nodes whose metadata has key, with
+// value if it is not empty.
+func FilterNodesByMetadata(nodes types.Nodes, key, value string) types.Nodes {
+	return slices.DeleteFunc(nodes, func(node *types.Node) bool {
+		got, ok := node.Metadata[key]
+
+		return !ok || (value != "" && got != value)
+	})
+}
+
+func (hsdb *HSDatabase) NodeSetLocked(nodeID types.NodeID, locked bool) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return NodeSetLocked(tx, nodeID, locked)
+	})
+}
+
+// NodeSetLocked locks or unlocks a node.
+func NodeSetLocked(tx *gorm.DB, nodeID types.NodeID, locked bool) error {
+	return tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("locked", locked).Error
+}
+
+// CheckNodeUnlocked returns ErrNodeLocked if the node is locked and the
+// change is not forced.
+func CheckNodeUnlocked(node *types.Node, force bool) error {
+	if node.Locked && !force {
+		return ErrNodeLocked.WithDetails(map[string]interface{}{
+			"node_id": node.ID,
+		})
+	}
+
+	return nil
+}
+
+// GetUnlockedNode returns the node, failing with ErrNodeLocked if it is
+// locked and the change is not forced. The node is read in the
+// transaction making the change, so it cannot be locked in between.
+func GetUnlockedNode(tx *gorm.DB, nodeID types.NodeID, force bool) (*types.Node, error) {
+	node, err := GetNodeByID(tx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CheckNodeUnlocked(node, force); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
 func (hsdb *HSDatabase) DeleteNode(node *types.Node, isConnected types.NodeConnectedMap) ([]types.NodeID, error) {
 	return Write(hsdb.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
 		return DeleteNode(tx, node, isConnected)
@@ -277,6 +478,18 @@ func DeleteNode(tx *gorm.DB,
 		return changed, err
 	}
 
+	if err := deleteNodeGroups(tx, node.ID); err != nil {
+		return changed, err
+	}
+
+	if err := deleteNodeAllowedRoutes(tx, node.ID); err != nil {
+		return changed, err
+	}
+
+	if err := deletePeerTrafficStats(tx, node.ID); err != nil {
+		return changed, err
+	}
+
 	// Unscoped causes the node to be fully removed from the database.
 	if err := tx.Unscoped().Delete(&node).Error; err != nil {
 		return changed, err
@@ -285,6 +498,115 @@ func DeleteNode(tx *gorm.DB,
 	return changed, nil
 }
 
+func (hsdb *HSDatabase) DeleteStaleNodes(
+	expiry time.Duration,
+	isConnected types.NodeConnectedMap,
+	dryRun bool,
+) (types.Nodes, []types.NodeID, error) {
+	var stale types.Nodes
+	var changed []types.NodeID
+	err := hsdb.Write(func(tx *gorm.DB) error {
+		var err error
+		stale, changed, err = DeleteStaleNodes(tx, expiry, isConnected, dryRun)
+
+		return err
+	})
+
+	return stale, changed, err
+}
+
+// DeleteStaleNodes deletes the nodes that are not connected and have
+// not been seen for longer than expiry, or only returns them if dryRun
+// is set. Nodes that have never been seen and locked nodes are kept.
+// It returns the stale nodes and the IDs of the nodes whose routes
+// changed. Caller is responsible for notifying all of change.
+func DeleteStaleNodes(
+	tx *gorm.DB,
+	expiry time.Duration,
+	isConnected types.NodeConnectedMap,
+	dryRun bool,
+) (types.Nodes, []types.NodeID, error) {
+	var nodes types.Nodes
+	if err := tx.
+		Preload("User").
+		Where("last_seen < ?", time.Now().Add(-expiry)).
+		Find(&nodes).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var stale types.Nodes
+	var changed []types.NodeID
+	for _, node := range nodes {
+		// Locked nodes are kept until they are unlocked.
+		if isConnected[node.ID] || node.Locked {
+			continue
+		}
+
+		stale = append(stale, node)
+
+		if dryRun {
+			continue
+		}
+
+		routesChanged, err := DeleteNode(tx, node, isConnected)
+		if err != nil {
+			return nil, nil, fmt.Errorf("deleting stale node %d: %w", node.ID, err)
+		}
+		changed = append(changed, routesChanged...)
+	}
+
+	return stale, changed, nil
+}
+
+// SetLastSeen sets the last seen time of a node when it disconnects. It
+// is written on every disconnection, the cached peers are patched
+// instead of invalidated.
+func (hsdb *HSDatabase) SetLastSeen(nodeID types.NodeID, lastSeen time.Time) error {
+	// The write is not recorded, the cache is patched below.
+	tx, _ := withPeerCacheWrites(hsdb.DB)
+	if err := SetLastSeen(tx, nodeID, lastSeen); err != nil {
+		return err
+	}
+
+	hsdb.patchPeerCache(nodeID, func(peer *types.Node) {
+		peer.LastSeen = &lastSeen
+	})
+
+	return nil
+}
+
+// SaveReportedNode saves node after a map request changed what the node
+// reports about itself: its keys, endpoints, Hostinfo and last seen time.
+// It is written on every endpoint update, the cached peers are patched
+// instead of invalidated.
+func (hsdb *HSDatabase) SaveReportedNode(node *types.Node) error {
+	// The write is not recorded, the cache is patched below.
+	tx, _ := withPeerCacheWrites(hsdb.DB)
+	// The allowed routes are only changed with the API, the ones loaded
+	// with the node may be outdated.
+	if err := tx.Omit("AllowedRoutes").Save(node).Error; err != nil {
+		return err
+	}
+
+	// The node is still changed by its session, the cache gets copies.
+	hostinfo := node.Hostinfo.Clone()
+	endpoints := slices.Clone(node.Endpoints)
+	var lastSeen *time.Time
+	if node.LastSeen != nil {
+		seen := *node.LastSeen
+		lastSeen = &seen
+	}
+	hsdb.patchPeerCache(node.ID, func(peer *types.Node) {
+		peer.NodeKey = node.NodeKey
+		peer.DiscoKey = node.DiscoKey
+		peer.Endpoints = endpoints
+		peer.Hostinfo = hostinfo
+		peer.LastSeen = lastSeen
+	})
+
+	return nil
+}
+
 // SetLastSeen sets a node's last seen field indicating that we
 // have recently communicating with this node.
 func SetLastSeen(tx *gorm.DB, nodeID types.NodeID, lastSeen time.Time) error {
@@ -318,6 +640,10 @@ func RegisterNodeFromAuthCallback(
 				)
 			}
 
+			if user.Disabled {
+				return nil, ErrUserDisabled
+			}
+
 			// Registration of expired node with different user
 			if registrationNode.ID != 0 &&
 				registrationNode.UserID != user.ID {
@@ -337,12 +663,17 @@ func RegisterNodeFromAuthCallback(
 				registrationNode,
 				ipv4, ipv6,
 			)
+			if err != nil {
+				return nil, err
+			}
 
-			if err == nil {
-				cache.Delete(mkey.String())
+			if err := DeletePendingRegistration(tx, mkey.String()); err != nil {
+				return nil, fmt.Errorf("failed to delete pending registration: %w", err)
 			}
 
-			return node, err
+			cache.Delete(mkey.String())
+
+			return node, nil
 		} else {
 			return nil, ErrCouldNotConvertNodeInterface
 		}
@@ -388,7 +719,13 @@ func RegisterNode(tx *gorm.DB, node types.Node, ipv4 *netip.Addr, ipv6 *netip.Ad
 	node.IPv4 = ipv4
 	node.IPv6 = ipv6
 
-	if err := tx.Save(&node).Error; err != nil {
+	// New nodes inherit the default tags of their user, on top of
+	// any tags coming from the pre auth key.
+	if len(node.User.DefaultTags) > 0 {
+		node.ForcedTags = mergeTags(node.ForcedTags, node.User.DefaultTags)
+	}
+
+	if err := withOperation(tx, operationNodeInsert).Save(&node).Error; err != nil {
 		return nil, fmt.Errorf("failed register(save) node in the database: %w", err)
 	}
 
@@ -551,6 +888,7 @@ func enableRoutes(tx *gorm.DB,
 			First(&route).Error
 		if err == nil {
 			route.Enabled = true
+			route.Disabled = false
 
 			// Mark already as primary if there is only this node offering this subnet
 			// (and is not an exit route)
@@ -589,10 +927,20 @@ func enableRoutes(tx *gorm.DB,
 	}, nil
 }
 
+// generateGivenName turns a hostname into a DNS label following the
+// dns_config.hostname_policy if it is enabled, or the rules of the user
+// names otherwise. With randomSuffix, the label is trimmed to fit a "-"
+// and NodeGivenNameHashLength random characters within 63 characters.
 func generateGivenName(suppliedName string, randomSuffix bool) (string, error) {
-	normalizedHostname, err := util.NormalizeToFQDNRulesConfigFromViper(
-		suppliedName,
-	)
+	policy := util.HostnamePolicyFromViper()
+
+	var normalizedHostname string
+	var err error
+	if policy.Enabled {
+		normalizedHostname, err = util.NormalizeHostname(suppliedName, policy)
+	} else {
+		normalizedHostname, err = util.NormalizeToFQDNRulesConfigFromViper(suppliedName)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -602,6 +950,9 @@ func generateGivenName(suppliedName string, randomSuffix bool) (string, error) {
 		trimmedHostnameLength := util.LabelHostnameLength - NodeGivenNameHashLength - NodeGivenNameTrimSize
 		if len(normalizedHostname) > trimmedHostnameLength {
 			normalizedHostname = normalizedHostname[:trimmedHostnameLength]
+			if policy.Enabled {
+				normalizedHostname = strings.TrimRight(normalizedHostname, "-")
+			}
 		}
 
 		suffix, err := util.GenerateRandomStringDNSSafe(NodeGivenNameHashLength)
@@ -624,6 +975,9 @@ func (hsdb *HSDatabase) GenerateGivenName(
 	})
 }
 
+// GenerateGivenName returns the DNS label of a node registering with
+// suppliedName as hostname. If another node already uses the label, a
+// random suffix is added to it.
 func GenerateGivenName(
 	tx *gorm.DB,
 	mkey key.MachinePublic,
@@ -659,8 +1013,13 @@ func GenerateGivenName(
 	return givenName, nil
 }
 
+// DeleteExpiredEphemeralNodes deletes the ephemeral nodes that are not
+// connected and have not been seen for longer than inactivityThreshhold.
+// It returns the IDs of the deleted nodes and of the nodes whose routes
+// changed.
 func DeleteExpiredEphemeralNodes(tx *gorm.DB,
 	inactivityThreshhold time.Duration,
+	isConnected types.NodeConnectedMap,
 ) ([]types.NodeID, []types.NodeID) {
 	users, err := ListUsers(tx)
 	if err != nil {
@@ -676,14 +1035,23 @@ func DeleteExpiredEphemeralNodes(tx *gorm.DB,
 		}
 
 		for idx, node := range nodes {
+			// Connected nodes are kept, their LastSeen is only
+			// refreshed with the keep alives.
+			if isConnected[node.ID] {
+				continue
+			}
+
 			if node.IsEphemeral() && node.LastSeen != nil &&
 				time.Now().
 					After(node.LastSeen.Add(inactivityThreshhold)) {
 				expired = append(expired, node.ID)
 
 				log.Info().
+					Uint64("node.id", node.ID.Uint64()).
 					Str("node", node.Hostname).
-					Msg("Ephemeral client removed from database")
+					Time("last_seen", *node.LastSeen).
+					Dur("inactivity_timeout", inactivityThreshhold).
+					Msg("Inactive ephemeral node removed from database")
 
 					// empty isConnected map as ephemeral nodes are not routes
 				changed, err := DeleteNode(tx, nodes[idx], nil)
@@ -712,7 +1080,7 @@ func ExpireExpiredNodes(tx *gorm.DB,
 	// checked everything.
 	started := time.Now()
 
-	expired := make([]*tailcfg.PeerChange, 0)
+	var expired []types.NodeID
 
 	nodes, err := ListNodes(tx)
 	if err != nil {
@@ -720,18 +1088,12 @@ func ExpireExpiredNodes(tx *gorm.DB,
 	}
 	for _, node := range nodes {
 		if node.IsExpired() && node.Expiry.After(lastCheck) {
-			expired = append(expired, &tailcfg.PeerChange{
-				NodeID:    tailcfg.NodeID(node.ID),
-				KeyExpiry: node.Expiry,
-			})
+			expired = append(expired, node.ID)
 		}
 	}
 
 	if len(expired) > 0 {
-		return started, types.StateUpdate{
-			Type:          types.StatePeerChangedPatch,
-			ChangePatches: expired,
-		}, true
+		return started, types.StateUpdateExpired(expired...), true
 	}
 
 	return started, types.StateUpdate{}, false
@@ -0,0 +1,211 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+)
+
+const nodeGroupPrefix = "group:"
+
+var (
+	ErrNodeGroupNotFound     = types.NewHeadscaleError(types.CodeNodeGroupNotFound, "node group not found")
+	ErrNodeGroupExists       = types.NewHeadscaleError(types.CodeNodeGroupExists, "node group already exists")
+	ErrNodeGroupMemberExists = types.NewHeadscaleError(types.CodeNodeGroupMemberExists, "node is already in the group")
+	ErrInvalidNodeGroupName  = types.NewHeadscaleError(types.CodeInvalidNodeGroupName, "invalid node group name")
+)
+
+// normalizeNodeGroupName returns the name of a group without the
+// "group:" prefix used in the ACL policy.
+func normalizeNodeGroupName(name string) (string, error) {
+	name = strings.TrimPrefix(strings.TrimSpace(name), nodeGroupPrefix)
+	if name == "" || strings.ContainsAny(name, ": \t\n") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidNodeGroupName, name)
+	}
+
+	return name, nil
+}
+
+func (hsdb *HSDatabase) AddNodeToGroup(
+	group string,
+	nodeID types.NodeID,
+) (*types.NodeGroup, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) (*types.NodeGroup, error) {
+		return AddNodeToGroup(tx, group, nodeID)
+	})
+}
+
+// AddNodeToGroup adds a node to a group of the ACL policy.
+func AddNodeToGroup(
+	tx *gorm.DB,
+	group string,
+	nodeID types.NodeID,
+) (*types.NodeGroup, error) {
+	name, err := normalizeNodeGroupName(group)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := GetNodeByID(tx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int64
+	if err := tx.Model(&types.NodeGroup{}).
+		Where("group_name = ? AND node_id = ?", name, node.ID).
+		Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrNodeGroupMemberExists
+	}
+
+	nodeGroup := types.NodeGroup{
+		GroupName: name,
+		NodeID:    uint64(node.ID),
+		UserID:    node.UserID,
+	}
+	if err := tx.Create(&nodeGroup).Error; err != nil {
+		return nil, fmt.Errorf("failed to add node to group: %w", err)
+	}
+
+	nodeGroup.Node = *node
+	nodeGroup.User = node.User
+
+	return &nodeGroup, nil
+}
+
+func (hsdb *HSDatabase) ListNodeGroups(group string, user string) ([]types.NodeGroup, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) ([]types.NodeGroup, error) {
+		return ListNodeGroups(rx, group, user)
+	})
+}
+
+// ListNodeGroups returns the node group memberships, only of the group
+// and of the nodes of the user if they are not empty.
+func ListNodeGroups(tx *gorm.DB, group string, user string) ([]types.NodeGroup, error) {
+	query := tx.Preload("Node").Preload("User")
+
+	if group != "" {
+		name, err := normalizeNodeGroupName(group)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("group_name = ?", name)
+	}
+
+	if user != "" {
+		u, err := GetUser(tx, user)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("user_id = ?", u.ID)
+	}
+
+	nodeGroups := []types.NodeGroup{}
+	if err := query.Order("group_name, node_id").Find(&nodeGroups).Error; err != nil {
+		return nil, err
+	}
+
+	return nodeGroups, nil
+}
+
+func (hsdb *HSDatabase) RenameNodeGroup(oldName, newName string) ([]types.NodeGroup, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) ([]types.NodeGroup, error) {
+		return RenameNodeGroup(tx, oldName, newName)
+	})
+}
+
+// RenameNodeGroup renames a group, it cannot be renamed to a group which
+// already has nodes.
+func RenameNodeGroup(tx *gorm.DB, oldName, newName string) ([]types.NodeGroup, error) {
+	oldName, err := normalizeNodeGroupName(oldName)
+	if err != nil {
+		return nil, err
+	}
+
+	newName, err = normalizeNodeGroupName(newName)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int64
+	if err := tx.Model(&types.NodeGroup{}).
+		Where("group_name = ?", newName).
+		Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrNodeGroupExists
+	}
+
+	result := tx.Model(&types.NodeGroup{}).
+		Where("group_name = ?", oldName).
+		Update("group_name", newName)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to rename node group: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNodeGroupNotFound
+	}
+
+	return ListNodeGroups(tx, newName, "")
+}
+
+func (hsdb *HSDatabase) RemoveNodeFromGroup(group string, nodeID types.NodeID) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return RemoveNodeFromGroup(tx, group, nodeID)
+	})
+}
+
+// RemoveNodeFromGroup removes a node from a group of the ACL policy.
+func RemoveNodeFromGroup(tx *gorm.DB, group string, nodeID types.NodeID) error {
+	name, err := normalizeNodeGroupName(group)
+	if err != nil {
+		return err
+	}
+
+	result := tx.
+		Where("group_name = ? AND node_id = ?", name, nodeID).
+		Delete(&types.NodeGroup{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to remove node from group: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNodeGroupNotFound
+	}
+
+	return nil
+}
+
+// deleteNodeGroups removes a node from all its groups, before it is
+// deleted.
+func deleteNodeGroups(tx *gorm.DB, nodeID types.NodeID) error {
+	return tx.Where("node_id = ?", nodeID).Delete(&types.NodeGroup{}).Error
+}
+
+func (hsdb *HSDatabase) NodeGroupMembers() (map[string][]types.NodeID, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (map[string][]types.NodeID, error) {
+		return NodeGroupMembers(rx)
+	})
+}
+
+// NodeGroupMembers returns the nodes of every node group, keyed by the
+// name of the group in the ACL policy, "group:<name>".
+func NodeGroupMembers(tx *gorm.DB) (map[string][]types.NodeID, error) {
+	nodeGroups := []types.NodeGroup{}
+	if err := tx.Order("group_name, node_id").Find(&nodeGroups).Error; err != nil {
+		return nil, err
+	}
+
+	members := make(map[string][]types.NodeID)
+	for _, nodeGroup := range nodeGroups {
+		name := nodeGroupPrefix + nodeGroup.GroupName
+		members[name] = append(members[name], types.NodeID(nodeGroup.NodeID))
+	}
+
+	return members, nil
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+	"tailscale.com/types/key"
+)
+
+func (s *Suite) TestNodeGroups(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	other, err := db.CreateUser("other")
+	c.Assert(err, check.IsNil)
+
+	nodes := make([]*types.Node, 0, 2)
+	for index, userID := range []uint{user.ID, other.ID} {
+		node := &types.Node{
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			Hostname:       "testnode" + string(rune('a'+index)),
+			UserID:         userID,
+			RegisterMethod: util.RegisterMethodCLI,
+		}
+		c.Assert(db.DB.Save(node).Error, check.IsNil)
+		nodes = append(nodes, node)
+	}
+
+	_, err = db.AddNodeToGroup("group:eng", nodes[0].ID)
+	c.Assert(err, check.IsNil)
+	_, err = db.AddNodeToGroup("eng", nodes[1].ID)
+	c.Assert(err, check.IsNil)
+
+	_, err = db.AddNodeToGroup("eng", nodes[1].ID)
+	c.Assert(errors.Is(err, ErrNodeGroupMemberExists), check.Equals, true)
+
+	_, err = db.AddNodeToGroup("group:", nodes[1].ID)
+	c.Assert(errors.Is(err, ErrInvalidNodeGroupName), check.Equals, true)
+
+	members, err := db.NodeGroupMembers()
+	c.Assert(err, check.IsNil)
+	c.Assert(members, check.DeepEquals, map[string][]types.NodeID{
+		"group:eng": {nodes[0].ID, nodes[1].ID},
+	})
+
+	nodeGroups, err := db.ListNodeGroups("", "other")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(nodeGroups), check.Equals, 1)
+	c.Assert(nodeGroups[0].Node.Hostname, check.Equals, "testnodeb")
+
+	_, err = db.RenameNodeGroup("eng", "group:ops")
+	c.Assert(err, check.IsNil)
+
+	_, err = db.RenameNodeGroup("eng", "ops")
+	c.Assert(errors.Is(err, ErrNodeGroupExists), check.Equals, true)
+
+	err = db.RemoveNodeFromGroup("ops", nodes[0].ID)
+	c.Assert(err, check.IsNil)
+
+	err = db.RemoveNodeFromGroup("ops", nodes[0].ID)
+	c.Assert(errors.Is(err, ErrNodeGroupNotFound), check.Equals, true)
+
+	// Deleting a node removes it from its groups.
+	_, err = db.DeleteNode(nodes[1], types.NodeConnectedMap{})
+	c.Assert(err, check.IsNil)
+
+	members, err = db.NodeGroupMembers()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(members), check.Equals, 0)
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"net/netip"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -165,6 +167,52 @@ func (s *Suite) TestListPeers(c *check.C) {
 	c.Assert(peersOfNode0[8].Hostname, check.Equals, "testnode10")
 }
 
+func (s *Suite) TestListNodesByLastSeenBefore(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	now := time.Now()
+	recent := now.Add(-time.Hour)
+	old := now.Add(-100 * time.Hour)
+	older := now.Add(-200 * time.Hour)
+	lastSeens := map[string]*time.Time{
+		"recent": &recent,
+		"old":    &old,
+		"older":  &older,
+		"never":  nil,
+	}
+
+	for hostname, lastSeen := range lastSeens {
+		node := types.Node{
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			Hostname:       hostname,
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+			LastSeen:       lastSeen,
+		}
+		c.Assert(db.DB.Save(&node).Error, check.IsNil)
+	}
+
+	nodes, err := db.ListNodesByLastSeenBefore(now.Add(-72 * time.Hour))
+	c.Assert(err, check.IsNil)
+
+	hostnames := []string{}
+	for _, node := range nodes {
+		hostnames = append(hostnames, node.Hostname)
+	}
+	slices.Sort(hostnames)
+	c.Assert(hostnames, check.DeepEquals, []string{"old", "older"})
+
+	nodes, err = db.ListNodesByLastSeenBefore(now.Add(-300 * time.Hour))
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 0)
+
+	nodes, err = db.ListNodesByLastSeenBefore(now)
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 3)
+}
+
 func (s *Suite) TestGetACLFilteredPeers(c *check.C) {
 	type base struct {
 		user *types.User
@@ -395,6 +443,87 @@ func (s *Suite) TestSetTags(c *check.C) {
 	c.Assert(node.ForcedTags, check.DeepEquals, types.StringList([]string{}))
 }
 
+func (s *Suite) TestNodeSetIP(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	ipv4 := netip.MustParseAddr("100.64.0.1")
+	ipv6 := netip.MustParseAddr("fd7a:115c:a1e0::1")
+
+	node := &types.Node{
+		MachineKey:     key.NewMachine().Public(),
+		NodeKey:        key.NewNode().Public(),
+		Hostname:       "testnode",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodCLI,
+		IPv4:           &ipv4,
+		IPv6:           &ipv6,
+	}
+	c.Assert(db.DB.Save(node).Error, check.IsNil)
+
+	newIPv4 := netip.MustParseAddr("100.64.0.10")
+	err = db.NodeSetIP(node.ID, newIPv4)
+	c.Assert(err, check.IsNil)
+
+	node, err = db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(*node.IPv4, check.Equals, newIPv4)
+	c.Assert(*node.IPv6, check.Equals, ipv6)
+
+	newIPv6 := netip.MustParseAddr("fd7a:115c:a1e0::10")
+	err = db.NodeSetIP(node.ID, newIPv6)
+	c.Assert(err, check.IsNil)
+
+	node, err = db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(*node.IPv4, check.Equals, newIPv4)
+	c.Assert(*node.IPv6, check.Equals, newIPv6)
+}
+
+func (s *Suite) TestSetNodeMetadata(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	node := &types.Node{
+		MachineKey:     key.NewMachine().Public(),
+		NodeKey:        key.NewNode().Public(),
+		Hostname:       "testnode",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodCLI,
+	}
+	c.Assert(db.DB.Save(node).Error, check.IsNil)
+
+	node, err = db.SetNodeMetadata(node.ID, map[string]string{"site": "par", "rack": "r12"})
+	c.Assert(err, check.IsNil)
+	c.Assert(node.Metadata, check.DeepEquals, types.NodeMetadata{"site": "par", "rack": "r12"})
+
+	// The keys not changed are kept, the empty values are removed.
+	node, err = db.SetNodeMetadata(node.ID, map[string]string{"rack": "", "cost": "eng"})
+	c.Assert(err, check.IsNil)
+	c.Assert(node.Metadata, check.DeepEquals, types.NodeMetadata{"site": "par", "cost": "eng"})
+
+	nodes, err := db.ListNodes()
+	c.Assert(err, check.IsNil)
+	c.Assert(FilterNodesByMetadata(nodes, "site", "par"), check.HasLen, 1)
+	c.Assert(FilterNodesByMetadata(nodes, "site", "ams"), check.HasLen, 0)
+	c.Assert(FilterNodesByMetadata(nodes, "cost", ""), check.HasLen, 1)
+
+	_, err = db.SetNodeMetadata(node.ID, map[string]string{"": "value"})
+	c.Assert(err, check.Equals, ErrNodeMetadataEmptyKey)
+
+	_, err = db.SetNodeMetadata(node.ID, map[string]string{"note": strings.Repeat("x", types.MaxNodeMetadataSize)})
+	c.Assert(err, check.Equals, ErrNodeMetadataTooLarge)
+
+	node, err = db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(node.Metadata, check.DeepEquals, types.NodeMetadata{"site": "par", "cost": "eng"})
+
+	// Removing all the keys leaves no metadata.
+	node, err = db.SetNodeMetadata(node.ID, map[string]string{"site": "", "cost": ""})
+	c.Assert(err, check.IsNil)
+	c.Assert(node.Metadata, check.HasLen, 0)
+}
+
 func TestHeadscale_generateGivenName(t *testing.T) {
 	type args struct {
 		suppliedName string
@@ -451,6 +580,24 @@ func TestHeadscale_generateGivenName(t *testing.T) {
 			want:    nil,
 			wantErr: true,
 		},
+		{
+			name: "node name with underscores and mixed case",
+			args: args{
+				suppliedName: "Build_Server_01",
+				randomSuffix: false,
+			},
+			want:    regexp.MustCompile("^build-server-01$"),
+			wantErr: false,
+		},
+		{
+			name: "node name with dots without hostname policy",
+			args: args{
+				suppliedName: "Build.Server__01",
+				randomSuffix: false,
+			},
+			want:    regexp.MustCompile("^build.server-01$"),
+			wantErr: false,
+		},
 		{
 			name: "node name with random suffix",
 			args: args{
@@ -578,4 +725,81 @@ func (s *Suite) TestAutoApproveRoutes(c *check.C) {
 	enabledRoutes, err := db.GetEnabledRoutes(node0ByID)
 	c.Assert(err, check.IsNil)
 	c.Assert(enabledRoutes, check.HasLen, 4)
+
+	// The routes disabled by hand are not approved again.
+	routes, err := db.GetNodeRoutes(node0ByID)
+	c.Assert(err, check.IsNil)
+	for _, route := range routes {
+		if netip.Prefix(route.Prefix) == route1 {
+			_, err = DisableRoute(db.DB, uint64(route.ID), types.NodeConnectedMap{})
+			c.Assert(err, check.IsNil)
+		}
+	}
+
+	err = db.EnableAutoApprovedRoutes(pol, node0ByID)
+	c.Assert(err, check.IsNil)
+
+	enabledRoutes, err = db.GetEnabledRoutes(node0ByID)
+	c.Assert(err, check.IsNil)
+	c.Assert(enabledRoutes, check.HasLen, 3)
+	c.Assert(slices.Contains(enabledRoutes, route1), check.Equals, false)
+
+	// Until they are enabled by hand.
+	for _, route := range routes {
+		if netip.Prefix(route.Prefix) == route1 {
+			_, err = EnableRoute(db.DB, uint64(route.ID))
+			c.Assert(err, check.IsNil)
+
+			got, err := GetRoute(db.DB, uint64(route.ID))
+			c.Assert(err, check.IsNil)
+			c.Assert(got.Disabled, check.Equals, false)
+		}
+	}
+}
+
+func (s *Suite) TestDeleteStaleNodes(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	longAgo := time.Now().Add(-100 * 24 * time.Hour)
+	recently := time.Now().Add(-time.Hour)
+	for _, node := range []types.Node{
+		{Hostname: "stale", LastSeen: &longAgo},
+		{Hostname: "connected", LastSeen: &longAgo},
+		{Hostname: "recent", LastSeen: &recently},
+		{Hostname: "never-seen"},
+	} {
+		node.MachineKey = key.NewMachine().Public()
+		node.NodeKey = key.NewNode().Public()
+		node.UserID = user.ID
+		node.RegisterMethod = util.RegisterMethodAuthKey
+		c.Assert(db.DB.Save(&node).Error, check.IsNil)
+	}
+
+	connected, err := db.getNode("test", "connected")
+	c.Assert(err, check.IsNil)
+	isConnected := types.NodeConnectedMap{connected.ID: true}
+
+	expiry := 90 * 24 * time.Hour
+
+	stale, _, err := db.DeleteStaleNodes(expiry, isConnected, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(stale, check.HasLen, 1)
+	c.Assert(stale[0].Hostname, check.Equals, "stale")
+	c.Assert(stale[0].User.Name, check.Equals, "test")
+
+	// A dry run does not delete anything
+	_, err = db.getNode("test", "stale")
+	c.Assert(err, check.IsNil)
+
+	stale, _, err = db.DeleteStaleNodes(expiry, isConnected, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(stale, check.HasLen, 1)
+
+	_, err = db.getNode("test", "stale")
+	c.Assert(err, check.NotNil)
+
+	nodes, err := db.ListNodes()
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 3)
 }
@@ -0,0 +1,226 @@
+package db
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+)
+
+// peerCacheTables are the tables loaded with the nodes, a change to
+// any of them invalidates the PeerMapCache once it is committed.
+var peerCacheTables = map[string]bool{
+	"nodes":                 true,
+	"routes":                true,
+	"users":                 true,
+	"pre_auth_keys":         true,
+	"pre_auth_key_acl_tags": true,
+	"per_node_routes":       true,
+}
+
+// PeerMapCache keeps the nodes listed for the peers of a node for a
+// short time, so the nodes connecting at once share a single query
+// instead of listing all the nodes each.
+//
+// The peers of a node are all the other nodes, whatever their user, the
+// policy is applied afterwards. The cache holds the list of all the
+// nodes and is invalidated when any of them changes, or patched for the
+// frequent changes the nodes report themselves.
+type PeerMapCache struct {
+	ttl time.Duration
+
+	// loading is held while listing the nodes, so the nodes connecting
+	// during the query wait for its result instead of running their
+	// own. It is separate from mu so writes invalidating the cache do
+	// not wait for the query, which may wait for their transaction.
+	loading sync.Mutex
+
+	mu         sync.Mutex
+	nodes      types.Nodes
+	loadedAt   time.Time
+	generation uint64
+}
+
+// NewPeerMapCache returns a cache reusing the nodes listed for ttl.
+func NewPeerMapCache(ttl time.Duration) *PeerMapCache {
+	return &PeerMapCache{
+		ttl: ttl,
+	}
+}
+
+// Peers returns the peers of the node nodeID, from the nodes listed by
+// load if the cached ones are older than the TTL or invalidated. Every
+// call returns its own shallow copies of the nodes: the callers can set
+// their fields, but not modify what they point to, like their Hostinfo
+// or their routes, which are shared with the cache.
+func (c *PeerMapCache) Peers(
+	nodeID types.NodeID,
+	load func() (types.Nodes, error),
+	now time.Time,
+) (types.Nodes, error) {
+	if nodes, ok := c.cached(now); ok {
+		return peersOf(nodes, nodeID), nil
+	}
+
+	c.loading.Lock()
+	defer c.loading.Unlock()
+
+	// The nodes may have been listed while waiting.
+	if nodes, ok := c.cached(now); ok {
+		return peersOf(nodes, nodeID), nil
+	}
+
+	c.mu.Lock()
+	generation := c.generation
+	c.mu.Unlock()
+
+	nodes, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	// The nodes are not kept if they changed during the load.
+	c.mu.Lock()
+	if generation == c.generation {
+		c.nodes = nodes
+		c.loadedAt = now
+	}
+	c.mu.Unlock()
+
+	return peersOf(nodes, nodeID), nil
+}
+
+func (c *PeerMapCache) cached(now time.Time) (types.Nodes, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.nodes == nil || now.Sub(c.loadedAt) >= c.ttl {
+		return nil, false
+	}
+
+	return c.nodes, true
+}
+
+// Invalidate drops the cached nodes, the next call to Peers lists them
+// again.
+func (c *PeerMapCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nodes = nil
+	c.generation++
+}
+
+// Patch applies update to the cached node nodeID instead of invalidating
+// the nodes. The node is updated in a copy, the nodes already returned
+// by Peers are not changed.
+func (c *PeerMapCache) Patch(nodeID types.NodeID, update func(node *types.Node)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The nodes being listed may not have the change.
+	c.generation++
+
+	index := slices.IndexFunc(c.nodes, func(node *types.Node) bool {
+		return node.ID == nodeID
+	})
+	if index < 0 {
+		return
+	}
+
+	nodes := slices.Clone(c.nodes)
+	node := *nodes[index]
+	update(&node)
+	nodes[index] = &node
+	c.nodes = nodes
+}
+
+// peersOf returns shallow copies of the nodes other than nodeID.
+func peersOf(nodes types.Nodes, nodeID types.NodeID) types.Nodes {
+	peers := make(types.Nodes, 0, len(nodes))
+	for _, node := range nodes {
+		if node.ID == nodeID {
+			continue
+		}
+
+		peer := *node
+		peers = append(peers, &peer)
+	}
+
+	return peers
+}
+
+type peerCacheWritesKey struct{}
+
+// peerCacheWrites records the cache a transaction of Write has to
+// invalidate once it is committed, if it wrote to the tables loaded
+// with the nodes. Invalidating it before, a node listing its peers
+// meanwhile would cache the nodes without the changes.
+type peerCacheWrites struct {
+	cache atomic.Pointer[PeerMapCache]
+}
+
+// withPeerCacheWrites returns db recording the writes of its statements
+// to the tables loaded with the nodes, instead of invalidating the cache.
+func withPeerCacheWrites(db *gorm.DB) (*gorm.DB, *peerCacheWrites) {
+	writes := &peerCacheWrites{}
+	ctx := context.WithValue(db.Statement.Context, peerCacheWritesKey{}, writes)
+
+	return db.WithContext(ctx), writes
+}
+
+// invalidate invalidates the cache written to, if any.
+func (w *peerCacheWrites) invalidate() {
+	if cache := w.cache.Load(); cache != nil {
+		cache.Invalidate()
+	}
+}
+
+// patchPeerCache applies update to the cached node nodeID, if the peers
+// are cached.
+func (hsdb *HSDatabase) patchPeerCache(nodeID types.NodeID, update func(node *types.Node)) {
+	if hsdb.peerCache != nil {
+		hsdb.peerCache.Patch(nodeID, update)
+	}
+}
+
+// registerPeerCacheCallbacks invalidates cache after every write to the
+// tables loaded with the nodes. The writes in a transaction of Write are
+// recorded and invalidate it after the commit, the other ones after the
+// transaction GORM runs them in. Raw statements do not tell their table
+// and always invalidate it.
+func registerPeerCacheCallbacks(db *gorm.DB, cache *PeerMapCache) error {
+	invalidate := func(tx *gorm.DB) {
+		if tx.Statement.Table != "" && !peerCacheTables[tx.Statement.Table] {
+			return
+		}
+
+		if writes, ok := tx.Statement.Context.Value(peerCacheWritesKey{}).(*peerCacheWrites); ok {
+			writes.cache.Store(cache)
+
+			return
+		}
+
+		cache.Invalidate()
+	}
+
+	const committed = "gorm:commit_or_rollback_transaction"
+
+	callbacks := db.Callback()
+	for _, err := range []error{
+		callbacks.Create().After(committed).Register("peer_cache:after_create", invalidate),
+		callbacks.Update().After(committed).Register("peer_cache:after_update", invalidate),
+		callbacks.Delete().After(committed).Register("peer_cache:after_delete", invalidate),
+		callbacks.Raw().After("gorm:raw").Register("peer_cache:after_raw", invalidate),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,315 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gorm.io/gorm"
+	"tailscale.com/types/key"
+)
+
+func TestPeerMapCache(t *testing.T) {
+	now := time.Now()
+	cache := NewPeerMapCache(10 * time.Second)
+
+	loads := 0
+	load := func() (types.Nodes, error) {
+		loads++
+
+		return types.Nodes{{ID: 1}, {ID: 2}, {ID: 3}}, nil
+	}
+
+	peers, err := cache.Peers(1, load, now)
+	if err != nil {
+		t.Fatalf("Peers() error = %s", err)
+	}
+	if len(peers) != 2 || peers[0].ID != 2 || peers[1].ID != 3 {
+		t.Errorf("Peers() = %v, want nodes 2 and 3", peers)
+	}
+
+	// The callers get their own copies of the nodes.
+	peers[0].GivenName = "changed"
+
+	peers, err = cache.Peers(3, load, now.Add(5*time.Second))
+	if err != nil {
+		t.Fatalf("Peers() error = %s", err)
+	}
+	if len(peers) != 2 || peers[0].ID != 1 || peers[1].GivenName != "" {
+		t.Errorf("Peers() = %v, want unchanged nodes 1 and 2", peers)
+	}
+	if loads != 1 {
+		t.Errorf("Peers() loaded the nodes %d times within the TTL, want 1", loads)
+	}
+
+	if _, err := cache.Peers(1, load, now.Add(10*time.Second)); err != nil {
+		t.Fatalf("Peers() error = %s", err)
+	}
+	if loads != 2 {
+		t.Errorf("Peers() loaded the nodes %d times after the TTL, want 2", loads)
+	}
+
+	cache.Invalidate()
+	if _, err := cache.Peers(1, load, now.Add(11*time.Second)); err != nil {
+		t.Fatalf("Peers() error = %s", err)
+	}
+	if loads != 3 {
+		t.Errorf("Peers() loaded the nodes %d times after Invalidate(), want 3", loads)
+	}
+}
+
+func TestListPeersCacheInvalidation(t *testing.T) {
+	hsdb, _ := peerCacheDB(t, 10*time.Second, 3)
+
+	peers, err := hsdb.ListPeers(1)
+	if err != nil {
+		t.Fatalf("ListPeers() error = %s", err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("ListPeers() returned %d peers, want 2", len(peers))
+	}
+
+	if err := hsdb.DB.Model(&types.Node{}).Where("id = ?", 2).
+		Update("given_name", "renamed").Error; err != nil {
+		t.Fatalf("renaming node: %s", err)
+	}
+
+	peers, err = hsdb.ListPeers(1)
+	if err != nil {
+		t.Fatalf("ListPeers() error = %s", err)
+	}
+	if peers[0].GivenName != "renamed" {
+		t.Errorf("ListPeers() returned the node as %q after it changed, want renamed", peers[0].GivenName)
+	}
+}
+
+func TestListPeersCacheWrite(t *testing.T) {
+	hsdb, queries := peerCacheDB(t, 10*time.Second, 3)
+
+	if _, err := hsdb.ListPeers(1); err != nil {
+		t.Fatalf("ListPeers() error = %s", err)
+	}
+
+	listed := func() types.Nodes {
+		t.Helper()
+
+		queries.Store(0)
+		peers, err := hsdb.ListPeers(1)
+		if err != nil {
+			t.Fatalf("ListPeers() error = %s", err)
+		}
+
+		return peers
+	}
+
+	// A transaction rolled back does not invalidate the cache.
+	errRollback := errors.New("rollback")
+	err := hsdb.Write(func(tx *gorm.DB) error {
+		if err := tx.Model(&types.Node{}).Where("id = ?", 2).
+			Update("given_name", "renamed").Error; err != nil {
+			return err
+		}
+
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("Write() error = %v, want %v", err, errRollback)
+	}
+	if peers := listed(); queries.Load() != 0 || peers[0].GivenName == "renamed" {
+		t.Errorf("ListPeers() listed the nodes after a rollback")
+	}
+
+	// A transaction committed invalidates it.
+	err = hsdb.Write(func(tx *gorm.DB) error {
+		return tx.Model(&types.Node{}).Where("id = ?", 2).
+			Update("given_name", "renamed").Error
+	})
+	if err != nil {
+		t.Fatalf("Write() error = %s", err)
+	}
+	if peers := listed(); queries.Load() == 0 || peers[0].GivenName != "renamed" {
+		t.Errorf("ListPeers() returned the node as %q after a commit, want renamed", peers[0].GivenName)
+	}
+
+	// The changes reported by the nodes patch it.
+	node, err := hsdb.GetNodeByID(2)
+	if err != nil {
+		t.Fatalf("GetNodeByID() error = %s", err)
+	}
+	node.Endpoints = []netip.AddrPort{netip.MustParseAddrPort("192.0.2.2:41641")}
+	if err := hsdb.SaveReportedNode(node); err != nil {
+		t.Fatalf("SaveReportedNode() error = %s", err)
+	}
+	lastSeen := time.Date(2026, time.October, 16, 12, 0, 0, 0, time.UTC)
+	if err := hsdb.SetLastSeen(3, lastSeen); err != nil {
+		t.Fatalf("SetLastSeen() error = %s", err)
+	}
+
+	peers := listed()
+	if queries.Load() != 0 {
+		t.Errorf("ListPeers() listed the nodes after endpoint and last seen updates")
+	}
+	if len(peers[0].Endpoints) != 1 || peers[0].Endpoints[0] != node.Endpoints[0] {
+		t.Errorf("ListPeers() returned the endpoints %v, want %v", peers[0].Endpoints, node.Endpoints)
+	}
+	if peers[1].LastSeen == nil || !peers[1].LastSeen.Equal(lastSeen) {
+		t.Errorf("ListPeers() returned the last seen time %v, want %s", peers[1].LastSeen, lastSeen)
+	}
+}
+
+// BenchmarkListPeersReconnect measures the database queries of all the
+// nodes of a network listing their peers at once.
+func BenchmarkListPeersReconnect(b *testing.B) {
+	const nodeCount = 1000
+
+	for _, ttl := range []time.Duration{0, 10 * time.Second} {
+		b.Run(fmt.Sprintf("ttl=%s", ttl), func(b *testing.B) {
+			hsdb, queries := peerCacheDB(b, ttl, nodeCount)
+
+			queries.Store(0)
+			b.ResetTimer()
+
+			for range b.N {
+				if hsdb.peerCache != nil {
+					hsdb.peerCache.Invalidate()
+				}
+
+				var wg sync.WaitGroup
+				for id := 1; id <= nodeCount; id++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+
+						if _, err := hsdb.ListPeers(types.NodeID(id)); err != nil {
+							b.Errorf("ListPeers() error = %s", err)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+
+			b.ReportMetric(float64(queries.Load())/float64(b.N), "queries/op")
+		})
+	}
+}
+
+// BenchmarkListPeersMixedLoad measures the database queries of nodes
+// listing their peers while other nodes update their endpoints, and the
+// nodes are changed with the API from time to time.
+func BenchmarkListPeersMixedLoad(b *testing.B) {
+	const (
+		nodeCount   = 200
+		readers     = 50
+		renameEvery = 10
+	)
+
+	for _, ttl := range []time.Duration{0, 10 * time.Second} {
+		b.Run(fmt.Sprintf("ttl=%s", ttl), func(b *testing.B) {
+			hsdb, queries := peerCacheDB(b, ttl, nodeCount)
+
+			nodes, err := hsdb.ListNodes()
+			if err != nil {
+				b.Fatalf("ListNodes() error = %s", err)
+			}
+
+			queries.Store(0)
+			b.ResetTimer()
+
+			for op := range b.N {
+				var wg sync.WaitGroup
+				for reader := range readers {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+
+						id := types.NodeID((op*readers+reader)%nodeCount + 1)
+						if _, err := hsdb.ListPeers(id); err != nil {
+							b.Errorf("ListPeers() error = %s", err)
+						}
+					}()
+				}
+
+				node := nodes[op%nodeCount]
+				node.Endpoints = []netip.AddrPort{netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), uint16(op))}
+				if err := hsdb.SaveReportedNode(node); err != nil {
+					b.Errorf("SaveReportedNode() error = %s", err)
+				}
+
+				if op%renameEvery == 0 {
+					err := hsdb.Write(func(tx *gorm.DB) error {
+						return tx.Model(&types.Node{}).Where("id = ?", node.ID).
+							Update("given_name", fmt.Sprintf("renamed-%d", op)).Error
+					})
+					if err != nil {
+						b.Errorf("Write() error = %s", err)
+					}
+				}
+
+				wg.Wait()
+			}
+
+			b.ReportMetric(float64(queries.Load())/float64(b.N), "queries/op")
+		})
+	}
+}
+
+// peerCacheDB returns a database caching the peers for ttl with
+// nodeCount nodes, and the count of the queries run on it.
+func peerCacheDB(tb testing.TB, ttl time.Duration, nodeCount int) (*HSDatabase, *atomic.Int64) {
+	tb.Helper()
+
+	tmpDir, err := os.MkdirTemp("", "headscale-peer-cache-*")
+	if err != nil {
+		tb.Fatalf("creating tempdir: %s", err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	hsdb, err := NewHeadscaleDatabase(
+		types.DatabaseConfig{
+			Type: "sqlite3",
+			Sqlite: types.SqliteConfig{
+				Path: filepath.Join(tmpDir, "headscale_test.db"),
+			},
+			PeerCacheTTL: ttl,
+		},
+		"",
+	)
+	if err != nil {
+		tb.Fatalf("setting up database: %s", err)
+	}
+
+	user, err := hsdb.CreateUser("bench")
+	if err != nil {
+		tb.Fatalf("creating user: %s", err)
+	}
+
+	nodes := make([]types.Node, nodeCount)
+	for index := range nodes {
+		nodes[index] = types.Node{
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			Hostname:       fmt.Sprintf("node-%d", index+1),
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+		}
+	}
+	if err := hsdb.DB.CreateInBatches(nodes, 100).Error; err != nil {
+		tb.Fatalf("creating nodes: %s", err)
+	}
+
+	var queries atomic.Int64
+	if err := hsdb.DB.Callback().Query().After("gorm:query").
+		Register("test:count_queries", func(*gorm.DB) { queries.Add(1) }); err != nil {
+		tb.Fatalf("counting queries: %s", err)
+	}
+
+	return hsdb, &queries
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+)
+
+func (hsdb *HSDatabase) SavePendingRegistration(
+	machineKey string,
+	node types.Node,
+	expiry time.Time,
+) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SavePendingRegistration(tx, machineKey, node, expiry)
+	})
+}
+
+// SavePendingRegistration stores a node waiting in the registration
+// cache, replacing any previous registration of the machine key.
+func SavePendingRegistration(
+	tx *gorm.DB,
+	machineKey string,
+	node types.Node,
+	expiry time.Time,
+) error {
+	reg := types.PendingRegistration{
+		MachineKey: machineKey,
+		Node:       node,
+		Expiry:     expiry,
+	}
+
+	if err := tx.Save(&reg).Error; err != nil {
+		return fmt.Errorf("failed to save pending registration: %w", err)
+	}
+
+	return nil
+}
+
+// DeletePendingRegistration removes the pending registration of the
+// machine key, if there is one.
+func DeletePendingRegistration(tx *gorm.DB, machineKey string) error {
+	return tx.Where("machine_key = ?", machineKey).Delete(&types.PendingRegistration{}).Error
+}
+
+func (hsdb *HSDatabase) ListPendingRegistrations(now time.Time) ([]types.PendingRegistration, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) ([]types.PendingRegistration, error) {
+		return ListPendingRegistrations(tx, now)
+	})
+}
+
+// ListPendingRegistrations deletes the pending registrations that have
+// expired at now and returns the remaining ones.
+func ListPendingRegistrations(tx *gorm.DB, now time.Time) ([]types.PendingRegistration, error) {
+	if err := tx.Where("expiry <= ?", now).Delete(&types.PendingRegistration{}).Error; err != nil {
+		return nil, fmt.Errorf("failed to delete expired pending registrations: %w", err)
+	}
+
+	regs := []types.PendingRegistration{}
+	if err := tx.Find(&regs).Error; err != nil {
+		return nil, err
+	}
+
+	return regs, nil
+}
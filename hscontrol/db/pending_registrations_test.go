@@ -0,0 +1,68 @@
+package db
+
+import (
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/patrickmn/go-cache"
+	"gopkg.in/check.v1"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func (s *Suite) TestPendingRegistrations(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	now := time.Now()
+	machineKey := key.NewMachine().Public()
+	expiredKey := key.NewMachine().Public()
+
+	node := types.Node{
+		MachineKey: machineKey,
+		NodeKey:    key.NewNode().Public(),
+		Hostname:   "pending",
+		GivenName:  "pending",
+		Hostinfo:   &tailcfg.Hostinfo{Hostname: "pending"},
+		LastSeen:   &now,
+		Expiry:     &time.Time{},
+	}
+
+	err = db.SavePendingRegistration(machineKey.String(), node, now.Add(time.Hour))
+	c.Assert(err, check.IsNil)
+
+	err = db.SavePendingRegistration(expiredKey.String(), types.Node{MachineKey: expiredKey}, now.Add(-time.Minute))
+	c.Assert(err, check.IsNil)
+
+	regs, err := db.ListPendingRegistrations(now)
+	c.Assert(err, check.IsNil)
+	c.Assert(regs, check.HasLen, 1)
+	c.Assert(regs[0].MachineKey, check.Equals, machineKey.String())
+	c.Assert(regs[0].Node.MachineKey, check.Equals, node.MachineKey)
+	c.Assert(regs[0].Node.NodeKey, check.Equals, node.NodeKey)
+	c.Assert(regs[0].Node.Hostname, check.Equals, "pending")
+	c.Assert(regs[0].Node.Hostinfo.Hostname, check.Equals, "pending")
+
+	// Completing the registration removes it.
+	registrationCache := cache.New(time.Hour, time.Hour)
+	registrationCache.Set(machineKey.String(), regs[0].Node, time.Hour)
+
+	_, err = Write(db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		return RegisterNodeFromAuthCallback(
+			tx,
+			registrationCache,
+			machineKey,
+			user.Name,
+			nil,
+			util.RegisterMethodCLI,
+			nil, nil,
+		)
+	})
+	c.Assert(err, check.IsNil)
+
+	regs, err = db.ListPendingRegistrations(now)
+	c.Assert(err, check.IsNil)
+	c.Assert(regs, check.HasLen, 0)
+}
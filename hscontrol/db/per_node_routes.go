@@ -0,0 +1,133 @@
+package db
+
+import (
+	"net/netip"
+	"slices"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+)
+
+var ErrAllowedRoutesDenyAll = types.NewHeadscaleError(
+	types.CodeInvalidArgument,
+	"allowed routes cannot be set when denying all the routes",
+)
+
+func (hsdb *HSDatabase) SetNodeAllowedRoutes(
+	nodeID types.NodeID,
+	prefixes []netip.Prefix,
+	denyAll bool,
+) ([]netip.Prefix, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) ([]netip.Prefix, error) {
+		return SetNodeAllowedRoutes(tx, nodeID, prefixes, denyAll)
+	})
+}
+
+// SetNodeAllowedRoutes replaces the routes the node nodeID is allowed to
+// use, the node only sees the routes of its peers within prefixes. With
+// denyAll, the node sees no routes. Without prefixes, the node sees all
+// the enabled routes again. It returns the allowed routes, sorted and
+// without duplicates.
+func SetNodeAllowedRoutes(
+	tx *gorm.DB,
+	nodeID types.NodeID,
+	prefixes []netip.Prefix,
+	denyAll bool,
+) ([]netip.Prefix, error) {
+	if denyAll && len(prefixes) > 0 {
+		return nil, ErrAllowedRoutesDenyAll
+	}
+
+	if _, err := GetNodeByID(tx, nodeID); err != nil {
+		return nil, err
+	}
+
+	if err := deleteNodeAllowedRoutes(tx, nodeID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Model(&types.Node{}).
+		Where("id = ?", nodeID).
+		Update("deny_all_routes", denyAll).Error; err != nil {
+		return nil, err
+	}
+
+	allowed := make([]netip.Prefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		allowed = append(allowed, prefix.Masked())
+	}
+	slices.SortFunc(allowed, netip.Prefix.Compare)
+	allowed = slices.Compact(allowed)
+
+	if len(allowed) == 0 {
+		return allowed, nil
+	}
+
+	routes := make([]types.PerNodeRoute, 0, len(allowed))
+	for _, prefix := range allowed {
+		routes = append(routes, types.PerNodeRoute{
+			NodeID: nodeID,
+			Prefix: types.IPPrefix(prefix),
+		})
+	}
+
+	if err := tx.Create(&routes).Error; err != nil {
+		return nil, err
+	}
+
+	return allowed, nil
+}
+
+func (hsdb *HSDatabase) GetNodeAllowedRoutes(nodeID types.NodeID) ([]netip.Prefix, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) ([]netip.Prefix, error) {
+		return GetNodeAllowedRoutes(rx, nodeID)
+	})
+}
+
+// GetNodeAllowedRoutes returns the routes the node nodeID is allowed to
+// use, none if it is not limited.
+func GetNodeAllowedRoutes(tx *gorm.DB, nodeID types.NodeID) ([]netip.Prefix, error) {
+	var routes []types.PerNodeRoute
+	if err := tx.Where("node_id = ?", nodeID).Find(&routes).Error; err != nil {
+		return nil, err
+	}
+
+	prefixes := make([]netip.Prefix, len(routes))
+	for index, route := range routes {
+		prefixes[index] = netip.Prefix(route.Prefix)
+	}
+	slices.SortFunc(prefixes, netip.Prefix.Compare)
+
+	return prefixes, nil
+}
+
+func (hsdb *HSDatabase) GetRoutesForNode(nodeID, viewerID types.NodeID) (types.Routes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Routes, error) {
+		return GetRoutesForNode(rx, nodeID, viewerID)
+	})
+}
+
+// GetRoutesForNode returns the enabled routes of the node nodeID seen by
+// the node viewerID. The routes viewerID is allowed to use take
+// precedence, without any it sees all the enabled routes.
+func GetRoutesForNode(tx *gorm.DB, nodeID, viewerID types.NodeID) (types.Routes, error) {
+	var routes types.Routes
+	if err := tx.
+		Preload("Node").
+		Preload("Node.User").
+		Where("node_id = ? AND enabled = ?", nodeID, true).
+		Find(&routes).Error; err != nil {
+		return nil, err
+	}
+
+	viewer, err := GetNodeByID(tx, viewerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return routes.AllowedBy(viewer), nil
+}
+
+func deleteNodeAllowedRoutes(tx *gorm.DB, nodeID types.NodeID) error {
+	return tx.Where("node_id = ?", nodeID).Delete(&types.PerNodeRoute{}).Error
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"net/netip"
+	"sort"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+)
+
+func (s *Suite) TestGetRoutesForNode(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	router := types.Node{
+		Hostname:       "router",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+		Hostinfo: &tailcfg.Hostinfo{
+			RoutableIPs: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/24"),
+				netip.MustParsePrefix("10.0.1.0/24"),
+				netip.MustParsePrefix("10.0.2.0/24"),
+			},
+		},
+	}
+	c.Assert(db.DB.Save(&router).Error, check.IsNil)
+
+	viewer := types.Node{
+		Hostname:       "viewer",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+	}
+	c.Assert(db.DB.Save(&viewer).Error, check.IsNil)
+
+	_, err = db.SaveNodeRoutes(&router)
+	c.Assert(err, check.IsNil)
+	_, err = db.enableRoutes(&router, "10.0.0.0/24", "10.0.1.0/24")
+	c.Assert(err, check.IsNil)
+
+	prefixes := func(routes types.Routes) []string {
+		res := []string{}
+		for _, prefix := range routes.Prefixes() {
+			res = append(res, prefix.String())
+		}
+		sort.Strings(res)
+
+		return res
+	}
+
+	// Without allowed routes, the viewer sees all the enabled routes.
+	routes, err := db.GetRoutesForNode(router.ID, viewer.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(prefixes(routes), check.DeepEquals, []string{"10.0.0.0/24", "10.0.1.0/24"})
+
+	// The allowed routes of the viewer take precedence, a route that is
+	// not enabled stays hidden.
+	allowed, err := db.SetNodeAllowedRoutes(viewer.ID, []netip.Prefix{
+		netip.MustParsePrefix("10.0.2.0/24"),
+		netip.MustParsePrefix("10.0.1.7/24"),
+		netip.MustParsePrefix("10.0.1.0/24"),
+	}, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(allowed, check.DeepEquals, []netip.Prefix{
+		netip.MustParsePrefix("10.0.1.0/24"),
+		netip.MustParsePrefix("10.0.2.0/24"),
+	})
+
+	routes, err = db.GetRoutesForNode(router.ID, viewer.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(prefixes(routes), check.DeepEquals, []string{"10.0.1.0/24"})
+
+	// They only apply to the viewer.
+	routes, err = db.GetRoutesForNode(router.ID, router.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(prefixes(routes), check.DeepEquals, []string{"10.0.0.0/24", "10.0.1.0/24"})
+
+	// The routes within an allowed prefix are allowed.
+	_, err = db.SetNodeAllowedRoutes(viewer.ID, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/23")}, false)
+	c.Assert(err, check.IsNil)
+
+	routes, err = db.GetRoutesForNode(router.ID, viewer.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(prefixes(routes), check.DeepEquals, []string{"10.0.0.0/24", "10.0.1.0/24"})
+
+	// Denying all the routes hides them all.
+	allowed, err = db.SetNodeAllowedRoutes(viewer.ID, nil, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(allowed, check.HasLen, 0)
+
+	routes, err = db.GetRoutesForNode(router.ID, viewer.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(routes, check.HasLen, 0)
+
+	_, err = db.SetNodeAllowedRoutes(viewer.ID, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}, true)
+	c.Assert(err, check.Equals, ErrAllowedRoutesDenyAll)
+
+	// Without prefixes, the viewer sees all the enabled routes again.
+	allowed, err = db.SetNodeAllowedRoutes(viewer.ID, nil, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(allowed, check.HasLen, 0)
+
+	routes, err = db.GetRoutesForNode(router.ID, viewer.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(prefixes(routes), check.DeepEquals, []string{"10.0.0.0/24", "10.0.1.0/24"})
+
+	_, err = db.SetNodeAllowedRoutes(9999, nil, false)
+	c.Assert(err, check.Equals, gorm.ErrRecordNotFound)
+}
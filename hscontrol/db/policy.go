@@ -0,0 +1,47 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+)
+
+var ErrPolicyNotFound = types.NewHeadscaleError(types.CodePolicyNotFound, "no ACL policy stored in the database")
+
+func (hsdb *HSDatabase) GetPolicy() (*types.Policy, error) {
+	return Read(hsdb.DB, GetPolicy)
+}
+
+// GetPolicy returns the latest version of the ACL policy.
+func GetPolicy(tx *gorm.DB) (*types.Policy, error) {
+	var pol types.Policy
+	if err := tx.Order("id DESC").First(&pol).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPolicyNotFound
+		}
+
+		return nil, err
+	}
+
+	return &pol, nil
+}
+
+func (hsdb *HSDatabase) SetPolicy(data string) (*types.Policy, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) (*types.Policy, error) {
+		return SetPolicy(tx, data)
+	})
+}
+
+// SetPolicy stores a new version of the ACL policy, it is not validated.
+func SetPolicy(tx *gorm.DB, data string) (*types.Policy, error) {
+	pol := types.Policy{
+		Data: data,
+	}
+	if err := tx.Create(&pol).Error; err != nil {
+		return nil, fmt.Errorf("failed to store ACL policy: %w", err)
+	}
+
+	return &pol, nil
+}
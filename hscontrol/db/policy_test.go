@@ -0,0 +1,24 @@
+package db
+
+import (
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestPolicy(c *check.C) {
+	_, err := db.GetPolicy()
+	c.Assert(err, check.Equals, ErrPolicyNotFound)
+
+	first, err := db.SetPolicy(`{"acls": []}`)
+	c.Assert(err, check.IsNil)
+	c.Assert(first.UpdatedAt.IsZero(), check.Equals, false)
+
+	second, err := db.SetPolicy(`{"groups": {}}`)
+	c.Assert(err, check.IsNil)
+	c.Assert(second.ID > first.ID, check.Equals, true)
+
+	// The latest version is in use.
+	pol, err := db.GetPolicy()
+	c.Assert(err, check.IsNil)
+	c.Assert(pol.ID, check.Equals, second.ID)
+	c.Assert(pol.Data, check.Equals, `{"groups": {}}`)
+}
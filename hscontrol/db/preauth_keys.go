@@ -5,19 +5,38 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/netip"
 	"strings"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// preAuthKeyPrefixLength is the length of the prefix stored
+	// for legacy keys, which are plain hex strings.
+	preAuthKeyPrefixLength = 8
+
+	// Keys have the format hskey-auth-<id>-<secret>, only a hash
+	// of the secret is stored.
+	preAuthKeyPrefix     = "hskey-auth-"
+	preAuthKeyIDSize     = 6
+	preAuthKeySecretSize = 32
 )
 
 var (
-	ErrPreAuthKeyNotFound          = errors.New("AuthKey not found")
-	ErrPreAuthKeyExpired           = errors.New("AuthKey expired")
-	ErrSingleUseAuthKeyHasBeenUsed = errors.New("AuthKey has already been used")
-	ErrUserMismatch                = errors.New("user mismatch")
-	ErrPreAuthKeyACLTagInvalid     = errors.New("AuthKey tag is invalid")
+	ErrPreAuthKeyNotFound          = types.NewHeadscaleError(types.CodeKeyNotFound, "AuthKey not found")
+	ErrPreAuthKeyExpired           = types.NewHeadscaleError(types.CodeKeyExpired, "AuthKey expired")
+	ErrSingleUseAuthKeyHasBeenUsed = types.NewHeadscaleError(types.CodeKeyUsed, "AuthKey has already been used")
+	ErrUserMismatch                = types.NewHeadscaleError(types.CodeUserMismatch, "user mismatch")
+	ErrPreAuthKeyACLTagInvalid     = types.NewHeadscaleError(types.CodeInvalidTag, "AuthKey tag is invalid")
+	ErrPreAuthKeyPrefixAmbiguous   = types.NewHeadscaleError(
+		types.CodeInvalidArgument,
+		"AuthKey prefix matches several keys, use the full key",
+	)
 )
 
 func (hsdb *HSDatabase) CreatePreAuthKey(
@@ -46,6 +65,10 @@ func CreatePreAuthKey(
 		return nil, err
 	}
 
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+
 	for _, tag := range aclTags {
 		if !strings.HasPrefix(tag, "tag:") {
 			return nil, fmt.Errorf(
@@ -57,13 +80,26 @@ func CreatePreAuthKey(
 	}
 
 	now := time.Now().UTC()
-	kstr, err := generateKey()
+	id, err := generateKey(preAuthKeyIDSize)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := generateKey(preAuthKeySecretSize)
 	if err != nil {
 		return nil, err
 	}
 
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := preAuthKeyPrefix + id
+
 	key := types.PreAuthKey{
-		Key:        kstr,
+		Hash:       hash,
+		Prefix:     prefix,
 		UserID:     user.ID,
 		User:       *user,
 		Reusable:   reusable,
@@ -76,6 +112,9 @@ func CreatePreAuthKey(
 		return nil, fmt.Errorf("failed to create key in the database: %w", err)
 	}
 
+	// The full key is only returned here, and never stored.
+	key.Key = prefix + "-" + secret
+
 	if len(aclTags) > 0 {
 		seenTags := map[string]bool{}
 
@@ -116,13 +155,21 @@ func ListPreAuthKeys(tx *gorm.DB, userName string) ([]types.PreAuthKey, error) {
 	return keys, nil
 }
 
-// GetPreAuthKey returns a PreAuthKey for a given key.
+// GetPreAuthKey returns a usable PreAuthKey for a given key, or for the
+// non-secret prefix of a key, as shown when listing keys.
 func GetPreAuthKey(tx *gorm.DB, user string, key string) (*types.PreAuthKey, error) {
-	pak, err := ValidatePreAuthKey(tx, key)
+	pak, err := findPreAuthKey(tx, key)
+	if errors.Is(err, ErrPreAuthKeyNotFound) {
+		pak, err = findPreAuthKeyByPrefix(tx, key)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if err := validatePreAuthKey(tx, pak); err != nil {
+		return nil, err
+	}
+
 	if pak.User.Name != user {
 		return nil, ErrUserMismatch
 	}
@@ -161,13 +208,130 @@ func ExpirePreAuthKey(tx *gorm.DB, k *types.PreAuthKey) error {
 	return nil
 }
 
-// UsePreAuthKey marks a PreAuthKey as used.
+// SetPreAuthKeyRequestedIP sets the IP given to the node registering
+// with the PreAuthKey.
+func SetPreAuthKeyRequestedIP(tx *gorm.DB, k *types.PreAuthKey, ip netip.Addr) error {
+	if err := tx.Model(k).Update("requested_ip", ip.String()).Error; err != nil {
+		return fmt.Errorf("failed to update key requested IP in the database: %w", err)
+	}
+
+	return nil
+}
+
+func (hsdb *HSDatabase) ClearExpiredRequestedIPs(now time.Time) ([]netip.Addr, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) ([]netip.Addr, error) {
+		return ClearExpiredRequestedIPs(tx, now)
+	})
+}
+
+// ClearExpiredRequestedIPs removes the IP requested by the unused pre auth
+// keys which have expired at now, and returns the addresses so they are
+// released from the IP allocator. The keys cannot be used anymore, the
+// addresses are only returned once, and not if a node has been given them
+// since, the allocator does not reserve them after a restart.
+func ClearExpiredRequestedIPs(tx *gorm.DB, now time.Time) ([]netip.Addr, error) {
+	var keys []types.PreAuthKey
+	err := tx.
+		Where("used = ? AND requested_ip IS NOT NULL AND requested_ip != ''", false).
+		Where("expiration IS NOT NULL AND expiration <= ?", now).
+		Find(&keys).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expired pre auth keys with a requested IP: %w", err)
+	}
+
+	var ips []netip.Addr
+	for index := range keys {
+		key := &keys[index]
+
+		ip, err := netip.ParseAddr(key.RequestedIP)
+		if err != nil {
+			return nil, fmt.Errorf("parsing requested IP of pre auth key %d: %w", key.ID, err)
+		}
+
+		if err := tx.Model(key).Update("requested_ip", "").Error; err != nil {
+			return nil, fmt.Errorf("failed to clear requested IP of pre auth key %d: %w", key.ID, err)
+		}
+
+		var nodes int64
+		err = tx.Model(&types.Node{}).
+			Where("ipv4 = ? OR ipv6 = ?", ip.String(), ip.String()).
+			Count(&nodes).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up the node with IP %s: %w", ip, err)
+		}
+
+		if nodes == 0 {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips, nil
+}
+
+func (hsdb *HSDatabase) UsePreAuthKey(k *types.PreAuthKey) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return UsePreAuthKey(tx, k)
+	})
+}
+
+// UsePreAuthKey marks a PreAuthKey as used, it fails with
+// ErrSingleUseAuthKeyHasBeenUsed if k is a single use key which has
+// already been used. A reusable key is only marked the first time.
+//
+// Concurrent registrations can all validate a single use key before any
+// of them marks it used, so the check and the mark are done together in
+// the transaction tx, which must also register the node:
+//   - on PostgreSQL and MySQL, the row of the key is locked with
+//     SELECT ... FOR UPDATE, concurrent transactions wait on it until tx
+//     commits or rolls back and then see the key used.
+//   - SQLite does not support row locks. Headscale uses a single
+//     connection to it, so a transaction holds the whole database until
+//     it ends, as BEGIN IMMEDIATE would.
+//
+// In all cases the key is marked with an UPDATE conditional on it not
+// being used, only the first transaction updates the row.
 func UsePreAuthKey(tx *gorm.DB, k *types.PreAuthKey) error {
-	k.Used = true
-	if err := tx.Save(k).Error; err != nil {
-		return fmt.Errorf("failed to update key used status in the database: %w", err)
+	if k.Reusable {
+		if !k.Used {
+			if err := tx.Model(&types.PreAuthKey{}).
+				Where("id = ?", k.ID).
+				Update("used", true).Error; err != nil {
+				return fmt.Errorf("failed to update key used status in the database: %w", err)
+			}
+		}
+
+		k.Used = true
+
+		return nil
 	}
 
+	switch tx.Dialector.Name() {
+	case types.DatabasePostgres, types.DatabaseMysql:
+		var locked types.PreAuthKey
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id").
+			First(&locked, k.ID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrPreAuthKeyNotFound
+			}
+
+			return fmt.Errorf("failed to lock key in the database: %w", err)
+		}
+	}
+
+	result := tx.Model(&types.PreAuthKey{}).
+		Where("id = ? AND used = ?", k.ID, false).
+		Update("used", true)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update key used status in the database: %w", result.Error)
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrSingleUseAuthKeyHasBeenUsed
+	}
+
+	k.Used = true
+
 	return nil
 }
 
@@ -180,20 +344,89 @@ func (hsdb *HSDatabase) ValidatePreAuthKey(k string) (*types.PreAuthKey, error)
 // ValidatePreAuthKey does the heavy lifting for validation of the PreAuthKey coming from a node
 // If returns no error and a PreAuthKey, it can be used.
 func ValidatePreAuthKey(tx *gorm.DB, k string) (*types.PreAuthKey, error) {
-	pak := types.PreAuthKey{}
-	if result := tx.Preload("User").Preload("ACLTags").First(&pak, "key = ?", k); errors.Is(
-		result.Error,
-		gorm.ErrRecordNotFound,
-	) {
+	pak, err := findPreAuthKey(tx, k)
+	if err != nil {
+		return nil, err
+	}
+
+	if pak.User.Disabled {
+		return nil, ErrUserDisabled
+	}
+
+	if err := validatePreAuthKey(tx, pak); err != nil {
+		return nil, err
+	}
+
+	return pak, nil
+}
+
+// findPreAuthKey returns the PreAuthKey matching the full key k, either
+// in the hskey-auth-<id>-<secret> format, or a legacy plain key.
+func findPreAuthKey(tx *gorm.DB, k string) (*types.PreAuthKey, error) {
+	if k == "" {
 		return nil, ErrPreAuthKeyNotFound
 	}
 
+	rest, found := strings.CutPrefix(k, preAuthKeyPrefix)
+	if !found {
+		pak := types.PreAuthKey{}
+		if err := tx.Preload("User").Preload("ACLTags").First(&pak, "key = ?", k).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrPreAuthKeyNotFound
+			}
+
+			return nil, err
+		}
+
+		return &pak, nil
+	}
+
+	id, secret, found := strings.Cut(rest, "-")
+	if !found {
+		return nil, ErrPreAuthKeyNotFound
+	}
+
+	pak, err := findPreAuthKeyByPrefix(tx, preAuthKeyPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword(pak.Hash, []byte(secret)); err != nil {
+		return nil, ErrPreAuthKeyNotFound
+	}
+
+	return pak, nil
+}
+
+// findPreAuthKeyByPrefix returns the key with the given prefix. The
+// prefixes of legacy keys are the beginning of the keys and can be
+// shared by several keys, such a prefix is rejected instead of picking
+// one of them.
+func findPreAuthKeyByPrefix(tx *gorm.DB, prefix string) (*types.PreAuthKey, error) {
+	paks := []types.PreAuthKey{}
+	if err := tx.Preload("User").Preload("ACLTags").Where("prefix = ?", prefix).Limit(2).Find(&paks).Error; err != nil {
+		return nil, err
+	}
+
+	switch len(paks) {
+	case 0:
+		return nil, ErrPreAuthKeyNotFound
+	case 1:
+		return &paks[0], nil
+	default:
+		return nil, ErrPreAuthKeyPrefixAmbiguous
+	}
+}
+
+// validatePreAuthKey returns an error if the PreAuthKey has expired
+// or has already been used.
+func validatePreAuthKey(tx *gorm.DB, pak *types.PreAuthKey) error {
 	if pak.Expiration != nil && pak.Expiration.Before(time.Now()) {
-		return nil, ErrPreAuthKeyExpired
+		return ErrPreAuthKeyExpired
 	}
 
 	if pak.Reusable { // we don't need to check if has been used before
-		return &pak, nil
+		return nil
 	}
 
 	nodes := types.Nodes{}
@@ -201,18 +434,18 @@ func ValidatePreAuthKey(tx *gorm.DB, k string) (*types.PreAuthKey, error) {
 		Preload("AuthKey").
 		Where(&types.Node{AuthKeyID: uint(pak.ID)}).
 		Find(&nodes).Error; err != nil {
-		return nil, err
+		return err
 	}
 
 	if len(nodes) != 0 || pak.Used {
-		return nil, ErrSingleUseAuthKeyHasBeenUsed
+		return ErrSingleUseAuthKeyHasBeenUsed
 	}
 
-	return &pak, nil
+	return nil
 }
 
-func generateKey() (string, error) {
-	size := 24
+// generateKey returns size random bytes encoded as hex.
+func generateKey(size int) (string, error) {
 	bytes := make([]byte, size)
 	if _, err := rand.Read(bytes); err != nil {
 		return "", err
@@ -1,6 +1,10 @@
 package db
 
 import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
@@ -21,8 +25,8 @@ func (*Suite) TestCreatePreAuthKey(c *check.C) {
 	c.Assert(err, check.IsNil)
 
 	// Did we get a valid key?
-	c.Assert(key.Key, check.NotNil)
-	c.Assert(len(key.Key), check.Equals, 48)
+	c.Assert(strings.HasPrefix(key.Key, "hskey-auth-"), check.Equals, true)
+	c.Assert(strings.HasPrefix(key.Key, key.Prefix+"-"), check.Equals, true)
 
 	// Make sure the User association is populated
 	c.Assert(key.User.Name, check.Equals, user.Name)
@@ -36,6 +40,63 @@ func (*Suite) TestCreatePreAuthKey(c *check.C) {
 
 	// Make sure the User association is populated
 	c.Assert((keys)[0].User.Name, check.Equals, user.Name)
+	c.Assert((keys)[0].Prefix, check.Equals, key.Prefix)
+
+	// Only the hash of the secret is stored
+	c.Assert((keys)[0].Key, check.Equals, "")
+	c.Assert((keys)[0].Hash, check.NotNil)
+
+	validated, err := db.ValidatePreAuthKey(key.Key)
+	c.Assert(err, check.IsNil)
+	c.Assert(validated.ID, check.Equals, key.ID)
+
+	// The prefix alone, or a wrong secret, is not a valid key
+	_, err = db.ValidatePreAuthKey(key.Prefix)
+	c.Assert(err, check.Equals, ErrPreAuthKeyNotFound)
+
+	_, err = db.ValidatePreAuthKey(key.Prefix + "-wrongsecret")
+	c.Assert(err, check.Equals, ErrPreAuthKeyNotFound)
+}
+
+func (*Suite) TestLegacyPreAuthKey(c *check.C) {
+	user, err := db.CreateUser("legacy")
+	c.Assert(err, check.IsNil)
+
+	legacy := types.PreAuthKey{
+		Key:      "0123456789abcdef0123456789abcdef0123456789abcdef",
+		Prefix:   "01234567",
+		UserID:   user.ID,
+		Reusable: true,
+	}
+	c.Assert(db.DB.Save(&legacy).Error, check.IsNil)
+
+	key, err := db.ValidatePreAuthKey(legacy.Key)
+	c.Assert(err, check.IsNil)
+	c.Assert(key.ID, check.Equals, legacy.ID)
+
+	// Legacy keys can be expired with the prefix shown by list
+	key, err = GetPreAuthKey(db.DB, user.Name, legacy.Prefix)
+	c.Assert(err, check.IsNil)
+	c.Assert(key.ID, check.Equals, legacy.ID)
+
+	_, err = db.ValidatePreAuthKey(legacy.Prefix)
+	c.Assert(err, check.Equals, ErrPreAuthKeyNotFound)
+
+	// A prefix shared by several legacy keys does not pick one of them
+	other := types.PreAuthKey{
+		Key:      "0123456789abcdeffedcba9876543210fedcba9876543210",
+		Prefix:   "01234567",
+		UserID:   user.ID,
+		Reusable: true,
+	}
+	c.Assert(db.DB.Save(&other).Error, check.IsNil)
+
+	_, err = GetPreAuthKey(db.DB, user.Name, legacy.Prefix)
+	c.Assert(err, check.Equals, ErrPreAuthKeyPrefixAmbiguous)
+
+	key, err = GetPreAuthKey(db.DB, user.Name, other.Key)
+	c.Assert(err, check.IsNil)
+	c.Assert(key.ID, check.Equals, other.ID)
 }
 
 func (*Suite) TestExpiredPreAuthKey(c *check.C) {
@@ -148,7 +209,7 @@ func (*Suite) TestEphemeralKeyReusable(c *check.C) {
 	c.Assert(err, check.IsNil)
 
 	db.DB.Transaction(func(tx *gorm.DB) error {
-		DeleteExpiredEphemeralNodes(tx, time.Second*20)
+		DeleteExpiredEphemeralNodes(tx, time.Second*20, nil)
 		return nil
 	})
 
@@ -182,7 +243,7 @@ func (*Suite) TestEphemeralKeyNotReusable(c *check.C) {
 	c.Assert(err, check.IsNil)
 
 	db.DB.Transaction(func(tx *gorm.DB) error {
-		DeleteExpiredEphemeralNodes(tx, time.Second*20)
+		DeleteExpiredEphemeralNodes(tx, time.Second*20, nil)
 		return nil
 	})
 
@@ -191,6 +252,51 @@ func (*Suite) TestEphemeralKeyNotReusable(c *check.C) {
 	c.Assert(err, check.NotNil)
 }
 
+func (*Suite) TestEphemeralNodeInactivity(c *check.C) {
+	user, err := db.CreateUser("test7")
+	c.Assert(err, check.IsNil)
+
+	pak, err := db.CreatePreAuthKey(user.Name, true, true, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	longAgo := time.Now().Add(-time.Hour)
+	recently := time.Now().Add(-time.Second * 10)
+	for _, node := range []types.Node{
+		{Hostname: "disconnected", LastSeen: &longAgo},
+		{Hostname: "connected", LastSeen: &longAgo},
+		{Hostname: "recent", LastSeen: &recently},
+	} {
+		node.UserID = user.ID
+		node.RegisterMethod = util.RegisterMethodAuthKey
+		node.AuthKeyID = uint(pak.ID)
+		db.DB.Save(&node)
+	}
+
+	connected, err := db.getNode("test7", "connected")
+	c.Assert(err, check.IsNil)
+
+	var removed []types.NodeID
+	db.DB.Transaction(func(tx *gorm.DB) error {
+		removed, _ = DeleteExpiredEphemeralNodes(
+			tx,
+			time.Second*30,
+			types.NodeConnectedMap{connected.ID: true},
+		)
+		return nil
+	})
+	c.Assert(removed, check.HasLen, 1)
+
+	// Only the node disconnected for longer than the timeout is deleted
+	_, err = db.getNode("test7", "disconnected")
+	c.Assert(err, check.NotNil)
+
+	_, err = db.getNode("test7", "connected")
+	c.Assert(err, check.IsNil)
+
+	_, err = db.getNode("test7", "recent")
+	c.Assert(err, check.IsNil)
+}
+
 func (*Suite) TestExpirePreauthKey(c *check.C) {
 	user, err := db.CreateUser("test3")
 	c.Assert(err, check.IsNil)
@@ -221,6 +327,17 @@ func (*Suite) TestNotReusableMarkedAsUsed(c *check.C) {
 	c.Assert(err, check.Equals, ErrSingleUseAuthKeyHasBeenUsed)
 }
 
+func (*Suite) TestUseReusablePreAuthKey(c *check.C) {
+	user, err := db.CreateUser("test-reusable")
+	c.Assert(err, check.IsNil)
+
+	pak, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(db.UsePreAuthKey(pak), check.IsNil)
+	c.Assert(db.UsePreAuthKey(pak), check.IsNil)
+}
+
 func (*Suite) TestPreAuthKeyACLTags(c *check.C) {
 	user, err := db.CreateUser("test8")
 	c.Assert(err, check.IsNil)
@@ -237,3 +354,103 @@ func (*Suite) TestPreAuthKeyACLTags(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(listedPaks[0].Proto().GetAclTags(), check.DeepEquals, tags)
 }
+
+func TestUsePreAuthKeyConcurrently(t *testing.T) {
+	tests := []struct {
+		name   string
+		dbFunc func(t *testing.T) *HSDatabase
+	}{
+		{
+			name: "sqlite",
+			dbFunc: func(t *testing.T) *HSDatabase {
+				return dbForTest(t, "use-preauth-key-concurrently")
+			},
+		},
+		{
+			name:   "mysql",
+			dbFunc: mysqlDBForTest,
+		},
+	}
+
+	const registrations = 50
+
+	// useConcurrently uses pak in registrations transactions at once, as
+	// many registrations having all validated the key before any uses it,
+	// and returns how many succeeded.
+	useConcurrently := func(t *testing.T, hsdb *HSDatabase, pak *types.PreAuthKey) int {
+		t.Helper()
+
+		errs := make(chan error, registrations)
+		var wg sync.WaitGroup
+		for range registrations {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				key := *pak
+				errs <- hsdb.UsePreAuthKey(&key)
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		succeeded := 0
+		for err := range errs {
+			if err == nil {
+				succeeded++
+
+				continue
+			}
+			if !errors.Is(err, ErrSingleUseAuthKeyHasBeenUsed) {
+				t.Errorf("UsePreAuthKey() error = %s", err)
+			}
+		}
+
+		return succeeded
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hsdb := tt.dbFunc(t)
+
+			user, err := hsdb.CreateUser("concurrent")
+			if err != nil {
+				t.Fatalf("creating user: %s", err)
+			}
+
+			pak, err := hsdb.CreatePreAuthKey(user.Name, false, false, nil, nil)
+			if err != nil {
+				t.Fatalf("creating key: %s", err)
+			}
+
+			if succeeded := useConcurrently(t, hsdb, pak); succeeded != 1 {
+				t.Errorf("single use key used %d times, want 1", succeeded)
+			}
+
+			if _, err := hsdb.ValidatePreAuthKey(pak.Key); !errors.Is(err, ErrSingleUseAuthKeyHasBeenUsed) {
+				t.Errorf("ValidatePreAuthKey() error = %v, want %v", err, ErrSingleUseAuthKeyHasBeenUsed)
+			}
+
+			reusable, err := hsdb.CreatePreAuthKey(user.Name, true, false, nil, nil)
+			if err != nil {
+				t.Fatalf("creating key: %s", err)
+			}
+
+			if succeeded := useConcurrently(t, hsdb, reusable); succeeded != registrations {
+				t.Errorf("reusable key used %d times, want %d", succeeded, registrations)
+			}
+
+			// The key is marked used, it can still be used again.
+			used, err := hsdb.ValidatePreAuthKey(reusable.Key)
+			if err != nil {
+				t.Fatalf("ValidatePreAuthKey() error = %s", err)
+			}
+			if !used.Used {
+				t.Error("reusable key not marked used")
+			}
+			if err := hsdb.UsePreAuthKey(used); err != nil {
+				t.Errorf("UsePreAuthKey() of a used reusable key error = %s", err)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/netip"
 	"sort"
+	"time"
 
 	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
@@ -13,7 +14,13 @@ import (
 	"tailscale.com/util/set"
 )
 
-var ErrRouteIsNotAvailable = errors.New("route is not available")
+var (
+	ErrRouteIsNotAvailable = types.NewHeadscaleError(types.CodeRouteNotAvailable, "route is not available")
+	ErrRoutesPageTooLarge  = types.NewHeadscaleError(
+		types.CodeInvalidArgument,
+		fmt.Sprintf("at most %d routes can be listed per page", MaxRoutesPerPage),
+	)
+)
 
 func GetRoutes(tx *gorm.DB) (types.Routes, error) {
 	var routes types.Routes
@@ -28,6 +35,73 @@ func GetRoutes(tx *gorm.DB) (types.Routes, error) {
 	return routes, nil
 }
 
+// MaxRoutesPerPage is the largest page of routes ListRoutes returns.
+const MaxRoutesPerPage = 200
+
+// RouteFilter selects the routes listed by ListRoutes. The zero value
+// lists all the routes.
+type RouteFilter struct {
+	// User and NodeID only list the routes of the nodes of the user,
+	// or of the node, when set.
+	User   string
+	NodeID types.NodeID
+
+	// Page, starting at 1, and PerPage only list a page of the routes.
+	// PerPage defaults to MaxRoutesPerPage if only Page is set, Page to
+	// the first page if only PerPage is set.
+	Page    int
+	PerPage int
+}
+
+// ListRoutes returns the routes matching filter, ordered by ID, and the
+// number of routes matching it on all the pages.
+func ListRoutes(tx *gorm.DB, filter RouteFilter) (types.Routes, int64, error) {
+	if filter.PerPage > MaxRoutesPerPage {
+		return nil, 0, ErrRoutesPageTooLarge
+	}
+
+	query := tx.Model(&types.Route{})
+	if filter.User != "" {
+		query = query.
+			Joins("JOIN nodes ON nodes.id = routes.node_id").
+			Joins("JOIN users ON users.id = nodes.user_id").
+			Where("users.name = ?", filter.User)
+	}
+	if filter.NodeID != 0 {
+		query = query.Where("routes.node_id = ?", filter.NodeID)
+	}
+
+	// The filters are shared by the count and the listing.
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	if filter.Page > 0 || filter.PerPage > 0 {
+		page := max(filter.Page, 1)
+		perPage := filter.PerPage
+		if perPage == 0 {
+			perPage = MaxRoutesPerPage
+		}
+
+		query = query.Offset((page - 1) * perPage).Limit(perPage)
+	}
+
+	var routes types.Routes
+	err := query.
+		Preload("Node").
+		Preload("Node.User").
+		Order("routes.id").
+		Find(&routes).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return routes, total, nil
+}
+
 func getAdvertisedAndEnabledRoutes(tx *gorm.DB) (types.Routes, error) {
 	var routes types.Routes
 	err := tx.
@@ -103,6 +177,17 @@ func GetRoute(tx *gorm.DB, id uint64) (*types.Route, error) {
 	return &route, nil
 }
 
+// CheckRouteUnlocked returns ErrNodeLocked if the node of the route is
+// locked and the change is not forced.
+func CheckRouteUnlocked(tx *gorm.DB, id uint64, force bool) error {
+	route, err := GetRoute(tx, id)
+	if err != nil {
+		return err
+	}
+
+	return CheckNodeUnlocked(&route.Node, force)
+}
+
 func EnableRoute(tx *gorm.DB, id uint64) (*types.StateUpdate, error) {
 	route, err := GetRoute(tx, id)
 	if err != nil {
@@ -142,6 +227,7 @@ func DisableRoute(tx *gorm.DB,
 	var update []types.NodeID
 	if !route.IsExitRoute() {
 		route.Enabled = false
+		route.Disabled = true
 		err = tx.Save(route).Error
 		if err != nil {
 			return nil, err
@@ -161,6 +247,7 @@ func DisableRoute(tx *gorm.DB,
 			if routes[i].IsExitRoute() {
 				routes[i].Enabled = false
 				routes[i].IsPrimary = false
+				routes[i].Disabled = true
 
 				err = tx.Save(&routes[i]).Error
 				if err != nil {
@@ -467,6 +554,83 @@ nodeRouteLoop:
 	return nil, nil
 }
 
+// RouteFailoverPolicy fails over primary routes served by nodes that
+// still look connected, but have not sent a heartbeat for longer than
+// Timeout, e.g. because the connection is hanging.
+type RouteFailoverPolicy struct {
+	Timeout time.Duration
+}
+
+// isStale reports if the node has not been seen for longer than
+// the policy timeout. The last heartbeat of the node is used if there
+// is one, its stored LastSeen otherwise.
+func (p RouteFailoverPolicy) isStale(
+	node *types.Node,
+	heartbeats map[types.NodeID]time.Time,
+	now time.Time,
+) bool {
+	if heartbeat, ok := heartbeats[node.ID]; ok {
+		return now.Sub(heartbeat) > p.Timeout
+	}
+
+	return node.LastSeen != nil && now.Sub(*node.LastSeen) > p.Timeout
+}
+
+// FailoverStaleRoutes moves every primary route served by a stale node
+// to another connected and not stale node advertising the same prefix,
+// if there is one. heartbeats holds when the connected nodes were last
+// heard from, they are kept in memory and not stored in the database.
+func (p RouteFailoverPolicy) FailoverStaleRoutes(
+	tx *gorm.DB,
+	isConnected types.NodeConnectedMap,
+	heartbeats map[types.NodeID]time.Time,
+	now time.Time,
+) (*types.StateUpdate, error) {
+	routes, err := getAdvertisedAndEnabledRoutes(tx)
+	if err != nil {
+		return nil, fmt.Errorf("getting enabled routes: %w", err)
+	}
+
+	// Stale nodes are treated as disconnected, so they are not
+	// picked as the new primary.
+	available := make(types.NodeConnectedMap)
+	for _, route := range routes {
+		available[route.Node.ID] = isConnected[route.Node.ID] && !p.isStale(&route.Node, heartbeats, now)
+	}
+
+	changedNodes := make(set.Set[types.NodeID])
+
+	for idx, route := range routes {
+		if !route.IsPrimary || !p.isStale(&route.Node, heartbeats, now) {
+			continue
+		}
+
+		changed, err := failoverRouteTx(tx, available, &routes[idx])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, nodeID := range changed {
+			changedNodes.Add(nodeID)
+		}
+	}
+
+	if len(changedNodes) == 0 {
+		return nil, nil
+	}
+
+	chng := changedNodes.Slice()
+	sort.SliceStable(chng, func(i, j int) bool {
+		return chng[i] < chng[j]
+	})
+
+	return &types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: chng,
+		Message:     "called from db.RouteFailoverPolicy.FailoverStaleRoutes",
+	}, nil
+}
+
 // failoverRouteTx takes a route that is no longer available,
 // this can be either from:
 // - being disabled
@@ -560,7 +724,8 @@ func failoverRoute(
 
 	var newPrimary *types.Route
 
-	// Find a new suitable route
+	// Find a new suitable route, preferring the connected
+	// node that was seen most recently.
 	for idx, route := range altRoutes {
 		if routeToReplace.ID == route.ID {
 			continue
@@ -570,9 +735,12 @@ func failoverRoute(
 			continue
 		}
 
-		if isConnected != nil && isConnected[route.Node.ID] {
+		if isConnected == nil || !isConnected[route.Node.ID] {
+			continue
+		}
+
+		if newPrimary == nil || seenAfter(&route.Node, &newPrimary.Node) {
 			newPrimary = &altRoutes[idx]
-			break
 		}
 	}
 
@@ -594,6 +762,20 @@ func failoverRoute(
 	}
 }
 
+// seenAfter reports if node a was last seen after node b. Nodes
+// that have never been seen are considered the oldest.
+func seenAfter(a, b *types.Node) bool {
+	if a.LastSeen == nil {
+		return false
+	}
+
+	if b.LastSeen == nil {
+		return true
+	}
+
+	return a.LastSeen.After(*b.LastSeen)
+}
+
 func (hsdb *HSDatabase) EnableAutoApprovedRoutes(
 	aclPolicy *policy.ACLPolicy,
 	node *types.Node,
@@ -604,6 +786,7 @@ func (hsdb *HSDatabase) EnableAutoApprovedRoutes(
 }
 
 // EnableAutoApprovedRoutes enables any routes advertised by a node that match the ACL autoApprovers policy.
+// The routes disabled by hand are left disabled.
 func EnableAutoApprovedRoutes(
 	tx *gorm.DB,
 	aclPolicy *policy.ACLPolicy,
@@ -623,7 +806,7 @@ func EnableAutoApprovedRoutes(
 	approvedRoutes := types.Routes{}
 
 	for _, advertisedRoute := range routes {
-		if advertisedRoute.Enabled {
+		if advertisedRoute.Enabled || advertisedRoute.Disabled {
 			continue
 		}
 
@@ -642,7 +825,10 @@ func EnableAutoApprovedRoutes(
 			Msg("looking up route for autoapproving")
 
 		for _, approvedAlias := range routeApprovers {
-			if approvedAlias == node.User.Name {
+			// The user of a node and its groups approve its routes
+			// even if the node is tagged, while the node is not
+			// part of them in the ACLs.
+			if approvedAlias == node.User.Name || aclPolicy.IsUserInGroup(approvedAlias, node.User.Name) {
 				approvedRoutes = append(approvedRoutes, advertisedRoute)
 			} else {
 				// TODO(kradalby): figure out how to get this to depend on less stuff
@@ -652,7 +838,7 @@ func EnableAutoApprovedRoutes(
 				}
 
 				// approvedIPs should contain all of node's IPs if it matches the rule, so check for first
-				if approvedIps.Contains(*node.IPv4) {
+				if approvedIps.Contains(node.IPs()[0]) {
 					approvedRoutes = append(approvedRoutes, advertisedRoute)
 				}
 			}
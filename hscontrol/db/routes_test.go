@@ -1,6 +1,7 @@
 package db
 
 import (
+	"errors"
 	"net/netip"
 	"os"
 	"testing"
@@ -58,6 +59,73 @@ func (s *Suite) TestGetRoutes(c *check.C) {
 	c.Assert(err, check.IsNil)
 }
 
+func (s *Suite) TestListRoutes(c *check.C) {
+	var nodes []types.Node
+	for _, name := range []string{"alice", "bob"} {
+		user, err := db.CreateUser(name)
+		c.Assert(err, check.IsNil)
+
+		node := types.Node{
+			Hostname:       name + "-router",
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+			Hostinfo: &tailcfg.Hostinfo{
+				RoutableIPs: []netip.Prefix{
+					netip.MustParsePrefix("10.0.0.0/24"),
+					netip.MustParsePrefix("10.0.1.0/24"),
+					netip.MustParsePrefix("10.0.2.0/24"),
+				},
+			},
+		}
+		c.Assert(db.DB.Save(&node).Error, check.IsNil)
+
+		_, err = db.SaveNodeRoutes(&node)
+		c.Assert(err, check.IsNil)
+
+		nodes = append(nodes, node)
+	}
+
+	list := func(filter RouteFilter) (types.Routes, int64) {
+		routes, total, err := ListRoutes(db.DB, filter)
+		c.Assert(err, check.IsNil)
+
+		return routes, total
+	}
+
+	routes, total := list(RouteFilter{})
+	c.Assert(routes, check.HasLen, 6)
+	c.Assert(total, check.Equals, int64(6))
+
+	routes, total = list(RouteFilter{User: "bob"})
+	c.Assert(routes, check.HasLen, 3)
+	c.Assert(total, check.Equals, int64(3))
+	for _, route := range routes {
+		c.Assert(route.Node.User.Name, check.Equals, "bob")
+	}
+
+	routes, _ = list(RouteFilter{NodeID: nodes[0].ID})
+	c.Assert(routes, check.HasLen, 3)
+	for _, route := range routes {
+		c.Assert(route.NodeID, check.Equals, nodes[0].ID.Uint64())
+	}
+
+	routes, total = list(RouteFilter{User: "alice", NodeID: nodes[1].ID})
+	c.Assert(routes, check.HasLen, 0)
+	c.Assert(total, check.Equals, int64(0))
+
+	// The pages follow the IDs of the routes.
+	first, total := list(RouteFilter{Page: 1, PerPage: 4})
+	c.Assert(first, check.HasLen, 4)
+	c.Assert(total, check.Equals, int64(6))
+
+	second, _ := list(RouteFilter{Page: 2, PerPage: 4})
+	c.Assert(second, check.HasLen, 2)
+	c.Assert(second[0].ID > first[3].ID, check.Equals, true)
+
+	_, _, err := ListRoutes(db.DB, RouteFilter{PerPage: MaxRoutesPerPage + 1})
+	c.Assert(errors.Is(err, ErrRoutesPageTooLarge), check.Equals, true)
+}
+
 func (s *Suite) TestGetEnableRoutes(c *check.C) {
 	user, err := db.CreateUser("test")
 	c.Assert(err, check.IsNil)
@@ -1044,6 +1112,17 @@ func TestFailoverRoute(t *testing.T) {
 		ro := r(id, nid, prefix, enabled, primary)
 		return &ro
 	}
+	now := time.Now()
+	seen := func(route types.Route, ago time.Duration) types.Route {
+		lastSeen := now.Add(-ago)
+		route.Node.LastSeen = &lastSeen
+
+		return route
+	}
+	seenp := func(route types.Route, ago time.Duration) *types.Route {
+		ro := seen(route, ago)
+		return &ro
+	}
 	tests := []struct {
 		name         string
 		failingRoute types.Route
@@ -1152,6 +1231,26 @@ func TestFailoverRoute(t *testing.T) {
 				new: rp(3, 2, ipp("10.0.0.0/24"), true, true),
 			},
 		},
+		{
+			name:         "failover-primary-most-recently-seen",
+			failingRoute: r(1, 1, ipp("10.0.0.0/24"), true, true),
+			routes: types.Routes{
+				r(1, 1, ipp("10.0.0.0/24"), true, true),
+				seen(r(2, 2, ipp("10.0.0.0/24"), true, false), 5*time.Minute),
+				seen(r(3, 3, ipp("10.0.0.0/24"), true, false), time.Minute),
+				seen(r(4, 4, ipp("10.0.0.0/24"), true, false), 10*time.Minute),
+			},
+			isConnected: types.NodeConnectedMap{
+				1: false,
+				2: true,
+				3: true,
+				4: true,
+			},
+			want: &failover{
+				old: rp(1, 1, ipp("10.0.0.0/24"), true, false),
+				new: seenp(r(3, 3, ipp("10.0.0.0/24"), true, true), time.Minute),
+			},
+		},
 		{
 			name:         "failover-primary-none-enabled",
 			failingRoute: r(1, 1, ipp("10.0.0.0/24"), true, true),
@@ -1200,3 +1299,123 @@ func TestFailoverRoute(t *testing.T) {
 		})
 	}
 }
+
+func TestRouteFailoverPolicy(t *testing.T) {
+	r := func(id uint, nid types.NodeID, prefix types.IPPrefix, enabled, primary bool) types.Route {
+		return types.Route{
+			Model: gorm.Model{
+				ID: id,
+			},
+			Node: types.Node{
+				ID: nid,
+			},
+			Prefix:     prefix,
+			Advertised: true,
+			Enabled:    enabled,
+			IsPrimary:  primary,
+		}
+	}
+	su := func(nids ...types.NodeID) *types.StateUpdate {
+		return &types.StateUpdate{
+			ChangeNodes: nids,
+		}
+	}
+
+	now := time.Now()
+	ago := func(d time.Duration) time.Time {
+		return now.Add(-d)
+	}
+
+	db := dbForTest(t, "route-failover-policy")
+
+	routes := types.Routes{
+		r(1, 1, ipp("10.0.0.0/24"), true, true),
+		r(2, 2, ipp("10.0.0.0/24"), true, false),
+	}
+	for _, route := range routes {
+		if err := db.DB.Save(&route).Error; err != nil {
+			t.Fatalf("failed to create route: %s", err)
+		}
+	}
+
+	// Both nodes keep their connection open during the test, only
+	// their heartbeats change. The stored LastSeen is only used
+	// without a heartbeat.
+	isConnected := types.NodeConnectedMap{
+		1: true,
+		2: true,
+	}
+	failoverPolicy := RouteFailoverPolicy{Timeout: 2 * time.Minute}
+
+	steps := []struct {
+		name     string
+		lastSeen map[types.NodeID]time.Time
+		want     *types.StateUpdate
+	}{
+		{
+			name:     "both-healthy",
+			lastSeen: map[types.NodeID]time.Time{1: ago(time.Minute), 2: ago(time.Minute)},
+			want:     nil,
+		},
+		{
+			name:     "primary-disappears",
+			lastSeen: map[types.NodeID]time.Time{1: ago(5 * time.Minute), 2: ago(time.Minute)},
+			want:     su(1, 2),
+		},
+		{
+			name:     "primary-still-gone",
+			lastSeen: map[types.NodeID]time.Time{1: ago(6 * time.Minute), 2: ago(time.Minute)},
+			want:     nil,
+		},
+		{
+			name:     "no-healthy-backup",
+			lastSeen: map[types.NodeID]time.Time{1: ago(7 * time.Minute), 2: ago(5 * time.Minute)},
+			want:     nil,
+		},
+		{
+			name:     "old-primary-back",
+			lastSeen: map[types.NodeID]time.Time{1: ago(time.Minute), 2: ago(6 * time.Minute)},
+			want:     su(1, 2),
+		},
+	}
+
+	for _, step := range steps {
+		got, err := Write(db.DB, func(tx *gorm.DB) (*types.StateUpdate, error) {
+			return failoverPolicy.FailoverStaleRoutes(tx, isConnected, step.lastSeen, now)
+		})
+		if err != nil {
+			t.Fatalf("%s: FailoverStaleRoutes() unexpected error: %s", step.name, err)
+		}
+
+		if diff := cmp.Diff(step.want, got, cmpopts.IgnoreFields(types.StateUpdate{}, "Type", "Message")); diff != "" {
+			t.Errorf("%s: FailoverStaleRoutes() unexpected result (-want +got):\n%s", step.name, diff)
+		}
+	}
+
+	primary, err := getPrimaryRoute(db.DB, netip.MustParsePrefix("10.0.0.0/24"))
+	if err != nil {
+		t.Fatalf("getting primary route: %s", err)
+	}
+
+	if primary.Node.ID != 1 {
+		t.Errorf("want node 1 to be primary after coming back, got node %d", primary.Node.ID)
+	}
+
+	// Without a heartbeat, the stored LastSeen tells if the node is
+	// stale.
+	err = db.DB.Model(&types.Node{}).Where("id = ?", 1).Update("last_seen", ago(5*time.Minute)).Error
+	if err != nil {
+		t.Fatalf("failed to update last seen: %s", err)
+	}
+
+	got, err := Write(db.DB, func(tx *gorm.DB) (*types.StateUpdate, error) {
+		return failoverPolicy.FailoverStaleRoutes(tx, isConnected, map[types.NodeID]time.Time{2: now}, now)
+	})
+	if err != nil {
+		t.Fatalf("FailoverStaleRoutes() unexpected error: %s", err)
+	}
+
+	if diff := cmp.Diff(su(1, 2), got, cmpopts.IgnoreFields(types.StateUpdate{}, "Type", "Message")); diff != "" {
+		t.Errorf("FailoverStaleRoutes() unexpected result (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,407 @@
+package db
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrStateNotEmpty          = types.NewHeadscaleError(types.CodeStateNotEmpty, "database is not empty")
+	ErrStateVersionMismatched = types.NewHeadscaleError(types.CodeStateVersionMismatch, "unsupported state version")
+)
+
+// stateTables are the tables holding the exported state, in the order
+// they are filled on import.
+var stateTables = []string{
+	"users",
+	"pre_auth_keys",
+	"pre_auth_key_acl_tags",
+	"nodes",
+	"routes",
+	"per_node_routes",
+	"node_groups",
+	"api_keys",
+	"policies",
+}
+
+// unexportedStateTables are the tables referring to the users and nodes
+// which are not exported: the interactive registrations waiting to be
+// completed and the traffic stats. They are emptied on import, their rows
+// would refer to users and nodes which are not the imported ones.
+var unexportedStateTables = []string{
+	"pending_registrations",
+	"peer_traffic_stats",
+}
+
+func (hsdb *HSDatabase) ExportState() (*types.State, error) {
+	return Read(hsdb.DB, ExportState)
+}
+
+// ExportState returns the users, nodes, pre auth keys, routes, node
+// groups, API keys and stored policies of the database.
+func ExportState(tx *gorm.DB) (*types.State, error) {
+	state := &types.State{
+		Version:    types.StateVersion,
+		ExportedAt: time.Now(),
+	}
+
+	var users []types.User
+	if err := tx.Order("id").Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("listing users: %w", err)
+	}
+	for _, user := range users {
+		state.Users = append(state.Users, types.StateUser{
+			ID:          user.ID,
+			Name:        user.Name,
+			DisplayName: user.DisplayName,
+			AvatarURL:   user.AvatarURL,
+			DefaultTags: user.DefaultTags,
+			Disabled:    user.Disabled,
+			DERPOnly:    user.DERPOnly,
+			CreatedAt:   user.CreatedAt,
+		})
+	}
+
+	var nodes []types.Node
+	if err := tx.Order("id").Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("listing nodes: %w", err)
+	}
+	for _, node := range nodes {
+		state.Nodes = append(state.Nodes, types.StateNode{
+			ID:             node.ID,
+			MachineKey:     node.MachineKey,
+			NodeKey:        node.NodeKey,
+			DiscoKey:       node.DiscoKey,
+			Endpoints:      node.Endpoints,
+			Hostinfo:       node.Hostinfo,
+			IPv4:           node.IPv4,
+			IPv6:           node.IPv6,
+			Hostname:       node.Hostname,
+			GivenName:      node.GivenName,
+			UserID:         node.UserID,
+			RegisterMethod: node.RegisterMethod,
+			ForcedTags:     node.ForcedTags,
+			AuthKeyID:      node.AuthKeyID,
+			LastSeen:       node.LastSeen,
+			Expiry:         node.Expiry,
+			Locked:         node.Locked,
+			Metadata:       node.Metadata,
+			DenyAllRoutes:  node.DenyAllRoutes,
+
+			PostureCheckedAt: node.PostureCheckedAt,
+			PostureError:     node.PostureError,
+
+			CreatedAt: node.CreatedAt,
+		})
+	}
+
+	var keys []types.PreAuthKey
+	if err := tx.Preload("ACLTags").Order("id").Find(&keys).Error; err != nil {
+		return nil, fmt.Errorf("listing pre auth keys: %w", err)
+	}
+	for _, pak := range keys {
+		var aclTags []string
+		for _, tag := range pak.ACLTags {
+			aclTags = append(aclTags, tag.Tag)
+		}
+
+		state.PreAuthKeys = append(state.PreAuthKeys, types.StatePreAuthKey{
+			ID:          pak.ID,
+			Prefix:      pak.Prefix,
+			Key:         pak.Key,
+			Hash:        pak.Hash,
+			UserID:      pak.UserID,
+			Reusable:    pak.Reusable,
+			Ephemeral:   pak.Ephemeral,
+			Used:        pak.Used,
+			ACLTags:     aclTags,
+			RequestedIP: pak.RequestedIP,
+			CreatedAt:   pak.CreatedAt,
+			Expiration:  pak.Expiration,
+		})
+	}
+
+	var routes []types.Route
+	if err := tx.Order("id").Find(&routes).Error; err != nil {
+		return nil, fmt.Errorf("listing routes: %w", err)
+	}
+	for _, route := range routes {
+		state.Routes = append(state.Routes, types.StateRoute{
+			ID:         route.ID,
+			NodeID:     route.NodeID,
+			Prefix:     netip.Prefix(route.Prefix),
+			Advertised: route.Advertised,
+			Enabled:    route.Enabled,
+			IsPrimary:  route.IsPrimary,
+			Disabled:   route.Disabled,
+		})
+	}
+
+	var perNodeRoutes []types.PerNodeRoute
+	if err := tx.Order("id").Find(&perNodeRoutes).Error; err != nil {
+		return nil, fmt.Errorf("listing allowed routes: %w", err)
+	}
+	for _, route := range perNodeRoutes {
+		state.PerNodeRoutes = append(state.PerNodeRoutes, types.StatePerNodeRoute{
+			ID:        route.ID,
+			NodeID:    route.NodeID,
+			Prefix:    netip.Prefix(route.Prefix),
+			CreatedAt: route.CreatedAt,
+		})
+	}
+
+	var groups []types.NodeGroup
+	if err := tx.Order("id").Find(&groups).Error; err != nil {
+		return nil, fmt.Errorf("listing node groups: %w", err)
+	}
+	for _, group := range groups {
+		state.NodeGroups = append(state.NodeGroups, types.StateNodeGroup{
+			ID:        group.ID,
+			GroupName: group.GroupName,
+			NodeID:    group.NodeID,
+			UserID:    group.UserID,
+			CreatedAt: group.CreatedAt,
+		})
+	}
+
+	var apiKeys []types.APIKey
+	if err := tx.Order("id").Find(&apiKeys).Error; err != nil {
+		return nil, fmt.Errorf("listing API keys: %w", err)
+	}
+	for _, apiKey := range apiKeys {
+		state.APIKeys = append(state.APIKeys, types.StateAPIKey{
+			ID:         apiKey.ID,
+			Prefix:     apiKey.Prefix,
+			Hash:       apiKey.Hash,
+			CreatedAt:  apiKey.CreatedAt,
+			Expiration: apiKey.Expiration,
+			LastSeen:   apiKey.LastSeen,
+			RotatedAt:  apiKey.RotatedAt,
+		})
+	}
+
+	var policies []types.Policy
+	if err := tx.Order("id").Find(&policies).Error; err != nil {
+		return nil, fmt.Errorf("listing policies: %w", err)
+	}
+	for _, pol := range policies {
+		state.Policies = append(state.Policies, types.StatePolicy{
+			ID:        pol.ID,
+			Data:      pol.Data,
+			CreatedAt: pol.CreatedAt,
+			UpdatedAt: pol.UpdatedAt,
+		})
+	}
+
+	return state, nil
+}
+
+func (hsdb *HSDatabase) ImportState(state *types.State, force bool) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return ImportState(tx, state, force)
+	})
+}
+
+// ImportState restores an exported state, keeping the IDs of all the
+// objects. If the database is not empty, ImportState returns
+// ErrStateNotEmpty, unless force is set in which case the existing
+// state is replaced. The pending registrations and traffic stats, which
+// are not exported, are dropped.
+func ImportState(tx *gorm.DB, state *types.State, force bool) error {
+	if state.Version != types.StateVersion {
+		return fmt.Errorf(
+			"%w: %d, expected %d",
+			ErrStateVersionMismatched,
+			state.Version,
+			types.StateVersion,
+		)
+	}
+
+	for _, table := range stateTables {
+		var count int64
+		if err := tx.Table(table).Count(&count).Error; err != nil {
+			return fmt.Errorf("counting %s: %w", table, err)
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		if !force {
+			return fmt.Errorf("%w: %d rows in %s", ErrStateNotEmpty, count, table)
+		}
+	}
+
+	for _, table := range unexportedStateTables {
+		if err := tx.Exec(fmt.Sprintf("DELETE FROM %s", table)).Error; err != nil {
+			return fmt.Errorf("emptying %s: %w", table, err)
+		}
+	}
+
+	if force {
+		for i := len(stateTables) - 1; i >= 0; i-- {
+			table := stateTables[i]
+			if err := tx.Exec(fmt.Sprintf("DELETE FROM %s", table)).Error; err != nil {
+				return fmt.Errorf("emptying %s: %w", table, err)
+			}
+		}
+	}
+
+	for _, user := range state.Users {
+		dbUser := types.User{
+			Name:        user.Name,
+			DisplayName: user.DisplayName,
+			AvatarURL:   user.AvatarURL,
+			DefaultTags: user.DefaultTags,
+			Disabled:    user.Disabled,
+			DERPOnly:    user.DERPOnly,
+		}
+		dbUser.ID = user.ID
+		dbUser.CreatedAt = user.CreatedAt
+		if err := tx.Create(&dbUser).Error; err != nil {
+			return fmt.Errorf("importing user %q: %w", user.Name, err)
+		}
+	}
+
+	for _, pak := range state.PreAuthKeys {
+		dbKey := types.PreAuthKey{
+			ID:          pak.ID,
+			Prefix:      pak.Prefix,
+			Key:         pak.Key,
+			Hash:        pak.Hash,
+			UserID:      pak.UserID,
+			Reusable:    pak.Reusable,
+			Ephemeral:   pak.Ephemeral,
+			Used:        pak.Used,
+			RequestedIP: pak.RequestedIP,
+			CreatedAt:   pak.CreatedAt,
+			Expiration:  pak.Expiration,
+		}
+		for _, tag := range pak.ACLTags {
+			dbKey.ACLTags = append(dbKey.ACLTags, types.PreAuthKeyACLTag{Tag: tag})
+		}
+		if err := tx.Omit("User").Create(&dbKey).Error; err != nil {
+			return fmt.Errorf("importing pre auth key %d: %w", pak.ID, err)
+		}
+	}
+
+	for _, node := range state.Nodes {
+		dbNode := types.Node{
+			ID:             node.ID,
+			MachineKey:     node.MachineKey,
+			NodeKey:        node.NodeKey,
+			DiscoKey:       node.DiscoKey,
+			Endpoints:      node.Endpoints,
+			Hostinfo:       node.Hostinfo,
+			IPv4:           node.IPv4,
+			IPv6:           node.IPv6,
+			Hostname:       node.Hostname,
+			GivenName:      node.GivenName,
+			UserID:         node.UserID,
+			RegisterMethod: node.RegisterMethod,
+			ForcedTags:     node.ForcedTags,
+			AuthKeyID:      node.AuthKeyID,
+			LastSeen:       node.LastSeen,
+			Expiry:         node.Expiry,
+			Locked:         node.Locked,
+			Metadata:       node.Metadata,
+			DenyAllRoutes:  node.DenyAllRoutes,
+
+			PostureCheckedAt: node.PostureCheckedAt,
+			PostureError:     node.PostureError,
+
+			CreatedAt: node.CreatedAt,
+		}
+		if err := tx.Omit(clause.Associations).Create(&dbNode).Error; err != nil {
+			return fmt.Errorf("importing node %d: %w", node.ID, err)
+		}
+	}
+
+	for _, route := range state.Routes {
+		dbRoute := types.Route{
+			NodeID:     route.NodeID,
+			Prefix:     types.IPPrefix(route.Prefix),
+			Advertised: route.Advertised,
+			Enabled:    route.Enabled,
+			IsPrimary:  route.IsPrimary,
+			Disabled:   route.Disabled,
+		}
+		dbRoute.ID = route.ID
+		if err := tx.Omit(clause.Associations).Create(&dbRoute).Error; err != nil {
+			return fmt.Errorf("importing route %d: %w", route.ID, err)
+		}
+	}
+
+	for _, route := range state.PerNodeRoutes {
+		dbRoute := types.PerNodeRoute{
+			ID:        route.ID,
+			NodeID:    route.NodeID,
+			Prefix:    types.IPPrefix(route.Prefix),
+			CreatedAt: route.CreatedAt,
+		}
+		if err := tx.Create(&dbRoute).Error; err != nil {
+			return fmt.Errorf("importing allowed route %d: %w", route.ID, err)
+		}
+	}
+
+	for _, group := range state.NodeGroups {
+		dbGroup := types.NodeGroup{
+			ID:        group.ID,
+			GroupName: group.GroupName,
+			NodeID:    group.NodeID,
+			UserID:    group.UserID,
+			CreatedAt: group.CreatedAt,
+		}
+		if err := tx.Omit(clause.Associations).Create(&dbGroup).Error; err != nil {
+			return fmt.Errorf("importing node group %d: %w", group.ID, err)
+		}
+	}
+
+	for _, apiKey := range state.APIKeys {
+		dbKey := types.APIKey{
+			ID:         apiKey.ID,
+			Prefix:     apiKey.Prefix,
+			Hash:       apiKey.Hash,
+			CreatedAt:  apiKey.CreatedAt,
+			Expiration: apiKey.Expiration,
+			LastSeen:   apiKey.LastSeen,
+			RotatedAt:  apiKey.RotatedAt,
+		}
+		if err := tx.Create(&dbKey).Error; err != nil {
+			return fmt.Errorf("importing API key %d: %w", apiKey.ID, err)
+		}
+	}
+
+	for _, pol := range state.Policies {
+		dbPolicy := types.Policy{
+			ID:        pol.ID,
+			Data:      pol.Data,
+			CreatedAt: pol.CreatedAt,
+			UpdatedAt: pol.UpdatedAt,
+		}
+		if err := tx.Create(&dbPolicy).Error; err != nil {
+			return fmt.Errorf("importing policy %d: %w", pol.ID, err)
+		}
+	}
+
+	// Postgres does not move the sequences of the IDs past the
+	// imported ones, the next objects created would collide with them.
+	if tx.Dialector.Name() == types.DatabasePostgres {
+		for _, table := range stateTables {
+			err := tx.Exec(fmt.Sprintf(
+				"SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %[1]s",
+				table,
+			)).Error
+			if err != nil {
+				return fmt.Errorf("resetting the id sequence of %s: %w", table, err)
+			}
+		}
+	}
+
+	return nil
+}
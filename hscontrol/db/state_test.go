@@ -0,0 +1,164 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func (s *Suite) TestExportImportState(c *check.C) {
+	user, err := db.CreateUser("state")
+	c.Assert(err, check.IsNil)
+	c.Assert(db.DB.Model(user).Update("derp_only", true).Error, check.IsNil)
+
+	pak, err := db.CreatePreAuthKey(user.Name, true, false, nil, []string{"tag:server"})
+	c.Assert(err, check.IsNil)
+
+	ipv4 := netip.MustParseAddr("100.64.0.7")
+	lastSeen := time.Now().Add(-time.Hour).UTC()
+	node := types.Node{
+		MachineKey:     key.NewMachine().Public(),
+		NodeKey:        key.NewNode().Public(),
+		DiscoKey:       key.NewDisco().Public(),
+		Hostinfo:       &tailcfg.Hostinfo{Hostname: "server", OS: "linux"},
+		IPv4:           &ipv4,
+		Hostname:       "server",
+		GivenName:      "server",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+		ForcedTags:     types.StringList{"tag:server"},
+		AuthKeyID:      uint(pak.ID),
+		LastSeen:       &lastSeen,
+	}
+	c.Assert(db.DB.Save(&node).Error, check.IsNil)
+
+	route := types.Route{
+		NodeID:     node.ID.Uint64(),
+		Prefix:     types.IPPrefix(netip.MustParsePrefix("10.0.0.0/24")),
+		Advertised: true,
+		Enabled:    true,
+		IsPrimary:  true,
+	}
+	c.Assert(db.DB.Save(&route).Error, check.IsNil)
+
+	disabledRoute := types.Route{
+		NodeID:     node.ID.Uint64(),
+		Prefix:     types.IPPrefix(netip.MustParsePrefix("10.1.0.0/24")),
+		Advertised: true,
+		Disabled:   true,
+	}
+	c.Assert(db.DB.Save(&disabledRoute).Error, check.IsNil)
+
+	_, err = db.SetNodeMetadata(node.ID, map[string]string{"site": "par1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(db.NodeSetPosture(node.ID, lastSeen, "missing required tag tag:managed"), check.IsNil)
+
+	_, err = db.SetNodeAllowedRoutes(node.ID, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}, false)
+	c.Assert(err, check.IsNil)
+	_, err = db.AddNodeToGroup("servers", node.ID)
+	c.Assert(err, check.IsNil)
+
+	_, apiKey, err := db.CreateAPIKey(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(db.DB.Model(apiKey).Update("rotated_at", lastSeen).Error, check.IsNil)
+
+	_, err = db.SetPolicy(`{"acls": []}`)
+	c.Assert(err, check.IsNil)
+	_, err = db.SetPolicy(`{"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}]}`)
+	c.Assert(err, check.IsNil)
+
+	exported, err := db.ExportState()
+	c.Assert(err, check.IsNil)
+	c.Assert(exported.PerNodeRoutes, check.HasLen, 1)
+	c.Assert(exported.NodeGroups, check.HasLen, 1)
+	c.Assert(exported.APIKeys, check.HasLen, 1)
+	c.Assert(exported.Policies, check.HasLen, 2)
+
+	data, err := json.Marshal(exported)
+	c.Assert(err, check.IsNil)
+
+	var state types.State
+	c.Assert(json.Unmarshal(data, &state), check.IsNil)
+
+	// Importing in a database which is not empty needs to be forced.
+	err = db.ImportState(&state, false)
+	c.Assert(errors.Is(err, ErrStateNotEmpty), check.Equals, true)
+
+	s.ResetDB(c)
+
+	err = db.ImportState(&state, false)
+	c.Assert(err, check.IsNil)
+
+	// Everything exported is imported, exporting again gives the
+	// same state.
+	reexported, err := db.ExportState()
+	c.Assert(err, check.IsNil)
+	reexported.ExportedAt = exported.ExportedAt
+	reexportedData, err := json.Marshal(reexported)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(reexportedData), check.Equals, string(data))
+
+	imported, err := db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(imported.MachineKey, check.Equals, node.MachineKey)
+	c.Assert(imported.NodeKey, check.Equals, node.NodeKey)
+	c.Assert(*imported.IPv4, check.Equals, ipv4)
+	c.Assert(imported.IPv6, check.IsNil)
+	c.Assert(imported.User.Name, check.Equals, "state")
+	c.Assert(imported.Hostinfo.Hostname, check.Equals, "server")
+	c.Assert(imported.LastSeen.Equal(lastSeen), check.Equals, true)
+	c.Assert(imported.Routes, check.HasLen, 1)
+	c.Assert(imported.Routes[0].IsPrimary, check.Equals, true)
+
+	importedKey, err := db.ValidatePreAuthKey(pak.Key)
+	c.Assert(err, check.IsNil)
+	c.Assert(importedKey.ID, check.Equals, pak.ID)
+	c.Assert(importedKey.ACLTags, check.HasLen, 1)
+
+	// The IDs are kept, new objects do not collide with them.
+	other, err := db.CreateUser("other")
+	c.Assert(err, check.IsNil)
+	c.Assert(other.ID > user.ID, check.Equals, true)
+
+	// Forcing the import replaces the existing state, and drops the
+	// state which is not exported.
+	err = db.SavePendingRegistration(
+		key.NewMachine().Public().String(),
+		types.Node{UserID: other.ID},
+		time.Now().Add(time.Hour),
+	)
+	c.Assert(err, check.IsNil)
+	stat := types.PeerTrafficStat{
+		SourceID:      node.ID,
+		DestinationID: node.ID + 1,
+		WindowStart:   time.Now(),
+		BytesTx:       1,
+	}
+	c.Assert(db.DB.Create(&stat).Error, check.IsNil)
+
+	err = db.ImportState(&state, true)
+	c.Assert(err, check.IsNil)
+
+	users, err := db.ListUsers()
+	c.Assert(err, check.IsNil)
+	c.Assert(users, check.HasLen, 1)
+
+	registrations, err := db.ListPendingRegistrations(time.Now())
+	c.Assert(err, check.IsNil)
+	c.Assert(registrations, check.HasLen, 0)
+
+	traffic, err := db.TopPeerTraffic(time.Now().Add(-time.Hour), 10)
+	c.Assert(err, check.IsNil)
+	c.Assert(traffic, check.HasLen, 0)
+
+	state.Version = types.StateVersion + 1
+	err = db.ImportState(&state, true)
+	c.Assert(errors.Is(err, ErrStateVersionMismatched), check.Equals, true)
+}
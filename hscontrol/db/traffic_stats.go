@@ -0,0 +1,140 @@
+package db
+
+import (
+	"database/sql"
+	"net/netip"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+	"tailscale.com/types/netlogtype"
+)
+
+func (hsdb *HSDatabase) RecordPeerTraffic(
+	nodeID types.NodeID,
+	msg *netlogtype.Message,
+) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return RecordPeerTraffic(tx, nodeID, msg)
+	})
+}
+
+// RecordPeerTraffic adds the traffic of the node nodeID with its peers,
+// reported in msg, to the traffic stats of the window the message starts
+// in.
+func RecordPeerTraffic(
+	tx *gorm.DB,
+	nodeID types.NodeID,
+	msg *netlogtype.Message,
+) error {
+	peers, err := nodeIDsByAddr(tx, msg.VirtualTraffic)
+	if err != nil {
+		return err
+	}
+
+	for _, stat := range types.PeerTrafficStatsFromMessage(nodeID, msg, peers) {
+		result := tx.Model(&types.PeerTrafficStat{}).
+			Where(
+				"source_id = ? AND destination_id = ? AND window_start = ?",
+				stat.SourceID,
+				stat.DestinationID,
+				stat.WindowStart,
+			).
+			Updates(map[string]interface{}{
+				"bytes_tx": gorm.Expr("bytes_tx + ?", stat.BytesTx),
+				"bytes_rx": gorm.Expr("bytes_rx + ?", stat.BytesRx),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			if err := tx.Create(&stat).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// nodeIDsByAddr returns the nodes owning the destination addresses of
+// the connections.
+func nodeIDsByAddr(tx *gorm.DB, conns []netlogtype.ConnectionCounts) (map[netip.Addr]types.NodeID, error) {
+	addrs := make([]string, 0, len(conns))
+	for _, conn := range conns {
+		addrs = append(addrs, conn.Dst.Addr().String())
+	}
+
+	peers := make(map[netip.Addr]types.NodeID)
+	if len(addrs) == 0 {
+		return peers, nil
+	}
+
+	var nodes []struct {
+		ID   types.NodeID
+		IPv4 sql.NullString `gorm:"column:ipv4"`
+		IPv6 sql.NullString `gorm:"column:ipv6"`
+	}
+	if err := tx.Model(&types.Node{}).
+		Select("id, ipv4, ipv6").
+		Where("ipv4 IN ? OR ipv6 IN ?", addrs, addrs).
+		Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+
+	for _, node := range nodes {
+		for _, ip := range []sql.NullString{node.IPv4, node.IPv6} {
+			if addr, err := netip.ParseAddr(ip.String); ip.Valid && err == nil {
+				peers[addr] = node.ID
+			}
+		}
+	}
+
+	return peers, nil
+}
+
+func (hsdb *HSDatabase) TopPeerTraffic(since time.Time, top int) ([]types.PeerTraffic, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) ([]types.PeerTraffic, error) {
+		return TopPeerTraffic(rx, since, top)
+	})
+}
+
+// TopPeerTraffic returns the top pairs of nodes exchanging the most
+// bytes, in both directions, in the windows since the one including
+// since. Each node reports its own traffic, the traffic between two
+// nodes is counted in a pair for each.
+func TopPeerTraffic(tx *gorm.DB, since time.Time, top int) ([]types.PeerTraffic, error) {
+	var traffic []types.PeerTraffic
+	if err := tx.Model(&types.PeerTrafficStat{}).
+		Select("source_id, destination_id, SUM(bytes_tx) AS bytes_tx, SUM(bytes_rx) AS bytes_rx").
+		Where("window_start >= ?", since.UTC().Truncate(types.TrafficStatsWindow)).
+		Group("source_id, destination_id").
+		Order("SUM(bytes_tx) + SUM(bytes_rx) DESC, source_id, destination_id").
+		Limit(top).
+		Scan(&traffic).Error; err != nil {
+		return nil, err
+	}
+
+	return traffic, nil
+}
+
+func (hsdb *HSDatabase) PrunePeerTraffic(before time.Time) (int64, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) (int64, error) {
+		return PrunePeerTraffic(tx, before)
+	})
+}
+
+// PrunePeerTraffic deletes the traffic stats of the windows started
+// before before, and returns how many were deleted.
+func PrunePeerTraffic(tx *gorm.DB, before time.Time) (int64, error) {
+	result := tx.Where("window_start < ?", before.UTC()).Delete(&types.PeerTrafficStat{})
+
+	return result.RowsAffected, result.Error
+}
+
+func deletePeerTrafficStats(tx *gorm.DB, nodeID types.NodeID) error {
+	return tx.
+		Where("source_id = ? OR destination_id = ?", nodeID, nodeID).
+		Delete(&types.PeerTrafficStat{}).Error
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+	"tailscale.com/types/netlogtype"
+)
+
+func (s *Suite) TestRecordPeerTraffic(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	createNode := func(hostname string, ip string) *types.Node {
+		ipv4 := netip.MustParseAddr(ip)
+		node := types.Node{
+			Hostname:       hostname,
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+			IPv4:           &ipv4,
+		}
+		c.Assert(db.DB.Save(&node).Error, check.IsNil)
+
+		return &node
+	}
+
+	web := createNode("web", "100.64.0.1")
+	database := createNode("database", "100.64.0.2")
+	cache := createNode("cache", "100.64.0.3")
+
+	report := func(node *types.Node, start time.Time, dst string, tx, rx uint64) {
+		err := db.RecordPeerTraffic(node.ID, &netlogtype.Message{
+			Start: start,
+			VirtualTraffic: []netlogtype.ConnectionCounts{
+				{
+					Connection: netlogtype.Connection{
+						Src: netip.AddrPortFrom(*node.IPv4, 40000),
+						Dst: netip.MustParseAddrPort(dst),
+					},
+					Counts: netlogtype.Counts{TxBytes: tx, RxBytes: rx},
+				},
+			},
+		})
+		c.Assert(err, check.IsNil)
+	}
+
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+
+	// The reports of a window add up.
+	report(web, now, "100.64.0.2:5432", 100, 1000)
+	report(web, now, "100.64.0.2:5432", 50, 500)
+	report(web, now, "100.64.0.3:6379", 10, 10)
+	report(cache, now, "100.64.0.1:443", 1, 1)
+	report(web, old, "100.64.0.3:6379", 1<<30, 1<<30)
+
+	traffic, err := db.TopPeerTraffic(now.Add(-time.Hour), 2)
+	c.Assert(err, check.IsNil)
+	c.Assert(traffic, check.DeepEquals, []types.PeerTraffic{
+		{SourceID: web.ID, DestinationID: database.ID, BytesTx: 150, BytesRx: 1500},
+		{SourceID: web.ID, DestinationID: cache.ID, BytesTx: 10, BytesRx: 10},
+	})
+
+	// The old window counts over a longer period.
+	traffic, err = db.TopPeerTraffic(now.Add(-72*time.Hour), 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(traffic, check.DeepEquals, []types.PeerTraffic{
+		{SourceID: web.ID, DestinationID: cache.ID, BytesTx: 1<<30 + 10, BytesRx: 1<<30 + 10},
+	})
+
+	pruned, err := db.PrunePeerTraffic(now.Add(-24 * time.Hour))
+	c.Assert(err, check.IsNil)
+	c.Assert(pruned, check.Equals, int64(1))
+
+	traffic, err = db.TopPeerTraffic(now.Add(-72*time.Hour), 10)
+	c.Assert(err, check.IsNil)
+	c.Assert(traffic, check.HasLen, 3)
+
+	// Deleting a node deletes its traffic, in both directions.
+	_, err = db.DeleteNode(cache, types.NodeConnectedMap{})
+	c.Assert(err, check.IsNil)
+
+	traffic, err = db.TopPeerTraffic(now.Add(-72*time.Hour), 10)
+	c.Assert(err, check.IsNil)
+	c.Assert(traffic, check.DeepEquals, []types.PeerTraffic{
+		{SourceID: web.ID, DestinationID: database.ID, BytesTx: 150, BytesRx: 1500},
+	})
+}
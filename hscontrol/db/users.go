@@ -3,6 +3,8 @@ package db
 import (
 	"errors"
 	"fmt"
+	"net/netip"
+	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
@@ -10,9 +12,12 @@ import (
 )
 
 var (
-	ErrUserExists        = errors.New("user already exists")
-	ErrUserNotFound      = errors.New("user not found")
-	ErrUserStillHasNodes = errors.New("user not empty: node(s) found")
+	ErrUserExists        = types.NewHeadscaleError(types.CodeUserExists, "user already exists")
+	ErrUserNotFound      = types.NewHeadscaleError(types.CodeUserNotFound, "user not found")
+	ErrUserStillHasNodes = types.NewHeadscaleError(types.CodeUserNotEmpty, "user not empty: node(s) found")
+	ErrUserDisabled      = types.NewHeadscaleError(types.CodeUserDisabled, "user is disabled")
+	ErrUserMergeSelf     = types.NewHeadscaleError(types.CodeInvalidArgument, "cannot merge a user into itself")
+	ErrUserMergeConflict = types.NewHeadscaleError(types.CodeUserMergeConflict, "nodes of both users have the same IP address")
 )
 
 func (hsdb *HSDatabase) CreateUser(name string) (*types.User, error) {
@@ -115,6 +120,108 @@ func RenameUser(tx *gorm.DB, oldName, newName string) error {
 	return nil
 }
 
+func (hsdb *HSDatabase) MergeUsers(
+	source, destination string,
+	force bool,
+) (*types.User, []types.NodeID, error) {
+	var user *types.User
+	var moved []types.NodeID
+
+	err := hsdb.Write(func(tx *gorm.DB) error {
+		var err error
+		user, moved, err = MergeUsers(tx, source, destination, force)
+
+		return err
+	})
+
+	return user, moved, err
+}
+
+// MergeUsers moves the nodes, pre auth keys and node groups of the user
+// source to the user destination and deletes source. It fails if a node
+// of source has the same IP address as a node of destination, or if a
+// node of source is locked and the merge is not forced. The IDs of the
+// nodes moved are returned.
+func MergeUsers(
+	tx *gorm.DB,
+	source, destination string,
+	force bool,
+) (*types.User, []types.NodeID, error) {
+	if source == destination {
+		return nil, nil, ErrUserMergeSelf
+	}
+
+	srcUser, err := GetUser(tx, source)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dstUser, err := GetUser(tx, destination)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	srcNodes, err := ListNodesByUser(tx, source)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dstNodes, err := ListNodesByUser(tx, destination)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dstIPs := make(map[netip.Addr]types.NodeID)
+	for _, node := range dstNodes {
+		for _, ip := range node.IPs() {
+			dstIPs[ip] = node.ID
+		}
+	}
+
+	moved := make([]types.NodeID, 0, len(srcNodes))
+	for _, node := range srcNodes {
+		if err := CheckNodeUnlocked(node, force); err != nil {
+			return nil, nil, err
+		}
+
+		for _, ip := range node.IPs() {
+			if other, ok := dstIPs[ip]; ok {
+				return nil, nil, ErrUserMergeConflict.WithDetails(map[string]interface{}{
+					"ip":                  ip.String(),
+					"node_id":             node.ID,
+					"destination_node_id": other,
+				})
+			}
+		}
+
+		moved = append(moved, node.ID)
+	}
+
+	if err := tx.Model(&types.Node{}).
+		Where("user_id = ?", srcUser.ID).
+		Update("user_id", dstUser.ID).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to move nodes to user: %w", err)
+	}
+
+	if err := tx.Model(&types.PreAuthKey{}).
+		Where("user_id = ?", srcUser.ID).
+		Update("user_id", dstUser.ID).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to move pre auth keys to user: %w", err)
+	}
+
+	if err := tx.Model(&types.NodeGroup{}).
+		Where("user_id = ?", srcUser.ID).
+		Update("user_id", dstUser.ID).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to update user of node groups: %w", err)
+	}
+
+	if err := tx.Unscoped().Delete(srcUser).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to delete merged user: %w", err)
+	}
+
+	return dstUser, moved, nil
+}
+
 func (hsdb *HSDatabase) GetUser(name string) (*types.User, error) {
 	return Read(hsdb.DB, func(rx *gorm.DB) (*types.User, error) {
 		return GetUser(rx, name)
@@ -149,6 +256,62 @@ func ListUsers(tx *gorm.DB) ([]types.User, error) {
 	return users, nil
 }
 
+// UserCounts holds the number of nodes and active pre auth keys
+// of a user.
+type UserCounts struct {
+	Nodes             int64
+	ActivePreAuthKeys int64
+}
+
+func (hsdb *HSDatabase) CountByUser() (map[uint]UserCounts, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (map[uint]UserCounts, error) {
+		return CountByUser(rx)
+	})
+}
+
+// CountByUser returns the number of nodes and of active (not expired
+// and still usable) pre auth keys of every user, indexed by user ID.
+// Users without nodes or keys are not in the map.
+func CountByUser(tx *gorm.DB) (map[uint]UserCounts, error) {
+	type userCount struct {
+		UserID uint
+		Count  int64
+	}
+
+	var nodeCounts []userCount
+	err := tx.Model(&types.Node{}).
+		Select("user_id, count(*) as count").
+		Group("user_id").
+		Scan(&nodeCounts).Error
+	if err != nil {
+		return nil, fmt.Errorf("counting nodes by user: %w", err)
+	}
+
+	var keyCounts []userCount
+	err = tx.Model(&types.PreAuthKey{}).
+		Select("user_id, count(*) as count").
+		Where("(expiration IS NULL OR expiration > ?) AND (reusable = ? OR used = ?)", time.Now(), true, false).
+		Group("user_id").
+		Scan(&keyCounts).Error
+	if err != nil {
+		return nil, fmt.Errorf("counting pre auth keys by user: %w", err)
+	}
+
+	counts := make(map[uint]UserCounts)
+	for _, c := range nodeCounts {
+		uc := counts[c.UserID]
+		uc.Nodes = c.Count
+		counts[c.UserID] = uc
+	}
+	for _, c := range keyCounts {
+		uc := counts[c.UserID]
+		uc.ActivePreAuthKeys = c.Count
+		counts[c.UserID] = uc
+	}
+
+	return counts, nil
+}
+
 // ListNodesByUser gets all the nodes in a given user.
 func ListNodesByUser(tx *gorm.DB, name string) (types.Nodes, error) {
 	err := util.CheckForFQDNRules(name)
@@ -161,13 +324,212 @@ func ListNodesByUser(tx *gorm.DB, name string) (types.Nodes, error) {
 	}
 
 	nodes := types.Nodes{}
-	if err := tx.Preload("AuthKey").Preload("AuthKey.User").Preload("User").Where(&types.Node{UserID: user.ID}).Find(&nodes).Error; err != nil {
+	if err := tx.Preload("AuthKey").Preload("AuthKey.User").Preload("AuthKey.ACLTags").Preload("User").Where(&types.Node{UserID: user.ID}).Find(&nodes).Error; err != nil {
 		return nil, err
 	}
 
 	return nodes, nil
 }
 
+func (hsdb *HSDatabase) SetUserDefaultTags(
+	name string,
+	tags []string,
+	applyExisting bool,
+) (*types.User, []types.NodeID, error) {
+	var user *types.User
+	var changed []types.NodeID
+
+	err := hsdb.Write(func(tx *gorm.DB) error {
+		var err error
+		user, changed, err = SetUserDefaultTags(tx, name, tags, applyExisting)
+
+		return err
+	})
+
+	return user, changed, err
+}
+
+// SetUserDefaultTags sets the tags applied to every node registering in
+// the user. If applyExisting is set, the tags are also merged into the
+// forced tags of the nodes already in the user, and the IDs of the nodes
+// that changed are returned.
+func SetUserDefaultTags(
+	tx *gorm.DB,
+	name string,
+	tags []string,
+	applyExisting bool,
+) (*types.User, []types.NodeID, error) {
+	user, err := GetUser(tx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user.DefaultTags = mergeTags(nil, tags)
+
+	if err := tx.Model(user).Update("default_tags", user.DefaultTags).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to update default tags for user in the database: %w", err)
+	}
+
+	if !applyExisting {
+		return user, nil, nil
+	}
+
+	nodes, err := ListNodesByUser(tx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var changed []types.NodeID
+	for _, node := range nodes {
+		newTags := mergeTags(node.ForcedTags, user.DefaultTags)
+		if len(newTags) == len(node.ForcedTags) {
+			continue
+		}
+
+		if err := SetTags(tx, node.ID, newTags); err != nil {
+			return nil, nil, err
+		}
+
+		changed = append(changed, node.ID)
+	}
+
+	return user, changed, nil
+}
+
+func (hsdb *HSDatabase) DisableUser(name string, now time.Time) (*types.User, []types.NodeID, error) {
+	var user *types.User
+	var expired []types.NodeID
+
+	err := hsdb.Write(func(tx *gorm.DB) error {
+		var err error
+		user, expired, err = DisableUser(tx, name, now)
+
+		return err
+	})
+
+	return user, expired, err
+}
+
+// DisableUser prevents a user from registering nodes and creating pre
+// auth keys, and expires all of its nodes that have not expired yet.
+// The IDs of the nodes expired are returned. Nodes and keys are kept.
+func DisableUser(tx *gorm.DB, name string, now time.Time) (*types.User, []types.NodeID, error) {
+	user, err := GetUser(tx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user.Disabled = true
+	if err := tx.Model(user).Update("disabled", true).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to disable user in the database: %w", err)
+	}
+
+	nodes, err := ListNodesByUser(tx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var expired []types.NodeID
+	for _, node := range nodes {
+		if node.Expiry != nil && !node.Expiry.IsZero() && !node.Expiry.After(now) {
+			continue
+		}
+
+		if err := NodeSetExpiry(tx, node.ID, now); err != nil {
+			return nil, nil, fmt.Errorf("failed to expire node of disabled user: %w", err)
+		}
+
+		expired = append(expired, node.ID)
+	}
+
+	return user, expired, nil
+}
+
+func (hsdb *HSDatabase) EnableUser(name string) (*types.User, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) (*types.User, error) {
+		return EnableUser(tx, name)
+	})
+}
+
+// EnableUser allows a disabled user to register nodes again. The nodes
+// expired when the user was disabled stay expired.
+func EnableUser(tx *gorm.DB, name string) (*types.User, error) {
+	user, err := GetUser(tx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Disabled = false
+	if err := tx.Model(user).Update("disabled", false).Error; err != nil {
+		return nil, fmt.Errorf("failed to enable user in the database: %w", err)
+	}
+
+	return user, nil
+}
+
+func (hsdb *HSDatabase) SetUserDERPOnly(name string, derpOnly bool) (*types.User, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) (*types.User, error) {
+		return SetUserDERPOnly(tx, name, derpOnly)
+	})
+}
+
+// SetUserDERPOnly sets whether the endpoints of the nodes of a user are
+// hidden from their peers, and the endpoints of the peers from them.
+func SetUserDERPOnly(tx *gorm.DB, name string, derpOnly bool) (*types.User, error) {
+	user, err := GetUser(tx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	user.DERPOnly = derpOnly
+	if err := tx.Model(user).Update("derp_only", derpOnly).Error; err != nil {
+		return nil, fmt.Errorf("failed to set DERP-only on user in the database: %w", err)
+	}
+
+	return user, nil
+}
+
+// SetUserDisplayName sets the human-readable name of a user.
+func SetUserDisplayName(tx *gorm.DB, name string, displayName string) error {
+	user, err := GetUser(tx, name)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Model(user).Update("display_name", displayName).Error; err != nil {
+		return fmt.Errorf("failed to set display name of user in the database: %w", err)
+	}
+
+	return nil
+}
+
+// SetUserAvatarURL sets the URL of the picture of a user.
+func SetUserAvatarURL(tx *gorm.DB, name string, avatarURL string) error {
+	user, err := GetUser(tx, name)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Model(user).Update("avatar_url", avatarURL).Error; err != nil {
+		return fmt.Errorf("failed to set avatar URL of user in the database: %w", err)
+	}
+
+	return nil
+}
+
+// mergeTags returns the tags in existing followed by the ones in extra
+// that are not already present.
+func mergeTags(existing []string, extra []string) types.StringList {
+	tags := types.StringList{}
+	for _, tag := range append(append([]string{}, existing...), extra...) {
+		if !util.StringOrPrefixListContains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
 func (hsdb *HSDatabase) AssignNodeToUser(node *types.Node, username string) error {
 	return hsdb.Write(func(tx *gorm.DB) error {
 		return AssignNodeToUser(tx, node, username)
@@ -189,5 +551,11 @@ func AssignNodeToUser(tx *gorm.DB, node *types.Node, username string) error {
 		return result.Error
 	}
 
+	if err := tx.Model(&types.NodeGroup{}).
+		Where("node_id = ?", node.ID).
+		Update("user_id", user.ID).Error; err != nil {
+		return fmt.Errorf("failed to update user of node groups: %w", err)
+	}
+
 	return nil
 }
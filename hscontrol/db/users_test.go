@@ -1,6 +1,10 @@
 package db
 
 import (
+	"errors"
+	"net/netip"
+	"time"
+
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
 	"gopkg.in/check.v1"
@@ -36,7 +40,7 @@ func (s *Suite) TestDestroyUserErrors(c *check.C) {
 	err = db.DestroyUser("test")
 	c.Assert(err, check.IsNil)
 
-	result := db.DB.Preload("User").First(&pak, "key = ?", pak.Key)
+	result := db.DB.Preload("User").First(&pak, "id = ?", pak.ID)
 	// destroying a user also deletes all associated preauthkeys
 	c.Assert(result.Error, check.Equals, gorm.ErrRecordNotFound)
 
@@ -121,3 +125,274 @@ func (s *Suite) TestSetMachineUser(c *check.C) {
 	c.Assert(node.UserID, check.Equals, newUser.ID)
 	c.Assert(node.User.Name, check.Equals, newUser.Name)
 }
+
+func (s *Suite) TestSetUserDefaultTags(c *check.C) {
+	_, _, err := db.SetUserDefaultTags("test", []string{"tag:ci"}, false)
+	c.Assert(err, check.Equals, ErrUserNotFound)
+
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	existing := types.Node{
+		ID:             0,
+		Hostname:       "existing",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodCLI,
+		ForcedTags:     types.StringList{"tag:web"},
+	}
+	db.DB.Save(&existing)
+
+	user, changed, err := db.SetUserDefaultTags(
+		"test",
+		[]string{"tag:ci", "tag:ci"},
+		false,
+	)
+	c.Assert(err, check.IsNil)
+	c.Assert(changed, check.HasLen, 0)
+	c.Assert(user.DefaultTags, check.DeepEquals, types.StringList{"tag:ci"})
+
+	user, err = db.GetUser("test")
+	c.Assert(err, check.IsNil)
+	c.Assert(user.DefaultTags, check.DeepEquals, types.StringList{"tag:ci"})
+
+	node, err := db.GetNodeByID(existing.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(node.ForcedTags, check.DeepEquals, types.StringList{"tag:web"})
+
+	registered, err := db.RegisterNode(types.Node{
+		Hostname:       "registered",
+		UserID:         user.ID,
+		User:           *user,
+		RegisterMethod: util.RegisterMethodAuthKey,
+		ForcedTags:     types.StringList{"tag:key", "tag:ci"},
+	}, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(
+		registered.ForcedTags,
+		check.DeepEquals,
+		types.StringList{"tag:key", "tag:ci"},
+	)
+
+	_, changed, err = db.SetUserDefaultTags("test", []string{"tag:ci"}, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(changed, check.DeepEquals, []types.NodeID{existing.ID})
+
+	node, err = db.GetNodeByID(existing.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(node.ForcedTags, check.DeepEquals, types.StringList{"tag:web", "tag:ci"})
+}
+
+func (s *Suite) TestDisableUser(c *check.C) {
+	_, _, err := db.DisableUser("test", time.Now())
+	c.Assert(err, check.Equals, ErrUserNotFound)
+
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	pak, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	active := types.Node{
+		Hostname:       "active",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+		Expiry:         &future,
+	}
+	c.Assert(db.DB.Save(&active).Error, check.IsNil)
+
+	expired := types.Node{
+		Hostname:       "expired",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+		Expiry:         &past,
+	}
+	c.Assert(db.DB.Save(&expired).Error, check.IsNil)
+
+	user, changed, err := db.DisableUser("test", now)
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Disabled, check.Equals, true)
+	c.Assert(changed, check.DeepEquals, []types.NodeID{active.ID})
+
+	node, err := db.GetNodeByID(active.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(node.IsExpired(), check.Equals, true)
+
+	// Nodes and keys are kept, but keys can no longer be used or created.
+	nodes, err := ListNodesByUser(db.DB, "test")
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 2)
+
+	_, err = db.ValidatePreAuthKey(pak.Key)
+	c.Assert(err, check.Equals, ErrUserDisabled)
+
+	_, err = db.CreatePreAuthKey(user.Name, true, false, nil, nil)
+	c.Assert(err, check.Equals, ErrUserDisabled)
+
+	user, err = db.EnableUser("test")
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Disabled, check.Equals, false)
+
+	// Enabling the user does not revive its nodes.
+	node, err = db.GetNodeByID(active.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(node.IsExpired(), check.Equals, true)
+
+	_, err = db.ValidatePreAuthKey(pak.Key)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *Suite) TestSetUserDERPOnly(c *check.C) {
+	_, err := db.SetUserDERPOnly("test", true)
+	c.Assert(err, check.Equals, ErrUserNotFound)
+
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+	c.Assert(user.DERPOnly, check.Equals, false)
+
+	user, err = db.SetUserDERPOnly("test", true)
+	c.Assert(err, check.IsNil)
+	c.Assert(user.DERPOnly, check.Equals, true)
+
+	node := types.Node{
+		Hostname:       "node",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+	}
+	c.Assert(db.DB.Save(&node).Error, check.IsNil)
+
+	// The setting is loaded with the nodes, for the map responses.
+	got, err := db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(got.User.DERPOnly, check.Equals, true)
+
+	user, err = db.SetUserDERPOnly("test", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(user.DERPOnly, check.Equals, false)
+}
+
+func (s *Suite) TestMergeUsers(c *check.C) {
+	_, _, err := db.MergeUsers("src", "dst", false)
+	c.Assert(err, check.Equals, ErrUserNotFound)
+
+	src, err := db.CreateUser("src")
+	c.Assert(err, check.IsNil)
+
+	dst, err := db.CreateUser("dst")
+	c.Assert(err, check.IsNil)
+
+	_, _, err = db.MergeUsers("src", "src", false)
+	c.Assert(err, check.Equals, ErrUserMergeSelf)
+
+	pak, err := db.CreatePreAuthKey(src.Name, true, false, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	srcIP := netip.MustParseAddr("100.64.0.1")
+	srcNode := types.Node{
+		Hostname:       "src-node",
+		UserID:         src.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+		IPv4:           &srcIP,
+		Locked:         true,
+	}
+	c.Assert(db.DB.Save(&srcNode).Error, check.IsNil)
+
+	dstIP := netip.MustParseAddr("100.64.0.2")
+	dstNode := types.Node{
+		Hostname:       "dst-node",
+		UserID:         dst.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+		IPv4:           &dstIP,
+	}
+	c.Assert(db.DB.Save(&dstNode).Error, check.IsNil)
+
+	// Locked nodes are only moved when forced.
+	_, _, err = db.MergeUsers("src", "dst", false)
+	c.Assert(errors.Is(err, ErrNodeLocked), check.Equals, true)
+
+	user, moved, err := db.MergeUsers("src", "dst", true)
+	c.Assert(err, check.IsNil)
+	c.Assert(user.Name, check.Equals, "dst")
+	c.Assert(moved, check.DeepEquals, []types.NodeID{srcNode.ID})
+
+	_, err = db.GetUser("src")
+	c.Assert(err, check.Equals, ErrUserNotFound)
+
+	nodes, err := ListNodesByUser(db.DB, "dst")
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 2)
+
+	keys, err := db.ListPreAuthKeys("dst")
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+	c.Assert(keys[0].ID, check.Equals, pak.ID)
+}
+
+func (s *Suite) TestMergeUsersIPConflict(c *check.C) {
+	src, err := db.CreateUser("src")
+	c.Assert(err, check.IsNil)
+
+	dst, err := db.CreateUser("dst")
+	c.Assert(err, check.IsNil)
+
+	ip := netip.MustParseAddr("100.64.0.1")
+	for _, user := range []*types.User{src, dst} {
+		node := types.Node{
+			Hostname:       user.Name + "-node",
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+			IPv4:           &ip,
+		}
+		c.Assert(db.DB.Save(&node).Error, check.IsNil)
+	}
+
+	_, _, err = db.MergeUsers("src", "dst", false)
+	c.Assert(errors.Is(err, ErrUserMergeConflict), check.Equals, true)
+
+	// Nothing is moved.
+	nodes, err := ListNodesByUser(db.DB, "src")
+	c.Assert(err, check.IsNil)
+	c.Assert(nodes, check.HasLen, 1)
+}
+
+func (s *Suite) TestCountByUser(c *check.C) {
+	user, err := db.CreateUser("test")
+	c.Assert(err, check.IsNil)
+
+	empty, err := db.CreateUser("empty")
+	c.Assert(err, check.IsNil)
+
+	for _, hostname := range []string{"node1", "node2"} {
+		node := types.Node{
+			Hostname:       hostname,
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodAuthKey,
+		}
+		c.Assert(db.DB.Save(&node).Error, check.IsNil)
+	}
+
+	// Active: unused single use key and used reusable key.
+	_, err = db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	reusable, err := db.CreatePreAuthKey(user.Name, true, false, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(db.DB.Model(reusable).Update("used", true).Error, check.IsNil)
+
+	// Not active: used single use key and expired key.
+	used, err := db.CreatePreAuthKey(user.Name, false, false, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(db.DB.Model(used).Update("used", true).Error, check.IsNil)
+
+	expired := time.Now().Add(-time.Hour)
+	_, err = db.CreatePreAuthKey(user.Name, true, false, &expired, nil)
+	c.Assert(err, check.IsNil)
+
+	counts, err := db.CountByUser()
+	c.Assert(err, check.IsNil)
+	c.Assert(counts[user.ID], check.Equals, UserCounts{Nodes: 2, ActivePreAuthKeys: 2})
+	c.Assert(counts[empty.ID], check.Equals, UserCounts{})
+}
@@ -3,15 +3,34 @@ package derp
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"sync"
 
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
 	"tailscale.com/tailcfg"
+	"tailscale.com/util/dnsname"
+)
+
+// defaultDERPPort is the port of the DERP servers without DERPPort.
+const defaultDERPPort = 443
+
+var (
+	ErrEmptyDERPMap        = errors.New("DERP map does not contain any regions")
+	ErrInvalidDERPRegion   = errors.New("invalid DERP region")
+	ErrInvalidDERPNode     = errors.New("invalid DERP node")
+	ErrDERPNodeUnreachable = errors.New("DERP node unreachable")
+	validDERPRegionCodeRex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
 )
 
 func loadDERPMapFromPath(path string) (*tailcfg.DERPMap, error) {
@@ -132,3 +151,162 @@ func GetDERPMap(cfg types.DERPConfig) *tailcfg.DERPMap {
 
 	return derpMap
 }
+
+// LoadDERPMap loads and merges the DERP maps of the configured paths and
+// URLs like GetDERPMap, but returns an error if one of them cannot be
+// loaded instead of leaving it out, so a broken file is not served.
+func LoadDERPMap(cfg types.DERPConfig) (*tailcfg.DERPMap, error) {
+	derpMaps := make([]*tailcfg.DERPMap, 0, len(cfg.Paths)+len(cfg.URLs))
+
+	for _, path := range cfg.Paths {
+		derpMap, err := loadDERPMapFromPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading DERP map from %s: %w", path, err)
+		}
+
+		derpMaps = append(derpMaps, derpMap)
+	}
+
+	for _, addr := range cfg.URLs {
+		derpMap, err := loadDERPMapFromURL(addr)
+		if err != nil {
+			return nil, fmt.Errorf("loading DERP map from %s: %w", addr.String(), err)
+		}
+
+		derpMaps = append(derpMaps, derpMap)
+	}
+
+	return mergeDERPMaps(derpMaps), nil
+}
+
+// CheckDERPMapReachable opens a TCP connection to every DERP server of
+// the DERPMap, STUN only servers excepted, and returns an error listing
+// the ones which cannot be reached.
+func CheckDERPMapReachable(ctx context.Context, derpMap *tailcfg.DERPMap) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+
+	for _, region := range derpMap.Regions {
+		for _, node := range region.Nodes {
+			if node.STUNOnly {
+				continue
+			}
+
+			wg.Add(1)
+			go func(node *tailcfg.DERPNode) {
+				defer wg.Done()
+
+				addr := derpNodeAddr(node)
+
+				var dialer net.Dialer
+				conn, err := dialer.DialContext(ctx, "tcp", addr)
+				if err != nil {
+					mu.Lock()
+					defer mu.Unlock()
+					errs = append(errs, fmt.Errorf(
+						"%w: node %s of region %d at %s: %w",
+						ErrDERPNodeUnreachable,
+						node.Name,
+						node.RegionID,
+						addr,
+						err,
+					))
+
+					return
+				}
+				conn.Close()
+			}(node)
+		}
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// derpNodeAddr returns the address clients connect to for the DERP
+// server node, its IPv4 address if it has one set, otherwise its
+// hostname.
+func derpNodeAddr(node *tailcfg.DERPNode) string {
+	host := node.HostName
+	if ip, err := netip.ParseAddr(node.IPv4); err == nil {
+		host = ip.String()
+	}
+
+	port := node.DERPPort
+	if port == 0 {
+		port = defaultDERPPort
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// ValidateDERPMap checks that a DERPMap provided by an administrator
+// can be served to clients: every region must have an ID matching its
+// key and a valid RegionCode, and every node must belong to its region
+// and have a valid hostname.
+func ValidateDERPMap(derpMap *tailcfg.DERPMap) error {
+	if derpMap == nil || len(derpMap.Regions) == 0 {
+		return ErrEmptyDERPMap
+	}
+
+	for id, region := range derpMap.Regions {
+		if region == nil {
+			return fmt.Errorf("%w: region %d is empty", ErrInvalidDERPRegion, id)
+		}
+
+		if region.RegionID != id {
+			return fmt.Errorf(
+				"%w: region %d has RegionID %d",
+				ErrInvalidDERPRegion,
+				id,
+				region.RegionID,
+			)
+		}
+
+		if !validDERPRegionCodeRex.MatchString(region.RegionCode) {
+			return fmt.Errorf(
+				"%w: region %d has invalid RegionCode %q",
+				ErrInvalidDERPRegion,
+				id,
+				region.RegionCode,
+			)
+		}
+
+		if len(region.Nodes) == 0 {
+			return fmt.Errorf("%w: region %d has no nodes", ErrInvalidDERPRegion, id)
+		}
+
+		for _, node := range region.Nodes {
+			if node == nil || node.Name == "" {
+				return fmt.Errorf("%w: region %d has a node without name", ErrInvalidDERPNode, id)
+			}
+
+			if node.RegionID != id {
+				return fmt.Errorf(
+					"%w: node %s has RegionID %d, expected %d",
+					ErrInvalidDERPNode,
+					node.Name,
+					node.RegionID,
+					id,
+				)
+			}
+
+			if _, err := netip.ParseAddr(node.HostName); err == nil {
+				continue
+			}
+
+			if err := dnsname.ValidHostname(node.HostName); err != nil {
+				return fmt.Errorf(
+					"%w: node %s has invalid hostname %q: %w",
+					ErrInvalidDERPNode,
+					node.Name,
+					node.HostName,
+					err,
+				)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package derp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestCheckDERPMapReachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	defer listener.Close()
+	openPort := listener.Addr().(*net.TCPAddr).Port
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	derpMap := func(port int) *tailcfg.DERPMap {
+		return &tailcfg.DERPMap{
+			Regions: map[int]*tailcfg.DERPRegion{
+				900: {
+					RegionID:   900,
+					RegionCode: "test",
+					Nodes: []*tailcfg.DERPNode{
+						{Name: "900a", RegionID: 900, HostName: "derp.example.com", IPv4: "127.0.0.1", DERPPort: port},
+						{Name: "900b", RegionID: 900, HostName: "stun.example.com", STUNOnly: true},
+					},
+				},
+			},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := CheckDERPMapReachable(ctx, derpMap(openPort)); err != nil {
+		t.Errorf("CheckDERPMapReachable() error = %s, want nil", err)
+	}
+
+	err = CheckDERPMapReachable(ctx, derpMap(closedPort))
+	if !errors.Is(err, ErrDERPNodeUnreachable) {
+		t.Errorf("CheckDERPMapReachable() error = %v, want %s", err, ErrDERPNodeUnreachable)
+	}
+}
+
+func TestDERPMapWatcher(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "derp.yaml")
+	if err := os.WriteFile(path, []byte("regions: {}\n"), 0o600); err != nil {
+		t.Fatalf("writing DERP map: %s", err)
+	}
+
+	reloaded := make(chan struct{}, 10)
+	watcher, err := NewDERPMapWatcher([]string{path}, func() {
+		reloaded <- struct{}{}
+	})
+	if err != nil {
+		t.Fatalf("NewDERPMapWatcher() error = %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watcher.Run(ctx)
+
+	// Other files of the directory are ignored.
+	if err := os.WriteFile(filepath.Join(dir, "other.yaml"), []byte("{}\n"), 0o600); err != nil {
+		t.Fatalf("writing other file: %s", err)
+	}
+
+	select {
+	case <-reloaded:
+		t.Fatal("reload called for a file which is not a DERP map")
+	case <-time.After(2 * derpMapWatcherDelay):
+	}
+
+	// The file is replaced like an editor would, with a rename.
+	tmp := filepath.Join(dir, ".derp.yaml."+strconv.Itoa(os.Getpid()))
+	if err := os.WriteFile(tmp, []byte("regions: {}\n# changed\n"), 0o600); err != nil {
+		t.Fatalf("writing DERP map: %s", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("replacing DERP map: %s", err)
+	}
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload not called after the DERP map changed")
+	}
+}
@@ -0,0 +1,108 @@
+package derp
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// derpMapWatcherDelay is how long the watcher waits for the writes to a
+// DERP map file to settle before reloading it, editors often write a
+// file in several steps.
+const derpMapWatcherDelay = 500 * time.Millisecond
+
+// DERPMapWatcher calls a function when one of the DERP map files
+// changes. The directories of the files are watched rather than the
+// files, which are often replaced by a rename when they are edited.
+type DERPMapWatcher struct {
+	watcher *fsnotify.Watcher
+	files   map[string]bool
+	reload  func()
+}
+
+// NewDERPMapWatcher returns a watcher calling reload when one of the
+// files of paths is written, created or replaced.
+func NewDERPMapWatcher(paths []string, reload func()) (*DERPMapWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating DERP map watcher: %w", err)
+	}
+
+	files := make(map[string]bool, len(paths))
+	dirs := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			watcher.Close()
+
+			return nil, fmt.Errorf("watching DERP map %s: %w", path, err)
+		}
+		files[abs] = true
+
+		dir := filepath.Dir(abs)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+
+			return nil, fmt.Errorf("watching DERP map %s: %w", path, err)
+		}
+	}
+
+	return &DERPMapWatcher{
+		watcher: watcher,
+		files:   files,
+		reload:  reload,
+	}, nil
+}
+
+// Run calls reload after the DERP map files change, until ctx is done.
+func (w *DERPMapWatcher) Run(ctx context.Context) {
+	defer w.watcher.Close()
+
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if !w.files[filepath.Clean(event.Name)] {
+				continue
+			}
+
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+
+			log.Debug().
+				Str("path", event.Name).
+				Str("op", event.Op.String()).
+				Msg("DERP map file changed")
+
+			pending = time.After(derpMapWatcherDelay)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			log.Error().Err(err).Msg("Error watching the DERP map files")
+
+		case <-pending:
+			pending = nil
+			w.reload()
+		}
+	}
+}
@@ -3,25 +3,37 @@ package hscontrol
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/netip"
+	"os"
+	"slices"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/prometheus/common/model"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"gorm.io/gorm"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
 	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/derp"
+	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
 )
 
+// defaultPreAuthKeyExpiration is the lifetime of the pre auth keys created
+// without an expiration.
+const defaultPreAuthKeyExpiration = time.Hour
+
 type headscaleV1APIServer struct { // v1.HeadscaleServiceServer
 	v1.UnimplementedHeadscaleServiceServer
 	h *Headscale
@@ -86,6 +98,40 @@ func (api headscaleV1APIServer) DeleteUser(
 	return &v1.DeleteUserResponse{}, nil
 }
 
+// MergeUsers moves the nodes and pre auth keys of a user to another one,
+// deletes it and replaces it by the other one in the ACL policy. The
+// merge is refused if the policy would be invalid.
+func (api headscaleV1APIServer) MergeUsers(
+	ctx context.Context,
+	request *v1.MergeUsersRequest,
+) (*v1.MergeUsersResponse, error) {
+	user, moved, err := api.h.mergeUsers(
+		ctx,
+		request.GetSource(),
+		request.GetDestination(),
+		request.GetForce(),
+	)
+	if errors.Is(err, errInvalidACLPolicy) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The user of the nodes is part of their map and of the packet
+	// filters of their peers.
+	if len(moved) > 0 {
+		ctx = types.NotifyCtx(ctx, "cli-mergeusers", request.GetSource())
+		api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: moved,
+			Message:     "called from api.MergeUsers",
+		})
+	}
+
+	return &v1.MergeUsersResponse{User: user.Proto()}, nil
+}
+
 func (api headscaleV1APIServer) ListUsers(
 	ctx context.Context,
 	request *v1.ListUsersRequest,
@@ -95,9 +141,16 @@ func (api headscaleV1APIServer) ListUsers(
 		return nil, err
 	}
 
+	counts, err := api.h.db.CountByUser()
+	if err != nil {
+		return nil, err
+	}
+
 	response := make([]*v1.User, len(users))
 	for index, user := range users {
 		response[index] = user.Proto()
+		response[index].NodeCount = uint64(counts[user.ID].Nodes)
+		response[index].ActivePreAuthKeyCount = uint64(counts[user.ID].ActivePreAuthKeys)
 	}
 
 	sort.Slice(response, func(i, j int) bool {
@@ -109,13 +162,150 @@ func (api headscaleV1APIServer) ListUsers(
 	return &v1.ListUsersResponse{Users: response}, nil
 }
 
+func (api headscaleV1APIServer) SetUserTags(
+	ctx context.Context,
+	request *v1.SetUserTagsRequest,
+) (*v1.SetUserTagsResponse, error) {
+	for _, tag := range request.GetTags() {
+		err := validateTag(tag)
+		if err != nil {
+			return nil, grpcError(codes.InvalidArgument, err)
+		}
+
+		if api.h.ACLPolicy != nil {
+			err = api.h.ACLPolicy.ValidateTagOwner(tag, request.GetName())
+			if err != nil {
+				return nil, grpcError(codes.InvalidArgument, err)
+			}
+		}
+	}
+
+	user, changedNodes, err := api.h.db.SetUserDefaultTags(
+		request.GetName(),
+		request.GetTags(),
+		request.GetApplyExisting(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changedNodes) > 0 {
+		ctx = types.NotifyCtx(ctx, "cli-setusertags", user.Name)
+		api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+			Type:        types.StatePeerChanged,
+			ChangeNodes: changedNodes,
+			Message:     "called from api.SetUserTags",
+		})
+	}
+
+	log.Trace().
+		Str("user", user.Name).
+		Strs("tags", request.GetTags()).
+		Bool("apply_existing", request.GetApplyExisting()).
+		Msg("Changing default tags of user")
+
+	return &v1.SetUserTagsResponse{User: user.Proto()}, nil
+}
+
+func (api headscaleV1APIServer) DisableUser(
+	ctx context.Context,
+	request *v1.DisableUserRequest,
+) (*v1.DisableUserResponse, error) {
+	now := time.Now()
+
+	user, expiredNodes, err := api.h.db.DisableUser(request.GetName(), now)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, nodeID := range expiredNodes {
+		ctx := types.NotifyCtx(ctx, "cli-disableuser-self", user.Name)
+		api.h.nodeNotifier.NotifyByMachineKey(
+			ctx,
+			types.StateUpdate{
+				Type:        types.StateSelfUpdate,
+				ChangeNodes: []types.NodeID{nodeID},
+			},
+			nodeID)
+
+		ctx = types.NotifyCtx(ctx, "cli-disableuser-peers", user.Name)
+		api.h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdateExpired(nodeID), nodeID)
+	}
+
+	log.Trace().
+		Str("user", user.Name).
+		Int("expired_nodes", len(expiredNodes)).
+		Msg("Disabled user")
+
+	return &v1.DisableUserResponse{User: user.Proto()}, nil
+}
+
+// SetUserDERPOnly hides the endpoints of the nodes of a user, or shows
+// them again, and sends all nodes a full update as the endpoints of
+// their peers change.
+func (api headscaleV1APIServer) SetUserDERPOnly(
+	ctx context.Context,
+	request *v1.SetUserDERPOnlyRequest,
+) (*v1.SetUserDERPOnlyResponse, error) {
+	user, err := api.h.db.SetUserDERPOnly(request.GetName(), request.GetDerpOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = types.NotifyCtx(ctx, "cli-setuserderponly", user.Name)
+	api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type: types.StateFullUpdate,
+	})
+
+	log.Trace().
+		Str("user", user.Name).
+		Bool("derp_only", user.DERPOnly).
+		Msg("Changed DERP-only setting of user")
+
+	return &v1.SetUserDERPOnlyResponse{User: user.Proto()}, nil
+}
+
+func (api headscaleV1APIServer) EnableUser(
+	ctx context.Context,
+	request *v1.EnableUserRequest,
+) (*v1.EnableUserResponse, error) {
+	user, err := api.h.db.EnableUser(request.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	log.Trace().
+		Str("user", user.Name).
+		Msg("Enabled user")
+
+	return &v1.EnableUserResponse{User: user.Proto()}, nil
+}
+
 func (api headscaleV1APIServer) CreatePreAuthKey(
 	ctx context.Context,
 	request *v1.CreatePreAuthKeyRequest,
 ) (*v1.CreatePreAuthKeyResponse, error) {
-	var expiration time.Time
-	if request.GetExpiration() != nil {
-		expiration = request.GetExpiration().AsTime()
+	// Keys created without an expiration expire after
+	// defaultPreAuthKeyExpiration, only the keys explicitly asked to
+	// never expire do not.
+	var expiration *time.Time
+	switch {
+	case request.GetNeverExpires():
+		if request.GetExpiration() != nil {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				"expiration cannot be set for a key that never expires",
+			)
+		}
+	case request.GetExpiration() != nil:
+		requested := request.GetExpiration().AsTime()
+		if !requested.After(time.Now()) {
+			return nil, status.Error(codes.InvalidArgument, "expiration is in the past")
+		}
+		expiration = &requested
+	default:
+		defaultExpiration := time.Now().Add(defaultPreAuthKeyExpiration)
+		expiration = &defaultExpiration
 	}
 
 	for _, tag := range request.AclTags {
@@ -123,17 +313,72 @@ func (api headscaleV1APIServer) CreatePreAuthKey(
 		if err != nil {
 			return &v1.CreatePreAuthKeyResponse{
 				PreAuthKey: nil,
-			}, status.Error(codes.InvalidArgument, err.Error())
+			}, grpcError(codes.InvalidArgument, err)
+		}
+
+		// Nodes registered with the key get its tags, so the
+		// user must be allowed to own them.
+		if api.h.ACLPolicy != nil {
+			err = api.h.ACLPolicy.ValidateTagOwner(tag, request.GetUser())
+			if err != nil {
+				return nil, grpcError(codes.InvalidArgument, err)
+			}
 		}
 	}
 
-	preAuthKey, err := api.h.db.CreatePreAuthKey(
-		request.GetUser(),
-		request.GetReusable(),
-		request.GetEphemeral(),
-		&expiration,
-		request.AclTags,
-	)
+	var requestedIP *netip.Addr
+	if request.GetIp() != "" {
+		if request.GetReusable() {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				"an IP can only be requested for single use pre auth keys",
+			)
+		}
+
+		ip, err := netip.ParseAddr(request.GetIp())
+		if err != nil {
+			return nil, grpcError(codes.InvalidArgument, err)
+		}
+		requestedIP = &ip
+	}
+
+	// The requested IP is reserved in the transaction creating the key,
+	// and released if the key is not created.
+	reserved := false
+	preAuthKey, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.PreAuthKey, error) {
+		preAuthKey, err := db.CreatePreAuthKey(
+			tx,
+			request.GetUser(),
+			request.GetReusable(),
+			request.GetEphemeral(),
+			expiration,
+			request.AclTags,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if requestedIP != nil {
+			if err := api.h.ipAlloc.Reserve(*requestedIP); err != nil {
+				return nil, grpcError(codes.InvalidArgument, err)
+			}
+			reserved = true
+
+			err = db.SetPreAuthKeyRequestedIP(tx, preAuthKey, *requestedIP)
+			if err != nil {
+				return nil, err
+			}
+			preAuthKey.RequestedIP = requestedIP.String()
+		}
+
+		return preAuthKey, nil
+	})
+	if err != nil && reserved {
+		api.h.ipAlloc.Release(requestedIP)
+	}
+	if errors.Is(err, db.ErrUserDisabled) {
+		return nil, grpcError(codes.FailedPrecondition, err)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -145,7 +390,7 @@ func (api headscaleV1APIServer) ExpirePreAuthKey(
 	ctx context.Context,
 	request *v1.ExpirePreAuthKeyRequest,
 ) (*v1.ExpirePreAuthKeyResponse, error) {
-	err := api.h.db.DB.Transaction(func(tx *gorm.DB) error {
+	err := api.h.db.Write(func(tx *gorm.DB) error {
 		preAuthKey, err := db.GetPreAuthKey(tx, request.GetUser(), request.Key)
 		if err != nil {
 			return err
@@ -172,6 +417,9 @@ func (api headscaleV1APIServer) ListPreAuthKeys(
 	response := make([]*v1.PreAuthKey, len(preAuthKeys))
 	for index, key := range preAuthKeys {
 		response[index] = key.Proto()
+
+		// Only show the prefix of legacy keys stored in clear.
+		response[index].Key = ""
 	}
 
 	sort.Slice(response, func(i, j int) bool {
@@ -196,8 +444,28 @@ func (api headscaleV1APIServer) RegisterNode(
 		return nil, err
 	}
 
-	ipv4, ipv6, err := api.h.ipAlloc.Next()
+	err = api.h.authorizeCachedRegistration(ctx, mkey, request.GetUser(), util.RegisterMethodCLI)
+	if err != nil {
+		return nil, grpcError(codes.PermissionDenied, err)
+	}
+
+	var requestedIP *netip.Addr
+	if request.GetIp() != "" {
+		ip, err := netip.ParseAddr(request.GetIp())
+		if err != nil {
+			return nil, grpcError(codes.InvalidArgument, err)
+		}
+
+		if err := api.h.ipAlloc.Reserve(ip); err != nil {
+			return nil, grpcError(codes.InvalidArgument, err)
+		}
+		requestedIP = &ip
+	}
+
+	ipv4, ipv6, err := api.h.ipAlloc.NextWith(requestedIP)
 	if err != nil {
+		api.h.ipAlloc.Release(requestedIP)
+
 		return nil, err
 	}
 
@@ -212,10 +480,20 @@ func (api headscaleV1APIServer) RegisterNode(
 			ipv4, ipv6,
 		)
 	})
+	if err != nil {
+		// The node is not registered, the IPs, requested or not, are
+		// handed out again.
+		api.h.ipAlloc.Release(ipv4, ipv6)
+	}
+	if errors.Is(err, db.ErrUserDisabled) {
+		return nil, grpcError(codes.FailedPrecondition, err)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	api.h.registrationWaiters.done(mkey)
+
 	return &v1.RegisterNodeResponse{Node: node.Proto()}, nil
 }
 
@@ -224,6 +502,9 @@ func (api headscaleV1APIServer) GetNode(
 	request *v1.GetNodeRequest,
 ) (*v1.GetNodeResponse, error) {
 	node, err := api.h.db.GetNodeByID(types.NodeID(request.GetNodeId()))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, db.ErrNodeNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -233,6 +514,7 @@ func (api headscaleV1APIServer) GetNode(
 	// Populate the online field based on
 	// currently connected nodes.
 	resp.Online = api.h.nodeNotifier.IsConnected(node.ID)
+	resp.ValidTags, resp.InvalidTags = api.h.ACLPolicy.TagsOfNode(node)
 
 	return &v1.GetNodeResponse{Node: resp}, nil
 }
@@ -249,6 +531,10 @@ func (api headscaleV1APIServer) SetTags(
 	}
 
 	node, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		if _, err := db.GetUnlockedNode(tx, types.NodeID(request.GetNodeId()), request.GetForce()); err != nil {
+			return nil, err
+		}
+
 		err := db.SetTags(tx, types.NodeID(request.GetNodeId()), request.GetTags())
 		if err != nil {
 			return nil, err
@@ -256,18 +542,23 @@ func (api headscaleV1APIServer) SetTags(
 
 		return db.GetNodeByID(tx, types.NodeID(request.GetNodeId()))
 	})
+	if errors.Is(err, db.ErrNodeLocked) || errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
 	if err != nil {
 		return &v1.SetTagsResponse{
 			Node: nil,
-		}, status.Error(codes.InvalidArgument, err.Error())
+		}, grpcError(codes.InvalidArgument, err)
 	}
 
+	// The tags change the packet filters of the node itself as well
+	// as the ones of its peers.
 	ctx = types.NotifyCtx(ctx, "cli-settags", node.Hostname)
-	api.h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdate{
+	api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
 		Type:        types.StatePeerChanged,
 		ChangeNodes: []types.NodeID{node.ID},
 		Message:     "called from api.SetTags",
-	}, node.ID)
+	})
 
 	log.Trace().
 		Str("node", node.Hostname).
@@ -294,19 +585,23 @@ func (api headscaleV1APIServer) DeleteNode(
 	ctx context.Context,
 	request *v1.DeleteNodeRequest,
 ) (*v1.DeleteNodeResponse, error) {
-	node, err := api.h.db.GetNodeByID(types.NodeID(request.GetNodeId()))
-	if err != nil {
-		return nil, err
-	}
+	var node *types.Node
+	isConnected := api.h.nodeNotifier.ConnectedMap()
+	changedNodes, err := db.Write(api.h.db.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
+		var err error
+		node, err = db.GetUnlockedNode(tx, types.NodeID(request.GetNodeId()), request.GetForce())
+		if err != nil {
+			return nil, err
+		}
 
-	changedNodes, err := api.h.db.DeleteNode(
-		node,
-		api.h.nodeNotifier.ConnectedMap(),
-	)
+		return db.DeleteNode(tx, node, isConnected)
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	api.h.nodeStatusMonitor.forget(node.ID)
+
 	ctx = types.NotifyCtx(ctx, "cli-deletenode", node.Hostname)
 	api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
 		Type:    types.StatePeerRemoved,
@@ -330,6 +625,10 @@ func (api headscaleV1APIServer) ExpireNode(
 	now := time.Now()
 
 	node, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		if _, err := db.GetUnlockedNode(tx, types.NodeID(request.GetNodeId()), request.GetForce()); err != nil {
+			return nil, err
+		}
+
 		db.NodeSetExpiry(
 			tx,
 			types.NodeID(request.GetNodeId()),
@@ -352,7 +651,7 @@ func (api headscaleV1APIServer) ExpireNode(
 		node.ID)
 
 	ctx = types.NotifyCtx(ctx, "cli-expirenode-peers", node.Hostname)
-	api.h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdateExpire(node.ID, now), node.ID)
+	api.h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdateExpired(node.ID), node.ID)
 
 	log.Trace().
 		Str("node", node.Hostname).
@@ -367,6 +666,10 @@ func (api headscaleV1APIServer) RenameNode(
 	request *v1.RenameNodeRequest,
 ) (*v1.RenameNodeResponse, error) {
 	node, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		if _, err := db.GetUnlockedNode(tx, types.NodeID(request.GetNodeId()), request.GetForce()); err != nil {
+			return nil, err
+		}
+
 		err := db.RenameNode(
 			tx,
 			request.GetNodeId(),
@@ -397,11 +700,133 @@ func (api headscaleV1APIServer) RenameNode(
 	return &v1.RenameNodeResponse{Node: node.Proto()}, nil
 }
 
+func (api headscaleV1APIServer) SetNodeIP(
+	ctx context.Context,
+	request *v1.SetNodeIPRequest,
+) (*v1.SetNodeIPResponse, error) {
+	ip, err := netip.ParseAddr(request.GetIp())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid IP address: %s", err)
+	}
+
+	node, err := api.h.db.GetNodeByID(types.NodeID(request.GetNodeId()))
+	if err != nil {
+		return nil, grpcError(codes.NotFound, err)
+	}
+
+	old := node.IPv4
+	if ip.Is6() {
+		old = node.IPv6
+	}
+
+	if old != nil && *old == ip {
+		return &v1.SetNodeIPResponse{Node: node.Proto()}, nil
+	}
+
+	if err := api.h.ipAlloc.Reserve(ip); err != nil {
+		return nil, grpcError(codes.InvalidArgument, err)
+	}
+
+	node, err = db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		if _, err := db.GetUnlockedNode(tx, node.ID, request.GetForce()); err != nil {
+			return nil, err
+		}
+
+		if err := db.NodeSetIP(tx, node.ID, ip); err != nil {
+			return nil, err
+		}
+
+		return db.GetNodeByID(tx, node.ID)
+	})
+	if err != nil {
+		api.h.ipAlloc.Release(&ip)
+
+		return nil, err
+	}
+
+	api.h.ipAlloc.Release(old)
+
+	ctx = types.NotifyCtx(ctx, "cli-setnodeip-self", node.Hostname)
+	api.h.nodeNotifier.NotifyByMachineKey(
+		ctx,
+		types.StateUpdate{
+			Type:        types.StateSelfUpdate,
+			ChangeNodes: []types.NodeID{node.ID},
+		},
+		node.ID)
+
+	ctx = types.NotifyCtx(ctx, "cli-setnodeip-peers", node.Hostname)
+	api.h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{node.ID},
+		Message:     "called from api.SetNodeIP",
+	}, node.ID)
+
+	log.Trace().
+		Str("node", node.Hostname).
+		Str("ip", ip.String()).
+		Msg("node IP changed")
+
+	return &v1.SetNodeIPResponse{Node: node.Proto()}, nil
+}
+
+// SetNodeMetadata sets or removes keys of the metadata of a node. The
+// metadata is not sent to the nodes, their peers are not notified.
+func (api headscaleV1APIServer) SetNodeMetadata(
+	ctx context.Context,
+	request *v1.SetNodeMetadataRequest,
+) (*v1.SetNodeMetadataResponse, error) {
+	nodeID := types.NodeID(request.GetNodeId())
+	node, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		if _, err := db.GetUnlockedNode(tx, nodeID, request.GetForce()); err != nil {
+			return nil, err
+		}
+
+		if err := db.SetNodeMetadata(tx, nodeID, request.GetMetadata()); err != nil {
+			return nil, err
+		}
+
+		return db.GetNodeByID(tx, nodeID)
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, db.ErrNodeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Trace().
+		Str("node", node.Hostname).
+		Interface("metadata", request.GetMetadata()).
+		Msg("node metadata changed")
+
+	return &v1.SetNodeMetadataResponse{Node: node.Proto()}, nil
+}
+
 func (api headscaleV1APIServer) ListNodes(
 	ctx context.Context,
 	request *v1.ListNodesRequest,
 ) (*v1.ListNodesResponse, error) {
 	isConnected := api.h.nodeNotifier.ConnectedMap()
+	if request.GetLastSeenBefore() != nil {
+		nodes, err := api.h.db.ListNodesByLastSeenBefore(request.GetLastSeenBefore().AsTime())
+		if err != nil {
+			return nil, err
+		}
+
+		if request.GetUser() != "" {
+			nodes = slices.DeleteFunc(nodes, func(node *types.Node) bool {
+				return node.User.Name != request.GetUser()
+			})
+		}
+
+		if request.GetMetadataKey() != "" {
+			nodes = db.FilterNodesByMetadata(nodes, request.GetMetadataKey(), request.GetMetadataValue())
+		}
+
+		return api.listNodesResponse(nodes, isConnected), nil
+	}
+
 	if request.GetUser() != "" {
 		nodes, err := db.Read(api.h.db.DB, func(rx *gorm.DB) (types.Nodes, error) {
 			return db.ListNodesByUser(rx, request.GetUser())
@@ -410,6 +835,10 @@ func (api headscaleV1APIServer) ListNodes(
 			return nil, err
 		}
 
+		if request.GetMetadataKey() != "" {
+			nodes = db.FilterNodesByMetadata(nodes, request.GetMetadataKey(), request.GetMetadataValue())
+		}
+
 		response := make([]*v1.Node, len(nodes))
 		for index, node := range nodes {
 			resp := node.Proto()
@@ -429,6 +858,17 @@ func (api headscaleV1APIServer) ListNodes(
 		return nil, err
 	}
 
+	if request.GetMetadataKey() != "" {
+		nodes = db.FilterNodesByMetadata(nodes, request.GetMetadataKey(), request.GetMetadataValue())
+	}
+
+	return api.listNodesResponse(nodes, isConnected), nil
+}
+
+func (api headscaleV1APIServer) listNodesResponse(
+	nodes types.Nodes,
+	isConnected types.NodeConnectedMap,
+) *v1.ListNodesResponse {
 	sort.Slice(nodes, func(i, j int) bool {
 		return nodes[i].ID < nodes[j].ID
 	})
@@ -449,57 +889,213 @@ func (api headscaleV1APIServer) ListNodes(
 		response[index] = resp
 	}
 
-	return &v1.ListNodesResponse{Nodes: response}, nil
+	return &v1.ListNodesResponse{Nodes: response}
 }
 
 func (api headscaleV1APIServer) MoveNode(
 	ctx context.Context,
 	request *v1.MoveNodeRequest,
 ) (*v1.MoveNodeResponse, error) {
-	node, err := api.h.db.GetNodeByID(types.NodeID(request.GetNodeId()))
-	if err != nil {
-		return nil, err
-	}
+	node, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		node, err := db.GetUnlockedNode(tx, types.NodeID(request.GetNodeId()), request.GetForce())
+		if err != nil {
+			return nil, err
+		}
 
-	err = api.h.db.AssignNodeToUser(node, request.GetUser())
+		return node, db.AssignNodeToUser(tx, node, request.GetUser())
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	// The user of the node is part of the packet filters of the node
+	// and its peers.
+	ctx = types.NotifyCtx(ctx, "cli-movenode", node.Hostname)
+	api.h.nodeNotifier.NotifyAll(ctx, types.StateUpdate{
+		Type:        types.StatePeerChanged,
+		ChangeNodes: []types.NodeID{node.ID},
+		Message:     "called from api.MoveNode",
+	})
+
 	return &v1.MoveNodeResponse{Node: node.Proto()}, nil
 }
 
-func (api headscaleV1APIServer) BackfillNodeIPs(
+// LockNode protects a node from the changes made with the API, they
+// fail until the node is unlocked unless they are forced.
+func (api headscaleV1APIServer) LockNode(
 	ctx context.Context,
-	request *v1.BackfillNodeIPsRequest,
-) (*v1.BackfillNodeIPsResponse, error) {
-	log.Trace().Msg("Backfill called")
-
-	if !request.Confirmed {
-		return nil, errors.New("not confirmed, aborting")
-	}
-
-	changes, err := api.h.db.BackfillNodeIPs(api.h.ipAlloc)
+	request *v1.LockNodeRequest,
+) (*v1.LockNodeResponse, error) {
+	node, err := api.setNodeLocked(types.NodeID(request.GetNodeId()), true)
 	if err != nil {
 		return nil, err
 	}
 
-	return &v1.BackfillNodeIPsResponse{Changes: changes}, nil
+	return &v1.LockNodeResponse{Node: node.Proto()}, nil
 }
 
-func (api headscaleV1APIServer) GetRoutes(
+func (api headscaleV1APIServer) UnlockNode(
 	ctx context.Context,
-	request *v1.GetRoutesRequest,
-) (*v1.GetRoutesResponse, error) {
-	routes, err := db.Read(api.h.db.DB, func(rx *gorm.DB) (types.Routes, error) {
-		return db.GetRoutes(rx)
-	})
+	request *v1.UnlockNodeRequest,
+) (*v1.UnlockNodeResponse, error) {
+	node, err := api.setNodeLocked(types.NodeID(request.GetNodeId()), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.UnlockNodeResponse{Node: node.Proto()}, nil
+}
+
+func (api headscaleV1APIServer) setNodeLocked(nodeID types.NodeID, locked bool) (*types.Node, error) {
+	node, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		if _, err := db.GetNodeByID(tx, nodeID); err != nil {
+			return nil, err
+		}
+
+		if err := db.NodeSetLocked(tx, nodeID, locked); err != nil {
+			return nil, err
+		}
+
+		return db.GetNodeByID(tx, nodeID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Uint64("node.id", nodeID.Uint64()).
+		Str("node", node.Hostname).
+		Bool("locked", locked).
+		Msg("Node lock changed")
+
+	return node, nil
+}
+
+func (api headscaleV1APIServer) BackfillNodeIPs(
+	ctx context.Context,
+	request *v1.BackfillNodeIPsRequest,
+) (*v1.BackfillNodeIPsResponse, error) {
+	log.Trace().Msg("Backfill called")
+
+	if !request.Confirmed {
+		return nil, errors.New("not confirmed, aborting")
+	}
+
+	changes, err := api.h.db.BackfillNodeIPs(api.h.ipAlloc, request.GetForce())
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.BackfillNodeIPsResponse{Changes: changes}, nil
+}
+
+func (api headscaleV1APIServer) DeleteStaleNodes(
+	ctx context.Context,
+	request *v1.DeleteStaleNodesRequest,
+) (*v1.DeleteStaleNodesResponse, error) {
+	expiry := api.h.cfg.GC.StaleNodeExpiry
+	if request.GetStaleNodeExpiry() != "" {
+		duration, err := model.ParseDuration(request.GetStaleNodeExpiry())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid stale node expiry: %s", err)
+		}
+		expiry = time.Duration(duration)
+	}
+
+	if expiry <= 0 {
+		return nil, status.Error(
+			codes.FailedPrecondition,
+			"gc.stale_node_expiry is not set, a stale node expiry must be given",
+		)
+	}
+
+	nodes, err := api.h.deleteStaleNodes(expiry, request.GetDryRun())
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]*v1.Node, len(nodes))
+	for index, node := range nodes {
+		response[index] = node.Proto()
+	}
+
+	return &v1.DeleteStaleNodesResponse{Nodes: response}, nil
+}
+
+func (api headscaleV1APIServer) GenerateRegisterURL(
+	ctx context.Context,
+	request *v1.GenerateRegisterURLRequest,
+) (*v1.GenerateRegisterURLResponse, error) {
+	var mkey key.MachinePublic
+	err := mkey.UnmarshalText([]byte(request.GetKey()))
+	if err != nil {
+		return nil, grpcError(codes.InvalidArgument, err)
+	}
+
+	var requestedIP *netip.Addr
+	if request.GetIp() != "" {
+		ip, err := netip.ParseAddr(request.GetIp())
+		if err != nil {
+			return nil, grpcError(codes.InvalidArgument, err)
+		}
+		requestedIP = &ip
+	}
+
+	url, expiry, err := api.h.generateRegistrationURL(mkey, request.GetUser(), requestedIP)
+	if errors.Is(err, errRegistrationNotPending) || errors.Is(err, db.ErrUserNotFound) {
+		return nil, grpcError(codes.NotFound, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.GenerateRegisterURLResponse{
+		Url:        url,
+		Expiration: timestamppb.New(expiry),
+	}, nil
+}
+
+func (api headscaleV1APIServer) GetRoutes(
+	ctx context.Context,
+	request *v1.GetRoutesRequest,
+) (*v1.GetRoutesResponse, error) {
+	filter := db.RouteFilter{
+		User:    request.GetUser(),
+		NodeID:  types.NodeID(request.GetNodeId()),
+		Page:    int(request.GetPage()),
+		PerPage: int(request.GetPerPage()),
+	}
+
+	if filter.User != "" {
+		if _, err := api.h.db.GetUser(filter.User); err != nil {
+			return nil, err
+		}
+	}
+
+	if filter.NodeID != 0 {
+		_, err := api.h.db.GetNodeByID(filter.NodeID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, db.ErrNodeNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var total int64
+	routes, err := db.Read(api.h.db.DB, func(rx *gorm.DB) (types.Routes, error) {
+		routes, count, err := db.ListRoutes(rx, filter)
+		total = count
+
+		return routes, err
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	return &v1.GetRoutesResponse{
 		Routes: types.Routes(routes).Proto(),
+		Total:  uint32(total),
 	}, nil
 }
 
@@ -508,6 +1104,10 @@ func (api headscaleV1APIServer) EnableRoute(
 	request *v1.EnableRouteRequest,
 ) (*v1.EnableRouteResponse, error) {
 	update, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.StateUpdate, error) {
+		if err := db.CheckRouteUnlocked(tx, request.GetRouteId(), request.GetForce()); err != nil {
+			return nil, err
+		}
+
 		return db.EnableRoute(tx, request.GetRouteId())
 	})
 	if err != nil {
@@ -528,6 +1128,10 @@ func (api headscaleV1APIServer) DisableRoute(
 	request *v1.DisableRouteRequest,
 ) (*v1.DisableRouteResponse, error) {
 	update, err := db.Write(api.h.db.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
+		if err := db.CheckRouteUnlocked(tx, request.GetRouteId(), request.GetForce()); err != nil {
+			return nil, err
+		}
+
 		return db.DisableRoute(tx, request.GetRouteId(), api.h.nodeNotifier.ConnectedMap())
 	})
 	if err != nil {
@@ -570,6 +1174,10 @@ func (api headscaleV1APIServer) DeleteRoute(
 ) (*v1.DeleteRouteResponse, error) {
 	isConnected := api.h.nodeNotifier.ConnectedMap()
 	update, err := db.Write(api.h.db.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
+		if err := db.CheckRouteUnlocked(tx, request.GetRouteId(), request.GetForce()); err != nil {
+			return nil, err
+		}
+
 		return db.DeleteRoute(tx, request.GetRouteId(), isConnected)
 	})
 	if err != nil {
@@ -587,11 +1195,67 @@ func (api headscaleV1APIServer) DeleteRoute(
 	return &v1.DeleteRouteResponse{}, nil
 }
 
+// SetNodeAllowedRoutes limits the routes of its peers a node sees to the
+// routes it is allowed to use, the node gets a new map with them.
+func (api headscaleV1APIServer) SetNodeAllowedRoutes(
+	ctx context.Context,
+	request *v1.SetNodeAllowedRoutesRequest,
+) (*v1.SetNodeAllowedRoutesResponse, error) {
+	prefixes := make([]netip.Prefix, 0, len(request.GetRoutes()))
+	for _, route := range request.GetRoutes() {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid route: %s", err)
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	nodeID := types.NodeID(request.GetNodeId())
+	allowed, err := db.Write(api.h.db.DB, func(tx *gorm.DB) ([]netip.Prefix, error) {
+		if _, err := db.GetUnlockedNode(tx, nodeID, request.GetForce()); err != nil {
+			return nil, err
+		}
+
+		return db.SetNodeAllowedRoutes(tx, nodeID, prefixes, request.GetDenyAll())
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, db.ErrNodeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = types.NotifyCtx(ctx, "cli-setnodeallowedroutes", "unknown")
+	api.h.nodeNotifier.NotifyByMachineKey(
+		ctx,
+		types.StateUpdate{
+			Type: types.StateFullUpdate,
+		},
+		nodeID)
+
+	routes := make([]string, len(allowed))
+	for index, prefix := range allowed {
+		routes[index] = prefix.String()
+	}
+
+	log.Trace().
+		Uint64("node.id", nodeID.Uint64()).
+		Strs("routes", routes).
+		Bool("deny_all", request.GetDenyAll()).
+		Msg("node allowed routes changed")
+
+	return &v1.SetNodeAllowedRoutesResponse{
+		Routes:  routes,
+		DenyAll: request.GetDenyAll(),
+	}, nil
+}
+
 func (api headscaleV1APIServer) CreateApiKey(
 	ctx context.Context,
 	request *v1.CreateApiKeyRequest,
 ) (*v1.CreateApiKeyResponse, error) {
-	var expiration time.Time
+	expiration := time.Now().Add(defaultAPIKeyExpiration)
 	if request.GetExpiration() != nil {
 		expiration = request.GetExpiration().AsTime()
 	}
@@ -606,6 +1270,25 @@ func (api headscaleV1APIServer) CreateApiKey(
 	return &v1.CreateApiKeyResponse{ApiKey: apiKey}, nil
 }
 
+// RenewApiKey extends the expiration of an API key which has not
+// expired, without changing its secret.
+func (api headscaleV1APIServer) RenewApiKey(
+	ctx context.Context,
+	request *v1.RenewApiKeyRequest,
+) (*v1.RenewApiKeyResponse, error) {
+	expiration := time.Now().Add(defaultAPIKeyExpiration)
+	if request.GetExpiration() != nil {
+		expiration = request.GetExpiration().AsTime()
+	}
+
+	apiKey, err := api.h.db.RenewAPIKey(request.GetPrefix(), expiration)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.RenewApiKeyResponse{ApiKey: apiKey.Proto()}, nil
+}
+
 func (api headscaleV1APIServer) ExpireApiKey(
 	ctx context.Context,
 	request *v1.ExpireApiKeyRequest,
@@ -668,6 +1351,284 @@ func (api headscaleV1APIServer) DeleteApiKey(
 	return &v1.DeleteApiKeyResponse{}, nil
 }
 
+// ReloadDERPMap fetches the DERPMap from the configured paths and URLs,
+// replacing any map set through the API, and pushes it to all
+// connected nodes.
+func (api headscaleV1APIServer) ReloadDERPMap(
+	ctx context.Context,
+	request *v1.ReloadDERPMapRequest,
+) (*v1.ReloadDERPMapResponse, error) {
+	derpMap := derp.GetDERPMap(api.h.cfg.DERP)
+
+	embedded := api.h.cfg.DERP.ServerEnabled && api.h.cfg.DERP.AutomaticallyAddEmbeddedDerpRegion
+	if len(derpMap.Regions) == 0 && !embedded {
+		return nil, status.Error(codes.FailedPrecondition, derp.ErrEmptyDERPMap.Error())
+	}
+
+	api.h.setDERPMap(derpMap, "cli-reloadderpmap")
+
+	regions := make([]*v1.DERPRegion, 0, len(derpMap.Regions))
+	for _, region := range derpMap.Regions {
+		regions = append(regions, &v1.DERPRegion{
+			RegionId:   int32(region.RegionID),
+			RegionCode: region.RegionCode,
+			RegionName: region.RegionName,
+			Nodes:      int32(len(region.Nodes)),
+		})
+	}
+
+	sort.Slice(regions, func(i, j int) bool {
+		return regions[i].GetRegionId() < regions[j].GetRegionId()
+	})
+
+	return &v1.ReloadDERPMapResponse{Regions: regions}, nil
+}
+
+// ReloadPolicy reads the ACL policy file again, like on SIGHUP, and
+// pushes the new packet filters to all connected nodes. The current
+// policy is kept if the file is invalid.
+func (api headscaleV1APIServer) ReloadPolicy(
+	ctx context.Context,
+	request *v1.ReloadPolicyRequest,
+) (*v1.ReloadPolicyResponse, error) {
+	err := api.h.reloadACLPolicy(ctx, "cli-reloadpolicy")
+	if errors.Is(err, errNoACLPolicyPath) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"reloading ACL policy, keeping the current policy: %s",
+			err,
+		)
+	}
+
+	return &v1.ReloadPolicyResponse{}, nil
+}
+
+// GetPolicy returns the ACL policy stored in the database or, in file
+// mode, the contents of the policy file.
+func (api headscaleV1APIServer) GetPolicy(
+	ctx context.Context,
+	request *v1.GetPolicyRequest,
+) (*v1.GetPolicyResponse, error) {
+	if api.h.cfg.ACL.PolicyMode == types.PolicyModeDB {
+		stored, err := api.h.db.GetPolicy()
+		if err != nil {
+			return nil, err
+		}
+
+		return &v1.GetPolicyResponse{
+			Policy:    stored.Data,
+			UpdatedAt: timestamppb.New(stored.UpdatedAt),
+		}, nil
+	}
+
+	if api.h.cfg.ACL.PolicyPath == "" {
+		return nil, status.Error(codes.FailedPrecondition, errNoACLPolicyPath.Error())
+	}
+
+	policyPath := util.AbsolutePathFromConfigPath(api.h.cfg.ACL.PolicyPath)
+	info, err := os.Stat(policyPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"the ACL policy is a directory of policies, %s",
+			policyPath,
+		)
+	}
+
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.GetPolicyResponse{
+		Policy:    string(data),
+		UpdatedAt: timestamppb.New(info.ModTime()),
+	}, nil
+}
+
+// SetPolicy validates the ACL policy, stores it in the database and
+// pushes the new packet filters to all connected nodes. It requires
+// policy.mode to be database.
+func (api headscaleV1APIServer) SetPolicy(
+	ctx context.Context,
+	request *v1.SetPolicyRequest,
+) (*v1.SetPolicyResponse, error) {
+	stored, err := api.h.storeACLPolicy(ctx, request.GetPolicy())
+	switch {
+	case errors.Is(err, errACLPolicyNotInDatabase):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, errInvalidACLPolicy):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case err != nil:
+		return nil, err
+	}
+
+	return &v1.SetPolicyResponse{
+		Policy:    stored.Data,
+		UpdatedAt: timestamppb.New(stored.UpdatedAt),
+	}, nil
+}
+
+// CheckPolicy evaluates the current ACL policy on the traffic from a
+// source to a destination, with the nodes registered.
+func (api headscaleV1APIServer) CheckPolicy(
+	ctx context.Context,
+	request *v1.CheckPolicyRequest,
+) (*v1.CheckPolicyResponse, error) {
+	if api.h.ACLPolicy == nil {
+		return &v1.CheckPolicyResponse{
+			Allowed:   true,
+			RuleIndex: -1,
+			Rule:      "no ACL policy, all traffic is allowed",
+		}, nil
+	}
+
+	nodes, err := api.h.db.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	check, err := api.h.ACLPolicy.CheckAccess(
+		nodes,
+		request.GetSource(),
+		request.GetDestination(),
+		request.GetProtocol(),
+	)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return &v1.CheckPolicyResponse{
+		Allowed:   check.Allowed,
+		Partial:   check.Partial,
+		RuleIndex: int32(check.RuleIndex),
+		Rule:      check.Rule,
+	}, nil
+}
+
+func (api headscaleV1APIServer) AddNodeToGroup(
+	ctx context.Context,
+	request *v1.AddNodeToGroupRequest,
+) (*v1.AddNodeToGroupResponse, error) {
+	nodeGroup, err := db.Write(api.h.db.DB, func(tx *gorm.DB) (*types.NodeGroup, error) {
+		if _, err := db.GetUnlockedNode(tx, types.NodeID(request.GetNodeId()), request.GetForce()); err != nil {
+			return nil, err
+		}
+
+		return db.AddNodeToGroup(tx, request.GetGroup(), types.NodeID(request.GetNodeId()))
+	})
+	if err != nil {
+		return nil, nodeGroupError(err)
+	}
+
+	api.h.nodeGroupsChanged(ctx, "cli-addnodetogroup")
+
+	return &v1.AddNodeToGroupResponse{NodeGroup: nodeGroup.Proto()}, nil
+}
+
+func (api headscaleV1APIServer) ListNodeGroups(
+	ctx context.Context,
+	request *v1.ListNodeGroupsRequest,
+) (*v1.ListNodeGroupsResponse, error) {
+	nodeGroups, err := api.h.db.ListNodeGroups(request.GetGroup(), request.GetUser())
+	if err != nil {
+		return nil, nodeGroupError(err)
+	}
+
+	response := make([]*v1.NodeGroup, len(nodeGroups))
+	for index, nodeGroup := range nodeGroups {
+		response[index] = nodeGroup.Proto()
+	}
+
+	return &v1.ListNodeGroupsResponse{NodeGroups: response}, nil
+}
+
+func (api headscaleV1APIServer) RenameNodeGroup(
+	ctx context.Context,
+	request *v1.RenameNodeGroupRequest,
+) (*v1.RenameNodeGroupResponse, error) {
+	nodeGroups, err := db.Write(api.h.db.DB, func(tx *gorm.DB) ([]types.NodeGroup, error) {
+		nodeGroups, err := db.RenameNodeGroup(tx, request.GetOldName(), request.GetNewName())
+		if err != nil {
+			return nil, err
+		}
+
+		return nodeGroups, api.h.checkNodeGroups(tx)
+	})
+	if err != nil {
+		return nil, nodeGroupError(err)
+	}
+
+	api.h.nodeGroupsChanged(ctx, "cli-renamenodegroup")
+
+	response := make([]*v1.NodeGroup, len(nodeGroups))
+	for index, nodeGroup := range nodeGroups {
+		response[index] = nodeGroup.Proto()
+	}
+
+	return &v1.RenameNodeGroupResponse{NodeGroups: response}, nil
+}
+
+func (api headscaleV1APIServer) RemoveNodeFromGroup(
+	ctx context.Context,
+	request *v1.RemoveNodeFromGroupRequest,
+) (*v1.RemoveNodeFromGroupResponse, error) {
+	err := api.h.db.Write(func(tx *gorm.DB) error {
+		if _, err := db.GetUnlockedNode(tx, types.NodeID(request.GetNodeId()), request.GetForce()); err != nil {
+			return err
+		}
+
+		err := db.RemoveNodeFromGroup(
+			tx,
+			request.GetGroup(),
+			types.NodeID(request.GetNodeId()),
+		)
+		if err != nil {
+			return err
+		}
+
+		return api.h.checkNodeGroups(tx)
+	})
+	if err != nil {
+		return nil, nodeGroupError(err)
+	}
+
+	api.h.nodeGroupsChanged(ctx, "cli-removenodefromgroup")
+
+	return &v1.RemoveNodeFromGroupResponse{}, nil
+}
+
+// checkNodeGroups checks that the ACL policy only references defined
+// groups with the node groups of tx, so a group in use is not removed.
+func (h *Headscale) checkNodeGroups(tx *gorm.DB) error {
+	if h.ACLPolicy == nil {
+		return nil
+	}
+
+	members, err := db.NodeGroupMembers(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = policyWithNodeGroups(h.ACLPolicy, members)
+
+	return err
+}
+
+func nodeGroupError(err error) error {
+	if errors.Is(err, policy.ErrInvalidGroup) {
+		return grpcError(codes.FailedPrecondition, err)
+	}
+
+	return apiError(err)
+}
+
 // The following service calls are for testing and debugging
 func (api headscaleV1APIServer) DebugCreateNode(
 	ctx context.Context,
@@ -725,13 +1686,81 @@ func (api headscaleV1APIServer) DebugCreateNode(
 		Str("machine_key", mkey.ShortString()).
 		Msg("adding debug machine via CLI, appending to registration cache")
 
-	api.h.registrationCache.Set(
-		mkey.String(),
-		newNode,
-		registerCacheExpiration,
-	)
+	api.h.cacheRegistration(mkey, newNode)
 
 	return &v1.DebugCreateNodeResponse{Node: newNode.Proto()}, nil
 }
 
+// GetTrafficStats returns the pairs of nodes which exchanged the most
+// traffic over the last window, 1h and the top 10 by default.
+func (api headscaleV1APIServer) GetTrafficStats(
+	ctx context.Context,
+	request *v1.GetTrafficStatsRequest,
+) (*v1.GetTrafficStatsResponse, error) {
+	window := time.Hour
+	if request.GetWindow() != "" {
+		duration, err := model.ParseDuration(request.GetWindow())
+		if err != nil || duration <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid window %q, want a duration like 1h", request.GetWindow())
+		}
+		window = time.Duration(duration)
+	}
+
+	top := 10
+	if request.GetTop() > 0 {
+		top = int(request.GetTop())
+	}
+
+	traffic, err := api.h.db.TopPeerTraffic(time.Now().Add(-window), top)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := api.h.db.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[types.NodeID]string, len(nodes))
+	for _, node := range nodes {
+		names[node.ID] = node.GivenName
+	}
+
+	response := &v1.GetTrafficStatsResponse{}
+	for _, pair := range traffic {
+		response.Stats = append(response.Stats, &v1.PeerTraffic{
+			SourceNodeId:        pair.SourceID.Uint64(),
+			SourceNodeName:      names[pair.SourceID],
+			DestinationNodeId:   pair.DestinationID.Uint64(),
+			DestinationNodeName: names[pair.DestinationID],
+			BytesTx:             pair.BytesTx,
+			BytesRx:             pair.BytesRx,
+		})
+	}
+
+	return response, nil
+}
+
+func (api headscaleV1APIServer) DebugNodeMap(
+	ctx context.Context,
+	request *v1.DebugNodeMapRequest,
+) (*v1.DebugNodeMapResponse, error) {
+	node, err := api.h.db.GetNodeByID(types.NodeID(request.GetNodeId()))
+	if err != nil {
+		return nil, grpcError(codes.NotFound, err)
+	}
+
+	resp, err := api.h.mapper.DebugMapResponse(node, api.h.ACLPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	mapResponse, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.DebugNodeMapResponse{MapResponse: string(mapResponse)}, nil
+}
+
 func (api headscaleV1APIServer) mustEmbedUnimplementedHeadscaleServiceServer() {}
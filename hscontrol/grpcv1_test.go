@@ -1,6 +1,28 @@
 package hscontrol
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/mapper"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
 
 func Test_validateTag(t *testing.T) {
 	type args struct {
@@ -40,3 +62,420 @@ func Test_validateTag(t *testing.T) {
 		})
 	}
 }
+
+func (s *Suite) TestSetNodeIP(c *check.C) {
+	prefix4 := netip.MustParsePrefix("100.64.0.0/10")
+
+	var err error
+	app.ipAlloc, err = db.NewIPAllocator(app.db, &prefix4, nil, types.IPAllocationStrategySequential, 32)
+	c.Assert(err, check.IsNil)
+
+	user, err := app.db.CreateUser("servers")
+	c.Assert(err, check.IsNil)
+
+	createNode := func(hostname string) *types.Node {
+		ipv4, _, err := app.ipAlloc.Next()
+		c.Assert(err, check.IsNil)
+
+		node := types.Node{
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			Hostname:       hostname,
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodCLI,
+			IPv4:           ipv4,
+		}
+		c.Assert(app.db.DB.Save(&node).Error, check.IsNil)
+
+		return &node
+	}
+
+	web := createNode("web")
+	other := createNode("other")
+
+	api := newHeadscaleV1APIServer(app)
+	setIP := func(node *types.Node, ip string) (*v1.Node, error) {
+		resp, err := api.SetNodeIP(context.Background(), &v1.SetNodeIPRequest{
+			NodeId: uint64(node.ID),
+			Ip:     ip,
+		})
+
+		return resp.GetNode(), err
+	}
+
+	resp, err := setIP(web, "100.64.0.10")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.GetIpAddresses(), check.DeepEquals, []string{"100.64.0.10"})
+
+	// The address of another node, out of range and invalid
+	// addresses are rejected.
+	for _, ip := range []string{"100.64.0.10", "10.0.0.1", "not-an-ip"} {
+		_, err = setIP(other, ip)
+		c.Assert(status.Code(err), check.Equals, codes.InvalidArgument, check.Commentf("ip %s", ip))
+	}
+
+	// The previous address of the node is released and can be used
+	// again.
+	_, err = setIP(other, web.IPv4.String())
+	c.Assert(err, check.IsNil)
+}
+
+func (s *Suite) TestRegisterNodeReleasesRequestedIP(c *check.C) {
+	prefix4 := netip.MustParsePrefix("100.64.0.0/10")
+
+	var err error
+	app.ipAlloc, err = db.NewIPAllocator(app.db, &prefix4, nil, types.IPAllocationStrategySequential, 32)
+	c.Assert(err, check.IsNil)
+
+	_, err = app.db.CreateUser("servers")
+	c.Assert(err, check.IsNil)
+
+	// The machine key is not waiting for a registration, so the
+	// registration fails after the IP has been reserved.
+	api := newHeadscaleV1APIServer(app)
+	_, err = api.RegisterNode(context.Background(), &v1.RegisterNodeRequest{
+		User: "servers",
+		Key:  key.NewMachine().Public().String(),
+		Ip:   "100.64.0.10",
+	})
+	c.Assert(err, check.NotNil)
+
+	c.Assert(app.ipAlloc.Reserve(netip.MustParseAddr("100.64.0.10")), check.IsNil)
+}
+
+func (s *Suite) TestCreatePreAuthKeyExpiration(c *check.C) {
+	_, err := app.db.CreateUser("keys")
+	c.Assert(err, check.IsNil)
+
+	api := newHeadscaleV1APIServer(app)
+	create := func(request *v1.CreatePreAuthKeyRequest) (*v1.PreAuthKey, error) {
+		request.User = "keys"
+		resp, err := api.CreatePreAuthKey(context.Background(), request)
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.GetPreAuthKey(), nil
+	}
+
+	// Without an expiration the key expires after the default one.
+	preAuthKey, err := create(&v1.CreatePreAuthKeyRequest{})
+	c.Assert(err, check.IsNil)
+	c.Assert(preAuthKey.GetExpiration(), check.NotNil)
+	expiration := preAuthKey.GetExpiration().AsTime()
+	c.Assert(expiration.After(time.Now()), check.Equals, true)
+	c.Assert(expiration.Before(time.Now().Add(defaultPreAuthKeyExpiration+time.Minute)), check.Equals, true)
+
+	preAuthKey, err = create(&v1.CreatePreAuthKeyRequest{NeverExpires: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(preAuthKey.GetExpiration(), check.IsNil)
+
+	_, err = create(&v1.CreatePreAuthKeyRequest{
+		NeverExpires: true,
+		Expiration:   timestamppb.New(time.Now().Add(time.Hour)),
+	})
+	c.Assert(status.Code(err), check.Equals, codes.InvalidArgument)
+}
+
+func (s *Suite) TestRemoveNodeFromGroupInUse(c *check.C) {
+	user, err := app.db.CreateUser("servers")
+	c.Assert(err, check.IsNil)
+
+	node := types.Node{
+		MachineKey:     key.NewMachine().Public(),
+		NodeKey:        key.NewNode().Public(),
+		Hostname:       "db",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodCLI,
+	}
+	c.Assert(app.db.DB.Save(&node).Error, check.IsNil)
+
+	app.ACLPolicy = &policy.ACLPolicy{
+		ACLs: []policy.ACL{
+			{Action: "accept", Sources: []string{"group:dba"}, Destinations: []string{"*:5432"}},
+		},
+	}
+	defer func() { app.ACLPolicy = nil }()
+
+	api := newHeadscaleV1APIServer(app)
+
+	_, err = api.AddNodeToGroup(context.Background(), &v1.AddNodeToGroupRequest{
+		Group:  "dba",
+		NodeId: uint64(node.ID),
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(app.ACLPolicy.NodeGroups["group:dba"], check.DeepEquals, []types.NodeID{node.ID})
+
+	// The policy references the group, its last node cannot be removed.
+	_, err = api.RemoveNodeFromGroup(context.Background(), &v1.RemoveNodeFromGroupRequest{
+		Group:  "dba",
+		NodeId: uint64(node.ID),
+	})
+	c.Assert(status.Code(err), check.Equals, codes.FailedPrecondition)
+
+	_, err = api.RenameNodeGroup(context.Background(), &v1.RenameNodeGroupRequest{
+		OldName: "dba",
+		NewName: "dbadmins",
+	})
+	c.Assert(status.Code(err), check.Equals, codes.FailedPrecondition)
+
+	members, err := app.db.NodeGroupMembers()
+	c.Assert(err, check.IsNil)
+	c.Assert(members["group:dba"], check.DeepEquals, []types.NodeID{node.ID})
+
+	// Deleting the node removes the group, which is then used as an
+	// empty group instead of failing the next startup.
+	_, err = app.db.DeleteNode(&node, nil)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(app.updateNodeGroups(), check.IsNil)
+	c.Assert(app.ACLPolicy.Groups["group:dba"], check.HasLen, 0)
+	c.Assert(app.ACLPolicy.NodeGroups["group:dba"], check.HasLen, 0)
+}
+
+func (s *Suite) TestReloadPolicy(c *check.C) {
+	api := newHeadscaleV1APIServer(app)
+
+	_, err := api.ReloadPolicy(context.Background(), &v1.ReloadPolicyRequest{})
+	c.Assert(status.Code(err), check.Equals, codes.FailedPrecondition)
+
+	policyPath := filepath.Join(tmpDir, "acl.hujson")
+	app.cfg.ACL.PolicyPath = policyPath
+	defer func() {
+		app.cfg.ACL.PolicyPath = ""
+		app.ACLPolicy = nil
+	}()
+
+	err = os.WriteFile(policyPath, []byte(`{
+  "acls": [
+    {"action": "accept", "src": ["*"], "dst": ["*:*"]},
+  ],
+}`), 0o600)
+	c.Assert(err, check.IsNil)
+
+	_, err = api.ReloadPolicy(context.Background(), &v1.ReloadPolicyRequest{})
+	c.Assert(err, check.IsNil)
+	c.Assert(app.ACLPolicy, check.NotNil)
+	c.Assert(app.ACLPolicy.ACLs, check.HasLen, 1)
+
+	// An invalid policy is rejected and the current policy is kept.
+	err = os.WriteFile(policyPath, []byte(`{
+  "acls": [
+    {"action": "accept", "src": ["group:undefined"], "dst": ["*:*"]},
+    {"action": "accept", "src": ["*"], "dst": ["*:22"]},
+  ],
+}`), 0o600)
+	c.Assert(err, check.IsNil)
+
+	_, err = api.ReloadPolicy(context.Background(), &v1.ReloadPolicyRequest{})
+	c.Assert(status.Code(err), check.Equals, codes.InvalidArgument)
+	c.Assert(app.ACLPolicy.ACLs, check.HasLen, 1)
+}
+
+func (s *Suite) TestSetPolicy(c *check.C) {
+	api := newHeadscaleV1APIServer(app)
+
+	// The policy can only be stored in database mode.
+	_, err := api.SetPolicy(context.Background(), &v1.SetPolicyRequest{Policy: `{}`})
+	c.Assert(status.Code(err), check.Equals, codes.FailedPrecondition)
+
+	app.cfg.ACL.PolicyMode = types.PolicyModeDB
+	defer func() {
+		app.cfg.ACL.PolicyMode = types.PolicyModeFile
+		app.ACLPolicy = nil
+	}()
+
+	_, err = api.GetPolicy(context.Background(), &v1.GetPolicyRequest{})
+	c.Assert(types.ErrorCodeOf(err), check.Equals, types.CodePolicyNotFound)
+
+	// An invalid policy is not stored.
+	_, err = api.SetPolicy(context.Background(), &v1.SetPolicyRequest{Policy: `{
+  "acls": [
+    {"action": "accept", "src": ["group:undefined"], "dst": ["*:*"]},
+  ],
+}`})
+	c.Assert(status.Code(err), check.Equals, codes.InvalidArgument)
+
+	_, err = api.GetPolicy(context.Background(), &v1.GetPolicyRequest{})
+	c.Assert(types.ErrorCodeOf(err), check.Equals, types.CodePolicyNotFound)
+	c.Assert(app.ACLPolicy, check.IsNil)
+
+	data := `{
+  "acls": [
+    {"action": "accept", "src": ["*"], "dst": ["*:22"]},
+  ],
+}`
+	set, err := api.SetPolicy(context.Background(), &v1.SetPolicyRequest{Policy: data})
+	c.Assert(err, check.IsNil)
+	c.Assert(set.GetUpdatedAt().IsValid(), check.Equals, true)
+	c.Assert(app.ACLPolicy, check.NotNil)
+	c.Assert(app.ACLPolicy.ACLs, check.HasLen, 1)
+
+	got, err := api.GetPolicy(context.Background(), &v1.GetPolicyRequest{})
+	c.Assert(err, check.IsNil)
+	c.Assert(got.GetPolicy(), check.Equals, data)
+}
+
+func (s *Suite) TestEnableRouteNotifiesPeers(c *check.C) {
+	user, err := app.db.CreateUser("routes")
+	c.Assert(err, check.IsNil)
+
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+
+	createNode := func(hostname string, ip string, routes []netip.Prefix) *types.Node {
+		ipv4 := netip.MustParseAddr(ip)
+		node := types.Node{
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			DiscoKey:       key.NewDisco().Public(),
+			Hostname:       hostname,
+			GivenName:      hostname,
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodCLI,
+			IPv4:           &ipv4,
+			Hostinfo:       &tailcfg.Hostinfo{RoutableIPs: routes},
+		}
+		c.Assert(app.db.DB.Save(&node).Error, check.IsNil)
+
+		return &node
+	}
+
+	router := createNode("router", "100.64.0.1", []netip.Prefix{prefix})
+	peer := createNode("peer", "100.64.0.2", nil)
+
+	_, err = app.db.SaveNodeRoutes(router)
+	c.Assert(err, check.IsNil)
+
+	routes, err := app.db.GetNodeRoutes(router)
+	c.Assert(err, check.IsNil)
+	c.Assert(routes, check.HasLen, 1)
+
+	updates := make(chan types.StateUpdate, 1)
+	app.nodeNotifier.AddNode(peer.ID, updates)
+	defer app.nodeNotifier.RemoveNode(peer.ID)
+
+	api := newHeadscaleV1APIServer(app)
+	_, err = api.EnableRoute(context.Background(), &v1.EnableRouteRequest{
+		RouteId: uint64(routes[0].ID),
+	})
+	c.Assert(err, check.IsNil)
+
+	// The update is queued for the peer by the call itself, not by
+	// the next map request of the peer.
+	var update types.StateUpdate
+	select {
+	case update = <-updates:
+	case <-time.After(time.Second):
+		c.Fatal("peer was not notified of the enabled route")
+	}
+	c.Assert(update.Type, check.Equals, types.StatePeerChanged)
+	c.Assert(update.ChangeNodes, check.DeepEquals, []types.NodeID{router.ID})
+
+	changed := make(map[types.NodeID]bool)
+	for _, nodeID := range update.ChangeNodes {
+		changed[nodeID] = true
+	}
+
+	m := mapper.NewMapper(app.db, app.cfg, &tailcfg.DERPMap{}, app.nodeNotifier.ConnectedMap())
+	data, err := m.PeerChangedResponse(tailcfg.MapRequest{}, peer, changed, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	// The response is prefixed with its size.
+	var resp tailcfg.MapResponse
+	c.Assert(json.Unmarshal(data[4:], &resp), check.IsNil)
+	c.Assert(resp.PeersChanged, check.HasLen, 1)
+	c.Assert(resp.PeersChanged[0].ID, check.Equals, tailcfg.NodeID(router.ID))
+	c.Assert(slices.Contains(resp.PeersChanged[0].PrimaryRoutes, prefix), check.Equals, true)
+}
+
+func (s *Suite) TestLockedNodeCannotBeDeleted(c *check.C) {
+	user, err := app.db.CreateUser("routers")
+	c.Assert(err, check.IsNil)
+
+	node := types.Node{
+		MachineKey:     key.NewMachine().Public(),
+		NodeKey:        key.NewNode().Public(),
+		Hostname:       "router",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodCLI,
+	}
+	c.Assert(app.db.DB.Save(&node).Error, check.IsNil)
+
+	api := newHeadscaleV1APIServer(app)
+
+	locked, err := api.LockNode(context.Background(), &v1.LockNodeRequest{NodeId: uint64(node.ID)})
+	c.Assert(err, check.IsNil)
+	c.Assert(locked.GetNode().GetLocked(), check.Equals, true)
+
+	_, err = api.DeleteNode(context.Background(), &v1.DeleteNodeRequest{NodeId: uint64(node.ID)})
+	c.Assert(types.ErrorCodeOf(err), check.Equals, types.CodeNodeLocked)
+
+	_, err = api.RenameNode(context.Background(), &v1.RenameNodeRequest{
+		NodeId:  uint64(node.ID),
+		NewName: "other",
+	})
+	c.Assert(types.ErrorCodeOf(err), check.Equals, types.CodeNodeLocked)
+
+	_, err = api.SetNodeMetadata(context.Background(), &v1.SetNodeMetadataRequest{
+		NodeId:   uint64(node.ID),
+		Metadata: map[string]string{"site": "par1"},
+	})
+	c.Assert(types.ErrorCodeOf(err), check.Equals, types.CodeNodeLocked)
+
+	_, err = api.SetNodeAllowedRoutes(context.Background(), &v1.SetNodeAllowedRoutesRequest{
+		NodeId: uint64(node.ID),
+		Routes: []string{"10.0.0.0/24"},
+	})
+	c.Assert(types.ErrorCodeOf(err), check.Equals, types.CodeNodeLocked)
+
+	_, err = api.AddNodeToGroup(context.Background(), &v1.AddNodeToGroupRequest{
+		Group:  "routers",
+		NodeId: uint64(node.ID),
+	})
+	c.Assert(headscaleErrorFromStatus(status.Convert(err)).Code, check.Equals, types.CodeNodeLocked)
+
+	unchanged, err := app.db.GetNodeByID(node.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(unchanged.GivenName, check.Equals, node.GivenName)
+	c.Assert(unchanged.Metadata, check.HasLen, 0)
+
+	// A forced change goes through.
+	_, err = api.DeleteNode(context.Background(), &v1.DeleteNodeRequest{
+		NodeId: uint64(node.ID),
+		Force:  true,
+	})
+	c.Assert(err, check.IsNil)
+
+	_, err = app.db.GetNodeByID(node.ID)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestGetNode(c *check.C) {
+	api := newHeadscaleV1APIServer(app)
+
+	_, err := api.GetNode(context.Background(), &v1.GetNodeRequest{NodeId: 42})
+	c.Assert(types.ErrorCodeOf(err), check.Equals, types.CodeNodeNotFound)
+
+	user, err := app.db.CreateUser("laptops")
+	c.Assert(err, check.IsNil)
+
+	node := types.Node{
+		MachineKey:     key.NewMachine().Public(),
+		NodeKey:        key.NewNode().Public(),
+		Hostname:       "laptop",
+		UserID:         user.ID,
+		RegisterMethod: util.RegisterMethodOIDC,
+		Hostinfo: &tailcfg.Hostinfo{
+			NetInfo: &tailcfg.NetInfo{PreferredDERP: 3},
+		},
+	}
+	c.Assert(app.db.DB.Save(&node).Error, check.IsNil)
+
+	resp, err := api.GetNode(context.Background(), &v1.GetNodeRequest{NodeId: uint64(node.ID)})
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.GetNode().GetName(), check.Equals, "laptop")
+	c.Assert(resp.GetNode().GetUser().GetName(), check.Equals, "laptops")
+	c.Assert(resp.GetNode().GetRegisterMethod(), check.Equals, v1.RegisterMethod_REGISTER_METHOD_OIDC)
+	c.Assert(resp.GetNode().GetPreferredDerp(), check.Equals, int32(3))
+	c.Assert(resp.GetNode().GetOnline(), check.Equals, false)
+}
@@ -11,6 +11,9 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/juanfont/headscale/hscontrol/derp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/rs/zerolog/log"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
@@ -29,8 +32,10 @@ const (
 	NoiseCapabilityVersion = 39
 
 	// TODO(juan): remove this once https://github.com/juanfont/headscale/issues/727 is fixed.
-	registrationHoldoff        = time.Second * 5
-	reservedResponseHeaderSize = 4
+	registrationHoldoff         = time.Second * 5
+	registrationFollowupTimeout = time.Minute
+	reservedResponseHeaderSize  = 4
+	maxDERPMapSize              = 1 << 20
 )
 
 var ErrRegisterMethodCLIDoesNotSupportExpire = errors.New(
@@ -59,9 +64,10 @@ func (h *Headscale) KeyHandler(
 	writer http.ResponseWriter,
 	req *http.Request,
 ) {
-	// New Tailscale clients send a 'v' parameter to indicate the CurrentCapabilityVersion
+	// New Tailscale clients send a 'v' parameter to indicate the CurrentCapabilityVersion,
+	// the oldest ones, using the legacy protocol, do not.
 	capVer, err := parseCabailityVersion(req)
-	if err != nil {
+	if err != nil && !errors.Is(err, ErrNoCapabilityVersion) {
 		log.Error().
 			Caller().
 			Err(err).
@@ -94,6 +100,21 @@ func (h *Headscale) KeyHandler(
 
 		return
 	}
+
+	// The legacy protocol, authenticating the machines over HTTPS
+	// without Noise, is not supported anymore. The old clients are
+	// told so, instead of being answered with an empty key.
+	log.Warn().
+		Caller().
+		Int("cap_ver", int(capVer)).
+		Int("min_version", int(NoiseCapabilityVersion)).
+		Str("remote_addr", req.RemoteAddr).
+		Msg("Client without Noise support connected, it has to be upgraded")
+	http.Error(
+		writer,
+		"This Tailscale client is too old, headscale only supports clients using the Noise protocol (/ts2021)",
+		http.StatusGone,
+	)
 }
 
 func (h *Headscale) HealthHandler(
@@ -134,6 +155,76 @@ func (h *Headscale) HealthHandler(
 	respond(nil)
 }
 
+// DERPRegionsHandler replaces the DERPMap served to the nodes with the
+// tailcfg.DERPMap in the request body, and pushes it to all connected
+// nodes. The map is kept in memory until the next scheduled DERP update
+// or `headscale derp reload`.
+func (h *Headscale) DERPRegionsHandler(
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	var derpMap tailcfg.DERPMap
+	body := http.MaxBytesReader(writer, req.Body, maxDERPMapSize)
+	if err := json.NewDecoder(body).Decode(&derpMap); err != nil {
+		http.Error(writer, fmt.Sprintf("decoding DERP map: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	if err := derp.ValidateDERPMap(&derpMap); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	h.setDERPMap(&derpMap, "api-derp-regions")
+
+	log.Info().
+		Int("regions", len(derpMap.Regions)).
+		Msg("DERPMap replaced through the API")
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(writer).Encode(&derpMap); err != nil {
+		log.Error().Caller().Err(err).Msg("Failed to write response")
+	}
+}
+
+// DebugFilterHandler writes the packet filter of the node given by the
+// node query parameter as JSON, with the source in the policy of each
+// rule. It is served on the debug listener only.
+func (h *Headscale) DebugFilterHandler(
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	nodeID, err := strconv.ParseUint(req.URL.Query().Get("node"), util.Base10, util.BitSize64)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("invalid node: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	node, err := h.db.GetNodeByID(types.NodeID(nodeID))
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("getting node %d: %s", nodeID, err), http.StatusNotFound)
+
+		return
+	}
+
+	filter, err := h.mapper.DebugFilter(node, h.ACLPolicy)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("compiling filter: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(writer).Encode(filter); err != nil {
+		log.Error().Caller().Err(err).Msg("Failed to write response")
+	}
+}
+
 type registerWebAPITemplateConfig struct {
 	Key string
 }
@@ -0,0 +1,268 @@
+package hscontrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/mapper"
+	"github.com/juanfont/headscale/hscontrol/notifier"
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestDERPRegionsHandler(t *testing.T) {
+	initial := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			900: {
+				RegionID:   900,
+				RegionCode: "initial",
+				Nodes: []*tailcfg.DERPNode{
+					{Name: "900a", RegionID: 900, HostName: "derp.example.com"},
+				},
+			},
+		},
+	}
+
+	cfg := &types.Config{
+		DNSConfig: &tailcfg.DNSConfig{},
+	}
+
+	h := &Headscale{
+		cfg:          cfg,
+		nodeNotifier: notifier.NewNotifier(),
+	}
+	h.derpMap.Store(initial)
+	h.mapper = mapper.NewMapper(nil, cfg, initial, h.nodeNotifier.ConnectedMap())
+
+	updates := make(chan types.StateUpdate, 1)
+	h.nodeNotifier.AddNode(1, updates)
+
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/derp/regions", bytes.NewBufferString(body))
+		rec := httptest.NewRecorder()
+		h.DERPRegionsHandler(rec, req)
+
+		return rec
+	}
+
+	invalid := []string{
+		`not json`,
+		`{"Regions": {}}`,
+		`{"Regions": {"901": {"RegionID": 902, "RegionCode": "a", "Nodes": [{"Name": "901a", "RegionID": 901, "HostName": "derp.example.com"}]}}}`,
+		`{"Regions": {"901": {"RegionID": 901, "RegionCode": "", "Nodes": [{"Name": "901a", "RegionID": 901, "HostName": "derp.example.com"}]}}}`,
+		`{"Regions": {"901": {"RegionID": 901, "RegionCode": "a", "Nodes": [{"Name": "901a", "RegionID": 901, "HostName": "not a hostname"}]}}}`,
+	}
+	for _, body := range invalid {
+		if rec := put(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: want status %d, got %d", body, http.StatusBadRequest, rec.Code)
+		}
+	}
+
+	if diff := cmp.Diff(initial, h.DERPMap()); diff != "" {
+		t.Fatalf("invalid maps changed the DERPMap (-want +got):\n%s", diff)
+	}
+
+	want := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			901: {
+				RegionID:   901,
+				RegionCode: "updated",
+				Nodes: []*tailcfg.DERPNode{
+					{Name: "901a", RegionID: 901, HostName: "derp2.example.com"},
+					{Name: "901b", RegionID: 901, HostName: "192.0.2.1"},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("marshalling DERP map: %s", err)
+	}
+
+	if rec := put(string(body)); rec.Code != http.StatusOK {
+		t.Fatalf("PUT: want status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	select {
+	case update := <-updates:
+		if update.Type != types.StateDERPUpdated {
+			t.Errorf("want update %s, got %s", types.StateDERPUpdated, update.Type)
+		}
+		if diff := cmp.Diff(want, update.DERPMap); diff != "" {
+			t.Errorf("unexpected DERPMap pushed to nodes (-want +got):\n%s", diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("DERPMap was not pushed to connected nodes within 5 seconds")
+	}
+
+	// The next map response of a node contains the new DERPMap.
+	expire := time.Now().Add(time.Hour)
+	ipv4 := netip.MustParseAddr("100.64.0.1")
+	node := &types.Node{
+		ID:        1,
+		IPv4:      &ipv4,
+		Hostname:  "node",
+		GivenName: "node",
+		User:      types.User{Name: "user"},
+		Expiry:    &expire,
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+
+	data, err := h.mapper.ReadOnlyMapResponse(tailcfg.MapRequest{}, node, nil)
+	if err != nil {
+		t.Fatalf("generating map response: %s", err)
+	}
+
+	var resp tailcfg.MapResponse
+	if err := json.Unmarshal(data[reservedResponseHeaderSize:], &resp); err != nil {
+		t.Fatalf("unmarshalling map response: %s", err)
+	}
+
+	if diff := cmp.Diff(want, resp.DERPMap); diff != "" {
+		t.Errorf("map response has unexpected DERPMap (-want +got):\n%s", diff)
+	}
+}
+
+func TestKeyHandler(t *testing.T) {
+	noisePrivateKey := key.NewMachine()
+	h := &Headscale{
+		noisePrivateKey: &noisePrivateKey,
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{name: "noise-client", query: "?v=58", wantStatus: http.StatusOK},
+		{name: "legacy-client", query: "?v=30", wantStatus: http.StatusGone},
+		{name: "no-version", query: "", wantStatus: http.StatusGone},
+		{name: "invalid-version", query: "?v=abc", wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.KeyHandler(rec, httptest.NewRequest(http.MethodGet, "/key"+tt.query, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp tailcfg.OverTLSPublicKeyResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("decoding response: %s", err)
+			}
+			if resp.PublicKey != noisePrivateKey.Public() {
+				t.Errorf("public key = %s, want %s", resp.PublicKey, noisePrivateKey.Public())
+			}
+		})
+	}
+}
+
+func TestNoiseUpgradeHandlerProtocol(t *testing.T) {
+	h := &Headscale{}
+
+	tests := []struct {
+		name       string
+		upgrade    string
+		wantStatus int
+	}{
+		{name: "no-upgrade", upgrade: "", wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, ts2021UpgradePath, nil)
+			if tt.upgrade != "" {
+				req.Header.Set("Upgrade", tt.upgrade)
+			}
+
+			rec := httptest.NewRecorder()
+			h.NoiseUpgradeHandler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func (s *Suite) TestDebugFilterHandler(c *check.C) {
+	createNode := func(username string, ip string) *types.Node {
+		user, err := app.db.CreateUser(username)
+		c.Assert(err, check.IsNil)
+
+		ipv4 := netip.MustParseAddr(ip)
+		node := types.Node{
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			Hostname:       username,
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodCLI,
+			IPv4:           &ipv4,
+		}
+		c.Assert(app.db.DB.Save(&node).Error, check.IsNil)
+
+		return &node
+	}
+
+	alice := createNode("alice", "100.64.0.1")
+	bob := createNode("bob", "100.64.0.2")
+
+	app.ACLPolicy = &policy.ACLPolicy{
+		ACLs: []policy.ACL{
+			{Action: "accept", Sources: []string{"alice"}, Destinations: []string{"bob:22"}},
+		},
+	}
+	app.mapper = mapper.NewMapper(app.db, app.cfg, &tailcfg.DERPMap{}, app.nodeNotifier.ConnectedMap())
+
+	get := func(node string) (*httptest.ResponseRecorder, mapper.DebugFilter) {
+		req := httptest.NewRequest(http.MethodGet, "/debug/filter?node="+node, nil)
+		rec := httptest.NewRecorder()
+		app.DebugFilterHandler(rec, req)
+
+		var filter mapper.DebugFilter
+		if rec.Code == http.StatusOK {
+			c.Assert(json.NewDecoder(rec.Body).Decode(&filter), check.IsNil)
+		}
+
+		return rec, filter
+	}
+
+	// The rule reaches bob, and comes from the first rule of the policy.
+	rec, filter := get(fmt.Sprint(bob.ID))
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+	c.Assert(filter.Filter, check.HasLen, 1)
+	c.Assert(filter.PacketFilter, check.HasLen, 1)
+	c.Assert(filter.PacketFilter[0].Source.ACL, check.NotNil)
+	c.Assert(*filter.PacketFilter[0].Source.ACL, check.Equals, 0)
+	c.Assert(filter.PacketFilter[0].Rule.SrcIPs, check.DeepEquals, []string{"100.64.0.1/32"})
+
+	// Alice gets no rule, nothing reaches her.
+	rec, filter = get(fmt.Sprint(alice.ID))
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+	c.Assert(filter.Filter, check.HasLen, 1)
+	c.Assert(filter.PacketFilter, check.HasLen, 0)
+
+	rec, _ = get("not-a-node")
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+
+	rec, _ = get("1000")
+	c.Assert(rec.Code, check.Equals, http.StatusNotFound)
+}
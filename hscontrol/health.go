@@ -0,0 +1,343 @@
+package hscontrol
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	// healthCheckTimeout is how long a subsystem has to answer a
+	// health check before it is reported down.
+	healthCheckTimeout = 5 * time.Second
+
+	// healthDegradedLatency is the latency above which a subsystem
+	// answering health checks is reported degraded.
+	healthDegradedLatency = 500 * time.Millisecond
+
+	// healthCheckInterval is how often the subsystems are checked, the
+	// requests to /healthz are answered with the last check.
+	healthCheckInterval = 30 * time.Second
+
+	defaultDERPPort = 443
+)
+
+type healthStatus string
+
+const (
+	healthOK       healthStatus = "ok"
+	healthDegraded healthStatus = "degraded"
+	healthDown     healthStatus = "down"
+)
+
+var (
+	errHealthBadStatus        = errors.New("unexpected status")
+	errHealthGRPCNotStarted   = errors.New("gRPC server not started")
+	errHealthGRPCNotServing   = errors.New("gRPC server not serving")
+	errHealthNoDERPRegions    = errors.New("no DERP regions")
+	errHealthDERPUnreachable  = errors.New("DERP regions unreachable")
+	errHealthDERPPartialReach = errors.New("some DERP regions unreachable")
+)
+
+// subsystemHealth is the health of a subsystem reported by /healthz.
+type subsystemHealth struct {
+	Status    healthStatus `json:"status"`
+	LatencyMS int64        `json:"latency_ms"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// healthResponse is the body of /healthz, status is the worst status of
+// the subsystems when they were checked, at CheckedAt.
+type healthResponse struct {
+	Status     healthStatus               `json:"status"`
+	CheckedAt  time.Time                  `json:"checked_at"`
+	Subsystems map[string]subsystemHealth `json:"subsystems"`
+}
+
+// newSubsystemHealth returns the health of a subsystem which answered a
+// check in latency, with err if the check failed.
+func newSubsystemHealth(latency time.Duration, err error) subsystemHealth {
+	health := subsystemHealth{
+		Status:    healthOK,
+		LatencyMS: latency.Milliseconds(),
+	}
+
+	switch {
+	case err != nil:
+		health.Status = healthDown
+		health.Error = err.Error()
+	case latency > healthDegradedLatency:
+		health.Status = healthDegraded
+	}
+
+	return health
+}
+
+// timeHealthCheck runs check and returns the health of the subsystem it
+// checks.
+func timeHealthCheck(ctx context.Context, check func(context.Context) error) subsystemHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+
+	return newSubsystemHealth(time.Since(start), err)
+}
+
+// HealthzHandler reports the health of the subsystems of headscale: the
+// database, the DERP servers, the OIDC provider if one is configured and
+// the gRPC server, as last checked by healthCheckWorker. It answers 200 if
+// they are all ok, 207 if some are degraded and 503 if any is down or if
+// they have not been checked yet.
+func (h *Headscale) HealthzHandler(
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	resp := h.health.Load()
+	if resp == nil {
+		resp = &healthResponse{
+			Status:     healthDown,
+			Subsystems: map[string]subsystemHealth{},
+		}
+	}
+
+	httpStatus := http.StatusOK
+	switch resp.Status {
+	case healthDegraded:
+		httpStatus = http.StatusMultiStatus
+	case healthDown:
+		httpStatus = http.StatusServiceUnavailable
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(httpStatus)
+	if err := json.NewEncoder(writer).Encode(resp); err != nil {
+		log.Error().
+			Caller().
+			Err(err).
+			Msg("Failed to write response")
+	}
+}
+
+// healthCheckWorker checks the health of the subsystems when started and
+// then every interval, for HealthzHandler to serve.
+func (h *Headscale) healthCheckWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h.health.Store(h.checkHealth(ctx))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth checks the subsystems of headscale at once.
+func (h *Headscale) checkHealth(ctx context.Context) *healthResponse {
+	checks := map[string]func(context.Context) subsystemHealth{
+		"database": func(ctx context.Context) subsystemHealth {
+			return timeHealthCheck(ctx, h.db.PingDB)
+		},
+		"derp": h.checkDERPHealth,
+		"grpc": func(ctx context.Context) subsystemHealth {
+			return timeHealthCheck(ctx, h.checkGRPCHealth)
+		},
+	}
+	if h.cfg.OIDC.Issuer != "" {
+		checks["oidc"] = func(ctx context.Context) subsystemHealth {
+			return timeHealthCheck(ctx, h.checkOIDCHealth)
+		}
+	}
+
+	resp := &healthResponse{
+		Status:     healthOK,
+		CheckedAt:  time.Now().UTC(),
+		Subsystems: make(map[string]subsystemHealth, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) subsystemHealth) {
+			defer wg.Done()
+
+			health := check(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Subsystems[name] = health
+		}(name, check)
+	}
+	wg.Wait()
+
+	for name, health := range resp.Subsystems {
+		if health.Status == healthOK {
+			continue
+		}
+
+		log.Warn().
+			Str("subsystem", name).
+			Str("status", string(health.Status)).
+			Str("error", health.Error).
+			Msg("Health check failed")
+
+		if resp.Status != healthDown {
+			resp.Status = health.Status
+		}
+	}
+
+	return resp
+}
+
+func (h *Headscale) checkGRPCHealth(ctx context.Context) error {
+	if h.grpcHealthClient == nil {
+		return errHealthGRPCNotStarted
+	}
+
+	resp, err := h.grpcHealthClient.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+
+	if resp.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("%w: %s", errHealthGRPCNotServing, resp.GetStatus())
+	}
+
+	return nil
+}
+
+// checkOIDCHealth fetches the discovery document of the OIDC provider.
+func (h *Headscale) checkOIDCHealth(ctx context.Context) error {
+	url := strings.TrimSuffix(h.cfg.OIDC.Issuer, "/") + "/.well-known/openid-configuration"
+
+	return healthProbe(ctx, http.DefaultClient, url)
+}
+
+// checkDERPHealth probes the DERP regions of the DERPMap. DERP is
+// degraded if only some regions can be reached and down if none can.
+func (h *Headscale) checkDERPHealth(ctx context.Context) subsystemHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+
+	derpMap := h.DERPMap()
+	if derpMap == nil || len(derpMap.Regions) == 0 {
+		return newSubsystemHealth(time.Since(start), errHealthNoDERPRegions)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	reachable := 0
+	for _, region := range derpMap.Regions {
+		wg.Add(1)
+		go func(region *tailcfg.DERPRegion) {
+			defer wg.Done()
+
+			if probeDERPRegion(ctx, region) {
+				mu.Lock()
+				defer mu.Unlock()
+				reachable++
+			}
+		}(region)
+	}
+	wg.Wait()
+
+	latency := time.Since(start)
+
+	switch {
+	case reachable == 0:
+		return newSubsystemHealth(latency, errHealthDERPUnreachable)
+	case reachable < len(derpMap.Regions):
+		health := newSubsystemHealth(latency, nil)
+		health.Status = healthDegraded
+		health.Error = fmt.Sprintf(
+			"%s: %d of %d reachable",
+			errHealthDERPPartialReach,
+			reachable,
+			len(derpMap.Regions),
+		)
+
+		return health
+	}
+
+	return newSubsystemHealth(latency, nil)
+}
+
+// probeDERPRegion reports if one of the DERP servers of the region
+// answers on /derp/probe.
+func probeDERPRegion(ctx context.Context, region *tailcfg.DERPRegion) bool {
+	for _, node := range region.Nodes {
+		if node.STUNOnly {
+			continue
+		}
+
+		port := node.DERPPort
+		if port == 0 {
+			port = defaultDERPPort
+		}
+
+		client := http.DefaultClient
+		if node.InsecureForTests {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+			client = &http.Client{Transport: transport}
+		}
+
+		url := fmt.Sprintf(
+			"https://%s/derp/probe",
+			net.JoinHostPort(node.HostName, strconv.Itoa(port)),
+		)
+		if err := healthProbe(ctx, client, url); err != nil {
+			log.Debug().
+				Err(err).
+				Str("region", region.RegionCode).
+				Str("node", node.Name).
+				Msg("DERP server unreachable")
+
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// healthProbe GETs url and expects a 200.
+func healthProbe(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", errHealthBadStatus, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+)
+
+type fakeGRPCHealthClient struct {
+	grpc_health_v1.HealthClient
+	status grpc_health_v1.HealthCheckResponse_ServingStatus
+}
+
+func (f fakeGRPCHealthClient) Check(
+	context.Context,
+	*grpc_health_v1.HealthCheckRequest,
+	...grpc.CallOption,
+) (*grpc_health_v1.HealthCheckResponse, error) {
+	return &grpc_health_v1.HealthCheckResponse{Status: f.status}, nil
+}
+
+func healthzDERPNode(c *check.C, server *httptest.Server, regionID int) *tailcfg.DERPNode {
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	c.Assert(err, check.IsNil)
+	derpPort, err := strconv.Atoi(port)
+	c.Assert(err, check.IsNil)
+
+	return &tailcfg.DERPNode{
+		Name:             strconv.Itoa(regionID) + "a",
+		RegionID:         regionID,
+		HostName:         host,
+		DERPPort:         derpPort,
+		InsecureForTests: true,
+	}
+}
+
+func (s *Suite) TestHealthz(c *check.C) {
+	probe := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/derp/probe" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer probe.Close()
+
+	unreachable := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer unreachable.Close()
+
+	app.derpMap.Store(&tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			900: {
+				RegionID: 900,
+				Nodes:    []*tailcfg.DERPNode{healthzDERPNode(c, probe, 900)},
+			},
+		},
+	})
+	app.grpcHealthClient = fakeGRPCHealthClient{status: grpc_health_v1.HealthCheckResponse_SERVING}
+
+	serve := func() (int, healthResponse) {
+		recorder := httptest.NewRecorder()
+		app.HealthzHandler(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+		var resp healthResponse
+		c.Assert(json.NewDecoder(recorder.Body).Decode(&resp), check.IsNil)
+
+		return recorder.Code, resp
+	}
+
+	healthz := func() (int, healthResponse) {
+		app.health.Store(app.checkHealth(context.Background()))
+
+		return serve()
+	}
+
+	// Nothing has been checked yet.
+	app.health.Store(nil)
+	code, resp := serve()
+	c.Assert(code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(resp.Status, check.Equals, healthDown)
+
+	code, resp = healthz()
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(resp.Status, check.Equals, healthOK)
+	c.Assert(resp.Subsystems, check.HasLen, 3)
+	for name, health := range resp.Subsystems {
+		c.Assert(health.Status, check.Equals, healthOK, check.Commentf("subsystem %s", name))
+	}
+
+	// One of two DERP regions cannot be reached.
+	app.DERPMap().Regions[901] = &tailcfg.DERPRegion{
+		RegionID: 901,
+		Nodes:    []*tailcfg.DERPNode{healthzDERPNode(c, unreachable, 901)},
+	}
+
+	// The requests are answered with the last check.
+	code, resp = serve()
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(resp.Subsystems["derp"].Status, check.Equals, healthOK)
+
+	code, resp = healthz()
+	c.Assert(code, check.Equals, http.StatusMultiStatus)
+	c.Assert(resp.Status, check.Equals, healthDegraded)
+	c.Assert(resp.Subsystems["derp"].Status, check.Equals, healthDegraded)
+
+	// The gRPC server is not serving.
+	app.grpcHealthClient = fakeGRPCHealthClient{status: grpc_health_v1.HealthCheckResponse_NOT_SERVING}
+
+	code, resp = healthz()
+	c.Assert(code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(resp.Status, check.Equals, healthDown)
+	c.Assert(resp.Subsystems["grpc"].Status, check.Equals, healthDown)
+
+	// The database is gone.
+	app.grpcHealthClient = fakeGRPCHealthClient{status: grpc_health_v1.HealthCheckResponse_SERVING}
+	c.Assert(app.db.Close(), check.IsNil)
+
+	code, resp = healthz()
+	c.Assert(code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(resp.Subsystems["database"].Status, check.Equals, healthDown)
+	c.Assert(resp.Subsystems["grpc"].Status, check.Equals, healthOK)
+}
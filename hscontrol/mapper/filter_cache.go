@@ -0,0 +1,189 @@
+package mapper
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"slices"
+	"sync"
+
+	"github.com/juanfont/headscale/hscontrol/policy"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+// filterCacheSize is the number of node sets the compiled filters are kept
+// for. All the nodes share the same node set, the few others come from
+// the expired peers left out of the filters.
+const filterCacheSize = 8
+
+// filterCache keeps the filter rules compiled for a policy and a node set,
+// the rules reduced for each node and the destinations of the SSH rules,
+// so the policy is not expanded again for every map response. An entry is used as long as the policy and the
+// nodes it was compiled for are the same, a new policy or a change to a
+// node the rules depend on compiles the rules again.
+type filterCache struct {
+	seed maphash.Seed
+
+	mu      sync.Mutex
+	entries []*filterCacheEntry
+}
+
+type filterCacheKey struct {
+	pol   *policy.ACLPolicy
+	nodes uint64
+	count int
+}
+
+type filterCacheEntry struct {
+	key   filterCacheKey
+	rules []tailcfg.FilterRule
+
+	// sshDestinations are the nodes given the SSH capability.
+	sshDestinations map[types.NodeID]bool
+
+	mu      sync.Mutex
+	reduced map[types.NodeID][]tailcfg.FilterRule
+}
+
+func newFilterCache() *filterCache {
+	return &filterCache{
+		seed: maphash.MakeSeed(),
+	}
+}
+
+// rules returns the filter rules of pol for nodes, compiled by compile,
+// and the SSH destinations among nodes, unless they are cached. The rules are shared, they must not be
+// modified. A nil cache compiles the rules on every call.
+func (c *filterCache) rules(
+	pol *policy.ACLPolicy,
+	nodes types.Nodes,
+	compile func() ([]tailcfg.FilterRule, error),
+) (*filterCacheEntry, error) {
+	if c == nil {
+		rules, err := compile()
+		if err != nil {
+			return nil, err
+		}
+
+		return &filterCacheEntry{
+			rules:           rules,
+			sshDestinations: pol.SSHDestinations(nodes),
+			reduced:         make(map[types.NodeID][]tailcfg.FilterRule),
+		}, nil
+	}
+
+	key := filterCacheKey{
+		pol:   pol,
+		nodes: c.fingerprint(nodes),
+		count: len(nodes),
+	}
+
+	// The lock is held while compiling, so the nodes asking for the same
+	// rules at once wait for them instead of compiling them each.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for index, entry := range c.entries {
+		if entry.key == key {
+			// Keep the entries used last at the end.
+			c.entries = append(slices.Delete(c.entries, index, index+1), entry)
+
+			return entry, nil
+		}
+	}
+
+	rules, err := compile()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &filterCacheEntry{
+		key:             key,
+		rules:           rules,
+		sshDestinations: pol.SSHDestinations(nodes),
+		reduced:         make(map[types.NodeID][]tailcfg.FilterRule),
+	}
+
+	// The entries of another policy are not used again.
+	c.entries = slices.DeleteFunc(c.entries, func(other *filterCacheEntry) bool {
+		return other.key.pol != pol
+	})
+	if len(c.entries) >= filterCacheSize {
+		c.entries = slices.Delete(c.entries, 0, len(c.entries)-filterCacheSize+1)
+	}
+	c.entries = append(c.entries, entry)
+
+	return entry, nil
+}
+
+// reducedRules returns the rules of the entry reduced to node, which is
+// one of the nodes the rules were compiled for.
+func (e *filterCacheEntry) reducedRules(node *types.Node) []tailcfg.FilterRule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if rules, ok := e.reduced[node.ID]; ok {
+		return rules
+	}
+
+	rules := policy.ReduceFilterRules(node, e.rules)
+	e.reduced[node.ID] = rules
+
+	return rules
+}
+
+// fingerprint hashes the fields of nodes the filter rules are compiled
+// from: their addresses, user, tags and routes. It does not depend on the
+// order of the nodes.
+func (c *filterCache) fingerprint(nodes types.Nodes) uint64 {
+	var sum uint64
+	var hash maphash.Hash
+	hash.SetSeed(c.seed)
+
+	for _, node := range nodes {
+		hash.Reset()
+
+		var id [8]byte
+		binary.LittleEndian.PutUint64(id[:], node.ID.Uint64())
+		hash.Write(id[:])
+
+		for _, ip := range node.IPs() {
+			hash.Write(ip.AsSlice())
+		}
+		hash.WriteByte(0)
+
+		hash.WriteString(node.User.Name)
+		hash.WriteByte(0)
+
+		for _, tag := range node.ForcedTags {
+			hash.WriteString(tag)
+			hash.WriteByte(0)
+		}
+		hash.WriteByte(0)
+
+		if node.AuthKey != nil {
+			for _, tag := range node.AuthKey.ACLTags {
+				hash.WriteString(tag.Tag)
+				hash.WriteByte(0)
+			}
+		}
+		hash.WriteByte(0)
+
+		if node.Hostinfo != nil {
+			for _, tag := range node.Hostinfo.RequestTags {
+				hash.WriteString(tag)
+				hash.WriteByte(0)
+			}
+			hash.WriteByte(0)
+
+			for _, prefix := range node.Hostinfo.RoutableIPs {
+				hash.WriteString(prefix.String())
+				hash.WriteByte(0)
+			}
+		}
+
+		sum += hash.Sum64()
+	}
+
+	return sum
+}
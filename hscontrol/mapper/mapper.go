@@ -53,9 +53,13 @@ type Mapper struct {
 	// TODO(kradalby): figure out if this is the format we want this in
 	db                *db.HSDatabase
 	cfg               *types.Config
-	derpMap           *tailcfg.DERPMap
+	derpMap           atomic.Pointer[tailcfg.DERPMap]
 	isLikelyConnected types.NodeConnectedMap
 
+	// filters keeps the filter rules compiled for the policy, shared by
+	// the map responses of all the nodes.
+	filters *filterCache
+
 	uid     string
 	created time.Time
 	seq     uint64
@@ -74,16 +78,26 @@ func NewMapper(
 ) *Mapper {
 	uid, _ := util.GenerateRandomStringDNSSafe(mapperIDLength)
 
-	return &Mapper{
+	mapper := &Mapper{
 		db:                db,
 		cfg:               cfg,
-		derpMap:           derpMap,
 		isLikelyConnected: isLikelyConnected,
+		filters:           newFilterCache(),
 
 		uid:     uid,
 		created: time.Now(),
 		seq:     0,
 	}
+	mapper.derpMap.Store(derpMap)
+
+	return mapper
+}
+
+// SetDERPMap replaces the DERPMap sent to nodes in full map responses.
+// It is independent of connected nodes, so nodes registering after a
+// DERPMap update get the new one even if no update was sent before.
+func (m *Mapper) SetDERPMap(derpMap *tailcfg.DERPMap) {
+	m.derpMap.Store(derpMap)
 }
 
 func (m *Mapper) String() string {
@@ -111,9 +125,10 @@ func generateUserProfiles(
 
 		profiles = append(profiles,
 			tailcfg.UserProfile{
-				ID:          tailcfg.UserID(user.ID),
-				LoginName:   user.Name,
-				DisplayName: displayName,
+				ID:            tailcfg.UserID(user.ID),
+				LoginName:     user.Name,
+				DisplayName:   displayName,
+				ProfilePicURL: user.AvatarURL,
 			})
 	}
 
@@ -141,13 +156,13 @@ func generateDNSConfig(
 			),
 		)
 
-		userSet := mapset.NewSet[types.User]()
-		userSet.Add(node.User)
+		userSet := mapset.NewSet[string]()
+		userSet.Add(node.User.Name)
 		for _, p := range peers {
-			userSet.Add(p.User)
+			userSet.Add(p.User.Name)
 		}
 		for _, user := range userSet.ToSlice() {
-			dnsRoute := fmt.Sprintf("%v.%v", user.Name, baseDomain)
+			dnsRoute := fmt.Sprintf("%v.%v", user, baseDomain)
 			dnsConfig.Routes[dnsRoute] = nil
 		}
 	} else {
@@ -196,9 +211,16 @@ func (m *Mapper) fullMapResponse(
 		return nil, err
 	}
 
+	if m.failsPosture(node) {
+		peers = types.Nodes{}
+	}
+	peers = m.withoutFailedPosture(peers)
+	resp.Health = m.postureHealth(node)
+
 	err = appendPeerChanges(
 		resp,
 		true, // full change
+		m.filters,
 		pol,
 		node,
 		capVer,
@@ -233,6 +255,74 @@ func (m *Mapper) FullMapResponse(
 	return m.marshalMapResponse(mapRequest, resp, node, mapRequest.Compress, messages...)
 }
 
+// DebugMapResponse returns the full MapResponse the node would receive
+// with the current state, without sending it.
+func (m *Mapper) DebugMapResponse(
+	node *types.Node,
+	pol *policy.ACLPolicy,
+) (*tailcfg.MapResponse, error) {
+	peers, err := m.ListPeers(node.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.fullMapResponse(node, peers, pol, tailcfg.CurrentCapabilityVersion)
+}
+
+// DebugFilter is the packet filter of a node, with the source in the
+// policy of each rule.
+type DebugFilter struct {
+	// Filter is the filter compiled for the node and its peers.
+	Filter []policy.SourcedFilterRule `json:"filter"`
+
+	// PacketFilter is the filter reduced to the rules the node receives.
+	PacketFilter []policy.SourcedFilterRule `json:"packetFilter"`
+}
+
+// DebugFilter returns the packet filter the node would receive with the
+// current state, compiled like in its map responses.
+func (m *Mapper) DebugFilter(
+	node *types.Node,
+	pol *policy.ACLPolicy,
+) (*DebugFilter, error) {
+	peers, err := m.ListPeers(node.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.failsPosture(node) {
+		peers = types.Nodes{}
+	}
+	nodes := append(removeExpired(m.withoutFailedPosture(peers)), node)
+
+	var rules []policy.SourcedFilterRule
+	if pol == nil && m.cfg.ACL.DefaultPolicy == types.DefaultPolicyUserIsolated {
+		rules = policy.SourceFilterRules(policy.UserIsolationFilterRules(nodes, m.cfg.ACL.SharedTags), nil)
+	} else {
+		rules, err = pol.CompileSourcedFilterRules(nodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filter := make([]tailcfg.FilterRule, len(rules))
+	for index, rule := range rules {
+		filter[index] = rule.Rule
+	}
+	filter, err = expandNodeBlocks(filter, nodes, m.cfg.PerNodePrefixLen)
+	if err != nil {
+		return nil, err
+	}
+	for index := range rules {
+		rules[index].Rule = filter[index]
+	}
+
+	return &DebugFilter{
+		Filter:       rules,
+		PacketFilter: policy.ReduceSourcedFilterRules(node, rules),
+	}, nil
+}
+
 // ReadOnlyResponse returns a MapResponse for the given node.
 // Lite means that the peers has been omitted, this is intended
 // to be used to answer MapRequests with OmitPeers set to true.
@@ -265,7 +355,7 @@ func (m *Mapper) DERPMapResponse(
 	node *types.Node,
 	derpMap *tailcfg.DERPMap,
 ) ([]byte, error) {
-	m.derpMap = derpMap
+	m.SetDERPMap(derpMap)
 
 	resp := m.baseMapResponse()
 	resp.DERPMap = derpMap
@@ -288,6 +378,11 @@ func (m *Mapper) PeerChangedResponse(
 		return nil, err
 	}
 
+	if m.failsPosture(node) {
+		peers = types.Nodes{}
+	}
+	resp.Health = m.postureHealth(node)
+
 	var removedIDs []tailcfg.NodeID
 	var changedIDs []types.NodeID
 	for nodeID, nodeChanged := range changed {
@@ -298,16 +393,26 @@ func (m *Mapper) PeerChangedResponse(
 		}
 	}
 
+	// The changed peers failing their device posture check are
+	// removed, the node can have received them before they failed it.
 	changedNodes := make(types.Nodes, 0, len(changedIDs))
 	for _, peer := range peers {
 		if slices.Contains(changedIDs, peer.ID) {
+			if m.failsPosture(peer) {
+				removedIDs = append(removedIDs, peer.ID.NodeID())
+
+				continue
+			}
+
 			changedNodes = append(changedNodes, peer)
 		}
 	}
+	peers = m.withoutFailedPosture(peers)
 
 	err = appendPeerChanges(
 		&resp,
 		false, // partial change
+		m.filters,
 		pol,
 		node,
 		mapRequest.Version,
@@ -338,7 +443,7 @@ func (m *Mapper) PeerChangedResponse(
 
 	// Add the node itself, it might have changed, and particularly
 	// if there are no patches or changes, this is a self update.
-	tailnode, err := tailNode(node, mapRequest.Version, pol, m.cfg)
+	tailnode, err := tailNode(node, mapRequest.Version, pol, pol.IsSSHDestination(node), m.cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -487,13 +592,15 @@ func (m *Mapper) baseWithConfigMapResponse(
 ) (*tailcfg.MapResponse, error) {
 	resp := m.baseMapResponse()
 
-	tailnode, err := tailNode(node, capVer, pol, m.cfg)
+	tailnode, err := tailNode(node, capVer, pol, pol.IsSSHDestination(node), m.cfg)
 	if err != nil {
 		return nil, err
 	}
 	resp.Node = tailnode
 
-	resp.DERPMap = m.derpMap
+	// The DERPMap is always sent, also to nodes without any peers,
+	// as clients need it to find relays on their first connection.
+	resp.DERPMap = m.derpMap.Load()
 
 	resp.Domain = m.cfg.BaseDomain
 
@@ -510,6 +617,39 @@ func (m *Mapper) baseWithConfigMapResponse(
 	return &resp, nil
 }
 
+// failsPosture reports whether the node failed its last device posture
+// check, nodes failing it are not sent any peers, nor sent as peers.
+func (m *Mapper) failsPosture(node *types.Node) bool {
+	return len(m.cfg.PosturePolicy.Rules) > 0 && node.PostureError != ""
+}
+
+// withoutFailedPosture returns the peers that did not fail their last
+// device posture check, the nodes failing it are not sent to others
+// either.
+func (m *Mapper) withoutFailedPosture(peers types.Nodes) types.Nodes {
+	if len(m.cfg.PosturePolicy.Rules) == 0 {
+		return peers
+	}
+
+	return slices.DeleteFunc(slices.Clone(peers), m.failsPosture)
+}
+
+// postureHealth returns the health problems to report to the node about
+// its device posture, or nil if there is no posture policy.
+func (m *Mapper) postureHealth(node *types.Node) []string {
+	if len(m.cfg.PosturePolicy.Rules) == 0 {
+		return nil
+	}
+
+	if node.PostureError == "" {
+		return []string{}
+	}
+
+	return []string{
+		fmt.Sprintf("This device has no access to its peers: %s", node.PostureError),
+	}
+}
+
 func (m *Mapper) ListPeers(nodeID types.NodeID) (types.Nodes, error) {
 	peers, err := m.db.ListPeers(nodeID)
 	if err != nil {
@@ -524,6 +664,36 @@ func (m *Mapper) ListPeers(nodeID types.NodeID) (types.Nodes, error) {
 	return peers, nil
 }
 
+// limitRoutes returns copies of the peers with only the routes viewer
+// sees, if it is limited to some routes. Otherwise, the peers are
+// returned unchanged.
+func limitRoutes(peers types.Nodes, viewer *types.Node) types.Nodes {
+	if !viewer.LimitsRoutes() {
+		return peers
+	}
+
+	limited := make(types.Nodes, len(peers))
+	for index, peer := range peers {
+		peerCopy := *peer
+		peerCopy.Routes = types.Routes(peer.Routes).AllowedBy(viewer)
+		limited[index] = &peerCopy
+	}
+
+	return limited
+}
+
+// removeExpired returns the nodes which have not expired.
+func removeExpired(nodes types.Nodes) types.Nodes {
+	ret := make(types.Nodes, 0, len(nodes))
+	for _, node := range nodes {
+		if !node.IsExpired() {
+			ret = append(ret, node)
+		}
+	}
+
+	return ret
+}
+
 func nodeMapToList(nodes map[uint64]*types.Node) types.Nodes {
 	ret := make(types.Nodes, 0)
 
@@ -534,12 +704,50 @@ func nodeMapToList(nodes map[uint64]*types.Node) types.Nodes {
 	return ret
 }
 
+// compileFilterRules compiles the filter rules of pol for nodes, or
+// returns them from filters if they were compiled for the same nodes.
+// Without a policy, the default policy of the configuration applies.
+func compileFilterRules(
+	filters *filterCache,
+	pol *policy.ACLPolicy,
+	nodes types.Nodes,
+	cfg *types.Config,
+) (*filterCacheEntry, error) {
+	return filters.rules(pol, nodes, func() ([]tailcfg.FilterRule, error) {
+		var rules []tailcfg.FilterRule
+		if pol == nil && cfg.ACL.DefaultPolicy == types.DefaultPolicyUserIsolated {
+			rules = policy.UserIsolationFilterRules(nodes, cfg.ACL.SharedTags)
+		} else {
+			var err error
+			rules, err = pol.CompileFilterRules(nodes)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return expandNodeBlocks(rules, nodes, cfg.PerNodePrefixLen)
+	})
+}
+
+// hideDERPOnlyEndpoints removes the endpoints of all the peers if node
+// belongs to a DERP-only user, and of the peers belonging to one
+// otherwise, so no direct path is given to the clients. tailPeers are
+// the peers in the order of peers.
+func hideDERPOnlyEndpoints(node *types.Node, peers types.Nodes, tailPeers []*tailcfg.Node) {
+	for index, peer := range peers {
+		if node.User.DERPOnly || peer.User.DERPOnly {
+			tailPeers[index].Endpoints = nil
+		}
+	}
+}
+
 // appendPeerChanges mutates a tailcfg.MapResponse with all the
 // necessary changes when peers have changed.
 func appendPeerChanges(
 	resp *tailcfg.MapResponse,
 
 	fullChange bool,
+	filters *filterCache,
 	pol *policy.ACLPolicy,
 	node *types.Node,
 	capVer tailcfg.CapabilityVersion,
@@ -548,20 +756,35 @@ func appendPeerChanges(
 	cfg *types.Config,
 ) error {
 
-	packetFilter, err := pol.CompileFilterRules(append(peers, node))
-	if err != nil {
-		return err
-	}
-
-	sshPolicy, err := pol.CompileSSHPolicy(node, peers)
+	packetFilter, err := compileFilterRules(filters, pol, append(peers, node), cfg)
 	if err != nil {
 		return err
 	}
 
 	// If there are filter rules present, see if there are any nodes that cannot
 	// access eachother at all and remove them from the peers.
-	if len(packetFilter) > 0 {
-		changed = policy.FilterNodesByACL(node, changed, packetFilter)
+	if len(packetFilter.rules) > 0 {
+		changed = policy.FilterNodesByACL(node, changed, packetFilter.rules)
+	}
+
+	// The SSH destinations are expanded with the filter rules, once per
+	// policy and node set.
+	sshDestinations := packetFilter.sshDestinations
+
+	// Expired peers are still sent, marked as expired so the node drops
+	// them, but their addresses are left out of the packet filter and SSH
+	// policy so no traffic reaches them before they are deleted.
+	activePeers := removeExpired(peers)
+	if len(activePeers) != len(peers) {
+		packetFilter, err = compileFilterRules(filters, pol, append(activePeers, node), cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	sshPolicy, err := pol.CompileSSHPolicy(node, activePeers)
+	if err != nil {
+		return err
 	}
 
 	profiles := generateUserProfiles(node, changed, cfg.BaseDomain)
@@ -573,10 +796,14 @@ func appendPeerChanges(
 		peers,
 	)
 
-	tailPeers, err := tailNodes(changed, capVer, pol, cfg)
+	// The node only gets the routes of its peers it is allowed to use.
+	changed = limitRoutes(changed, node)
+
+	tailPeers, err := tailNodes(changed, capVer, pol, sshDestinations, cfg)
 	if err != nil {
 		return err
 	}
+	hideDERPOnlyEndpoints(node, changed, tailPeers)
 
 	// Peers is always returned sorted by Node.ID.
 	sort.SliceStable(tailPeers, func(x, y int) bool {
@@ -589,7 +816,7 @@ func appendPeerChanges(
 		resp.PeersChanged = tailPeers
 	}
 	resp.DNSConfig = dnsConfig
-	resp.PacketFilter = policy.ReduceFilterRules(node, packetFilter)
+	resp.PacketFilter = packetFilter.reducedRules(node)
 	resp.UserProfiles = profiles
 	resp.SSHPolicy = sshPolicy
 
@@ -3,6 +3,7 @@ package mapper
 import (
 	"fmt"
 	"net/netip"
+	"slices"
 	"testing"
 	"time"
 
@@ -246,7 +247,6 @@ func Test_fullMapResponse(t *testing.T) {
 		Capabilities: []tailcfg.NodeCapability{
 			tailcfg.CapabilityFileSharing,
 			tailcfg.CapabilityAdmin,
-			tailcfg.CapabilitySSH,
 			tailcfg.NodeAttrDisableUPnP,
 		},
 	}
@@ -301,7 +301,6 @@ func Test_fullMapResponse(t *testing.T) {
 		Capabilities: []tailcfg.NodeCapability{
 			tailcfg.CapabilityFileSharing,
 			tailcfg.CapabilityAdmin,
-			tailcfg.CapabilitySSH,
 			tailcfg.NodeAttrDisableUPnP,
 		},
 	}
@@ -504,3 +503,479 @@ func Test_fullMapResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestFullMapResponseDERPMapWithoutPeers(t *testing.T) {
+	lastSeen := time.Date(2009, time.November, 10, 23, 9, 0, 0, time.UTC)
+	expire := time.Date(2500, time.November, 11, 23, 0, 0, 0, time.UTC)
+
+	node := &types.Node{
+		ID:        1,
+		IPv4:      iap("100.64.0.1"),
+		Hostname:  "sole",
+		GivenName: "sole",
+		User:      types.User{Name: "sole"},
+		LastSeen:  &lastSeen,
+		Expiry:    &expire,
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+
+	derpMap := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			900: {
+				RegionID:   900,
+				RegionCode: "headscale",
+				Nodes: []*tailcfg.DERPNode{
+					{Name: "900a", RegionID: 900, HostName: "derp.example.com"},
+				},
+			},
+		},
+	}
+
+	mappy := NewMapper(
+		nil,
+		&types.Config{
+			DNSConfig: &tailcfg.DNSConfig{},
+		},
+		derpMap,
+		nil,
+	)
+
+	got, err := mappy.fullMapResponse(node, types.Nodes{}, nil, 0)
+	if err != nil {
+		t.Fatalf("fullMapResponse() unexpected error: %s", err)
+	}
+
+	if got.DERPMap == nil || len(got.DERPMap.Regions) == 0 {
+		t.Fatalf("fullMapResponse() for a node without peers has no DERP regions")
+	}
+
+	updated := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			901: {RegionID: 901, RegionCode: "updated"},
+		},
+	}
+	mappy.SetDERPMap(updated)
+
+	got, err = mappy.fullMapResponse(node, types.Nodes{}, nil, 0)
+	if err != nil {
+		t.Fatalf("fullMapResponse() unexpected error: %s", err)
+	}
+
+	if diff := cmp.Diff(updated, got.DERPMap); diff != "" {
+		t.Errorf("fullMapResponse() DERPMap not updated (-want +got):\n%s", diff)
+	}
+}
+
+func TestFullMapResponseExpiredPeer(t *testing.T) {
+	lastSeen := time.Date(2009, time.November, 10, 23, 9, 0, 0, time.UTC)
+	expire := time.Date(2500, time.November, 11, 23, 0, 0, 0, time.UTC)
+	expired := time.Now().Add(-time.Minute)
+
+	node := &types.Node{
+		ID:        1,
+		IPv4:      iap("100.64.0.1"),
+		Hostname:  "mini",
+		GivenName: "mini",
+		User:      types.User{Name: "mini"},
+		LastSeen:  &lastSeen,
+		Expiry:    &expire,
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+
+	peer := &types.Node{
+		ID:        2,
+		IPv4:      iap("100.64.0.2"),
+		Hostname:  "peer1",
+		GivenName: "peer1",
+		User:      types.User{Name: "mini"},
+		LastSeen:  &lastSeen,
+		Expiry:    &expire,
+		Hostinfo:  &tailcfg.Hostinfo{},
+	}
+
+	pol := &policy.ACLPolicy{
+		ACLs: []policy.ACL{
+			{
+				Action:       "accept",
+				Sources:      []string{"mini"},
+				Destinations: []string{"mini:*"},
+			},
+		},
+	}
+
+	mappy := NewMapper(
+		nil,
+		&types.Config{
+			DNSConfig: &tailcfg.DNSConfig{},
+		},
+		&tailcfg.DERPMap{},
+		nil,
+	)
+
+	hasSrc := func(resp *tailcfg.MapResponse, src string) bool {
+		for _, rule := range resp.PacketFilter {
+			for _, srcIP := range rule.SrcIPs {
+				if srcIP == src {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	got, err := mappy.fullMapResponse(node, types.Nodes{peer}, pol, 0)
+	if err != nil {
+		t.Fatalf("fullMapResponse() unexpected error: %s", err)
+	}
+
+	if !hasSrc(got, "100.64.0.2/32") {
+		t.Fatalf("packet filter of an active peer does not contain its address: %v", got.PacketFilter)
+	}
+
+	peer.Expiry = &expired
+
+	got, err = mappy.fullMapResponse(node, types.Nodes{peer}, pol, 0)
+	if err != nil {
+		t.Fatalf("fullMapResponse() unexpected error: %s", err)
+	}
+
+	if hasSrc(got, "100.64.0.2/32") {
+		t.Errorf("packet filter contains the address of an expired peer: %v", got.PacketFilter)
+	}
+
+	if !hasSrc(got, "100.64.0.1/32") {
+		t.Errorf("packet filter lost the address of the node itself: %v", got.PacketFilter)
+	}
+
+	if len(got.Peers) != 1 || !got.Peers[0].Expired {
+		t.Errorf("expired peer should be sent marked as expired, got %v", got.Peers)
+	}
+}
+
+func TestFullMapResponseFailedPosturePeer(t *testing.T) {
+	lastSeen := time.Date(2009, time.November, 10, 23, 9, 0, 0, time.UTC)
+	expire := time.Date(2500, time.November, 11, 23, 0, 0, 0, time.UTC)
+
+	newNode := func(id types.NodeID, ip string) *types.Node {
+		return &types.Node{
+			ID:        id,
+			IPv4:      iap(ip),
+			Hostname:  fmt.Sprintf("node%d", id),
+			GivenName: fmt.Sprintf("node%d", id),
+			User:      types.User{Name: "mini"},
+			LastSeen:  &lastSeen,
+			Expiry:    &expire,
+			Hostinfo:  &tailcfg.Hostinfo{},
+		}
+	}
+
+	node := newNode(1, "100.64.0.1")
+	passing := newNode(2, "100.64.0.2")
+	failing := newNode(3, "100.64.0.3")
+	failing.PostureError = "device posture check failed: missing required tag tag:managed"
+
+	mappy := NewMapper(
+		nil,
+		&types.Config{
+			DNSConfig: &tailcfg.DNSConfig{},
+			PosturePolicy: types.PosturePolicyConfig{
+				Rules: []types.PostureRule{{RequiredTags: []string{"tag:managed"}}},
+			},
+		},
+		&tailcfg.DERPMap{},
+		nil,
+	)
+
+	got, err := mappy.fullMapResponse(node, types.Nodes{passing, failing}, nil, 0)
+	if err != nil {
+		t.Fatalf("fullMapResponse() unexpected error: %s", err)
+	}
+
+	peerIDs := []tailcfg.NodeID{}
+	for _, peer := range got.Peers {
+		peerIDs = append(peerIDs, peer.ID)
+	}
+	if diff := cmp.Diff([]tailcfg.NodeID{2}, peerIDs); diff != "" {
+		t.Errorf("peers of a node with a failed posture peer (-want +got):\n%s", diff)
+	}
+
+	for _, rule := range got.PacketFilter {
+		if slices.Contains(rule.SrcIPs, "100.64.0.3/32") {
+			t.Errorf("packet filter lets a peer failing its posture check in: %v", rule)
+		}
+	}
+}
+
+func TestFullMapResponseUserIsolated(t *testing.T) {
+	lastSeen := time.Date(2009, time.November, 10, 23, 9, 0, 0, time.UTC)
+	expire := time.Date(2500, time.November, 11, 23, 0, 0, 0, time.UTC)
+
+	newNode := func(id types.NodeID, ip, user string, tags ...string) *types.Node {
+		return &types.Node{
+			ID:         id,
+			IPv4:       iap(ip),
+			Hostname:   fmt.Sprintf("node%d", id),
+			GivenName:  fmt.Sprintf("node%d", id),
+			User:       types.User{Name: user},
+			ForcedTags: tags,
+			LastSeen:   &lastSeen,
+			Expiry:     &expire,
+			Hostinfo:   &tailcfg.Hostinfo{},
+		}
+	}
+
+	node := newNode(1, "100.64.0.1", "alice")
+	sameUser := newNode(2, "100.64.0.2", "alice")
+	otherUser := newNode(3, "100.64.0.3", "bob")
+	shared := newNode(4, "100.64.0.4", "infra", "tag:shared")
+
+	peers := types.Nodes{sameUser, otherUser, shared}
+
+	mapResponse := func(defaultPolicy types.DefaultPolicy) *tailcfg.MapResponse {
+		mappy := NewMapper(
+			nil,
+			&types.Config{
+				DNSConfig: &tailcfg.DNSConfig{},
+				ACL: types.ACLConfig{
+					DefaultPolicy: defaultPolicy,
+					SharedTags:    []string{"tag:shared"},
+				},
+			},
+			&tailcfg.DERPMap{},
+			nil,
+		)
+
+		got, err := mappy.fullMapResponse(node, peers, nil, 0)
+		if err != nil {
+			t.Fatalf("fullMapResponse() unexpected error: %s", err)
+		}
+
+		return got
+	}
+
+	peerIDs := func(resp *tailcfg.MapResponse) []tailcfg.NodeID {
+		ids := []tailcfg.NodeID{}
+		for _, peer := range resp.Peers {
+			ids = append(ids, peer.ID)
+		}
+
+		return ids
+	}
+
+	got := mapResponse(types.DefaultPolicyAllowAll)
+	if diff := cmp.Diff([]tailcfg.NodeID{2, 3, 4}, peerIDs(got)); diff != "" {
+		t.Errorf("allow-all peers (-want +got):\n%s", diff)
+	}
+
+	got = mapResponse(types.DefaultPolicyUserIsolated)
+	if diff := cmp.Diff([]tailcfg.NodeID{2, 4}, peerIDs(got)); diff != "" {
+		t.Errorf("user-isolated peers (-want +got):\n%s", diff)
+	}
+
+	for _, rule := range got.PacketFilter {
+		if slices.Contains(rule.SrcIPs, "100.64.0.3/32") {
+			t.Errorf("user-isolated packet filter lets another user in: %v", rule)
+		}
+	}
+}
+
+func TestFullMapResponseDERPOnly(t *testing.T) {
+	lastSeen := time.Date(2009, time.November, 10, 23, 9, 0, 0, time.UTC)
+	expire := time.Date(2500, time.November, 11, 23, 0, 0, 0, time.UTC)
+
+	newNode := func(id types.NodeID, ip string, user types.User) *types.Node {
+		return &types.Node{
+			ID:        id,
+			IPv4:      iap(ip),
+			Hostname:  fmt.Sprintf("node%d", id),
+			GivenName: fmt.Sprintf("node%d", id),
+			User:      user,
+			Endpoints: []netip.AddrPort{
+				netip.MustParseAddrPort(fmt.Sprintf("192.0.2.%d:41641", id)),
+			},
+			LastSeen: &lastSeen,
+			Expiry:   &expire,
+			Hostinfo: &tailcfg.Hostinfo{},
+		}
+	}
+
+	secure := types.User{Name: "secure", DERPOnly: true}
+	regular := types.User{Name: "regular"}
+
+	nodes := types.Nodes{
+		newNode(1, "100.64.0.1", secure),
+		newNode(2, "100.64.0.2", regular),
+		newNode(3, "100.64.0.3", regular),
+	}
+
+	mappy := NewMapper(
+		nil,
+		&types.Config{
+			DNSConfig: &tailcfg.DNSConfig{},
+		},
+		&tailcfg.DERPMap{},
+		nil,
+	)
+
+	endpoints := func(node *types.Node) map[tailcfg.NodeID]int {
+		var peers types.Nodes
+		for _, peer := range nodes {
+			if peer.ID != node.ID {
+				peers = append(peers, peer)
+			}
+		}
+
+		got, err := mappy.fullMapResponse(node, peers, nil, 0)
+		if err != nil {
+			t.Fatalf("fullMapResponse() unexpected error: %s", err)
+		}
+
+		ret := make(map[tailcfg.NodeID]int)
+		for _, peer := range got.Peers {
+			ret[peer.ID] = len(peer.Endpoints)
+		}
+
+		return ret
+	}
+
+	// A DERP-only node is not given the endpoints of its peers.
+	if diff := cmp.Diff(map[tailcfg.NodeID]int{2: 0, 3: 0}, endpoints(nodes[0])); diff != "" {
+		t.Errorf("endpoints of the peers of a DERP-only node (-want +got):\n%s", diff)
+	}
+
+	// Other nodes are not given the endpoints of DERP-only nodes, and
+	// still see the endpoints of each other.
+	if diff := cmp.Diff(map[tailcfg.NodeID]int{1: 0, 3: 1}, endpoints(nodes[1])); diff != "" {
+		t.Errorf("endpoints of the peers of a regular node (-want +got):\n%s", diff)
+	}
+}
+
+// BenchmarkFullMapResponse builds the full maps of all the nodes of a
+// tailnet of 500 nodes, in 50 users reaching their own nodes, with a
+// group of admins reaching all the nodes.
+func BenchmarkFullMapResponse(b *testing.B) {
+	const (
+		nodeCount = 500
+		userCount = 50
+	)
+
+	expire := time.Now().Add(time.Hour)
+	pol := &policy.ACLPolicy{
+		Groups: policy.Groups{
+			"group:admins": []string{"user0"},
+		},
+		ACLs: []policy.ACL{
+			{Action: "accept", Sources: []string{"group:admins"}, Destinations: []string{"*:*"}},
+		},
+	}
+
+	nodes := make(types.Nodes, nodeCount)
+	for index := range nodes {
+		user := fmt.Sprintf("user%d", index%userCount)
+		nodes[index] = &types.Node{
+			ID:         types.NodeID(index + 1),
+			MachineKey: key.NewMachine().Public(),
+			NodeKey:    key.NewNode().Public(),
+			DiscoKey:   key.NewDisco().Public(),
+			IPv4:       iap(fmt.Sprintf("100.64.%d.%d", (index+1)/256, (index+1)%256)),
+			Hostname:   fmt.Sprintf("node%d", index+1),
+			GivenName:  fmt.Sprintf("node%d", index+1),
+			UserID:     uint(index%userCount + 1),
+			User:       types.User{Name: user},
+			Expiry:     &expire,
+			Hostinfo:   &tailcfg.Hostinfo{},
+		}
+	}
+
+	for index := range userCount {
+		user := fmt.Sprintf("user%d", index)
+		pol.ACLs = append(pol.ACLs, policy.ACL{
+			Action:       "accept",
+			Sources:      []string{user},
+			Destinations: []string{user + ":*"},
+		})
+	}
+
+	mappy := NewMapper(
+		nil,
+		&types.Config{
+			BaseDomain: "example.com",
+			DNSConfig:  &tailcfg.DNSConfig{},
+		},
+		&tailcfg.DERPMap{},
+		nil,
+	)
+
+	b.ResetTimer()
+
+	for range b.N {
+		for index, node := range nodes {
+			peers := slices.Concat(nodes[:index], nodes[index+1:])
+			if _, err := mappy.fullMapResponse(node, peers, pol, tailcfg.CurrentCapabilityVersion); err != nil {
+				b.Fatalf("fullMapResponse() error = %s", err)
+			}
+		}
+	}
+}
+
+func TestLimitRoutes(t *testing.T) {
+	route := func(prefix string) types.Route {
+		return types.Route{Prefix: types.IPPrefix(netip.MustParsePrefix(prefix)), Enabled: true}
+	}
+
+	peers := types.Nodes{
+		{ID: 2, Routes: []types.Route{route("10.0.0.0/24"), route("192.168.0.0/24")}},
+		{ID: 3, Routes: []types.Route{route("0.0.0.0/0"), route("::/0")}},
+	}
+
+	routes := func(peers types.Nodes) [][]string {
+		got := make([][]string, len(peers))
+		for index, peer := range peers {
+			got[index] = []string{}
+			for _, prefix := range types.Routes(peer.Routes).Prefixes() {
+				got[index] = append(got[index], prefix.String())
+			}
+		}
+
+		return got
+	}
+
+	tests := []struct {
+		name   string
+		viewer *types.Node
+		want   [][]string
+	}{
+		{
+			name:   "not limited",
+			viewer: &types.Node{ID: 1},
+			want:   [][]string{{"10.0.0.0/24", "192.168.0.0/24"}, {"0.0.0.0/0", "::/0"}},
+		},
+		{
+			name: "allowed routes",
+			viewer: &types.Node{ID: 1, AllowedRoutes: []types.PerNodeRoute{
+				{Prefix: types.IPPrefix(netip.MustParsePrefix("10.0.0.0/8"))},
+				{Prefix: types.IPPrefix(netip.MustParsePrefix("::/0"))},
+			}},
+			want: [][]string{{"10.0.0.0/24"}, {"::/0"}},
+		},
+		{
+			name:   "deny all",
+			viewer: &types.Node{ID: 1, DenyAllRoutes: true},
+			want:   [][]string{{}, {}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, routes(limitRoutes(peers, tt.viewer))); diff != "" {
+				t.Errorf("limitRoutes() unexpected routes (-want +got):\n%s", diff)
+			}
+
+			// The peers are not modified.
+			if len(peers[0].Routes) != 2 {
+				t.Errorf("limitRoutes() modified the routes of the peers")
+			}
+		})
+	}
+}
@@ -3,52 +3,192 @@ package mapper
 import (
 	"fmt"
 	"net/netip"
+	"runtime"
 	"time"
 
 	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/samber/lo"
+	"go4.org/netipx"
+	"golang.org/x/sync/errgroup"
 	"tailscale.com/tailcfg"
 )
 
+// tailNodes converts nodes into Tailscale Nodes, the nodes in
+// sshDestinations are given the SSH capability.
 func tailNodes(
 	nodes types.Nodes,
 	capVer tailcfg.CapabilityVersion,
 	pol *policy.ACLPolicy,
+	sshDestinations map[types.NodeID]bool,
 	cfg *types.Config,
 ) ([]*tailcfg.Node, error) {
 	tNodes := make([]*tailcfg.Node, len(nodes))
 
+	// The nodes are independent, they are converted in parallel for the
+	// full maps of large tailnets.
+	var group errgroup.Group
+	group.SetLimit(runtime.GOMAXPROCS(0))
+
 	for index, node := range nodes {
-		node, err := tailNode(
-			node,
-			capVer,
-			pol,
-			cfg,
-		)
+		group.Go(func() error {
+			node, err := tailNode(
+				node,
+				capVer,
+				pol,
+				sshDestinations[node.ID],
+				cfg,
+			)
+			if err != nil {
+				return err
+			}
+
+			tNodes[index] = node
+
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	return tNodes, nil
+}
+
+// nodeBlocks returns the prefixes allocated to a node with the addresses
+// addrs, the IPv4 block starting at its address with a per node prefix
+// length, or its addresses.
+func nodeBlocks(addrs []netip.Prefix, perNodePrefixLen int) []netip.Prefix {
+	blocks := make([]netip.Prefix, len(addrs))
+	for index, addr := range addrs {
+		blocks[index] = addr
+
+		if addr.Addr().Is4() && perNodePrefixLen > 0 && perNodePrefixLen < 32 {
+			block := netip.PrefixFrom(addr.Addr(), perNodePrefixLen).Masked()
+			if block.Addr() == addr.Addr() {
+				blocks[index] = block
+			}
+		}
+	}
+
+	return blocks
+}
+
+// expandNodeBlocks widens the addresses of nodes in the sources and
+// destinations of rules to the blocks allocated to the nodes, the policy
+// only knows their addresses but the peers route the whole block to them.
+func expandNodeBlocks(
+	rules []tailcfg.FilterRule,
+	nodes types.Nodes,
+	perNodePrefixLen int,
+) ([]tailcfg.FilterRule, error) {
+	blocks := make(map[netip.Addr]netip.Prefix)
+	for _, node := range nodes {
+		for _, block := range nodeBlocks(node.Prefixes(), perNodePrefixLen) {
+			if !block.IsSingleIP() {
+				blocks[block.Addr()] = block
+			}
+		}
+	}
+
+	if len(blocks) == 0 {
+		return rules, nil
+	}
+
+	expand := func(ip string) ([]string, error) {
+		if ip == "*" {
+			return []string{ip}, nil
+		}
+
+		set, err := util.ParseIPSet(ip, nil)
 		if err != nil {
 			return nil, err
 		}
 
-		tNodes[index] = node
+		var build netipx.IPSetBuilder
+		build.AddSet(set)
+
+		expanded := false
+		for _, prefix := range set.Prefixes() {
+			// The blocks are aligned, a prefix holding a whole block
+			// does not need to be widened.
+			if prefix.Bits() <= perNodePrefixLen {
+				continue
+			}
+
+			block, ok := blocks[netip.PrefixFrom(prefix.Addr(), perNodePrefixLen).Masked().Addr()]
+			if ok && prefix.Contains(block.Addr()) {
+				build.AddPrefix(block)
+				expanded = true
+			}
+		}
+
+		if !expanded {
+			return []string{ip}, nil
+		}
+
+		set, err = build.IPSet()
+		if err != nil {
+			return nil, err
+		}
+
+		ips := []string{}
+		for _, prefix := range set.Prefixes() {
+			ips = append(ips, prefix.String())
+		}
+
+		return ips, nil
 	}
 
-	return tNodes, nil
+	expandedRules := make([]tailcfg.FilterRule, len(rules))
+	for index, rule := range rules {
+		srcIPs := []string{}
+		for _, src := range rule.SrcIPs {
+			ips, err := expand(src)
+			if err != nil {
+				return nil, err
+			}
+			srcIPs = append(srcIPs, ips...)
+		}
+
+		dstPorts := []tailcfg.NetPortRange{}
+		for _, dst := range rule.DstPorts {
+			ips, err := expand(dst.IP)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, ip := range ips {
+				dst.IP = ip
+				dstPorts = append(dstPorts, dst)
+			}
+		}
+
+		rule.SrcIPs = srcIPs
+		rule.DstPorts = dstPorts
+		expandedRules[index] = rule
+	}
+
+	return expandedRules, nil
 }
 
 // tailNode converts a Node into a Tailscale Node. includeRoutes is false for shared nodes
-// as per the expected behaviour in the official SaaS.
+// as per the expected behaviour in the official SaaS. Only the destinations
+// of the SSH rules, sshDestination, run the Tailscale SSH server.
 func tailNode(
 	node *types.Node,
 	capVer tailcfg.CapabilityVersion,
 	pol *policy.ACLPolicy,
+	sshDestination bool,
 	cfg *types.Config,
 ) (*tailcfg.Node, error) {
 	addrs := node.Prefixes()
 
 	allowedIPs := append(
 		[]netip.Prefix{},
-		addrs...) // we append the node own IP, as it is required by the clients
+		nodeBlocks(addrs, cfg.PerNodePrefixLen)...) // we append the node own IP, as it is required by the clients
 
 	primaryPrefixes := []netip.Prefix{}
 
@@ -120,7 +260,10 @@ func tailNode(
 		tNode.CapMap = tailcfg.NodeCapMap{
 			tailcfg.CapabilityFileSharing: []tailcfg.RawMessage{},
 			tailcfg.CapabilityAdmin:       []tailcfg.RawMessage{},
-			tailcfg.CapabilitySSH:         []tailcfg.RawMessage{},
+		}
+
+		if sshDestination {
+			tNode.CapMap[tailcfg.CapabilitySSH] = []tailcfg.RawMessage{}
 		}
 
 		if cfg.RandomizeClientPort {
@@ -130,7 +273,10 @@ func tailNode(
 		tNode.Capabilities = []tailcfg.NodeCapability{
 			tailcfg.CapabilityFileSharing,
 			tailcfg.CapabilityAdmin,
-			tailcfg.CapabilitySSH,
+		}
+
+		if sshDestination {
+			tNode.Capabilities = append(tNode.Capabilities, tailcfg.CapabilitySSH)
 		}
 
 		if cfg.RandomizeClientPort {
@@ -141,6 +287,14 @@ func tailNode(
 	//   - 72: 2023-08-23: TS-2023-006 UPnP issue fixed; UPnP can now be used again
 	if capVer < 72 {
 		tNode.Capabilities = append(tNode.Capabilities, tailcfg.NodeAttrDisableUPnP)
+	} else if node.User.DERPOnly {
+		// Port mapping only helps direct connections, which the nodes
+		// of DERP-only users are not given.
+		if tNode.CapMap != nil {
+			tNode.CapMap[tailcfg.NodeAttrDisableUPnP] = []tailcfg.RawMessage{}
+		} else {
+			tNode.Capabilities = append(tNode.Capabilities, tailcfg.NodeAttrDisableUPnP)
+		}
 	}
 
 	if node.IsOnline == nil || !*node.IsOnline {
@@ -71,7 +71,7 @@ func TestTailNode(t *testing.T) {
 				MachineAuthorized: true,
 				Capabilities: []tailcfg.NodeCapability{
 					"https://tailscale.com/cap/file-sharing", "https://tailscale.com/cap/is-admin",
-					"https://tailscale.com/cap/ssh", "debug-disable-upnp",
+					"debug-disable-upnp",
 				},
 			},
 			wantErr: false,
@@ -167,7 +167,6 @@ func TestTailNode(t *testing.T) {
 				Capabilities: []tailcfg.NodeCapability{
 					tailcfg.CapabilityFileSharing,
 					tailcfg.CapabilityAdmin,
-					tailcfg.CapabilitySSH,
 					tailcfg.NodeAttrDisableUPnP,
 				},
 			},
@@ -189,6 +188,7 @@ func TestTailNode(t *testing.T) {
 				tt.node,
 				0,
 				tt.pol,
+				tt.pol.IsSSHDestination(tt.node),
 				cfg,
 			)
 
@@ -204,3 +204,159 @@ func TestTailNode(t *testing.T) {
 		})
 	}
 }
+
+func TestNodeBlocks(t *testing.T) {
+	addrs := []netip.Prefix{
+		netip.MustParsePrefix("100.64.0.4/32"),
+		netip.MustParsePrefix("fd7a:115c:a1e0::1/128"),
+	}
+
+	tests := []struct {
+		name             string
+		addrs            []netip.Prefix
+		perNodePrefixLen int
+		want             []netip.Prefix
+	}{
+		{
+			name:             "single addresses",
+			addrs:            addrs,
+			perNodePrefixLen: 32,
+			want:             addrs,
+		},
+		{
+			name:             "ipv4 block",
+			addrs:            addrs,
+			perNodePrefixLen: 30,
+			want: []netip.Prefix{
+				netip.MustParsePrefix("100.64.0.4/30"),
+				netip.MustParsePrefix("fd7a:115c:a1e0::1/128"),
+			},
+		},
+		{
+			name:             "address not starting a block",
+			addrs:            []netip.Prefix{netip.MustParsePrefix("100.64.0.5/32")},
+			perNodePrefixLen: 30,
+			want:             []netip.Prefix{netip.MustParsePrefix("100.64.0.5/32")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := nodeBlocks(tt.addrs, tt.perNodePrefixLen)
+			if diff := cmp.Diff(tt.want, got, cmp.Comparer(func(x, y netip.Prefix) bool {
+				return x == y
+			})); diff != "" {
+				t.Errorf("nodeBlocks() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCompileFilterRulesNodeBlocks(t *testing.T) {
+	pol := &policy.ACLPolicy{
+		Hosts: policy.Hosts{"router": netip.MustParsePrefix("100.64.0.9/32")},
+		ACLs: []policy.ACL{
+			{Action: "accept", Sources: []string{"alice"}, Destinations: []string{"bob:22"}},
+			{Action: "accept", Sources: []string{"bob"}, Destinations: []string{"router:80", "100.64.0.0/10:443"}},
+		},
+	}
+	alice := &types.Node{ID: 1, IPv4: iap("100.64.0.4"), User: types.User{Name: "alice"}}
+	bob := &types.Node{ID: 2, IPv4: iap("100.64.0.8"), User: types.User{Name: "bob"}}
+	nodes := types.Nodes{alice, bob}
+
+	packetFilter, err := compileFilterRules(nil, pol, nodes, &types.Config{PerNodePrefixLen: 30})
+	if err != nil {
+		t.Fatalf("compileFilterRules() error = %s", err)
+	}
+
+	// The nodes are allowed with their whole block. The router host is
+	// only an address of the block of bob, and the prefix already holds
+	// the blocks, they are left as they are.
+	want := []tailcfg.FilterRule{
+		{
+			SrcIPs: []string{"100.64.0.4/30"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "100.64.0.8/30", Ports: tailcfg.PortRange{First: 22, Last: 22}},
+			},
+		},
+		{
+			SrcIPs: []string{"100.64.0.8/30"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "100.64.0.9/32", Ports: tailcfg.PortRange{First: 80, Last: 80}},
+				{IP: "100.64.0.0/10", Ports: tailcfg.PortRange{First: 443, Last: 443}},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, packetFilter.rules, cmpopts.IgnoreFields(tailcfg.FilterRule{}, "IPProto")); diff != "" {
+		t.Errorf("compileFilterRules() unexpected rules (-want +got):\n%s", diff)
+	}
+
+	// bob still receives the rules it is the destination of.
+	if got := packetFilter.reducedRules(bob); len(got) != 2 {
+		t.Errorf("reducedRules() = %+v, want the 2 rules", got)
+	}
+
+	// Without blocks the rules are left as compiled.
+	packetFilter, err = compileFilterRules(nil, pol, nodes, &types.Config{PerNodePrefixLen: 32})
+	if err != nil {
+		t.Fatalf("compileFilterRules() error = %s", err)
+	}
+	if got := packetFilter.rules[0].SrcIPs; !cmp.Equal(got, []string{"100.64.0.4/32"}) {
+		t.Errorf("SrcIPs = %v, want [100.64.0.4/32]", got)
+	}
+}
+
+func TestTailNodeSSHCapability(t *testing.T) {
+	pol := &policy.ACLPolicy{
+		TagOwners: policy.TagOwners{"tag:server": []string{"alice"}},
+		SSHs: []policy.SSH{
+			{
+				Action:       "accept",
+				Sources:      []string{"alice"},
+				Destinations: []string{"tag:server"},
+				Users:        []string{"autogroup:nonroot"},
+			},
+		},
+	}
+
+	server := &types.Node{
+		ID:         1,
+		IPv4:       iap("100.64.0.1"),
+		User:       types.User{Name: "alice"},
+		ForcedTags: []string{"tag:server"},
+		Hostinfo:   &tailcfg.Hostinfo{},
+	}
+	laptop := &types.Node{
+		ID:       2,
+		IPv4:     iap("100.64.0.2"),
+		User:     types.User{Name: "alice"},
+		Hostinfo: &tailcfg.Hostinfo{},
+	}
+
+	tests := []struct {
+		name    string
+		node    *types.Node
+		pol     *policy.ACLPolicy
+		capVer  tailcfg.CapabilityVersion
+		wantSSH bool
+	}{
+		{name: "destination", node: server, pol: pol, capVer: tailcfg.CurrentCapabilityVersion, wantSSH: true},
+		{name: "destination-old-client", node: server, pol: pol, capVer: 0, wantSSH: true},
+		{name: "source", node: laptop, pol: pol, capVer: tailcfg.CurrentCapabilityVersion},
+		{name: "no-ssh-rules", node: server, pol: &policy.ACLPolicy{}, capVer: tailcfg.CurrentCapabilityVersion},
+		{name: "no-policy", node: server, capVer: tailcfg.CurrentCapabilityVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tailNode(tt.node, tt.capVer, tt.pol, tt.pol.IsSSHDestination(tt.node), &types.Config{})
+			if err != nil {
+				t.Fatalf("tailNode() error = %s", err)
+			}
+
+			if hasSSH := got.HasCap(tailcfg.CapabilitySSH); hasSSH != tt.wantSSH {
+				t.Errorf("tailNode() SSH capability = %t, want %t", hasSSH, tt.wantSSH)
+			}
+		})
+	}
+}
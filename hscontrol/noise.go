@@ -1,10 +1,15 @@
 package hscontrol
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io"
+	"net"
 	"net/http"
+	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/juanfont/headscale/hscontrol/types"
@@ -41,6 +46,9 @@ type noiseServer struct {
 	machineKey     key.MachinePublic
 	nodeKey        key.NodePublic
 
+	// clientIP is the source IP of the client upgrading to Noise.
+	clientIP string
+
 	// EarlyNoise-related stuff
 	challenge       key.ChallengePrivate
 	protocolVersion int
@@ -70,15 +78,10 @@ func (h *Headscale) NoiseUpgradeHandler(
 	noiseServer := noiseServer{
 		headscale: h,
 		challenge: key.NewChallenge(),
+		clientIP:  clientIP(req, h.cfg.RateLimit.TrustedProxies),
 	}
 
-	noiseConn, err := controlhttp.AcceptHTTP(
-		req.Context(),
-		writer,
-		req,
-		*h.noisePrivateKey,
-		noiseServer.earlyNoise,
-	)
+	noiseConn, err := h.acceptNoise(writer, req, noiseServer.earlyNoise)
 	if err != nil {
 		log.Error().Err(err).Msg("noise upgrade failed")
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
@@ -95,10 +98,16 @@ func (h *Headscale) NoiseUpgradeHandler(
 	// The HTTP2 server that exposes this router is created for
 	// a single hijacked connection from /ts2021, using netutil.NewOneConnListener
 	router := mux.NewRouter()
+	router.Use(requestIDMiddleware)
+	if h.sentryHub != nil {
+		router.Use(sentryMiddleware(h.sentryHub))
+	}
 
 	router.HandleFunc("/machine/register", noiseServer.NoiseRegistrationHandler).
 		Methods(http.MethodPost)
-	router.HandleFunc("/machine/map", noiseServer.NoisePollNetMapHandler)
+	router.HandleFunc("/machine/map", withSentryTransaction("NoisePollNetMap", noiseServer.NoisePollNetMapHandler))
+	router.HandleFunc("/machine/{id}/stats", noiseServer.NoiseTrafficStatsHandler).
+		Methods(http.MethodPost)
 
 	server := http.Server{
 		ReadTimeout: types.HTTPTimeout,
@@ -120,6 +129,162 @@ func (h *Headscale) NoiseUpgradeHandler(
 	)
 }
 
+// acceptNoise upgrades the connection to Noise with the server private key.
+// After a key rotation, clients still using the previous key are accepted
+// as well: the handshake is first attempted with the current key, buffering
+// anything written to the client, and retried with the previous key if it
+// fails.
+func (h *Headscale) acceptNoise(
+	writer http.ResponseWriter,
+	req *http.Request,
+	earlyWrite func(protocolVersion int, writer io.Writer) error,
+) (*controlbase.Conn, error) {
+	// The WebSocket upgrade reads the handshake from the connection,
+	// so it cannot be retried.
+	if h.previousNoisePrivateKey == nil || req.Header.Get("Upgrade") == "websocket" {
+		return controlhttp.AcceptHTTP(
+			req.Context(),
+			writer,
+			req,
+			*h.noisePrivateKey,
+			earlyWrite,
+		)
+	}
+
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		return nil, errNoiseHijackUnsupported
+	}
+
+	trial := &trialResponseWriter{ResponseWriter: writer, hijacker: hijacker}
+
+	conn, err := controlhttp.AcceptHTTP(
+		req.Context(),
+		trial,
+		req,
+		*h.noisePrivateKey,
+		earlyWrite,
+	)
+	if err == nil {
+		return conn, trial.commit()
+	}
+
+	// Nothing has been hijacked, the request was rejected before
+	// the handshake.
+	if trial.conn == nil {
+		return nil, err
+	}
+
+	trial.conn.reset()
+
+	conn, err = controlhttp.AcceptHTTP(
+		req.Context(),
+		trial,
+		req,
+		*h.previousNoisePrivateKey,
+		earlyWrite,
+	)
+	if err != nil {
+		trial.conn.Conn.Close()
+
+		return nil, err
+	}
+
+	log.Info().
+		Caller().
+		Str("machine_key", conn.Peer().ShortString()).
+		Msg("Client connected using the previous Noise private key")
+
+	return conn, trial.commit()
+}
+
+var errNoiseHijackUnsupported = errors.New("connection does not support hijacking")
+
+// trialResponseWriter hands out the same buffered connection every time
+// it is hijacked, so the Noise handshake can be attempted more than once
+// on a single client connection.
+type trialResponseWriter struct {
+	http.ResponseWriter
+	hijacker http.Hijacker
+
+	conn *trialConn
+	brw  *bufio.ReadWriter
+}
+
+func (w *trialResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.conn == nil {
+		conn, brw, err := w.hijacker.Hijack()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		w.conn = &trialConn{Conn: conn}
+		w.brw = bufio.NewReadWriter(brw.Reader, bufio.NewWriter(w.conn))
+	}
+
+	return w.conn, w.brw, nil
+}
+
+func (w *trialResponseWriter) commit() error {
+	if w.conn == nil {
+		return nil
+	}
+
+	return w.conn.commit()
+}
+
+// trialConn buffers writes and ignores Close until it is committed, so a
+// failed handshake leaves nothing behind on the underlying connection.
+type trialConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	committed bool
+}
+
+func (c *trialConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.committed {
+		return c.buf.Write(b)
+	}
+
+	return c.Conn.Write(b)
+}
+
+func (c *trialConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.committed {
+		return nil
+	}
+
+	return c.Conn.Close()
+}
+
+func (c *trialConn) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.buf.Reset()
+}
+
+// commit writes everything buffered so far to the connection, and lets
+// all following writes through.
+func (c *trialConn) commit() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.committed = true
+	_, err := c.Conn.Write(c.buf.Bytes())
+	c.buf.Reset()
+
+	return err
+}
+
 func (ns *noiseServer) earlyNoise(protocolVersion int, writer io.Writer) error {
 	log.Trace().
 		Caller().
@@ -181,11 +346,12 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 	writer http.ResponseWriter,
 	req *http.Request,
 ) {
-	log.Trace().
+	logger := requestLogger(req.Context())
+	logger.Trace().
 		Str("handler", "NoisePollNetMap").
 		Msg("PollNetMapHandler called")
 
-	log.Trace().
+	logger.Trace().
 		Any("headers", req.Header).
 		Caller().
 		Msg("Headers")
@@ -194,7 +360,7 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 
 	mapRequest := tailcfg.MapRequest{}
 	if err := json.Unmarshal(body, &mapRequest); err != nil {
-		log.Error().
+		logger.Error().
 			Caller().
 			Err(err).
 			Msg("Cannot parse MapRequest")
@@ -205,7 +371,7 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 
 	// Reject unsupported versions
 	if mapRequest.Version < MinimumCapVersion {
-		log.Info().
+		logger.Info().
 			Caller().
 			Int("min_version", int(MinimumCapVersion)).
 			Int("client_version", int(mapRequest.Version)).
@@ -215,6 +381,18 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 		return
 	}
 
+	// Only the requests opening a long-poll are limited, the updates
+	// sent by the nodes on their own are not.
+	if mapRequest.Stream && !mapRequest.ReadOnly && !checkRateLimit(
+		writer,
+		ns.headscale.mapRateLimiter,
+		"map",
+		ns.clientIP,
+		ns.machineKey.String(),
+	) {
+		return
+	}
+
 	ns.nodeKey = mapRequest.NodeKey
 
 	node, err := ns.headscale.db.GetNodeByAnyKey(
@@ -223,7 +401,7 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 		key.NodePublic{},
 	)
 	if err != nil {
-		log.Error().
+		logger.Error().
 			Str("handler", "NoisePollNetMap").
 			Uint64("node.id", node.ID.Uint64()).
 			Msgf("Failed to fetch node from the database with node key: %s", mapRequest.NodeKey.String())
@@ -231,6 +409,25 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 
 		return
 	}
+
+	hostinfo := mapRequest.Hostinfo
+	if hostinfo == nil {
+		hostinfo = node.Hostinfo
+	}
+	if hostinfo != nil {
+		if err := ns.headscale.checkClientVersion(hostinfo.IPNVersion); err != nil {
+			logger.Info().
+				Caller().
+				Str("node", node.Hostname).
+				Str("client_version", hostinfo.IPNVersion).
+				Str("min_client_version", ns.headscale.cfg.MinClientVersion).
+				Msg("Rejecting map request of outdated client")
+			http.Error(writer, err.Error(), http.StatusForbidden)
+
+			return
+		}
+	}
+
 	sess := ns.headscale.newMapSession(req.Context(), mapRequest, writer, node)
 
 	sess.tracef("a node sending a MapRequest with Noise protocol")
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
 
@@ -26,6 +28,14 @@ import (
 
 const (
 	randomByteSize = 16
+
+	// pkceCachePrefix prefixes the OIDC state in the registration cache
+	// to store the PKCE code verifier of a login attempt.
+	pkceCachePrefix = "pkce-"
+
+	// avatarURLMaxLength is the length the URL of the picture of a
+	// user is truncated to.
+	avatarURLMaxLength = 512
 )
 
 var (
@@ -41,7 +51,9 @@ var (
 	errOIDCInvalidNodeState = errors.New(
 		"requested node state key expired before authorisation completed",
 	)
-	errOIDCNodeKeyMissing = errors.New("could not get node key from cache")
+	errOIDCNodeKeyMissing  = errors.New("could not get node key from cache")
+	errOIDCMissingClaim    = errors.New("ID token is missing the claim")
+	errOIDCInsecurePicture = errors.New("picture claim is not an HTTPS URL")
 )
 
 type IDTokenClaims struct {
@@ -49,6 +61,31 @@ type IDTokenClaims struct {
 	Groups   []string `json:"groups,omitempty"`
 	Email    string   `json:"email"`
 	Username string   `json:"preferred_username,omitempty"`
+	Picture  string   `json:"picture,omitempty"`
+
+	// raw holds all the claims, to read the ones chosen in
+	// oidc.claims.
+	raw map[string]any
+}
+
+// claim returns the value of a claim of the ID token, which must be a
+// non-empty string.
+func (c *IDTokenClaims) claim(name string) (string, error) {
+	value, ok := c.raw[name].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("%w %q", errOIDCMissingClaim, name)
+	}
+
+	return value, nil
+}
+
+// oidcUserInfo is the information about the user read from the claims
+// chosen in oidc.claims.
+type oidcUserInfo struct {
+	Identity    string
+	UserName    string
+	DisplayName string
+	AvatarURL   string
 }
 
 func (h *Headscale) initOIDC() error {
@@ -71,6 +108,22 @@ func (h *Headscale) initOIDC() error {
 			),
 			Scopes: h.cfg.OIDC.Scope,
 		}
+
+		// Unless enabled in the configuration, only use PKCE if the
+		// provider advertises it in its discovery document, some
+		// providers reject unknown parameters.
+		var discovery struct {
+			CodeChallengeMethods []string `json:"code_challenge_methods_supported"`
+		}
+		if err := h.oidcProvider.Claims(&discovery); err != nil {
+			return fmt.Errorf("reading OIDC provider discovery document: %w", err)
+		}
+		h.oidcPKCE = h.cfg.OIDC.PKCE.Enabled ||
+			slices.Contains(discovery.CodeChallengeMethods, "S256")
+
+		log.Debug().
+			Bool("pkce", h.oidcPKCE).
+			Msg("OIDC provider configured")
 	}
 
 	return nil
@@ -137,7 +190,7 @@ func (h *Headscale) RegisterOIDC(
 	h.registrationCache.Set(
 		stateStr,
 		machineKey,
-		registerCacheExpiration,
+		h.cfg.NodeRegistrationTimeout,
 	)
 
 	// Add any extra parameter provided in the configuration to the Authorize Endpoint request
@@ -147,6 +200,19 @@ func (h *Headscale) RegisterOIDC(
 		extras = append(extras, oauth2.SetAuthURLParam(k, v))
 	}
 
+	// place the PKCE code verifier into the state cache, so it can be
+	// sent with the code in the callback
+	if h.oidcPKCE {
+		verifier := oauth2.GenerateVerifier()
+		h.registrationCache.Set(
+			pkceCachePrefix+stateStr,
+			verifier,
+			h.cfg.NodeRegistrationTimeout,
+		)
+
+		extras = append(extras, oauth2.S256ChallengeOption(verifier))
+	}
+
 	authURL := h.oauth2Config.AuthCodeURL(stateStr, extras...)
 	log.Debug().Msgf("Redirecting to %s for authentication", authURL)
 
@@ -202,6 +268,11 @@ func (h *Headscale) OIDCCallback(
 		return
 	}
 
+	userInfo, err := getOIDCUserInfo(writer, h.cfg.OIDC.Claims, claims)
+	if err != nil {
+		return
+	}
+
 	if err := validateOIDCAllowedDomains(writer, h.cfg.OIDC.AllowedDomains, claims); err != nil {
 		return
 	}
@@ -210,21 +281,21 @@ func (h *Headscale) OIDCCallback(
 		return
 	}
 
-	if err := validateOIDCAllowedUsers(writer, h.cfg.OIDC.AllowedUsers, claims); err != nil {
+	if err := validateOIDCAllowedUsers(writer, h.cfg.OIDC.AllowedUsers, userInfo.Identity); err != nil {
 		return
 	}
 
 	machineKey, nodeExists, err := h.validateNodeForOIDCCallback(
 		writer,
 		state,
-		claims,
+		userInfo,
 		idTokenExpiry,
 	)
 	if err != nil || nodeExists {
 		return
 	}
 
-	userName, err := getUserName(writer, claims, h.cfg.OIDC.StripEmaildomain)
+	userName, err := getUserName(writer, userInfo.UserName, h.cfg.OIDC.StripEmaildomain)
 	if err != nil {
 		return
 	}
@@ -232,16 +303,16 @@ func (h *Headscale) OIDCCallback(
 	// register the node if it's new
 	log.Debug().Msg("Registering new node after successful callback")
 
-	user, err := h.findOrCreateNewUserForOIDCCallback(writer, userName)
+	user, err := h.findOrCreateNewUserForOIDCCallback(writer, userName, userInfo)
 	if err != nil {
 		return
 	}
 
-	if err := h.registerNodeForOIDCCallback(writer, user, machineKey, idTokenExpiry); err != nil {
+	if err := h.registerNodeForOIDCCallback(req.Context(), writer, user, machineKey, idTokenExpiry); err != nil {
 		return
 	}
 
-	content, err := renderOIDCCallbackTemplate(writer, claims)
+	content, err := renderOIDCCallbackTemplate(writer, userInfo.Identity)
 	if err != nil {
 		return
 	}
@@ -279,7 +350,16 @@ func (h *Headscale) getIDTokenForOIDCCallback(
 	writer http.ResponseWriter,
 	code, state string,
 ) (string, error) {
-	oauth2Token, err := h.oauth2Config.Exchange(ctx, code)
+	var opts []oauth2.AuthCodeOption
+	if verifier, ok := h.registrationCache.Get(pkceCachePrefix + state); ok {
+		h.registrationCache.Delete(pkceCachePrefix + state)
+
+		if verifier, ok := verifier.(string); ok {
+			opts = append(opts, oauth2.VerifierOption(verifier))
+		}
+	}
+
+	oauth2Token, err := h.oauth2Config.Exchange(ctx, code, opts...)
 	if err != nil {
 		util.LogErr(err, "Could not exchange code for token")
 		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -340,7 +420,11 @@ func extractIDTokenClaims(
 	idToken *oidc.IDToken,
 ) (*IDTokenClaims, error) {
 	var claims IDTokenClaims
-	if err := idToken.Claims(&claims); err != nil {
+	err := idToken.Claims(&claims)
+	if err == nil {
+		err = idToken.Claims(&claims.raw)
+	}
+	if err != nil {
 		util.LogErr(err, "Failed to decode id token claims")
 
 		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -356,6 +440,69 @@ func extractIDTokenClaims(
 	return &claims, nil
 }
 
+// getOIDCUserInfo reads the information about the user from the claims
+// chosen in oidc.claims, failing with the name of the claim if one is
+// missing.
+func getOIDCUserInfo(
+	writer http.ResponseWriter,
+	cfg types.OIDCClaimsConfig,
+	claims *IDTokenClaims,
+) (*oidcUserInfo, error) {
+	var info oidcUserInfo
+	var err error
+
+	info.Identity, err = claims.claim(cfg.Identity)
+	if err == nil {
+		info.UserName, err = claims.claim(cfg.Username)
+	}
+	if err == nil && cfg.DisplayName != "" {
+		info.DisplayName, err = claims.claim(cfg.DisplayName)
+	}
+	if err == nil && claims.Picture != "" {
+		// The picture is only informative, the login goes on
+		// without it.
+		info.AvatarURL, err = avatarURLFromClaim(claims.Picture)
+		if err != nil {
+			log.Warn().Err(err).Str("picture", claims.Picture).Msg("ignoring picture claim")
+			err = nil
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("cannot read user information from the ID token")
+
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.WriteHeader(http.StatusBadRequest)
+		_, werr := writer.Write([]byte(err.Error()))
+		if werr != nil {
+			util.LogErr(err, "Failed to write response")
+		}
+
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// avatarURLFromClaim returns the URL of the picture claim, truncated to
+// avatarURLMaxLength. Only HTTPS URLs are accepted, clients fetch the
+// picture and must not be pointed to plain HTTP.
+func avatarURLFromClaim(picture string) (string, error) {
+	pictureURL, err := url.Parse(picture)
+	if err != nil {
+		return "", fmt.Errorf("parsing picture claim: %w", err)
+	}
+
+	if pictureURL.Scheme != "https" || pictureURL.Host == "" {
+		return "", errOIDCInsecurePicture
+	}
+
+	if len(picture) > avatarURLMaxLength {
+		picture = picture[:avatarURLMaxLength]
+	}
+
+	return picture, nil
+}
+
 // validateOIDCAllowedDomains checks that if AllowedDomains is provided,
 // that the authenticated principal ends with @<alloweddomain>.
 func validateOIDCAllowedDomains(
@@ -413,14 +560,15 @@ func validateOIDCAllowedGroups(
 }
 
 // validateOIDCAllowedUsers checks that if AllowedUsers is provided,
-// that the authenticated principal is part of that list.
+// that the authenticated principal, read from the oidc.claims.identity
+// claim, is part of that list.
 func validateOIDCAllowedUsers(
 	writer http.ResponseWriter,
 	allowedUsers []string,
-	claims *IDTokenClaims,
+	identity string,
 ) error {
 	if len(allowedUsers) > 0 &&
-		!util.IsStringInSlice(allowedUsers, claims.Email) {
+		!util.IsStringInSlice(allowedUsers, identity) {
 		log.Trace().Msg("authenticated principal does not match any allowed user")
 		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		writer.WriteHeader(http.StatusBadRequest)
@@ -442,7 +590,7 @@ func validateOIDCAllowedUsers(
 func (h *Headscale) validateNodeForOIDCCallback(
 	writer http.ResponseWriter,
 	state string,
-	claims *IDTokenClaims,
+	userInfo *oidcUserInfo,
 	expiry time.Time,
 ) (*key.MachinePublic, bool, error) {
 	// retrieve nodekey from state cache
@@ -488,6 +636,12 @@ func (h *Headscale) validateNodeForOIDCCallback(
 			Str("node", node.Hostname).
 			Msg("node already registered, reauthenticating")
 
+		if node.User.Disabled {
+			http.Error(writer, "user is disabled", http.StatusForbidden)
+
+			return nil, true, db.ErrUserDisabled
+		}
+
 		err := h.db.NodeSetExpiry(node.ID, expiry)
 		if err != nil {
 			util.LogErr(err, "Failed to refresh node")
@@ -504,9 +658,11 @@ func (h *Headscale) validateNodeForOIDCCallback(
 			Str("expiresAt", fmt.Sprintf("%v", expiry)).
 			Msg("successfully refreshed node")
 
+		h.updateUserFromOIDCClaims(&node.User, userInfo)
+
 		var content bytes.Buffer
 		if err := oidcCallbackTemplate.Execute(&content, oidcCallbackTemplateConfig{
-			User: claims.Email,
+			User: userInfo.Identity,
 			Verb: "Reauthenticated",
 		}); err != nil {
 			writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -537,19 +693,19 @@ func (h *Headscale) validateNodeForOIDCCallback(
 
 func getUserName(
 	writer http.ResponseWriter,
-	claims *IDTokenClaims,
+	claim string,
 	stripEmaildomain bool,
 ) (string, error) {
 	userName, err := util.NormalizeToFQDNRules(
-		claims.Email,
+		claim,
 		stripEmaildomain,
 	)
 	if err != nil {
-		util.LogErr(err, "couldn't normalize email")
+		util.LogErr(err, "couldn't normalize user name")
 
 		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		writer.WriteHeader(http.StatusInternalServerError)
-		_, werr := writer.Write([]byte("couldn't normalize email"))
+		_, werr := writer.Write([]byte("couldn't normalize user name"))
 		if werr != nil {
 			util.LogErr(err, "Failed to write response")
 		}
@@ -560,9 +716,12 @@ func getUserName(
 	return userName, nil
 }
 
+// findOrCreateNewUserForOIDCCallback returns the user, creating it if
+// needed, and updates it from the claims.
 func (h *Headscale) findOrCreateNewUserForOIDCCallback(
 	writer http.ResponseWriter,
 	userName string,
+	userInfo *oidcUserInfo,
 ) (*types.User, error) {
 	user, err := h.db.GetUser(userName)
 	if errors.Is(err, db.ErrUserNotFound) {
@@ -588,21 +747,65 @@ func (h *Headscale) findOrCreateNewUserForOIDCCallback(
 		return nil, fmt.Errorf("find or create user: %w", err)
 	}
 
+	h.updateUserFromOIDCClaims(user, userInfo)
+
 	return user, nil
 }
 
+// updateUserFromOIDCClaims updates the display name and the picture of
+// the user from the claims of every login, so they follow the changes
+// made in the identity provider.
+func (h *Headscale) updateUserFromOIDCClaims(user *types.User, userInfo *oidcUserInfo) {
+	// The display name and the picture are only informative, the
+	// registration goes on if they cannot be updated.
+	if userInfo.DisplayName != "" && user.DisplayName != userInfo.DisplayName {
+		err := h.db.Write(func(tx *gorm.DB) error {
+			return db.SetUserDisplayName(tx, user.Name, userInfo.DisplayName)
+		})
+		if err != nil {
+			util.LogErr(err, "could not update display name of user")
+		} else {
+			user.DisplayName = userInfo.DisplayName
+		}
+	}
+
+	if user.AvatarURL != userInfo.AvatarURL {
+		err := h.db.Write(func(tx *gorm.DB) error {
+			return db.SetUserAvatarURL(tx, user.Name, userInfo.AvatarURL)
+		})
+		if err != nil {
+			util.LogErr(err, "could not update avatar URL of user")
+		} else {
+			user.AvatarURL = userInfo.AvatarURL
+		}
+	}
+}
+
 func (h *Headscale) registerNodeForOIDCCallback(
+	ctx context.Context,
 	writer http.ResponseWriter,
 	user *types.User,
 	machineKey *key.MachinePublic,
 	expiry time.Time,
 ) error {
+	err := h.authorizeCachedRegistration(context.WithoutCancel(ctx), *machineKey, user.Name, util.RegisterMethodOIDC)
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.WriteHeader(http.StatusForbidden)
+		_, werr := writer.Write([]byte(err.Error()))
+		if werr != nil {
+			util.LogErr(err, "Failed to write response")
+		}
+
+		return err
+	}
+
 	ipv4, ipv6, err := h.ipAlloc.Next()
 	if err != nil {
 		return err
 	}
 
-	if err := h.db.DB.Transaction(func(tx *gorm.DB) error {
+	if err := h.db.Write(func(tx *gorm.DB) error {
 		if _, err := db.RegisterNodeFromAuthCallback(
 			// TODO(kradalby): find a better way to use the cache across modules
 			tx,
@@ -620,7 +823,11 @@ func (h *Headscale) registerNodeForOIDCCallback(
 	}); err != nil {
 		util.LogErr(err, "could not register node")
 		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		writer.WriteHeader(http.StatusInternalServerError)
+		if errors.Is(err, db.ErrUserDisabled) {
+			writer.WriteHeader(http.StatusForbidden)
+		} else {
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
 		_, werr := writer.Write([]byte("could not register node"))
 		if werr != nil {
 			util.LogErr(err, "Failed to write response")
@@ -629,16 +836,18 @@ func (h *Headscale) registerNodeForOIDCCallback(
 		return err
 	}
 
+	h.registrationWaiters.done(*machineKey)
+
 	return nil
 }
 
 func renderOIDCCallbackTemplate(
 	writer http.ResponseWriter,
-	claims *IDTokenClaims,
+	identity string,
 ) (*bytes.Buffer, error) {
 	var content bytes.Buffer
 	if err := oidcCallbackTemplate.Execute(&content, oidcCallbackTemplateConfig{
-		User: claims.Email,
+		User: identity,
 		Verb: "Authenticated",
 	}); err != nil {
 		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -0,0 +1,366 @@
+package hscontrol
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/mux"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/patrickmn/go-cache"
+	"tailscale.com/types/key"
+)
+
+func TestGetOIDCUserInfo(t *testing.T) {
+	claims := &IDTokenClaims{
+		raw: map[string]any{
+			"email":              "alice@example.com",
+			"preferred_username": "alice",
+			"display_name":       "Alice Liddell",
+			"groups":             []any{"admins"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		cfg     types.OIDCClaimsConfig
+		want    *oidcUserInfo
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			cfg:  types.OIDCClaimsConfig{Identity: "email", Username: "email"},
+			want: &oidcUserInfo{
+				Identity: "alice@example.com",
+				UserName: "alice@example.com",
+			},
+		},
+		{
+			name: "custom-claims",
+			cfg: types.OIDCClaimsConfig{
+				Identity:    "email",
+				Username:    "preferred_username",
+				DisplayName: "display_name",
+			},
+			want: &oidcUserInfo{
+				Identity:    "alice@example.com",
+				UserName:    "alice",
+				DisplayName: "Alice Liddell",
+			},
+		},
+		{
+			name:    "missing-claim",
+			cfg:     types.OIDCClaimsConfig{Identity: "email", Username: "upn"},
+			wantErr: `"upn"`,
+		},
+		{
+			name: "missing-display-name",
+			cfg: types.OIDCClaimsConfig{
+				Identity:    "email",
+				Username:    "email",
+				DisplayName: "name",
+			},
+			wantErr: `"name"`,
+		},
+		{
+			name:    "not-a-string",
+			cfg:     types.OIDCClaimsConfig{Identity: "groups", Username: "email"},
+			wantErr: `"groups"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+
+			got, err := getOIDCUserInfo(rec, tt.cfg, claims)
+			if tt.wantErr != "" {
+				if !errors.Is(err, errOIDCMissingClaim) {
+					t.Fatalf("want errOIDCMissingClaim, got %v", err)
+				}
+
+				if rec.Code != http.StatusBadRequest {
+					t.Errorf("want status %d, got %d", http.StatusBadRequest, rec.Code)
+				}
+
+				if !strings.Contains(rec.Body.String(), tt.wantErr) {
+					t.Errorf("response %q does not name the claim %s", rec.Body.String(), tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("getOIDCUserInfo() error = %v", err)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("getOIDCUserInfo() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAvatarURLFromClaim(t *testing.T) {
+	long := "https://example.com/" + strings.Repeat("a", avatarURLMaxLength)
+
+	tests := []struct {
+		name    string
+		picture string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "https",
+			picture: "https://example.com/alice.png",
+			want:    "https://example.com/alice.png",
+		},
+		{
+			name:    "truncated",
+			picture: long,
+			want:    long[:avatarURLMaxLength],
+		},
+		{
+			name:    "http",
+			picture: "http://example.com/alice.png",
+			wantErr: true,
+		},
+		{
+			name:    "data",
+			picture: "data:image/png;base64,iVBORw0KGgo=",
+			wantErr: true,
+		},
+		{
+			name:    "relative",
+			picture: "/alice.png",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := avatarURLFromClaim(tt.picture)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("avatarURLFromClaim() error = %v, wantErr %t", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("avatarURLFromClaim() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCPKCE(t *testing.T) {
+	tests := []struct {
+		name     string
+		methods  []string
+		wantPKCE bool
+	}{
+		{
+			name:     "s256",
+			methods:  []string{"plain", "S256"},
+			wantPKCE: true,
+		},
+		{
+			name:     "not-advertised",
+			wantPKCE: false,
+		},
+		{
+			name:     "plain-only",
+			methods:  []string{"plain"},
+			wantPKCE: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotVerifier string
+
+			handler := http.NewServeMux()
+			srv := httptest.NewServer(handler)
+			defer srv.Close()
+
+			handler.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]any{
+					"issuer":                           srv.URL,
+					"authorization_endpoint":           srv.URL + "/authorize",
+					"token_endpoint":                   srv.URL + "/token",
+					"jwks_uri":                         srv.URL + "/keys",
+					"code_challenge_methods_supported": tt.methods,
+				})
+			})
+			handler.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				gotVerifier = r.PostForm.Get("code_verifier")
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]any{
+					"access_token": "access",
+					"token_type":   "Bearer",
+					"id_token":     "id",
+				})
+			})
+
+			h := &Headscale{
+				cfg: &types.Config{
+					ServerURL:               "https://headscale.example.com",
+					NodeRegistrationTimeout: time.Minute,
+					OIDC: types.OIDCConfig{
+						Issuer:   srv.URL,
+						ClientID: "headscale",
+					},
+				},
+				registrationCache: cache.New(time.Minute, time.Minute),
+			}
+
+			if err := h.initOIDC(); err != nil {
+				t.Fatalf("initOIDC() error = %v", err)
+			}
+
+			if h.oidcPKCE != tt.wantPKCE {
+				t.Fatalf("want pkce %t, got %t", tt.wantPKCE, h.oidcPKCE)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/oidc/register", nil)
+			req = mux.SetURLVars(req, map[string]string{
+				"mkey": key.NewMachine().Public().String(),
+			})
+			rec := httptest.NewRecorder()
+			h.RegisterOIDC(rec, req)
+
+			if rec.Code != http.StatusFound {
+				t.Fatalf("want status %d, got %d", http.StatusFound, rec.Code)
+			}
+
+			authURL, err := url.Parse(rec.Header().Get("Location"))
+			if err != nil {
+				t.Fatalf("parsing redirect: %s", err)
+			}
+			state := authURL.Query().Get("state")
+			challenge := authURL.Query().Get("code_challenge")
+
+			_, err = h.getIDTokenForOIDCCallback(context.Background(), httptest.NewRecorder(), "code", state)
+			if err != nil {
+				t.Fatalf("getIDTokenForOIDCCallback() error = %v", err)
+			}
+
+			if !tt.wantPKCE {
+				if challenge != "" || gotVerifier != "" {
+					t.Errorf("want no PKCE, got challenge %q and verifier %q", challenge, gotVerifier)
+				}
+
+				return
+			}
+
+			if method := authURL.Query().Get("code_challenge_method"); method != "S256" {
+				t.Errorf("want code_challenge_method S256, got %q", method)
+			}
+
+			sum := sha256.Sum256([]byte(gotVerifier))
+			if want := base64.RawURLEncoding.EncodeToString(sum[:]); challenge != want {
+				t.Errorf("verifier %q does not match the challenge %q", gotVerifier, challenge)
+			}
+
+			if _, ok := h.registrationCache.Get(pkceCachePrefix + state); ok {
+				t.Errorf("verifier still in the cache after the exchange")
+			}
+		})
+	}
+}
+
+func TestOIDCPKCEEnabled(t *testing.T) {
+	var gotVerifier string
+
+	handler := http.NewServeMux()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	// The provider does not advertise PKCE, but requires it.
+	handler.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/keys",
+		})
+	})
+	handler.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		gotVerifier = r.PostForm.Get("code_verifier")
+
+		w.Header().Set("Content-Type", "application/json")
+		if gotVerifier == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{
+				"error":             "invalid_request",
+				"error_description": "code_verifier is required",
+			})
+
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     "id",
+		})
+	})
+
+	h := &Headscale{
+		cfg: &types.Config{
+			ServerURL:               "https://headscale.example.com",
+			NodeRegistrationTimeout: time.Minute,
+			OIDC: types.OIDCConfig{
+				Issuer:   srv.URL,
+				ClientID: "headscale",
+				PKCE:     types.OIDCPKCEConfig{Enabled: true},
+			},
+		},
+		registrationCache: cache.New(time.Minute, time.Minute),
+	}
+
+	if err := h.initOIDC(); err != nil {
+		t.Fatalf("initOIDC() error = %v", err)
+	}
+
+	if !h.oidcPKCE {
+		t.Fatal("want pkce with oidc.pkce.enabled")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/register", nil)
+	req = mux.SetURLVars(req, map[string]string{
+		"mkey": key.NewMachine().Public().String(),
+	})
+	rec := httptest.NewRecorder()
+	h.RegisterOIDC(rec, req)
+
+	authURL, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("parsing redirect: %s", err)
+	}
+
+	_, err = h.getIDTokenForOIDCCallback(
+		context.Background(),
+		httptest.NewRecorder(),
+		"code",
+		authURL.Query().Get("state"),
+	)
+	if err != nil {
+		t.Fatalf("getIDTokenForOIDCCallback() error = %v", err)
+	}
+
+	sum := sha256.Sum256([]byte(gotVerifier))
+	if want := base64.RawURLEncoding.EncodeToString(sum[:]); authURL.Query().Get("code_challenge") != want {
+		t.Errorf("verifier %q does not match the challenge %q", gotVerifier, authURL.Query().Get("code_challenge"))
+	}
+}
@@ -0,0 +1,248 @@
+package hscontrol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+)
+
+// nodeStatusEventBuffer is how many online status changes can wait for
+// the monitor before new ones are dropped.
+const nodeStatusEventBuffer = 256
+
+const nodeStatusOffline = "offline"
+
+var errOnlineStatusWebhookBadStatus = errors.New("online status webhook returned unexpected status")
+
+// onlineStatusWebhookNode describes the node in the body POSTed to the
+// online status webhook.
+type onlineStatusWebhookNode struct {
+	ID       types.NodeID `json:"id"`
+	Name     string       `json:"name"`
+	Hostname string       `json:"hostname"`
+	User     string       `json:"user"`
+}
+
+// onlineStatusWebhookRequest is the body POSTed to the online status
+// webhook when a node goes offline.
+type onlineStatusWebhookRequest struct {
+	Node     onlineStatusWebhookNode `json:"node"`
+	Status   string                  `json:"status"`
+	LastSeen *time.Time              `json:"last_seen"`
+}
+
+// nodeStatusEvent is a change of the online status of a node, or its
+// deletion, with a copy of the fields of the node sent to the webhook.
+type nodeStatusEvent struct {
+	online   bool
+	deleted  bool
+	at       time.Time
+	node     onlineStatusWebhookNode
+	lastSeen *time.Time
+}
+
+// NodeStatusMonitor follows the online status of the nodes and calls
+// the online status webhook when a node goes offline. A node is only
+// reported once it has been offline for the debounce delay, and only
+// once until it comes back online.
+type NodeStatusMonitor struct {
+	cfg    types.OnlineStatusWebhookConfig
+	events chan nodeStatusEvent
+
+	// notified holds the nodes reported offline and pending the nodes
+	// offline for less than the debounce delay, only accessed by the
+	// goroutine running the monitor.
+	notified map[types.NodeID]bool
+	pending  map[types.NodeID]nodeStatusEvent
+}
+
+func newNodeStatusMonitor(cfg types.OnlineStatusWebhookConfig) *NodeStatusMonitor {
+	return &NodeStatusMonitor{
+		cfg:      cfg,
+		events:   make(chan nodeStatusEvent, nodeStatusEventBuffer),
+		notified: make(map[types.NodeID]bool),
+		pending:  make(map[types.NodeID]nodeStatusEvent),
+	}
+}
+
+// report queues a change of the online status of a node. It does not
+// block the poll session: the change is dropped if the monitor is too
+// far behind.
+func (m *NodeStatusMonitor) report(online bool, node *types.Node) {
+	event := nodeStatusEvent{
+		online: online,
+		at:     time.Now(),
+		node: onlineStatusWebhookNode{
+			ID:       node.ID,
+			Name:     node.GivenName,
+			Hostname: node.Hostname,
+			User:     node.User.Name,
+		},
+	}
+	if node.LastSeen != nil {
+		lastSeen := *node.LastSeen
+		event.lastSeen = &lastSeen
+	}
+
+	m.queue(event)
+}
+
+// forget queues the deletion of nodes, so the monitor does not keep them
+// around. It does nothing on a nil monitor, when no online status
+// webhook is configured.
+func (m *NodeStatusMonitor) forget(nodeIDs ...types.NodeID) {
+	if m == nil {
+		return
+	}
+
+	for _, nodeID := range nodeIDs {
+		m.queue(nodeStatusEvent{
+			deleted: true,
+			at:      time.Now(),
+			node:    onlineStatusWebhookNode{ID: nodeID},
+		})
+	}
+}
+
+func (m *NodeStatusMonitor) queue(event nodeStatusEvent) {
+	select {
+	case m.events <- event:
+	default:
+		log.Warn().
+			Uint64("node.id", event.node.ID.Uint64()).
+			Bool("online", event.online).
+			Bool("deleted", event.deleted).
+			Msg("Online status monitor is behind, dropping status change")
+	}
+}
+
+// run handles the status changes, and reports the nodes offline for the
+// debounce delay, until ctx is done.
+func (m *NodeStatusMonitor) run(ctx context.Context) {
+	for {
+		var wake <-chan time.Time
+		if due, ok := m.nextDue(); ok {
+			wake = time.After(time.Until(due))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-m.events:
+			m.handle(ctx, event)
+		case now := <-wake:
+			m.flush(ctx, now)
+		}
+	}
+}
+
+func (m *NodeStatusMonitor) handle(ctx context.Context, event nodeStatusEvent) {
+	if event.online || event.deleted {
+		delete(m.notified, event.node.ID)
+		delete(m.pending, event.node.ID)
+
+		return
+	}
+
+	if m.notified[event.node.ID] {
+		return
+	}
+
+	if m.cfg.Debounce <= 0 {
+		m.notify(ctx, event)
+
+		return
+	}
+
+	// The node is reported once it has been offline for the debounce
+	// delay since it first went offline.
+	if _, ok := m.pending[event.node.ID]; !ok {
+		m.pending[event.node.ID] = event
+	}
+}
+
+// flush reports the pending nodes offline for the debounce delay at now.
+func (m *NodeStatusMonitor) flush(ctx context.Context, now time.Time) {
+	for nodeID, event := range m.pending {
+		if now.Before(event.at.Add(m.cfg.Debounce)) {
+			continue
+		}
+
+		delete(m.pending, nodeID)
+		m.notify(ctx, event)
+	}
+}
+
+// nextDue returns when the next pending node is to be reported.
+func (m *NodeStatusMonitor) nextDue() (time.Time, bool) {
+	var next time.Time
+	for _, event := range m.pending {
+		if due := event.at.Add(m.cfg.Debounce); next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+func (m *NodeStatusMonitor) notify(ctx context.Context, event nodeStatusEvent) {
+	err := callOnlineStatusWebhook(ctx, m.cfg, onlineStatusWebhookRequest{
+		Node:     event.node,
+		Status:   nodeStatusOffline,
+		LastSeen: event.lastSeen,
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Uint64("node.id", event.node.ID.Uint64()).
+			Str("hostname", event.node.Hostname).
+			Msg("Online status webhook failed")
+
+		return
+	}
+
+	m.notified[event.node.ID] = true
+}
+
+func callOnlineStatusWebhook(
+	ctx context.Context,
+	cfg types.OnlineStatusWebhookConfig,
+	req onlineStatusWebhookRequest,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{
+		Timeout: cfg.Timeout,
+	}
+
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode < http.StatusOK || httpResp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %s", errOnlineStatusWebhookBadStatus, httpResp.Status)
+	}
+
+	return nil
+}
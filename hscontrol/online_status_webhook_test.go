@@ -0,0 +1,175 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+func TestNodeStatusMonitor(t *testing.T) {
+	var mu sync.Mutex
+	var received []onlineStatusWebhookRequest
+	fail := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req onlineStatusWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding webhook request: %s", err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, req)
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	monitor := newNodeStatusMonitor(types.OnlineStatusWebhookConfig{
+		URL:     server.URL,
+		Timeout: 5 * time.Second,
+	})
+
+	lastSeen := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	node := &types.Node{
+		ID:        1,
+		GivenName: "laptop",
+		Hostname:  "laptop.local",
+		User:      types.User{Name: "alice"},
+		LastSeen:  &lastSeen,
+	}
+
+	ctx := context.Background()
+	step := func(online bool) {
+		t.Helper()
+		monitor.report(online, node)
+		monitor.handle(ctx, <-monitor.events)
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(received)
+	}
+
+	step(true)
+	if got := count(); got != 0 {
+		t.Fatalf("going online sent %d notifications, want 0", got)
+	}
+
+	step(false)
+	step(false)
+	if got := count(); got != 1 {
+		t.Fatalf("going offline twice sent %d notifications, want 1", got)
+	}
+
+	want := onlineStatusWebhookRequest{
+		Node: onlineStatusWebhookNode{
+			ID:       1,
+			Name:     "laptop",
+			Hostname: "laptop.local",
+			User:     "alice",
+		},
+		Status:   nodeStatusOffline,
+		LastSeen: &lastSeen,
+	}
+	if diff := cmp.Diff(want, received[0]); diff != "" {
+		t.Fatalf("unexpected webhook request (-want +got):\n%s", diff)
+	}
+
+	step(true)
+	step(false)
+	if got := count(); got != 2 {
+		t.Fatalf("going offline again sent %d notifications, want 2", got)
+	}
+
+	// A failed notification is not recorded, the next offline change
+	// is reported again.
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+
+	step(true)
+	step(false)
+	step(false)
+	if got := count(); got != 4 {
+		t.Fatalf("failed notifications sent %d notifications, want 4", got)
+	}
+}
+
+func TestNodeStatusMonitorDebounce(t *testing.T) {
+	var mu sync.Mutex
+	received := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received++
+	}))
+	defer server.Close()
+
+	monitor := newNodeStatusMonitor(types.OnlineStatusWebhookConfig{
+		URL:      server.URL,
+		Timeout:  5 * time.Second,
+		Debounce: time.Minute,
+	})
+
+	node := &types.Node{ID: 1, Hostname: "laptop.local"}
+
+	ctx := context.Background()
+	step := func(online bool) time.Time {
+		t.Helper()
+		monitor.report(online, node)
+		event := <-monitor.events
+		monitor.handle(ctx, event)
+
+		return event.at
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return received
+	}
+
+	// A node reconnecting before the debounce delay is not reported.
+	offline := step(false)
+	monitor.flush(ctx, offline.Add(30*time.Second))
+	step(true)
+	monitor.flush(ctx, offline.Add(2*time.Minute))
+	if got := count(); got != 0 {
+		t.Fatalf("reconnecting node sent %d notifications, want 0", got)
+	}
+
+	// The delay runs from the first time the node went offline.
+	offline = step(false)
+	step(false)
+	if due, ok := monitor.nextDue(); !ok || !due.Equal(offline.Add(time.Minute)) {
+		t.Fatalf("next due = %s, %t, want %s", due, ok, offline.Add(time.Minute))
+	}
+	monitor.flush(ctx, offline.Add(time.Minute))
+	if got := count(); got != 1 {
+		t.Fatalf("offline node sent %d notifications, want 1", got)
+	}
+	if _, ok := monitor.nextDue(); ok {
+		t.Fatal("reported node should not be pending anymore")
+	}
+
+	// Deleted nodes are forgotten.
+	monitor.forget(node.ID)
+	monitor.handle(ctx, <-monitor.events)
+	if len(monitor.notified) != 0 || len(monitor.pending) != 0 {
+		t.Fatalf("deleted node still tracked: notified %v, pending %v", monitor.notified, monitor.pending)
+	}
+
+	var disabled *NodeStatusMonitor
+	disabled.forget(node.ID)
+}
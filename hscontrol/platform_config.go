@@ -156,45 +156,11 @@ func (h *Headscale) ApplePlatformConfig(
 		return
 	}
 
-	id, err := uuid.NewV4()
-	if err != nil {
-		log.Error().
-			Str("handler", "ApplePlatformConfig").
-			Err(err).
-			Msg("Failed not create UUID")
-
-		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		writer.WriteHeader(http.StatusInternalServerError)
-		_, err := writer.Write([]byte("Failed to create UUID"))
-		if err != nil {
-			log.Error().
-				Caller().
-				Err(err).
-				Msg("Failed to write response")
-		}
-
-		return
-	}
-
-	contentID, err := uuid.NewV4()
-	if err != nil {
-		log.Error().
-			Str("handler", "ApplePlatformConfig").
-			Err(err).
-			Msg("Failed not create UUID")
-
-		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		writer.WriteHeader(http.StatusInternalServerError)
-		_, err := writer.Write([]byte("Failed to create content UUID"))
-		if err != nil {
-			log.Error().
-				Caller().
-				Err(err).
-				Msg("Failed to write response")
-		}
-
-		return
-	}
+	// The profile identifiers are derived from the server URL, so
+	// installing the profile again updates the existing one instead
+	// of adding a duplicate.
+	id := uuid.NewV5(uuid.NamespaceURL, h.cfg.ServerURL)
+	contentID := uuid.NewV5(id, platform)
 
 	platformConfig := AppleMobilePlatformConfig{
 		UUID: contentID,
@@ -220,7 +186,7 @@ func (h *Headscale) ApplePlatformConfig(
 	}
 
 	switch platform {
-	case "macos-standalone":
+	case "macos", "macos-standalone":
 		if err := macosStandaloneTemplate.Execute(&payload, platformConfig); err != nil {
 			handleMacError(err)
 
@@ -255,7 +221,7 @@ func (h *Headscale) ApplePlatformConfig(
 		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		writer.WriteHeader(http.StatusBadRequest)
 		_, err := writer.Write(
-			[]byte("Invalid platform. Only ios, macos-app-store and macos-standalone are supported"),
+			[]byte("Invalid platform. Only ios, macos, macos-app-store and macos-standalone are supported"),
 		)
 		if err != nil {
 			log.Error().
@@ -296,7 +262,7 @@ func (h *Headscale) ApplePlatformConfig(
 	writer.Header().
 		Set("Content-Type", "application/x-apple-aspen-config; charset=utf-8")
 	writer.WriteHeader(http.StatusOK)
-	_, err = writer.Write(content.Bytes())
+	_, err := writer.Write(content.Bytes())
 	if err != nil {
 		log.Error().
 			Caller().
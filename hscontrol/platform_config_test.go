@@ -0,0 +1,92 @@
+package hscontrol
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+func TestApplePlatformConfigStableUUID(t *testing.T) {
+	h := &Headscale{
+		cfg: &types.Config{ServerURL: "https://headscale.example.com"},
+	}
+
+	profile := func(platform string) string {
+		req := httptest.NewRequest(http.MethodGet, "/apple/"+platform, nil)
+		req = mux.SetURLVars(req, map[string]string{"platform": platform})
+		rec := httptest.NewRecorder()
+
+		h.ApplePlatformConfig(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status code for %s: %d", platform, rec.Code)
+		}
+
+		return rec.Body.String()
+	}
+
+	for _, platform := range []string{"ios", "macos", "macos-app-store", "macos-standalone"} {
+		if first, second := profile(platform), profile(platform); first != second {
+			t.Errorf("profile for %s is not stable between requests", platform)
+		}
+	}
+
+	if profile("ios") == profile("macos-app-store") {
+		t.Errorf("profiles for different platforms should not be identical")
+	}
+}
+
+// TestPlatformConfigBehindProxy checks that the pages and profiles given
+// to the clients point to server_url when a reverse proxy rewrites the
+// Host header to an internal address.
+func TestPlatformConfigBehindProxy(t *testing.T) {
+	h := &Headscale{
+		cfg: &types.Config{ServerURL: "https://headscale.example.com"},
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		vars    map[string]string
+		handler http.HandlerFunc
+	}{
+		{name: "windows page", path: "/windows", handler: h.WindowsConfigMessage},
+		{name: "windows registry", path: "/windows/tailscale.reg", handler: h.WindowsRegConfig},
+		{name: "apple page", path: "/apple", handler: h.AppleConfigMessage},
+		{
+			name:    "macos profile",
+			path:    "/apple/macos-app-store",
+			vars:    map[string]string{"platform": "macos-app-store"},
+			handler: h.ApplePlatformConfig,
+		},
+		{name: "redirect", path: "/register/nodekey", handler: h.redirect},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://10.0.0.5:8080"+tt.path, nil)
+			req.Host = "headscale.internal:8080"
+			req.Header.Set("X-Forwarded-Host", "proxy.internal")
+			if tt.vars != nil {
+				req = mux.SetURLVars(req, tt.vars)
+			}
+			rec := httptest.NewRecorder()
+
+			tt.handler(rec, req)
+
+			response := rec.Header().Get("Location") + rec.Body.String()
+			if !strings.Contains(response, "https://headscale.example.com") {
+				t.Errorf("response does not point to server_url:\n%s", response)
+			}
+			for _, internal := range []string{"10.0.0.5", "headscale.internal", "proxy.internal"} {
+				if strings.Contains(response, internal) {
+					t.Errorf("response leaks the internal address %s:\n%s", internal, response)
+				}
+			}
+		})
+	}
+}
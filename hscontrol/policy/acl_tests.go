@@ -0,0 +1,359 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+	"go4.org/netipx"
+	"tailscale.com/tailcfg"
+)
+
+var (
+	ErrPolicyTestFailed     = errors.New("policy test failed")
+	ErrPolicyCheckNoAddress = errors.New("matches no node or address")
+)
+
+// RunTests evaluates the tests section of the policy against the packet
+// filter compiled for nodes. An accept assertion holds if a single rule
+// allows the traffic from all the addresses of the source to all the
+// addresses of the destination, a deny assertion holds if no rule allows
+// any of it. The assertions of sources or destinations matching no
+// address are skipped, as there is nothing to check them against.
+// All the broken assertions are returned, joined.
+func (pol *ACLPolicy) RunTests(nodes types.Nodes) error {
+	if pol == nil || len(pol.Tests) == 0 {
+		return nil
+	}
+
+	rules, err := pol.CompileFilterRules(nodes)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for index, test := range pol.Tests {
+		srcs, err := pol.expandTestAlias(nodes, test.Source)
+		if err != nil {
+			return fmt.Errorf("tests[%d]: src %q: %w", index, test.Source, err)
+		}
+
+		protocols, _, err := parseProtocol(test.Protocol)
+		if err != nil {
+			return fmt.Errorf("tests[%d]: %w", index, err)
+		}
+
+		for _, dest := range test.Accept {
+			dsts, port, err := pol.parseTestDestination(nodes, dest)
+			if err != nil {
+				return fmt.Errorf("tests[%d]: accept %q: %w", index, dest, err)
+			}
+
+			if srcs == nil || dsts == nil {
+				log.Warn().
+					Int("test", index).
+					Str("src", test.Source).
+					Str("dst", dest).
+					Msg("Policy test matches no address, skipping it")
+
+				continue
+			}
+
+			if firstMatchingRule(rules, srcs, dsts, port, protocols, true) == -1 {
+				errs = append(errs, fmt.Errorf(
+					"%w: tests[%d]: %s -> %s: want accepted, denied as no rule allows it",
+					ErrPolicyTestFailed, index, test.Source, dest,
+				))
+			}
+		}
+
+		for _, dest := range test.Deny {
+			dsts, port, err := pol.parseTestDestination(nodes, dest)
+			if err != nil {
+				return fmt.Errorf("tests[%d]: deny %q: %w", index, dest, err)
+			}
+
+			if srcs == nil || dsts == nil {
+				continue
+			}
+
+			if rule := firstMatchingRule(rules, srcs, dsts, port, protocols, false); rule != -1 {
+				errs = append(errs, fmt.Errorf(
+					"%w: tests[%d]: %s -> %s: want denied, accepted by %s",
+					ErrPolicyTestFailed, index, test.Source, dest, pol.describeRule(rule),
+				))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// expandTestAlias returns the addresses of alias, or nil if it matches
+// no address.
+func (pol *ACLPolicy) expandTestAlias(nodes types.Nodes, alias string) (*netipx.IPSet, error) {
+	set, err := pol.ExpandAlias(nodes, alias)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(set.Prefixes()) == 0 {
+		return nil, nil
+	}
+
+	return set, nil
+}
+
+// parseTestDestination parses a test destination, an alias and a single
+// port like tag:server:22.
+func (pol *ACLPolicy) parseTestDestination(
+	nodes types.Nodes,
+	dest string,
+) (*netipx.IPSet, uint16, error) {
+	alias, portStr, err := parseDestination(dest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	port, err := strconv.ParseUint(portStr, util.Base10, util.BitSize16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: tests take a single port", ErrInvalidPortFormat)
+	}
+
+	dsts, err := pol.expandTestAlias(nodes, alias)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return dsts, uint16(port), nil
+}
+
+// firstMatchingRule returns the index of the first rule allowing traffic
+// on port from srcs to dsts, or -1. With whole, the rule must allow it
+// from all the sources to all the destinations, otherwise allowing any
+// part of it is enough.
+func firstMatchingRule(
+	rules []tailcfg.FilterRule,
+	srcs, dsts *netipx.IPSet,
+	port uint16,
+	protocols []int,
+	whole bool,
+) int {
+	covers := func(set, other *netipx.IPSet) bool {
+		if whole {
+			return subsetOf(other, set)
+		}
+
+		return set.Overlaps(other)
+	}
+
+	for index, rule := range rules {
+		if !protocolsMatch(rule.IPProto, protocols) {
+			continue
+		}
+
+		ruleSrcs := ipSetOf(rule.SrcIPs...)
+		if !covers(ruleSrcs, srcs) {
+			continue
+		}
+
+		var ruleDsts netipx.IPSetBuilder
+		for _, dst := range rule.DstPorts {
+			if port >= dst.Ports.First && port <= dst.Ports.Last {
+				ruleDsts.AddSet(ipSetOf(dst.IP))
+			}
+		}
+
+		set, _ := ruleDsts.IPSet()
+		if covers(set, dsts) {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// protocolsMatch reports whether a rule for ruleProtocols applies to the
+// traffic of a test for protocols. No protocols stand for TCP, UDP and
+// ICMP, as for the rules.
+func protocolsMatch(ruleProtocols, protocols []int) bool {
+	if len(ruleProtocols) == 0 {
+		ruleProtocols = []int{protocolTCP, protocolUDP, protocolICMP, protocolIPv6ICMP}
+	}
+
+	if len(protocols) == 0 {
+		protocols = []int{protocolTCP}
+	}
+
+	for _, protocol := range protocols {
+		if slices.Contains(ruleProtocols, protocol) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func ipSetOf(prefixes ...string) *netipx.IPSet {
+	var build netipx.IPSetBuilder
+	for _, prefix := range prefixes {
+		set, err := util.ParseIPSet(prefix, nil)
+		if err != nil {
+			continue
+		}
+
+		build.AddSet(set)
+	}
+
+	set, _ := build.IPSet()
+
+	return set
+}
+
+func subsetOf(set, other *netipx.IPSet) bool {
+	for _, prefix := range set.Prefixes() {
+		if !other.ContainsPrefix(prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// describeRule names the rule at index of the compiled filter, the rules
+// of the user policies follow the ones of the ACLs.
+func (pol *ACLPolicy) describeRule(index int) string {
+	if index < len(pol.ACLs) {
+		acl := pol.ACLs[index]
+
+		return fmt.Sprintf("acls[%d] (src %v, dst %v)", index, acl.Sources, acl.Destinations)
+	}
+
+	return "a user policy"
+}
+
+// AccessCheck is the verdict of CheckAccess on some traffic.
+type AccessCheck struct {
+	// Allowed reports whether a rule allows the traffic from all the
+	// addresses of the source to all the addresses of the destination.
+	Allowed bool
+
+	// Partial reports whether the traffic is denied but a rule allows
+	// part of it, between some of the addresses.
+	Partial bool
+
+	// RuleIndex is the index in the acls section of the rule allowing
+	// the traffic, or -1 if no rule or a user policy allows it.
+	RuleIndex int
+
+	// Rule describes the rule allowing the traffic, or part of it.
+	Rule string
+}
+
+// CheckAccess evaluates the policy on the traffic from src to dst, with
+// protocol, for nodes. The source is an alias or the name of a node, the
+// destination is one of them with a single port like tag:server:22, the
+// traffic is TCP unless protocol says otherwise. As for the accept
+// assertions of the tests, the traffic is allowed if a single rule
+// allows it from every address of the source to every address of the
+// destination.
+func (pol *ACLPolicy) CheckAccess(
+	nodes types.Nodes,
+	src, dst, protocol string,
+) (*AccessCheck, error) {
+	rules, err := pol.CompileFilterRules(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	srcs, err := pol.expandCheckAlias(nodes, src)
+	if err != nil {
+		return nil, fmt.Errorf("src %q: %w", src, err)
+	}
+
+	alias, portStr, err := parseDestination(dst)
+	if err != nil {
+		return nil, fmt.Errorf("dst %q: %w", dst, err)
+	}
+
+	port, err := strconv.ParseUint(portStr, util.Base10, util.BitSize16)
+	if err != nil {
+		return nil, fmt.Errorf("dst %q: %w: a single port is checked", dst, ErrInvalidPortFormat)
+	}
+
+	dsts, err := pol.expandCheckAlias(nodes, alias)
+	if err != nil {
+		return nil, fmt.Errorf("dst %q: %w", dst, err)
+	}
+
+	protocols, _, err := parseProtocol(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	check := &AccessCheck{RuleIndex: -1}
+
+	rule := firstMatchingRule(rules, srcs, dsts, uint16(port), protocols, true)
+	if rule == -1 {
+		rule = firstMatchingRule(rules, srcs, dsts, uint16(port), protocols, false)
+		if rule == -1 {
+			return check, nil
+		}
+
+		check.Partial = true
+	} else {
+		check.Allowed = true
+	}
+
+	if rule < len(pol.ACLs) {
+		check.RuleIndex = rule
+	}
+	check.Rule = pol.describeRule(rule)
+
+	return check, nil
+}
+
+// expandCheckAlias returns the addresses of alias, or of the node named
+// alias if it is not the name of a user. It fails if they match no
+// address.
+func (pol *ACLPolicy) expandCheckAlias(nodes types.Nodes, alias string) (*netipx.IPSet, error) {
+	isUser := false
+	var named *types.Node
+	for _, node := range nodes {
+		if node.User.Name == alias {
+			isUser = true
+		}
+
+		if node.GivenName == alias {
+			named = node
+		}
+	}
+
+	if named != nil && !isUser {
+		if len(named.IPs()) == 0 {
+			return nil, ErrPolicyCheckNoAddress
+		}
+
+		var build netipx.IPSetBuilder
+		for _, ip := range named.IPs() {
+			build.Add(ip)
+		}
+
+		return build.IPSet()
+	}
+
+	set, err := pol.expandTestAlias(nodes, alias)
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		return nil, ErrPolicyCheckNoAddress
+	}
+
+	return set, nil
+}
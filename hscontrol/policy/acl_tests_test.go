@@ -0,0 +1,247 @@
+package policy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+func TestACLPolicyRunTests(t *testing.T) {
+	nodes := types.Nodes{
+		{
+			ID:   1,
+			IPv4: iap("100.64.0.1"),
+			User: types.User{Name: "alice"},
+		},
+		{
+			ID:   2,
+			IPv4: iap("100.64.0.2"),
+			User: types.User{Name: "bob"},
+		},
+		{
+			ID:         3,
+			IPv4:       iap("100.64.0.3"),
+			User:       types.User{Name: "admin"},
+			ForcedTags: []string{"tag:db"},
+		},
+	}
+
+	acls := `
+		"groups": {"group:dev": ["alice", "bob"]},
+		"tagOwners": {"tag:db": ["admin"]},
+		"acls": [
+			{"action": "accept", "src": ["group:dev"], "dst": ["tag:db:5432"]},
+			{"action": "accept", "src": ["alice"], "dst": ["bob:22"]},
+		],
+	`
+
+	tests := []struct {
+		name    string
+		tests   string
+		wantErr []string
+	}{
+		{
+			name: "assertions hold",
+			tests: `[
+				{"src": "group:dev", "accept": ["tag:db:5432"], "deny": ["tag:db:22"]},
+				{"src": "alice", "accept": ["bob:22", "100.64.0.3:5432"]},
+				{"src": "bob", "deny": ["alice:22"]},
+			]`,
+		},
+		{
+			name: "accept denied",
+			tests: `[
+				{"src": "bob", "accept": ["alice:22"]},
+			]`,
+			wantErr: []string{"tests[0]: bob -> alice:22: want accepted, denied as no rule allows it"},
+		},
+		{
+			name: "deny accepted",
+			tests: `[
+				{"src": "alice", "deny": ["tag:db:5432"]},
+			]`,
+			wantErr: []string{"tests[0]: alice -> tag:db:5432: want denied, accepted by acls[0]"},
+		},
+		{
+			name: "accept of part of a group",
+			tests: `[
+				{"src": "group:dev", "accept": ["bob:22"]},
+			]`,
+			wantErr: []string{"tests[0]: group:dev -> bob:22: want accepted"},
+		},
+		{
+			name: "all broken assertions are reported",
+			tests: `[
+				{"src": "bob", "accept": ["alice:22"]},
+				{"src": "alice", "accept": ["tag:db:22"], "deny": ["bob:22"]},
+			]`,
+			wantErr: []string{
+				"tests[0]: bob -> alice:22",
+				"tests[1]: alice -> tag:db:22",
+				"tests[1]: alice -> bob:22",
+			},
+		},
+		{
+			name: "protocol of the test",
+			tests: `[
+				{"src": "alice", "proto": "udp", "accept": ["bob:22"]},
+				{"src": "alice", "proto": "sctp", "deny": ["bob:22"]},
+			]`,
+		},
+		{
+			name: "source without nodes is skipped",
+			tests: `[
+				{"src": "carol", "accept": ["tag:db:5432"]},
+			]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol, err := LoadACLPolicyFromBytes(
+				[]byte("{"+acls+`"tests": `+tt.tests+"}"),
+				"hujson",
+			)
+			if err != nil {
+				t.Fatalf("loading policy: %s", err)
+			}
+
+			err = pol.RunTests(nodes)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("RunTests() error = %s, want none", err)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, ErrPolicyTestFailed) {
+				t.Fatalf("RunTests() error = %v, want %v", err, ErrPolicyTestFailed)
+			}
+
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("RunTests() error = %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestACLPolicyCheckAccess(t *testing.T) {
+	nodes := types.Nodes{
+		{
+			ID:        1,
+			GivenName: "laptop",
+			IPv4:      iap("100.64.0.1"),
+			User:      types.User{Name: "alice"},
+		},
+		{
+			ID:        2,
+			GivenName: "desktop",
+			IPv4:      iap("100.64.0.2"),
+			User:      types.User{Name: "bob"},
+		},
+		{
+			ID:         3,
+			GivenName:  "db",
+			IPv4:       iap("100.64.0.3"),
+			User:       types.User{Name: "admin"},
+			ForcedTags: []string{"tag:db"},
+		},
+	}
+
+	pol, err := LoadACLPolicyFromBytes([]byte(`{
+		"groups": {"group:dev": ["alice", "bob"]},
+		"tagOwners": {"tag:db": ["admin"]},
+		"acls": [
+			{"action": "accept", "src": ["group:dev"], "dst": ["tag:db:5432"]},
+			{"action": "accept", "proto": "udp", "src": ["alice"], "dst": ["bob:53"]},
+		],
+	}`), "hujson")
+	if err != nil {
+		t.Fatalf("loading policy: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		src      string
+		dst      string
+		protocol string
+		want     AccessCheck
+		wantErr  error
+	}{
+		{
+			name: "allowed by a group",
+			src:  "bob",
+			dst:  "tag:db:5432",
+			want: AccessCheck{Allowed: true, RuleIndex: 0, Rule: "acls[0] (src [group:dev], dst [tag:db:5432])"},
+		},
+		{
+			name: "node names",
+			src:  "laptop",
+			dst:  "db:5432",
+			want: AccessCheck{Allowed: true, RuleIndex: 0, Rule: "acls[0] (src [group:dev], dst [tag:db:5432])"},
+		},
+		{
+			name: "denied port",
+			src:  "alice",
+			dst:  "100.64.0.3:22",
+			want: AccessCheck{RuleIndex: -1},
+		},
+		{
+			name:     "protocol",
+			src:      "alice",
+			dst:      "desktop:53",
+			protocol: "udp",
+			want:     AccessCheck{Allowed: true, RuleIndex: 1, Rule: "acls[1] (src [alice], dst [bob:53])"},
+		},
+		{
+			name: "tcp by default",
+			src:  "alice",
+			dst:  "desktop:53",
+			want: AccessCheck{RuleIndex: -1},
+		},
+		{
+			name:     "part of a group",
+			src:      "group:dev",
+			dst:      "bob:53",
+			protocol: "udp",
+			want:     AccessCheck{Partial: true, RuleIndex: 1, Rule: "acls[1] (src [alice], dst [bob:53])"},
+		},
+		{
+			name:    "source without nodes",
+			src:     "carol",
+			dst:     "tag:db:5432",
+			wantErr: ErrPolicyCheckNoAddress,
+		},
+		{
+			name:    "port range",
+			src:     "alice",
+			dst:     "tag:db:1-1000",
+			wantErr: ErrInvalidPortFormat,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pol.CheckAccess(nodes, tt.src, tt.dst, tt.protocol)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("CheckAccess() error = %v, want %v", err, tt.wantErr)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckAccess() error = %s", err)
+			}
+
+			if *got != tt.want {
+				t.Errorf("CheckAccess() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
@@ -8,16 +8,19 @@ import (
 	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/juanfont/headscale/hscontrol/policy/matcher"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/rs/zerolog/log"
 	"github.com/tailscale/hujson"
 	"go4.org/netipx"
 	"gopkg.in/yaml.v3"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 )
 
@@ -26,10 +29,32 @@ var (
 	ErrInvalidAction     = errors.New("invalid action")
 	ErrInvalidGroup      = errors.New("invalid group")
 	ErrInvalidTag        = errors.New("invalid tag")
+	ErrInvalidHost       = errors.New("invalid host")
 	ErrInvalidPortFormat = errors.New("invalid port format")
 	ErrWildcardIsNeeded  = errors.New("wildcard as port is required for the protocol")
+	ErrInvalidAutogroup  = errors.New("invalid autogroup")
+	ErrInvalidProtocol   = errors.New("invalid protocol")
+	ErrInvalidSSHRule    = errors.New("invalid ssh rule")
 )
 
+// autogroupInternet is the destination of the traffic routed through
+// exit nodes.
+const autogroupInternet = "autogroup:internet"
+
+// autogroupMember stands for the nodes owned by a user, and autogroupTagged
+// for the tagged nodes. A node is in one or the other.
+const (
+	autogroupMember = "autogroup:member"
+	autogroupTagged = "autogroup:tagged"
+)
+
+// sshUserNonRoot is the SSH user standing for any local user but root.
+const sshUserNonRoot = "autogroup:nonroot"
+
+// defaultSSHCheckPeriod is how long a check of an SSH rule with no
+// checkPeriod lasts, the default of Tailscale.
+const defaultSSHCheckPeriod = 12 * time.Hour
+
 const (
 	portRangeBegin     = 0
 	portRangeEnd       = 65535
@@ -51,15 +76,31 @@ const (
 	protocolIPv6ICMP = 58  // ICMP for IPv6
 	protocolSCTP     = 132 // Stream Control Transmission Protocol
 	ProtocolFC       = 133 // Fibre Channel
+
+	protocolMax = 255 // highest protocol number
 )
 
 // LoadACLPolicyFromPath loads the ACL policy from the specify path, and generates the ACL rules.
+// If path is a directory, it is loaded with LoadACLPolicyFromDir and the
+// policies of the users that cannot be loaded are logged and ignored.
 func LoadACLPolicyFromPath(path string) (*ACLPolicy, error) {
 	log.Debug().
 		Str("func", "LoadACLPolicy").
 		Str("path", path).
 		Msg("Loading ACL policy from path")
 
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		pol, userErrs, err := LoadACLPolicyFromDir(path)
+		for user, userErr := range userErrs {
+			log.Error().
+				Err(userErr).
+				Str("user", user).
+				Msg("Could not load the ACL policy of the user, ignoring it")
+		}
+
+		return pol, err
+	}
+
 	policyFile, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -103,7 +144,7 @@ func LoadACLPolicyFromBytes(acl []byte, format string) (*ACLPolicy, error) {
 		acl = ast.Pack()
 		err = json.Unmarshal(acl, &policy)
 		if err != nil {
-			return nil, err
+			return nil, withLineColumn(acl, err)
 		}
 	}
 
@@ -114,6 +155,34 @@ func LoadACLPolicyFromBytes(acl []byte, format string) (*ACLPolicy, error) {
 	return &policy, nil
 }
 
+// withLineColumn adds the position of a JSON decoding error to it, like
+// hujson does for its parsing errors. Standardize keeps the byte offsets
+// of the policy, so the position is the one in the policy file.
+func withLineColumn(data []byte, err error) error {
+	var offset int64
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+
+	if offset < 0 || offset > int64(len(data)) {
+		return err
+	}
+
+	before := data[:offset]
+	line := 1 + strings.Count(string(before), "\n")
+	column := 1 + len(before) - (strings.LastIndex(string(before), "\n") + 1)
+
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
 func GenerateFilterAndSSHRulesForTests(
 	policy *ACLPolicy,
 	node *types.Node,
@@ -144,36 +213,47 @@ func GenerateFilterAndSSHRulesForTests(
 func (pol *ACLPolicy) CompileFilterRules(
 	nodes types.Nodes,
 ) ([]tailcfg.FilterRule, error) {
+	rules, _, err := pol.compileFilterRules(nodes)
+
+	return rules, err
+}
+
+// compileFilterRules compiles the filter rules like CompileFilterRules,
+// with the source of each rule in the policy.
+func (pol *ACLPolicy) compileFilterRules(
+	nodes types.Nodes,
+) ([]tailcfg.FilterRule, []FilterRuleSource, error) {
 	if pol == nil {
-		return tailcfg.FilterAllowAll, nil
+		return tailcfg.FilterAllowAll, make([]FilterRuleSource, len(tailcfg.FilterAllowAll)), nil
 	}
 
 	rules := []tailcfg.FilterRule{}
+	sources := []FilterRuleSource{}
 
 	for index, acl := range pol.ACLs {
 		if acl.Action != "accept" {
-			return nil, ErrInvalidAction
+			return nil, nil, ErrInvalidAction
 		}
 
 		srcIPs := []string{}
 		for srcIndex, src := range acl.Sources {
 			srcs, err := pol.expandSource(src, nodes)
 			if err != nil {
-				return nil, fmt.Errorf("parsing policy, acl index: %d->%d: %w", index, srcIndex, err)
+				return nil, nil, fmt.Errorf("parsing policy, acl index: %d->%d: %w", index, srcIndex, err)
 			}
 			srcIPs = append(srcIPs, srcs...)
 		}
 
 		protocols, isWildcard, err := parseProtocol(acl.Protocol)
 		if err != nil {
-			return nil, fmt.Errorf("parsing policy, protocol err: %w ", err)
+			return nil, nil, fmt.Errorf("parsing policy, acl index: %d: %w", index, err)
 		}
 
 		destPorts := []tailcfg.NetPortRange{}
-		for _, dest := range acl.Destinations {
+		for destIndex, dest := range acl.Destinations {
 			alias, port, err := parseDestination(dest)
 			if err != nil {
-				return nil, err
+				return nil, nil, fmt.Errorf("parsing policy, acl index: %d->%d: %w", index, destIndex, err)
 			}
 
 			expanded, err := pol.ExpandAlias(
@@ -181,12 +261,12 @@ func (pol *ACLPolicy) CompileFilterRules(
 				alias,
 			)
 			if err != nil {
-				return nil, err
+				return nil, nil, fmt.Errorf("parsing policy, acl index: %d->%d: %w", index, destIndex, err)
 			}
 
 			ports, err := expandPorts(port, isWildcard)
 			if err != nil {
-				return nil, err
+				return nil, nil, fmt.Errorf("parsing policy, acl index: %d->%d: %w", index, destIndex, err)
 			}
 
 			dests := []tailcfg.NetPortRange{}
@@ -207,9 +287,16 @@ func (pol *ACLPolicy) CompileFilterRules(
 			DstPorts: destPorts,
 			IPProto:  protocols,
 		})
+		sources = append(sources, FilterRuleSource{ACL: &index})
+	}
+
+	userRules, owners := pol.compileUserPoliciesFilterRules(nodes)
+	rules = append(rules, userRules...)
+	for _, owner := range owners {
+		sources = append(sources, FilterRuleSource{User: owner})
 	}
 
-	return rules, nil
+	return rules, sources, nil
 }
 
 // ReduceFilterRules takes a node and a set of rules and removes all rules and destinations
@@ -231,19 +318,23 @@ func ReduceFilterRules(node *types.Node, rules []tailcfg.FilterRule) []tailcfg.F
 
 			if node.InIPSet(expanded) {
 				dests = append(dests, dest)
+
+				continue
 			}
 
 			// If the node exposes routes, ensure they are note removed
-			// when the filters are reduced.
+			// when the filters are reduced. The destinations only need to
+			// overlap the routes, exit nodes route 0.0.0.0/0 and ::/0 but
+			// autogroup:internet does not cover the private ranges.
 			if node.Hostinfo != nil {
 				// TODO(kradalby): Evaluate if we should only keep
 				// the routes if the route is enabled. This will
 				// require database access in this part of the code.
-				if len(node.Hostinfo.RoutableIPs) > 0 {
-					for _, routableIP := range node.Hostinfo.RoutableIPs {
-						if expanded.ContainsPrefix(routableIP) {
-							dests = append(dests, dest)
-						}
+				for _, routableIP := range node.Hostinfo.RoutableIPs {
+					if expanded.OverlapsPrefix(routableIP) {
+						dests = append(dests, dest)
+
+						break
 					}
 				}
 			}
@@ -322,7 +413,7 @@ func (pol *ACLPolicy) CompileSSHPolicy(
 				action = *checkAction
 			}
 		default:
-			return nil, fmt.Errorf("parsing SSH policy, unknown action %q, index: %d: %w", sshACL.Action, index, err)
+			return nil, fmt.Errorf("parsing SSH policy, index: %d: %w %q", index, ErrInvalidAction, sshACL.Action)
 		}
 
 		principals := make([]*tailcfg.SSHPrincipal, 0, len(sshACL.Sources))
@@ -360,6 +451,15 @@ func (pol *ACLPolicy) CompileSSHPolicy(
 
 		userMap := make(map[string]string, len(sshACL.Users))
 		for _, user := range sshACL.Users {
+			if user == sshUserNonRoot {
+				// Any local user but root, logging in as
+				// themselves.
+				userMap["*"] = "="
+				userMap["root"] = ""
+
+				continue
+			}
+
 			userMap[user] = "="
 		}
 		rules = append(rules, &tailcfg.SSHRule{
@@ -374,10 +474,402 @@ func (pol *ACLPolicy) CompileSSHPolicy(
 	}, nil
 }
 
+// SSHDestinations returns the nodes of nodes which are the destination of
+// one of the SSH rules of the policy. Only these nodes are given the SSH
+// capability. Each destination is expanded once for all the nodes.
+func (pol *ACLPolicy) SSHDestinations(nodes types.Nodes) map[types.NodeID]bool {
+	destinations := make(map[types.NodeID]bool)
+	if pol == nil {
+		return destinations
+	}
+
+	for _, sshACL := range pol.SSHs {
+		for _, dst := range sshACL.Destinations {
+			expanded, err := pol.ExpandAlias(nodes, dst)
+			if err != nil {
+				continue
+			}
+
+			for _, node := range nodes {
+				if !destinations[node.ID] && node.InIPSet(expanded) {
+					destinations[node.ID] = true
+				}
+			}
+		}
+	}
+
+	return destinations
+}
+
+// IsSSHDestination reports if node is the destination of one of the SSH
+// rules of the policy, like SSHDestinations for a single node.
+func (pol *ACLPolicy) IsSSHDestination(node *types.Node) bool {
+	return pol.SSHDestinations(types.Nodes{node})[node.ID]
+}
+
+// ValidateGroups checks that all the groups referenced by the policy are
+// defined, in Groups or in NodeGroups. Tag owners are users, so the groups
+// they reference must be in Groups.
+func (pol *ACLPolicy) ValidateGroups() error {
+	if pol == nil {
+		return nil
+	}
+
+	return pol.walkGroups(func(alias string, where string, nodeGroups bool) error {
+		if pol.isGroupDefined(alias, nodeGroups) {
+			return nil
+		}
+
+		return fmt.Errorf("%w: %s is not defined, referenced in %s", ErrInvalidGroup, alias, where)
+	})
+}
+
+// UndefinedNodeGroups returns the groups referenced where nodes are
+// accepted, like the sources and destinations of the ACLs, which are
+// defined neither in Groups nor in NodeGroups.
+func (pol *ACLPolicy) UndefinedNodeGroups() []string {
+	if pol == nil {
+		return nil
+	}
+
+	var undefined []string
+	_ = pol.walkGroups(func(alias string, _ string, nodeGroups bool) error {
+		if nodeGroups && !pol.isGroupDefined(alias, true) && !slices.Contains(undefined, alias) {
+			undefined = append(undefined, alias)
+		}
+
+		return nil
+	})
+
+	return undefined
+}
+
+func (pol *ACLPolicy) isGroupDefined(group string, nodeGroups bool) bool {
+	if _, ok := pol.Groups[group]; ok {
+		return true
+	}
+
+	_, ok := pol.NodeGroups[group]
+
+	return ok && nodeGroups
+}
+
+// walkGroups calls visit with every group referenced by the policy, where
+// it is referenced and whether node groups are accepted there, until
+// visit returns an error.
+func (pol *ACLPolicy) walkGroups(visit func(group string, where string, nodeGroups bool) error) error {
+	check := func(alias string, where string, nodeGroups bool) error {
+		if !isGroup(alias) {
+			return nil
+		}
+
+		return visit(alias, where, nodeGroups)
+	}
+
+	for index, acl := range pol.ACLs {
+		for _, src := range acl.Sources {
+			if err := check(src, fmt.Sprintf("acls[%d].src", index), true); err != nil {
+				return err
+			}
+		}
+
+		for _, dest := range acl.Destinations {
+			alias, _, err := parseDestination(dest)
+			if err != nil {
+				return err
+			}
+
+			if err := check(alias, fmt.Sprintf("acls[%d].dst", index), true); err != nil {
+				return err
+			}
+		}
+	}
+
+	for index, ssh := range pol.SSHs {
+		for _, src := range ssh.Sources {
+			if err := check(src, fmt.Sprintf("ssh[%d].src", index), true); err != nil {
+				return err
+			}
+		}
+
+		for _, dest := range ssh.Destinations {
+			if err := check(dest, fmt.Sprintf("ssh[%d].dst", index), true); err != nil {
+				return err
+			}
+		}
+	}
+
+	for prefix, approvers := range pol.AutoApprovers.Routes {
+		for _, approver := range approvers {
+			if err := check(approver, fmt.Sprintf("autoApprovers.routes[%s]", prefix), true); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, approver := range pol.AutoApprovers.ExitNode {
+		if err := check(approver, "autoApprovers.exitNode", true); err != nil {
+			return err
+		}
+	}
+
+	for tag, owners := range pol.TagOwners {
+		for _, owner := range owners {
+			if err := check(owner, fmt.Sprintf("tagOwners[%s]", tag), false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateTags checks that all the tags referenced by the rules and the
+// auto approvers of the policy have an owner in TagOwners.
+func (pol *ACLPolicy) ValidateTags() error {
+	if pol == nil {
+		return nil
+	}
+
+	check := func(alias string, where string) error {
+		if !isTag(alias) {
+			return nil
+		}
+
+		if _, ok := pol.TagOwners[alias]; ok {
+			return nil
+		}
+
+		return fmt.Errorf("%w: %s has no owner in tagOwners, referenced in %s", ErrInvalidTag, alias, where)
+	}
+
+	for index, acl := range pol.ACLs {
+		for _, src := range acl.Sources {
+			if err := check(src, fmt.Sprintf("acls[%d].src", index)); err != nil {
+				return err
+			}
+		}
+
+		for _, dest := range acl.Destinations {
+			alias, _, err := parseDestination(dest)
+			if err != nil {
+				return err
+			}
+
+			if err := check(alias, fmt.Sprintf("acls[%d].dst", index)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for index, ssh := range pol.SSHs {
+		for _, src := range ssh.Sources {
+			if err := check(src, fmt.Sprintf("ssh[%d].src", index)); err != nil {
+				return err
+			}
+		}
+
+		for _, dest := range ssh.Destinations {
+			if err := check(dest, fmt.Sprintf("ssh[%d].dst", index)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for prefix, approvers := range pol.AutoApprovers.Routes {
+		for _, approver := range approvers {
+			if err := check(approver, fmt.Sprintf("autoApprovers.routes[%s]", prefix)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, approver := range pol.AutoApprovers.ExitNode {
+		if err := check(approver, "autoApprovers.exitNode"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateHosts checks that the names used in the rules of the policy are
+// defined in Hosts, or are valid user names: names which are not hosts
+// are users.
+func (pol *ACLPolicy) ValidateHosts() error {
+	if pol == nil {
+		return nil
+	}
+
+	check := func(alias string, where string) error {
+		if !isHostName(alias) {
+			return nil
+		}
+
+		if _, ok := pol.Hosts[alias]; ok {
+			return nil
+		}
+
+		if looksLikeAddress(alias) {
+			return fmt.Errorf(
+				"%w: %s is not a valid IP address or prefix, referenced in %s",
+				ErrInvalidHost,
+				alias,
+				where,
+			)
+		}
+
+		if util.CheckForFQDNRules(alias) == nil {
+			return nil
+		}
+
+		return fmt.Errorf(
+			"%w: %s is not defined in hosts and is not a valid user name, referenced in %s",
+			ErrInvalidHost,
+			alias,
+			where,
+		)
+	}
+
+	for index, acl := range pol.ACLs {
+		for _, src := range acl.Sources {
+			if err := check(src, fmt.Sprintf("acls[%d].src", index)); err != nil {
+				return err
+			}
+		}
+
+		for _, dest := range acl.Destinations {
+			alias, _, err := parseDestination(dest)
+			if err != nil {
+				return err
+			}
+
+			if err := check(alias, fmt.Sprintf("acls[%d].dst", index)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for index, ssh := range pol.SSHs {
+		for _, src := range ssh.Sources {
+			if err := check(src, fmt.Sprintf("ssh[%d].src", index)); err != nil {
+				return err
+			}
+		}
+
+		for _, dest := range ssh.Destinations {
+			if err := check(dest, fmt.Sprintf("ssh[%d].dst", index)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidatePorts checks that the protocol and the ports of the destinations
+// of every ACL of the policy can be parsed, so a list like 80,443 or a
+// range like 5432-5440 with a start after its end or a port above 65535
+// is reported with the index of its rule when the policy is loaded.
+func (pol *ACLPolicy) ValidatePorts() error {
+	if pol == nil {
+		return nil
+	}
+
+	for index, acl := range pol.ACLs {
+		_, isWildcard, err := parseProtocol(acl.Protocol)
+		if err != nil {
+			return fmt.Errorf("acls[%d].proto: %w", index, err)
+		}
+
+		for destIndex, dest := range acl.Destinations {
+			_, port, err := parseDestination(dest)
+			if err != nil {
+				return fmt.Errorf("acls[%d].dst[%d] %q: %w", index, destIndex, dest, err)
+			}
+
+			if _, err := expandPorts(port, isWildcard); err != nil {
+				if errors.Is(err, ErrWildcardIsNeeded) {
+					return fmt.Errorf("acls[%d].dst[%d] %q: %w %q", index, destIndex, dest, err, acl.Protocol)
+				}
+
+				return fmt.Errorf("acls[%d].dst[%d] %q: %w", index, destIndex, dest, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateSSH checks that every rule of the ssh section of the policy has
+// a known action, a check period which can be parsed, and at least one
+// source, destination and user, so a mistake is reported when the policy
+// is loaded rather than when the SSH policy of a node is compiled.
+func (pol *ACLPolicy) ValidateSSH() error {
+	if pol == nil {
+		return nil
+	}
+
+	for index, ssh := range pol.SSHs {
+		switch ssh.Action {
+		case "accept":
+			if ssh.CheckPeriod != "" {
+				return fmt.Errorf(
+					"ssh[%d].checkPeriod: %w: only allowed with the check action",
+					index,
+					ErrInvalidSSHRule,
+				)
+			}
+		case "check":
+			if _, err := sshCheckAction(ssh.CheckPeriod); err != nil {
+				return fmt.Errorf("ssh[%d].checkPeriod: %w: %w", index, ErrInvalidSSHRule, err)
+			}
+		default:
+			return fmt.Errorf(
+				"ssh[%d].action: %w %q, must be accept or check",
+				index,
+				ErrInvalidAction,
+				ssh.Action,
+			)
+		}
+
+		if len(ssh.Sources) == 0 {
+			return fmt.Errorf("ssh[%d].src: %w: no source", index, ErrInvalidSSHRule)
+		}
+
+		if len(ssh.Destinations) == 0 {
+			return fmt.Errorf("ssh[%d].dst: %w: no destination", index, ErrInvalidSSHRule)
+		}
+
+		if len(ssh.Users) == 0 {
+			return fmt.Errorf("ssh[%d].users: %w: no user", index, ErrInvalidSSHRule)
+		}
+
+		for userIndex, user := range ssh.Users {
+			if user == "" || (user != sshUserNonRoot && strings.ContainsAny(user, " \t:@/")) {
+				return fmt.Errorf(
+					"ssh[%d].users[%d]: %w: %q is not a local user name or %s",
+					index,
+					userIndex,
+					ErrInvalidSSHRule,
+					user,
+					sshUserNonRoot,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
 func sshCheckAction(duration string) (*tailcfg.SSHAction, error) {
-	sessionLength, err := time.ParseDuration(duration)
-	if err != nil {
-		return nil, err
+	sessionLength := defaultSSHCheckPeriod
+	if duration != "" {
+		var err error
+		sessionLength, err = time.ParseDuration(duration)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &tailcfg.SSHAction{
@@ -479,8 +971,13 @@ func parseProtocol(protocol string) ([]int, bool, error) {
 
 	default:
 		protocolNumber, err := strconv.Atoi(protocol)
-		if err != nil {
-			return nil, false, fmt.Errorf("parsing protocol number: %w", err)
+		if err != nil || protocolNumber < 0 || protocolNumber > protocolMax {
+			return nil, false, fmt.Errorf(
+				"%w: %q is neither a known protocol name nor a number between 0 and %d",
+				ErrInvalidProtocol,
+				protocol,
+				protocolMax,
+			)
 		}
 		needsWildcard := protocolNumber != protocolTCP &&
 			protocolNumber != protocolUDP &&
@@ -496,6 +993,10 @@ func (pol *ACLPolicy) expandSource(
 	src string,
 	nodes types.Nodes,
 ) ([]string, error) {
+	if src == autogroupInternet {
+		return nil, fmt.Errorf("%w: %s can only be used as a destination", ErrInvalidAutogroup, src)
+	}
+
 	ipSet, err := pol.ExpandAlias(nodes, src)
 	if err != nil {
 		return []string{}, err
@@ -517,6 +1018,9 @@ func (pol *ACLPolicy) expandSource(
 // - a host
 // - an ip
 // - a cidr
+// - autogroup:internet
+// - autogroup:member
+// - autogroup:tagged
 // and transform these in IPAddresses.
 func (pol *ACLPolicy) ExpandAlias(
 	nodes types.Nodes,
@@ -526,6 +1030,14 @@ func (pol *ACLPolicy) ExpandAlias(
 		return util.ParseIPSet("*", nil)
 	}
 
+	if alias == autogroupInternet {
+		return theInternet()
+	}
+
+	if alias == autogroupMember || alias == autogroupTagged {
+		return pol.expandIPsFromAutogroupTagged(nodes, alias == autogroupTagged)
+	}
+
 	build := netipx.IPSetBuilder{}
 
 	log.Debug().
@@ -573,6 +1085,8 @@ func (pol *ACLPolicy) ExpandAlias(
 // excludeCorrectlyTaggedNodes will remove from the list of input nodes the ones
 // that are correctly tagged since they should not be listed as being in the user
 // we assume in this function that we only have nodes from 1 user.
+// A node is correctly tagged if it has forced tags, or if it requests a tag
+// the user owns.
 func excludeCorrectlyTaggedNodes(
 	aclPolicy *ACLPolicy,
 	nodes types.Nodes,
@@ -581,30 +1095,25 @@ func excludeCorrectlyTaggedNodes(
 	out := types.Nodes{}
 	tags := []string{}
 	for tag := range aclPolicy.TagOwners {
-		owners, _ := expandOwnersFromTag(aclPolicy, user)
-		ns := append(owners, user)
-		if util.StringOrPrefixListContains(ns, user) {
+		owners, _ := expandOwnersFromTag(aclPolicy, tag)
+		if slices.Contains(owners, user) {
 			tags = append(tags, tag)
 		}
 	}
 	// for each node if tag is in tags list, don't append it.
 	for _, node := range nodes {
-		found := false
+		found := len(node.ForcedTags) > 0
 
-		if node.Hostinfo == nil {
-			continue
-		}
-
-		for _, t := range node.Hostinfo.RequestTags {
-			if util.StringOrPrefixListContains(tags, t) {
-				found = true
+		if !found && node.Hostinfo != nil {
+			for _, t := range node.Hostinfo.RequestTags {
+				if util.StringOrPrefixListContains(tags, t) {
+					found = true
 
-				break
+					break
+				}
 			}
 		}
-		if len(node.ForcedTags) > 0 {
-			found = true
-		}
+
 		if !found {
 			out = append(out, node)
 		}
@@ -630,7 +1139,7 @@ func expandPorts(portsStr string, isWild bool) (*[]tailcfg.PortRange, error) {
 		rang := strings.Split(portStr, "-")
 		switch len(rang) {
 		case 1:
-			port, err := strconv.ParseUint(rang[0], util.Base10, util.BitSize16)
+			port, err := parsePort(rang[0])
 			if err != nil {
 				return nil, err
 			}
@@ -640,14 +1149,21 @@ func expandPorts(portsStr string, isWild bool) (*[]tailcfg.PortRange, error) {
 			})
 
 		case expectedTokenItems:
-			start, err := strconv.ParseUint(rang[0], util.Base10, util.BitSize16)
+			start, err := parsePort(rang[0])
 			if err != nil {
 				return nil, err
 			}
-			last, err := strconv.ParseUint(rang[1], util.Base10, util.BitSize16)
+			last, err := parsePort(rang[1])
 			if err != nil {
 				return nil, err
 			}
+			if start > last {
+				return nil, fmt.Errorf(
+					"%w: range %s starts after it ends",
+					ErrInvalidPortFormat,
+					portStr,
+				)
+			}
 			ports = append(ports, tailcfg.PortRange{
 				First: uint16(start),
 				Last:  uint16(last),
@@ -661,8 +1177,21 @@ func expandPorts(portsStr string, isWild bool) (*[]tailcfg.PortRange, error) {
 	return &ports, nil
 }
 
-// expandOwnersFromTag will return a list of user. An owner can be either a user or a group
-// a group cannot be composed of groups.
+// parsePort parses a port of a destination, between 0 and 65535.
+func parsePort(portStr string) (uint64, error) {
+	port, err := strconv.ParseUint(portStr, util.Base10, util.BitSize16)
+	if err != nil {
+		return 0, fmt.Errorf(
+			"%w: %q is not a port between 0 and 65535",
+			ErrInvalidPortFormat,
+			portStr,
+		)
+	}
+
+	return port, nil
+}
+
+// expandOwnersFromTag will return a list of user. An owner can be either a user or a group.
 func expandOwnersFromTag(
 	pol *ACLPolicy,
 	tag string,
@@ -695,14 +1224,58 @@ func expandOwnersFromTag(
 	return owners, nil
 }
 
+// ValidateTagOwner returns an error if the tag is not declared in
+// tagOwners or if the user is not one of its owners.
+func (pol *ACLPolicy) ValidateTagOwner(tag string, user string) error {
+	owners, err := expandOwnersFromTag(pol, tag)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(owners, user) {
+		return fmt.Errorf(
+			"%w. %v is not an owner of %v in tagOwners",
+			ErrInvalidTag,
+			user,
+			tag,
+		)
+	}
+
+	return nil
+}
+
+// IsUserInGroup reports if user is in the group of the groups section of
+// the policy.
+func (pol *ACLPolicy) IsUserInGroup(group string, user string) bool {
+	if pol == nil || !isGroup(group) {
+		return false
+	}
+
+	users, err := pol.expandUsersFromGroup(group)
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(users, user)
+}
+
 // expandUsersFromGroup will return the list of user inside the group
-// after some validation.
+// after some validation. The groups in the group are expanded to their
+// users.
 func (pol *ACLPolicy) expandUsersFromGroup(
 	group string,
 ) ([]string, error) {
+	groups := pol.resolvedGroups
+	if groups == nil {
+		var err error
+		groups, err = resolveGroups(pol.Groups)
+		if err != nil {
+			return []string{}, err
+		}
+	}
+
 	users := []string{}
-	log.Trace().Caller().Interface("pol", pol).Msg("test")
-	aclGroups, ok := pol.Groups[group]
+	aclGroups, ok := groups[group]
 	if !ok {
 		return []string{}, fmt.Errorf(
 			"group %v isn't registered. %w",
@@ -711,12 +1284,6 @@ func (pol *ACLPolicy) expandUsersFromGroup(
 		)
 	}
 	for _, group := range aclGroups {
-		if isGroup(group) {
-			return []string{}, fmt.Errorf(
-				"%w. A group cannot be composed of groups. https://tailscale.com/kb/1018/acls/#groups",
-				ErrInvalidGroup,
-			)
-		}
 		grp, err := util.NormalizeToFQDNRulesConfigFromViper(group)
 		if err != nil {
 			return []string{}, fmt.Errorf(
@@ -737,13 +1304,24 @@ func (pol *ACLPolicy) expandIPsFromGroup(
 ) (*netipx.IPSet, error) {
 	build := netipx.IPSetBuilder{}
 
-	users, err := pol.expandUsersFromGroup(group)
-	if err != nil {
-		return &netipx.IPSet{}, err
+	// A group only managed with the API is not in the policy file.
+	nodeIDs, inNodeGroups := pol.NodeGroups[group]
+	if _, inGroups := pol.Groups[group]; inGroups || !inNodeGroups {
+		users, err := pol.expandUsersFromGroup(group)
+		if err != nil {
+			return &netipx.IPSet{}, err
+		}
+		for _, user := range users {
+			filteredNodes := filterNodesByUser(nodes, user)
+			filteredNodes = excludeCorrectlyTaggedNodes(pol, filteredNodes, user)
+			for _, node := range filteredNodes {
+				node.AppendToIPSet(&build)
+			}
+		}
 	}
-	for _, user := range users {
-		filteredNodes := filterNodesByUser(nodes, user)
-		for _, node := range filteredNodes {
+
+	for _, node := range nodes {
+		if slices.Contains(nodeIDs, node.ID) {
 			node.AppendToIPSet(&build)
 		}
 	}
@@ -787,11 +1365,7 @@ func (pol *ACLPolicy) expandIPsFromTag(
 	for _, user := range owners {
 		nodes := filterNodesByUser(nodes, user)
 		for _, node := range nodes {
-			if node.Hostinfo == nil {
-				continue
-			}
-
-			if util.StringOrPrefixListContains(node.Hostinfo.RequestTags, alias) {
+			if util.StringOrPrefixListContains(node.RequestTags(), alias) {
 				node.AppendToIPSet(&build)
 			}
 		}
@@ -821,6 +1395,23 @@ func (pol *ACLPolicy) expandIPsFromUser(
 	return build.IPSet()
 }
 
+// expandIPsFromAutogroupTagged returns the IPs of the tagged nodes, or of
+// the nodes owned by their user if tagged is false.
+func (pol *ACLPolicy) expandIPsFromAutogroupTagged(
+	nodes types.Nodes,
+	tagged bool,
+) (*netipx.IPSet, error) {
+	build := netipx.IPSetBuilder{}
+
+	for _, node := range nodes {
+		if pol.isTagged(node) == tagged {
+			node.AppendToIPSet(&build)
+		}
+	}
+
+	return build.IPSet()
+}
+
 func (pol *ACLPolicy) expandIPsFromSingleIP(
 	ip netip.Addr,
 	nodes types.Nodes,
@@ -862,6 +1453,30 @@ func (pol *ACLPolicy) expandIPsFromIPPrefix(
 	return build.IPSet()
 }
 
+// theInternet returns the addresses reached through exit nodes, as
+// published by Tailscale for autogroup:internet: all of IPv4 but the
+// private, link-local and tailnet ranges, and the IPv6 global unicast
+// space, which does not include the private, link-local and tailnet
+// IPv6 ranges.
+func theInternet() (*netipx.IPSet, error) {
+	var build netipx.IPSetBuilder
+	build.AddPrefix(netip.MustParsePrefix("0.0.0.0/0"))
+	build.AddPrefix(netip.MustParsePrefix("2000::/3"))
+
+	// Private networks, RFC 1918.
+	build.RemovePrefix(netip.MustParsePrefix("10.0.0.0/8"))
+	build.RemovePrefix(netip.MustParsePrefix("172.16.0.0/12"))
+	build.RemovePrefix(netip.MustParsePrefix("192.168.0.0/16"))
+
+	// Link-local network.
+	build.RemovePrefix(netip.MustParsePrefix("169.254.0.0/16"))
+
+	// The tailnet.
+	build.RemovePrefix(tsaddr.CGNATRange())
+
+	return build.IPSet()
+}
+
 func isWildcard(str string) bool {
 	return str == "*"
 }
@@ -874,6 +1489,35 @@ func isTag(str string) bool {
 	return strings.HasPrefix(str, "tag:")
 }
 
+// isHostName reports if str can only be a user or a host, and not a
+// wildcard, a group, a tag, an autogroup, an address or a prefix.
+func isHostName(str string) bool {
+	if isWildcard(str) || isGroup(str) || isTag(str) || strings.HasPrefix(str, "autogroup:") {
+		return false
+	}
+
+	if _, err := netip.ParseAddr(str); err == nil {
+		return false
+	}
+
+	if _, err := netip.ParsePrefix(str); err == nil {
+		return false
+	}
+
+	return true
+}
+
+// looksLikeAddress reports whether the alias is meant as an IP address or
+// prefix, like 10.20.0.0/33 or 10.20.0.300: it has a slash or a colon,
+// which no user or host name has, or only digits and dots.
+func looksLikeAddress(alias string) bool {
+	if strings.ContainsAny(alias, "/:") {
+		return true
+	}
+
+	return strings.Contains(alias, ".") && strings.Trim(alias, "0123456789.") == ""
+}
+
 // TagsOfNode will return the tags of the current node.
 // Invalid tags are tags added by a user on a node, and that user doesn't have authority to add this tag.
 // Valid tags are tags added by a user that is allowed in the ACL policy to add this tag.
@@ -891,7 +1535,16 @@ func (pol *ACLPolicy) TagsOfNode(
 	validTagMap := make(map[string]bool)
 	invalidTagMap := make(map[string]bool)
 	if node.Hostinfo != nil {
+		// Tags ignored because the node is locked to the tags of
+		// its pre auth key are invalid.
+		requestTags := node.RequestTags()
 		for _, tag := range node.Hostinfo.RequestTags {
+			if !slices.Contains(requestTags, tag) {
+				invalidTagMap[tag] = true
+
+				continue
+			}
+
 			owners, err := expandOwnersFromTag(pol, tag)
 			if errors.Is(err, ErrInvalidTag) {
 				invalidTagMap[tag] = true
@@ -921,6 +1574,19 @@ func (pol *ACLPolicy) TagsOfNode(
 	return validTags, invalidTags
 }
 
+// isTagged reports if the node is tagged: it has forced tags, or requested
+// a tag its user owns. A tagged node is no longer considered owned by its
+// user.
+func (pol *ACLPolicy) isTagged(node *types.Node) bool {
+	if len(node.ForcedTags) > 0 {
+		return true
+	}
+
+	validTags, _ := pol.TagsOfNode(node)
+
+	return len(validTags) > 0
+}
+
 func filterNodesByUser(nodes types.Nodes, user string) types.Nodes {
 	out := types.Nodes{}
 	for _, node := range nodes {
@@ -940,12 +1606,16 @@ func FilterNodesByACL(
 ) types.Nodes {
 	result := types.Nodes{}
 
+	// The matches are built once for all the peers, it is the most
+	// expensive part of the check.
+	matches := matcher.MatchesFromFilterRules(filter)
+
 	for index, peer := range nodes {
 		if peer.ID == node.ID {
 			continue
 		}
 
-		if node.CanAccess(filter, nodes[index]) || peer.CanAccess(filter, node) {
+		if node.CanAccessMatches(matches, nodes[index]) || peer.CanAccessMatches(matches, node) {
 			result = append(result, peer)
 		}
 	}
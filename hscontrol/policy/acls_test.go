@@ -1,8 +1,14 @@
 package policy
 
 import (
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -345,6 +351,78 @@ acls:
 			},
 			wantErr: false,
 		},
+		{
+			name:   "hosts-single-ips-and-ports",
+			format: "hujson",
+			acl: `
+{
+	"hosts": {
+		"internal-dns": "100.100.100.100",
+		"dns-v6": "fd7a:115c:a1e0::53",
+		"office": "192.168.1.0/24",
+	},
+	"tagOwners": {
+		"tag:web": ["testuser"],
+	},
+	"acls": [
+		{
+			"action": "accept",
+			"src": ["office"],
+			"dst": ["internal-dns:53", "dns-v6:53", "tag:web:443"],
+		},
+	],
+}
+`,
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"192.168.1.0/24"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.100.100.100/32", Ports: tailcfg.PortRange{First: 53, Last: 53}},
+						{IP: "fd7a:115c:a1e0::53/128", Ports: tailcfg.PortRange{First: 53, Last: 53}},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:   "hosts-single-ip-yaml",
+			format: "yaml",
+			acl: `
+---
+hosts:
+  internal-dns: 100.100.100.100
+acls:
+  - action: accept
+    src:
+      - "*"
+    dst:
+      - internal-dns:53
+`,
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"0.0.0.0/0", "::/0"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.100.100.100/32", Ports: tailcfg.PortRange{First: 53, Last: 53}},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:   "hosts-invalid-ip",
+			format: "hujson",
+			acl: `
+{
+	"hosts": {
+		"internal-dns": "100.100.100",
+	},
+	"acls": [
+		{"action": "accept", "src": ["*"], "dst": ["internal-dns:53"]},
+	],
+}
+`,
+			wantErr: true,
+		},
 		{
 			name:   "ipv6-yaml",
 			format: "yaml",
@@ -569,11 +647,11 @@ func (s *Suite) TestInvalidAction(c *check.C) {
 }
 
 func (s *Suite) TestInvalidGroupInGroup(c *check.C) {
-	// this ACL is wrong because the group in Sources sections doesn't exist
+	// this ACL is wrong because the group in group:error doesn't exist
 	pol := &ACLPolicy{
 		Groups: Groups{
 			"group:test":  []string{"foo"},
-			"group:error": []string{"foo", "group:test"},
+			"group:error": []string{"foo", "group:undefined"},
 		},
 		ACLs: []ACL{
 			{
@@ -603,6 +681,304 @@ func (s *Suite) TestInvalidTagOwners(c *check.C) {
 	c.Assert(errors.Is(err, ErrInvalidTag), check.Equals, true)
 }
 
+func TestLoadACLPolicyErrorPosition(t *testing.T) {
+	tests := []struct {
+		name    string
+		acl     string
+		wantErr string
+	}{
+		{
+			name: "syntax",
+			acl: `{
+  // comments keep the positions
+  "acls": [
+    {"action": "accept" "src": ["*"]},
+  ],
+}`,
+			wantErr: "line 4, column 25",
+		},
+		{
+			name: "type",
+			acl: `{
+  /* a block
+     comment */
+  "acls": [
+    {"action": "accept", "src": "*", "dst": ["*:*"]},
+  ],
+}`,
+			wantErr: "line 5, column 36",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadACLPolicyFromBytes([]byte(tt.acl), "hujson")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestValidateGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		pol     ACLPolicy
+		wantErr string
+	}{
+		{
+			name: "defined",
+			pol: ACLPolicy{
+				Groups: Groups{"group:eng": []string{"alice", "bob"}},
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"group:eng"}, Destinations: []string{"group:eng:*"}},
+				},
+				TagOwners: TagOwners{"tag:web": []string{"group:eng"}},
+			},
+		},
+		{
+			name: "node-group",
+			pol: ACLPolicy{
+				NodeGroups: map[string][]types.NodeID{"group:ops": {1}},
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"group:ops"}, Destinations: []string{"*:22"}},
+				},
+			},
+		},
+		{
+			name: "undefined-src",
+			pol: ACLPolicy{
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"group:eng"}, Destinations: []string{"*:*"}},
+				},
+			},
+			wantErr: "group:eng is not defined, referenced in acls[0].src",
+		},
+		{
+			name: "undefined-dst",
+			pol: ACLPolicy{
+				Groups: Groups{"group:eng": []string{"alice"}},
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"*"}, Destinations: []string{"*:*"}},
+					{Action: "accept", Sources: []string{"group:eng"}, Destinations: []string{"group:ops:80,443"}},
+				},
+			},
+			wantErr: "group:ops is not defined, referenced in acls[1].dst",
+		},
+		{
+			name: "undefined-ssh",
+			pol: ACLPolicy{
+				SSHs: []SSH{
+					{Action: "accept", Sources: []string{"group:eng"}, Destinations: []string{"autogroup:self"}},
+				},
+			},
+			wantErr: "group:eng is not defined, referenced in ssh[0].src",
+		},
+		{
+			name: "node-group-tag-owner",
+			pol: ACLPolicy{
+				NodeGroups: map[string][]types.NodeID{"group:ops": {1}},
+				TagOwners:  TagOwners{"tag:web": []string{"group:ops"}},
+			},
+			wantErr: "group:ops is not defined, referenced in tagOwners[tag:web]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.pol.ValidateGroups()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidGroup) {
+				t.Fatalf("want ErrInvalidGroup, got %v", err)
+			}
+
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		pol     ACLPolicy
+		wantErr string
+	}{
+		{
+			name: "owned",
+			pol: ACLPolicy{
+				Groups:    Groups{"group:ops": []string{"alice"}},
+				TagOwners: TagOwners{"tag:prod-server": []string{"group:ops"}},
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"group:ops"}, Destinations: []string{"tag:prod-server:22"}},
+				},
+				AutoApprovers: AutoApprovers{ExitNode: []string{"tag:prod-server"}},
+			},
+		},
+		{
+			name: "unowned-dst",
+			pol: ACLPolicy{
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"*"}, Destinations: []string{"tag:prod-server:22"}},
+				},
+			},
+			wantErr: "tag:prod-server has no owner in tagOwners, referenced in acls[0].dst",
+		},
+		{
+			name: "unowned-src",
+			pol: ACLPolicy{
+				TagOwners: TagOwners{"tag:prod-server": []string{"alice"}},
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"tag:ci"}, Destinations: []string{"tag:prod-server:22"}},
+				},
+			},
+			wantErr: "tag:ci has no owner in tagOwners, referenced in acls[0].src",
+		},
+		{
+			name: "unowned-ssh",
+			pol: ACLPolicy{
+				SSHs: []SSH{
+					{Action: "accept", Sources: []string{"alice"}, Destinations: []string{"tag:prod-server"}},
+				},
+			},
+			wantErr: "tag:prod-server has no owner in tagOwners, referenced in ssh[0].dst",
+		},
+		{
+			name: "unowned-auto-approver",
+			pol: ACLPolicy{
+				AutoApprovers: AutoApprovers{
+					Routes: map[string][]string{"10.0.0.0/8": {"tag:router"}},
+				},
+			},
+			wantErr: "tag:router has no owner in tagOwners, referenced in autoApprovers.routes[10.0.0.0/8]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.pol.ValidateTags()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidTag) {
+				t.Fatalf("want ErrInvalidTag, got %v", err)
+			}
+
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestValidateHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		pol     ACLPolicy
+		wantErr string
+	}{
+		{
+			name: "defined",
+			pol: ACLPolicy{
+				Hosts: Hosts{
+					"internal-dns": netip.MustParsePrefix("10.0.0.53/32"),
+					"Office_LAN":   netip.MustParsePrefix("192.168.1.0/24"),
+				},
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"Office_LAN", "alice"}, Destinations: []string{"internal-dns:53", "10.0.0.1:22", "bob:*"}},
+				},
+			},
+		},
+		{
+			name: "undefined-dst",
+			pol: ACLPolicy{
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"*"}, Destinations: []string{"Internal_DNS:53"}},
+				},
+			},
+			wantErr: "Internal_DNS is not defined in hosts and is not a valid user name, referenced in acls[0].dst",
+		},
+		{
+			name: "undefined-src",
+			pol: ACLPolicy{
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"Office_LAN"}, Destinations: []string{"*:*"}},
+				},
+			},
+			wantErr: "Office_LAN is not defined in hosts and is not a valid user name, referenced in acls[0].src",
+		},
+		{
+			name: "undefined-ssh",
+			pol: ACLPolicy{
+				SSHs: []SSH{
+					{Action: "accept", Sources: []string{"alice"}, Destinations: []string{"Jump_Host"}},
+				},
+			},
+			wantErr: "Jump_Host is not defined in hosts and is not a valid user name, referenced in ssh[0].dst",
+		},
+		{
+			name: "addresses",
+			pol: ACLPolicy{
+				ACLs: []ACL{
+					{
+						Action:       "accept",
+						Sources:      []string{"10.20.0.5", "fd7a:115c:a1e0::1", "192.168.0.0/16"},
+						Destinations: []string{"10.20.0.0/16:443", "fd7a:115c:a1e0::/48:22"},
+					},
+				},
+			},
+		},
+		{
+			name: "malformed-prefix-dst",
+			pol: ACLPolicy{
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"*"}, Destinations: []string{"10.20.0.0/33:443"}},
+				},
+			},
+			wantErr: "10.20.0.0/33 is not a valid IP address or prefix, referenced in acls[0].dst",
+		},
+		{
+			name: "malformed-ip-src",
+			pol: ACLPolicy{
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"10.20.0.300"}, Destinations: []string{"*:*"}},
+				},
+			},
+			wantErr: "10.20.0.300 is not a valid IP address or prefix, referenced in acls[0].src",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.pol.ValidateHosts()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidHost) {
+				t.Fatalf("want ErrInvalidHost, got %v", err)
+			}
+
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
 func Test_expandGroup(t *testing.T) {
 	type field struct {
 		pol ACLPolicy
@@ -634,6 +1010,23 @@ func Test_expandGroup(t *testing.T) {
 			want:    []string{"user1", "user2", "user3"},
 			wantErr: false,
 		},
+		{
+			name: "nested groups",
+			field: field{
+				pol: ACLPolicy{
+					Groups: Groups{
+						"group:eng":      []string{"group:backend", "group:frontend"},
+						"group:backend":  []string{"user1", "user2"},
+						"group:frontend": []string{"user2", "user3"},
+					},
+				},
+			},
+			args: args{
+				group: "group:eng",
+			},
+			want:    []string{"user1", "user2", "user3"},
+			wantErr: false,
+		},
 		{
 			name: "InexistantGroup",
 			field: field{
@@ -797,6 +1190,64 @@ func Test_expandTagOwners(t *testing.T) {
 	}
 }
 
+func TestValidateTagOwner(t *testing.T) {
+	pol := &ACLPolicy{
+		Groups:    Groups{"group:ci": []string{"user2"}},
+		TagOwners: TagOwners{"tag:ci": []string{"group:ci", "user1"}},
+	}
+
+	tests := []struct {
+		name    string
+		pol     *ACLPolicy
+		tag     string
+		user    string
+		wantErr bool
+	}{
+		{
+			name: "direct-owner",
+			pol:  pol,
+			tag:  "tag:ci",
+			user: "user1",
+		},
+		{
+			name: "owner-through-group",
+			pol:  pol,
+			tag:  "tag:ci",
+			user: "user2",
+		},
+		{
+			name:    "not-an-owner",
+			pol:     pol,
+			tag:     "tag:ci",
+			user:    "user3",
+			wantErr: true,
+		},
+		{
+			name:    "undeclared-tag",
+			pol:     pol,
+			tag:     "tag:web",
+			user:    "user1",
+			wantErr: true,
+		},
+		{
+			name:    "no-policy",
+			pol:     nil,
+			tag:     "tag:ci",
+			user:    "user1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.pol.ValidateTagOwner(tt.tag, tt.user)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateTagOwner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func Test_expandPorts(t *testing.T) {
 	type args struct {
 		portsStr      string
@@ -878,6 +1329,29 @@ func Test_expandPorts(t *testing.T) {
 			want:    nil,
 			wantErr: true,
 		},
+		{
+			name: "ranges and ports mixed",
+			args: args{portsStr: "22,5432-5440,8000-8080,443", needsWildcard: false},
+			want: &[]tailcfg.PortRange{
+				{First: 22, Last: 22},
+				{First: 5432, Last: 5440},
+				{First: 8000, Last: 8080},
+				{First: 443, Last: 443},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "range starting after its end",
+			args:    args{portsStr: "5440-5432", needsWildcard: false},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "range ending out of bounds",
+			args:    args{portsStr: "80-65536", needsWildcard: false},
+			want:    nil,
+			wantErr: true,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -885,10 +1359,122 @@ func Test_expandPorts(t *testing.T) {
 			if (err != nil) != test.wantErr {
 				t.Errorf("expandPorts() error = %v, wantErr %v", err, test.wantErr)
 
-				return
+				return
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("expandPorts() = (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidatePorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		acls    []ACL
+		wantErr string
+	}{
+		{
+			name: "lists and ranges",
+			acls: []ACL{
+				{Action: "accept", Sources: []string{"*"}, Destinations: []string{"web:80,443", "db:5432-5440,22"}},
+				{Action: "accept", Protocol: "icmp", Sources: []string{"*"}, Destinations: []string{"*:*"}},
+			},
+		},
+		{
+			name: "range starting after its end",
+			acls: []ACL{
+				{Action: "accept", Sources: []string{"*"}, Destinations: []string{"*:22"}},
+				{Action: "accept", Sources: []string{"*"}, Destinations: []string{"web:80", "db:5440-5432"}},
+			},
+			wantErr: `acls[1].dst[1] "db:5440-5432"`,
+		},
+		{
+			name: "port out of bounds",
+			acls: []ACL{
+				{Action: "accept", Sources: []string{"*"}, Destinations: []string{"web:80,65536"}},
+			},
+			wantErr: `acls[0].dst[0] "web:80,65536"`,
+		},
+		{
+			name: "protocol out of bounds",
+			acls: []ACL{
+				{Action: "accept", Protocol: "300", Sources: []string{"*"}, Destinations: []string{"*:*"}},
+			},
+			wantErr: "acls[0].proto",
+		},
+		{
+			name: "port with a protocol needing a wildcard",
+			acls: []ACL{
+				{Action: "accept", Protocol: "icmp", Sources: []string{"*"}, Destinations: []string{"*:22"}},
+			},
+			wantErr: `acls[0].dst[0] "*:22": wildcard as port is required for the protocol "icmp"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol := ACLPolicy{ACLs: tt.acls}
+
+			err := pol.ValidatePorts()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("want error containing %q, got none", tt.wantErr)
+			}
+
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func Test_parseProtocol(t *testing.T) {
+	tests := []struct {
+		protocol          string
+		want              []int
+		wantNeedsWildcard bool
+		wantErr           bool
+	}{
+		{protocol: "", want: nil},
+		{protocol: "tcp", want: []int{protocolTCP}},
+		{protocol: "udp", want: []int{protocolUDP}},
+		{protocol: "sctp", want: []int{protocolSCTP}},
+		{protocol: "icmp", want: []int{protocolICMP, protocolIPv6ICMP}, wantNeedsWildcard: true},
+		{protocol: "gre", want: []int{protocolGRE}, wantNeedsWildcard: true},
+		{protocol: "6", want: []int{protocolTCP}},
+		{protocol: "47", want: []int{protocolGRE}, wantNeedsWildcard: true},
+		{protocol: "256", wantErr: true},
+		{protocol: "-1", wantErr: true},
+		{protocol: "quic", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			got, needsWildcard, err := parseProtocol(tt.protocol)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidProtocol) {
+					t.Fatalf("parseProtocol() error = %v, want %v", err, ErrInvalidProtocol)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseProtocol() unexpected error: %s", err)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("parseProtocol() = (-want +got):\n%s", diff)
 			}
-			if diff := cmp.Diff(test.want, got); diff != "" {
-				t.Errorf("expandPorts() = (-want +got):\n%s", diff)
+
+			if needsWildcard != tt.wantNeedsWildcard {
+				t.Errorf("parseProtocol() needsWildcard = %t, want %t", needsWildcard, tt.wantNeedsWildcard)
 			}
 		})
 	}
@@ -1075,6 +1661,71 @@ func Test_expandAlias(t *testing.T) {
 			want:    set([]string{}, []string{}),
 			wantErr: true,
 		},
+		{
+			name: "node group",
+			field: field{
+				pol: ACLPolicy{
+					NodeGroups: map[string][]types.NodeID{"group:hr": {2, 4}},
+				},
+			},
+			args: args{
+				alias: "group:hr",
+				nodes: types.Nodes{
+					&types.Node{
+						ID:   1,
+						IPv4: iap("100.64.0.1"),
+						User: types.User{Name: "joe"},
+					},
+					&types.Node{
+						ID:   2,
+						IPv4: iap("100.64.0.2"),
+						User: types.User{Name: "joe"},
+					},
+					&types.Node{
+						ID:   4,
+						IPv4: iap("100.64.0.4"),
+						User: types.User{Name: "mickael"},
+					},
+				},
+			},
+			want: set([]string{
+				"100.64.0.2", "100.64.0.4",
+			}, []string{}),
+			wantErr: false,
+		},
+		{
+			name: "group with users and nodes",
+			field: field{
+				pol: ACLPolicy{
+					Groups:     Groups{"group:accountant": []string{"marc"}},
+					NodeGroups: map[string][]types.NodeID{"group:accountant": {1}},
+				},
+			},
+			args: args{
+				alias: "group:accountant",
+				nodes: types.Nodes{
+					&types.Node{
+						ID:   1,
+						IPv4: iap("100.64.0.1"),
+						User: types.User{Name: "joe"},
+					},
+					&types.Node{
+						ID:   2,
+						IPv4: iap("100.64.0.2"),
+						User: types.User{Name: "joe"},
+					},
+					&types.Node{
+						ID:   3,
+						IPv4: iap("100.64.0.3"),
+						User: types.User{Name: "marc"},
+					},
+				},
+			},
+			want: set([]string{
+				"100.64.0.1", "100.64.0.3",
+			}, []string{}),
+			wantErr: false,
+		},
 		{
 			name: "simple ipaddress",
 			field: field{
@@ -1612,6 +2263,59 @@ func Test_excludeCorrectlyTaggedNodes(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "tag owned by another user, don't exclude",
+			args: args{
+				aclPolicy: &ACLPolicy{
+					TagOwners: TagOwners{"tag:accountant-webserver": []string{"bar"}},
+				},
+				nodes: types.Nodes{
+					&types.Node{
+						IPv4: iap("100.64.0.1"),
+						User: types.User{Name: "joe"},
+						Hostinfo: &tailcfg.Hostinfo{
+							RequestTags: []string{"tag:accountant-webserver"},
+						},
+					},
+				},
+				user: "joe",
+			},
+			want: types.Nodes{
+				&types.Node{
+					IPv4: iap("100.64.0.1"),
+					User: types.User{Name: "joe"},
+					Hostinfo: &tailcfg.Hostinfo{
+						RequestTags: []string{"tag:accountant-webserver"},
+					},
+				},
+			},
+		},
+		{
+			name: "keep nodes without hostinfo",
+			args: args{
+				aclPolicy: &ACLPolicy{
+					TagOwners: TagOwners{"tag:accountant-webserver": []string{"joe"}},
+				},
+				nodes: types.Nodes{
+					&types.Node{
+						IPv4: iap("100.64.0.1"),
+						User: types.User{Name: "joe"},
+					},
+					&types.Node{
+						IPv4:       iap("100.64.0.2"),
+						User:       types.User{Name: "joe"},
+						ForcedTags: []string{"tag:accountant-webserver"},
+					},
+				},
+				user: "joe",
+			},
+			want: types.Nodes{
+				&types.Node{
+					IPv4: iap("100.64.0.1"),
+					User: types.User{Name: "joe"},
+				},
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -1745,6 +2449,95 @@ func TestACLPolicy_generateFilterRules(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "group-can-reach-tag-ssh",
+			field: field{
+				pol: ACLPolicy{
+					Groups: Groups{"group:ops": []string{"alice"}},
+					TagOwners: TagOwners{
+						"tag:prod-server": []string{"group:ops"},
+					},
+					ACLs: []ACL{
+						{
+							Action:       "accept",
+							Sources:      []string{"group:ops"},
+							Destinations: []string{"tag:prod-server:22"},
+						},
+					},
+				},
+			},
+			args: args{
+				nodes: types.Nodes{
+					&types.Node{
+						IPv4:     iap("100.64.0.1"),
+						User:     types.User{Name: "alice"},
+						Hostinfo: &tailcfg.Hostinfo{},
+					},
+					// Tagged nodes are not part of the identity of
+					// their user.
+					&types.Node{
+						IPv4: iap("100.64.0.2"),
+						User: types.User{Name: "alice"},
+						Hostinfo: &tailcfg.Hostinfo{
+							RequestTags: []string{"tag:prod-server"},
+						},
+					},
+					&types.Node{
+						IPv4:       iap("100.64.0.4"),
+						User:       types.User{Name: "bob"},
+						ForcedTags: []string{"tag:prod-server"},
+					},
+					// bob does not own the tag.
+					&types.Node{
+						IPv4: iap("100.64.0.6"),
+						User: types.User{Name: "bob"},
+						Hostinfo: &tailcfg.Hostinfo{
+							RequestTags: []string{"tag:prod-server"},
+						},
+					},
+				},
+			},
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.1/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{
+							IP:    "100.64.0.2/32",
+							Ports: tailcfg.PortRange{First: 22, Last: 22},
+						},
+						{
+							IP:    "100.64.0.4/32",
+							Ports: tailcfg.PortRange{First: 22, Last: 22},
+						},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "autogroup-internet-source",
+			field: field{
+				pol: ACLPolicy{
+					ACLs: []ACL{
+						{
+							Action:       "accept",
+							Sources:      []string{"autogroup:internet"},
+							Destinations: []string{"*:*"},
+						},
+					},
+				},
+			},
+			args: args{
+				nodes: types.Nodes{
+					&types.Node{
+						IPv4: iap("100.64.0.1"),
+						User: types.User{Name: "alice"},
+					},
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1869,6 +2662,81 @@ func TestReduceFilterRules(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "exit-node-keeps-autogroup-internet",
+			pol: ACLPolicy{
+				Groups: Groups{
+					"group:dev": {"dev"},
+				},
+				ACLs: []ACL{
+					{
+						Action:       "accept",
+						Sources:      []string{"group:dev"},
+						Destinations: []string{"autogroup:internet:*"},
+					},
+				},
+			},
+			node: &types.Node{
+				IPv4: iap("100.64.0.1"),
+				IPv6: iap("fd7a:115c:a1e0::1"),
+				User: types.User{Name: "exit"},
+				Hostinfo: &tailcfg.Hostinfo{
+					RoutableIPs: []netip.Prefix{
+						netip.MustParsePrefix("0.0.0.0/0"),
+						netip.MustParsePrefix("::/0"),
+					},
+				},
+			},
+			peers: types.Nodes{
+				&types.Node{
+					IPv4: iap("100.64.0.2"),
+					IPv6: iap("fd7a:115c:a1e0::2"),
+					User: types.User{Name: "dev"},
+				},
+			},
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{
+						"100.64.0.2/32",
+						"fd7a:115c:a1e0::2/128",
+					},
+					DstPorts: internetPortRanges(tailcfg.PortRangeAny),
+				},
+			},
+		},
+		{
+			name: "autogroup-internet-dropped-without-exit-route",
+			pol: ACLPolicy{
+				Groups: Groups{
+					"group:dev": {"dev"},
+				},
+				ACLs: []ACL{
+					{
+						Action:       "accept",
+						Sources:      []string{"group:dev"},
+						Destinations: []string{"autogroup:internet:*"},
+					},
+				},
+			},
+			node: &types.Node{
+				IPv4: iap("100.64.0.1"),
+				IPv6: iap("fd7a:115c:a1e0::1"),
+				User: types.User{Name: "server"},
+				Hostinfo: &tailcfg.Hostinfo{
+					RoutableIPs: []netip.Prefix{
+						netip.MustParsePrefix("10.33.0.0/16"),
+					},
+				},
+			},
+			peers: types.Nodes{
+				&types.Node{
+					IPv4: iap("100.64.0.2"),
+					IPv6: iap("fd7a:115c:a1e0::2"),
+					User: types.User{Name: "dev"},
+				},
+			},
+			want: []tailcfg.FilterRule{},
+		},
 	}
 
 	for _, tt := range tests {
@@ -1887,6 +2755,21 @@ func TestReduceFilterRules(t *testing.T) {
 	}
 }
 
+// internetPortRanges returns the destinations of autogroup:internet on ports.
+func internetPortRanges(ports tailcfg.PortRange) []tailcfg.NetPortRange {
+	internet, _ := theInternet()
+
+	ranges := []tailcfg.NetPortRange{}
+	for _, prefix := range internet.Prefixes() {
+		ranges = append(ranges, tailcfg.NetPortRange{
+			IP:    prefix.String(),
+			Ports: ports,
+		})
+	}
+
+	return ranges
+}
+
 func Test_getTags(t *testing.T) {
 	type args struct {
 		aclPolicy *ACLPolicy
@@ -1983,20 +2866,45 @@ func Test_getTags(t *testing.T) {
 			wantInvalid: []string{"tag:invalid", "very-invalid"},
 		},
 		{
-			name: "empty ACLPolicy should return empty tags and should not panic",
+			name: "empty ACLPolicy should return empty tags and should not panic",
+			args: args{
+				aclPolicy: &ACLPolicy{},
+				node: &types.Node{
+					User: types.User{
+						Name: "joe",
+					},
+					Hostinfo: &tailcfg.Hostinfo{
+						RequestTags: []string{"tag:invalid", "very-invalid"},
+					},
+				},
+			},
+			wantValid:   nil,
+			wantInvalid: []string{"tag:invalid", "very-invalid"},
+		},
+		{
+			name: "node registered with a tagged auth key cannot request other tags",
 			args: args{
-				aclPolicy: &ACLPolicy{},
+				aclPolicy: &ACLPolicy{
+					TagOwners: TagOwners{
+						"tag:valid":  []string{"joe"},
+						"tag:server": []string{"joe"},
+					},
+				},
 				node: &types.Node{
 					User: types.User{
 						Name: "joe",
 					},
+					AuthKey: &types.PreAuthKey{
+						ACLTags: []types.PreAuthKeyACLTag{{Tag: "tag:server"}},
+					},
+					ForcedTags: types.StringList{"tag:server"},
 					Hostinfo: &tailcfg.Hostinfo{
-						RequestTags: []string{"tag:invalid", "very-invalid"},
+						RequestTags: []string{"tag:valid"},
 					},
 				},
 			},
 			wantValid:   nil,
-			wantInvalid: []string{"tag:invalid", "very-invalid"},
+			wantInvalid: []string{"tag:valid"},
 		},
 	}
 	for _, test := range tests {
@@ -2526,101 +3434,334 @@ func Test_getFilteredByACLPeers(t *testing.T) {
 				{
 					ID:       0,
 					IPv4:     iap("100.64.0.1"),
-					Hostname: "user1-1",
+					Hostname: "user1-1",
+					User:     types.User{Name: "user1"},
+				},
+				{
+					ID:       3,
+					IPv4:     iap("100.64.0.4"),
+					Hostname: "user2-2",
+					User:     types.User{Name: "user2"},
+				},
+			},
+		},
+		{
+			name: "p4-host-in-netmap-user1-dest-bug",
+			args: args{
+				nodes: []*types.Node{
+					{
+						ID:       1,
+						IPv4:     iap("100.64.0.2"),
+						Hostname: "user1-2",
+						User:     types.User{Name: "user1"},
+					},
+					{
+						ID:       2,
+						IPv4:     iap("100.64.0.3"),
+						Hostname: "user-2-1",
+						User:     types.User{Name: "user2"},
+					},
+					{
+						ID:       3,
+						IPv4:     iap("100.64.0.4"),
+						Hostname: "user2-2",
+						User:     types.User{Name: "user2"},
+					},
+				},
+				rules: []tailcfg.FilterRule{
+					{
+						SrcIPs: []string{
+							"100.64.0.1/32",
+							"100.64.0.2/32",
+							"fd7a:115c:a1e0::1/128",
+							"fd7a:115c:a1e0::2/128",
+						},
+						DstPorts: []tailcfg.NetPortRange{
+							{IP: "100.64.0.1/32", Ports: tailcfg.PortRangeAny},
+							{IP: "100.64.0.2/32", Ports: tailcfg.PortRangeAny},
+							{IP: "fd7a:115c:a1e0::1/128", Ports: tailcfg.PortRangeAny},
+							{IP: "fd7a:115c:a1e0::2/128", Ports: tailcfg.PortRangeAny},
+						},
+					},
+					{
+						SrcIPs: []string{
+							"100.64.0.1/32",
+							"100.64.0.2/32",
+							"fd7a:115c:a1e0::1/128",
+							"fd7a:115c:a1e0::2/128",
+						},
+						DstPorts: []tailcfg.NetPortRange{
+							{IP: "100.64.0.3/32", Ports: tailcfg.PortRangeAny},
+							{IP: "100.64.0.4/32", Ports: tailcfg.PortRangeAny},
+							{IP: "fd7a:115c:a1e0::3/128", Ports: tailcfg.PortRangeAny},
+							{IP: "fd7a:115c:a1e0::4/128", Ports: tailcfg.PortRangeAny},
+						},
+					},
+				},
+				node: &types.Node{
+					ID:       0,
+					IPv4:     iap("100.64.0.1"),
+					Hostname: "user1-1",
+					User:     types.User{Name: "user1"},
+				},
+			},
+			want: []*types.Node{
+				{
+					ID:       1,
+					IPv4:     iap("100.64.0.2"),
+					Hostname: "user1-2",
+					User:     types.User{Name: "user1"},
+				},
+				{
+					ID:       2,
+					IPv4:     iap("100.64.0.3"),
+					Hostname: "user-2-1",
+					User:     types.User{Name: "user2"},
+				},
+				{
+					ID:       3,
+					IPv4:     iap("100.64.0.4"),
+					Hostname: "user2-2",
+					User:     types.User{Name: "user2"},
+				},
+			},
+		},
+
+		{
+			name: "subnet-router-with-only-route",
+			args: args{
+				nodes: []*types.Node{
+					{
+						ID:       1,
+						IPv4:     iap("100.64.0.1"),
+						Hostname: "user1",
+						User:     types.User{Name: "user1"},
+					},
+					{
+						ID:       2,
+						IPv4:     iap("100.64.0.2"),
+						Hostname: "router",
+						User:     types.User{Name: "router"},
+						Routes: types.Routes{
+							types.Route{
+								NodeID:    2,
+								Prefix:    types.IPPrefix(netip.MustParsePrefix("10.33.0.0/16")),
+								IsPrimary: true,
+								Enabled:   true,
+							},
+						},
+					},
+				},
+				rules: []tailcfg.FilterRule{
+					{
+						SrcIPs: []string{
+							"100.64.0.1/32",
+						},
+						DstPorts: []tailcfg.NetPortRange{
+							{IP: "10.33.0.0/16", Ports: tailcfg.PortRangeAny},
+						},
+					},
+				},
+				node: &types.Node{
+					ID:       1,
+					IPv4:     iap("100.64.0.1"),
+					Hostname: "user1",
+					User:     types.User{Name: "user1"},
+				},
+			},
+			want: []*types.Node{
+				{
+					ID:       2,
+					IPv4:     iap("100.64.0.2"),
+					Hostname: "router",
+					User:     types.User{Name: "router"},
+					Routes: types.Routes{
+						types.Route{
+							NodeID:    2,
+							Prefix:    types.IPPrefix(netip.MustParsePrefix("10.33.0.0/16")),
+							IsPrimary: true,
+							Enabled:   true,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "subnet-router-with-host-in-route",
+			args: args{
+				nodes: []*types.Node{
+					{
+						ID:       1,
+						IPv4:     iap("100.64.0.1"),
+						Hostname: "user1",
+						User:     types.User{Name: "user1"},
+					},
+					{
+						ID:       2,
+						IPv4:     iap("100.64.0.2"),
+						Hostname: "router",
+						User:     types.User{Name: "router"},
+						Routes: types.Routes{
+							types.Route{
+								NodeID:    2,
+								Prefix:    types.IPPrefix(netip.MustParsePrefix("10.33.0.0/16")),
+								IsPrimary: true,
+								Enabled:   true,
+							},
+						},
+					},
+				},
+				rules: []tailcfg.FilterRule{
+					{
+						SrcIPs: []string{
+							"100.64.0.1/32",
+						},
+						DstPorts: []tailcfg.NetPortRange{
+							{IP: "10.33.12.5/32", Ports: tailcfg.PortRangeAny},
+						},
+					},
+				},
+				node: &types.Node{
+					ID:       1,
+					IPv4:     iap("100.64.0.1"),
+					Hostname: "user1",
+					User:     types.User{Name: "user1"},
+				},
+			},
+			want: []*types.Node{
+				{
+					ID:       2,
+					IPv4:     iap("100.64.0.2"),
+					Hostname: "router",
+					User:     types.User{Name: "router"},
+					Routes: types.Routes{
+						types.Route{
+							NodeID:    2,
+							Prefix:    types.IPPrefix(netip.MustParsePrefix("10.33.0.0/16")),
+							IsPrimary: true,
+							Enabled:   true,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "subnet-router-with-route-as-source",
+			args: args{
+				nodes: []*types.Node{
+					{
+						ID:       1,
+						IPv4:     iap("100.64.0.1"),
+						Hostname: "user1",
+						User:     types.User{Name: "user1"},
+					},
+					{
+						ID:       2,
+						IPv4:     iap("100.64.0.2"),
+						Hostname: "router",
+						User:     types.User{Name: "router"},
+						Routes: types.Routes{
+							types.Route{
+								NodeID:    2,
+								Prefix:    types.IPPrefix(netip.MustParsePrefix("10.33.0.0/16")),
+								IsPrimary: true,
+								Enabled:   true,
+							},
+						},
+					},
+				},
+				rules: []tailcfg.FilterRule{
+					{
+						SrcIPs: []string{
+							"10.33.0.0/24",
+						},
+						DstPorts: []tailcfg.NetPortRange{
+							{IP: "100.64.0.1/32", Ports: tailcfg.PortRangeAny},
+						},
+					},
+				},
+				node: &types.Node{
+					ID:       1,
+					IPv4:     iap("100.64.0.1"),
+					Hostname: "user1",
 					User:     types.User{Name: "user1"},
 				},
+			},
+			want: []*types.Node{
 				{
-					ID:       3,
-					IPv4:     iap("100.64.0.4"),
-					Hostname: "user2-2",
-					User:     types.User{Name: "user2"},
+					ID:       2,
+					IPv4:     iap("100.64.0.2"),
+					Hostname: "router",
+					User:     types.User{Name: "router"},
+					Routes: types.Routes{
+						types.Route{
+							NodeID:    2,
+							Prefix:    types.IPPrefix(netip.MustParsePrefix("10.33.0.0/16")),
+							IsPrimary: true,
+							Enabled:   true,
+						},
+					},
 				},
 			},
 		},
 		{
-			name: "p4-host-in-netmap-user1-dest-bug",
+			name: "exit-node-without-internet-access",
 			args: args{
 				nodes: []*types.Node{
 					{
 						ID:       1,
-						IPv4:     iap("100.64.0.2"),
-						Hostname: "user1-2",
+						IPv4:     iap("100.64.0.1"),
+						Hostname: "user1",
 						User:     types.User{Name: "user1"},
 					},
 					{
 						ID:       2,
-						IPv4:     iap("100.64.0.3"),
-						Hostname: "user-2-1",
-						User:     types.User{Name: "user2"},
+						IPv4:     iap("100.64.0.2"),
+						Hostname: "server",
+						User:     types.User{Name: "user1"},
 					},
 					{
 						ID:       3,
-						IPv4:     iap("100.64.0.4"),
-						Hostname: "user2-2",
-						User:     types.User{Name: "user2"},
+						IPv4:     iap("100.64.0.3"),
+						Hostname: "exit",
+						User:     types.User{Name: "exit"},
+						Routes: types.Routes{
+							types.Route{
+								NodeID:  3,
+								Prefix:  types.IPPrefix(types.ExitRouteV4),
+								Enabled: true,
+							},
+						},
 					},
 				},
 				rules: []tailcfg.FilterRule{
 					{
 						SrcIPs: []string{
 							"100.64.0.1/32",
-							"100.64.0.2/32",
-							"fd7a:115c:a1e0::1/128",
-							"fd7a:115c:a1e0::2/128",
 						},
 						DstPorts: []tailcfg.NetPortRange{
-							{IP: "100.64.0.1/32", Ports: tailcfg.PortRangeAny},
 							{IP: "100.64.0.2/32", Ports: tailcfg.PortRangeAny},
-							{IP: "fd7a:115c:a1e0::1/128", Ports: tailcfg.PortRangeAny},
-							{IP: "fd7a:115c:a1e0::2/128", Ports: tailcfg.PortRangeAny},
-						},
-					},
-					{
-						SrcIPs: []string{
-							"100.64.0.1/32",
-							"100.64.0.2/32",
-							"fd7a:115c:a1e0::1/128",
-							"fd7a:115c:a1e0::2/128",
-						},
-						DstPorts: []tailcfg.NetPortRange{
-							{IP: "100.64.0.3/32", Ports: tailcfg.PortRangeAny},
-							{IP: "100.64.0.4/32", Ports: tailcfg.PortRangeAny},
-							{IP: "fd7a:115c:a1e0::3/128", Ports: tailcfg.PortRangeAny},
-							{IP: "fd7a:115c:a1e0::4/128", Ports: tailcfg.PortRangeAny},
 						},
 					},
 				},
 				node: &types.Node{
-					ID:       0,
+					ID:       1,
 					IPv4:     iap("100.64.0.1"),
-					Hostname: "user1-1",
+					Hostname: "user1",
 					User:     types.User{Name: "user1"},
 				},
 			},
 			want: []*types.Node{
 				{
-					ID:       1,
+					ID:       2,
 					IPv4:     iap("100.64.0.2"),
-					Hostname: "user1-2",
+					Hostname: "server",
 					User:     types.User{Name: "user1"},
 				},
-				{
-					ID:       2,
-					IPv4:     iap("100.64.0.3"),
-					Hostname: "user-2-1",
-					User:     types.User{Name: "user2"},
-				},
-				{
-					ID:       3,
-					IPv4:     iap("100.64.0.4"),
-					Hostname: "user2-2",
-					User:     types.User{Name: "user2"},
-				},
 			},
 		},
-
 		{
-			name: "subnet-router-with-only-route",
+			name: "exit-node-with-internet-access",
 			args: args{
 				nodes: []*types.Node{
 					{
@@ -2630,16 +3771,15 @@ func Test_getFilteredByACLPeers(t *testing.T) {
 						User:     types.User{Name: "user1"},
 					},
 					{
-						ID:       2,
-						IPv4:     iap("100.64.0.2"),
-						Hostname: "router",
-						User:     types.User{Name: "router"},
+						ID:       3,
+						IPv4:     iap("100.64.0.3"),
+						Hostname: "exit",
+						User:     types.User{Name: "exit"},
 						Routes: types.Routes{
 							types.Route{
-								NodeID:    2,
-								Prefix:    types.IPPrefix(netip.MustParsePrefix("10.33.0.0/16")),
-								IsPrimary: true,
-								Enabled:   true,
+								NodeID:  3,
+								Prefix:  types.IPPrefix(types.ExitRouteV4),
+								Enabled: true,
 							},
 						},
 					},
@@ -2650,7 +3790,7 @@ func Test_getFilteredByACLPeers(t *testing.T) {
 							"100.64.0.1/32",
 						},
 						DstPorts: []tailcfg.NetPortRange{
-							{IP: "10.33.0.0/16", Ports: tailcfg.PortRangeAny},
+							{IP: "8.0.0.0/7", Ports: tailcfg.PortRangeAny},
 						},
 					},
 				},
@@ -2663,16 +3803,15 @@ func Test_getFilteredByACLPeers(t *testing.T) {
 			},
 			want: []*types.Node{
 				{
-					ID:       2,
-					IPv4:     iap("100.64.0.2"),
-					Hostname: "router",
-					User:     types.User{Name: "router"},
+					ID:       3,
+					IPv4:     iap("100.64.0.3"),
+					Hostname: "exit",
+					User:     types.User{Name: "exit"},
 					Routes: types.Routes{
 						types.Route{
-							NodeID:    2,
-							Prefix:    types.IPPrefix(netip.MustParsePrefix("10.33.0.0/16")),
-							IsPrimary: true,
-							Enabled:   true,
+							NodeID:  3,
+							Prefix:  types.IPPrefix(types.ExitRouteV4),
+							Enabled: true,
 						},
 					},
 				},
@@ -2778,13 +3917,15 @@ func TestSSHRules(t *testing.T) {
 						},
 					},
 					SSHUsers: map[string]string{
-						"autogroup:nonroot": "=",
+						"*":    "=",
+						"root": "",
 					},
 					Action: &tailcfg.SSHAction{Accept: true, AllowLocalPortForwarding: true},
 				},
 				{
 					SSHUsers: map[string]string{
-						"autogroup:nonroot": "=",
+						"*":    "=",
+						"root": "",
 					},
 					Principals: []*tailcfg.SSHPrincipal{
 						{
@@ -2800,13 +3941,15 @@ func TestSSHRules(t *testing.T) {
 						},
 					},
 					SSHUsers: map[string]string{
-						"autogroup:nonroot": "=",
+						"*":    "=",
+						"root": "",
 					},
 					Action: &tailcfg.SSHAction{Accept: true, AllowLocalPortForwarding: true},
 				},
 				{
 					SSHUsers: map[string]string{
-						"autogroup:nonroot": "=",
+						"*":    "=",
+						"root": "",
 					},
 					Principals: []*tailcfg.SSHPrincipal{
 						{
@@ -2882,6 +4025,118 @@ func TestSSHRules(t *testing.T) {
 	}
 }
 
+func TestValidateSSH(t *testing.T) {
+	tests := []struct {
+		name    string
+		ssh     SSH
+		wantErr string
+	}{
+		{
+			name: "accept",
+			ssh: SSH{
+				Action:       "accept",
+				Sources:      []string{"group:admin"},
+				Destinations: []string{"tag:server"},
+				Users:        []string{"root", "autogroup:nonroot"},
+			},
+		},
+		{
+			name: "check with period",
+			ssh: SSH{
+				Action:       "check",
+				Sources:      []string{"user1"},
+				Destinations: []string{"user1"},
+				Users:        []string{"ubuntu"},
+				CheckPeriod:  "1h",
+			},
+		},
+		{
+			name: "check with default period",
+			ssh: SSH{
+				Action:       "check",
+				Sources:      []string{"user1"},
+				Destinations: []string{"user1"},
+				Users:        []string{"ubuntu"},
+			},
+		},
+		{
+			name: "unknown action",
+			ssh: SSH{
+				Action:       "allow",
+				Sources:      []string{"user1"},
+				Destinations: []string{"user1"},
+				Users:        []string{"ubuntu"},
+			},
+			wantErr: `ssh[0].action: invalid action "allow", must be accept or check`,
+		},
+		{
+			name: "invalid check period",
+			ssh: SSH{
+				Action:       "check",
+				Sources:      []string{"user1"},
+				Destinations: []string{"user1"},
+				Users:        []string{"ubuntu"},
+				CheckPeriod:  "a day",
+			},
+			wantErr: `ssh[0].checkPeriod: invalid ssh rule: time: invalid duration "a day"`,
+		},
+		{
+			name: "check period on accept",
+			ssh: SSH{
+				Action:       "accept",
+				Sources:      []string{"user1"},
+				Destinations: []string{"user1"},
+				Users:        []string{"ubuntu"},
+				CheckPeriod:  "1h",
+			},
+			wantErr: "ssh[0].checkPeriod: invalid ssh rule: only allowed with the check action",
+		},
+		{
+			name: "no source",
+			ssh: SSH{
+				Action:       "accept",
+				Destinations: []string{"user1"},
+				Users:        []string{"ubuntu"},
+			},
+			wantErr: "ssh[0].src: invalid ssh rule: no source",
+		},
+		{
+			name: "no user",
+			ssh: SSH{
+				Action:       "accept",
+				Sources:      []string{"user1"},
+				Destinations: []string{"user1"},
+			},
+			wantErr: "ssh[0].users: invalid ssh rule: no user",
+		},
+		{
+			name: "invalid user",
+			ssh: SSH{
+				Action:       "accept",
+				Sources:      []string{"user1"},
+				Destinations: []string{"user1"},
+				Users:        []string{"autogroup:root"},
+			},
+			wantErr: `ssh[0].users[0]: invalid ssh rule: "autogroup:root" is not a local user name or autogroup:nonroot`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol := &ACLPolicy{SSHs: []SSH{tt.ssh}}
+
+			err := pol.ValidateSSH()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
 func TestParseDestination(t *testing.T) {
 	tests := []struct {
 		dest      string
@@ -3176,3 +4431,243 @@ func TestValidTagInvalidUser(t *testing.T) {
 		t.Errorf("TestValidTagInvalidUser() unexpected result (-want +got):\n%s", diff)
 	}
 }
+
+func TestAutogroupMemberAndTagged(t *testing.T) {
+	pol := &ACLPolicy{
+		TagOwners: TagOwners{"tag:server": []string{"alice"}},
+		ACLs: []ACL{
+			{Action: "accept", Sources: []string{"autogroup:member"}, Destinations: []string{"autogroup:tagged:22"}},
+		},
+	}
+
+	laptop := &types.Node{
+		ID:       1,
+		IPv4:     iap("100.64.0.1"),
+		User:     types.User{Name: "alice"},
+		Hostinfo: &tailcfg.Hostinfo{},
+	}
+	forced := &types.Node{
+		ID:         2,
+		IPv4:       iap("100.64.0.2"),
+		User:       types.User{Name: "bob"},
+		ForcedTags: []string{"tag:db"},
+		Hostinfo:   &tailcfg.Hostinfo{},
+	}
+	requested := &types.Node{
+		ID:       3,
+		IPv4:     iap("100.64.0.3"),
+		User:     types.User{Name: "alice"},
+		Hostinfo: &tailcfg.Hostinfo{RequestTags: []string{"tag:server"}},
+	}
+	// bob does not own tag:server, the node stays his.
+	unowned := &types.Node{
+		ID:       4,
+		IPv4:     iap("100.64.0.4"),
+		User:     types.User{Name: "bob"},
+		Hostinfo: &tailcfg.Hostinfo{RequestTags: []string{"tag:server"}},
+	}
+	nodes := types.Nodes{laptop, forced, requested, unowned}
+
+	tests := []struct {
+		alias string
+		want  []string
+	}{
+		{alias: "autogroup:member", want: []string{"100.64.0.1/32", "100.64.0.4/32"}},
+		{alias: "autogroup:tagged", want: []string{"100.64.0.2/31"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.alias, func(t *testing.T) {
+			got, err := pol.ExpandAlias(nodes, tt.alias)
+			if err != nil {
+				t.Fatalf("ExpandAlias() error = %s", err)
+			}
+
+			var prefixes []string
+			for _, prefix := range got.Prefixes() {
+				prefixes = append(prefixes, prefix.String())
+			}
+			if diff := cmp.Diff(tt.want, prefixes); diff != "" {
+				t.Errorf("ExpandAlias() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// The laptop is tagged: it moves from the sources to the destinations
+	// of the rules.
+	tagged := *laptop
+	tagged.ForcedTags = []string{"tag:server"}
+
+	rules, err := pol.CompileFilterRules(types.Nodes{&tagged, forced, requested, unowned})
+	if err != nil {
+		t.Fatalf("CompileFilterRules() error = %s", err)
+	}
+
+	want := []tailcfg.FilterRule{
+		{
+			SrcIPs: []string{"100.64.0.4/32"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "100.64.0.1/32", Ports: tailcfg.PortRange{First: 22, Last: 22}},
+				{IP: "100.64.0.2/31", Ports: tailcfg.PortRange{First: 22, Last: 22}},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, rules); diff != "" {
+		t.Errorf("CompileFilterRules() unexpected rules after tagging (-want +got):\n%s", diff)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+// TestTheInternet makes sure the ranges of autogroup:internet do not drift
+// from the ranges published by Tailscale, in testdata/autogroup-internet.golden.
+func TestTheInternet(t *testing.T) {
+	internet, err := theInternet()
+	if err != nil {
+		t.Fatalf("building the internet: %s", err)
+	}
+
+	var got strings.Builder
+	for _, prefix := range internet.Prefixes() {
+		got.WriteString(prefix.String())
+		got.WriteString("\n")
+	}
+
+	golden := filepath.Join("testdata", "autogroup-internet.golden")
+	if *updateGolden {
+		if err := os.WriteFile(golden, []byte(got.String()), 0o600); err != nil {
+			t.Fatalf("writing golden file: %s", err)
+		}
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("reading golden file: %s", err)
+	}
+
+	if diff := cmp.Diff(string(want), got.String()); diff != "" {
+		t.Errorf("autogroup:internet does not match %s (-want +got):\n%s", golden, diff)
+	}
+
+	for _, ip := range []string{"100.64.0.1", "10.1.2.3", "192.168.1.1", "169.254.1.1", "fd7a:115c:a1e0::1", "fe80::1"} {
+		if internet.Contains(netip.MustParseAddr(ip)) {
+			t.Errorf("autogroup:internet contains %s", ip)
+		}
+	}
+	for _, ip := range []string{"1.1.1.1", "8.8.8.8", "2606:4700:4700::1111"} {
+		if !internet.Contains(netip.MustParseAddr(ip)) {
+			t.Errorf("autogroup:internet does not contain %s", ip)
+		}
+	}
+}
+
+// reduceFilterRulesPolicy returns a policy where every user reaches the
+// next one on a port, with a group of every other user reaching all the
+// nodes on port 22, and the nodes, one per user.
+func reduceFilterRulesPolicy(users int) (*ACLPolicy, types.Nodes) {
+	pol := &ACLPolicy{
+		Groups: Groups{},
+	}
+
+	nodes := types.Nodes{}
+	for index := 0; index < users; index++ {
+		name := fmt.Sprintf("user%d", index)
+		nodes = append(nodes, &types.Node{
+			ID:   types.NodeID(index + 1),
+			IPv4: iap(fmt.Sprintf("100.64.%d.%d", index/250, index%250+1)),
+			User: types.User{Name: name},
+		})
+
+		if index%2 == 0 {
+			pol.Groups["group:admins"] = append(pol.Groups["group:admins"], name)
+		}
+
+		pol.ACLs = append(pol.ACLs, ACL{
+			Action:       "accept",
+			Sources:      []string{name},
+			Destinations: []string{fmt.Sprintf("user%d:%d", (index+1)%users, 1000+index)},
+		})
+	}
+
+	pol.ACLs = append(pol.ACLs, ACL{
+		Action:       "accept",
+		Sources:      []string{"group:admins"},
+		Destinations: []string{"*:22"},
+	})
+
+	return pol, nodes
+}
+
+// TestReduceFilterRulesKeepsConnectivity checks that a node allows the
+// same traffic with its reduced packet filter as with the full one.
+func TestReduceFilterRulesKeepsConnectivity(t *testing.T) {
+	pol, nodes := reduceFilterRulesPolicy(12)
+
+	rules, err := pol.CompileFilterRules(nodes)
+	if err != nil {
+		t.Fatalf("compiling filter rules: %s", err)
+	}
+
+	ports := []uint16{22, 80}
+	for index := range nodes {
+		ports = append(ports, uint16(1000+index))
+	}
+
+	for _, dst := range nodes {
+		reduced := ReduceFilterRules(dst, rules)
+		if len(reduced) >= len(rules) {
+			t.Errorf("node %d: reduced filter has %d rules, want less than %d", dst.ID, len(reduced), len(rules))
+		}
+
+		dsts := ipSetOf(dst.IPv4.String())
+		for _, src := range nodes {
+			srcs := ipSetOf(src.IPv4.String())
+			for _, port := range ports {
+				want := firstMatchingRule(rules, srcs, dsts, port, nil, true) != -1
+				got := firstMatchingRule(reduced, srcs, dsts, port, nil, true) != -1
+				if got != want {
+					t.Errorf(
+						"%s -> %s:%d: allowed by reduced filter = %t, by full filter = %t",
+						src.User.Name, dst.User.Name, port, got, want,
+					)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkReduceFilterRules reports the size of the packet filter sent
+// to a node, reduced and not, on a policy with a rule per user.
+func BenchmarkReduceFilterRules(b *testing.B) {
+	for _, users := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("users=%d", users), func(b *testing.B) {
+			pol, nodes := reduceFilterRulesPolicy(users)
+
+			rules, err := pol.CompileFilterRules(nodes)
+			if err != nil {
+				b.Fatalf("compiling filter rules: %s", err)
+			}
+
+			full, err := json.Marshal(rules)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var reduced []tailcfg.FilterRule
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				reduced = ReduceFilterRules(nodes[i%len(nodes)], rules)
+			}
+			b.StopTimer()
+
+			reducedJSON, err := json.Marshal(reduced)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportMetric(float64(len(full)), "full-bytes")
+			b.ReportMetric(float64(len(reducedJSON)), "reduced-bytes")
+		})
+	}
+}
@@ -2,9 +2,11 @@ package policy
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/netip"
 	"strings"
 
+	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/tailscale/hujson"
 	"gopkg.in/yaml.v3"
 )
@@ -18,6 +20,20 @@ type ACLPolicy struct {
 	Tests         []ACLTest     `json:"tests"         yaml:"tests"`
 	AutoApprovers AutoApprovers `json:"autoApprovers" yaml:"autoApprovers"`
 	SSHs          []SSH         `json:"ssh"           yaml:"ssh"`
+
+	// NodeGroups are the nodes of the groups managed with the API and
+	// stored in the database, keyed by the group name. A group of Groups
+	// also contains its nodes.
+	NodeGroups map[string][]types.NodeID `json:"-" yaml:"-"`
+
+	// UserPolicies are the policies of the users loaded from a policy
+	// directory, keyed by user name. Their rules only apply to the nodes
+	// of the user.
+	UserPolicies map[string]*ACLPolicy `json:"-" yaml:"-"`
+
+	// resolvedGroups are the users of the groups, with the groups
+	// they contain expanded, set by ResolveGroups.
+	resolvedGroups Groups
 }
 
 // ACL is a basic rule for the ACL Policy.
@@ -37,11 +53,13 @@ type Hosts map[string]netip.Prefix
 // TagOwners specify what users (users?) are allow to use certain tags.
 type TagOwners map[string][]string
 
-// ACLTest is not implemented, but should be use to check if a certain rule is allowed.
+// ACLTest asserts that the traffic from a source to destinations is
+// accepted or denied by the policy, it is checked by RunTests.
 type ACLTest struct {
-	Source string   `json:"src"            yaml:"src"`
-	Accept []string `json:"accept"         yaml:"accept"`
-	Deny   []string `json:"deny,omitempty" yaml:"deny,omitempty"`
+	Source   string   `json:"src"             yaml:"src"`
+	Protocol string   `json:"proto,omitempty" yaml:"proto,omitempty"`
+	Accept   []string `json:"accept"          yaml:"accept"`
+	Deny     []string `json:"deny,omitempty"  yaml:"deny,omitempty"`
 }
 
 // AutoApprovers specify which users (users?), groups or tags have their advertised routes
@@ -62,7 +80,6 @@ type SSH struct {
 
 // UnmarshalJSON allows to parse the Hosts directly into netip objects.
 func (hosts *Hosts) UnmarshalJSON(data []byte) error {
-	newHosts := Hosts{}
 	hostIPPrefixMap := make(map[string]string)
 	ast, err := hujson.Parse(data)
 	if err != nil {
@@ -74,35 +91,42 @@ func (hosts *Hosts) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
-	for host, prefixStr := range hostIPPrefixMap {
-		if !strings.Contains(prefixStr, "/") {
-			prefixStr += "/32"
-		}
-		prefix, err := netip.ParsePrefix(prefixStr)
-		if err != nil {
-			return err
-		}
-		newHosts[host] = prefix
-	}
-	*hosts = newHosts
 
-	return nil
+	return hosts.parse(hostIPPrefixMap)
 }
 
 // UnmarshalYAML allows to parse the Hosts directly into netip objects.
-func (hosts *Hosts) UnmarshalYAML(data []byte) error {
-	newHosts := Hosts{}
+func (hosts *Hosts) UnmarshalYAML(value *yaml.Node) error {
 	hostIPPrefixMap := make(map[string]string)
 
-	err := yaml.Unmarshal(data, &hostIPPrefixMap)
+	err := value.Decode(&hostIPPrefixMap)
 	if err != nil {
 		return err
 	}
+
+	return hosts.parse(hostIPPrefixMap)
+}
+
+// parse sets the hosts from their values, which are either a prefix or a
+// single IP address.
+func (hosts *Hosts) parse(hostIPPrefixMap map[string]string) error {
+	newHosts := Hosts{}
 	for host, prefixStr := range hostIPPrefixMap {
-		prefix, err := netip.ParsePrefix(prefixStr)
-		if err != nil {
-			return err
+		var prefix netip.Prefix
+		if strings.Contains(prefixStr, "/") {
+			var err error
+			prefix, err = netip.ParsePrefix(prefixStr)
+			if err != nil {
+				return fmt.Errorf("host %s: %w", host, err)
+			}
+		} else {
+			addr, err := netip.ParseAddr(prefixStr)
+			if err != nil {
+				return fmt.Errorf("host %s: %w", host, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
 		}
+
 		newHosts[host] = prefix
 	}
 	*hosts = newHosts
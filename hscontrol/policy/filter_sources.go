@@ -0,0 +1,67 @@
+package policy
+
+import (
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+// FilterRuleSource is the part of the policy a filter rule is compiled
+// from. It is empty for the rules not coming from a policy, like the
+// rules allowing all traffic without one.
+type FilterRuleSource struct {
+	// ACL is the index of the rule in the acls of the policy.
+	ACL *int `json:"acl,omitempty"`
+
+	// User is the user whose policy the rule comes from.
+	User string `json:"user,omitempty"`
+}
+
+// SourcedFilterRule is a filter rule with its source in the policy.
+type SourcedFilterRule struct {
+	Source FilterRuleSource   `json:"source"`
+	Rule   tailcfg.FilterRule `json:"rule"`
+}
+
+// CompileSourcedFilterRules compiles the filter rules of the policy for
+// nodes like CompileFilterRules, and attaches to each rule its source in
+// the policy.
+func (pol *ACLPolicy) CompileSourcedFilterRules(
+	nodes types.Nodes,
+) ([]SourcedFilterRule, error) {
+	rules, sources, err := pol.compileFilterRules(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	return SourceFilterRules(rules, sources), nil
+}
+
+// SourceFilterRules pairs rules with their sources, rules without a source
+// get an empty one.
+func SourceFilterRules(rules []tailcfg.FilterRule, sources []FilterRuleSource) []SourcedFilterRule {
+	sourced := make([]SourcedFilterRule, len(rules))
+	for index, rule := range rules {
+		sourced[index].Rule = rule
+		if index < len(sources) {
+			sourced[index].Source = sources[index]
+		}
+	}
+
+	return sourced
+}
+
+// ReduceSourcedFilterRules reduces the rules to the ones relevant to node
+// like ReduceFilterRules, keeping the source of each rule.
+func ReduceSourcedFilterRules(node *types.Node, rules []SourcedFilterRule) []SourcedFilterRule {
+	reduced := []SourcedFilterRule{}
+	for _, rule := range rules {
+		for _, reducedRule := range ReduceFilterRules(node, []tailcfg.FilterRule{rule.Rule}) {
+			reduced = append(reduced, SourcedFilterRule{
+				Source: rule.Source,
+				Rule:   reducedRule,
+			})
+		}
+	}
+
+	return reduced
+}
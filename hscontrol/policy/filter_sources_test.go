@@ -0,0 +1,78 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestCompileSourcedFilterRules(t *testing.T) {
+	nodes := types.Nodes{
+		{ID: 1, IPv4: iap("100.64.0.1"), User: types.User{Name: "alice"}},
+		{ID: 2, IPv4: iap("100.64.0.2"), User: types.User{Name: "bob"}},
+		{ID: 3, IPv4: iap("100.64.0.3"), User: types.User{Name: "carol"}},
+	}
+
+	pol := &ACLPolicy{
+		ACLs: []ACL{
+			{Action: "accept", Sources: []string{"alice"}, Destinations: []string{"bob:22"}},
+			{Action: "accept", Sources: []string{"bob"}, Destinations: []string{"alice:80"}},
+		},
+		UserPolicies: map[string]*ACLPolicy{
+			"carol": {
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"carol"}, Destinations: []string{"carol:443"}},
+				},
+			},
+		},
+	}
+
+	got, err := pol.CompileSourcedFilterRules(nodes)
+	if err != nil {
+		t.Fatalf("CompileSourcedFilterRules() error = %s", err)
+	}
+
+	rules, err := pol.CompileFilterRules(nodes)
+	if err != nil {
+		t.Fatalf("CompileFilterRules() error = %s", err)
+	}
+
+	first, second := 0, 1
+	want := SourceFilterRules(rules, []FilterRuleSource{
+		{ACL: &first},
+		{ACL: &second},
+		{User: "carol"},
+	})
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CompileSourcedFilterRules() unexpected rules (-want +got):\n%s", diff)
+	}
+
+	// The rules reaching bob keep their source.
+	reduced := ReduceSourcedFilterRules(nodes[1], got)
+	wantReduced := []SourcedFilterRule{
+		{
+			Source: FilterRuleSource{ACL: &first},
+			Rule: tailcfg.FilterRule{
+				SrcIPs: []string{"100.64.0.1/32"},
+				DstPorts: []tailcfg.NetPortRange{
+					{IP: "100.64.0.2/32", Ports: tailcfg.PortRange{First: 22, Last: 22}},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(wantReduced, reduced); diff != "" {
+		t.Errorf("ReduceSourcedFilterRules() unexpected rules (-want +got):\n%s", diff)
+	}
+
+	// Without a policy, the rules allowing everything have no source.
+	var noPolicy *ACLPolicy
+	allowAll, err := noPolicy.CompileSourcedFilterRules(nodes)
+	if err != nil {
+		t.Fatalf("CompileSourcedFilterRules() error = %s", err)
+	}
+	if diff := cmp.Diff(SourceFilterRules(tailcfg.FilterAllowAll, nil), allowAll); diff != "" {
+		t.Errorf("CompileSourcedFilterRules() unexpected rules without a policy (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,99 @@
+package policy
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ResolveGroups expands the groups contained in the groups of the policy
+// to their users, once for all the rules compiled with the policy. It
+// fails if a group contains an undefined group, or contains itself
+// through other groups, naming the groups of the cycle.
+func (pol *ACLPolicy) ResolveGroups() error {
+	if pol == nil {
+		return nil
+	}
+
+	resolved, err := resolveGroups(pol.Groups)
+	if err != nil {
+		return err
+	}
+
+	pol.resolvedGroups = resolved
+
+	return nil
+}
+
+// resolveGroups returns the users of the groups, with the groups they
+// contain replaced by their users.
+func resolveGroups(groups Groups) (Groups, error) {
+	resolved := make(Groups, len(groups))
+
+	var resolve func(group string, path []string) ([]string, error)
+	resolve = func(group string, path []string) ([]string, error) {
+		if users, ok := resolved[group]; ok {
+			return users, nil
+		}
+
+		if index := slices.Index(path, group); index >= 0 {
+			cycle := append(slices.Clone(path[index:]), group)
+
+			return nil, fmt.Errorf(
+				"%w: groups contain each other: %s",
+				ErrInvalidGroup,
+				strings.Join(cycle, " -> "),
+			)
+		}
+
+		members, ok := groups[group]
+		if !ok {
+			return nil, fmt.Errorf(
+				"%w: %s is not defined, referenced in %s",
+				ErrInvalidGroup,
+				group,
+				path[len(path)-1],
+			)
+		}
+
+		path = append(slices.Clip(path), group)
+		users := []string{}
+		for _, member := range members {
+			nested := []string{member}
+			if isGroup(member) {
+				var err error
+				nested, err = resolve(member, path)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			for _, user := range nested {
+				if !slices.Contains(users, user) {
+					users = append(users, user)
+				}
+			}
+		}
+
+		resolved[group] = users
+
+		return users, nil
+	}
+
+	// The groups are resolved in order so a cycle is always reported
+	// from the same group.
+	names := make([]string, 0, len(groups))
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+
+	for _, group := range names {
+		if _, err := resolve(group, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,90 @@
+package policy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResolveGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		groups  Groups
+		want    Groups
+		wantErr string
+	}{
+		{
+			name: "nested groups",
+			groups: Groups{
+				"group:eng":      []string{"group:backend", "group:frontend", "dave"},
+				"group:backend":  []string{"alice", "bob"},
+				"group:frontend": []string{"bob", "carol"},
+			},
+			want: Groups{
+				"group:eng":      []string{"alice", "bob", "carol", "dave"},
+				"group:backend":  []string{"alice", "bob"},
+				"group:frontend": []string{"bob", "carol"},
+			},
+		},
+		{
+			name: "transitive groups",
+			groups: Groups{
+				"group:all": []string{"group:eng"},
+				"group:eng": []string{"group:ops"},
+				"group:ops": []string{"alice"},
+			},
+			want: Groups{
+				"group:all": []string{"alice"},
+				"group:eng": []string{"alice"},
+				"group:ops": []string{"alice"},
+			},
+		},
+		{
+			name: "cycle",
+			groups: Groups{
+				"group:a": []string{"group:b"},
+				"group:b": []string{"alice", "group:c"},
+				"group:c": []string{"group:a"},
+			},
+			wantErr: "group:a -> group:b -> group:c -> group:a",
+		},
+		{
+			name: "group containing itself",
+			groups: Groups{
+				"group:a": []string{"alice", "group:a"},
+			},
+			wantErr: "group:a -> group:a",
+		},
+		{
+			name: "undefined group",
+			groups: Groups{
+				"group:eng": []string{"group:backend"},
+			},
+			wantErr: "group:backend is not defined, referenced in group:eng",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol := &ACLPolicy{Groups: tt.groups}
+
+			err := pol.ResolveGroups()
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrInvalidGroup) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ResolveGroups() error = %v, want %q", err, tt.wantErr)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveGroups() error = %s", err)
+			}
+
+			if diff := cmp.Diff(tt.want, pol.resolvedGroups); diff != "" {
+				t.Errorf("ResolveGroups() unexpected groups (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package policy
+
+import (
+	"net/netip"
+	"slices"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"go4.org/netipx"
+	"tailscale.com/tailcfg"
+)
+
+// UserIsolationFilterRules returns the filter rules applied when no ACL
+// policy is loaded and the users are isolated: the nodes of a user can
+// reach the nodes of the user and their approved routes, and all the
+// nodes can reach the nodes tagged with one of sharedTags, and their
+// approved routes. The routes never cover the addresses of the nodes, so
+// a node routing the tailnet range or the whole internet does not open
+// the nodes of the other users.
+//
+// Only the forced tags are considered, the tags requested by a node are
+// not validated without an ACL policy, so any node could share itself.
+func UserIsolationFilterRules(nodes types.Nodes, sharedTags []string) []tailcfg.FilterRule {
+	users := []string{}
+	userNodes := make(map[string]types.Nodes)
+	shared := types.Nodes{}
+	for _, node := range nodes {
+		if _, ok := userNodes[node.User.Name]; !ok {
+			users = append(users, node.User.Name)
+		}
+		userNodes[node.User.Name] = append(userNodes[node.User.Name], node)
+
+		if slices.ContainsFunc(node.ForcedTags, func(tag string) bool {
+			return slices.Contains(sharedTags, tag)
+		}) {
+			shared = append(shared, node)
+		}
+	}
+	slices.Sort(users)
+
+	rules := []tailcfg.FilterRule{}
+	for _, user := range users {
+		rules = append(rules, isolationFilterRule(userNodes[user], userNodes[user], nodes))
+	}
+
+	if len(shared) > 0 {
+		rules = append(rules, isolationFilterRule(nodes, shared, nodes))
+	}
+
+	return rules
+}
+
+// isolationFilterRule returns a rule letting srcs reach all the ports of
+// dsts and of their approved routes, without the addresses of the nodes
+// of tailnet. The routes a node advertises are not approved yet.
+func isolationFilterRule(srcs, dsts, tailnet types.Nodes) tailcfg.FilterRule {
+	var srcIPs, dstIPs, routeIPs netipx.IPSetBuilder
+	for _, node := range srcs {
+		node.AppendToIPSet(&srcIPs)
+	}
+	for _, node := range dsts {
+		node.AppendToIPSet(&dstIPs)
+
+		for _, route := range node.Routes {
+			if route.Enabled {
+				routeIPs.AddPrefix(netip.Prefix(route.Prefix))
+			}
+		}
+	}
+	for _, node := range tailnet {
+		for _, ip := range node.IPs() {
+			routeIPs.Remove(ip)
+		}
+	}
+	routeSet, _ := routeIPs.IPSet()
+	dstIPs.AddSet(routeSet)
+
+	rule := tailcfg.FilterRule{
+		SrcIPs:   []string{},
+		DstPorts: []tailcfg.NetPortRange{},
+	}
+
+	// The builders only hold valid addresses and prefixes.
+	srcSet, _ := srcIPs.IPSet()
+	for _, prefix := range srcSet.Prefixes() {
+		rule.SrcIPs = append(rule.SrcIPs, prefix.String())
+	}
+
+	dstSet, _ := dstIPs.IPSet()
+	for _, prefix := range dstSet.Prefixes() {
+		rule.DstPorts = append(rule.DstPorts, tailcfg.NetPortRange{
+			IP:    prefix.String(),
+			Ports: tailcfg.PortRangeAny,
+		})
+	}
+
+	return rule
+}
@@ -0,0 +1,201 @@
+package policy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"go4.org/netipx"
+	"tailscale.com/tailcfg"
+)
+
+func TestUserIsolationFilterRules(t *testing.T) {
+	alice1 := &types.Node{
+		ID:   1,
+		IPv4: iap("100.64.0.1"),
+		User: types.User{Name: "alice"},
+	}
+	alice2 := &types.Node{
+		ID:   2,
+		IPv4: iap("100.64.0.2"),
+		User: types.User{Name: "alice"},
+		Hostinfo: &tailcfg.Hostinfo{
+			RoutableIPs: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+		},
+		Routes: types.Routes{
+			{Prefix: types.IPPrefix(netip.MustParsePrefix("10.1.0.0/16")), Advertised: true, Enabled: true},
+		},
+	}
+	bob := &types.Node{
+		ID:   3,
+		IPv4: iap("100.64.0.3"),
+		User: types.User{Name: "bob"},
+	}
+	dns := &types.Node{
+		ID:         4,
+		IPv4:       iap("100.64.0.4"),
+		User:       types.User{Name: "infra"},
+		ForcedTags: []string{"tag:shared"},
+	}
+	requested := &types.Node{
+		ID:   5,
+		IPv4: iap("100.64.0.5"),
+		User: types.User{Name: "bob"},
+		Hostinfo: &tailcfg.Hostinfo{
+			RequestTags: []string{"tag:shared"},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		nodes      types.Nodes
+		sharedTags []string
+		want       []tailcfg.FilterRule
+	}{
+		{
+			name:  "no-nodes",
+			nodes: types.Nodes{},
+			want:  []tailcfg.FilterRule{},
+		},
+		{
+			name:  "users-are-isolated",
+			nodes: types.Nodes{bob, alice2, alice1},
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.1/32", "100.64.0.2/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "10.1.0.0/16", Ports: tailcfg.PortRangeAny},
+						{IP: "100.64.0.1/32", Ports: tailcfg.PortRangeAny},
+						{IP: "100.64.0.2/32", Ports: tailcfg.PortRangeAny},
+					},
+				},
+				{
+					SrcIPs: []string{"100.64.0.3/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.64.0.3/32", Ports: tailcfg.PortRangeAny},
+					},
+				},
+			},
+		},
+		{
+			name:       "shared-nodes-are-reachable",
+			nodes:      types.Nodes{alice1, bob, dns, requested},
+			sharedTags: []string{"tag:shared"},
+			want: []tailcfg.FilterRule{
+				{
+					SrcIPs: []string{"100.64.0.1/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.64.0.1/32", Ports: tailcfg.PortRangeAny},
+					},
+				},
+				{
+					SrcIPs: []string{"100.64.0.3/32", "100.64.0.5/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.64.0.3/32", Ports: tailcfg.PortRangeAny},
+						{IP: "100.64.0.5/32", Ports: tailcfg.PortRangeAny},
+					},
+				},
+				{
+					SrcIPs: []string{"100.64.0.4/32"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.64.0.4/32", Ports: tailcfg.PortRangeAny},
+					},
+				},
+				{
+					SrcIPs: []string{"100.64.0.1/32", "100.64.0.3/32", "100.64.0.4/31"},
+					DstPorts: []tailcfg.NetPortRange{
+						{IP: "100.64.0.4/32", Ports: tailcfg.PortRangeAny},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := UserIsolationFilterRules(tt.nodes, tt.sharedTags)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserIsolationFilterRules() unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUserIsolationFilterRulesRoutes(t *testing.T) {
+	exitRoutes := types.Routes{
+		{Prefix: types.IPPrefix(types.ExitRouteV4), Advertised: true, Enabled: true},
+		{Prefix: types.IPPrefix(types.ExitRouteV6), Advertised: true, Enabled: true},
+	}
+
+	// Alice advertises an exit route, nobody approved it.
+	alice := &types.Node{
+		ID:   1,
+		IPv4: iap("100.64.0.1"),
+		User: types.User{Name: "alice"},
+		Hostinfo: &tailcfg.Hostinfo{
+			RoutableIPs: []netip.Prefix{types.ExitRouteV4, types.ExitRouteV6},
+		},
+	}
+	// Carol runs an approved exit node and routes the tailnet range.
+	carol := &types.Node{
+		ID:   2,
+		IPv4: iap("100.64.0.2"),
+		User: types.User{Name: "carol"},
+		Hostinfo: &tailcfg.Hostinfo{
+			RoutableIPs: []netip.Prefix{types.ExitRouteV4, types.ExitRouteV6, netip.MustParsePrefix("100.64.0.0/10")},
+		},
+		Routes: append(types.Routes{
+			{Prefix: types.IPPrefix(netip.MustParsePrefix("100.64.0.0/10")), Advertised: true, Enabled: true},
+		}, exitRoutes...),
+	}
+	bob := &types.Node{
+		ID:   3,
+		IPv4: iap("100.64.0.3"),
+		User: types.User{Name: "bob"},
+	}
+
+	rules := UserIsolationFilterRules(types.Nodes{alice, bob, carol}, nil)
+
+	want := []tailcfg.FilterRule{
+		{
+			SrcIPs: []string{"100.64.0.3/32"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "100.64.0.3/32", Ports: tailcfg.PortRangeAny},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, ReduceFilterRules(bob, rules)); diff != "" {
+		t.Errorf("ReduceFilterRules() for bob unexpected result (-want +got):\n%s", diff)
+	}
+
+	want = []tailcfg.FilterRule{
+		{
+			SrcIPs: []string{"100.64.0.1/32"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "100.64.0.1/32", Ports: tailcfg.PortRangeAny},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, rules[:1]); diff != "" {
+		t.Errorf("UserIsolationFilterRules() for alice unexpected result (-want +got):\n%s", diff)
+	}
+
+	// The approved routes of carol are kept, but not the addresses of the
+	// other nodes.
+	var carolSet netipx.IPSetBuilder
+	for _, dst := range rules[2].DstPorts {
+		carolSet.AddPrefix(netip.MustParsePrefix(dst.IP))
+	}
+	set, _ := carolSet.IPSet()
+	for _, addr := range []string{"100.64.0.2", "100.64.0.4", "8.8.8.8", "2001:db8::1"} {
+		if !set.Contains(netip.MustParseAddr(addr)) {
+			t.Errorf("carol cannot reach %s, want it reachable", addr)
+		}
+	}
+	for _, addr := range []string{"100.64.0.1", "100.64.0.3"} {
+		if set.Contains(netip.MustParseAddr(addr)) {
+			t.Errorf("carol can reach %s, want it isolated", addr)
+		}
+	}
+}
@@ -22,6 +22,17 @@ func MatchFromFilterRule(rule tailcfg.FilterRule) Match {
 	return MatchFromStrings(rule.SrcIPs, dests)
 }
 
+// MatchesFromFilterRules returns the matches of the rules, to be reused
+// for all the nodes checked against them.
+func MatchesFromFilterRules(rules []tailcfg.FilterRule) []Match {
+	matches := make([]Match, 0, len(rules))
+	for _, rule := range rules {
+		matches = append(matches, MatchFromFilterRule(rule))
+	}
+
+	return matches
+}
+
 func MatchFromStrings(sources, destinations []string) Match {
 	srcs := new(netipx.IPSetBuilder)
 	dests := new(netipx.IPSetBuilder)
@@ -68,3 +79,15 @@ func (m *Match) DestsContainsIP(ips []netip.Addr) bool {
 
 	return false
 }
+
+// SrcsOverlapsIPSet reports whether any address of set is a source of
+// the match.
+func (m *Match) SrcsOverlapsIPSet(set *netipx.IPSet) bool {
+	return set != nil && m.Srcs.Overlaps(set)
+}
+
+// DestsOverlapsIPSet reports whether any address of set is a destination
+// of the match.
+func (m *Match) DestsOverlapsIPSet(set *netipx.IPSet) bool {
+	return set != nil && m.Dests.Overlaps(set)
+}
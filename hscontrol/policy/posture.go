@@ -0,0 +1,104 @@
+package policy
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+var ErrPostureCheckFailed = errors.New("device posture check failed")
+
+var versionRegexp = regexp.MustCompile(`\d+(\.\d+)*`)
+
+// CheckDevicePosture evaluates the posture rules against the Hostinfo
+// and tags of the node. It returns an error wrapping
+// ErrPostureCheckFailed with the reason if a rule applying to the OS of
+// the node is not satisfied, and nil if there are no rules.
+func CheckDevicePosture(
+	rules []types.PostureRule,
+	node *types.Node,
+	pol *ACLPolicy,
+) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	if node.Hostinfo == nil {
+		return fmt.Errorf("%w: node has not reported its host information", ErrPostureCheckFailed)
+	}
+
+	tags := slices.Clone(node.ForcedTags)
+	if pol != nil {
+		validTags, _ := pol.TagsOfNode(node)
+		tags = append(tags, validTags...)
+	}
+
+	for _, rule := range rules {
+		if rule.OS != "" && !strings.EqualFold(rule.OS, node.Hostinfo.OS) {
+			continue
+		}
+
+		if rule.MinVersion != "" {
+			version := osVersion(node.Hostinfo.OS, node.Hostinfo.OSVersion)
+			if version == "" || compareVersions(version, rule.MinVersion) < 0 {
+				return fmt.Errorf(
+					"%w: %s version %q is older than %s",
+					ErrPostureCheckFailed,
+					node.Hostinfo.OS,
+					node.Hostinfo.OSVersion,
+					rule.MinVersion,
+				)
+			}
+		}
+
+		for _, tag := range rule.RequiredTags {
+			if !slices.Contains(tags, tag) {
+				return fmt.Errorf("%w: missing required tag %s", ErrPostureCheckFailed, tag)
+			}
+		}
+	}
+
+	return nil
+}
+
+// osVersion extracts the version number from the OSVersion reported in
+// Hostinfo. Linux clients report their distribution followed by the
+// kernel version, which is the one used.
+func osVersion(goos string, reported string) string {
+	if strings.EqualFold(goos, "linux") {
+		if _, kernel, found := strings.Cut(reported, "kernel="); found {
+			reported = kernel
+		}
+	}
+
+	return versionRegexp.FindString(reported)
+}
+
+// compareVersions compares two dotted version numbers, returning -1, 0
+// or 1. Missing components are treated as zero.
+func compareVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+
+	for i := range max(len(aParts), len(bParts)) {
+		var aNum, bNum int
+		if i < len(aParts) {
+			aNum, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bNum, _ = strconv.Atoi(bParts[i])
+		}
+
+		if c := cmp.Compare(aNum, bNum); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,158 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestCheckDevicePosture(t *testing.T) {
+	rules := []types.PostureRule{
+		{OS: "linux", MinVersion: "5.15"},
+		{OS: "macOS", MinVersion: "14.2", RequiredTags: []string{"tag:corp"}},
+	}
+
+	tests := []struct {
+		name     string
+		rules    []types.PostureRule
+		node     *types.Node
+		wantFail bool
+	}{
+		{
+			name:  "no-rules",
+			rules: nil,
+			node:  &types.Node{},
+		},
+		{
+			name:     "no-hostinfo",
+			rules:    rules,
+			node:     &types.Node{},
+			wantFail: true,
+		},
+		{
+			name:  "linux-kernel-recent",
+			rules: rules,
+			node: &types.Node{
+				Hostinfo: &tailcfg.Hostinfo{
+					OS:        "linux",
+					OSVersion: "Debian 12.4 (bookworm); kernel=6.1.0-17-amd64",
+				},
+			},
+		},
+		{
+			name:  "linux-kernel-equal",
+			rules: rules,
+			node: &types.Node{
+				Hostinfo: &tailcfg.Hostinfo{
+					OS:        "linux",
+					OSVersion: "Ubuntu 22.04; kernel=5.15.0-91-generic",
+				},
+			},
+		},
+		{
+			name:  "linux-kernel-old",
+			rules: rules,
+			node: &types.Node{
+				Hostinfo: &tailcfg.Hostinfo{
+					OS:        "linux",
+					OSVersion: "Debian 11.8 (bullseye); kernel=5.10.0-26-amd64",
+				},
+			},
+			wantFail: true,
+		},
+		{
+			name:  "linux-no-version",
+			rules: rules,
+			node: &types.Node{
+				Hostinfo: &tailcfg.Hostinfo{OS: "linux"},
+			},
+			wantFail: true,
+		},
+		{
+			name:  "macos-forced-tag",
+			rules: rules,
+			node: &types.Node{
+				Hostinfo: &tailcfg.Hostinfo{
+					OS:        "macOS",
+					OSVersion: "14.3",
+				},
+				ForcedTags: types.StringList{"tag:corp"},
+			},
+		},
+		{
+			name:  "macos-missing-tag",
+			rules: rules,
+			node: &types.Node{
+				Hostinfo: &tailcfg.Hostinfo{
+					OS:        "macOS",
+					OSVersion: "14.3",
+				},
+			},
+			wantFail: true,
+		},
+		{
+			name:  "macos-old",
+			rules: rules,
+			node: &types.Node{
+				Hostinfo: &tailcfg.Hostinfo{
+					OS:        "macOS",
+					OSVersion: "14.1.2",
+				},
+				ForcedTags: types.StringList{"tag:corp"},
+			},
+			wantFail: true,
+		},
+		{
+			name:  "other-os",
+			rules: rules,
+			node: &types.Node{
+				Hostinfo: &tailcfg.Hostinfo{
+					OS:        "windows",
+					OSVersion: "10.0.19045.3803",
+				},
+			},
+		},
+		{
+			name:  "all-os-rule",
+			rules: []types.PostureRule{{RequiredTags: []string{"tag:corp"}}},
+			node: &types.Node{
+				Hostinfo: &tailcfg.Hostinfo{OS: "windows"},
+			},
+			wantFail: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckDevicePosture(tt.rules, tt.node, nil)
+			if tt.wantFail != (err != nil) {
+				t.Fatalf("CheckDevicePosture() error = %v, wantFail %t", err, tt.wantFail)
+			}
+
+			if err != nil && !errors.Is(err, ErrPostureCheckFailed) {
+				t.Errorf("CheckDevicePosture() error = %v, want ErrPostureCheckFailed", err)
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"5.15", "5.15", 0},
+		{"5.15.0", "5.15", 0},
+		{"6.1", "5.15", 1},
+		{"5.9", "5.15", -1},
+		{"14", "14.2", -1},
+	}
+
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
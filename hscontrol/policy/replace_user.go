@@ -0,0 +1,312 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tailscale/hujson"
+)
+
+var ErrUserPolicyConflict = errors.New("both users have a policy")
+
+// userReplacer replaces a user by another one in the aliases of a policy,
+// and records whether one changed.
+type userReplacer struct {
+	oldUser string
+	newUser string
+	changed bool
+}
+
+// alias replaces the user in an alias, like a member of a group or a
+// source.
+func (r *userReplacer) alias(alias string) string {
+	if alias == r.oldUser {
+		return r.newUser
+	}
+
+	return alias
+}
+
+// destination replaces the user in a destination, an alias followed by
+// its ports.
+func (r *userReplacer) destination(dest string) string {
+	index := strings.LastIndex(dest, ":")
+	if index < 0 || dest[:index] != r.oldUser {
+		return dest
+	}
+
+	return r.newUser + dest[index:]
+}
+
+// list replaces the user in the values of a list. A list already
+// containing the replacement only loses the user.
+func (r *userReplacer) list(values []string, replace func(string) string) []string {
+	if !slices.ContainsFunc(values, func(value string) bool { return replace(value) != value }) {
+		return values
+	}
+
+	r.changed = true
+	replaced := make([]string, 0, len(values))
+	for _, value := range values {
+		value = replace(value)
+		if !slices.Contains(replaced, value) {
+			replaced = append(replaced, value)
+		}
+	}
+
+	return replaced
+}
+
+func replaceUserInLists[M ~map[string][]string](r *userReplacer, lists M) M {
+	if lists == nil {
+		return nil
+	}
+
+	replaced := make(M, len(lists))
+	for key, values := range lists {
+		replaced[key] = r.list(values, r.alias)
+	}
+
+	return replaced
+}
+
+// ReplaceUser returns a copy of the policy where the user oldUser is
+// replaced by newUser everywhere a user can be referenced: the groups, the
+// tag owners, the auto approvers and the sources and destinations of the
+// acls, the ssh rules and the tests, and whether the policy changed. The
+// ssh users are local users of the destinations, they are kept.
+// The policy of oldUser in a policy directory becomes the policy of
+// newUser, it fails with ErrUserPolicyConflict if both users have one.
+func (pol *ACLPolicy) ReplaceUser(oldUser, newUser string) (*ACLPolicy, bool, error) {
+	if pol == nil {
+		return nil, false, nil
+	}
+
+	r := &userReplacer{oldUser: oldUser, newUser: newUser}
+
+	replaced := *pol
+	replaced.Groups = replaceUserInLists(r, pol.Groups)
+	replaced.TagOwners = replaceUserInLists(r, pol.TagOwners)
+	replaced.AutoApprovers.Routes = replaceUserInLists(r, pol.AutoApprovers.Routes)
+	replaced.AutoApprovers.ExitNode = r.list(pol.AutoApprovers.ExitNode, r.alias)
+
+	replaced.ACLs = slices.Clone(pol.ACLs)
+	for index := range replaced.ACLs {
+		acl := &replaced.ACLs[index]
+		acl.Sources = r.list(acl.Sources, r.alias)
+		acl.Destinations = r.list(acl.Destinations, r.destination)
+	}
+
+	replaced.SSHs = slices.Clone(pol.SSHs)
+	for index := range replaced.SSHs {
+		ssh := &replaced.SSHs[index]
+		ssh.Sources = r.list(ssh.Sources, r.alias)
+		ssh.Destinations = r.list(ssh.Destinations, r.alias)
+	}
+
+	replaced.Tests = slices.Clone(pol.Tests)
+	for index := range replaced.Tests {
+		test := &replaced.Tests[index]
+		if source := r.alias(test.Source); source != test.Source {
+			test.Source = source
+			r.changed = true
+		}
+		test.Accept = r.list(test.Accept, r.destination)
+		test.Deny = r.list(test.Deny, r.destination)
+	}
+
+	if len(pol.UserPolicies) > 0 {
+		if _, ok := pol.UserPolicies[oldUser]; ok {
+			if _, ok := pol.UserPolicies[newUser]; ok {
+				return nil, false, fmt.Errorf("%w: %s and %s", ErrUserPolicyConflict, oldUser, newUser)
+			}
+		}
+
+		replaced.UserPolicies = make(map[string]*ACLPolicy, len(pol.UserPolicies))
+		for user, userPol := range pol.UserPolicies {
+			userReplaced, changed, err := userPol.ReplaceUser(oldUser, newUser)
+			if err != nil {
+				return nil, false, err
+			}
+			r.changed = r.changed || changed
+
+			if user == oldUser {
+				user = newUser
+				r.changed = true
+			}
+			replaced.UserPolicies[user] = userReplaced
+		}
+	}
+
+	if !r.changed {
+		return pol, false, nil
+	}
+
+	// Only users are replaced, the groups resolve as before.
+	replaced.resolvedGroups, _ = resolveGroups(replaced.Groups)
+
+	return &replaced, true, nil
+}
+
+// ReplaceUserHuJSON replaces the user oldUser by newUser in the policy in
+// the HuJSON format data, like ReplaceUser, keeping its comments and
+// formatting, and returns whether the policy changed.
+func ReplaceUserHuJSON(data []byte, oldUser, newUser string) ([]byte, bool, error) {
+	ast, err := hujson.Parse(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	root, ok := ast.Value.(*hujson.Object)
+	if !ok {
+		return data, false, nil
+	}
+
+	r := &userReplacer{oldUser: oldUser, newUser: newUser}
+	for index := range root.Members {
+		section := &root.Members[index]
+		switch literalString(section.Name.Value) {
+		case "groups", "tagOwners":
+			r.hujsonLists(&section.Value, r.alias)
+		case "autoApprovers":
+			r.hujsonFields(&section.Value, map[string]func(*hujson.Value){
+				"routes":   func(value *hujson.Value) { r.hujsonLists(value, r.alias) },
+				"exitNode": func(value *hujson.Value) { r.hujsonList(value, r.alias) },
+			})
+		case "acls":
+			r.hujsonRules(&section.Value, map[string]func(*hujson.Value){
+				"src": func(value *hujson.Value) { r.hujsonList(value, r.alias) },
+				"dst": func(value *hujson.Value) { r.hujsonList(value, r.destination) },
+			})
+		case "ssh":
+			r.hujsonRules(&section.Value, map[string]func(*hujson.Value){
+				"src": func(value *hujson.Value) { r.hujsonList(value, r.alias) },
+				"dst": func(value *hujson.Value) { r.hujsonList(value, r.alias) },
+			})
+		case "tests":
+			r.hujsonRules(&section.Value, map[string]func(*hujson.Value){
+				"src":    func(value *hujson.Value) { r.hujsonString(value, r.alias) },
+				"accept": func(value *hujson.Value) { r.hujsonList(value, r.destination) },
+				"deny":   func(value *hujson.Value) { r.hujsonList(value, r.destination) },
+			})
+		}
+	}
+
+	if !r.changed {
+		return data, false, nil
+	}
+
+	return ast.Pack(), true, nil
+}
+
+// hujsonRules replaces the user in the fields of every object of a HuJSON
+// array, like the rules of the acls.
+func (r *userReplacer) hujsonRules(value *hujson.Value, fields map[string]func(*hujson.Value)) {
+	rules, ok := value.Value.(*hujson.Array)
+	if !ok {
+		return
+	}
+
+	for index := range rules.Elements {
+		r.hujsonFields(&rules.Elements[index], fields)
+	}
+}
+
+// hujsonFields replaces the user in the fields of a HuJSON object.
+func (r *userReplacer) hujsonFields(value *hujson.Value, fields map[string]func(*hujson.Value)) {
+	object, ok := value.Value.(*hujson.Object)
+	if !ok {
+		return
+	}
+
+	for index := range object.Members {
+		member := &object.Members[index]
+		if replace, ok := fields[literalString(member.Name.Value)]; ok {
+			replace(&member.Value)
+		}
+	}
+}
+
+// hujsonLists replaces the user in the lists of a HuJSON object, like the
+// members of the groups.
+func (r *userReplacer) hujsonLists(value *hujson.Value, replace func(string) string) {
+	object, ok := value.Value.(*hujson.Object)
+	if !ok {
+		return
+	}
+
+	for index := range object.Members {
+		r.hujsonList(&object.Members[index].Value, replace)
+	}
+}
+
+// hujsonString replaces the user in a HuJSON string.
+func (r *userReplacer) hujsonString(value *hujson.Value, replace func(string) string) {
+	str := literalString(value.Value)
+	if replaced := replace(str); str != "" && replaced != str {
+		value.Value = hujson.String(replaced)
+		r.changed = true
+	}
+}
+
+// hujsonList replaces the user in the strings of a HuJSON array. A list
+// already containing the replacement only loses the user.
+func (r *userReplacer) hujsonList(value *hujson.Value, replace func(string) string) {
+	list, ok := value.Value.(*hujson.Array)
+	if !ok {
+		return
+	}
+
+	present := make(map[string]bool, len(list.Elements))
+	for _, element := range list.Elements {
+		present[literalString(element.Value)] = true
+	}
+
+	// The whitespace before a value removed goes to the next one, to
+	// keep the formatting of the list.
+	var before *hujson.Extra
+	elements := list.Elements[:0]
+	for _, element := range list.Elements {
+		str := literalString(element.Value)
+		if replaced := replace(str); str != "" && replaced != str {
+			r.changed = true
+			if present[replaced] {
+				if before == nil {
+					before = &element.BeforeExtra
+				}
+
+				continue
+			}
+
+			element.Value = hujson.String(replaced)
+			present[replaced] = true
+		}
+
+		if before != nil {
+			element.BeforeExtra = *before
+			before = nil
+		}
+
+		elements = append(elements, element)
+	}
+	list.Elements = elements
+}
+
+// literalString returns the value of a HuJSON string, or an empty string
+// if value is not a string.
+func literalString(value hujson.ValueTrimmed) string {
+	literal, ok := value.(hujson.Literal)
+	if !ok {
+		return ""
+	}
+
+	var str string
+	if err := json.Unmarshal(literal, &str); err != nil {
+		return ""
+	}
+
+	return str
+}
@@ -0,0 +1,172 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestReplaceUser(t *testing.T) {
+	pol := &ACLPolicy{
+		Groups: Groups{
+			"group:dev":   []string{"alice", "bob"},
+			"group:ops":   []string{"alice", "carol"},
+			"group:admin": []string{"carol"},
+		},
+		TagOwners: TagOwners{
+			"tag:web": []string{"alice"},
+		},
+		ACLs: []ACL{
+			{
+				Action:       "accept",
+				Sources:      []string{"alice", "group:ops"},
+				Destinations: []string{"alice:22", "bob:*"},
+			},
+		},
+		Tests: []ACLTest{
+			{Source: "alice", Accept: []string{"bob:80"}, Deny: []string{"alice:5432"}},
+		},
+		AutoApprovers: AutoApprovers{
+			Routes:   map[string][]string{"10.0.0.0/8": {"alice"}},
+			ExitNode: []string{"alice", "carol"},
+		},
+		SSHs: []SSH{
+			{
+				Action:       "accept",
+				Sources:      []string{"alice"},
+				Destinations: []string{"alice"},
+				Users:        []string{"alice"},
+			},
+		},
+		UserPolicies: map[string]*ACLPolicy{
+			"alice": {Groups: Groups{"group:self": []string{"alice"}}},
+		},
+	}
+
+	got, changed, err := pol.ReplaceUser("alice", "carol")
+	if err != nil {
+		t.Fatalf("ReplaceUser() error = %s", err)
+	}
+	if !changed {
+		t.Fatal("ReplaceUser() did not change the policy")
+	}
+
+	want := &ACLPolicy{
+		Groups: Groups{
+			"group:dev":   []string{"carol", "bob"},
+			"group:ops":   []string{"carol"},
+			"group:admin": []string{"carol"},
+		},
+		TagOwners: TagOwners{
+			"tag:web": []string{"carol"},
+		},
+		ACLs: []ACL{
+			{
+				Action:       "accept",
+				Sources:      []string{"carol", "group:ops"},
+				Destinations: []string{"carol:22", "bob:*"},
+			},
+		},
+		Tests: []ACLTest{
+			{Source: "carol", Accept: []string{"bob:80"}, Deny: []string{"carol:5432"}},
+		},
+		AutoApprovers: AutoApprovers{
+			Routes:   map[string][]string{"10.0.0.0/8": {"carol"}},
+			ExitNode: []string{"carol"},
+		},
+		SSHs: []SSH{
+			{
+				Action:       "accept",
+				Sources:      []string{"carol"},
+				Destinations: []string{"carol"},
+				// The local users are kept.
+				Users: []string{"alice"},
+			},
+		},
+		UserPolicies: map[string]*ACLPolicy{
+			"carol": {Groups: Groups{"group:self": []string{"carol"}}},
+		},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreUnexported(ACLPolicy{})); diff != "" {
+		t.Errorf("ReplaceUser() unexpected policy (-want +got):\n%s", diff)
+	}
+
+	// The policy replaced is not modified.
+	if diff := cmp.Diff([]string{"alice", "bob"}, pol.Groups["group:dev"]); diff != "" {
+		t.Errorf("ReplaceUser() modified the policy (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"alice:22", "bob:*"}, pol.ACLs[0].Destinations); diff != "" {
+		t.Errorf("ReplaceUser() modified the policy (-want +got):\n%s", diff)
+	}
+
+	if _, changed, _ := pol.ReplaceUser("dave", "carol"); changed {
+		t.Error("ReplaceUser() changed the policy for a user it does not reference")
+	}
+
+	pol.UserPolicies["carol"] = &ACLPolicy{}
+	if _, _, err := pol.ReplaceUser("alice", "carol"); !errors.Is(err, ErrUserPolicyConflict) {
+		t.Errorf("ReplaceUser() error = %v, want %v", err, ErrUserPolicyConflict)
+	}
+}
+
+func TestReplaceUserHuJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		want        string
+		wantChanged bool
+	}{
+		{
+			name: "replaced keeping comments",
+			data: `{
+	// Developers
+	"groups": {
+		"group:dev": ["alice", "bob"], // the team
+		"group:ops": ["alice", "carol"],
+	},
+	"tagOwners": {"tag:web": ["alice"]},
+	"acls": [{"action": "accept", "src": ["alice"], "dst": ["alice:22", "bob:*"]}],
+	"autoApprovers": {"routes": {"10.0.0.0/8": ["alice"]}, "exitNode": ["alice"]},
+	"ssh": [{"action": "accept", "src": ["alice"], "dst": ["alice"], "users": ["alice"]}],
+	"tests": [{"src": "alice", "accept": ["carol:80"], "deny": ["alice:5432"]}],
+}`,
+			want: `{
+	// Developers
+	"groups": {
+		"group:dev": ["carol", "bob"], // the team
+		"group:ops": ["carol"],
+	},
+	"tagOwners": {"tag:web": ["carol"]},
+	"acls": [{"action": "accept", "src": ["carol"], "dst": ["carol:22", "bob:*"]}],
+	"autoApprovers": {"routes": {"10.0.0.0/8": ["carol"]}, "exitNode": ["carol"]},
+	"ssh": [{"action": "accept", "src": ["carol"], "dst": ["carol"], "users": ["alice"]}],
+	"tests": [{"src": "carol", "accept": ["carol:80"], "deny": ["carol:5432"]}],
+}`,
+			wantChanged: true,
+		},
+		{
+			name: "user not referenced",
+			data: `{"groups": {"group:dev": ["bob"]}, "acls": [{"action": "accept", "src": ["bob"], "dst": ["bob:*"]}]}`,
+			want: `{"groups": {"group:dev": ["bob"]}, "acls": [{"action": "accept", "src": ["bob"], "dst": ["bob:*"]}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed, err := ReplaceUserHuJSON([]byte(tt.data), "alice", "carol")
+			if err != nil {
+				t.Fatalf("ReplaceUserHuJSON() error = %s", err)
+			}
+
+			if changed != tt.wantChanged {
+				t.Errorf("ReplaceUserHuJSON() changed = %t, want %t", changed, tt.wantChanged)
+			}
+
+			if diff := cmp.Diff(tt.want, string(got)); diff != "" {
+				t.Errorf("ReplaceUserHuJSON() unexpected policy (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
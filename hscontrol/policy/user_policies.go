@@ -0,0 +1,271 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+	"go4.org/netipx"
+	"tailscale.com/tailcfg"
+)
+
+// globalPolicyName is the name, without extension, of the global policy
+// in a policy directory. User names cannot start with an underscore.
+const globalPolicyName = "_global"
+
+var (
+	ErrUnsupportedUserPolicy = errors.New("unsupported in user policies")
+	ErrDuplicateUserPolicy   = errors.New("more than one policy file")
+)
+
+var policyExtensions = []string{".hujson", ".json", ".yaml", ".yml"}
+
+// LoadACLPolicyFromDir loads a policy directory: the global policy from
+// _global.hujson, if it exists, and the policy of each user from
+// <user>.hujson. The policy files can also be JSON or YAML.
+//
+// The policies of the users are loaded and validated independently, the
+// ones that fail are left out of the policy and their errors are returned
+// keyed by user. An error loading the global policy fails the whole load.
+func LoadACLPolicyFromDir(path string) (*ACLPolicy, map[string]error, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pol := &ACLPolicy{}
+	userPolicies := make(map[string]*ACLPolicy)
+	userErrs := make(map[string]error)
+
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") ||
+			!slices.Contains(policyExtensions, ext) {
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), ext)
+		filePath := filepath.Join(path, entry.Name())
+
+		if name == globalPolicyName {
+			global, err := LoadACLPolicyFromPath(filePath)
+			if err != nil {
+				return nil, nil, fmt.Errorf("loading the global policy %s: %w", filePath, err)
+			}
+			pol = global
+
+			continue
+		}
+
+		if _, ok := userPolicies[name]; ok {
+			userErrs[name] = fmt.Errorf("%w: %s", ErrDuplicateUserPolicy, filePath)
+			delete(userPolicies, name)
+
+			continue
+		}
+		if _, ok := userErrs[name]; ok {
+			continue
+		}
+
+		userPol, err := LoadACLPolicyFromPath(filePath)
+		if err == nil {
+			err = validateUserPolicy(userPol)
+		}
+		if err != nil {
+			userErrs[name] = fmt.Errorf("loading the policy of user %s from %s: %w", name, filePath, err)
+
+			continue
+		}
+
+		userPolicies[name] = userPol
+	}
+
+	if len(userPolicies) > 0 {
+		pol.UserPolicies = userPolicies
+	}
+
+	return pol, userErrs, nil
+}
+
+// validateUserPolicy checks the policy of a user only uses the sections
+// applying to the nodes of the user.
+func validateUserPolicy(pol *ACLPolicy) error {
+	if len(pol.SSHs) > 0 {
+		return fmt.Errorf("ssh: %w", ErrUnsupportedUserPolicy)
+	}
+
+	if len(pol.AutoApprovers.Routes) > 0 || len(pol.AutoApprovers.ExitNode) > 0 {
+		return fmt.Errorf("autoApprovers: %w", ErrUnsupportedUserPolicy)
+	}
+
+	if err := pol.ValidateTags(); err != nil {
+		return err
+	}
+
+	if err := pol.ValidateHosts(); err != nil {
+		return err
+	}
+
+	return pol.ValidatePorts()
+}
+
+// compileUserFilterRules compiles the rules of the policy of user, they
+// only allow traffic from the nodes of the user to the nodes of the user
+// and their approved routes. The routes never cover the addresses of the
+// nodes of the other users, so a user routing the tailnet range or the
+// whole internet does not reach them.
+func (pol *ACLPolicy) compileUserFilterRules(
+	user string,
+	nodes types.Nodes,
+) ([]tailcfg.FilterRule, error) {
+	userNodes := types.Nodes{}
+	var srcs, dsts, routes netipx.IPSetBuilder
+	for _, node := range nodes {
+		if node.User.Name != user {
+			continue
+		}
+
+		userNodes = append(userNodes, node)
+		node.AppendToIPSet(&srcs)
+		node.AppendToIPSet(&dsts)
+
+		for _, route := range node.Routes {
+			if route.Enabled {
+				routes.AddPrefix(netip.Prefix(route.Prefix))
+			}
+		}
+	}
+
+	if len(userNodes) == 0 {
+		return nil, nil
+	}
+
+	for _, node := range nodes {
+		if node.User.Name != user {
+			for _, ip := range node.IPs() {
+				routes.Remove(ip)
+			}
+		}
+	}
+
+	routeScope, err := routes.IPSet()
+	if err != nil {
+		return nil, err
+	}
+	dsts.AddSet(routeScope)
+
+	srcScope, err := srcs.IPSet()
+	if err != nil {
+		return nil, err
+	}
+
+	dstScope, err := dsts.IPSet()
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := pol.CompileFilterRules(userNodes)
+	if err != nil {
+		return nil, err
+	}
+
+	scoped := []tailcfg.FilterRule{}
+	for _, rule := range rules {
+		srcIPs, err := clipPrefixes(rule.SrcIPs, srcScope)
+		if err != nil {
+			return nil, err
+		}
+
+		dstPorts := []tailcfg.NetPortRange{}
+		for _, dst := range rule.DstPorts {
+			ips, err := clipPrefixes([]string{dst.IP}, dstScope)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, ip := range ips {
+				dstPorts = append(dstPorts, tailcfg.NetPortRange{
+					IP:    ip,
+					Ports: dst.Ports,
+				})
+			}
+		}
+
+		if len(srcIPs) == 0 || len(dstPorts) == 0 {
+			continue
+		}
+
+		scoped = append(scoped, tailcfg.FilterRule{
+			SrcIPs:   srcIPs,
+			DstPorts: dstPorts,
+			IPProto:  rule.IPProto,
+		})
+	}
+
+	return scoped, nil
+}
+
+// compileUserPoliciesFilterRules compiles the rules of the policies of
+// the users, sorted by user, and returns the user owning each rule. A
+// policy that cannot be compiled is logged and left out, so it does not
+// affect the other users.
+func (pol *ACLPolicy) compileUserPoliciesFilterRules(nodes types.Nodes) ([]tailcfg.FilterRule, []string) {
+	users := make([]string, 0, len(pol.UserPolicies))
+	for user := range pol.UserPolicies {
+		users = append(users, user)
+	}
+	slices.Sort(users)
+
+	rules := []tailcfg.FilterRule{}
+	owners := []string{}
+	for _, user := range users {
+		userRules, err := pol.UserPolicies[user].compileUserFilterRules(user, nodes)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Msg("Failed to compile the policy of the user, ignoring it")
+
+			continue
+		}
+
+		rules = append(rules, userRules...)
+		for range userRules {
+			owners = append(owners, user)
+		}
+	}
+
+	return rules, owners
+}
+
+// clipPrefixes returns the parts of the prefixes within scope.
+func clipPrefixes(prefixes []string, scope *netipx.IPSet) ([]string, error) {
+	var build netipx.IPSetBuilder
+	for _, prefix := range prefixes {
+		set, err := util.ParseIPSet(prefix, nil)
+		if err != nil {
+			return nil, err
+		}
+		build.AddSet(set)
+	}
+	build.Intersect(scope)
+
+	set, err := build.IPSet()
+	if err != nil {
+		return nil, err
+	}
+
+	clipped := []string{}
+	for _, prefix := range set.Prefixes() {
+		clipped = append(clipped, prefix.String())
+	}
+
+	return clipped, nil
+}
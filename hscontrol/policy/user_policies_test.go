@@ -0,0 +1,221 @@
+package policy
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+)
+
+func TestLoadACLPolicyFromDir(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"_global.hujson": `{
+			// The global policy.
+			"acls": [{"action": "accept", "src": ["admin"], "dst": ["*:*"]}],
+		}`,
+		"alice.hujson": `{
+			"groups": {"group:web": ["alice"]},
+			"acls": [{"action": "accept", "src": ["group:web"], "dst": ["alice:443"]}],
+		}`,
+		"bob.yaml": `
+acls:
+  - action: accept
+    src: ["bob"]
+    dst: ["bob:22"]
+`,
+		"carol.hujson": `{"acls": [`,
+		"dave.hujson": `{
+			"acls": [{"action": "accept", "src": ["dave"], "dst": ["dave:*"]}],
+			"ssh": [{"action": "accept", "src": ["dave"], "dst": ["dave"], "users": ["root"]}],
+		}`,
+		"README.md": "Not a policy.",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pol, userErrs, err := LoadACLPolicyFromDir(dir)
+	if err != nil {
+		t.Fatalf("loading policy directory: %s", err)
+	}
+
+	if len(pol.ACLs) != 1 || pol.ACLs[0].Sources[0] != "admin" {
+		t.Errorf("unexpected global policy: %+v", pol.ACLs)
+	}
+
+	var users []string
+	for user := range pol.UserPolicies {
+		users = append(users, user)
+	}
+	slices.Sort(users)
+	if diff := cmp.Diff([]string{"alice", "bob"}, users); diff != "" {
+		t.Errorf("unexpected user policies (-want +got):\n%s", diff)
+	}
+
+	if len(userErrs) != 2 || userErrs["carol"] == nil {
+		t.Errorf("want errors for carol and dave, got %v", userErrs)
+	}
+	if !errors.Is(userErrs["dave"], ErrUnsupportedUserPolicy) {
+		t.Errorf("dave: want %s, got %v", ErrUnsupportedUserPolicy, userErrs["dave"])
+	}
+
+	// A broken global policy fails the whole directory.
+	if err := os.WriteFile(filepath.Join(dir, "_global.hujson"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadACLPolicyFromDir(dir); err == nil {
+		t.Errorf("loading a broken global policy did not fail")
+	}
+}
+
+func TestCompileFilterRulesUserPolicies(t *testing.T) {
+	nodes := types.Nodes{
+		&types.Node{
+			ID:   1,
+			IPv4: iap("100.64.0.1"),
+			User: types.User{Name: "alice"},
+		},
+		&types.Node{
+			ID:   2,
+			IPv4: iap("100.64.0.2"),
+			User: types.User{Name: "alice"},
+			Hostinfo: &tailcfg.Hostinfo{
+				RoutableIPs: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+			},
+			Routes: types.Routes{
+				{Prefix: types.IPPrefix(netip.MustParsePrefix("10.1.0.0/16")), Advertised: true, Enabled: true},
+			},
+		},
+		&types.Node{
+			ID:   3,
+			IPv4: iap("100.64.0.3"),
+			User: types.User{Name: "bob"},
+		},
+	}
+
+	pol := &ACLPolicy{
+		UserPolicies: map[string]*ACLPolicy{
+			// Everything alice allows stays within her nodes and routes.
+			"alice": {
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"*"}, Destinations: []string{"*:22"}},
+					{Action: "accept", Sources: []string{"alice"}, Destinations: []string{"10.0.0.0/8:80"}},
+					{Action: "accept", Sources: []string{"alice"}, Destinations: []string{"100.64.0.3:*"}},
+				},
+			},
+			// An invalid policy does not affect the others.
+			"bob": {
+				ACLs: []ACL{
+					{Action: "deny", Sources: []string{"*"}, Destinations: []string{"*:*"}},
+				},
+			},
+		},
+	}
+
+	got, err := pol.CompileFilterRules(nodes)
+	if err != nil {
+		t.Fatalf("compiling filter rules: %s", err)
+	}
+
+	port22 := tailcfg.PortRange{First: 22, Last: 22}
+	port80 := tailcfg.PortRange{First: 80, Last: 80}
+	want := []tailcfg.FilterRule{
+		{
+			SrcIPs: []string{"100.64.0.1/32", "100.64.0.2/32"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "10.1.0.0/16", Ports: port22},
+				{IP: "100.64.0.1/32", Ports: port22},
+				{IP: "100.64.0.2/32", Ports: port22},
+			},
+		},
+		{
+			SrcIPs: []string{"100.64.0.1/32", "100.64.0.2/32"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "10.1.0.0/16", Ports: port80},
+			},
+		},
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected filter rules (-want +got):\n%s", diff)
+	}
+}
+
+func TestCompileFilterRulesUserPoliciesExitRoute(t *testing.T) {
+	exit := &types.Node{
+		ID:   1,
+		IPv4: iap("100.64.0.1"),
+		User: types.User{Name: "alice"},
+		Hostinfo: &tailcfg.Hostinfo{
+			RoutableIPs: []netip.Prefix{types.ExitRouteV4, netip.MustParsePrefix("100.64.0.0/10")},
+		},
+	}
+	bob := &types.Node{
+		ID:   2,
+		IPv4: iap("100.64.0.2"),
+		User: types.User{Name: "bob"},
+	}
+
+	pol := &ACLPolicy{
+		UserPolicies: map[string]*ACLPolicy{
+			"alice": {
+				ACLs: []ACL{
+					{Action: "accept", Sources: []string{"*"}, Destinations: []string{"*:*"}},
+				},
+			},
+		},
+	}
+
+	// The advertised routes are not approved, alice only reaches her node.
+	got, err := pol.CompileFilterRules(types.Nodes{exit, bob})
+	if err != nil {
+		t.Fatalf("compiling filter rules: %s", err)
+	}
+
+	want := []tailcfg.FilterRule{
+		{
+			SrcIPs: []string{"100.64.0.1/32"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "100.64.0.1/32", Ports: tailcfg.PortRangeAny},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected filter rules (-want +got):\n%s", diff)
+	}
+
+	// Approved, the routes reach the internet and the tailnet range but
+	// not the node of bob.
+	exit.Routes = types.Routes{
+		{Prefix: types.IPPrefix(types.ExitRouteV4), Advertised: true, Enabled: true},
+		{Prefix: types.IPPrefix(netip.MustParsePrefix("100.64.0.0/10")), Advertised: true, Enabled: true},
+	}
+	got, err = pol.CompileFilterRules(types.Nodes{exit, bob})
+	if err != nil {
+		t.Fatalf("compiling filter rules: %s", err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("got %d filter rules, want 1", len(got))
+	}
+	if reduced := ReduceFilterRules(bob, got); len(reduced) != 0 {
+		t.Errorf("ReduceFilterRules() for bob = %v, want no rule", reduced)
+	}
+	for _, addr := range []string{"100.64.0.1", "100.64.0.3", "8.8.8.8"} {
+		if !slices.ContainsFunc(got[0].DstPorts, func(dst tailcfg.NetPortRange) bool {
+			return netip.MustParsePrefix(dst.IP).Contains(netip.MustParseAddr(addr))
+		}) {
+			t.Errorf("alice cannot reach %s, want it reachable", addr)
+		}
+	}
+}
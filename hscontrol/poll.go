@@ -3,7 +3,9 @@ package hscontrol
 import (
 	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"math/rand/v2"
 	"net/http"
 	"net/netip"
@@ -14,17 +16,15 @@ import (
 
 	"github.com/juanfont/headscale/hscontrol/db"
 	"github.com/juanfont/headscale/hscontrol/mapper"
+	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	xslices "golang.org/x/exp/slices"
 	"gorm.io/gorm"
 	"tailscale.com/tailcfg"
 )
 
-const (
-	keepAliveInterval = 50 * time.Second
-)
-
 type contextKey string
 
 const nodeNameContextKey = contextKey("nodeName")
@@ -64,13 +64,21 @@ func (h *Headscale) newMapSession(
 	w http.ResponseWriter,
 	node *types.Node,
 ) *mapSession {
-	warnf, tracef, infof, errf := logPollFunc(req, node)
+	warnf, tracef, infof, errf := logPollFunc(requestLogger(ctx), req, node)
 
 	// Use a buffered channel in case a node is not fully ready
 	// to receive a message to make sure we dont block the entire
 	// notifier.
 	updateChan := make(chan types.StateUpdate, h.cfg.Tuning.NodeMapSessionBufferedChanSize)
 
+	// The configuration rejects intervals out of bounds, a Config
+	// built without it (zero value) gets the default instead of a
+	// ticker that panics.
+	keepAliveInterval := h.cfg.MapKeepAliveInterval
+	if keepAliveInterval < types.MinMapKeepAliveInterval {
+		keepAliveInterval = types.DefaultMapKeepAliveInterval
+	}
+
 	return &mapSession{
 		h:      h,
 		ctx:    ctx,
@@ -86,7 +94,9 @@ func (h *Headscale) newMapSession(
 		ch:       updateChan,
 		cancelCh: make(chan struct{}),
 
-		keepAliveTicker: time.NewTicker(keepAliveInterval + (time.Duration(rand.IntN(9000)) * time.Millisecond)),
+		// Spread the keep alives of the nodes, without going over
+		// the configured interval.
+		keepAliveTicker: time.NewTicker(keepAliveInterval - rand.N(keepAliveInterval/10)),
 
 		// Loggers
 		warnf:  warnf,
@@ -137,6 +147,7 @@ func (m *mapSession) serve() {
 
 		defer m.h.updateNodeOnlineStatus(false, m.node)
 		defer m.h.nodeNotifier.RemoveNode(m.node.ID)
+		defer m.h.nodeHeartbeats.forget(m.node.ID)
 
 		defer func() {
 			m.servingMu.Lock()
@@ -150,6 +161,7 @@ func (m *mapSession) serve() {
 
 		m.h.nodeNotifier.AddNode(m.node.ID, m.ch)
 		m.h.updateNodeOnlineStatus(true, m.node)
+		m.h.nodeHeartbeats.record(m.node.ID, time.Now())
 
 		m.infof("node has connected, mapSession: %p", m)
 	}
@@ -250,10 +262,28 @@ func (m *mapSession) serve() {
 			m.node, err = m.h.db.GetNodeByID(m.node.ID)
 			if err != nil {
 				m.errf(err, "Could not get machine from db")
+				// A node deleted while connected is not an error.
+				if !errors.Is(err, gorm.ErrRecordNotFound) {
+					m.h.captureException(m.ctx, err)
+				}
 
 				return
 			}
 
+			// The node only gets its peers, and is only sent to them,
+			// while it passes the device posture check, a change of the
+			// result needs a full update and the peers to be told.
+			if m.checkPosture(full) {
+				full = true
+
+				ctx := types.NotifyCtx(context.Background(), "poll-posture-changed", m.node.Hostname)
+				m.h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdate{
+					Type:        types.StatePeerChanged,
+					ChangeNodes: []types.NodeID{m.node.ID},
+					Message:     "called from mapSession.checkPosture",
+				}, m.node.ID)
+			}
+
 			// If there are patches _and_ fully changed nodes, filter the
 			// patches and remove all patches that are present for the full
 			// changes updates. This allows us to send them as part of the
@@ -308,11 +338,12 @@ func (m *mapSession) serve() {
 				data, err = m.mapper.PeerChangedPatchResponse(m.req, m.node, patches, m.h.ACLPolicy)
 			} else if derp {
 				m.tracef("Sending DERPUpdate MapResponse")
-				data, err = m.mapper.DERPMapResponse(m.req, m.node, m.h.DERPMap)
+				data, err = m.mapper.DERPMapResponse(m.req, m.node, m.h.DERPMap())
 			}
 
 			if err != nil {
 				m.errf(err, "Could not get the create map update")
+				m.h.captureException(m.ctx, err)
 
 				return
 			}
@@ -418,8 +449,42 @@ func (m *mapSession) serve() {
 				m.errf(err, "flushing keep alive to client, for mapSession: %p", m)
 				return
 			}
+
+			m.h.nodeHeartbeats.record(m.node.ID, time.Now())
+		}
+	}
+}
+
+// checkPosture evaluates the device posture of the node and sets the
+// result on it. The result is saved when it changed, and on full updates
+// to keep track of the time of the last check. It returns true if the
+// result changed.
+func (m *mapSession) checkPosture(full bool) bool {
+	if len(m.h.cfg.PosturePolicy.Rules) == 0 {
+		return false
+	}
+
+	var postureErr string
+	err := policy.CheckDevicePosture(m.h.cfg.PosturePolicy.Rules, m.node, m.h.ACLPolicy)
+	if err != nil {
+		postureErr = err.Error()
+	}
+
+	changed := m.node.PostureCheckedAt == nil || m.node.PostureError != postureErr
+	if changed && postureErr != "" {
+		m.infof("node failed device posture check: %s", postureErr)
+	}
+
+	if changed || full {
+		now := time.Now()
+		if err := m.h.db.NodeSetPosture(m.node.ID, now, postureErr); err != nil {
+			m.errf(err, "Could not save device posture check result")
 		}
+		m.node.PostureCheckedAt = &now
 	}
+	m.node.PostureError = postureErr
+
+	return changed
 }
 
 func (m *mapSession) pollFailoverRoutes(where string, node *types.Node) {
@@ -438,6 +503,44 @@ func (m *mapSession) pollFailoverRoutes(where string, node *types.Node) {
 	}
 }
 
+// nodeHeartbeats records when the connected nodes were last heard
+// from, with every keep alive. It is kept in memory so the keep alives
+// do not write to the database, which only stores the last seen time
+// of a node when it disconnects. The route failover uses it to detect
+// connections that are hanging.
+type nodeHeartbeats struct {
+	mu       sync.Mutex
+	lastSeen map[types.NodeID]time.Time
+}
+
+func newNodeHeartbeats() *nodeHeartbeats {
+	return &nodeHeartbeats{
+		lastSeen: make(map[types.NodeID]time.Time),
+	}
+}
+
+func (b *nodeHeartbeats) record(nodeID types.NodeID, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastSeen[nodeID] = now
+}
+
+func (b *nodeHeartbeats) forget(nodeID types.NodeID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.lastSeen, nodeID)
+}
+
+// snapshot returns a copy of the heartbeats of the connected nodes.
+func (b *nodeHeartbeats) snapshot() map[types.NodeID]time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return maps.Clone(b.lastSeen)
+}
+
 // updateNodeOnlineStatus records the last seen status of a node and notifies peers
 // about change in their online/offline status.
 // It takes a StateUpdateType of either StatePeerOnlineChanged or StatePeerOfflineChanged.
@@ -454,16 +557,17 @@ func (h *Headscale) updateNodeOnlineStatus(online bool, node *types.Node) {
 		node.LastSeen = &now
 		change.LastSeen = &now
 
-		err := h.db.DB.Transaction(func(tx *gorm.DB) error {
-			return db.SetLastSeen(tx, node.ID, *node.LastSeen)
-		})
-		if err != nil {
+		if err := h.db.SetLastSeen(node.ID, *node.LastSeen); err != nil {
 			log.Error().Err(err).Msg("Cannot update node LastSeen")
 
 			return
 		}
 	}
 
+	if h.nodeStatusMonitor != nil {
+		h.nodeStatusMonitor.report(online, node)
+	}
+
 	ctx := types.NotifyCtx(context.Background(), "poll-nodeupdate-onlinestatus", node.Hostname)
 	h.nodeNotifier.NotifyWithIgnore(ctx, types.StateUpdate{
 		Type: types.StatePeerChangedPatch,
@@ -544,7 +648,7 @@ func (m *mapSession) handleEndpointUpdate() {
 
 	}
 
-	if err := m.h.db.DB.Save(m.node).Error; err != nil {
+	if err := m.h.db.SaveReportedNode(m.node); err != nil {
 		m.errf(err, "Failed to persist/update node in the database")
 		http.Error(m.w, "", http.StatusInternalServerError)
 
@@ -615,7 +719,7 @@ func (m *mapSession) handleSaveNode() error {
 		}
 	}
 
-	if err := m.h.db.DB.Save(m.node).Error; err != nil {
+	if err := m.h.db.SaveReportedNode(m.node); err != nil {
 		return err
 	}
 
@@ -701,11 +805,12 @@ func peerChangeEmpty(chng tailcfg.PeerChange) bool {
 }
 
 func logPollFunc(
+	logger *zerolog.Logger,
 	mapRequest tailcfg.MapRequest,
 	node *types.Node,
 ) (func(string, ...any), func(string, ...any), func(string, ...any), func(error, string, ...any)) {
 	return func(msg string, a ...any) {
-			log.Warn().
+			logger.Warn().
 				Caller().
 				Bool("readOnly", mapRequest.ReadOnly).
 				Bool("omitPeers", mapRequest.OmitPeers).
@@ -715,7 +820,7 @@ func logPollFunc(
 				Msgf(msg, a...)
 		},
 		func(msg string, a ...any) {
-			log.Info().
+			logger.Info().
 				Caller().
 				Bool("readOnly", mapRequest.ReadOnly).
 				Bool("omitPeers", mapRequest.OmitPeers).
@@ -725,7 +830,7 @@ func logPollFunc(
 				Msgf(msg, a...)
 		},
 		func(msg string, a ...any) {
-			log.Trace().
+			logger.Trace().
 				Caller().
 				Bool("readOnly", mapRequest.ReadOnly).
 				Bool("omitPeers", mapRequest.OmitPeers).
@@ -735,7 +840,7 @@ func logPollFunc(
 				Msgf(msg, a...)
 		},
 		func(err error, msg string, a ...any) {
-			log.Error().
+			logger.Error().
 				Caller().
 				Bool("readOnly", mapRequest.ReadOnly).
 				Bool("omitPeers", mapRequest.OmitPeers).
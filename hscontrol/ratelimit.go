@@ -0,0 +1,177 @@
+package hscontrol
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter is a set of token buckets, one per key (a source IP or a
+// node), refilled with perMinute tokens a minute. A bucket holds up to a
+// minute of tokens, so bursts of requests like reconnections after a
+// network change are let through.
+type rateLimiter struct {
+	perMinute int
+
+	mu        sync.Mutex
+	buckets   map[string]*rateLimiterBucket
+	lastSweep time.Time
+}
+
+type rateLimiterBucket struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// newRateLimiter returns a rateLimiter, or nil if perMinute is 0 which
+// disables the limit. The methods of a nil rateLimiter allow everything.
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		perMinute: perMinute,
+		buckets:   make(map[string]*rateLimiterBucket),
+	}
+}
+
+// allow takes a token from the bucket of every key at now. If one of
+// the buckets is empty, no token is taken and the time to wait before
+// retrying is returned.
+func (l *rateLimiter) allow(now time.Time, keys ...string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	reservations := make([]*rate.Reservation, 0, len(keys))
+	for _, key := range keys {
+		bucket, ok := l.buckets[key]
+		if !ok {
+			bucket = &rateLimiterBucket{
+				limiter: rate.NewLimiter(rate.Limit(float64(l.perMinute)/60), l.perMinute),
+			}
+			l.buckets[key] = bucket
+		}
+		bucket.lastUsed = now
+
+		reservation := bucket.limiter.ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+			for _, r := range reservations {
+				r.CancelAt(now)
+			}
+
+			return false, delay
+		}
+
+		reservations = append(reservations, reservation)
+	}
+
+	return true, 0
+}
+
+// sweep forgets the buckets not used for a minute, they are full again
+// and equivalent to new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.lastUsed) >= time.Minute {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP returns the source IP of req. If req comes from one of the
+// trusted proxies, it is the last address of X-Forwarded-For which is not
+// a trusted proxy, the addresses before it could have been set by the
+// client.
+func clientIP(req *http.Request, trustedProxies []netip.Prefix) string {
+	ip := sourceIP(req.RemoteAddr)
+	if !isTrustedProxy(ip, trustedProxies) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+
+		ip = addr.String()
+		if !isTrustedProxy(ip, trustedProxies) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func isTrustedProxy(ip string, trustedProxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	return slices.ContainsFunc(trustedProxies, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr.Unmap())
+	})
+}
+
+// checkRateLimit answers with a 429 and returns false if the source IP,
+// as returned by clientIP, or the node of a request is over the limit.
+func checkRateLimit(
+	writer http.ResponseWriter,
+	limiter *rateLimiter,
+	endpoint string,
+	ip string,
+	machineKey string,
+) bool {
+	ok, retryAfter := limiter.allow(time.Now(), "ip:"+ip, "node:"+machineKey)
+	if ok {
+		return true
+	}
+
+	log.Info().
+		Str("endpoint", endpoint).
+		Str("remote_addr", ip).
+		Str("machine_key", machineKey).
+		Msg("Request rate limited")
+
+	writer.Header().Set(
+		"Retry-After",
+		strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))),
+	)
+	writeAPIError(
+		writer,
+		http.StatusTooManyRequests,
+		types.ErrQuotaExceeded.WithDetails(map[string]interface{}{
+			"retry_after_seconds": int(math.Ceil(retryAfter.Seconds())),
+		}),
+	)
+
+	return false
+}
@@ -0,0 +1,146 @@
+package hscontrol
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+
+	disabled := newRateLimiter(0)
+	if ok, _ := disabled.allow(now, "ip:1.2.3.4"); !ok {
+		t.Fatal("disabled limiter should allow everything")
+	}
+
+	limiter := newRateLimiter(3)
+
+	// A minute worth of requests is allowed at once.
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow(now, "ip:1.2.3.4", "node:a"); !ok {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+
+	ok, retryAfter := limiter.allow(now, "ip:1.2.3.4", "node:a")
+	if ok {
+		t.Fatal("request over the limit should be denied")
+	}
+	if retryAfter != 20*time.Second {
+		t.Errorf("want retry after 20s, got %s", retryAfter)
+	}
+
+	// The source IP is limited for other nodes too, and denied requests
+	// do not take a token from the other buckets.
+	if ok, _ := limiter.allow(now, "ip:1.2.3.4", "node:b"); ok {
+		t.Fatal("request from a limited IP should be denied")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow(now, "ip:5.6.7.8", "node:b"); !ok {
+			t.Fatalf("request %d of node b should be allowed", i)
+		}
+	}
+
+	// Tokens come back over time.
+	if ok, _ := limiter.allow(now.Add(20*time.Second), "ip:1.2.3.4", "node:a"); !ok {
+		t.Fatal("request should be allowed once a token is back")
+	}
+
+	// Buckets not used for a minute are forgotten.
+	limiter.allow(now.Add(2*time.Minute), "ip:9.9.9.9")
+	if len(limiter.buckets) != 1 {
+		t.Errorf("want 1 bucket after the sweep, got %d", len(limiter.buckets))
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	limiter := newRateLimiter(1)
+
+	rec := httptest.NewRecorder()
+	if !checkRateLimit(rec, limiter, "register", "1.2.3.4", "mkey:a") {
+		t.Fatal("first request should be allowed")
+	}
+
+	// Another node behind the same IP shares the bucket.
+	rec = httptest.NewRecorder()
+	if checkRateLimit(rec, limiter, "register", "1.2.3.4", "mkey:b") {
+		t.Fatal("second request should be denied")
+	}
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("want status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("want Retry-After 60, got %q", got)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{
+			name:       "direct",
+			remoteAddr: "1.2.3.4:41641",
+			want:       "1.2.3.4",
+		},
+		{
+			name:         "untrusted proxy",
+			remoteAddr:   "1.2.3.4:41641",
+			forwardedFor: []string{"5.6.7.8"},
+			want:         "1.2.3.4",
+		},
+		{
+			name:         "trusted proxy",
+			remoteAddr:   "10.0.0.1:41641",
+			forwardedFor: []string{"5.6.7.8"},
+			want:         "5.6.7.8",
+		},
+		{
+			name:         "spoofed by the client",
+			remoteAddr:   "10.0.0.1:41641",
+			forwardedFor: []string{"9.9.9.9, 5.6.7.8"},
+			want:         "5.6.7.8",
+		},
+		{
+			name:         "chain of trusted proxies",
+			remoteAddr:   "10.0.0.1:41641",
+			forwardedFor: []string{"9.9.9.9", "5.6.7.8, 10.0.0.2"},
+			want:         "5.6.7.8",
+		},
+		{
+			name:       "trusted proxy without header",
+			remoteAddr: "10.0.0.1:41641",
+			want:       "10.0.0.1",
+		},
+		{
+			name:         "invalid header",
+			remoteAddr:   "10.0.0.1:41641",
+			forwardedFor: []string{"not-an-ip"},
+			want:         "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/ts2021", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", header)
+			}
+
+			if got := clientIP(req, trusted); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
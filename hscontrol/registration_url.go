@@ -0,0 +1,354 @@
+package hscontrol
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"tailscale.com/types/key"
+)
+
+const (
+	registrationURLTokenExpiry = 5 * time.Minute
+
+	// registrationURLUsedPrefix prefixes the nonce of the registration
+	// URL tokens already used in the registration cache.
+	registrationURLUsedPrefix = "regurl-"
+)
+
+var (
+	errRegistrationURLTokenInvalid = errors.New("registration URL token is invalid")
+	errRegistrationURLTokenExpired = errors.New("registration URL token has expired")
+	errRegistrationURLTokenUsed    = errors.New("registration URL token has already been used")
+	errRegistrationNotPending      = errors.New("no pending registration for this key")
+)
+
+// registrationURLToken is embedded in the one-time registration URLs
+// generated by the CLI, it is signed with a secret only known to the
+// server.
+type registrationURLToken struct {
+	MachineKey key.MachinePublic `json:"machine_key"`
+	User       string            `json:"user"`
+	Expiry     int64             `json:"expiry"`
+	Nonce      string            `json:"nonce"`
+
+	// IP is the address requested for the node, empty to allocate the
+	// next free one.
+	IP string `json:"ip,omitempty"`
+}
+
+// newRegistrationURLSecret returns the secret the registration URL
+// tokens are signed with. It only lives in memory, the URLs generated
+// before a restart are no longer valid.
+func newRegistrationURLSecret() ([]byte, error) {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("generating registration URL secret: %w", err)
+	}
+
+	return secret, nil
+}
+
+func signRegistrationURLToken(secret []byte, token registrationURLToken) (string, error) {
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", fmt.Errorf("marshalling registration URL token: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseRegistrationURLToken checks the signature and the expiry of a
+// registration URL token.
+func parseRegistrationURLToken(
+	secret []byte,
+	signed string,
+	now time.Time,
+) (*registrationURLToken, error) {
+	payloadStr, sigStr, ok := strings.Cut(signed, ".")
+	if !ok {
+		return nil, errRegistrationURLTokenInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(payloadStr)
+	if err != nil {
+		return nil, errRegistrationURLTokenInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(sigStr)
+	if err != nil {
+		return nil, errRegistrationURLTokenInvalid
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errRegistrationURLTokenInvalid
+	}
+
+	var token registrationURLToken
+	if err := json.Unmarshal(payload, &token); err != nil {
+		return nil, errRegistrationURLTokenInvalid
+	}
+
+	if !now.Before(time.Unix(token.Expiry, 0)) {
+		return nil, errRegistrationURLTokenExpired
+	}
+
+	return &token, nil
+}
+
+// generateRegistrationURL returns a one-time URL registering the node
+// waiting with machineKey in the user once opened, and its expiry. The
+// node is given requestedIP if it is not nil.
+func (h *Headscale) generateRegistrationURL(
+	machineKey key.MachinePublic,
+	userName string,
+	requestedIP *netip.Addr,
+) (string, time.Time, error) {
+	if _, ok := h.registrationCache.Get(machineKey.String()); !ok {
+		return "", time.Time{}, errRegistrationNotPending
+	}
+
+	if _, err := h.db.GetUser(userName); err != nil {
+		return "", time.Time{}, err
+	}
+
+	nonce := make([]byte, randomByteSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", time.Time{}, fmt.Errorf("generating registration URL nonce: %w", err)
+	}
+
+	expiry := time.Now().Add(registrationURLTokenExpiry)
+	token := registrationURLToken{
+		MachineKey: machineKey,
+		User:       userName,
+		Expiry:     expiry.Unix(),
+		Nonce:      hex.EncodeToString(nonce),
+	}
+	if requestedIP != nil {
+		token.IP = requestedIP.String()
+	}
+
+	signed, err := signRegistrationURLToken(h.registrationURLSecret, token)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return fmt.Sprintf(
+		"%s/register/confirm/%s",
+		strings.TrimSuffix(h.cfg.ServerURL, "/"),
+		signed,
+	), expiry, nil
+}
+
+type registerURLTemplateConfig struct {
+	Node    string
+	User    string
+	Message string
+	Confirm bool
+}
+
+var registerURLTemplate = template.Must(
+	template.New("registerurl").Parse(`
+<html>
+	<head>
+		<title>Registration - Headscale</title>
+	</head>
+	<body>
+		<h1>headscale</h1>
+		<h2>Machine registration</h2>
+		{{if .Confirm}}
+		<p>
+			Add the machine <code>{{.Node}}</code> to the user <code>{{.User}}</code>?
+		</p>
+		<form method="post">
+			<button type="submit">Register</button>
+		</form>
+		{{else}}
+		<p>{{.Message}}</p>
+		{{end}}
+	</body>
+</html>
+`))
+
+// RegisterURL completes the registration of a node with a one-time URL
+// generated by `headscale nodes generate-register-url`. A GET only shows
+// a confirmation page, so link previews do not use the URL, the node is
+// registered on POST.
+// Listens in /register/confirm/:token.
+func (h *Headscale) RegisterURL(
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	token, err := parseRegistrationURLToken(
+		h.registrationURLSecret,
+		mux.Vars(req)["token"],
+		time.Now(),
+	)
+	if err != nil {
+		log.Debug().
+			Err(err).
+			Msg("Rejected registration URL")
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if _, used := h.registrationCache.Get(registrationURLUsedPrefix + token.Nonce); used {
+		http.Error(writer, errRegistrationURLTokenUsed.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	nodeInterface, ok := h.registrationCache.Get(token.MachineKey.String())
+	if !ok {
+		http.Error(writer, errRegistrationNotPending.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	node, ok := nodeInterface.(types.Node)
+	if !ok {
+		http.Error(writer, errRegistrationNotPending.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		renderRegisterURLTemplate(writer, registerURLTemplateConfig{
+			Node:    node.Hostname,
+			User:    token.User,
+			Confirm: true,
+		})
+
+		return
+	}
+
+	// the token is only accepted once, go-cache's Add fails if the
+	// nonce is already there.
+	if err := h.registrationCache.Add(
+		registrationURLUsedPrefix+token.Nonce,
+		true,
+		registrationURLTokenExpiry,
+	); err != nil {
+		http.Error(writer, errRegistrationURLTokenUsed.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	err = h.authorizeCachedRegistration(
+		req.Context(),
+		token.MachineKey,
+		token.User,
+		util.RegisterMethodCLI,
+	)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusForbidden)
+
+		return
+	}
+
+	var requestedIP *netip.Addr
+	if token.IP != "" {
+		ip, err := netip.ParseAddr(token.IP)
+		if err != nil {
+			http.Error(writer, errRegistrationURLTokenInvalid.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if err := h.ipAlloc.Reserve(ip); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		requestedIP = &ip
+	}
+
+	ipv4, ipv6, err := h.ipAlloc.NextWith(requestedIP)
+	if err != nil {
+		h.ipAlloc.Release(requestedIP)
+
+		util.LogErr(err, "Failed to allocate IP addresses for registration URL")
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+
+		return
+	}
+
+	registered, err := db.Write(h.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		return db.RegisterNodeFromAuthCallback(
+			tx,
+			h.registrationCache,
+			token.MachineKey,
+			token.User,
+			nil,
+			util.RegisterMethodCLI,
+			ipv4, ipv6,
+		)
+	})
+	if err != nil {
+		// The node is not registered, the IPs, requested or not, are
+		// handed out again.
+		h.ipAlloc.Release(ipv4, ipv6)
+	}
+	if errors.Is(err, db.ErrUserDisabled) {
+		http.Error(writer, err.Error(), http.StatusForbidden)
+
+		return
+	}
+	if err != nil {
+		util.LogErr(err, "Failed to register node from registration URL")
+		http.Error(writer, "Failed to register node", http.StatusInternalServerError)
+
+		return
+	}
+
+	h.registrationWaiters.done(token.MachineKey)
+
+	log.Info().
+		Str("node", registered.Hostname).
+		Str("user", token.User).
+		Msg("Node registered with registration URL")
+
+	renderRegisterURLTemplate(writer, registerURLTemplateConfig{
+		Message: fmt.Sprintf("The machine %s has been added to the user %s.", registered.Hostname, token.User),
+	})
+}
+
+func renderRegisterURLTemplate(writer http.ResponseWriter, config registerURLTemplateConfig) {
+	var content bytes.Buffer
+	if err := registerURLTemplate.Execute(&content, config); err != nil {
+		util.LogErr(err, "Could not render register URL template")
+		http.Error(writer, "Could not render register URL template", http.StatusInternalServerError)
+
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	if _, err := writer.Write(content.Bytes()); err != nil {
+		util.LogErr(err, "Failed to write response")
+	}
+}
@@ -0,0 +1,177 @@
+package hscontrol
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gopkg.in/check.v1"
+	"tailscale.com/types/key"
+)
+
+func TestParseRegistrationURLToken(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+
+	token := registrationURLToken{
+		MachineKey: key.NewMachine().Public(),
+		User:       "alice",
+		Expiry:     now.Add(registrationURLTokenExpiry).Unix(),
+		Nonce:      "nonce",
+	}
+
+	signed, err := signRegistrationURLToken(secret, token)
+	if err != nil {
+		t.Fatalf("signRegistrationURLToken() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		signed  string
+		now     time.Time
+		wantErr error
+	}{
+		{
+			name:   "valid",
+			secret: secret,
+			signed: signed,
+			now:    now,
+		},
+		{
+			name:    "expired",
+			secret:  secret,
+			signed:  signed,
+			now:     now.Add(registrationURLTokenExpiry + time.Second),
+			wantErr: errRegistrationURLTokenExpired,
+		},
+		{
+			name:    "other-secret",
+			secret:  []byte("other"),
+			signed:  signed,
+			now:     now,
+			wantErr: errRegistrationURLTokenInvalid,
+		},
+		{
+			name:    "tampered",
+			secret:  secret,
+			signed:  "e30" + signed[3:],
+			now:     now,
+			wantErr: errRegistrationURLTokenInvalid,
+		},
+		{
+			name:    "garbage",
+			secret:  secret,
+			signed:  "not-a-token",
+			now:     now,
+			wantErr: errRegistrationURLTokenInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRegistrationURLToken(tt.secret, tt.signed, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+
+			if tt.wantErr == nil && *got != token {
+				t.Errorf("want token %+v, got %+v", token, *got)
+			}
+		})
+	}
+}
+
+func (s *Suite) TestRegisterURL(c *check.C) {
+	app.cfg.ServerURL = "https://headscale.example.com"
+
+	_, err := app.db.CreateUser("iot")
+	c.Assert(err, check.IsNil)
+
+	machineKey := key.NewMachine().Public()
+
+	_, _, err = app.generateRegistrationURL(machineKey, "iot", nil)
+	c.Assert(errors.Is(err, errRegistrationNotPending), check.Equals, true)
+
+	app.registrationCache.Set(machineKey.String(), types.Node{
+		MachineKey: machineKey,
+		NodeKey:    key.NewNode().Public(),
+		Hostname:   "sensor",
+	}, time.Minute)
+
+	registerURL, _, err := app.generateRegistrationURL(machineKey, "iot", nil)
+	c.Assert(err, check.IsNil)
+
+	parsed, err := url.Parse(registerURL)
+	c.Assert(err, check.IsNil)
+	c.Assert(parsed.Host, check.Equals, "headscale.example.com")
+
+	request := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, parsed.Path, nil)
+		req = mux.SetURLVars(req, map[string]string{"token": path.Base(parsed.Path)})
+		rec := httptest.NewRecorder()
+		app.RegisterURL(rec, req)
+
+		return rec
+	}
+
+	// Opening the URL only asks for a confirmation.
+	c.Assert(request(http.MethodGet).Code, check.Equals, http.StatusOK)
+
+	_, err = app.db.GetNodeByMachineKey(machineKey)
+	c.Assert(err, check.NotNil)
+
+	c.Assert(request(http.MethodPost).Code, check.Equals, http.StatusOK)
+
+	node, err := app.db.GetNodeByMachineKey(machineKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(node.User.Name, check.Equals, "iot")
+
+	// The URL can only be used once.
+	c.Assert(request(http.MethodPost).Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *Suite) TestRegisterURLRequestedIP(c *check.C) {
+	app.cfg.ServerURL = "https://headscale.example.com"
+
+	prefix4 := netip.MustParsePrefix("100.64.0.0/10")
+
+	var err error
+	app.ipAlloc, err = db.NewIPAllocator(app.db, &prefix4, nil, types.IPAllocationStrategySequential, 32)
+	c.Assert(err, check.IsNil)
+
+	_, err = app.db.CreateUser("iot")
+	c.Assert(err, check.IsNil)
+
+	machineKey := key.NewMachine().Public()
+	app.registrationCache.Set(machineKey.String(), types.Node{
+		MachineKey: machineKey,
+		NodeKey:    key.NewNode().Public(),
+		Hostname:   "sensor",
+	}, time.Minute)
+
+	requestedIP := netip.MustParseAddr("100.64.0.10")
+	registerURL, _, err := app.generateRegistrationURL(machineKey, "iot", &requestedIP)
+	c.Assert(err, check.IsNil)
+
+	parsed, err := url.Parse(registerURL)
+	c.Assert(err, check.IsNil)
+
+	req := httptest.NewRequest(http.MethodPost, parsed.Path, nil)
+	req = mux.SetURLVars(req, map[string]string{"token": path.Base(parsed.Path)})
+	rec := httptest.NewRecorder()
+	app.RegisterURL(rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+	node, err := app.db.GetNodeByMachineKey(machineKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(*node.IPv4, check.Equals, requestedIP)
+}
@@ -0,0 +1,260 @@
+package hscontrol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// maxRegistrationWebhookResponseSize limits how much of the webhook
+// response is read.
+const maxRegistrationWebhookResponseSize = 64 << 10
+
+var (
+	ErrRegistrationDenied           = errors.New("registration denied")
+	errRegistrationWebhookBadStatus = errors.New("registration webhook returned unexpected status")
+)
+
+// registrationWebhookRequest is the body POSTed to the registration
+// webhook for every node registration.
+type registrationWebhookRequest struct {
+	MachineKey     string   `json:"machine_key"`
+	NodeKey        string   `json:"node_key"`
+	Hostname       string   `json:"hostname"`
+	User           string   `json:"user"`
+	Tags           []string `json:"tags"`
+	RegisterMethod string   `json:"register_method"`
+
+	// SourceIP is the address the registration request came from, it
+	// is empty for the interactive registrations, approved after the
+	// request.
+	SourceIP string `json:"source_ip,omitempty"`
+
+	// RequestID is the ID of the request the registration is part of,
+	// also sent in the X-Headscale-Request-Id header.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// registrationWebhookResponse is the answer expected from the
+// registration webhook. Allow defaults to true when it is missing.
+type registrationWebhookResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// newRegistrationWebhookRequest describes the registration of a node
+// with the given machine and node keys. Tags contains both the tags
+// forced on the node and the ones it requested itself.
+func newRegistrationWebhookRequest(
+	machineKey key.MachinePublic,
+	nodeKey key.NodePublic,
+	hostinfo *tailcfg.Hostinfo,
+	userName string,
+	forcedTags []string,
+	registerMethod string,
+) registrationWebhookRequest {
+	req := registrationWebhookRequest{
+		MachineKey:     machineKey.String(),
+		NodeKey:        nodeKey.String(),
+		User:           userName,
+		Tags:           slices.Clone(forcedTags),
+		RegisterMethod: registerMethod,
+	}
+
+	if hostinfo != nil {
+		req.Hostname = hostinfo.Hostname
+		req.Tags = append(req.Tags, hostinfo.RequestTags...)
+	}
+
+	slices.Sort(req.Tags)
+	req.Tags = slices.Compact(req.Tags)
+
+	if req.Tags == nil {
+		req.Tags = []string{}
+	}
+
+	return req
+}
+
+// sourceIP returns the IP of remoteAddr, an address with a port as in
+// http.Request.RemoteAddr.
+func sourceIP(remoteAddr string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+
+	return ip
+}
+
+// authorizeRegistration asks the configured registration webhook if the
+// node may register. It returns an error wrapping ErrRegistrationDenied,
+// with the reason given by the webhook, if the registration is refused.
+// A 4xx answer refuses the registration with its body as reason. If the
+// webhook cannot be reached or answers with something unexpected, the
+// registration is allowed or refused depending on FailOpen.
+func authorizeRegistration(
+	ctx context.Context,
+	cfg types.RegistrationWebhookConfig,
+	req registrationWebhookRequest,
+) error {
+	if cfg.URL == "" {
+		return nil
+	}
+
+	if req.RequestID == "" {
+		req.RequestID = requestIDFromContext(ctx)
+	}
+	logger := requestLogger(ctx)
+
+	resp, err := callRegistrationWebhook(ctx, cfg, req)
+	if err != nil {
+		if cfg.FailOpen {
+			logger.Warn().
+				Err(err).
+				Str("machine_key", req.MachineKey).
+				Str("hostname", req.Hostname).
+				Msg("Registration webhook failed, allowing registration")
+
+			return nil
+		}
+
+		logger.Error().
+			Err(err).
+			Str("machine_key", req.MachineKey).
+			Str("hostname", req.Hostname).
+			Msg("Registration webhook failed, denying registration")
+
+		return fmt.Errorf("%w: registration webhook unavailable", ErrRegistrationDenied)
+	}
+
+	if !resp.Allow {
+		reason := resp.Reason
+		if reason == "" {
+			reason = "denied by registration webhook"
+		}
+
+		logger.Info().
+			Str("machine_key", req.MachineKey).
+			Str("hostname", req.Hostname).
+			Str("user", req.User).
+			Str("reason", reason).
+			Msg("Registration denied by webhook")
+
+		return fmt.Errorf("%w: %s", ErrRegistrationDenied, reason)
+	}
+
+	return nil
+}
+
+func callRegistrationWebhook(
+	ctx context.Context,
+	cfg types.RegistrationWebhookConfig,
+	req registrationWebhookRequest,
+) (*registrationWebhookResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if req.RequestID != "" {
+		httpReq.Header.Set(requestIDHeader, req.RequestID)
+	}
+
+	client := http.Client{
+		Timeout: cfg.Timeout,
+	}
+
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(httpResp.Body, maxRegistrationWebhookResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	respBody = bytes.TrimSpace(respBody)
+
+	// A client error is a deliberate refusal, its body is the reason.
+	if httpResp.StatusCode >= http.StatusBadRequest && httpResp.StatusCode < http.StatusInternalServerError {
+		var resp registrationWebhookResponse
+		if err := json.Unmarshal(respBody, &resp); err != nil || resp.Reason == "" {
+			resp.Reason = string(respBody)
+		}
+		resp.Allow = false
+
+		return &resp, nil
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", errRegistrationWebhookBadStatus, httpResp.Status)
+	}
+
+	// A 200 allows the registration unless its body says
+	// "allow": false, an empty body and a body without "allow" both
+	// allow it.
+	resp := registrationWebhookResponse{Allow: true}
+	if len(respBody) == 0 {
+		return &resp, nil
+	}
+
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return nil, fmt.Errorf("decoding registration webhook response: %w", err)
+	}
+
+	return &resp, nil
+}
+
+// authorizeCachedRegistration asks the registration webhook about a node
+// waiting in the registration cache for an interactive registration.
+// Nodes that are not in the cache are left for the registration itself
+// to reject.
+func (h *Headscale) authorizeCachedRegistration(
+	ctx context.Context,
+	machineKey key.MachinePublic,
+	userName string,
+	registerMethod string,
+) error {
+	nodeInterface, ok := h.registrationCache.Get(machineKey.String())
+	if !ok {
+		return nil
+	}
+
+	node, ok := nodeInterface.(types.Node)
+	if !ok {
+		return nil
+	}
+
+	return authorizeRegistration(
+		ctx,
+		h.cfg.RegistrationWebhook,
+		newRegistrationWebhookRequest(
+			machineKey,
+			node.NodeKey,
+			node.Hostinfo,
+			userName,
+			node.ForcedTags,
+			registerMethod,
+		),
+	)
+}
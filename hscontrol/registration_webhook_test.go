@@ -0,0 +1,196 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestAuthorizeRegistration(t *testing.T) {
+	machineKey := key.NewMachine().Public()
+	nodeKey := key.NewNode().Public()
+	req := newRegistrationWebhookRequest(
+		machineKey,
+		nodeKey,
+		&tailcfg.Hostinfo{
+			Hostname:    "laptop",
+			RequestTags: []string{"tag:laptop", "tag:client"},
+		},
+		"alice",
+		[]string{"tag:client"},
+		util.RegisterMethodAuthKey,
+	)
+
+	want := registrationWebhookRequest{
+		MachineKey:     machineKey.String(),
+		NodeKey:        nodeKey.String(),
+		Hostname:       "laptop",
+		User:           "alice",
+		Tags:           []string{"tag:client", "tag:laptop"},
+		RegisterMethod: util.RegisterMethodAuthKey,
+	}
+	if diff := cmp.Diff(want, req); diff != "" {
+		t.Fatalf("newRegistrationWebhookRequest() unexpected result (-want +got):\n%s", diff)
+	}
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		noURL      bool
+		failOpen   bool
+		wantDenied bool
+		wantReason string
+	}{
+		{
+			name:    "no-webhook",
+			noURL:   true,
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+		},
+		{
+			name: "allow",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"allow": true}`))
+			},
+		},
+		{
+			name: "deny",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"allow": false, "reason": "not in inventory"}`))
+			},
+			wantDenied: true,
+			wantReason: "not in inventory",
+		},
+		{
+			name: "deny-without-reason",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"allow": false}`))
+			},
+			wantDenied: true,
+			wantReason: "denied by registration webhook",
+		},
+		{
+			name:    "allow-empty-response",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+		},
+		{
+			name: "allow-empty-object",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{}`))
+			},
+		},
+		{
+			name: "allow-reason-only",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"reason": "known device"}`))
+			},
+		},
+		{
+			name: "deny-client-error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "device not compliant", http.StatusForbidden)
+			},
+			wantDenied: true,
+			wantReason: "device not compliant",
+		},
+		{
+			name: "deny-client-error-json",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"reason": "not in inventory"}`))
+			},
+			wantDenied: true,
+			wantReason: "not in inventory",
+		},
+		{
+			name: "deny-client-error-fail-open",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			},
+			failOpen:   true,
+			wantDenied: true,
+			wantReason: "denied by registration webhook",
+		},
+		{
+			name: "error-fail-closed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			wantDenied: true,
+			wantReason: "registration webhook unavailable",
+		},
+		{
+			name: "invalid-response-fail-closed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`not json`))
+			},
+			wantDenied: true,
+			wantReason: "registration webhook unavailable",
+		},
+		{
+			name: "timeout-fail-closed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			wantDenied: true,
+			wantReason: "registration webhook unavailable",
+		},
+		{
+			name: "timeout-fail-open",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			failOpen: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got registrationWebhookRequest
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Errorf("decoding webhook request: %s", err)
+				}
+				tt.handler(w, r)
+			}))
+			defer srv.Close()
+
+			cfg := types.RegistrationWebhookConfig{
+				URL:      srv.URL,
+				Timeout:  200 * time.Millisecond,
+				FailOpen: tt.failOpen,
+			}
+			if tt.noURL {
+				cfg.URL = ""
+			}
+
+			err := authorizeRegistration(context.Background(), cfg, req)
+
+			// Wait for the handler to finish before looking at got.
+			srv.Close()
+
+			if denied := errors.Is(err, ErrRegistrationDenied); denied != tt.wantDenied {
+				t.Fatalf("authorizeRegistration() error = %v, want denied %t", err, tt.wantDenied)
+			}
+
+			if tt.wantDenied && err.Error() != ErrRegistrationDenied.Error()+": "+tt.wantReason {
+				t.Errorf("authorizeRegistration() error = %q, want reason %q", err, tt.wantReason)
+			}
+
+			if !tt.noURL {
+				if diff := cmp.Diff(req, got); diff != "" {
+					t.Errorf("webhook got unexpected request (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
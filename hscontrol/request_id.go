@@ -0,0 +1,86 @@
+package hscontrol
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// requestIDHeader is the header the request ID is returned in, and sent
+// to the webhooks in.
+const requestIDHeader = "X-Headscale-Request-Id"
+
+type requestIDKey struct{}
+
+// requestIDMiddleware gives every request an ID, returned in the
+// X-Headscale-Request-Id header and added to the logs and webhooks of the
+// request. The trace ID of a W3C traceparent header is used as ID, so the
+// request can be found in the traces of the caller.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		requestID, ok := traceIDFromTraceparent(req.Header.Get("traceparent"))
+		if !ok {
+			requestID = newRequestID()
+		}
+
+		writer.Header().Set(requestIDHeader, requestID)
+
+		ctx := context.WithValue(req.Context(), requestIDKey{}, requestID)
+		next.ServeHTTP(writer, req.WithContext(ctx))
+	})
+}
+
+// requestIDFromContext returns the ID of the request ctx belongs to, if
+// any.
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+
+	return requestID
+}
+
+// requestLogger returns the logger of the request ctx belongs to, which
+// adds the request ID to the log lines.
+func requestLogger(ctx context.Context) *zerolog.Logger {
+	logger := log.Logger
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		logger = logger.With().Str("request_id", requestID).Logger()
+	}
+
+	return &logger
+}
+
+// newRequestID returns a random ID of 16 bytes, in hex like a W3C trace
+// ID.
+func newRequestID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		log.Error().Err(err).Msg("Failed to generate request ID")
+	}
+
+	return hex.EncodeToString(id[:])
+}
+
+// traceIDFromTraceparent returns the trace ID of a W3C traceparent
+// header, like 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func traceIDFromTraceparent(traceparent string) (string, bool) {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", false
+	}
+
+	traceID := strings.ToLower(parts[1])
+	if _, err := hex.DecodeString(traceID); err != nil || strings.Trim(traceID, "0") == "" {
+		return "", false
+	}
+	if _, err := hex.DecodeString(parts[2]); err != nil {
+		return "", false
+	}
+
+	return traceID, true
+}
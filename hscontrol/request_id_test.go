@@ -0,0 +1,133 @@
+package hscontrol
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+)
+
+func TestTraceIDFromTraceparent(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		want        string
+		wantOK      bool
+	}{
+		{
+			name:        "valid",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want:        "4bf92f3577b34da6a3ce929d0e0e4736",
+			wantOK:      true,
+		},
+		{
+			name:        "upper case",
+			traceparent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+			want:        "4bf92f3577b34da6a3ce929d0e0e4736",
+			wantOK:      true,
+		},
+		{
+			name:        "future version",
+			traceparent: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			want:        "4bf92f3577b34da6a3ce929d0e0e4736",
+			wantOK:      true,
+		},
+		{
+			name:        "empty",
+			traceparent: "",
+		},
+		{
+			name:        "invalid version",
+			traceparent: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		{
+			name:        "zero trace ID",
+			traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		},
+		{
+			name:        "short trace ID",
+			traceparent: "00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+		},
+		{
+			name:        "not hex",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+		},
+		{
+			name:        "missing flags",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := traceIDFromTraceparent(tt.traceparent)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("traceIDFromTraceparent(%q) = %q, %t, want %q, %t", tt.traceparent, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var got string
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requestIDFromContext(r.Context())
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/machine/register", nil))
+
+	if len(got) != 32 {
+		t.Errorf("request ID = %q, want 32 hex characters", got)
+	}
+	if header := rec.Header().Get(requestIDHeader); header != got {
+		t.Errorf("%s header = %q, want %q", requestIDHeader, header, got)
+	}
+
+	// The trace ID of the caller is used as request ID.
+	req := httptest.NewRequest(http.MethodPost, "/machine/register", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if want := "4bf92f3577b34da6a3ce929d0e0e4736"; got != want {
+		t.Errorf("request ID = %q, want the trace ID %q", got, want)
+	}
+	if header := rec.Header().Get(requestIDHeader); header != got {
+		t.Errorf("%s header = %q, want %q", requestIDHeader, header, got)
+	}
+}
+
+func TestRegistrationWebhookRequestID(t *testing.T) {
+	var gotHeader string
+	var gotBody registrationWebhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Get(requestIDHeader)
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			t.Errorf("decoding webhook request: %s", err)
+		}
+		w.Write([]byte(`{"allow": true}`))
+	}))
+	defer srv.Close()
+
+	cfg := types.RegistrationWebhookConfig{
+		URL:     srv.URL,
+		Timeout: time.Second,
+	}
+
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "4bf92f3577b34da6a3ce929d0e0e4736")
+	if err := authorizeRegistration(ctx, cfg, registrationWebhookRequest{Hostname: "node"}); err != nil {
+		t.Fatalf("authorizeRegistration() error = %s", err)
+	}
+
+	if gotHeader != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("%s header = %q, want the request ID", requestIDHeader, gotHeader)
+	}
+	if gotBody.RequestID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("request_id = %q, want the request ID", gotBody.RequestID)
+	}
+}
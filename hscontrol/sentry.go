@@ -0,0 +1,179 @@
+package hscontrol
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	sentryhttp "github.com/getsentry/sentry-go/http"
+	"github.com/gorilla/mux"
+)
+
+// sentryFlushTimeout is how long the errors waiting to be sent to Sentry
+// are given at shutdown.
+const sentryFlushTimeout = 5 * time.Second
+
+var (
+	errInvalidSentryDSN    = errors.New("invalid monitoring.sentry_dsn")
+	errHTTPInternalFailure = errors.New("request failed")
+)
+
+// newSentryHub returns a hub reporting the errors to the Sentry project
+// of options.Dsn, like https://<key>@o0.ingest.sentry.io/<project>. The
+// events are sent in the background.
+func newSentryHub(options sentry.ClientOptions) (*sentry.Hub, error) {
+	client, err := sentry.NewClient(options)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidSentryDSN, err)
+	}
+
+	return sentry.NewHub(client, sentry.NewScope()), nil
+}
+
+// captureException reports err to Sentry, if monitoring.sentry_dsn is
+// set, with the hub of the request of ctx if there is one.
+func (h *Headscale) captureException(ctx context.Context, err error) {
+	if h.sentryHub == nil {
+		return
+	}
+
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		hub = h.sentryHub.Clone()
+		if requestID := requestIDFromContext(ctx); requestID != "" {
+			hub.Scope().SetTag("request_id", requestID)
+		}
+	}
+
+	hub.CaptureException(err)
+}
+
+// withSentryTransaction names the errors captured while handler runs
+// after the transaction name, so the errors of a handler are grouped.
+func withSentryTransaction(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if hub := sentry.GetHubFromContext(req.Context()); hub != nil {
+			hub.Scope().AddEventProcessor(func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+				event.Transaction = name
+
+				return event
+			})
+		}
+
+		handler(writer, req)
+	}
+}
+
+// sentryMiddleware gives every request its own clone of hub, tagged
+// with the request ID. The panics of the handlers are reported by
+// sentryhttp, the panicking requests are answered with a 500 if nothing
+// has been written yet. The requests answered with a 5xx status are
+// reported too.
+func sentryMiddleware(hub *sentry.Hub) mux.MiddlewareFunc {
+	recoverer := sentryhttp.New(sentryhttp.Options{
+		Repanic: true,
+	})
+
+	return func(next http.Handler) http.Handler {
+		reported := recoverer.Handle(next)
+
+		return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+			requestHub := hub.Clone()
+			if requestID := requestIDFromContext(req.Context()); requestID != "" {
+				requestHub.Scope().SetTag("request_id", requestID)
+			}
+			ctx := sentry.SetHubOnContext(req.Context(), requestHub)
+
+			sw := &sentryResponseWriter{ResponseWriter: writer}
+
+			defer func() {
+				if rec := recover(); rec != nil {
+					// ErrAbortHandler aborts the response on purpose.
+					if rec == http.ErrAbortHandler { //nolint:errorlint
+						panic(rec)
+					}
+
+					requestLogger(ctx).Error().
+						Str("path", req.URL.Path).
+						Bytes("stack", debug.Stack()).
+						Msgf("panic: %v", rec)
+
+					if sw.status == 0 && !sw.hijacked {
+						http.Error(sw, "Internal error", http.StatusInternalServerError)
+					}
+
+					return
+				}
+
+				if sw.status >= http.StatusInternalServerError {
+					requestHub.CaptureException(fmt.Errorf(
+						"%w: %s %s returned %d %s",
+						errHTTPInternalFailure,
+						req.Method,
+						req.URL.Path,
+						sw.status,
+						http.StatusText(sw.status),
+					))
+				}
+			}()
+
+			reported.ServeHTTP(sw, req.WithContext(ctx))
+		})
+	}
+}
+
+// sentryResponseWriter records the status of the response, it keeps
+// the streaming and the hijacking of the connection working.
+type sentryResponseWriter struct {
+	http.ResponseWriter
+
+	status   int
+	hijacked bool
+}
+
+func (w *sentryResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sentryResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *sentryResponseWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *sentryResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errNoiseHijackUnsupported
+	}
+
+	w.hijacked = true
+
+	return hijacker.Hijack()
+}
+
+func (w *sentryResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,177 @@
+package hscontrol
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// fakeSentryTransport records the events instead of sending them.
+type fakeSentryTransport struct {
+	mu     sync.Mutex
+	events []*sentry.Event
+}
+
+func (t *fakeSentryTransport) Configure(sentry.ClientOptions) {}
+
+func (t *fakeSentryTransport) SendEvent(event *sentry.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Only the errors are recorded, not the transactions.
+	if event.Type == "" {
+		t.events = append(t.events, event)
+	}
+}
+
+func (t *fakeSentryTransport) Flush(time.Duration) bool {
+	return true
+}
+
+func newFakeSentryHub(t *testing.T) (*sentry.Hub, *fakeSentryTransport) {
+	t.Helper()
+
+	transport := &fakeSentryTransport{}
+	hub, err := newSentryHub(sentry.ClientOptions{
+		Dsn:       "https://abc123@o1.ingest.sentry.io/42",
+		Transport: transport,
+	})
+	if err != nil {
+		t.Fatalf("newSentryHub() error = %s", err)
+	}
+
+	return hub, transport
+}
+
+func TestSentryMiddleware(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		wantStatus  int
+		wantMessage string
+		wantErr     string
+	}{
+		{
+			name: "panic",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			},
+			wantStatus:  http.StatusInternalServerError,
+			wantMessage: "boom",
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "Internal error", http.StatusServiceUnavailable)
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantErr:    "request failed: GET /machine/map returned 503 Service Unavailable",
+		},
+		{
+			name: "client error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "not found", http.StatusNotFound)
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name: "streamed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("map response"))
+				if err := http.NewResponseController(w).Flush(); err != nil {
+					t.Errorf("Flush() error = %s", err)
+				}
+			},
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, transport := newFakeSentryHub(t)
+			handler := requestIDMiddleware(sentryMiddleware(hub)(tt.handler))
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/machine/map", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			if tt.wantMessage == "" && tt.wantErr == "" {
+				if len(transport.events) != 0 {
+					t.Errorf("captured %d events, want none", len(transport.events))
+				}
+
+				return
+			}
+
+			if len(transport.events) != 1 {
+				t.Fatalf("captured %d events, want 1", len(transport.events))
+			}
+			event := transport.events[0]
+
+			if tt.wantMessage != "" && event.Message != tt.wantMessage {
+				t.Errorf("message = %q, want %q", event.Message, tt.wantMessage)
+			}
+
+			if tt.wantErr != "" {
+				if len(event.Exception) == 0 {
+					t.Fatalf("exception = %+v, want %q", event.Exception, tt.wantErr)
+				}
+				exception := event.Exception[len(event.Exception)-1]
+				if exception.Value != tt.wantErr {
+					t.Errorf("exception value = %q, want %q", exception.Value, tt.wantErr)
+				}
+				// The type groups the events, it is not the message which
+				// differs between requests.
+				if exception.Type == tt.wantErr {
+					t.Errorf("exception type = %q, want the type of the error", exception.Type)
+				}
+			}
+
+			if requestID := rec.Header().Get(requestIDHeader); event.Tags["request_id"] != requestID {
+				t.Errorf("request_id tag = %q, want %q", event.Tags["request_id"], requestID)
+			}
+		})
+	}
+}
+
+func TestSentryTransaction(t *testing.T) {
+	hub, transport := newFakeSentryHub(t)
+
+	handler := sentryMiddleware(hub)(withSentryTransaction("NoisePollNetMap", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/machine/map", nil))
+
+	if len(transport.events) != 1 {
+		t.Fatalf("captured %d events, want 1", len(transport.events))
+	}
+	if transaction := transport.events[0].Transaction; transaction != "NoisePollNetMap" {
+		t.Errorf("transaction = %q, want NoisePollNetMap", transaction)
+	}
+
+	// The transaction only names the errors of its request.
+	other := sentryMiddleware(hub)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	other.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	if len(transport.events) != 2 {
+		t.Fatalf("captured %d events, want 2", len(transport.events))
+	}
+	if transaction := transport.events[1].Transaction; transaction == "NoisePollNetMap" {
+		t.Errorf("transaction = %q, want the one of the request", transaction)
+	}
+}
+
+func TestNewSentryHubInvalidDSN(t *testing.T) {
+	if _, err := newSentryHub(sentry.ClientOptions{Dsn: "https://o1.ingest.sentry.io/42"}); err == nil {
+		t.Error("newSentryHub() succeeded with a DSN without a key")
+	}
+}
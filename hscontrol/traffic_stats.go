@@ -0,0 +1,116 @@
+package hscontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netlogtype"
+)
+
+const (
+	// trafficStatsPruneInterval is how often the traffic stats older
+	// than the retention are deleted.
+	trafficStatsPruneInterval = time.Hour
+
+	// maxTrafficStatsSize is the largest traffic stats message accepted
+	// from a node.
+	maxTrafficStatsSize = 4 << 20
+)
+
+// NoiseTrafficStatsHandler records the traffic stats a node POSTs to
+// /machine/:id/stats, a Tailscale network log message with the bytes
+// exchanged with each peer.
+func (ns *noiseServer) NoiseTrafficStatsHandler(
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	ns.headscale.handleTrafficStats(writer, req, ns.machineKey)
+}
+
+// handleTrafficStats records the traffic stats of the node given in the
+// path, which must be the node of machineKey: a node only reports its own
+// traffic.
+func (h *Headscale) handleTrafficStats(
+	writer http.ResponseWriter,
+	req *http.Request,
+	machineKey key.MachinePublic,
+) {
+	logger := requestLogger(req.Context())
+
+	nodeID, err := strconv.ParseUint(mux.Vars(req)["id"], util.Base10, util.BitSize64)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("invalid node: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	node, err := h.db.GetNodeByID(types.NodeID(nodeID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(writer, "node not found", http.StatusNotFound)
+
+			return
+		}
+
+		logger.Error().Caller().Err(err).Uint64("node.id", nodeID).Msg("Cannot fetch node")
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+
+		return
+	}
+
+	if node.MachineKey != machineKey {
+		http.Error(writer, "traffic stats can only be reported by the node itself", http.StatusForbidden)
+
+		return
+	}
+
+	var msg netlogtype.Message
+	body := http.MaxBytesReader(writer, req.Body, maxTrafficStatsSize)
+	if err := json.NewDecoder(body).Decode(&msg); err != nil {
+		http.Error(writer, fmt.Sprintf("decoding traffic stats: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	if msg.Start.IsZero() {
+		msg.Start = time.Now()
+	}
+
+	if err := h.db.RecordPeerTraffic(node.ID, &msg); err != nil {
+		logger.Error().Caller().Err(err).Uint64("node.id", nodeID).Msg("Cannot record traffic stats")
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// pruneTrafficStatsWorker deletes the traffic stats older than
+// h.cfg.Stats.Retention every interval.
+func (h *Headscale) pruneTrafficStatsWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		pruned, err := h.db.PrunePeerTraffic(time.Now().Add(-h.cfg.Stats.Retention))
+		if err != nil {
+			log.Error().Err(err).Msg("database error while pruning traffic stats")
+
+			continue
+		}
+
+		if pruned > 0 {
+			log.Debug().Int64("stats", pruned).Msg("Pruned traffic stats")
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package hscontrol
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gopkg.in/check.v1"
+	"tailscale.com/types/key"
+)
+
+func (s *Suite) TestHandleTrafficStats(c *check.C) {
+	user, err := app.db.CreateUser("stats")
+	c.Assert(err, check.IsNil)
+
+	createNode := func(hostname string, ip string) *types.Node {
+		ipv4 := netip.MustParseAddr(ip)
+		node := types.Node{
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			Hostname:       hostname,
+			UserID:         user.ID,
+			RegisterMethod: util.RegisterMethodCLI,
+			IPv4:           &ipv4,
+		}
+		c.Assert(app.db.DB.Save(&node).Error, check.IsNil)
+
+		return &node
+	}
+
+	web := createNode("web", "100.64.0.1")
+	database := createNode("database", "100.64.0.2")
+
+	body := fmt.Sprintf(`{
+		"nodeId": "n1",
+		"start": %q,
+		"virtualTraffic": [
+			{"src": "100.64.0.1:40000", "dst": "100.64.0.2:5432", "txBytes": 100, "rxBytes": 1000}
+		]
+	}`, time.Now().Format(time.RFC3339))
+
+	post := func(id string, machineKey key.MachinePublic) int {
+		req := httptest.NewRequest(http.MethodPost, "/machine/"+id+"/stats", bytes.NewBufferString(body))
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rec := httptest.NewRecorder()
+		app.handleTrafficStats(rec, req, machineKey)
+
+		return rec.Code
+	}
+
+	// A node only reports its own traffic.
+	c.Assert(post(fmt.Sprint(web.ID), database.MachineKey), check.Equals, http.StatusForbidden)
+	c.Assert(post(fmt.Sprint(web.ID), web.MachineKey), check.Equals, http.StatusNoContent)
+	c.Assert(post("1000", web.MachineKey), check.Equals, http.StatusNotFound)
+	c.Assert(post("web", web.MachineKey), check.Equals, http.StatusBadRequest)
+
+	traffic, err := app.db.TopPeerTraffic(time.Now().Add(-time.Hour), 10)
+	c.Assert(err, check.IsNil)
+	c.Assert(traffic, check.DeepEquals, []types.PeerTraffic{
+		{SourceID: web.ID, DestinationID: database.ID, BytesTx: 100, BytesRx: 1000},
+	})
+}
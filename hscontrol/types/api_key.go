@@ -10,13 +10,19 @@ import (
 // APIKey describes the datamodel for API keys used to remotely authenticate with
 // headscale.
 type APIKey struct {
-	ID     uint64 `gorm:"primary_key"`
-	Prefix string `gorm:"uniqueIndex"`
+	ID uint64 `gorm:"primary_key"`
+	// The size is needed for the unique index on MySQL, which
+	// cannot index TEXT columns.
+	Prefix string `gorm:"uniqueIndex;size:255"`
 	Hash   []byte
 
 	CreatedAt  *time.Time
 	Expiration *time.Time
 	LastSeen   *time.Time
+
+	// RotatedAt is when a new key was issued to replace the key
+	// before it expires, keys are only rotated once.
+	RotatedAt *time.Time
 }
 
 func (key *APIKey) Proto() *v1.ApiKey {
@@ -37,5 +43,9 @@ func (key *APIKey) Proto() *v1.ApiKey {
 		protoKey.LastSeen = timestamppb.New(*key.LastSeen)
 	}
 
+	if key.RotatedAt != nil {
+		protoKey.RotatedAt = timestamppb.New(*key.RotatedAt)
+	}
+
 	return &protoKey
 }
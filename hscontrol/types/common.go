@@ -16,6 +16,7 @@ const (
 	SelfUpdateIdentifier = "self-update"
 	DatabasePostgres     = "postgres"
 	DatabaseSqlite       = "sqlite3"
+	DatabaseMysql        = "mysql"
 )
 
 var ErrCannotParsePrefix = errors.New("cannot parse prefix")
@@ -171,6 +172,16 @@ func (su *StateUpdate) Empty() bool {
 	return false
 }
 
+// StateUpdateExpired sends the nodes which have just expired to their
+// peers, marked as expired and left out of their packet filter.
+func StateUpdateExpired(nodeIDs ...NodeID) StateUpdate {
+	return StateUpdate{
+		Type:        StatePeerChanged,
+		ChangeNodes: nodeIDs,
+		Message:     "nodes expired",
+	}
+}
+
 func StateUpdateExpire(nodeID NodeID, expiry time.Time) StateUpdate {
 	return StateUpdate{
 		Type: StatePeerChangedPatch,
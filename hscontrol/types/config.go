@@ -3,10 +3,12 @@ package types
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/netip"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -25,12 +27,37 @@ import (
 const (
 	defaultOIDCExpiryTime               = 180 * 24 * time.Hour // 180 Days
 	maxDuration           time.Duration = 1<<63 - 1
+
+	// MinMapKeepAliveInterval and MaxMapKeepAliveInterval are the bounds
+	// of map_keepalive_interval.
+	MinMapKeepAliveInterval     = 10 * time.Second
+	MaxMapKeepAliveInterval     = 120 * time.Second
+	DefaultMapKeepAliveInterval = 60 * time.Second
+
+	// MinEphemeralNodeInactivityTimeout is the lowest
+	// ephemeral_node_inactivity_timeout, ephemeral nodes are only
+	// deleted once disconnected so it does not depend on the keep
+	// alive interval.
+	MinEphemeralNodeInactivityTimeout = 30 * time.Second
 )
 
 var errOidcMutuallyExclusive = errors.New(
 	"oidc_client_secret and oidc_client_secret_path are mutually exclusive",
 )
 
+var (
+	errInvalidPostureVersion = errors.New("invalid posture_policy min_version")
+	errInvalidPostureTag     = errors.New("invalid posture_policy required tag")
+)
+
+var versionRegexp = regexp.MustCompile(`^\d+(\.\d+)*$`)
+
+var errInvalidServerURL = errors.New("invalid server_url")
+
+var errServerURLInBaseDomain = errors.New("server_url must not be in base_domain")
+
+var errInvalidPerNodePrefixLen = errors.New("invalid prefixes.per_node_prefix_len")
+
 type IPAllocationStrategy string
 
 const (
@@ -46,9 +73,14 @@ type Config struct {
 	GRPCAddr                       string
 	GRPCAllowInsecure              bool
 	EphemeralNodeInactivityTimeout time.Duration
+	NodeRegistrationTimeout        time.Duration
+	RouteFailoverTimeout           time.Duration
+	MapKeepAliveInterval           time.Duration
+	MinClientVersion               string
 	PrefixV4                       *netip.Prefix
 	PrefixV6                       *netip.Prefix
 	IPAllocation                   IPAllocationStrategy
+	PerNodePrefixLen               int
 	NoisePrivateKeyPath            string
 	BaseDomain                     string
 	Log                            LogConfig
@@ -77,6 +109,24 @@ type Config struct {
 
 	ACL ACLConfig
 
+	RegistrationWebhook RegistrationWebhookConfig
+
+	OnlineStatusWebhook OnlineStatusWebhookConfig
+
+	HTTPCompression HTTPCompressionConfig
+
+	PosturePolicy PosturePolicyConfig
+
+	GC GCConfig
+
+	APIKeyRotation APIKeyRotationConfig
+
+	RateLimit RateLimitConfig
+
+	Stats StatsConfig
+
+	Monitoring MonitoringConfig
+
 	Tuning Tuning
 }
 
@@ -96,13 +146,35 @@ type PostgresConfig struct {
 	ConnMaxIdleTimeSecs int
 }
 
+type MysqlConfig struct {
+	Host                string
+	Port                int
+	Name                string
+	User                string
+	Pass                string
+	MaxOpenConnections  int
+	MaxIdleConnections  int
+	ConnMaxIdleTimeSecs int
+}
+
 type DatabaseConfig struct {
-	// Type sets the database type, either "sqlite3" or "postgres"
+	// Type sets the database type, either "sqlite3", "postgres" or "mysql"
 	Type  string
 	Debug bool
 
+	// Connection pool of the sql.DB, the number of open connections
+	// is capped at 1 for SQLite.
+	MaxOpenConnections int
+	MaxIdleConnections int
+	ConnMaxLifetime    time.Duration
+
+	// PeerCacheTTL is how long the nodes listed for the peers of a
+	// node are reused by the next nodes, 0 disables the cache.
+	PeerCacheTTL time.Duration
+
 	Sqlite   SqliteConfig
 	Postgres PostgresConfig
+	Mysql    MysqlConfig
 }
 
 type TLSConfig struct {
@@ -110,6 +182,7 @@ type TLSConfig struct {
 	KeyPath  string
 
 	LetsEncrypt LetsEncryptConfig
+	ACME        ACMEConfig
 }
 
 type LetsEncryptConfig struct {
@@ -119,6 +192,21 @@ type LetsEncryptConfig struct {
 	ChallengeType string
 }
 
+// ACMEConfig configures certificates obtained and renewed with the
+// DNS-01 challenge.
+type ACMEConfig struct {
+	Provider             string
+	DirectoryURL         string
+	Domain               string
+	Email                string
+	DNSChallengeProvider string
+	DataDir              string
+	RenewBefore          time.Duration
+
+	DNSResolvers            []string
+	DisablePropagationCheck bool
+}
+
 type OIDCConfig struct {
 	OnlyStartIfOIDCIsAvailable bool
 	Issuer                     string
@@ -132,6 +220,29 @@ type OIDCConfig struct {
 	StripEmaildomain           bool
 	Expiry                     time.Duration
 	UseExpiryFromToken         bool
+	Claims                     OIDCClaimsConfig
+	PKCE                       OIDCPKCEConfig
+}
+
+// OIDCClaimsConfig names the claims of the ID token headscale reads
+// the information about the user from.
+type OIDCClaimsConfig struct {
+	// Identity identifies the user, it is matched against
+	// oidc.allowed_users.
+	Identity string
+	// Username is the claim the name of the headscale user is
+	// derived from.
+	Username string
+	// DisplayName is the claim holding the human-readable name of
+	// the user, it is not read if empty.
+	DisplayName string
+}
+
+// OIDCPKCEConfig configures PKCE in the OIDC login flow.
+type OIDCPKCEConfig struct {
+	// Enabled always uses PKCE, even if the provider does not advertise
+	// it in its discovery document.
+	Enabled bool
 }
 
 type DERPConfig struct {
@@ -146,6 +257,7 @@ type DERPConfig struct {
 	Paths                              []string
 	AutoUpdate                         bool
 	UpdateFrequency                    time.Duration
+	WatchPaths                         bool
 	IPv4                               string
 	IPv6                               string
 }
@@ -162,7 +274,130 @@ type CLIConfig struct {
 }
 
 type ACLConfig struct {
+	// PolicyMode is where the ACL policy is read from, the file at
+	// PolicyPath or the database.
+	PolicyMode PolicyMode
 	PolicyPath string
+
+	// DefaultPolicy is applied when no ACL policy is loaded.
+	DefaultPolicy DefaultPolicy
+
+	// SharedTags are the tags of the nodes every node can reach when
+	// DefaultPolicy isolates the users.
+	SharedTags []string
+}
+
+// PolicyMode is where the ACL policy is stored.
+type PolicyMode string
+
+const (
+	// PolicyModeFile reads the ACL policy from acl_policy_path.
+	PolicyModeFile PolicyMode = "file"
+
+	// PolicyModeDB stores the ACL policy in the database, where it is
+	// managed with the API.
+	PolicyModeDB PolicyMode = "database"
+)
+
+// DefaultPolicy is the policy applied when no ACL policy is loaded.
+type DefaultPolicy string
+
+const (
+	// DefaultPolicyAllowAll lets all nodes reach each other.
+	DefaultPolicyAllowAll DefaultPolicy = "allow-all"
+
+	// DefaultPolicyUserIsolated only lets the nodes reach the nodes of
+	// their user, and the nodes tagged with a shared tag.
+	DefaultPolicyUserIsolated DefaultPolicy = "user-isolated"
+
+	// defaultPolicyNamespaceIsolated is the name of user-isolated from
+	// when users were called namespaces.
+	defaultPolicyNamespaceIsolated = "namespace-isolated"
+)
+
+// HTTPCompressionConfig configures the compression of the responses
+// of the HTTP server.
+type HTTPCompressionConfig struct {
+	Enabled bool
+	MinSize int
+}
+
+// GCConfig configures the garbage collection of abandoned nodes.
+type GCConfig struct {
+	// StaleNodeExpiry is how long a node can stay disconnected before
+	// it is deleted, 0 disables the garbage collection.
+	StaleNodeExpiry time.Duration
+}
+
+// APIKeyRotationConfig configures the automatic rotation of the API
+// keys: BeforeExpiry before a key expires, a new key valid for
+// Expiration is issued, POSTed to WebhookURL and written to the file of
+// Directory holding the key it replaces.
+type APIKeyRotationConfig struct {
+	Enabled        bool
+	BeforeExpiry   time.Duration
+	Expiration     time.Duration
+	Directory      string
+	WebhookURL     string
+	WebhookTimeout time.Duration
+}
+
+// StatsConfig configures the traffic statistics reported by the nodes.
+type StatsConfig struct {
+	// Retention is how long the traffic statistics are kept.
+	Retention time.Duration
+}
+
+// MonitoringConfig configures the reporting of errors to Sentry.
+type MonitoringConfig struct {
+	// SentryDSN is the DSN of the Sentry project the errors are sent to,
+	// no errors are sent if it is empty.
+	SentryDSN string
+}
+
+// RateLimitConfig limits the requests of a source IP and of a node to
+// the Noise registration and map endpoints, 0 disables a limit.
+type RateLimitConfig struct {
+	RegisterPerMinute int
+	MapPerMinute      int
+
+	// TrustedProxies are the proxies whose X-Forwarded-For header gives
+	// the source IP of the requests, instead of the address they come
+	// from.
+	TrustedProxies []netip.Prefix
+}
+
+// PosturePolicyConfig lists the device posture rules nodes have to
+// satisfy to be given their peers.
+type PosturePolicyConfig struct {
+	Rules []PostureRule
+}
+
+// PostureRule requires nodes running OS, or all nodes if OS is empty,
+// to run at least MinVersion and to have all the RequiredTags.
+type PostureRule struct {
+	OS           string   `mapstructure:"os"`
+	MinVersion   string   `mapstructure:"min_version"`
+	RequiredTags []string `mapstructure:"required_tags"`
+}
+
+// RegistrationWebhookConfig configures the external service asked
+// to allow or deny each node registration.
+type RegistrationWebhookConfig struct {
+	URL      string
+	Timeout  time.Duration
+	FailOpen bool
+}
+
+// OnlineStatusWebhookConfig configures the URL notified when a node
+// goes offline.
+type OnlineStatusWebhookConfig struct {
+	URL     string
+	Timeout time.Duration
+
+	// Debounce is how long a node has to stay offline to be reported, so
+	// nodes reconnecting right away are not.
+	Debounce time.Duration
 }
 
 type LogConfig struct {
@@ -190,6 +425,41 @@ func LoadConfig(path string, isFile bool) error {
 		}
 	}
 
+	return loadConfig(func() error {
+		if err := viper.ReadInConfig(); err != nil {
+			log.Warn().Err(err).Msg("Failed to read configuration from disk")
+
+			return fmt.Errorf("fatal error reading config file: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// LoadConfigFromReader loads the YAML configuration read from r, so
+// secrets can be passed on stdin or in an environment variable instead of
+// a file. Relative paths in the configuration are relative to the working
+// directory.
+func LoadConfigFromReader(r io.Reader) error {
+	viper.SetConfigType("yaml")
+
+	return loadConfig(func() error {
+		if err := viper.ReadConfig(r); err != nil {
+			return fmt.Errorf("fatal error reading config: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// loadConfig sets the defaults of the configuration, reads it with read
+// and validates it. Every field can be overridden by an environment
+// variable named after its path, prefixed with HEADSCALE_ and with dots
+// replaced by underscores, like HEADSCALE_DATABASE_POSTGRES_PASS for
+// database.postgres.pass, which takes precedence over the file. The maps
+// and the lists of objects, read with UnmarshalKey or GetStringMap*, are
+// only read from the file.
+func loadConfig(read func() error) error {
 	viper.SetEnvPrefix("headscale")
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
@@ -197,6 +467,15 @@ func LoadConfig(path string, isFile bool) error {
 	viper.SetDefault("tls_letsencrypt_cache_dir", "/var/www/.cache")
 	viper.SetDefault("tls_letsencrypt_challenge_type", HTTP01ChallengeType)
 
+	viper.SetDefault("acme.provider", ACMEProviderLetsEncrypt)
+	viper.SetDefault("acme.domain", "")
+	viper.SetDefault("acme.email", "")
+	viper.SetDefault("acme.dns_challenge_provider", "")
+	viper.SetDefault("acme.data_dir", "/var/lib/headscale/acme")
+	viper.SetDefault("acme.renew_before", "720h")
+	viper.SetDefault("acme.dns_resolvers", []string{})
+	viper.SetDefault("acme.disable_propagation_check", false)
+
 	viper.SetDefault("log.level", "info")
 	viper.SetDefault("log.format", TextLogFormat)
 
@@ -206,6 +485,7 @@ func LoadConfig(path string, isFile bool) error {
 	viper.SetDefault("derp.server.enabled", false)
 	viper.SetDefault("derp.server.stun.enabled", true)
 	viper.SetDefault("derp.server.automatically_add_embedded_derp_region", true)
+	viper.SetDefault("derp.watch_paths", true)
 
 	viper.SetDefault("unix_socket", "/var/run/headscale/headscale.sock")
 	viper.SetDefault("unix_socket_permission", "0o770")
@@ -216,35 +496,73 @@ func LoadConfig(path string, isFile bool) error {
 	viper.SetDefault("cli.timeout", "5s")
 	viper.SetDefault("cli.insecure", false)
 
+	viper.SetDefault("database.max_open_connections", 10)
+	viper.SetDefault("database.max_idle_connections", 10)
+	viper.SetDefault("database.conn_max_lifetime", "0s")
+	viper.SetDefault("database.peer_cache_ttl", "10s")
+
+	// The pool settings of the postgres and mysql blocks take
+	// precedence over the database wide ones when set.
 	viper.SetDefault("database.postgres.ssl", false)
-	viper.SetDefault("database.postgres.max_open_conns", 10)
-	viper.SetDefault("database.postgres.max_idle_conns", 10)
+	viper.SetDefault("database.postgres.max_open_conns", 0)
+	viper.SetDefault("database.postgres.max_idle_conns", 0)
 	viper.SetDefault("database.postgres.conn_max_idle_time_secs", 3600)
 
+	viper.SetDefault("database.mysql.port", 3306)
+	viper.SetDefault("database.mysql.max_open_conns", 0)
+	viper.SetDefault("database.mysql.max_idle_conns", 0)
+	viper.SetDefault("database.mysql.conn_max_idle_time_secs", 3600)
+
 	viper.SetDefault("oidc.scope", []string{oidc.ScopeOpenID, "profile", "email"})
 	viper.SetDefault("oidc.strip_email_domain", true)
 	viper.SetDefault("oidc.only_start_if_oidc_is_available", true)
 	viper.SetDefault("oidc.expiry", "180d")
 	viper.SetDefault("oidc.use_expiry_from_token", false)
+	viper.SetDefault("oidc.claims.identity", "email")
+	viper.SetDefault("oidc.claims.username", "email")
+	viper.SetDefault("oidc.pkce.enabled", false)
 
 	viper.SetDefault("logtail.enabled", false)
 	viper.SetDefault("randomize_client_port", false)
 
 	viper.SetDefault("ephemeral_node_inactivity_timeout", "120s")
+	viper.SetDefault("node_registration_timeout", "15m")
+	viper.SetDefault("route_failover.timeout", "120s")
+	viper.SetDefault("map_keepalive_interval", DefaultMapKeepAliveInterval)
+	viper.SetDefault("gc.stale_node_expiry", "0")
+	viper.SetDefault("stats.retention", "7d")
+	viper.SetDefault("api_key_rotation.enabled", false)
+	viper.SetDefault("api_key_rotation.before_expiry", "7d")
+	viper.SetDefault("api_key_rotation.expiration", "90d")
+	viper.SetDefault("api_key_rotation.webhook_timeout", "5s")
+	viper.SetDefault("ratelimit.register_per_minute", 0)
+	viper.SetDefault("ratelimit.map_per_minute", 0)
+	viper.SetDefault("ratelimit.trusted_proxies", []string{})
+
+	viper.SetDefault("registration_webhook_timeout", "5s")
+	viper.SetDefault("registration_webhook_fail_open", false)
+
+	viper.SetDefault("online_status_webhook.timeout", "5s")
+	viper.SetDefault("online_status_webhook.debounce", "30s")
+
+	viper.SetDefault("http_compression.enabled", true)
+	viper.SetDefault("http_compression.min_size", 1024)
 
 	viper.SetDefault("tuning.batch_change_delay", "800ms")
 	viper.SetDefault("tuning.node_mapsession_buffered_chan_size", 30)
 
 	viper.SetDefault("prefixes.allocation", string(IPAllocationStrategySequential))
+	viper.SetDefault("prefixes.per_node_prefix_len", 32)
+
+	viper.SetDefault("policy.mode", string(PolicyModeFile))
+	viper.SetDefault("default_policy", string(DefaultPolicyAllowAll))
 
 	if IsCLIConfigured() {
 		return nil
 	}
 
-	if err := viper.ReadInConfig(); err != nil {
-		log.Warn().Err(err).Msg("Failed to read configuration from disk")
-
-		return fmt.Errorf("fatal error reading config file: %w", err)
+	if err := read(); err != nil {
+		return err
 	}
 
 	// Collect any validation errors and return them all at once
@@ -254,7 +572,7 @@ func LoadConfig(path string, isFile bool) error {
 		errorText += "Fatal config error: set either tls_letsencrypt_hostname or tls_cert_path/tls_key_path, not both\n"
 	}
 
-	if !viper.IsSet("noise") || viper.GetString("noise.private_key_path") == "" {
+	if viper.GetString("noise.private_key_path") == "" {
 		errorText += "Fatal config error: headscale now requires a new `noise.private_key_path` field in the config file for the Tailscale v2 protocol\n"
 	}
 
@@ -271,19 +589,196 @@ func LoadConfig(path string, isFile bool) error {
 		errorText += "Fatal config error: the only supported values for tls_letsencrypt_challenge_type are HTTP-01 and TLS-ALPN-01\n"
 	}
 
+	if viper.GetString("acme.domain") != "" {
+		if viper.GetString("acme.provider") != ACMEProviderLetsEncrypt {
+			errorText += fmt.Sprintf(
+				"Fatal config error: acme.provider (%s) is not supported, the only supported value is %s\n",
+				viper.GetString("acme.provider"),
+				ACMEProviderLetsEncrypt,
+			)
+		}
+
+		if viper.GetString("acme.dns_challenge_provider") == "" {
+			errorText += "Fatal config error: acme.dns_challenge_provider is required when acme.domain is set\n"
+		}
+
+		if viper.GetString("tls_letsencrypt_hostname") != "" ||
+			viper.GetString("tls_cert_path") != "" || viper.GetString("tls_key_path") != "" {
+			errorText += "Fatal config error: set either acme.domain, tls_letsencrypt_hostname or tls_cert_path/tls_key_path, not several\n"
+		}
+	}
+
 	if !strings.HasPrefix(viper.GetString("server_url"), "http://") &&
 		!strings.HasPrefix(viper.GetString("server_url"), "https://") {
 		errorText += "Fatal config error: server_url must start with https:// or http://\n"
+	} else if err := validateServerURL(viper.GetString("server_url")); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: server_url: %s\n", err)
+	}
+
+	if viper.GetBool("dns_config.magic_dns") {
+		baseDomain := viper.GetString("dns_config.base_domain")
+		if err := validateBaseDomain(viper.GetString("server_url"), baseDomain); err != nil {
+			errorText += fmt.Sprintf("Fatal config error: dns_config.base_domain: %s\n", err)
+		}
+
+		if baseDomain != "" && viper.GetString("tls_letsencrypt_hostname") != "" {
+			// Let's Encrypt only issues wildcard certificates with the
+			// DNS-01 challenge, the certificate only covers the hostname.
+			log.Warn().
+				Str("base_domain", baseDomain).
+				Msgf(
+					"Warning: the certificate of tls_letsencrypt_hostname only covers %s, a wildcard certificate for *.%s cannot be obtained with %s, the MagicDNS names are not covered",
+					viper.GetString("tls_letsencrypt_hostname"),
+					baseDomain,
+					viper.GetString("tls_letsencrypt_challenge_type"),
+				)
+		}
+	}
+
+	keepAliveInterval := viper.GetDuration("map_keepalive_interval")
+	if keepAliveInterval < MinMapKeepAliveInterval || keepAliveInterval > MaxMapKeepAliveInterval {
+		errorText += fmt.Sprintf(
+			"Fatal config error: map_keepalive_interval (%s) must be between %s and %s\n",
+			viper.GetString("map_keepalive_interval"),
+			MinMapKeepAliveInterval,
+			MaxMapKeepAliveInterval,
+		)
+	}
+
+	minClientVersion := viper.GetString("min_client_version")
+	if minClientVersion != "" && !versionRegexp.MatchString(minClientVersion) {
+		errorText += fmt.Sprintf(
+			"Fatal config error: min_client_version (%s) must be a version number like 1.32.0\n",
+			minClientVersion,
+		)
+	}
+
+	maxOpen, maxIdle := databaseConnections(viper.GetString("database.type"))
+	if maxOpen < 0 || maxIdle < 0 {
+		errorText += "Fatal config error: database.max_open_connections and database.max_idle_connections must not be negative\n"
+	} else if maxOpen != 0 && maxIdle > maxOpen {
+		errorText += fmt.Sprintf(
+			"Fatal config error: database.max_idle_connections (%d) must not be greater than database.max_open_connections (%d)\n",
+			maxIdle,
+			maxOpen,
+		)
+	}
+
+	if viper.GetDuration("database.conn_max_lifetime") < 0 {
+		errorText += fmt.Sprintf(
+			"Fatal config error: database.conn_max_lifetime (%s) must not be negative\n",
+			viper.GetString("database.conn_max_lifetime"),
+		)
 	}
 
-	// Minimum inactivity time out is keepalive timeout (60s) plus a few seconds
-	// to avoid races
-	minInactivityTimeout, _ := time.ParseDuration("65s")
-	if viper.GetDuration("ephemeral_node_inactivity_timeout") <= minInactivityTimeout {
+	if viper.GetDuration("database.peer_cache_ttl") < 0 {
 		errorText += fmt.Sprintf(
-			"Fatal config error: ephemeral_node_inactivity_timeout (%s) is set too low, must be more than %s",
+			"Fatal config error: database.peer_cache_ttl (%s) must not be negative\n",
+			viper.GetString("database.peer_cache_ttl"),
+		)
+	}
+
+	if viper.GetDuration("ephemeral_node_inactivity_timeout") < MinEphemeralNodeInactivityTimeout {
+		errorText += fmt.Sprintf(
+			"Fatal config error: ephemeral_node_inactivity_timeout (%s) is set too low, must be at least %s\n",
 			viper.GetString("ephemeral_node_inactivity_timeout"),
-			minInactivityTimeout,
+			MinEphemeralNodeInactivityTimeout,
+		)
+	}
+
+	// Nodes send a heartbeat with every keep alive, a lower
+	// timeout would fail over routes of healthy nodes. A few seconds
+	// are added to avoid races.
+	minFailoverTimeout := keepAliveInterval + 5*time.Second
+	if timeout := viper.GetDuration("route_failover.timeout"); timeout != 0 && timeout <= minFailoverTimeout {
+		errorText += fmt.Sprintf(
+			"Fatal config error: route_failover.timeout (%s) is set too low, must be 0 or more than %s\n",
+			viper.GetString("route_failover.timeout"),
+			minFailoverTimeout,
+		)
+	}
+
+	if _, err := model.ParseDuration(viper.GetString("gc.stale_node_expiry")); err != nil {
+		errorText += fmt.Sprintf(
+			"Fatal config error: gc.stale_node_expiry (%s) must be a duration like 90d: %s\n",
+			viper.GetString("gc.stale_node_expiry"),
+			err,
+		)
+	}
+
+	if retention, err := model.ParseDuration(viper.GetString("stats.retention")); err != nil || retention <= 0 {
+		errorText += fmt.Sprintf(
+			"Fatal config error: stats.retention (%s) must be a positive duration like 7d\n",
+			viper.GetString("stats.retention"),
+		)
+	}
+
+	if viper.GetBool("api_key_rotation.enabled") {
+		for _, key := range []string{"api_key_rotation.before_expiry", "api_key_rotation.expiration"} {
+			if duration, err := model.ParseDuration(viper.GetString(key)); err != nil || duration <= 0 {
+				errorText += fmt.Sprintf(
+					"Fatal config error: %s (%s) must be a positive duration like 7d\n",
+					key,
+					viper.GetString(key),
+				)
+			}
+		}
+
+		if viper.GetString("api_key_rotation.directory") == "" &&
+			viper.GetString("api_key_rotation.webhook_url") == "" {
+			errorText += "Fatal config error: api_key_rotation requires a directory or a webhook_url to deliver the new keys to\n"
+		}
+	}
+
+	for _, key := range []string{"ratelimit.register_per_minute", "ratelimit.map_per_minute"} {
+		if viper.GetInt(key) < 0 {
+			errorText += fmt.Sprintf(
+				"Fatal config error: %s (%d) must be 0 or more\n",
+				key,
+				viper.GetInt(key),
+			)
+		}
+	}
+
+	switch PolicyMode(viper.GetString("policy.mode")) {
+	case PolicyModeFile:
+	case PolicyModeDB:
+		if viper.GetString("acl_policy_path") != "" {
+			errorText += "Fatal config error: acl_policy_path cannot be set when policy.mode is database\n"
+		}
+	default:
+		errorText += fmt.Sprintf(
+			"Fatal config error: policy.mode (%s) must be %s or %s\n",
+			viper.GetString("policy.mode"),
+			PolicyModeFile,
+			PolicyModeDB,
+		)
+	}
+
+	switch viper.GetString("default_policy") {
+	case string(DefaultPolicyAllowAll), string(DefaultPolicyUserIsolated), defaultPolicyNamespaceIsolated:
+	default:
+		errorText += fmt.Sprintf(
+			"Fatal config error: default_policy (%s) must be %s or %s\n",
+			viper.GetString("default_policy"),
+			DefaultPolicyAllowAll,
+			DefaultPolicyUserIsolated,
+		)
+	}
+
+	for _, tag := range viper.GetStringSlice("default_policy_shared_tags") {
+		if !strings.HasPrefix(tag, "tag:") {
+			errorText += fmt.Sprintf(
+				"Fatal config error: default_policy_shared_tags (%s) must begin with 'tag:'\n",
+				tag,
+			)
+		}
+	}
+
+	if viper.GetDuration("node_registration_timeout") <= 0 {
+		errorText += fmt.Sprintf(
+			"Fatal config error: node_registration_timeout (%s) must be a positive duration\n",
+			viper.GetString("node_registration_timeout"),
 		)
 	}
 
@@ -295,6 +790,55 @@ func LoadConfig(path string, isFile bool) error {
 	}
 }
 
+// validateServerURL checks that serverURL is an absolute URL with a host.
+// All the URLs given to the clients and the browsers are derived from it,
+// never from the Host header of the requests, which a reverse proxy may
+// have rewritten to an internal address.
+func validateServerURL(serverURL string) error {
+	parsed, err := url.Parse(serverURL)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidServerURL, err)
+	}
+
+	if parsed.Host == "" {
+		return fmt.Errorf("%w: %q has no host", errInvalidServerURL, serverURL)
+	}
+
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		return fmt.Errorf("%w: %q must not have a query or a fragment", errInvalidServerURL, serverURL)
+	}
+
+	return nil
+}
+
+// validateBaseDomain checks that the host of serverURL is not baseDomain
+// or one of its subdomains. MagicDNS answers for the names in baseDomain,
+// the nodes would no longer reach headscale once connected.
+func validateBaseDomain(serverURL, baseDomain string) error {
+	parsed, err := url.Parse(serverURL)
+	if err != nil {
+		// Reported by validateServerURL.
+		return nil
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+	baseDomain = strings.ToLower(strings.TrimSuffix(baseDomain, "."))
+	if host == "" || baseDomain == "" {
+		return nil
+	}
+
+	if host == baseDomain || strings.HasSuffix(host, "."+baseDomain) {
+		return fmt.Errorf(
+			"%w: the host of %q would be resolved by MagicDNS in %q, use a base_domain the host is not part of, like tailnet.example.com for headscale.example.com",
+			errServerURLInBaseDomain,
+			serverURL,
+			baseDomain,
+		)
+	}
+
+	return nil
+}
+
 func GetTLSConfig() TLSConfig {
 	return TLSConfig{
 		LetsEncrypt: LetsEncryptConfig{
@@ -305,6 +849,19 @@ func GetTLSConfig() TLSConfig {
 			),
 			ChallengeType: viper.GetString("tls_letsencrypt_challenge_type"),
 		},
+		ACME: ACMEConfig{
+			Provider:             viper.GetString("acme.provider"),
+			DirectoryURL:         viper.GetString("acme_url"),
+			Domain:               viper.GetString("acme.domain"),
+			Email:                viper.GetString("acme.email"),
+			DNSChallengeProvider: viper.GetString("acme.dns_challenge_provider"),
+			DataDir: util.AbsolutePathFromConfigPath(
+				viper.GetString("acme.data_dir"),
+			),
+			RenewBefore:             viper.GetDuration("acme.renew_before"),
+			DNSResolvers:            viper.GetStringSlice("acme.dns_resolvers"),
+			DisablePropagationCheck: viper.GetBool("acme.disable_propagation_check"),
+		},
 		CertPath: util.AbsolutePathFromConfigPath(
 			viper.GetString("tls_cert_path"),
 		),
@@ -357,6 +914,7 @@ func GetDERPConfig() DERPConfig {
 
 	autoUpdate := viper.GetBool("derp.auto_update_enabled")
 	updateFrequency := viper.GetDuration("derp.update_frequency")
+	watchPaths := viper.GetBool("derp.watch_paths")
 
 	return DERPConfig{
 		ServerEnabled:                      serverEnabled,
@@ -369,6 +927,7 @@ func GetDERPConfig() DERPConfig {
 		Paths:                              paths,
 		AutoUpdate:                         autoUpdate,
 		UpdateFrequency:                    updateFrequency,
+		WatchPaths:                         watchPaths,
 		IPv4:                               ipv4,
 		IPv6:                               ipv6,
 		AutomaticallyAddEmbeddedDerpRegion: automaticallyAddEmbeddedDerpRegion,
@@ -386,8 +945,16 @@ func GetLogTailConfig() LogTailConfig {
 func GetACLConfig() ACLConfig {
 	policyPath := viper.GetString("acl_policy_path")
 
+	defaultPolicy := DefaultPolicy(viper.GetString("default_policy"))
+	if defaultPolicy == defaultPolicyNamespaceIsolated {
+		defaultPolicy = DefaultPolicyUserIsolated
+	}
+
 	return ACLConfig{
-		PolicyPath: policyPath,
+		PolicyMode:    PolicyMode(viper.GetString("policy.mode")),
+		PolicyPath:    policyPath,
+		DefaultPolicy: defaultPolicy,
+		SharedTags:    viper.GetStringSlice("default_policy_shared_tags"),
 	}
 }
 
@@ -419,24 +986,72 @@ func GetLogConfig() LogConfig {
 	}
 }
 
+func GetPosturePolicyConfig() (PosturePolicyConfig, error) {
+	var rules []PostureRule
+	if err := viper.UnmarshalKey("posture_policy.rules", &rules); err != nil {
+		return PosturePolicyConfig{}, fmt.Errorf("failed to parse posture_policy.rules: %w", err)
+	}
+
+	for _, rule := range rules {
+		if rule.MinVersion != "" && !versionRegexp.MatchString(rule.MinVersion) {
+			return PosturePolicyConfig{}, fmt.Errorf("%w: %q", errInvalidPostureVersion, rule.MinVersion)
+		}
+
+		for _, tag := range rule.RequiredTags {
+			if !strings.HasPrefix(tag, "tag:") {
+				return PosturePolicyConfig{}, fmt.Errorf("%w: %q does not begin with 'tag:'", errInvalidPostureTag, tag)
+			}
+		}
+	}
+
+	return PosturePolicyConfig{Rules: rules}, nil
+}
+
+// databaseConnections returns the maximum number of open and idle
+// connections for the database type. The settings of the postgres and
+// mysql blocks take precedence over the database wide ones.
+func databaseConnections(dbType string) (int, int) {
+	maxOpen := viper.GetInt("database.max_open_connections")
+	maxIdle := viper.GetInt("database.max_idle_connections")
+
+	switch dbType {
+	case DatabasePostgres, DatabaseMysql:
+		if backendMaxOpen := viper.GetInt("database." + dbType + ".max_open_conns"); backendMaxOpen != 0 {
+			maxOpen = backendMaxOpen
+		}
+
+		if backendMaxIdle := viper.GetInt("database." + dbType + ".max_idle_conns"); backendMaxIdle != 0 {
+			maxIdle = backendMaxIdle
+		}
+	}
+
+	return maxOpen, maxIdle
+}
+
 func GetDatabaseConfig() DatabaseConfig {
 	debug := viper.GetBool("database.debug")
 
 	type_ := viper.GetString("database.type")
 
 	switch type_ {
-	case DatabaseSqlite, DatabasePostgres:
+	case DatabaseSqlite, DatabasePostgres, DatabaseMysql:
 		break
 	case "sqlite":
 		type_ = "sqlite3"
 	default:
 		log.Fatal().
-			Msgf("invalid database type %q, must be sqlite, sqlite3 or postgres", type_)
+			Msgf("invalid database type %q, must be sqlite, sqlite3, postgres or mysql", type_)
 	}
 
+	maxOpen, maxIdle := databaseConnections(type_)
+
 	return DatabaseConfig{
-		Type:  type_,
-		Debug: debug,
+		Type:               type_,
+		Debug:              debug,
+		MaxOpenConnections: maxOpen,
+		MaxIdleConnections: maxIdle,
+		ConnMaxLifetime:    viper.GetDuration("database.conn_max_lifetime"),
+		PeerCacheTTL:       viper.GetDuration("database.peer_cache_ttl"),
 		Sqlite: SqliteConfig{
 			Path: util.AbsolutePathFromConfigPath(
 				viper.GetString("database.sqlite.path"),
@@ -449,12 +1064,24 @@ func GetDatabaseConfig() DatabaseConfig {
 			User:               viper.GetString("database.postgres.user"),
 			Pass:               viper.GetString("database.postgres.pass"),
 			Ssl:                viper.GetString("database.postgres.ssl"),
-			MaxOpenConnections: viper.GetInt("database.postgres.max_open_conns"),
-			MaxIdleConnections: viper.GetInt("database.postgres.max_idle_conns"),
+			MaxOpenConnections: maxOpen,
+			MaxIdleConnections: maxIdle,
 			ConnMaxIdleTimeSecs: viper.GetInt(
 				"database.postgres.conn_max_idle_time_secs",
 			),
 		},
+		Mysql: MysqlConfig{
+			Host:               viper.GetString("database.mysql.host"),
+			Port:               viper.GetInt("database.mysql.port"),
+			Name:               viper.GetString("database.mysql.name"),
+			User:               viper.GetString("database.mysql.user"),
+			Pass:               viper.GetString("database.mysql.pass"),
+			MaxOpenConnections: maxOpen,
+			MaxIdleConnections: maxIdle,
+			ConnMaxIdleTimeSecs: viper.GetInt(
+				"database.mysql.conn_max_idle_time_secs",
+			),
+		},
 	}
 }
 
@@ -577,6 +1204,27 @@ func GetDNSConfig() (*tailcfg.DNSConfig, string) {
 	return nil, ""
 }
 
+// rateLimitTrustedProxies parses ratelimit.trusted_proxies, a list of
+// prefixes or of single IPs.
+func rateLimitTrustedProxies() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, str := range viper.GetStringSlice("ratelimit.trusted_proxies") {
+		if addr, err := netip.ParseAddr(str); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(str)
+		if err != nil {
+			return nil, fmt.Errorf("parsing ratelimit.trusted_proxies from config: %w", err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
 func PrefixV4() (*netip.Prefix, error) {
 	prefixV4Str := viper.GetString("prefixes.v4")
 
@@ -628,6 +1276,33 @@ func PrefixV6() (*netip.Prefix, error) {
 	return &prefixV6, nil
 }
 
+// PerNodePrefixLen returns the length of the IPv4 prefix allocated to
+// every node, 32 for a single address. The IPv4 prefix must hold at
+// least four blocks, the first and the last one hold its network and
+// broadcast addresses.
+func PerNodePrefixLen(prefix4 *netip.Prefix) (int, error) {
+	bits := viper.GetInt("prefixes.per_node_prefix_len")
+	if bits == 32 {
+		return bits, nil
+	}
+
+	if prefix4 == nil {
+		return 0, fmt.Errorf("%w: /%d blocks need prefixes.v4", errInvalidPerNodePrefixLen, bits)
+	}
+
+	if bits < prefix4.Bits()+2 || bits > 32 {
+		return 0, fmt.Errorf(
+			"%w: /%d blocks do not fit in %s, the length must be between %d and 32",
+			errInvalidPerNodePrefixLen,
+			bits,
+			prefix4,
+			prefix4.Bits()+2,
+		)
+	}
+
+	return bits, nil
+}
+
 func GetHeadscaleConfig() (*Config, error) {
 	if IsCLIConfigured() {
 		return &Config{
@@ -650,6 +1325,11 @@ func GetHeadscaleConfig() (*Config, error) {
 		return nil, err
 	}
 
+	perNodePrefixLen, err := PerNodePrefixLen(prefix4)
+	if err != nil {
+		return nil, err
+	}
+
 	allocStr := viper.GetString("prefixes.allocation")
 	var alloc IPAllocationStrategy
 	switch allocStr {
@@ -661,6 +1341,11 @@ func GetHeadscaleConfig() (*Config, error) {
 		log.Fatal().Msgf("config error, prefixes.allocation is set to %s, which is not a valid strategy, allowed options: %s, %s", allocStr, IPAllocationStrategySequential, IPAllocationStrategyRandom)
 	}
 
+	trustedProxies, err := rateLimitTrustedProxies()
+	if err != nil {
+		return nil, err
+	}
+
 	dnsConfig, baseDomain := GetDNSConfig()
 	derpConfig := GetDERPConfig()
 	logConfig := GetLogTailConfig()
@@ -679,17 +1364,23 @@ func GetHeadscaleConfig() (*Config, error) {
 		oidcClientSecret = strings.TrimSpace(string(secretBytes))
 	}
 
+	posturePolicy, err := GetPosturePolicyConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	return &Config{
-		ServerURL:          viper.GetString("server_url"),
+		ServerURL:          strings.TrimSuffix(viper.GetString("server_url"), "/"),
 		Addr:               viper.GetString("listen_addr"),
 		MetricsAddr:        viper.GetString("metrics_listen_addr"),
 		GRPCAddr:           viper.GetString("grpc_listen_addr"),
 		GRPCAllowInsecure:  viper.GetBool("grpc_allow_insecure"),
 		DisableUpdateCheck: viper.GetBool("disable_check_updates"),
 
-		PrefixV4:     prefix4,
-		PrefixV6:     prefix6,
-		IPAllocation: IPAllocationStrategy(alloc),
+		PrefixV4:         prefix4,
+		PrefixV6:         prefix6,
+		IPAllocation:     IPAllocationStrategy(alloc),
+		PerNodePrefixLen: perNodePrefixLen,
 
 		NoisePrivateKeyPath: util.AbsolutePathFromConfigPath(
 			viper.GetString("noise.private_key_path"),
@@ -701,6 +1392,83 @@ func GetHeadscaleConfig() (*Config, error) {
 		EphemeralNodeInactivityTimeout: viper.GetDuration(
 			"ephemeral_node_inactivity_timeout",
 		),
+		NodeRegistrationTimeout: viper.GetDuration(
+			"node_registration_timeout",
+		),
+		RouteFailoverTimeout: viper.GetDuration(
+			"route_failover.timeout",
+		),
+		MapKeepAliveInterval: viper.GetDuration(
+			"map_keepalive_interval",
+		),
+		MinClientVersion: viper.GetString("min_client_version"),
+
+		RegistrationWebhook: RegistrationWebhookConfig{
+			URL:      viper.GetString("registration_webhook_url"),
+			Timeout:  viper.GetDuration("registration_webhook_timeout"),
+			FailOpen: viper.GetBool("registration_webhook_fail_open"),
+		},
+
+		OnlineStatusWebhook: OnlineStatusWebhookConfig{
+			URL:      viper.GetString("online_status_webhook.url"),
+			Timeout:  viper.GetDuration("online_status_webhook.timeout"),
+			Debounce: viper.GetDuration("online_status_webhook.debounce"),
+		},
+
+		HTTPCompression: HTTPCompressionConfig{
+			Enabled: viper.GetBool("http_compression.enabled"),
+			MinSize: viper.GetInt("http_compression.min_size"),
+		},
+
+		PosturePolicy: posturePolicy,
+
+		GC: GCConfig{
+			StaleNodeExpiry: func() time.Duration {
+				// Validated in LoadConfig.
+				expiry, _ := model.ParseDuration(viper.GetString("gc.stale_node_expiry"))
+
+				return time.Duration(expiry)
+			}(),
+		},
+
+		APIKeyRotation: APIKeyRotationConfig{
+			Enabled: viper.GetBool("api_key_rotation.enabled"),
+			// Validated in LoadConfig when enabled.
+			BeforeExpiry: func() time.Duration {
+				before, _ := model.ParseDuration(viper.GetString("api_key_rotation.before_expiry"))
+
+				return time.Duration(before)
+			}(),
+			Expiration: func() time.Duration {
+				expiration, _ := model.ParseDuration(viper.GetString("api_key_rotation.expiration"))
+
+				return time.Duration(expiration)
+			}(),
+			Directory: util.AbsolutePathFromConfigPath(
+				viper.GetString("api_key_rotation.directory"),
+			),
+			WebhookURL:     viper.GetString("api_key_rotation.webhook_url"),
+			WebhookTimeout: viper.GetDuration("api_key_rotation.webhook_timeout"),
+		},
+
+		RateLimit: RateLimitConfig{
+			RegisterPerMinute: viper.GetInt("ratelimit.register_per_minute"),
+			MapPerMinute:      viper.GetInt("ratelimit.map_per_minute"),
+			TrustedProxies:    trustedProxies,
+		},
+
+		Stats: StatsConfig{
+			Retention: func() time.Duration {
+				// Validated in LoadConfig.
+				retention, _ := model.ParseDuration(viper.GetString("stats.retention"))
+
+				return time.Duration(retention)
+			}(),
+		},
+
+		Monitoring: MonitoringConfig{
+			SentryDSN: viper.GetString("monitoring.sentry_dsn"),
+		},
 
 		Database: GetDatabaseConfig(),
 
@@ -743,6 +1511,14 @@ func GetHeadscaleConfig() (*Config, error) {
 				}
 			}(),
 			UseExpiryFromToken: viper.GetBool("oidc.use_expiry_from_token"),
+			Claims: OIDCClaimsConfig{
+				Identity:    viper.GetString("oidc.claims.identity"),
+				Username:    viper.GetString("oidc.claims.username"),
+				DisplayName: viper.GetString("oidc.claims.display_name"),
+			},
+			PKCE: OIDCPKCEConfig{
+				Enabled: viper.GetBool("oidc.pkce.enabled"),
+			},
 		},
 
 		LogTail:             logConfig,
@@ -8,6 +8,8 @@ const (
 	TLSALPN01ChallengeType = "TLS-ALPN-01"
 	HTTP01ChallengeType    = "HTTP-01"
 
+	ACMEProviderLetsEncrypt = "letsencrypt"
+
 	JSONLogFormat = "json"
 	TextLogFormat = "text"
 
@@ -0,0 +1,111 @@
+package types
+
+import (
+	"errors"
+	"maps"
+)
+
+// ErrorCode identifies the kind of a HeadscaleError for API clients.
+type ErrorCode string
+
+const (
+	CodeInternal           ErrorCode = "INTERNAL"
+	CodeInvalidArgument    ErrorCode = "INVALID_ARGUMENT"
+	CodeNotFound           ErrorCode = "NOT_FOUND"
+	CodeAlreadyExists      ErrorCode = "ALREADY_EXISTS"
+	CodeFailedPrecondition ErrorCode = "FAILED_PRECONDITION"
+	CodePermissionDenied   ErrorCode = "PERMISSION_DENIED"
+	CodeUnauthenticated    ErrorCode = "UNAUTHENTICATED"
+	CodeUnavailable        ErrorCode = "UNAVAILABLE"
+	CodeUnimplemented      ErrorCode = "UNIMPLEMENTED"
+	CodeDeadlineExceeded   ErrorCode = "DEADLINE_EXCEEDED"
+	CodeCanceled           ErrorCode = "CANCELED"
+	CodeQuotaExceeded      ErrorCode = "QUOTA_EXCEEDED"
+
+	CodeNodeNotFound          ErrorCode = "NODE_NOT_FOUND"
+	CodeNodeNotRegistered     ErrorCode = "NODE_NOT_REGISTERED"
+	CodeRouteNotAvailable     ErrorCode = "ROUTE_NOT_AVAILABLE"
+	CodeUserNotFound          ErrorCode = "USER_NOT_FOUND"
+	CodeUserExists            ErrorCode = "USER_EXISTS"
+	CodeUserNotEmpty          ErrorCode = "USER_NOT_EMPTY"
+	CodeUserDisabled          ErrorCode = "USER_DISABLED"
+	CodeUserMismatch          ErrorCode = "USER_MISMATCH"
+	CodeKeyNotFound           ErrorCode = "KEY_NOT_FOUND"
+	CodeKeyExpired            ErrorCode = "KEY_EXPIRED"
+	CodeKeyUsed               ErrorCode = "KEY_USED"
+	CodeKeyInvalid            ErrorCode = "KEY_INVALID"
+	CodeInvalidTag            ErrorCode = "INVALID_TAG"
+	CodeNodeGroupNotFound     ErrorCode = "NODE_GROUP_NOT_FOUND"
+	CodeNodeGroupExists       ErrorCode = "NODE_GROUP_EXISTS"
+	CodeNodeGroupMemberExists ErrorCode = "NODE_GROUP_MEMBER_EXISTS"
+	CodeInvalidNodeGroupName  ErrorCode = "INVALID_NODE_GROUP_NAME"
+	CodeIPExhausted           ErrorCode = "IP_EXHAUSTED"
+	CodeIPNotInPrefix         ErrorCode = "IP_NOT_IN_PREFIX"
+	CodeIPAlreadyAllocated    ErrorCode = "IP_ALREADY_ALLOCATED"
+	CodeStateNotEmpty         ErrorCode = "STATE_NOT_EMPTY"
+	CodeStateVersionMismatch  ErrorCode = "STATE_VERSION_MISMATCH"
+	CodePolicyNotFound        ErrorCode = "POLICY_NOT_FOUND"
+	CodeNodeLocked            ErrorCode = "NODE_LOCKED"
+	CodeUserMergeConflict     ErrorCode = "USER_MERGE_CONFLICT"
+)
+
+// ErrQuotaExceeded is returned when a client is over a rate limit.
+var ErrQuotaExceeded = NewHeadscaleError(CodeQuotaExceeded, "too many requests")
+
+// HeadscaleError is an error with a code API clients can rely on, and
+// optional details about what caused it. It is serialised as
+// {"error": {"code": ..., "message": ..., "details": ...}} by the HTTP API.
+type HeadscaleError struct {
+	Code    ErrorCode              `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func NewHeadscaleError(code ErrorCode, message string) *HeadscaleError {
+	return &HeadscaleError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *HeadscaleError) Error() string {
+	return e.Message
+}
+
+// Is reports if target is the same error, so that errors.Is matches the
+// copies made by WithDetails.
+func (e *HeadscaleError) Is(target error) bool {
+	t, ok := target.(*HeadscaleError)
+	if !ok {
+		return false
+	}
+
+	return t.Code == e.Code && t.Message == e.Message
+}
+
+// WithDetails returns a copy of the error with the details added.
+func (e *HeadscaleError) WithDetails(details map[string]interface{}) *HeadscaleError {
+	withDetails := *e
+	withDetails.Details = maps.Clone(e.Details)
+	if withDetails.Details == nil {
+		withDetails.Details = make(map[string]interface{}, len(details))
+	}
+	maps.Copy(withDetails.Details, details)
+
+	return &withDetails
+}
+
+// ErrorCodeOf returns the code of the HeadscaleError wrapped in err, or
+// CodeInternal if there is none. It returns an empty code for nil.
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+
+	var hsErr *HeadscaleError
+	if errors.As(err, &hsErr) {
+		return hsErr.Code
+	}
+
+	return CodeInternal
+}
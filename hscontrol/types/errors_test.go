@@ -0,0 +1,39 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestHeadscaleError(t *testing.T) {
+	errNotFound := NewHeadscaleError(CodeNotFound, "thing not found")
+
+	withDetails := errNotFound.WithDetails(map[string]interface{}{"id": 1})
+	if !errors.Is(withDetails, errNotFound) {
+		t.Errorf("error with details does not match the original error")
+	}
+	if errNotFound.Details != nil {
+		t.Errorf("WithDetails modified the original error: %v", errNotFound.Details)
+	}
+
+	other := NewHeadscaleError(CodeNotFound, "other thing not found")
+	if errors.Is(other, errNotFound) {
+		t.Errorf("errors with different messages match")
+	}
+
+	tests := []struct {
+		err  error
+		want ErrorCode
+	}{
+		{err: nil, want: ""},
+		{err: errNotFound, want: CodeNotFound},
+		{err: fmt.Errorf("wrapped: %w", withDetails), want: CodeNotFound},
+		{err: errors.New("plain"), want: CodeInternal},
+	}
+	for _, tt := range tests {
+		if got := ErrorCodeOf(tt.err); got != tt.want {
+			t.Errorf("ErrorCodeOf(%v): want %q, got %q", tt.err, tt.want, got)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +17,8 @@ import (
 	"go4.org/netipx"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 )
@@ -25,6 +28,7 @@ var (
 	ErrHostnameTooLong      = errors.New("hostname too long, cannot except 255 ASCII chars")
 	ErrNodeHasNoGivenName   = errors.New("node has no given name")
 	ErrNodeUserHasNoName    = errors.New("node user has no name")
+	ErrNodeMetadataInvalid  = errors.New("failed to parse node metadata")
 )
 
 type NodeID uint64
@@ -120,8 +124,27 @@ type Node struct {
 	LastSeen *time.Time
 	Expiry   *time.Time
 
+	// PostureCheckedAt is the time of the last device posture check
+	// of the node, PostureError is why it failed, empty if it passed.
+	PostureCheckedAt *time.Time
+	PostureError     string
+
+	// Locked nodes cannot be changed or deleted with the API unless
+	// the change is forced, to protect critical nodes from mistakes.
+	Locked bool
+
+	// Metadata holds attributes managed outside headscale, like a site
+	// code or a rack, set with the API.
+	Metadata NodeMetadata
+
 	Routes []Route
 
+	// AllowedRoutes are the routes of its peers the node is limited to,
+	// DenyAllRoutes limits it to none. Without either, the node sees all
+	// the enabled routes of its peers.
+	AllowedRoutes []PerNodeRoute
+	DenyAllRoutes bool
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt *time.Time
@@ -133,6 +156,55 @@ type (
 	Nodes []*Node
 )
 
+// MaxNodeMetadataSize is the size of the largest metadata of a node, in
+// JSON.
+const MaxNodeMetadataSize = 4096
+
+// NodeMetadata is stored as a JSON object, JSONB on PostgreSQL.
+type NodeMetadata map[string]string
+
+func (m *NodeMetadata) Scan(destination interface{}) error {
+	switch value := destination.(type) {
+	case nil:
+		*m = nil
+
+		return nil
+
+	case []byte:
+		return json.Unmarshal(value, m)
+
+	case string:
+		return json.Unmarshal([]byte(value), m)
+
+	default:
+		return fmt.Errorf("%w: unexpected data type %T", ErrNodeMetadataInvalid, destination)
+	}
+}
+
+// Value return json value, implement driver.Valuer interface.
+func (m NodeMetadata) Value() (driver.Value, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+
+	bytes, err := json.Marshal(m)
+
+	return string(bytes), err
+}
+
+// GormDBDataType stores the metadata as JSONB on PostgreSQL, JSON on
+// MySQL and TEXT on SQLite.
+func (NodeMetadata) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	switch db.Dialector.Name() {
+	case DatabasePostgres:
+		return "JSONB"
+	case DatabaseMysql:
+		return "JSON"
+	default:
+		return "TEXT"
+	}
+}
+
 // IsExpired returns whether the node registration has expired.
 func (node Node) IsExpired() bool {
 	// If Expiry is not set, the client has not indicated that
@@ -151,6 +223,49 @@ func (node *Node) IsEphemeral() bool {
 	return node.AuthKey != nil && node.AuthKey.Ephemeral
 }
 
+// RequestTags returns the tags the node requested itself in its Hostinfo.
+// Nodes registered with a pre auth key scoped to tags only carry the tags
+// of the key, so their requested tags are ignored.
+func (node *Node) RequestTags() []string {
+	if node.Hostinfo == nil {
+		return nil
+	}
+
+	if node.AuthKey != nil && len(node.AuthKey.ACLTags) > 0 {
+		return nil
+	}
+
+	return node.Hostinfo.RequestTags
+}
+
+// LimitsRoutes returns whether the node only sees some of the routes of
+// its peers, or none.
+func (node *Node) LimitsRoutes() bool {
+	return node.DenyAllRoutes || len(node.AllowedRoutes) > 0
+}
+
+// AllowsRoute returns whether the node sees the route prefix of its
+// peers: if it is not limited, or if prefix is within one of its
+// allowed routes.
+func (node *Node) AllowsRoute(prefix netip.Prefix) bool {
+	if node.DenyAllRoutes {
+		return false
+	}
+
+	if len(node.AllowedRoutes) == 0 {
+		return true
+	}
+
+	for _, allowed := range node.AllowedRoutes {
+		allowedPrefix := netip.Prefix(allowed.Prefix)
+		if allowedPrefix.Bits() <= prefix.Bits() && allowedPrefix.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (node *Node) IPs() []netip.Addr {
 	var ret []netip.Addr
 
@@ -207,25 +322,28 @@ func (node *Node) AppendToIPSet(build *netipx.IPSetBuilder) {
 	}
 }
 
+// CanAccess reports whether a rule of filter allows traffic from node to
+// node2. The subnets routed by a node count as its addresses, traffic
+// from or to a subnet goes through its router, as well as the internet
+// for an exit node, so routers stay visible to the nodes using them.
 func (node *Node) CanAccess(filter []tailcfg.FilterRule, node2 *Node) bool {
+	return node.CanAccessMatches(matcher.MatchesFromFilterRules(filter), node2)
+}
+
+// CanAccessMatches is CanAccess with the matches of the filter rules,
+// built once to check many nodes.
+func (node *Node) CanAccessMatches(matches []matcher.Match, node2 *Node) bool {
 	src := node.IPs()
+	srcRoutes := node.routedIPSet()
 	allowedIPs := node2.IPs()
+	allowedRoutes := node2.routedIPSet()
 
-	for _, route := range node2.Routes {
-		if route.Enabled {
-			allowedIPs = append(allowedIPs, netip.Prefix(route.Prefix).Addr())
-		}
-	}
-
-	for _, rule := range filter {
-		// TODO(kradalby): Cache or pregen this
-		matcher := matcher.MatchFromFilterRule(rule)
-
-		if !matcher.SrcsContainsIPs(src) {
+	for _, matcher := range matches {
+		if !matcher.SrcsContainsIPs(src) && !matcher.SrcsOverlapsIPSet(srcRoutes) {
 			continue
 		}
 
-		if matcher.DestsContainsIP(allowedIPs) {
+		if matcher.DestsContainsIP(allowedIPs) || matcher.DestsOverlapsIPSet(allowedRoutes) {
 			return true
 		}
 	}
@@ -233,6 +351,36 @@ func (node *Node) CanAccess(filter []tailcfg.FilterRule, node2 *Node) bool {
 	return false
 }
 
+// routedIPSet returns the addresses of the enabled routes of the node,
+// without the addresses of the tailnet, which are never reached through
+// a route, so an exit node is not reachable just because a rule allows
+// traffic to another node. It returns nil if the node has no enabled
+// route.
+func (node *Node) routedIPSet() *netipx.IPSet {
+	var build netipx.IPSetBuilder
+	hasRoutes := false
+	for _, route := range node.Routes {
+		if route.Enabled {
+			build.AddPrefix(netip.Prefix(route.Prefix))
+			hasRoutes = true
+		}
+	}
+
+	if !hasRoutes {
+		return nil
+	}
+
+	build.RemovePrefix(tsaddr.CGNATRange())
+	build.RemovePrefix(tsaddr.TailscaleULARange())
+
+	set, err := build.IPSet()
+	if err != nil {
+		return nil
+	}
+
+	return set
+}
+
 func (nodes Nodes) FilterByIP(ip netip.Addr) Nodes {
 	var found Nodes
 
@@ -363,13 +511,18 @@ func (node *Node) Proto() *v1.Node {
 		GivenName:   node.GivenName,
 		User:        node.User.Proto(),
 		ForcedTags:  node.ForcedTags,
+		Locked:      node.Locked,
+		Metadata:    node.Metadata,
 
-		// TODO(kradalby): Implement register method enum converter
-		// RegisterMethod: ,
+		RegisterMethod: registerMethodProto(node.RegisterMethod),
 
 		CreatedAt: timestamppb.New(node.CreatedAt),
 	}
 
+	if node.Hostinfo != nil && node.Hostinfo.NetInfo != nil {
+		nodeProto.PreferredDerp = int32(node.Hostinfo.NetInfo.PreferredDERP)
+	}
+
 	if node.AuthKey != nil {
 		nodeProto.PreAuthKey = node.AuthKey.Proto()
 	}
@@ -382,9 +535,27 @@ func (node *Node) Proto() *v1.Node {
 		nodeProto.Expiry = timestamppb.New(*node.Expiry)
 	}
 
+	if node.PostureCheckedAt != nil {
+		nodeProto.PostureCheckedAt = timestamppb.New(*node.PostureCheckedAt)
+		nodeProto.PostureError = node.PostureError
+	}
+
 	return nodeProto
 }
 
+func registerMethodProto(method string) v1.RegisterMethod {
+	switch method {
+	case util.RegisterMethodAuthKey:
+		return v1.RegisterMethod_REGISTER_METHOD_AUTH_KEY
+	case util.RegisterMethodCLI:
+		return v1.RegisterMethod_REGISTER_METHOD_CLI
+	case util.RegisterMethodOIDC:
+		return v1.RegisterMethod_REGISTER_METHOD_OIDC
+	default:
+		return v1.RegisterMethod_REGISTER_METHOD_UNSPECIFIED
+	}
+}
+
 func (node *Node) GetFQDN(dnsConfig *tailcfg.DNSConfig, baseDomain string) (string, error) {
 	var hostname string
 	if dnsConfig != nil && dnsConfig.Proxied { // MagicDNS
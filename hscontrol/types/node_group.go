@@ -0,0 +1,45 @@
+package types
+
+import (
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// NodeGroup is the membership of a node in a group of the ACL policy,
+// managed with the API instead of the groups section of the policy file.
+type NodeGroup struct {
+	ID uint64 `gorm:"primary_key"`
+
+	// GroupName is the name of the group without the "group:" prefix.
+	// The size is needed for the unique index on MySQL, which
+	// cannot index TEXT columns.
+	GroupName string `gorm:"uniqueIndex:idx_node_groups_group_node;size:255"`
+
+	NodeID uint64 `gorm:"uniqueIndex:idx_node_groups_group_node"`
+	Node   Node
+
+	// UserID is the user of the node, kept in sync when the node is
+	// moved to another user.
+	UserID uint
+	User   User
+
+	CreatedAt *time.Time
+}
+
+func (group *NodeGroup) Proto() *v1.NodeGroup {
+	protoGroup := v1.NodeGroup{
+		Id:       group.ID,
+		Name:     group.GroupName,
+		NodeId:   group.NodeID,
+		NodeName: group.Node.GivenName,
+		User:     group.User.Proto(),
+	}
+
+	if group.CreatedAt != nil {
+		protoGroup.CreatedAt = timestamppb.New(*group.CreatedAt)
+	}
+
+	return &protoGroup
+}
@@ -0,0 +1,50 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PendingRegistration is a node waiting in the registration cache for
+// an interactive registration to be completed. It is stored in the
+// database so the registration survives a restart of headscale.
+type PendingRegistration struct {
+	// MachineKey is the key of the registration cache entry.
+	MachineKey string `gorm:"primaryKey;size:255"`
+
+	// NodeDatabaseField is the JSON representation of Node,
+	// it is _only_ used for reading and writing the node to the
+	// database and should not be used.
+	// Use Node instead.
+	NodeDatabaseField string `gorm:"column:node"`
+	Node              Node   `gorm:"-"`
+
+	// Expiry is when the registration cache entry expires.
+	Expiry time.Time
+}
+
+// BeforeSave is a hook that ensures that some values that
+// cannot be directly marshalled into database values are stored
+// correctly in the database.
+func (reg *PendingRegistration) BeforeSave(tx *gorm.DB) error {
+	node, err := json.Marshal(reg.Node)
+	if err != nil {
+		return fmt.Errorf("marshalling pending registration node to store in db: %w", err)
+	}
+	reg.NodeDatabaseField = string(node)
+
+	return nil
+}
+
+// AfterFind is a hook that ensures that Node is restored from
+// the JSON stored in the database.
+func (reg *PendingRegistration) AfterFind(tx *gorm.DB) error {
+	if err := json.Unmarshal([]byte(reg.NodeDatabaseField), &reg.Node); err != nil {
+		return fmt.Errorf("unmarshalling pending registration node from db: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,18 @@
+package types
+
+import (
+	"time"
+)
+
+// Policy is a version of the ACL policy stored in the database when
+// policy.mode is database. Every change adds a new version, the latest
+// one is in use.
+type Policy struct {
+	ID uint64 `gorm:"primary_key"`
+
+	// Data is the policy in the HuJSON format.
+	Data string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
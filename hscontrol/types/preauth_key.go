@@ -11,8 +11,12 @@ import (
 
 // PreAuthKey describes a pre-authorization key usable in a particular user.
 type PreAuthKey struct {
-	ID        uint64 `gorm:"primary_key"`
+	ID uint64 `gorm:"primary_key"`
+
+	// Key is only stored for keys created before keys were hashed,
+	// newer keys only store the Hash of their secret.
 	Key       string
+	Hash      []byte
 	UserID    uint
 	User      User
 	Reusable  bool
@@ -20,6 +24,15 @@ type PreAuthKey struct {
 	Used      bool `gorm:"default:false"`
 	ACLTags   []PreAuthKeyACLTag
 
+	// RequestedIP is the address given to the node registering with
+	// this key, instead of one allocated automatically.
+	RequestedIP string
+
+	// Prefix is the non-secret beginning of the key, kept so operators
+	// can tell which key a node used without looking at the secret.
+	// The size is needed for the index on MySQL.
+	Prefix string `gorm:"index;size:255"`
+
 	CreatedAt  *time.Time
 	Expiration *time.Time
 }
@@ -40,6 +53,8 @@ func (key *PreAuthKey) Proto() *v1.PreAuthKey {
 		Reusable:  key.Reusable,
 		Used:      key.Used,
 		AclTags:   make([]string, len(key.ACLTags)),
+		Ip:        key.RequestedIP,
+		KeyPrefix: key.Prefix,
 	}
 
 	if key.Expiration != nil {
@@ -3,6 +3,7 @@ package types
 import (
 	"fmt"
 	"net/netip"
+	"time"
 
 	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -26,10 +27,25 @@ type Route struct {
 	Advertised bool
 	Enabled    bool
 	IsPrimary  bool
+
+	// Disabled is set when the route is disabled by hand, the
+	// autoApprovers do not enable it again until it is enabled by hand.
+	Disabled bool
 }
 
 type Routes []Route
 
+// PerNodeRoute is a route a node is allowed to use, overriding the routes
+// it is given. A node with allowed routes only sees the routes of its
+// peers it is allowed to use, to split its tunnel from the others.
+type PerNodeRoute struct {
+	ID     uint64 `gorm:"primary_key"`
+	NodeID NodeID `gorm:"index"`
+	Prefix IPPrefix
+
+	CreatedAt time.Time
+}
+
 func (r *Route) String() string {
 	return fmt.Sprintf("%s:%s", r.Node.Hostname, netip.Prefix(r.Prefix).String())
 }
@@ -63,6 +79,23 @@ func (rs Routes) Primaries() Routes {
 	return res
 }
 
+// AllowedBy returns the routes the node viewer sees, the routes within
+// its allowed routes if it is limited to some.
+func (rs Routes) AllowedBy(viewer *Node) Routes {
+	if !viewer.LimitsRoutes() {
+		return rs
+	}
+
+	res := make(Routes, 0, len(rs))
+	for _, route := range rs {
+		if viewer.AllowsRoute(netip.Prefix(route.Prefix)) {
+			res = append(res, route)
+		}
+	}
+
+	return res
+}
+
 func (rs Routes) PrefixMap() map[IPPrefix][]Route {
 	res := map[IPPrefix][]Route{}
 
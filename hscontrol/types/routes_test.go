@@ -92,3 +92,72 @@ func TestPrefixMap(t *testing.T) {
 		})
 	}
 }
+
+func TestRoutesAllowedBy(t *testing.T) {
+	ipp := func(s string) IPPrefix { return IPPrefix(netip.MustParsePrefix(s)) }
+
+	routes := Routes{
+		{Prefix: ipp("10.0.0.0/24"), Enabled: true},
+		{Prefix: ipp("10.0.1.0/24"), Enabled: true},
+		{Prefix: ipp("0.0.0.0/0"), Enabled: true},
+	}
+
+	allowed := func(prefixes ...string) []PerNodeRoute {
+		routes := make([]PerNodeRoute, len(prefixes))
+		for index, prefix := range prefixes {
+			routes[index] = PerNodeRoute{Prefix: ipp(prefix)}
+		}
+
+		return routes
+	}
+
+	tests := []struct {
+		name   string
+		viewer *Node
+		want   []string
+	}{
+		{
+			name:   "no allowed routes",
+			viewer: &Node{},
+			want:   []string{"10.0.0.0/24", "10.0.1.0/24", "0.0.0.0/0"},
+		},
+		{
+			name:   "allowed routes take precedence",
+			viewer: &Node{AllowedRoutes: allowed("10.0.1.0/24")},
+			want:   []string{"10.0.1.0/24"},
+		},
+		{
+			name:   "allowed prefix covering the routes",
+			viewer: &Node{AllowedRoutes: allowed("10.0.0.0/8")},
+			want:   []string{"10.0.0.0/24", "10.0.1.0/24"},
+		},
+		{
+			name:   "allowed prefix within a route",
+			viewer: &Node{AllowedRoutes: allowed("10.0.0.0/25")},
+			want:   []string{},
+		},
+		{
+			name:   "exit route covering all the routes",
+			viewer: &Node{AllowedRoutes: allowed("0.0.0.0/0")},
+			want:   []string{"10.0.0.0/24", "10.0.1.0/24", "0.0.0.0/0"},
+		},
+		{
+			name:   "deny all",
+			viewer: &Node{DenyAllRoutes: true},
+			want:   []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, prefix := range routes.AllowedBy(tt.viewer).Prefixes() {
+				got = append(got, prefix.String())
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("AllowedBy() unexpected routes (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package types
+
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// StateVersion is the version of the State format written by export,
+// import refuses states of other versions.
+const StateVersion = 1
+
+// State is a dump of the users, nodes, pre auth keys, routes, node
+// groups, API keys and stored policies of headscale, independent of the
+// database engine. It is used to back up the server and to move it to
+// another database.
+type State struct {
+	Version       int                 `json:"version"`
+	ExportedAt    time.Time           `json:"exported_at"`
+	Users         []StateUser         `json:"users"`
+	Nodes         []StateNode         `json:"nodes"`
+	PreAuthKeys   []StatePreAuthKey   `json:"pre_auth_keys"`
+	Routes        []StateRoute        `json:"routes"`
+	PerNodeRoutes []StatePerNodeRoute `json:"per_node_routes,omitempty"`
+	NodeGroups    []StateNodeGroup    `json:"node_groups,omitempty"`
+	APIKeys       []StateAPIKey       `json:"api_keys,omitempty"`
+	Policies      []StatePolicy       `json:"policies,omitempty"`
+}
+
+type StateUser struct {
+	ID          uint      `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"display_name,omitempty"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	DefaultTags []string  `json:"default_tags,omitempty"`
+	Disabled    bool      `json:"disabled,omitempty"`
+	DERPOnly    bool      `json:"derp_only,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type StateNode struct {
+	ID             NodeID            `json:"id"`
+	MachineKey     key.MachinePublic `json:"machine_key"`
+	NodeKey        key.NodePublic    `json:"node_key"`
+	DiscoKey       key.DiscoPublic   `json:"disco_key"`
+	Endpoints      []netip.AddrPort  `json:"endpoints,omitempty"`
+	Hostinfo       *tailcfg.Hostinfo `json:"hostinfo,omitempty"`
+	IPv4           *netip.Addr       `json:"ipv4,omitempty"`
+	IPv6           *netip.Addr       `json:"ipv6,omitempty"`
+	Hostname       string            `json:"hostname"`
+	GivenName      string            `json:"given_name"`
+	UserID         uint              `json:"user_id"`
+	RegisterMethod string            `json:"register_method"`
+	ForcedTags     []string          `json:"forced_tags,omitempty"`
+	AuthKeyID      uint              `json:"auth_key_id,omitempty"`
+	LastSeen       *time.Time        `json:"last_seen,omitempty"`
+	Expiry         *time.Time        `json:"expiry,omitempty"`
+	Locked         bool              `json:"locked,omitempty"`
+	Metadata       NodeMetadata      `json:"metadata,omitempty"`
+	DenyAllRoutes  bool              `json:"deny_all_routes,omitempty"`
+
+	PostureCheckedAt *time.Time `json:"posture_checked_at,omitempty"`
+	PostureError     string     `json:"posture_error,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// StatePreAuthKey only contains the hash of the secret of the key,
+// except for legacy keys which were stored in full.
+type StatePreAuthKey struct {
+	ID          uint64     `json:"id"`
+	Prefix      string     `json:"prefix,omitempty"`
+	Key         string     `json:"key,omitempty"`
+	Hash        []byte     `json:"hash,omitempty"`
+	UserID      uint       `json:"user_id"`
+	Reusable    bool       `json:"reusable"`
+	Ephemeral   bool       `json:"ephemeral"`
+	Used        bool       `json:"used"`
+	ACLTags     []string   `json:"acl_tags,omitempty"`
+	RequestedIP string     `json:"requested_ip,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	Expiration  *time.Time `json:"expiration,omitempty"`
+}
+
+type StateRoute struct {
+	ID         uint         `json:"id"`
+	NodeID     uint64       `json:"node_id"`
+	Prefix     netip.Prefix `json:"prefix"`
+	Advertised bool         `json:"advertised"`
+	Enabled    bool         `json:"enabled"`
+	IsPrimary  bool         `json:"is_primary"`
+	Disabled   bool         `json:"disabled,omitempty"`
+}
+
+type StatePerNodeRoute struct {
+	ID        uint64       `json:"id"`
+	NodeID    NodeID       `json:"node_id"`
+	Prefix    netip.Prefix `json:"prefix"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type StateNodeGroup struct {
+	ID        uint64     `json:"id"`
+	GroupName string     `json:"group_name"`
+	NodeID    uint64     `json:"node_id"`
+	UserID    uint       `json:"user_id"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// StateAPIKey only contains the hash of the key.
+type StateAPIKey struct {
+	ID         uint64     `json:"id"`
+	Prefix     string     `json:"prefix"`
+	Hash       []byte     `json:"hash"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+	LastSeen   *time.Time `json:"last_seen,omitempty"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+}
+
+// StatePolicy is a version of the ACL policy stored in the database,
+// the latest one is in use.
+type StatePolicy struct {
+	ID        uint64    `json:"id"`
+	Data      string    `json:"data"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,77 @@
+package types
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+
+	"tailscale.com/types/netlogtype"
+)
+
+// TrafficStatsWindow is the period the traffic reported by the nodes is
+// summed over, a window starts at a multiple of it.
+const TrafficStatsWindow = 5 * time.Minute
+
+// PeerTrafficStat is the traffic a node exchanged with a peer during the
+// window starting at WindowStart, as reported by the node.
+type PeerTrafficStat struct {
+	SourceID      NodeID    `gorm:"primaryKey;autoIncrement:false"`
+	DestinationID NodeID    `gorm:"primaryKey;autoIncrement:false;index"`
+	WindowStart   time.Time `gorm:"primaryKey;index"`
+	BytesTx       uint64
+	BytesRx       uint64
+}
+
+// PeerTraffic is the traffic a node exchanged with a peer over a period.
+type PeerTraffic struct {
+	SourceID      NodeID
+	DestinationID NodeID
+	BytesTx       uint64
+	BytesRx       uint64
+}
+
+// PeerTrafficStatsFromMessage returns the traffic of the node nodeID with
+// its peers in the network log message, one stat per peer. The peers are
+// looked up by address in peers, the traffic with other addresses, and
+// with the node itself, is left out. The message is counted in the window
+// it starts in.
+//
+// The connections are recorded from the point of view of the node, the
+// source is an address of the node and the destination the peer.
+func PeerTrafficStatsFromMessage(
+	nodeID NodeID,
+	msg *netlogtype.Message,
+	peers map[netip.Addr]NodeID,
+) []PeerTrafficStat {
+	windowStart := msg.Start.UTC().Truncate(TrafficStatsWindow)
+
+	byPeer := make(map[NodeID]*PeerTrafficStat)
+	for _, conn := range msg.VirtualTraffic {
+		peerID, ok := peers[conn.Dst.Addr()]
+		if !ok || peerID == nodeID {
+			continue
+		}
+
+		stat, ok := byPeer[peerID]
+		if !ok {
+			stat = &PeerTrafficStat{
+				SourceID:      nodeID,
+				DestinationID: peerID,
+				WindowStart:   windowStart,
+			}
+			byPeer[peerID] = stat
+		}
+		stat.BytesTx += conn.TxBytes
+		stat.BytesRx += conn.RxBytes
+	}
+
+	stats := make([]PeerTrafficStat, 0, len(byPeer))
+	for _, stat := range byPeer {
+		stats = append(stats, *stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].DestinationID < stats[j].DestinationID
+	})
+
+	return stats
+}
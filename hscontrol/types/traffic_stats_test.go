@@ -0,0 +1,51 @@
+package types
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/types/netlogtype"
+)
+
+func TestPeerTrafficStatsFromMessage(t *testing.T) {
+	conn := func(dst string, tx, rx uint64) netlogtype.ConnectionCounts {
+		return netlogtype.ConnectionCounts{
+			Connection: netlogtype.Connection{
+				Src: netip.MustParseAddrPort("100.64.0.1:40000"),
+				Dst: netip.MustParseAddrPort(dst),
+			},
+			Counts: netlogtype.Counts{TxBytes: tx, RxBytes: rx},
+		}
+	}
+
+	msg := &netlogtype.Message{
+		Start: time.Date(2026, 10, 16, 12, 7, 30, 0, time.UTC),
+		VirtualTraffic: []netlogtype.ConnectionCounts{
+			conn("100.64.0.3:22", 100, 1000),
+			conn("100.64.0.2:443", 10, 20),
+			conn("[fd7a:115c:a1e0::2]:80", 1, 2),
+			// Addresses of no peer, or of the node itself, are left out.
+			conn("100.64.0.9:53", 5, 5),
+			conn("100.64.0.1:8080", 7, 7),
+		},
+	}
+	peers := map[netip.Addr]NodeID{
+		netip.MustParseAddr("100.64.0.1"):        1,
+		netip.MustParseAddr("100.64.0.2"):        2,
+		netip.MustParseAddr("fd7a:115c:a1e0::2"): 2,
+		netip.MustParseAddr("100.64.0.3"):        3,
+	}
+
+	window := time.Date(2026, 10, 16, 12, 5, 0, 0, time.UTC)
+	want := []PeerTrafficStat{
+		{SourceID: 1, DestinationID: 2, WindowStart: window, BytesTx: 11, BytesRx: 22},
+		{SourceID: 1, DestinationID: 3, WindowStart: window, BytesTx: 100, BytesRx: 1000},
+	}
+
+	got := PeerTrafficStatsFromMessage(1, msg, peers)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("PeerTrafficStatsFromMessage() unexpected stats (-want +got):\n%s", diff)
+	}
+}
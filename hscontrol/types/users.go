@@ -17,15 +17,45 @@ import (
 type User struct {
 	gorm.Model
 	Name string `gorm:"unique"`
+
+	// DefaultTags are applied as forced tags to every node
+	// registering in the user.
+	DefaultTags StringList
+
+	// Disabled users cannot register nodes or create pre auth keys,
+	// their nodes are expired when the user is disabled.
+	Disabled bool
+
+	// DisplayName is the human-readable name of the user, read from
+	// the oidc.claims.display_name claim.
+	DisplayName string
+
+	// AvatarURL is the URL of the picture of the user, read from the
+	// picture claim of the OIDC ID token.
+	AvatarURL string
+
+	// DERPOnly users do not share the endpoints of their nodes with
+	// their peers, nor receive the endpoints of their peers, so their
+	// traffic is relayed through DERP.
+	DERPOnly bool `gorm:"column:derp_only"`
+}
+
+// displayName returns the DisplayName of the user, or its Name if
+// it has none.
+func (n *User) displayName() string {
+	if n.DisplayName != "" {
+		return n.DisplayName
+	}
+
+	return n.Name
 }
 
 func (n *User) TailscaleUser() *tailcfg.User {
 	user := tailcfg.User{
-		ID:          tailcfg.UserID(n.ID),
-		LoginName:   n.Name,
-		DisplayName: n.Name,
-		// TODO(kradalby): See if we can fill in Gravatar here
-		ProfilePicURL: "",
+		ID:            tailcfg.UserID(n.ID),
+		LoginName:     n.Name,
+		DisplayName:   n.displayName(),
+		ProfilePicURL: n.AvatarURL,
 		Logins:        []tailcfg.LoginID{},
 		Created:       n.CreatedAt,
 	}
@@ -35,11 +65,10 @@ func (n *User) TailscaleUser() *tailcfg.User {
 
 func (n *User) TailscaleLogin() *tailcfg.Login {
 	login := tailcfg.Login{
-		ID:          tailcfg.LoginID(n.ID),
-		LoginName:   n.Name,
-		DisplayName: n.Name,
-		// TODO(kradalby): See if we can fill in Gravatar here
-		ProfilePicURL: "",
+		ID:            tailcfg.LoginID(n.ID),
+		LoginName:     n.Name,
+		DisplayName:   n.displayName(),
+		ProfilePicURL: n.AvatarURL,
 	}
 
 	return &login
@@ -47,8 +76,12 @@ func (n *User) TailscaleLogin() *tailcfg.Login {
 
 func (n *User) Proto() *v1.User {
 	return &v1.User{
-		Id:        strconv.FormatUint(uint64(n.ID), util.Base10),
-		Name:      n.Name,
-		CreatedAt: timestamppb.New(n.CreatedAt),
+		Id:          strconv.FormatUint(uint64(n.ID), util.Base10),
+		Name:        n.Name,
+		CreatedAt:   timestamppb.New(n.CreatedAt),
+		DefaultTags: n.DefaultTags,
+		Disabled:    n.Disabled,
+		DisplayName: n.DisplayName,
+		DerpOnly:    n.DERPOnly,
 	}
 }
@@ -23,7 +23,93 @@ const (
 
 var invalidCharsInUserRegex = regexp.MustCompile("[^a-z0-9-.]+")
 
-var ErrInvalidUserName = errors.New("invalid user name")
+// invalidCharsInHostnameRegex matches the characters that cannot be in
+// a DNS label, uppercase letters are handled by HostnamePolicy.Lowercase.
+var invalidCharsInHostnameRegex = regexp.MustCompile("[^a-zA-Z0-9-]+")
+
+var repeatedHyphensRegex = regexp.MustCompile("-{2,}")
+
+// fallbackHostname is used for hostnames without any valid character.
+const fallbackHostname = "node"
+
+var (
+	ErrInvalidUserName = errors.New("invalid user name")
+	ErrInvalidHostname = errors.New("invalid hostname")
+)
+
+// HostnamePolicy configures how the hostname of a node is turned into
+// the DNS label used by MagicDNS.
+type HostnamePolicy struct {
+	// Enabled uses the policy instead of the rules of the user names,
+	// which keep dots and do not merge or trim hyphens.
+	Enabled bool
+	// Lowercase converts uppercase letters to lowercase.
+	Lowercase bool
+	// ReplaceInvalid replaces each run of characters not allowed in a
+	// DNS label with a "-", instead of removing them.
+	ReplaceInvalid bool
+	// Truncate cuts hostnames longer than 63 characters instead of
+	// rejecting them.
+	Truncate bool
+}
+
+// HostnamePolicyFromViper returns the dns_config.hostname_policy of the
+// configuration. It is disabled by default, once enabled every option
+// defaults to true except truncate.
+func HostnamePolicyFromViper() HostnamePolicy {
+	policy := HostnamePolicy{
+		Enabled:        viper.GetBool("dns_config.hostname_policy.enabled"),
+		Lowercase:      true,
+		ReplaceInvalid: true,
+	}
+
+	if viper.IsSet("dns_config.hostname_policy.lowercase") {
+		policy.Lowercase = viper.GetBool("dns_config.hostname_policy.lowercase")
+	}
+	if viper.IsSet("dns_config.hostname_policy.replace_invalid") {
+		policy.ReplaceInvalid = viper.GetBool("dns_config.hostname_policy.replace_invalid")
+	}
+	policy.Truncate = viper.GetBool("dns_config.hostname_policy.truncate")
+
+	return policy
+}
+
+// NormalizeHostname turns a hostname into a DNS label following policy.
+// Repeated hyphens are merged, leading and trailing ones are removed, and
+// a hostname without any valid character becomes "node". The same
+// hostname always gives the same label.
+func NormalizeHostname(name string, policy HostnamePolicy) (string, error) {
+	if policy.Lowercase {
+		name = strings.ToLower(name)
+	}
+	name = strings.ReplaceAll(name, "'", "")
+
+	replacement := ""
+	if policy.ReplaceInvalid {
+		replacement = "-"
+	}
+	name = invalidCharsInHostnameRegex.ReplaceAllString(name, replacement)
+	name = repeatedHyphensRegex.ReplaceAllString(name, "-")
+	name = strings.Trim(name, "-")
+
+	if len(name) > LabelHostnameLength {
+		if !policy.Truncate {
+			return "", fmt.Errorf(
+				"hostname %v is more than 63 chars: %w",
+				name,
+				ErrInvalidHostname,
+			)
+		}
+
+		name = strings.TrimRight(name[:LabelHostnameLength], "-")
+	}
+
+	if name == "" {
+		name = fallbackHostname
+	}
+
+	return name, nil
+}
 
 func NormalizeToFQDNRulesConfigFromViper(name string) (string, error) {
 	strip := viper.GetBool("oidc.strip_email_domain")
@@ -2,6 +2,7 @@ package util
 
 import (
 	"net/netip"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -101,6 +102,118 @@ func TestNormalizeToFQDNRules(t *testing.T) {
 	}
 }
 
+func TestNormalizeHostname(t *testing.T) {
+	defaultPolicy := HostnamePolicy{
+		Lowercase:      true,
+		ReplaceInvalid: true,
+	}
+	long := strings.Repeat("a", 60) + "_bcdef"
+
+	tests := []struct {
+		name     string
+		hostname string
+		policy   HostnamePolicy
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "valid",
+			hostname: "laptop-1",
+			policy:   defaultPolicy,
+			want:     "laptop-1",
+		},
+		{
+			name:     "underscores and mixed case",
+			hostname: "Build_Server__01",
+			policy:   defaultPolicy,
+			want:     "build-server-01",
+		},
+		{
+			name:     "keep case",
+			hostname: "Build_Server",
+			policy:   HostnamePolicy{ReplaceInvalid: true},
+			want:     "Build-Server",
+		},
+		{
+			name:     "remove invalid characters",
+			hostname: "build_server.local",
+			policy:   HostnamePolicy{Lowercase: true},
+			want:     "buildserverlocal",
+		},
+		{
+			name:     "dots",
+			hostname: "mbp.home.arpa",
+			policy:   defaultPolicy,
+			want:     "mbp-home-arpa",
+		},
+		{
+			name:     "apostrophe",
+			hostname: "Alice's MacBook",
+			policy:   defaultPolicy,
+			want:     "alices-macbook",
+		},
+		{
+			name:     "unicode",
+			hostname: "café-über_ноутбук",
+			policy:   defaultPolicy,
+			want:     "caf-ber",
+		},
+		{
+			name:     "only unicode",
+			hostname: "ноутбук",
+			policy:   defaultPolicy,
+			want:     "node",
+		},
+		{
+			name:     "leading and trailing invalid characters",
+			hostname: "_laptop_",
+			policy:   defaultPolicy,
+			want:     "laptop",
+		},
+		{
+			name:     "over-length rejected",
+			hostname: long,
+			policy:   defaultPolicy,
+			wantErr:  true,
+		},
+		{
+			name:     "over-length truncated",
+			hostname: long,
+			policy:   HostnamePolicy{Lowercase: true, ReplaceInvalid: true, Truncate: true},
+			want:     strings.Repeat("a", 60) + "-bc",
+		},
+		{
+			name:     "truncated before a hyphen",
+			hostname: strings.Repeat("a", 62) + "_b",
+			policy:   HostnamePolicy{Lowercase: true, ReplaceInvalid: true, Truncate: true},
+			want:     strings.Repeat("a", 62),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeHostname(tt.hostname, tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NormalizeHostname() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got != tt.want {
+				t.Errorf("NormalizeHostname() = %v, want %v", got, tt.want)
+			}
+			if len(got) > LabelHostnameLength {
+				t.Errorf("NormalizeHostname() = %v is longer than %d", got, LabelHostnameLength)
+			}
+
+			again, err := NormalizeHostname(tt.hostname, tt.policy)
+			if err != nil || again != got {
+				t.Errorf("NormalizeHostname() is not stable, got %v then %v (%v)", got, again, err)
+			}
+		})
+	}
+}
+
 func TestCheckForFQDNRules(t *testing.T) {
 	type args struct {
 		name string
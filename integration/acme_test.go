@@ -0,0 +1,163 @@
+package integration
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/juanfont/headscale/integration/dockertestutil"
+	"github.com/juanfont/headscale/integration/hsic"
+	"github.com/ory/dockertest/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	pebbleDirectoryPort  = "14000"
+	pebbleManagementPort = "15000"
+	acmeTestDomain       = "headscale.example.com"
+)
+
+// runPebble starts pebble, the ACME test server, accepting all
+// challenges without validating them.
+func runPebble(s *Scenario) (*dockertest.Resource, error) {
+	hash, _ := util.GenerateRandomStringDNSSafe(scenarioHashLength)
+
+	pebbleOptions := &dockertest.RunOptions{
+		Name:       fmt.Sprintf("pebble-%s", hash),
+		Repository: "ghcr.io/letsencrypt/pebble",
+		Tag:        "latest",
+		Networks:   []*dockertest.Network{s.network},
+		Env: []string{
+			"PEBBLE_VA_ALWAYS_VALID=1",
+			"PEBBLE_VA_NOSLEEP=1",
+		},
+	}
+
+	return s.pool.RunWithOptions(pebbleOptions, dockertestutil.DockerRestartPolicy)
+}
+
+// pebbleTLSCertificate returns the certificate pebble serves its
+// directory with, to be trusted by the ACME client.
+func pebbleTLSCertificate(s *Scenario, hostEndpoint string) ([]byte, error) {
+	var certPEM []byte
+
+	err := s.pool.Retry(func() error {
+		conn, err := tls.Dial("tcp", hostEndpoint, &tls.Config{InsecureSkipVerify: true}) //nolint
+		if err != nil {
+			log.Printf("pebble is not ready: %s\n", err)
+
+			return err
+		}
+		defer conn.Close()
+
+		cert := conn.ConnectionState().PeerCertificates[0]
+		certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+
+		return nil
+	})
+
+	return certPEM, err
+}
+
+// pebbleRootCertificate returns the root pebble signs the issued
+// certificates with, it is generated on every start.
+func pebbleRootCertificate(hostEndpoint string) (*x509.CertPool, error) {
+	insecureTransport := http.DefaultTransport.(*http.Transport).Clone()      //nolint
+	insecureTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint
+	client := &http.Client{Transport: insecureTransport}
+
+	req, _ := http.NewRequestWithContext(
+		context.Background(),
+		http.MethodGet,
+		fmt.Sprintf("https://%s/roots/0", hostEndpoint),
+		nil,
+	)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errStatusCodeNotOK
+	}
+
+	rootPEM, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rootPEM) {
+		return nil, fmt.Errorf("no certificate in pebble root %q", rootPEM)
+	}
+
+	return pool, nil
+}
+
+func TestACMEDNSChallenge(t *testing.T) {
+	IntegrationSkip(t)
+	t.Parallel()
+
+	scenario, err := NewScenario()
+	assertNoErr(t, err)
+	defer scenario.Shutdown()
+
+	pebble, err := runPebble(scenario)
+	assertNoErr(t, err)
+	defer func() {
+		if err := scenario.pool.Purge(pebble); err != nil {
+			log.Printf("failed to remove pebble container: %s", err)
+		}
+	}()
+
+	pebbleIP := pebble.GetIPInNetwork(scenario.network)
+
+	caCert, err := pebbleTLSCertificate(scenario, net.JoinHostPort(pebbleIP, pebbleDirectoryPort))
+	assertNoErr(t, err)
+
+	headscale, err := scenario.Headscale(
+		hsic.WithTestName("acme"),
+		hsic.WithACME(
+			fmt.Sprintf("https://%s/dir", net.JoinHostPort(pebbleIP, pebbleDirectoryPort)),
+			acmeTestDomain,
+			caCert,
+		),
+		// The certificate pebble serves its directory with is
+		// issued for the name pebble.
+		hsic.WithConfigEnv(map[string]string{
+			"LEGO_CA_SERVER_NAME": "pebble",
+		}),
+	)
+	assertNoErr(t, err)
+
+	roots, err := pebbleRootCertificate(net.JoinHostPort(pebbleIP, pebbleManagementPort))
+	assertNoErr(t, err)
+
+	endpoint, err := url.Parse(headscale.GetEndpoint())
+	assertNoErr(t, err)
+
+	conn, err := tls.Dial("tcp", endpoint.Host, &tls.Config{
+		RootCAs:    roots,
+		ServerName: acmeTestDomain,
+		MinVersion: tls.VersionTLS12,
+	})
+	assertNoErr(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, []string{acmeTestDomain}, conn.ConnectionState().PeerCertificates[0].DNSNames)
+
+	files, err := headscale.Execute([]string{"ls", "/tmp/acme"})
+	assertNoErr(t, err)
+	assert.Contains(t, files, acmeTestDomain+".crt")
+	assert.Contains(t, files, "account.json")
+}
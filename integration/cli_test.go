@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -185,9 +186,14 @@ func TestPreAuthKeyCommand(t *testing.T) {
 		},
 	)
 
-	assert.NotEmpty(t, listedPreAuthKeys[1].GetKey())
-	assert.NotEmpty(t, listedPreAuthKeys[2].GetKey())
-	assert.NotEmpty(t, listedPreAuthKeys[3].GetKey())
+	assert.Empty(t, listedPreAuthKeys[1].GetKey())
+	assert.Empty(t, listedPreAuthKeys[2].GetKey())
+	assert.Empty(t, listedPreAuthKeys[3].GetKey())
+
+	for index := range keys {
+		assert.True(t, strings.HasPrefix(keys[index].GetKey(), "hskey-auth-"))
+		assert.True(t, strings.HasPrefix(keys[index].GetKey(), listedPreAuthKeys[index+1].GetKeyPrefix()+"-"))
+	}
 
 	assert.True(t, listedPreAuthKeys[1].GetExpiration().AsTime().After(time.Now()))
 	assert.True(t, listedPreAuthKeys[2].GetExpiration().AsTime().After(time.Now()))
@@ -222,7 +228,7 @@ func TestPreAuthKeyCommand(t *testing.T) {
 			"--user",
 			user,
 			"expire",
-			listedPreAuthKeys[1].GetKey(),
+			listedPreAuthKeys[1].GetKeyPrefix(),
 		},
 	)
 	assertNoErr(t, err)
@@ -976,6 +982,39 @@ func TestNodeCommand(t *testing.T) {
 	assert.Equal(t, "otherUser-node-1", listAllWithotherUser[5].GetName())
 	assert.Equal(t, "otherUser-node-2", listAllWithotherUser[6].GetName())
 
+	// Test list the nodes of all the users explicitly
+	var listAllUsers []v1.Node
+	err = executeAndUnmarshal(
+		headscale,
+		[]string{
+			"headscale",
+			"nodes",
+			"list",
+			"--all-users",
+			"--output",
+			"json",
+		},
+		&listAllUsers,
+	)
+	assert.Nil(t, err)
+
+	assert.Len(t, listAllUsers, 7)
+	assert.Equal(t, "node-user", listAllUsers[0].GetUser().GetName())
+	assert.Equal(t, "other-user", listAllUsers[6].GetUser().GetName())
+
+	// --all-users cannot be combined with a user
+	_, err = headscale.Execute(
+		[]string{
+			"headscale",
+			"nodes",
+			"list",
+			"--all-users",
+			"--user",
+			"other-user",
+		},
+	)
+	assert.NotNil(t, err)
+
 	// Test list all nodes after added otherUser
 	var listOnlyotherUserMachineUser []v1.Node
 	err = executeAndUnmarshal(
@@ -7,6 +7,7 @@ import (
 
 type ControlServer interface {
 	Shutdown() error
+	StopDatabase() error
 	SaveLog(string) error
 	SaveProfile(string) error
 	Execute(command []string) (string, error)
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/ory/dockertest/v3"
@@ -30,10 +31,13 @@ func ExecuteCommandTimeout(timeout time.Duration) ExecuteCommandOption {
 	})
 }
 
+// ExecuteCommand runs cmd in the container of resource, with the
+// environment variables in env set for it, and returns its stdout and
+// stderr.
 func ExecuteCommand(
 	resource *dockertest.Resource,
 	cmd []string,
-	env []string,
+	env map[string]string,
 	options ...ExecuteCommandOption,
 ) (string, string, error) {
 	var stdout bytes.Buffer
@@ -62,7 +66,7 @@ func ExecuteCommand(
 		exitCode, err := resource.Exec(
 			cmd,
 			dockertest.ExecOptions{
-				Env:    append(env, "HEADSCALE_LOG_LEVEL=disabled"),
+				Env:    append(envList(env), "HEADSCALE_LOG_LEVEL=disabled"),
 				StdOut: &stdout,
 				StdErr: &stderr,
 			},
@@ -92,3 +96,14 @@ func ExecuteCommand(
 		return stdout.String(), stderr.String(), ErrDockertestCommandTimeout
 	}
 }
+
+// envList returns the variables of env as sorted KEY=VALUE pairs.
+func envList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for key, value := range env {
+		list = append(list, key+"="+value)
+	}
+	sort.Strings(list)
+
+	return list
+}
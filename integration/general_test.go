@@ -3,6 +3,7 @@ package integration
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/netip"
 	"strings"
 	"testing"
@@ -573,6 +574,91 @@ func TestResolveMagicDNS(t *testing.T) {
 	}
 }
 
+// TestMagicDNSResolution verifies that nodes resolve the hostname of
+// their peers to their Tailscale IP through the MagicDNS resolver.
+func TestMagicDNSResolution(t *testing.T) {
+	IntegrationSkip(t)
+	t.Parallel()
+
+	// MagicDNS records can take a while to reach the resolver of a
+	// node after it has joined the tailnet.
+	const resolveTimeout = 30 * time.Second
+
+	scenario, err := NewScenario()
+	assertNoErr(t, err)
+	defer scenario.Shutdown()
+
+	spec := map[string]int{
+		"magicdnsres": 2,
+	}
+
+	err = scenario.CreateHeadscaleEnv(spec, []tsic.Option{},
+		hsic.WithTestName("magicdnsres"),
+		hsic.WithConfigEnv(map[string]string{
+			"HEADSCALE_DNS_CONFIG_MAGIC_DNS": "true",
+		}),
+	)
+	assertNoErrHeadscaleEnv(t, err)
+
+	allClients, err := scenario.ListTailscaleClients()
+	assertNoErrListClients(t, err)
+
+	err = scenario.WaitForTailscaleSync()
+	assertNoErrSync(t, err)
+
+	for _, client := range allClients {
+		for _, peer := range allClients {
+			if client.Hostname() == peer.Hostname() {
+				continue
+			}
+
+			peerFQDN, err := peer.FQDN()
+			assertNoErrListFQDN(t, err)
+
+			peerIPs, err := peer.IPs()
+			assertNoErrListClientIPs(t, err)
+
+			var peerIPv4 string
+			for _, ip := range peerIPs {
+				if ip.Is4() {
+					peerIPv4 = ip.String()
+				}
+			}
+
+			// Ask the MagicDNS resolver of the node directly, the
+			// containers do not use it as their system resolver.
+			command := []string{
+				"nslookup",
+				peerFQDN,
+				"100.100.100.100",
+			}
+
+			var result string
+			deadline := time.Now().Add(resolveTimeout)
+			for {
+				result, _, err = client.Execute(command)
+				if err == nil && strings.Contains(result, peerIPv4) {
+					break
+				}
+
+				if time.Now().After(deadline) {
+					t.Fatalf(
+						"%s did not resolve %s to %s within %s, err: %v, output:\n%s",
+						client.Hostname(),
+						peerFQDN,
+						peerIPv4,
+						resolveTimeout,
+						err,
+						result,
+					)
+				}
+
+				time.Sleep(time.Second)
+			}
+		}
+	}
+}
+
 func TestExpireNode(t *testing.T) {
 	IntegrationSkip(t)
 	t.Parallel()
@@ -894,3 +980,44 @@ func TestPingAllByIPManyUpDown(t *testing.T) {
 		t.Logf("%d successful pings out of %d", success, len(allClients)*len(allIps))
 	}
 }
+
+func TestHealthzDatabaseDown(t *testing.T) {
+	IntegrationSkip(t)
+	t.Parallel()
+
+	scenario, err := NewScenario()
+	assertNoErr(t, err)
+	defer scenario.Shutdown()
+
+	headscale, err := scenario.Headscale(
+		hsic.WithTestName("healthz"),
+		hsic.WithPostgres(),
+	)
+	assertNoErr(t, err)
+
+	healthz := func() (int, map[string]any) {
+		t.Helper()
+
+		resp, err := http.Get(headscale.GetEndpoint() + "/healthz") //nolint
+		assertNoErr(t, err)
+		defer resp.Body.Close()
+
+		var body struct {
+			Subsystems map[string]any `json:"subsystems"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		assertNoErr(t, err)
+
+		return resp.StatusCode, body.Subsystems["database"].(map[string]any)
+	}
+
+	_, database := healthz()
+	assert.Equal(t, "ok", database["status"])
+
+	err = headscale.StopDatabase()
+	assertNoErr(t, err)
+
+	status, database := healthz()
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "down", database["status"])
+}
@@ -38,10 +38,14 @@ const (
 	aclPolicyPath        = "/etc/headscale/acl.hujson"
 	tlsCertPath          = "/etc/headscale/tls.cert"
 	tlsKeyPath           = "/etc/headscale/tls.key"
+	acmeCACertPath       = "/etc/headscale/acme-ca.pem"
 	headscaleDefaultPort = 8080
 )
 
-var errHeadscaleStatusCodeNotOk = errors.New("headscale status code not ok")
+var (
+	errHeadscaleStatusCodeNotOk = errors.New("headscale status code not ok")
+	errNoPostgres               = errors.New("headscale is not using postgres")
+)
 
 type fileInContainer struct {
 	path     string
@@ -67,6 +71,7 @@ type HeadscaleInContainer struct {
 	env              map[string]string
 	tlsCert          []byte
 	tlsKey           []byte
+	acme             bool
 	filesInContainer []fileInContainer
 	postgres         bool
 }
@@ -103,6 +108,29 @@ func WithTLS() Option {
 	}
 }
 
+// WithACME enables HTTPS with a certificate for domain obtained from
+// the ACME directory with the DNS-01 challenge. The DNS provider is a
+// no-op, the CA is expected to skip the validation (e.g. pebble with
+// PEBBLE_VA_ALWAYS_VALID). caCert is used to trust the directory.
+func WithACME(directoryURL string, domain string, caCert []byte) Option {
+	return func(hsic *HeadscaleInContainer) {
+		hsic.env["HEADSCALE_ACME_URL"] = directoryURL
+		hsic.env["HEADSCALE_ACME_DOMAIN"] = domain
+		hsic.env["HEADSCALE_ACME_DATA_DIR"] = "/tmp/acme"
+		hsic.env["HEADSCALE_ACME_DNS_CHALLENGE_PROVIDER"] = "exec"
+		hsic.env["HEADSCALE_ACME_DISABLE_PROPAGATION_CHECK"] = "true"
+		hsic.env["EXEC_PATH"] = "/bin/true"
+		hsic.env["LEGO_CA_CERTIFICATES"] = acmeCACertPath
+
+		hsic.acme = true
+		hsic.filesInContainer = append(hsic.filesInContainer,
+			fileInContainer{
+				path:     acmeCACertPath,
+				contents: caCert,
+			})
+	}
+}
+
 // WithConfigEnv takes a map of environment variables that
 // can be used to override Headscale configuration.
 func WithConfigEnv(configEnv map[string]string) Option {
@@ -238,7 +266,7 @@ func New(
 		return nil, err
 	}
 
-	if len(hsic.tlsCert) != 0 && len(hsic.tlsKey) != 0 {
+	if hsic.hasTLS() {
 		serverURL.Scheme = "https"
 		hsic.env["HEADSCALE_SERVER_URL"] = serverURL.String()
 	}
@@ -348,7 +376,7 @@ func New(
 		}
 	}
 
-	if hsic.hasTLS() {
+	if len(hsic.tlsCert) != 0 && len(hsic.tlsKey) != 0 {
 		err = hsic.WriteFile(tlsCertPath, hsic.tlsCert)
 		if err != nil {
 			return nil, fmt.Errorf("failed to write TLS certificate to container: %w", err)
@@ -374,7 +402,7 @@ func (t *HeadscaleInContainer) ConnectToNetwork(network *dockertest.Network) err
 }
 
 func (t *HeadscaleInContainer) hasTLS() bool {
-	return len(t.tlsCert) != 0 && len(t.tlsKey) != 0
+	return t.acme || (len(t.tlsCert) != 0 && len(t.tlsKey) != 0)
 }
 
 // Shutdown stops and cleans up the Headscale container.
@@ -433,6 +461,15 @@ func (t *HeadscaleInContainer) Shutdown() error {
 	return t.pool.Purge(t.container)
 }
 
+// StopDatabase stops the Postgres container of the Headscale instance.
+func (t *HeadscaleInContainer) StopDatabase() error {
+	if !t.postgres {
+		return errNoPostgres
+	}
+
+	return t.pool.Client.StopContainer(t.pgContainer.Container.ID, 10)
+}
+
 // SaveLog saves the current stdout log of the container to a path
 // on the host system.
 func (t *HeadscaleInContainer) SaveLog(path string) error {
@@ -501,7 +538,7 @@ func (t *HeadscaleInContainer) Execute(
 	stdout, stderr, err := dockertestutil.ExecuteCommand(
 		t.container,
 		command,
-		[]string{},
+		nil,
 	)
 	if err != nil {
 		log.Printf("command stderr: %s\n", stderr)
@@ -593,7 +630,7 @@ func (t *HeadscaleInContainer) CreateUser(
 	_, _, err := dockertestutil.ExecuteCommand(
 		t.container,
 		command,
-		[]string{},
+		nil,
 	)
 	if err != nil {
 		return err
@@ -632,7 +669,7 @@ func (t *HeadscaleInContainer) CreateAuthKey(
 	result, _, err := dockertestutil.ExecuteCommand(
 		t.container,
 		command,
-		[]string{},
+		nil,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute create auth key command: %w", err)
@@ -657,7 +694,7 @@ func (t *HeadscaleInContainer) ListNodesInUser(
 	result, _, err := dockertestutil.ExecuteCommand(
 		t.container,
 		command,
-		[]string{},
+		nil,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute list node command: %w", err)
@@ -52,7 +52,7 @@ func WriteFileToContainer(
 	_, _, err = dockertestutil.ExecuteCommand(
 		container,
 		[]string{"mkdir", "-p", dirPath},
-		[]string{},
+		nil,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to ensure directory: %w", err)
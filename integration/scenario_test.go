@@ -1,9 +1,13 @@
 package integration
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/juanfont/headscale/integration/dockertestutil"
+	"github.com/ory/dockertest/v3"
 )
 
 // This file is intended to "test the test framework", by proxy it will also test
@@ -184,3 +188,56 @@ func TestTailscaleNodesJoiningHeadcale(t *testing.T) {
 		}
 	})
 }
+
+// TestExecuteCommandEnv checks the environment variables given to
+// ExecuteCommand are set for the command run in the container.
+func TestExecuteCommandEnv(t *testing.T) {
+	IntegrationSkip(t)
+	t.Parallel()
+
+	scenario, err := NewScenario()
+	assertNoErr(t, err)
+	defer scenario.Shutdown()
+
+	hash, _ := util.GenerateRandomStringDNSSafe(scenarioHashLength)
+	container, err := scenario.pool.RunWithOptions(
+		&dockertest.RunOptions{
+			Name:       fmt.Sprintf("busybox-%s", hash),
+			Repository: "busybox",
+			Tag:        "latest",
+			Cmd:        []string{"sleep", "3600"},
+			Networks:   []*dockertest.Network{scenario.network},
+		},
+		dockertestutil.DockerRestartPolicy,
+	)
+	assertNoErr(t, err)
+	defer func() {
+		if err := scenario.pool.Purge(container); err != nil {
+			t.Logf("failed to remove busybox container: %s", err)
+		}
+	}()
+
+	stdout, _, err := dockertestutil.ExecuteCommand(
+		container,
+		[]string{"sh", "-c", "echo $HOME"},
+		map[string]string{"HOME": "/tmp"},
+	)
+	assertNoErr(t, err)
+
+	if got := strings.TrimSpace(stdout); got != "/tmp" {
+		t.Errorf("HOME in the container = %q, want /tmp", got)
+	}
+
+	// Without variables, the command gets the environment of the
+	// container.
+	stdout, _, err = dockertestutil.ExecuteCommand(
+		container,
+		[]string{"sh", "-c", "echo $HOME"},
+		nil,
+	)
+	assertNoErr(t, err)
+
+	if got := strings.TrimSpace(stdout); got != "/root" {
+		t.Errorf("HOME in the container = %q, want /root", got)
+	}
+}
@@ -328,7 +328,7 @@ func (t *TailscaleInContainer) Execute(
 	stdout, stderr, err := dockertestutil.ExecuteCommand(
 		t.container,
 		command,
-		[]string{},
+		nil,
 		options...,
 	)
 	if err != nil {
@@ -0,0 +1,34 @@
+package integration
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAdminUI(t *testing.T) {
+	IntegrationSkip(t)
+	t.Parallel()
+
+	scenario, err := NewScenario()
+	assertNoErr(t, err)
+	defer scenario.Shutdown()
+
+	headscale, err := scenario.Headscale()
+	assertNoErr(t, err)
+
+	err = headscale.WaitForRunning()
+	assertNoErr(t, err)
+
+	resp, err := http.Get(headscale.GetEndpoint() + "/admin/") //nolint
+	assertNoErr(t, err)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		t.Fatalf("expected Content-Type text/html, got %q", contentType)
+	}
+}
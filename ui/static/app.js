@@ -0,0 +1,372 @@
+// headscale admin interface.
+//
+// Everything goes through the REST API under /api/v1, authenticated with
+// an API key created with `headscale apikeys create`. The key is kept in
+// the browser's local storage.
+
+"use strict";
+
+const apiKeyStorage = "headscale-api-key";
+
+const app = document.getElementById("app");
+const logout = document.getElementById("logout");
+
+// h creates a DOM element with the given attributes and children.
+function h(tag, attrs, ...children) {
+  const el = document.createElement(tag);
+  for (const [name, value] of Object.entries(attrs || {})) {
+    if (name.startsWith("on")) {
+      el.addEventListener(name.slice(2), value);
+    } else if (value === true) {
+      el.setAttribute(name, "");
+    } else if (value !== false && value !== undefined && value !== null) {
+      el.setAttribute(name, value);
+    }
+  }
+  for (const child of children.flat()) {
+    el.append(child instanceof Node ? child : String(child ?? ""));
+  }
+  return el;
+}
+
+function render(...children) {
+  app.replaceChildren(...children);
+}
+
+function formatTime(value) {
+  if (!value || value.startsWith("0001-01-01")) {
+    return "";
+  }
+  return new Date(value).toLocaleString();
+}
+
+async function api(method, path, body) {
+  const response = await fetch("/api/v1" + path, {
+    method: method,
+    headers: {
+      Authorization: "Bearer " + localStorage.getItem(apiKeyStorage),
+      "Content-Type": "application/json",
+    },
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+
+  if (response.status === 401) {
+    localStorage.removeItem(apiKeyStorage);
+    route();
+    throw new Error("Unauthorized, please provide a valid API key");
+  }
+
+  const text = await response.text();
+  const data = text ? JSON.parse(text) : {};
+  if (!response.ok) {
+    throw new Error(data.message || response.statusText);
+  }
+  return data;
+}
+
+// action runs fn and re-renders the current page, showing any error.
+async function action(fn) {
+  try {
+    await fn();
+    await route();
+  } catch (err) {
+    app.prepend(h("p", { class: "error" }, err.message));
+  }
+}
+
+function loginPage() {
+  const input = h("input", {
+    type: "password",
+    placeholder: "API key",
+    size: 60,
+    required: true,
+  });
+
+  render(
+    h("h2", {}, "Log in"),
+    h("p", {}, "Create an API key with ", h("code", {}, "headscale apikeys create"), "."),
+    h(
+      "form",
+      {
+        onsubmit: (event) => {
+          event.preventDefault();
+          localStorage.setItem(apiKeyStorage, input.value.trim());
+          route();
+        },
+      },
+      input,
+      h("button", { type: "submit" }, "Log in"),
+    ),
+  );
+}
+
+async function usersPage() {
+  const { users = [] } = await api("GET", "/user");
+  const name = h("input", { placeholder: "Name", required: true });
+
+  render(
+    h("h2", {}, "Users"),
+    h(
+      "form",
+      {
+        onsubmit: (event) => {
+          event.preventDefault();
+          action(() => api("POST", "/user", { name: name.value.trim() }));
+        },
+      },
+      name,
+      h("button", { type: "submit" }, "Create"),
+    ),
+    h(
+      "table",
+      {},
+      h("tr", {}, h("th", {}, "ID"), h("th", {}, "Name"), h("th", {}, "Default tags"), h("th", {}, "Created"), h("th")),
+      users.map((user) =>
+        h(
+          "tr",
+          {},
+          h("td", {}, user.id),
+          h("td", {}, user.name),
+          h("td", {}, (user.defaultTags || []).join(", ")),
+          h("td", {}, formatTime(user.createdAt)),
+          h(
+            "td",
+            {},
+            h(
+              "button",
+              {
+                onclick: () => {
+                  if (confirm(`Delete user ${user.name}?`)) {
+                    action(() => api("DELETE", "/user/" + encodeURIComponent(user.name)));
+                  }
+                },
+              },
+              "Delete",
+            ),
+          ),
+        ),
+      ),
+    ),
+  );
+}
+
+async function nodesPage() {
+  const { nodes = [] } = await api("GET", "/node");
+
+  render(
+    h("h2", {}, "Nodes"),
+    h(
+      "table",
+      {},
+      h(
+        "tr",
+        {},
+        h("th", {}, "ID"),
+        h("th", {}, "Name"),
+        h("th", {}, "User"),
+        h("th", {}, "IP addresses"),
+        h("th", {}, "Status"),
+        h("th", {}, "Last seen"),
+        h("th", {}, "Expiry"),
+      ),
+      nodes.map((node) =>
+        h(
+          "tr",
+          {},
+          h("td", {}, node.id),
+          h("td", {}, node.givenName || node.name),
+          h("td", {}, node.user ? node.user.name : ""),
+          h("td", {}, (node.ipAddresses || []).join(", ")),
+          h(
+            "td",
+            { class: node.online ? "online" : "offline" },
+            node.online ? "online" : "offline",
+          ),
+          h("td", {}, formatTime(node.lastSeen)),
+          h("td", {}, formatTime(node.expiry)),
+        ),
+      ),
+    ),
+  );
+}
+
+async function preAuthKeysPage() {
+  const { users = [] } = await api("GET", "/user");
+  const selected = new URLSearchParams(location.hash.split("?")[1]).get("user") || (users[0] && users[0].name);
+
+  const userSelect = h(
+    "select",
+    {
+      onchange: () => {
+        location.hash = "#/preauthkeys?user=" + encodeURIComponent(userSelect.value);
+      },
+    },
+    users.map((user) => h("option", { value: user.name, selected: user.name === selected }, user.name)),
+  );
+
+  if (!selected) {
+    render(h("h2", {}, "Pre auth keys"), h("p", {}, "Create a user first."));
+    return;
+  }
+
+  const { preAuthKeys = [] } = await api("GET", "/preauthkey?user=" + encodeURIComponent(selected));
+
+  const reusable = h("input", { type: "checkbox" });
+  const ephemeral = h("input", { type: "checkbox" });
+  const tags = h("input", { placeholder: "tag:a,tag:b" });
+  const expiration = h("input", { type: "number", min: 1, value: 60, size: 5 });
+
+  render(
+    h("h2", {}, "Pre auth keys"),
+    h("p", {}, "User: ", userSelect),
+    h(
+      "form",
+      {
+        onsubmit: (event) => {
+          event.preventDefault();
+          action(() =>
+            api("POST", "/preauthkey", {
+              user: selected,
+              reusable: reusable.checked,
+              ephemeral: ephemeral.checked,
+              expiration: new Date(Date.now() + expiration.value * 60 * 1000).toISOString(),
+              aclTags: tags.value
+                .split(",")
+                .map((tag) => tag.trim())
+                .filter((tag) => tag !== ""),
+            }),
+          );
+        },
+      },
+      h("label", {}, reusable, " Reusable"),
+      h("label", {}, ephemeral, " Ephemeral"),
+      h("label", {}, "Tags ", tags),
+      h("label", {}, "Expires in ", expiration, " minutes"),
+      h("button", { type: "submit" }, "Create"),
+    ),
+    h(
+      "table",
+      {},
+      h(
+        "tr",
+        {},
+        h("th", {}, "ID"),
+        h("th", {}, "Key"),
+        h("th", {}, "Reusable"),
+        h("th", {}, "Ephemeral"),
+        h("th", {}, "Used"),
+        h("th", {}, "Tags"),
+        h("th", {}, "Expiration"),
+        h("th"),
+      ),
+      preAuthKeys.map((key) =>
+        h(
+          "tr",
+          {},
+          h("td", {}, key.id),
+          h("td", {}, h("code", {}, key.key)),
+          h("td", {}, key.reusable ? "yes" : "no"),
+          h("td", {}, key.ephemeral ? "yes" : "no"),
+          h("td", {}, key.used ? "yes" : "no"),
+          h("td", {}, (key.aclTags || []).join(", ")),
+          h("td", {}, formatTime(key.expiration)),
+          h(
+            "td",
+            {},
+            h(
+              "button",
+              {
+                disabled: new Date(key.expiration) < new Date(),
+                onclick: () => action(() => api("POST", "/preauthkey/expire", { user: selected, key: key.key })),
+              },
+              "Expire",
+            ),
+          ),
+        ),
+      ),
+    ),
+  );
+}
+
+async function routesPage() {
+  const { routes = [] } = await api("GET", "/routes");
+
+  render(
+    h("h2", {}, "Routes"),
+    h(
+      "table",
+      {},
+      h(
+        "tr",
+        {},
+        h("th", {}, "ID"),
+        h("th", {}, "Node"),
+        h("th", {}, "Prefix"),
+        h("th", {}, "Advertised"),
+        h("th", {}, "Enabled"),
+        h("th", {}, "Primary"),
+        h("th"),
+      ),
+      routes.map((route) =>
+        h(
+          "tr",
+          {},
+          h("td", {}, route.id),
+          h("td", {}, route.node ? route.node.givenName || route.node.name : ""),
+          h("td", {}, route.prefix),
+          h("td", {}, route.advertised ? "yes" : "no"),
+          h("td", {}, route.enabled ? "yes" : "no"),
+          h("td", {}, route.isPrimary ? "yes" : "no"),
+          h(
+            "td",
+            {},
+            h(
+              "button",
+              {
+                onclick: () =>
+                  action(() => api("POST", `/routes/${route.id}/${route.enabled ? "disable" : "enable"}`)),
+              },
+              route.enabled ? "Disable" : "Approve",
+            ),
+          ),
+        ),
+      ),
+    ),
+  );
+}
+
+const pages = {
+  "/users": usersPage,
+  "/nodes": nodesPage,
+  "/preauthkeys": preAuthKeysPage,
+  "/routes": routesPage,
+};
+
+async function route() {
+  const loggedIn = Boolean(localStorage.getItem(apiKeyStorage));
+  logout.hidden = !loggedIn;
+  if (!loggedIn) {
+    loginPage();
+    return;
+  }
+
+  const path = location.hash.slice(1).split("?")[0] || "/users";
+  for (const link of document.querySelectorAll("header nav a")) {
+    link.classList.toggle("active", link.getAttribute("href") === "#" + path);
+  }
+
+  const page = pages[path] || usersPage;
+  try {
+    await page();
+  } catch (err) {
+    render(h("p", { class: "error" }, err.message));
+  }
+}
+
+logout.addEventListener("click", () => {
+  localStorage.removeItem(apiKeyStorage);
+  route();
+});
+
+window.addEventListener("hashchange", route);
+route();
@@ -0,0 +1,29 @@
+// Package ui contains the headscale admin web interface.
+//
+// The interface is a single page application that is embedded in the
+// headscale binary and served under /admin. It does not have any access
+// to headscale internals and talks exclusively to the REST API, using an
+// API key provided by the user for authentication.
+package ui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler returns a http.Handler serving the admin interface, the prefix
+// it is mounted on is stripped from the request path.
+func Handler(prefix string) http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		// The directory is embedded at build time, this can only
+		// fail if the embed directive above is wrong.
+		panic(err)
+	}
+
+	return http.StripPrefix(prefix, http.FileServer(http.FS(files)))
+}